@@ -0,0 +1,201 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	stderrors "errors"
+	"net"
+	"net/http"
+	"time"
+)
+
+const (
+	// adaptiveConcurrencyEnvVar enables adapting the concurrency budget of
+	// the plugin's GCP API requests to their latency and error rate.
+	adaptiveConcurrencyEnvVar = "VELERO_GCP_PLUGIN_ADAPTIVE_CONCURRENCY"
+
+	// defaultAdaptiveMaxConcurrency is the most weight in flight the
+	// concurrency budget grows to if VELERO_GCP_PLUGIN_MAX_CONCURRENT_REQUESTS
+	// isn't set.
+	defaultAdaptiveMaxConcurrency = 64
+	// adaptiveMinConcurrency is the least weight in flight the budget
+	// shrinks to, enough for an upload or download.
+	adaptiveMinConcurrency = 4
+
+	// adaptiveLatencyFactor is how many times slower than usual for its
+	// type of operation a response has to be to count as congestion.
+	adaptiveLatencyFactor = 3
+	// adaptiveWarmupSamples is the number of responses of a type of
+	// operation needed before their latency is judged.
+	adaptiveWarmupSamples = 10
+	// adaptiveLatencySmoothing is the weight of each response in the usual
+	// latency of its type of operation.
+	adaptiveLatencySmoothing = 0.1
+	// adaptiveDecreaseInterval is the least time between two decreases, so
+	// a burst of errors from requests made at the same limit only halves
+	// it once.
+	adaptiveDecreaseInterval = 2 * time.Second
+
+	requestBudgetLimitGauge = "velero_gcp_request_budget_limit"
+)
+
+// concurrencyController adapts the concurrency limit of the request budget
+// by additive increase and multiplicative decrease: each time as many
+// requests as the limit succeed without congestion, the limit grows by one,
+// and a throttled, failed or unusually slow response halves it. The limit
+// settles just below where GCP or the network starts pushing back, without
+// tuning it to the cluster's size. Uploads and downloads take as long as
+// their data takes to transfer, so only throttling responses to them count
+// as congestion.
+type concurrencyController struct {
+	min, max int
+	// successes counts the requests that succeeded since the limit last
+	// changed.
+	successes    int
+	lastDecrease time.Time
+	// latencies is the usual latency of each type of operation, in
+	// seconds.
+	latencies map[string]*latencyAverage
+}
+
+type latencyAverage struct {
+	seconds float64
+	samples int
+}
+
+func newConcurrencyController(max int) *concurrencyController {
+	min := adaptiveMinConcurrency
+	if min > max {
+		min = max
+	}
+	return &concurrencyController{min: min, max: max, latencies: make(map[string]*latencyAverage)}
+}
+
+// initial returns the limit to start with, halfway up.
+func (c *concurrencyController) initial() int {
+	if limit := c.max / 2; limit > c.min {
+		return limit
+	}
+	return c.min
+}
+
+// observe returns the limit after a response of the given type of operation
+// arrived with the given latency, and whether it was congested.
+func (c *concurrencyController) observe(limit int, operation string, latency time.Duration, congested bool, now time.Time) int {
+	var average *latencyAverage
+	seconds := latency.Seconds()
+	if !isStreamingOperation(operation) {
+		var ok bool
+		if average, ok = c.latencies[operation]; !ok {
+			average = new(latencyAverage)
+			c.latencies[operation] = average
+		}
+		if average.samples >= adaptiveWarmupSamples && seconds > adaptiveLatencyFactor*average.seconds {
+			congested = true
+		}
+	}
+
+	if congested {
+		if now.Sub(c.lastDecrease) < adaptiveDecreaseInterval {
+			return limit
+		}
+		c.lastDecrease, c.successes = now, 0
+		if limit /= 2; limit < c.min {
+			limit = c.min
+		}
+		return limit
+	}
+
+	// only uncongested responses make up the usual latency, so it doesn't
+	// creep up while GCP is slow
+	if average != nil {
+		if average.samples == 0 {
+			average.seconds = seconds
+		} else {
+			average.seconds += adaptiveLatencySmoothing * (seconds - average.seconds)
+		}
+		average.samples++
+	}
+
+	if c.successes++; c.successes >= limit {
+		c.successes = 0
+		if limit < c.max {
+			limit++
+		}
+	}
+	return limit
+}
+
+// isCongestionResponse reports whether a response, or the lack of one,
+// shows that GCP or the network is overloaded or throttling the plugin.
+// Canceled requests and other transport errors don't.
+func isCongestionResponse(res *http.Response, err error) bool {
+	if err != nil {
+		var netErr net.Error
+		return stderrors.As(err, &netErr) && netErr.Timeout()
+	}
+	return res.StatusCode == http.StatusTooManyRequests || res.StatusCode >= http.StatusInternalServerError
+}
+
+// isStreamingOperation reports whether requests of a type of operation
+// transfer object data, so their latency grows with the size of the data.
+func isStreamingOperation(operation string) bool {
+	return operation == uploadRequest || operation == downloadRequest
+}
+
+// isThrottlingResponse reports whether a response shows that GCP is
+// throttling the plugin or overloaded, whatever the size of the request.
+func isThrottlingResponse(res *http.Response, err error) bool {
+	return err == nil && (res.StatusCode == http.StatusTooManyRequests || res.StatusCode == http.StatusServiceUnavailable)
+}
+
+// adapt makes the budget's concurrency limit adapt to responses, starting
+// halfway up.
+func (b *requestBudget) adapt(controller *concurrencyController) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.adaptive = controller
+	b.limit = controller.initial()
+	b.setLimitGauge()
+}
+
+// observe adapts the concurrency limit to a response, if enabled, letting
+// waiting requests through if it grew.
+func (b *requestBudget) observe(operation string, latency time.Duration, res *http.Response, err error) {
+	if b.adaptive == nil {
+		return
+	}
+	congested := isCongestionResponse(res, err)
+	if isStreamingOperation(operation) {
+		// a slow or timed out transfer may just be a large one
+		congested = isThrottlingResponse(res, err)
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	limit := b.adaptive.observe(b.limit, operation, latency, congested, b.now())
+	if limit == b.limit {
+		return
+	}
+	b.limit = limit
+	b.setLimitGauge()
+	b.grant()
+}
+
+func (b *requestBudget) setLimitGauge() {
+	pluginMetrics.setGauge(requestBudgetLimitGauge, "Weight of the GCP API requests allowed in flight by the adaptive concurrency budget.", nil, float64(b.limit))
+}
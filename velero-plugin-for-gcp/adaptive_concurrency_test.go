@@ -0,0 +1,212 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	logtest "github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+var _ net.Error = timeoutError{}
+
+func TestConcurrencyController(t *testing.T) {
+	c := newConcurrencyController(16)
+	assert.Equal(t, 8, c.initial())
+	now := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	// the limit grows by one each time as many requests as the limit
+	// succeed
+	limit := c.initial()
+	for i := 0; i < 8+9; i++ {
+		limit = c.observe(limit, readRequest, 100*time.Millisecond, false, now)
+	}
+	assert.Equal(t, 10, limit)
+
+	// and halves on congestion, once per burst
+	limit = c.observe(limit, readRequest, 100*time.Millisecond, true, now)
+	assert.Equal(t, 5, limit)
+	limit = c.observe(limit, readRequest, 100*time.Millisecond, true, now.Add(time.Second))
+	assert.Equal(t, 5, limit)
+
+	// unusually slow responses are congestion too, but only compared with
+	// the same type of operation
+	now = now.Add(adaptiveDecreaseInterval)
+	limit = c.observe(limit, uploadRequest, 2*time.Second, false, now)
+	assert.Equal(t, 5, limit)
+	limit = c.observe(limit, readRequest, time.Second, false, now)
+	assert.Equal(t, 4, limit, "the limit doesn't go below the minimum")
+
+	// it doesn't grow above the maximum
+	now = now.Add(adaptiveDecreaseInterval)
+	for i := 0; i < 1000; i++ {
+		limit = c.observe(limit, readRequest, 100*time.Millisecond, false, now)
+	}
+	assert.Equal(t, 16, limit)
+
+	small := newConcurrencyController(2)
+	assert.Equal(t, 2, small.min)
+	assert.Equal(t, 2, small.initial())
+}
+
+func TestConcurrencyControllerStreaming(t *testing.T) {
+	c := newConcurrencyController(16)
+	now := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	limit := c.initial()
+	for i := 0; i < adaptiveWarmupSamples; i++ {
+		limit = c.observe(limit, downloadRequest, 100*time.Millisecond, false, now)
+	}
+	assert.Equal(t, 9, limit)
+
+	// the latency of uploads and downloads grows with their size, so a large
+	// one isn't congestion
+	limit = c.observe(limit, downloadRequest, time.Minute, false, now)
+	assert.Equal(t, 9, limit)
+	limit = c.observe(limit, uploadRequest, time.Hour, false, now)
+	assert.Equal(t, 9, limit)
+	assert.NotContains(t, c.latencies, downloadRequest)
+	assert.NotContains(t, c.latencies, uploadRequest)
+}
+
+func TestAdaptiveRequestBudgetStreaming(t *testing.T) {
+	defer func(registry *metricsRegistry) { pluginMetrics = registry }(pluginMetrics)
+	pluginMetrics = newMetricsRegistry()
+
+	timeout := &url.Error{Op: "Put", Err: timeoutError{}}
+	tests := []struct {
+		name      string
+		operation string
+		res       *http.Response
+		err       error
+		congested bool
+	}{
+		{name: "upload server error", operation: uploadRequest, res: &http.Response{StatusCode: http.StatusInternalServerError}},
+		{name: "upload timeout", operation: uploadRequest, err: timeout},
+		{name: "download timeout", operation: downloadRequest, err: timeout},
+		{name: "upload throttled", operation: uploadRequest, res: &http.Response{StatusCode: http.StatusTooManyRequests}, congested: true},
+		{name: "download unavailable", operation: downloadRequest, res: &http.Response{StatusCode: http.StatusServiceUnavailable}, congested: true},
+		{name: "read server error", operation: readRequest, res: &http.Response{StatusCode: http.StatusInternalServerError}, congested: true},
+		{name: "read timeout", operation: readRequest, err: timeout, congested: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			budget := newRequestBudget(16, 0, defaultRequestWeights)
+			budget.adapt(newConcurrencyController(16))
+			budget.observe(test.operation, time.Minute, test.res, test.err)
+			if test.congested {
+				assert.Equal(t, 4, budget.limit)
+			} else {
+				assert.Equal(t, 8, budget.limit)
+			}
+		})
+	}
+}
+
+func TestIsCongestionResponse(t *testing.T) {
+	assert.True(t, isCongestionResponse(&http.Response{StatusCode: http.StatusTooManyRequests}, nil))
+	assert.True(t, isCongestionResponse(&http.Response{StatusCode: http.StatusServiceUnavailable}, nil))
+	assert.False(t, isCongestionResponse(&http.Response{StatusCode: http.StatusNotFound}, nil))
+	assert.False(t, isCongestionResponse(&http.Response{StatusCode: http.StatusOK}, nil))
+	assert.True(t, isCongestionResponse(nil, &url.Error{Op: "Get", Err: timeoutError{}}))
+	assert.False(t, isCongestionResponse(nil, context.Canceled))
+	assert.False(t, isCongestionResponse(nil, errors.New("connection refused")))
+}
+
+func TestAdaptiveRequestBudget(t *testing.T) {
+	defer func(registry *metricsRegistry) { pluginMetrics = registry }(pluginMetrics)
+	pluginMetrics = newMetricsRegistry()
+
+	budget := newRequestBudget(8, 0, defaultRequestWeights)
+	budget.adapt(newConcurrencyController(8))
+	assert.Equal(t, 4, budget.limit)
+	ctx := context.Background()
+
+	_, err := budget.acquire(ctx, budget.weight(uploadRequest))
+	require.NoError(t, err)
+
+	// a second upload waits until the limit grows
+	upload := make(chan error)
+	go func() {
+		_, err := budget.acquire(ctx, budget.weight(uploadRequest))
+		upload <- err
+	}()
+	require.Eventually(t, func() bool {
+		budget.lock.Lock()
+		defer budget.lock.Unlock()
+		return len(budget.waiters) == 1
+	}, time.Second, time.Millisecond)
+
+	ok := &http.Response{StatusCode: http.StatusOK}
+	for i := 0; i < 4+5+6+7; i++ {
+		budget.observe(readRequest, 10*time.Millisecond, ok, nil)
+	}
+	require.NoError(t, <-upload)
+	assert.Equal(t, 8, budget.limit)
+
+	values := make(map[string]float64)
+	pluginMetrics.each(func(m *metric, s *sample) {
+		values[m.name+labelString(s.labels)] = s.value
+	})
+	assert.Equal(t, 8.0, values[requestBudgetLimitGauge])
+
+	// a budget that isn't adaptive ignores responses
+	fixed := newRequestBudget(8, 0, defaultRequestWeights)
+	fixed.observe(readRequest, time.Minute, &http.Response{StatusCode: http.StatusTooManyRequests}, nil)
+	assert.Equal(t, 8, fixed.limit)
+}
+
+func TestAdaptiveRequestBudgetFromEnv(t *testing.T) {
+	defer func() {
+		os.Unsetenv(maxConcurrentRequestsEnvVar)
+		os.Unsetenv(adaptiveConcurrencyEnvVar)
+	}()
+	logger, _ := logtest.NewNullLogger()
+
+	os.Setenv(adaptiveConcurrencyEnvVar, "true")
+	budget := requestBudgetFromEnv(logger)
+	require.NotNil(t, budget)
+	require.NotNil(t, budget.adaptive)
+	assert.Equal(t, defaultAdaptiveMaxConcurrency, budget.maxConcurrent)
+	assert.Equal(t, defaultAdaptiveMaxConcurrency/2, budget.limit)
+
+	os.Setenv(maxConcurrentRequestsEnvVar, "20")
+	budget = requestBudgetFromEnv(logger)
+	require.NotNil(t, budget)
+	assert.Equal(t, 20, budget.adaptive.max)
+	assert.Equal(t, 10, budget.limit)
+
+	os.Setenv(adaptiveConcurrencyEnvVar, "sometimes")
+	budget = requestBudgetFromEnv(logger)
+	require.NotNil(t, budget)
+	assert.Nil(t, budget.adaptive)
+	assert.Equal(t, 20, budget.limit)
+}
@@ -0,0 +1,208 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// auditLogEnvVar is the environment variable enabling the audit log of
+	// mutating GCP API calls.
+	auditLogEnvVar = "VELERO_GCP_PLUGIN_AUDIT_LOG"
+
+	// auditLogField marks the entries of the audit log, so they can be
+	// selected from the rest of Velero's logs.
+	auditLogField = "gcpAudit"
+
+	// maxAuditBodySize is the most of a response body read to find the
+	// operation or error of a call.
+	maxAuditBodySize = 1 << 20
+)
+
+// readOnlyMethods are custom methods called with POST that don't change
+// anything.
+var readOnlyMethods = map[string]bool{
+	"testIamPermissions": true,
+	"getIamPolicy":       true,
+}
+
+func auditLogEnabled() bool {
+	enabled, _ := strconv.ParseBool(os.Getenv(auditLogEnvVar))
+	return enabled
+}
+
+// auditTransport logs one structured entry for each mutating request made
+// through it: the resource, project, operation and outcome, so Velero's
+// changes can be reconciled with Cloud Audit Logs.
+type auditTransport struct {
+	log     logrus.FieldLogger
+	service string
+	base    http.RoundTripper
+}
+
+func (t *auditTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !isMutatingRequest(req) {
+		return t.base.RoundTrip(req)
+	}
+
+	start := time.Now()
+	res, err := t.base.RoundTrip(req)
+	if err == nil && skipAudit(req, res) {
+		return res, err
+	}
+
+	resource, project := auditResource(req.URL)
+	fields := logrus.Fields{
+		auditLogField:     true,
+		"service":         t.service,
+		"method":          req.Method,
+		"api":             apiOperation(req.URL.EscapedPath()),
+		"resource":        resource,
+		"durationSeconds": time.Since(start).Seconds(),
+	}
+	if project != "" {
+		fields["project"] = project
+	}
+
+	switch {
+	case err != nil:
+		fields["outcome"] = "failure"
+		fields["error"] = err.Error()
+	default:
+		fields["status"] = res.StatusCode
+		result := readAuditResult(res)
+		if result.operationID != "" {
+			fields["operationId"] = result.operationID
+		}
+		if res.StatusCode/100 == 2 {
+			fields["outcome"] = "success"
+		} else {
+			fields["outcome"] = "failure"
+			fields["error"] = result.message
+			if result.message == "" {
+				fields["error"] = res.Status
+			}
+		}
+	}
+	t.log.WithFields(fields).Info("GCP API call")
+	return res, err
+}
+
+func isMutatingRequest(req *http.Request) bool {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return false
+	}
+	path := req.URL.EscapedPath()
+	method := path[strings.LastIndexAny(path, "/:")+1:]
+	return !readOnlyMethods[method]
+}
+
+// skipAudit reports whether a response is an intermediate step of a
+// resumable upload, whose outcome is logged with its last request.
+func skipAudit(req *http.Request, res *http.Response) bool {
+	if res.StatusCode == http.StatusPermanentRedirect {
+		// 308 Resume Incomplete acknowledges a chunk of the upload
+		return true
+	}
+	return req.Method == http.MethodPost && req.URL.Query().Get("uploadType") == "resumable" && res.StatusCode/100 == 2
+}
+
+// auditResource returns the name of the resource a request acts on, which
+// is its path after the API version, and the project it belongs to, if
+// any. Objects uploaded by name are appended to their bucket's path.
+func auditResource(u *url.URL) (string, string) {
+	segments := strings.Split(strings.Trim(u.EscapedPath(), "/"), "/")
+	for i, segment := range segments {
+		if apiVersionRegexp.MatchString(segment) {
+			segments = segments[i+1:]
+			break
+		}
+	}
+	for i := range segments {
+		if unescaped, err := url.PathUnescape(segments[i]); err == nil {
+			segments[i] = unescaped
+		}
+	}
+	if name := u.Query().Get("name"); name != "" {
+		segments = append(segments, name)
+	}
+
+	var project string
+	for i := 0; i+1 < len(segments); i++ {
+		if segments[i] == "projects" {
+			project = segments[i+1]
+			break
+		}
+	}
+	return strings.Join(segments, "/"), project
+}
+
+type auditResult struct {
+	operationID string
+	message     string
+}
+
+// readAuditResult returns the long-running operation started by a call,
+// whose ID Cloud Audit Logs also records, or the error message of a failed
+// call. The body is restored for the caller.
+func readAuditResult(res *http.Response) auditResult {
+	if res.Body == nil || !strings.Contains(res.Header.Get("Content-Type"), "json") {
+		return auditResult{}
+	}
+	original := res.Body
+	body, err := ioutil.ReadAll(io.LimitReader(original, maxAuditBodySize))
+	res.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(body), original), original}
+	if err != nil {
+		return auditResult{}
+	}
+
+	var parsed struct {
+		Kind  string `json:"kind"`
+		Name  string `json:"name"`
+		Error *struct {
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	if err := json.Unmarshal(body, &parsed); err != nil {
+		return auditResult{}
+	}
+
+	var result auditResult
+	if strings.HasSuffix(parsed.Kind, "#operation") || strings.Contains(parsed.Name, "/operations/") {
+		result.operationID = parsed.Name
+	}
+	if parsed.Error != nil {
+		result.message = parsed.Error.Message
+	}
+	return result
+}
@@ -0,0 +1,145 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"testing"
+
+	logtest "github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/api/compute/v1"
+	"google.golang.org/api/option"
+)
+
+func TestAuditResource(t *testing.T) {
+	tests := []struct {
+		url      string
+		resource string
+		project  string
+	}{
+		{
+			url:      "https://compute.googleapis.com/compute/v1/projects/p/zones/z/disks/d/createSnapshot",
+			resource: "projects/p/zones/z/disks/d/createSnapshot",
+			project:  "p",
+		},
+		{
+			url:      "https://storage.googleapis.com/storage/v1/b/bucket/o/backups%2Fb1%2Fb1.tar.gz",
+			resource: "b/bucket/o/backups/b1/b1.tar.gz",
+		},
+		{
+			url:      "https://storage.googleapis.com/upload/storage/v1/b/bucket/o?uploadType=multipart&name=backups%2Fb1%2Fb1-logs.gz",
+			resource: "b/bucket/o/backups/b1/b1-logs.gz",
+		},
+		{
+			url:      "https://file.googleapis.com/v1/projects/p/locations/us-central1/backups?backupId=b&alt=json",
+			resource: "projects/p/locations/us-central1/backups",
+			project:  "p",
+		},
+	}
+	for _, test := range tests {
+		u, err := url.Parse(test.url)
+		require.NoError(t, err)
+		resource, project := auditResource(u)
+		assert.Equal(t, test.resource, resource, test.url)
+		assert.Equal(t, test.project, project, test.url)
+	}
+}
+
+func TestIsMutatingRequest(t *testing.T) {
+	tests := []struct {
+		method   string
+		path     string
+		mutating bool
+	}{
+		{method: http.MethodGet, path: "/compute/v1/projects/p/global/snapshots/s"},
+		{method: http.MethodHead, path: "/storage/v1/b/bucket/o/backups%2Fb1%2Fvelero-backup.json"},
+		{method: http.MethodPost, path: "/v1/projects/p:testIamPermissions"},
+		{method: http.MethodPost, path: "/compute/v1/projects/p/zones/z/disks/d/getIamPolicy"},
+		{method: http.MethodPost, path: "/compute/v1/projects/p/zones/z/disks", mutating: true},
+		{method: http.MethodPost, path: "/compute/v1/projects/p/global/snapshots/s/setLabels", mutating: true},
+		{method: http.MethodPatch, path: "/storage/v1/b/bucket", mutating: true},
+		{method: http.MethodDelete, path: "/compute/v1/projects/p/global/snapshots/s", mutating: true},
+	}
+	for _, test := range tests {
+		req, err := http.NewRequest(test.method, "https://example.com"+test.path, nil)
+		require.NoError(t, err)
+		assert.Equal(t, test.mutating, isMutatingRequest(req), test.method+" "+test.path)
+	}
+}
+
+func TestAuditTransport(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+		switch {
+		case r.Method == http.MethodGet:
+			w.Write([]byte(`{"name":"d"}`))
+		case r.Method == http.MethodPost:
+			w.Write([]byte(`{"kind":"compute#operation","name":"operation-123","status":"RUNNING"}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"error":{"code":404,"message":"The resource 'projects/p/global/snapshots/s' was not found"}}`))
+		}
+	}))
+	defer server.Close()
+
+	os.Setenv(auditLogEnvVar, "true")
+	defer os.Unsetenv(auditLogEnvVar)
+
+	logger, hook := logtest.NewNullLogger()
+	opts, err := instrumentClientOptions(context.Background(), logger, computeService, []option.ClientOption{
+		option.WithEndpoint(server.URL + "/compute/v1/"),
+		option.WithoutAuthentication(),
+	})
+	require.NoError(t, err)
+	gce, err := compute.NewService(context.Background(), opts...)
+	require.NoError(t, err)
+
+	_, err = gce.Disks.Get("p", "z", "d").Do()
+	require.NoError(t, err)
+	op, err := gce.Disks.CreateSnapshot("p", "z", "d", &compute.Snapshot{Name: "s"}).Do()
+	require.NoError(t, err)
+	// the response is still available to the client after it was read
+	assert.Equal(t, "operation-123", op.Name)
+	_, err = gce.Snapshots.Delete("p", "s").Do()
+	require.Error(t, err)
+
+	entries := hook.AllEntries()
+	require.Len(t, entries, 2)
+
+	created := entries[0].Data
+	assert.Equal(t, true, created[auditLogField])
+	assert.Equal(t, "compute", created["service"])
+	assert.Equal(t, "POST", created["method"])
+	assert.Equal(t, "projects.zones.disks.createSnapshot", created["api"])
+	assert.Equal(t, "projects/p/zones/z/disks/d/createSnapshot", created["resource"])
+	assert.Equal(t, "p", created["project"])
+	assert.Equal(t, "operation-123", created["operationId"])
+	assert.Equal(t, http.StatusOK, created["status"])
+	assert.Equal(t, "success", created["outcome"])
+
+	deleted := entries[1].Data
+	assert.Equal(t, "projects/p/global/snapshots/s", deleted["resource"])
+	assert.Equal(t, "failure", deleted["outcome"])
+	assert.Equal(t, "The resource 'projects/p/global/snapshots/s' was not found", deleted["error"])
+	assert.NotContains(t, deleted, "operationId")
+}
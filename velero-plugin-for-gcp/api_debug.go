@@ -0,0 +1,196 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// debugHTTPEnvVar is the environment variable enabling the logging of
+	// GCP API requests and responses.
+	debugHTTPEnvVar = "VELERO_GCP_PLUGIN_DEBUG_HTTP"
+
+	// maxDebugBodySize is the most of a request or response body logged.
+	maxDebugBodySize = 64 << 10
+
+	redacted = "REDACTED"
+)
+
+var (
+	// sensitiveHeaders are the headers whose values are never logged.
+	sensitiveHeaders = map[string]bool{
+		"Authorization":                            true,
+		"Proxy-Authorization":                      true,
+		"Cookie":                                   true,
+		"Set-Cookie":                               true,
+		"X-Goog-Iam-Authorization-Token":           true,
+		"X-Goog-Encryption-Key":                    true,
+		"X-Goog-Encryption-Key-Sha256":             true,
+		"X-Goog-Copy-Source-Encryption-Key":        true,
+		"X-Goog-Copy-Source-Encryption-Key-Sha256": true,
+	}
+
+	// sensitiveParams are the query parameters whose values are never
+	// logged: the signatures and credentials of signed URLs, API keys and
+	// the IDs of resumable upload sessions, which authorize the upload.
+	sensitiveParams = map[string]bool{
+		"x-goog-signature":  true,
+		"x-goog-credential": true,
+		"signature":         true,
+		"googleaccessid":    true,
+		"access_token":      true,
+		"key":               true,
+		"upload_id":         true,
+	}
+
+	// sensitiveFieldsRegexp matches the values of JSON fields holding
+	// credentials or key material.
+	sensitiveFieldsRegexp = regexp.MustCompile(`("(?:access_token|refresh_token|id_token|accessToken|private_key|private_key_id|client_secret|signedBlob|signedJwt|rawKey|rsaEncryptedKey|sha256)"\s*:\s*)"(?:[^"\\]|\\.)*"?`)
+
+	// urlRegexp matches URLs in header values, e.g. the Location of a
+	// resumable upload session.
+	urlRegexp = regexp.MustCompile(`https?://[^\s,;"]+`)
+)
+
+func debugHTTPEnabled() bool {
+	enabled, _ := strconv.ParseBool(os.Getenv(debugHTTPEnvVar))
+	return enabled
+}
+
+// debugTransport logs the requests made through it and their responses,
+// with credentials, keys and signatures redacted. Only JSON bodies are
+// logged, so object data isn't.
+type debugTransport struct {
+	log     logrus.FieldLogger
+	service string
+	base    http.RoundTripper
+}
+
+func (t *debugTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	fields := logrus.Fields{
+		"service":        t.service,
+		"method":         req.Method,
+		"url":            redactURL(req.URL),
+		"requestHeaders": redactHeaders(req.Header),
+	}
+	if req.Body != nil && req.Body != http.NoBody {
+		var body io.ReadCloser
+		fields["requestBody"], body = debugBody(req.Header, req.Body, req.ContentLength)
+		req = req.Clone(req.Context())
+		req.Body = body
+	}
+
+	start := time.Now()
+	res, err := t.base.RoundTrip(req)
+	fields["durationSeconds"] = time.Since(start).Seconds()
+	if err != nil {
+		t.log.WithFields(fields).WithError(err).Info("GCP API request failed")
+		return res, err
+	}
+
+	fields["status"] = res.StatusCode
+	fields["responseHeaders"] = redactHeaders(res.Header)
+	if res.Body != nil {
+		fields["responseBody"], res.Body = debugBody(res.Header, res.Body, res.ContentLength)
+	}
+	t.log.WithFields(fields).Info("GCP API request")
+	return res, err
+}
+
+// debugBody returns the redacted start of a JSON body, with a body that
+// reads the whole body again, or a description of any other body, which
+// isn't read.
+func debugBody(header http.Header, body io.ReadCloser, length int64) (string, io.ReadCloser) {
+	contentType := header.Get("Content-Type")
+	if !strings.Contains(contentType, "json") {
+		if length < 0 {
+			return fmt.Sprintf("[body of type %q omitted]", contentType), body
+		}
+		return fmt.Sprintf("[%d bytes of type %q omitted]", length, contentType), body
+	}
+
+	start, _ := ioutil.ReadAll(io.LimitReader(body, maxDebugBodySize+1))
+	rest := struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(start), body), body}
+
+	truncated := len(start) > maxDebugBodySize
+	if truncated {
+		start = start[:maxDebugBodySize]
+	}
+	res := sensitiveFieldsRegexp.ReplaceAllString(string(start), `$1"`+redacted+`"`)
+	if truncated {
+		res += "...[truncated]"
+	}
+	return res, rest
+}
+
+func redactHeaders(header http.Header) map[string]string {
+	res := make(map[string]string, len(header))
+	for k, v := range header {
+		value := strings.Join(v, ", ")
+		switch {
+		case sensitiveHeaders[http.CanonicalHeaderKey(k)]:
+			value = redacted
+		default:
+			value = urlRegexp.ReplaceAllStringFunc(value, func(s string) string {
+				u, err := url.Parse(s)
+				if err != nil {
+					return s
+				}
+				return redactURL(u)
+			})
+		}
+		res[k] = value
+	}
+	return res
+}
+
+// redactURL returns a URL with the values of sensitive query parameters
+// and any user info redacted.
+func redactURL(u *url.URL) string {
+	redactedURL := *u
+	if redactedURL.User != nil {
+		redactedURL.User = url.User(redacted)
+	}
+	query := redactedURL.Query()
+	changed := false
+	for k := range query {
+		if sensitiveParams[strings.ToLower(k)] {
+			query.Set(k, redacted)
+			changed = true
+		}
+	}
+	if changed {
+		redactedURL.RawQuery = query.Encode()
+	}
+	return redactedURL.String()
+}
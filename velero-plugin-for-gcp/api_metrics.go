@@ -0,0 +1,233 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/api/option"
+	"google.golang.org/api/option/internaloption"
+	htransport "google.golang.org/api/transport/http"
+)
+
+const (
+	apiRequestsCounter        = "velero_gcp_api_requests_total"
+	apiRequestDuration        = "velero_gcp_api_request_duration_seconds"
+	apiTransientErrorsCounter = "velero_gcp_api_transient_errors_total"
+	apiThrottledCounter       = "velero_gcp_api_throttled_total"
+	tokenRetriesCounter       = "velero_gcp_token_retries_total"
+	snapshotThrottleCounter   = "velero_gcp_snapshot_throttle_waits_total"
+
+	computeService         = "compute"
+	storageService         = "storage"
+	filestoreService       = "file"
+	sqlAdminService        = "sqladmin"
+	resourceManagerService = "cloudresourcemanager"
+	pubsubService          = "pubsub"
+	cloudAssetService      = "cloudasset"
+	backupDRService        = "backupdr"
+)
+
+// apiEndpoints are the default and mTLS endpoints of the instrumented APIs,
+// which the client libraries set themselves when they create their own
+// HTTP clients.
+var apiEndpoints = map[string][2]string{
+	computeService:         {"https://compute.googleapis.com/compute/v1/", "https://compute.mtls.googleapis.com/compute/v1/"},
+	storageService:         {"https://storage.googleapis.com/storage/v1/", "https://storage.mtls.googleapis.com/storage/v1/"},
+	filestoreService:       {"https://file.googleapis.com/", "https://file.mtls.googleapis.com/"},
+	sqlAdminService:        {"https://sqladmin.googleapis.com/", "https://sqladmin.mtls.googleapis.com/"},
+	resourceManagerService: {"https://cloudresourcemanager.googleapis.com/", "https://cloudresourcemanager.mtls.googleapis.com/"},
+	pubsubService:          {"https://pubsub.googleapis.com/", "https://pubsub.mtls.googleapis.com/"},
+	cloudAssetService:      {"https://cloudasset.googleapis.com/", "https://cloudasset.mtls.googleapis.com/"},
+	backupDRService:        {"https://backupdr.googleapis.com/", "https://backupdr.mtls.googleapis.com/"},
+}
+
+// apiDurationBuckets are the upper bounds, in seconds, of the buckets of
+// the request duration histogram.
+var apiDurationBuckets = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+
+// apiVersionRegexp matches the version segment of API paths, which the
+// resource path follows.
+var apiVersionRegexp = regexp.MustCompile(`^v[0-9]+((alpha|beta)[0-9]*)?$`)
+
+// instrumentClientOptions returns client options making an API client's
+// requests through the connection pool shared by all clients, and through
+// transports recording metrics of them, when the plugin serves or writes
+// metrics, logging the mutating ones, when the audit log is enabled, logging
+// all of them, when HTTP debugging is enabled, warning when they are
+// throttled, unless throttling warnings are disabled, within the process's
+// request budget, if one is configured, and through the API's circuit
+// breaker, unless it's disabled. The client's transport
+// is created the same way the client library does, so authentication, mTLS
+// and endpoint selection are kept.
+func instrumentClientOptions(ctx context.Context, log logrus.FieldLogger, service string, opts []option.ClientOption) ([]option.ClientOption, error) {
+	metrics, audit, debug := os.Getenv(metricsAddressEnvVar) != "" || cloudMonitoringEnabled(), auditLogEnabled(), debugHTTPEnabled()
+	warn, breaker := throttleWarningsEnabled(), circuitBreakerEnabled()
+	endpoints := apiEndpoints[service]
+	all := append(append([]option.ClientOption{}, opts...),
+		internaloption.WithDefaultEndpoint(endpoints[0]),
+		internaloption.WithDefaultMTLSEndpoint(endpoints[1]),
+	)
+	client, endpoint, err := htransport.NewClient(ctx, all...)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error creating %s API client", service)
+	}
+	transport := client.Transport
+	// clients authenticating with a client certificate need a connection
+	// pool of their own, as do clients given an HTTP client
+	if !strings.Contains(endpoint, ".mtls.") {
+		if pooled, err := htransport.NewTransport(ctx, sharedBaseTransport(), all...); err == nil {
+			transport = pooled
+		}
+	}
+	if location := locationKeyFrom(ctx); location != "" {
+		transport = &evictingTransport{location: location, base: transport}
+	}
+	if debug {
+		transport = &debugTransport{log: log, service: service, base: transport}
+	}
+	if metrics {
+		transport = &metricsTransport{service: service, base: transport}
+	}
+	if warn {
+		transport = newThrottleWarningTransport(log, service, transport)
+	}
+	if budget := sharedRequestBudget(log); budget != nil {
+		transport = &requestBudgetTransport{budget: budget, service: service, base: transport}
+	}
+	if breaker {
+		transport = &circuitBreakerTransport{log: log, service: service, base: transport}
+	}
+	if audit {
+		transport = &auditTransport{log: log, service: service, base: transport}
+	}
+	instrumented := &http.Client{Transport: transport}
+	return []option.ClientOption{option.WithHTTPClient(instrumented), option.WithEndpoint(endpoint)}, nil
+}
+
+// metricsTransport records the count, latency, status codes, transient
+// errors and throttling of the requests made through it.
+type metricsTransport struct {
+	service string
+	base    http.RoundTripper
+}
+
+func (t *metricsTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	res, err := t.base.RoundTrip(req)
+	elapsed := time.Since(start).Seconds()
+
+	operation := apiOperation(req.URL.EscapedPath())
+	code := "error"
+	if err == nil {
+		code = strconv.Itoa(res.StatusCode)
+	}
+	labels := map[string]string{"service": t.service, "operation": operation, "method": req.Method}
+	pluginMetrics.observeHistogram(apiRequestDuration, "Latency of GCP API requests in seconds.", labels, apiDurationBuckets, elapsed)
+
+	labels["code"] = code
+	pluginMetrics.addCounter(apiRequestsCounter, "Number of GCP API requests by response code.", labels, 1)
+
+	failure := map[string]string{"service": t.service, "operation": operation}
+	if err != nil || isTransientStatus(res.StatusCode) {
+		pluginMetrics.addCounter(apiTransientErrorsCounter, "Number of GCP API requests that failed transiently, which client libraries retry for idempotent calls.", failure, 1)
+	}
+	if err == nil && isThrottled(res) {
+		pluginMetrics.addCounter(apiThrottledCounter, "Number of GCP API requests rejected by rate limits or quotas.", failure, 1)
+	}
+	return res, err
+}
+
+func isTransientStatus(code int) bool {
+	switch code {
+	case http.StatusTooManyRequests, http.StatusInternalServerError, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// maxThrottleBodySize is the most of a 403 response's body read for the
+// reason it was rejected, which error responses give near their start.
+const maxThrottleBodySize = 64 * 1024
+
+// isThrottled reports whether a response rejected the request for exceeding
+// a rate limit or quota. Compute Engine rejects those with a 403 and a
+// reason in the body, the start of which is read and restored for the
+// caller.
+func isThrottled(res *http.Response) bool {
+	switch res.StatusCode {
+	case http.StatusTooManyRequests:
+		return true
+	case http.StatusForbidden:
+		start, err := ioutil.ReadAll(io.LimitReader(res.Body, maxThrottleBodySize))
+		res.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(start), res.Body), res.Body}
+		if err != nil {
+			return false
+		}
+		return bytes.Contains(start, []byte("rateLimitExceeded")) || bytes.Contains(start, []byte("quotaExceeded"))
+	}
+	return false
+}
+
+// apiOperation returns the resource collections and custom method of an
+// API path, without the names of resources, e.g.
+// projects.zones.disks.createSnapshot for
+// /compute/v1/projects/p/zones/z/disks/d/createSnapshot, to keep the
+// cardinality of the metrics' labels low. Paths without a version, such as
+// those of the Cloud Storage XML API, are "xml".
+func apiOperation(path string) string {
+	segments := strings.Split(strings.Trim(path, "/"), "/")
+	start := -1
+	for i, segment := range segments {
+		if apiVersionRegexp.MatchString(segment) {
+			start = i + 1
+			break
+		}
+	}
+	if start < 0 {
+		return "xml"
+	}
+
+	var parts []string
+	for i := start; i < len(segments); i++ {
+		parts = append(parts, segments[i])
+		switch segments[i] {
+		case "global", "aggregated":
+			// collections without a resource name
+		default:
+			i++
+		}
+	}
+	if len(parts) == 0 {
+		return "root"
+	}
+	return strings.Join(parts, ".")
+}
@@ -0,0 +1,124 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/api/compute/v1"
+	"google.golang.org/api/option"
+
+	velerotest "github.com/vmware-tanzu/velero/pkg/test"
+)
+
+func TestAPIOperation(t *testing.T) {
+	tests := map[string]string{
+		"/compute/v1/projects/p/zones/us-central1-a/disks/d/createSnapshot": "projects.zones.disks.createSnapshot",
+		"/compute/v1/projects/p/global/snapshots/s":                         "projects.global.snapshots",
+		"/compute/v1/projects/p/aggregated/disks":                           "projects.aggregated.disks",
+		"/storage/v1/b/bucket/o/backups%2Fb1%2Fvelero-backup.json":          "b.o",
+		"/upload/storage/v1/b/bucket/o":                                     "b.o",
+		"/v1beta4/projects/p/instances/i/backupRuns":                        "projects.instances.backupRuns",
+		"/bucket/backups/b1/velero-backup.json":                             "xml",
+		"/storage/v1/":                                                      "root",
+	}
+	for path, expected := range tests {
+		assert.Equal(t, expected, apiOperation(path), path)
+	}
+}
+
+func TestInstrumentClientOptions(t *testing.T) {
+	defer func(registry *metricsRegistry) { pluginMetrics = registry }(pluginMetrics)
+	pluginMetrics = newMetricsRegistry()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/compute/v1/projects/p/zones/z/disks/throttled":
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(`{"error":{"code":403,"errors":[{"reason":"rateLimitExceeded"}],"message":"Rate Limit Exceeded"}}`))
+		case "/compute/v1/projects/p/zones/z/disks/unavailable":
+			w.WriteHeader(http.StatusServiceUnavailable)
+		default:
+			w.Write([]byte(`{"name":"d"}`))
+		}
+	}))
+	defer server.Close()
+	opts := []option.ClientOption{option.WithEndpoint(server.URL + "/compute/v1/"), option.WithoutAuthentication()}
+
+	// metrics are only recorded when they're served
+	os.Unsetenv(metricsAddressEnvVar)
+	os.Setenv(throttleWarningsEnvVar, "false")
+	defer os.Unsetenv(throttleWarningsEnvVar)
+	pooled, err := instrumentClientOptions(context.Background(), velerotest.NewLogger(), computeService, opts)
+	require.NoError(t, err)
+	gce, err := compute.NewService(context.Background(), pooled...)
+	require.NoError(t, err)
+	_, err = gce.Disks.Get("p", "z", "d").Do()
+	require.NoError(t, err)
+	buf := new(bytes.Buffer)
+	pluginMetrics.write(buf)
+	assert.Empty(t, buf.String())
+
+	os.Setenv(metricsAddressEnvVar, "127.0.0.1:0")
+	defer os.Unsetenv(metricsAddressEnvVar)
+	instrumented, err := instrumentClientOptions(context.Background(), velerotest.NewLogger(), computeService, opts)
+	require.NoError(t, err)
+	gce, err = compute.NewService(context.Background(), instrumented...)
+	require.NoError(t, err)
+
+	_, err = gce.Disks.Get("p", "z", "d").Do()
+	require.NoError(t, err)
+	_, err = gce.Disks.Get("p", "z", "throttled").Do()
+	// the body is still available to the client library after it was read
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "Rate Limit Exceeded")
+	_, err = gce.Disks.Get("p", "z", "unavailable").Do()
+	require.Error(t, err)
+
+	buf.Reset()
+	pluginMetrics.write(buf)
+	out, _ := ioutil.ReadAll(buf)
+	assert.Contains(t, string(out), `velero_gcp_api_requests_total{code="200",method="GET",operation="projects.zones.disks",service="compute"} 1`)
+	assert.Contains(t, string(out), `velero_gcp_api_requests_total{code="403",method="GET",operation="projects.zones.disks",service="compute"} 1`)
+	assert.Contains(t, string(out), `velero_gcp_api_throttled_total{operation="projects.zones.disks",service="compute"} 1`)
+	assert.Contains(t, string(out), `velero_gcp_api_transient_errors_total{operation="projects.zones.disks",service="compute"} 1`)
+	assert.Contains(t, string(out), `velero_gcp_api_request_duration_seconds_count{method="GET",operation="projects.zones.disks",service="compute"} 3`)
+}
+
+func TestIsThrottled(t *testing.T) {
+	body := `{"error":{"code":403,"errors":[{"reason":"rateLimitExceeded"}]}}` + strings.Repeat(" ", 2*maxThrottleBodySize)
+	res := &http.Response{StatusCode: http.StatusForbidden, Body: ioutil.NopCloser(strings.NewReader(body))}
+	assert.True(t, isThrottled(res))
+	read, err := ioutil.ReadAll(res.Body)
+	require.NoError(t, err)
+	assert.Equal(t, body, string(read), "the whole body is left for the caller")
+
+	res = &http.Response{StatusCode: http.StatusForbidden, Body: ioutil.NopCloser(strings.NewReader(strings.Repeat(" ", maxThrottleBodySize) + "quotaExceeded"))}
+	assert.False(t, isThrottled(res), "only the start of the body is read")
+
+	assert.True(t, isThrottled(&http.Response{StatusCode: http.StatusTooManyRequests}))
+	assert.False(t, isThrottled(&http.Response{StatusCode: http.StatusNotFound}))
+}
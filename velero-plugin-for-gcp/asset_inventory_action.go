@@ -0,0 +1,232 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"path"
+	"regexp"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	api "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	"github.com/vmware-tanzu/velero/pkg/plugin/framework"
+	"github.com/vmware-tanzu/velero/pkg/plugin/velero"
+	"google.golang.org/api/cloudasset/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+const (
+	assetInventoryActionName = "velero.io/gcp-asset-inventory"
+
+	// assetScopeConfigKey is the key of the action's ConfigMap holding the
+	// project, folder or organization whose assets are exported.
+	assetScopeConfigKey = "scope"
+	// assetTypesConfigKey is the key of the action's ConfigMap holding the
+	// comma-separated asset types to export, all of them if it's empty.
+	assetTypesConfigKey = "assetTypes"
+	// assetContentTypeConfigKey is the key of the action's ConfigMap holding
+	// the content to export of each asset.
+	assetContentTypeConfigKey = "contentType"
+
+	defaultAssetContentType = "RESOURCE"
+)
+
+// assetScopeRegexp matches the parents Cloud Asset Inventory exports from.
+var assetScopeRegexp = regexp.MustCompile(`^(projects|folders|organizations)/[^/]+$`)
+
+// assetContentTypes are the content types Cloud Asset Inventory exports.
+var assetContentTypes = map[string]bool{
+	"RESOURCE":      true,
+	"IAM_POLICY":    true,
+	"ORG_POLICY":    true,
+	"ACCESS_POLICY": true,
+	"OS_INVENTORY":  true,
+	"RELATIONSHIP":  true,
+}
+
+// assetExporter starts exporting a scope's assets and returns the name of
+// the export's operation.
+type assetExporter func(ctx context.Context, scope string, req *cloudasset.ExportAssetsRequest) (string, error)
+
+// assetExport is what the action's ConfigMap configures to export.
+type assetExport struct {
+	scope       string
+	assetTypes  []string
+	contentType string
+}
+
+// AssetInventoryAction is a backup item action that starts a Cloud Asset
+// Inventory export of the cluster's project, or of the scope and asset
+// types set in its ConfigMap, into the backup's directory of its backup
+// storage location, so the backup comes with a snapshot of the cloud
+// resources the cluster runs on. It runs once per backup, on the first item
+// backed up, and only if its ConfigMap exists. Cloud Asset Inventory writes
+// the export itself, usually within minutes, so the backup doesn't wait for
+// it.
+type AssetInventoryAction struct {
+	log     logrus.FieldLogger
+	cluster veleroCluster
+
+	once    sync.Once
+	export  *assetExport
+	start   assetExporter
+	initErr error
+
+	lock     sync.Mutex
+	exported map[string]bool
+}
+
+func newAssetInventoryAction(logger logrus.FieldLogger) (interface{}, error) {
+	return &AssetInventoryAction{log: logger, cluster: inCluster{}, exported: make(map[string]bool)}, nil
+}
+
+func (a *AssetInventoryAction) AppliesTo() (velero.ResourceSelector, error) {
+	return velero.ResourceSelector{}, nil
+}
+
+// parseAssetExport returns the export configured by the action's
+// ConfigMap, defaulting to the resources of the given project.
+func parseAssetExport(config map[string]string, project string) (*assetExport, error) {
+	export := &assetExport{
+		scope:       config[assetScopeConfigKey],
+		assetTypes:  parseList(config[assetTypesConfigKey]),
+		contentType: config[assetContentTypeConfigKey],
+	}
+	if export.scope == "" {
+		if project == "" {
+			return nil, errors.Errorf("no project to export the assets of; set %s in the action's ConfigMap", assetScopeConfigKey)
+		}
+		export.scope = "projects/" + project
+	}
+	if !assetScopeRegexp.MatchString(export.scope) {
+		return nil, errors.Errorf("invalid %s %q, expected projects/PROJECT, folders/FOLDER or organizations/ORGANIZATION", assetScopeConfigKey, export.scope)
+	}
+	if export.contentType == "" {
+		export.contentType = defaultAssetContentType
+	}
+	if !assetContentTypes[export.contentType] {
+		return nil, errors.Errorf("invalid %s %q", assetContentTypeConfigKey, export.contentType)
+	}
+	return export, nil
+}
+
+// init reads the action's ConfigMap, which can hold the same credentials
+// settings as a VolumeSnapshotLocation, and creates the Cloud Asset client.
+// It leaves the export nil if there's no ConfigMap.
+func (a *AssetInventoryAction) init() error {
+	a.once.Do(func() {
+		if a.start != nil {
+			return
+		}
+
+		config, err := a.cluster.pluginConfig(framework.PluginKindBackupItemAction, assetInventoryActionName)
+		if err != nil || config == nil {
+			a.initErr = err
+			return
+		}
+		opts, project, config, err := newActionClientOptions(a.cluster, framework.PluginKindBackupItemAction, assetInventoryActionName, cloudasset.CloudPlatformScope)
+		if err != nil {
+			a.initErr = err
+			return
+		}
+		export, err := parseAssetExport(config, project)
+		if err != nil {
+			a.initErr = err
+			return
+		}
+		if opts, err = instrumentClientOptions(context.Background(), a.log, cloudAssetService, opts); err != nil {
+			a.initErr = err
+			return
+		}
+		svc, err := cloudasset.NewService(context.Background(), opts...)
+		if err != nil {
+			a.initErr = errors.WithStack(err)
+			return
+		}
+		a.export = export
+		a.start = func(ctx context.Context, scope string, req *cloudasset.ExportAssetsRequest) (string, error) {
+			op, err := svc.V1.ExportAssets(scope, req).Context(ctx).Do()
+			if err != nil {
+				return "", err
+			}
+			return op.Name, nil
+		}
+	})
+	return a.initErr
+}
+
+func (a *AssetInventoryAction) Execute(item runtime.Unstructured, backup *api.Backup) (runtime.Unstructured, []velero.ResourceIdentifier, error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	key := backup.Namespace + "/" + backup.Name
+	if a.exported[key] {
+		return item, nil, nil
+	}
+	a.exported[key] = true
+
+	// the export is informational, so failures to start it don't fail the
+	// backup
+	log := a.log.WithField("backup", key)
+	operation, err := a.exportAssets(backup.Name)
+	switch {
+	case err != nil:
+		log.WithError(err).Warn("Unable to export the backup's Cloud Asset Inventory")
+	case operation != "":
+		log.WithField("operation", operation).Info("Started exporting the backup's Cloud Asset Inventory")
+	}
+	return item, nil, nil
+}
+
+// exportAssets starts the export of a backup's assets and returns the name
+// of its operation, or an empty name if exports aren't configured.
+func (a *AssetInventoryAction) exportAssets(backup string) (string, error) {
+	if err := a.init(); err != nil {
+		return "", err
+	}
+	if a.export == nil {
+		return "", nil
+	}
+
+	location, err := a.cluster.backupStorageLocation(backup)
+	if err != nil {
+		return "", err
+	}
+	if !isGCPProvider(location.Spec.Provider) || location.Spec.ObjectStorage == nil {
+		return "", errors.Errorf("backup storage location %s isn't a GCS bucket", location.Name)
+	}
+
+	req := &cloudasset.ExportAssetsRequest{
+		AssetTypes:  a.export.assetTypes,
+		ContentType: a.export.contentType,
+		OutputConfig: &cloudasset.OutputConfig{
+			GcsDestination: &cloudasset.GcsDestination{
+				Uri: "gs://" + location.Spec.ObjectStorage.Bucket + "/" + assetInventoryKey(location.Spec.ObjectStorage.Prefix, backup),
+			},
+		},
+	}
+	operation, err := a.start(context.Background(), a.export.scope, req)
+	return operation, errors.Wrapf(err, "error exporting the assets of %s", a.export.scope)
+}
+
+// assetInventoryKey returns the key of a backup's asset inventory export,
+// next to the other files of the backup.
+func assetInventoryKey(prefix, backup string) string {
+	return path.Join(prefix, "backups", backup, backup+"-gcp-assets.json")
+}
@@ -0,0 +1,114 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	api "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	"google.golang.org/api/cloudasset/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+
+	velerotest "github.com/vmware-tanzu/velero/pkg/test"
+)
+
+func TestParseAssetExport(t *testing.T) {
+	export, err := parseAssetExport(map[string]string{}, "my-project")
+	require.NoError(t, err)
+	assert.Equal(t, &assetExport{scope: "projects/my-project", contentType: "RESOURCE"}, export)
+
+	export, err = parseAssetExport(map[string]string{
+		assetScopeConfigKey:       "folders/123",
+		assetTypesConfigKey:       "container.googleapis.com/Cluster, compute.googleapis.com/Disk",
+		assetContentTypeConfigKey: "IAM_POLICY",
+	}, "")
+	require.NoError(t, err)
+	assert.Equal(t, &assetExport{
+		scope:       "folders/123",
+		assetTypes:  []string{"container.googleapis.com/Cluster", "compute.googleapis.com/Disk"},
+		contentType: "IAM_POLICY",
+	}, export)
+
+	for _, config := range []map[string]string{
+		{},
+		{assetScopeConfigKey: "my-project"},
+		{assetScopeConfigKey: "projects/p", assetContentTypeConfigKey: "EVERYTHING"},
+	} {
+		_, err := parseAssetExport(config, "")
+		assert.Error(t, err, config)
+	}
+}
+
+func TestAssetInventoryActionExecute(t *testing.T) {
+	location := &api.BackupStorageLocation{
+		ObjectMeta: metav1.ObjectMeta{Name: "default"},
+		Spec: api.BackupStorageLocationSpec{
+			Provider:    "velero.io/gcp",
+			StorageType: api.StorageType{ObjectStorage: &api.ObjectStorageLocation{Bucket: "bucket", Prefix: "cluster"}},
+		},
+	}
+
+	var requests []*cloudasset.ExportAssetsRequest
+	action := &AssetInventoryAction{
+		log:      velerotest.NewLogger(),
+		cluster:  &fakeCluster{location: location},
+		exported: make(map[string]bool),
+		export:   &assetExport{scope: "projects/p", assetTypes: []string{"container.googleapis.com/Cluster"}, contentType: "RESOURCE"},
+		start: func(ctx context.Context, scope string, req *cloudasset.ExportAssetsRequest) (string, error) {
+			assert.Equal(t, "projects/p", scope)
+			requests = append(requests, req)
+			return "projects/123/operations/ExportAssets/RESOURCE/1", nil
+		},
+	}
+
+	backup := &api.Backup{ObjectMeta: metav1.ObjectMeta{Namespace: "velero", Name: "backup-1"}}
+	item := &unstructured.Unstructured{Object: map[string]interface{}{"apiVersion": "v1", "kind": "Namespace", "metadata": map[string]interface{}{"name": "app"}}}
+	for i := 0; i < 2; i++ {
+		updated, additional, err := action.Execute(item, backup)
+		require.NoError(t, err)
+		assert.Equal(t, item, updated)
+		assert.Empty(t, additional)
+	}
+
+	// the assets are exported once per backup, next to its other files
+	require.Len(t, requests, 1)
+	assert.Equal(t, &cloudasset.ExportAssetsRequest{
+		AssetTypes:  []string{"container.googleapis.com/Cluster"},
+		ContentType: "RESOURCE",
+		OutputConfig: &cloudasset.OutputConfig{
+			GcsDestination: &cloudasset.GcsDestination{Uri: "gs://bucket/cluster/backups/backup-1/backup-1-gcp-assets.json"},
+		},
+	}, requests[0])
+
+	// failures don't fail the backup
+	action.start = func(context.Context, string, *cloudasset.ExportAssetsRequest) (string, error) {
+		return "", assert.AnError
+	}
+	_, _, err := action.Execute(item, &api.Backup{ObjectMeta: metav1.ObjectMeta{Namespace: "velero", Name: "backup-2"}})
+	require.NoError(t, err)
+}
+
+func TestAssetInventoryActionWithoutConfigMap(t *testing.T) {
+	action := &AssetInventoryAction{log: velerotest.NewLogger(), cluster: &fakeCluster{}, exported: make(map[string]bool)}
+	operation, err := action.exportAssets("backup-1")
+	require.NoError(t, err)
+	assert.Empty(t, operation)
+}
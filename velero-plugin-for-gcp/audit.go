@@ -0,0 +1,265 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+
+	"cloud.google.com/go/storage"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/pflag"
+	"google.golang.org/api/cloudkms/v1"
+	"google.golang.org/api/cloudresourcemanager/v1"
+	iam "google.golang.org/api/iam/v1"
+)
+
+// auditPermissionsCommand is the argument that runs the permissions audit
+// instead of the plugin server, e.g.
+// `kubectl -n velero exec deploy/velero -- /plugins/velero-plugin-for-gcp audit-permissions --bucket my-bucket`.
+const auditPermissionsCommand = "audit-permissions"
+
+// permissionTester returns which of the given permissions the caller has on
+// a resource, using the resource's testIamPermissions method.
+type permissionTester func(ctx context.Context, permissions []string) ([]string, error)
+
+// permissionCheck is a plugin operation and the permissions it needs on a
+// resource.
+type permissionCheck struct {
+	operation   string
+	resource    string
+	permissions []string
+	test        permissionTester
+}
+
+type permissionResult struct {
+	operation  string
+	resource   string
+	permission string
+	granted    bool
+	err        error
+}
+
+func bucketChecks(client *storage.Client, bucket string) []permissionCheck {
+	test := func(ctx context.Context, permissions []string) ([]string, error) {
+		return client.Bucket(bucket).IAM().TestPermissions(ctx, permissions)
+	}
+	resource := "gs://" + bucket
+	return []permissionCheck{
+		{operation: "Write backups", resource: resource, permissions: []string{"storage.objects.create"}, test: test},
+		{operation: "Read backups", resource: resource, permissions: []string{"storage.objects.get", "storage.objects.list"}, test: test},
+		{operation: "Delete backups", resource: resource, permissions: []string{"storage.objects.delete"}, test: test},
+		{operation: "Check bucket encryption", resource: resource, permissions: []string{"storage.buckets.get"}, test: test},
+	}
+}
+
+func projectChecks(crm *cloudresourcemanager.Service, project string) []permissionCheck {
+	test := func(ctx context.Context, permissions []string) ([]string, error) {
+		res, err := crm.Projects.TestIamPermissions(project, &cloudresourcemanager.TestIamPermissionsRequest{Permissions: permissions}).Context(ctx).Do()
+		if err != nil {
+			return nil, err
+		}
+		return res.Permissions, nil
+	}
+	resource := "projects/" + project
+	return []permissionCheck{
+		{operation: "Create snapshots", resource: resource, permissions: []string{"compute.disks.get", "compute.disks.createSnapshot", "compute.snapshots.create", "compute.snapshots.get", "compute.snapshots.setLabels"}, test: test},
+		{operation: "Delete snapshots", resource: resource, permissions: []string{"compute.snapshots.delete"}, test: test},
+		{operation: "Restore volumes", resource: resource, permissions: []string{"compute.disks.create", "compute.snapshots.useReadOnly", "compute.zones.get"}, test: test},
+	}
+}
+
+func kmsKeyChecks(kms *cloudkms.Service, key string) []permissionCheck {
+	test := func(ctx context.Context, permissions []string) ([]string, error) {
+		res, err := kms.Projects.Locations.KeyRings.CryptoKeys.TestIamPermissions(key, &cloudkms.TestIamPermissionsRequest{Permissions: permissions}).Context(ctx).Do()
+		if err != nil {
+			return nil, err
+		}
+		return res.Permissions, nil
+	}
+	return []permissionCheck{
+		{operation: "Verify KMS keys", resource: key, permissions: []string{"cloudkms.cryptoKeys.get", "cloudkms.cryptoKeyVersions.get"}, test: test},
+	}
+}
+
+func signBlobChecks(iamSvc *iam.Service, serviceAccount string) []permissionCheck {
+	resource := "projects/-/serviceAccounts/" + serviceAccount
+	test := func(ctx context.Context, permissions []string) ([]string, error) {
+		res, err := iamSvc.Projects.ServiceAccounts.TestIamPermissions(resource, &iam.TestIamPermissionsRequest{Permissions: permissions}).Context(ctx).Do()
+		if err != nil {
+			return nil, err
+		}
+		return res.Permissions, nil
+	}
+	return []permissionCheck{
+		{operation: "Create signed URLs", resource: resource, permissions: []string{"iam.serviceAccounts.signBlob"}, test: test},
+	}
+}
+
+// auditPermissions runs the checks and returns one result per operation and
+// permission, in order.
+func auditPermissions(ctx context.Context, checks []permissionCheck) []permissionResult {
+	var results []permissionResult
+	for _, check := range checks {
+		granted, err := check.test(ctx, check.permissions)
+
+		grantedSet := make(map[string]bool, len(granted))
+		for _, p := range granted {
+			grantedSet[p] = true
+		}
+		for _, p := range check.permissions {
+			results = append(results, permissionResult{
+				operation:  check.operation,
+				resource:   check.resource,
+				permission: p,
+				granted:    err == nil && grantedSet[p],
+				err:        err,
+			})
+		}
+	}
+	return results
+}
+
+// writePermissionMatrix prints the results as a table and reports whether
+// every permission is granted.
+func writePermissionMatrix(w io.Writer, results []permissionResult) bool {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "OPERATION\tRESOURCE\tPERMISSION\tSTATUS")
+
+	ok := true
+	for _, r := range results {
+		status := "granted"
+		switch {
+		case r.err != nil:
+			status = "error: " + r.err.Error()
+			if classifyError(r.err) == perimeterError {
+				status += " (" + perimeterAdvice(r.err) + ")"
+			}
+			ok = false
+		case !r.granted:
+			status = "MISSING"
+			ok = false
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", r.operation, r.resource, r.permission, status)
+	}
+	tw.Flush()
+	return ok
+}
+
+// runPermissionsAudit checks the permissions the plugin's identity has for
+// the given locations and prints a matrix of granted and missing
+// permissions. It returns the process exit code.
+func runPermissionsAudit(args []string, out io.Writer) int {
+	flags := pflag.NewFlagSet(auditPermissionsCommand, pflag.ContinueOnError)
+	flags.SetOutput(out)
+	var (
+		bucket, project, kmsKey, serviceAccount string
+		config                                  map[string]string
+	)
+	flags.StringVar(&bucket, "bucket", "", "GCS bucket of the backup storage location")
+	flags.StringVar(&project, "project", "", "project snapshots are created in")
+	flags.StringVar(&kmsKey, "kms-key", "", "Cloud KMS key encrypting the bucket or disks")
+	flags.StringVar(&serviceAccount, "service-account", "", "service account signed URLs are created as")
+	flags.StringToStringVar(&config, "config", nil, "location config, e.g. credentialsFile=/credentials/cloud,impersonateServiceAccount=velero@my-project.iam.gserviceaccount.com")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	if err := auditLocation(context.Background(), out, config, bucket, project, kmsKey, serviceAccount); err != nil {
+		fmt.Fprintln(out, err)
+		return 1
+	}
+	return 0
+}
+
+func auditLocation(ctx context.Context, out io.Writer, config map[string]string, bucket, project, kmsKey, serviceAccount string) error {
+	// the object store and volume snapshotter may use separate identities
+	storageCreds, err := newLocationCredentials(platformSecrets{}, config, objectStoreCredentialsEnvVar)
+	if err != nil {
+		return err
+	}
+	computeCreds, err := newLocationCredentials(platformSecrets{}, config, volumeSnapshotterCredentialsEnvVar)
+	if err != nil {
+		return err
+	}
+	if serviceAccount == "" {
+		serviceAccount = config[serviceAccountConfig]
+	}
+
+	var checks []permissionCheck
+	if bucket != "" {
+		opts, err := storageCreds.clientOptions(ctx, parseScopes(config, storage.ScopeReadWrite)...)
+		if err != nil {
+			return err
+		}
+		// inside a service perimeter the bucket may only be reachable
+		// through the location's endpoints
+		logger := logrus.New()
+		logger.SetOutput(os.Stderr)
+		endpointOptions, err := endpointClientOptions(config, "storage/v1/", logger)
+		if err != nil {
+			return err
+		}
+		client, err := storage.NewClient(ctx, append(opts, endpointOptions...)...)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		defer client.Close()
+		checks = append(checks, bucketChecks(client, bucket)...)
+	}
+	if project != "" {
+		opts, err := computeCreds.clientOptions(ctx, cloudresourcemanager.CloudPlatformReadOnlyScope)
+		if err != nil {
+			return err
+		}
+		crm, err := cloudresourcemanager.NewService(ctx, opts...)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		checks = append(checks, projectChecks(crm, project)...)
+	}
+	if kmsKey != "" {
+		kms, err := newKMSService(ctx, storageCreds)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		checks = append(checks, kmsKeyChecks(kms, kmsKey)...)
+	}
+	if serviceAccount != "" {
+		opts, err := storageCreds.clientOptions(ctx, iam.CloudPlatformScope)
+		if err != nil {
+			return err
+		}
+		iamSvc, err := iam.NewService(ctx, opts...)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		checks = append(checks, signBlobChecks(iamSvc, serviceAccount)...)
+	}
+	if len(checks) == 0 {
+		return errors.New("nothing to audit; specify at least one of --bucket, --project, --kms-key and --service-account")
+	}
+
+	if !writePermissionMatrix(out, auditPermissions(ctx, checks)) {
+		return errors.New("some permissions are missing")
+	}
+	return nil
+}
@@ -0,0 +1,81 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/api/googleapi"
+)
+
+func TestAuditPermissions(t *testing.T) {
+	grants := func(granted ...string) permissionTester {
+		return func(ctx context.Context, permissions []string) ([]string, error) {
+			return granted, nil
+		}
+	}
+	failing := func(ctx context.Context, permissions []string) ([]string, error) {
+		return nil, errors.New("403 forbidden")
+	}
+
+	results := auditPermissions(context.Background(), []permissionCheck{
+		{operation: "Write backups", resource: "gs://bucket", permissions: []string{"storage.objects.create"}, test: grants("storage.objects.create")},
+		{operation: "Read backups", resource: "gs://bucket", permissions: []string{"storage.objects.get", "storage.objects.list"}, test: grants("storage.objects.get")},
+		{operation: "Create signed URLs", resource: "projects/-/serviceAccounts/velero", permissions: []string{"iam.serviceAccounts.signBlob"}, test: failing},
+	})
+
+	assert.Len(t, results, 4)
+	assert.True(t, results[0].granted)
+	assert.True(t, results[1].granted)
+	assert.False(t, results[2].granted)
+	assert.Equal(t, "storage.objects.list", results[2].permission)
+	assert.False(t, results[3].granted)
+	assert.Error(t, results[3].err)
+
+	var out bytes.Buffer
+	assert.False(t, writePermissionMatrix(&out, results))
+	assert.Contains(t, out.String(), "OPERATION")
+	assert.Contains(t, out.String(), "storage.objects.list")
+	assert.Contains(t, out.String(), "MISSING")
+	assert.Contains(t, out.String(), "error: 403 forbidden")
+
+	out.Reset()
+	assert.True(t, writePermissionMatrix(&out, results[:2]))
+
+	// calls blocked by VPC Service Controls are explained
+	out.Reset()
+	assert.False(t, writePermissionMatrix(&out, []permissionResult{{
+		operation:  "Write backups",
+		resource:   "gs://bucket",
+		permission: "storage.objects.create",
+		err:        &googleapi.Error{Code: http.StatusForbidden, Message: "Request is prohibited by organization's policy. vpcServiceControlsUniqueIdentifier: abc"},
+	}}))
+	assert.Contains(t, out.String(), "blocked by VPC Service Controls")
+}
+
+func TestRunPermissionsAuditRequiresResources(t *testing.T) {
+	var out bytes.Buffer
+	assert.Equal(t, 1, runPermissionsAudit(nil, &out))
+	assert.Contains(t, out.String(), "nothing to audit")
+
+	assert.Equal(t, 2, runPermissionsAudit([]string{"--unknown"}, &out))
+}
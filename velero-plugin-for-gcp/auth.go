@@ -0,0 +1,121 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	stderrors "errors"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/oauth2"
+)
+
+const (
+	tokenRetryAttempts = 3
+	tokenRetryBackoff  = time.Second
+)
+
+// authErrorHints maps fragments of token endpoint errors to how to fix them,
+// in order of precedence.
+var authErrorHints = []struct {
+	fragment string
+	hint     string
+}{
+	{
+		fragment: "invalid jwt signature",
+		hint:     "the service account key was deleted, disabled or has expired; create a new key and update the credentials",
+	},
+	{
+		fragment: "token must be a short-lived token",
+		hint:     "the token request was rejected as being outside its validity window; check that the clock of the node running Velero is synchronized",
+	},
+	{
+		fragment: "account not found",
+		hint:     "the service account no longer exists; recreate it or update the credentials",
+	},
+	{
+		fragment: "disabled",
+		hint:     "the service account is disabled; re-enable it with `gcloud iam service-accounts enable`",
+	},
+	{
+		fragment: "iam.serviceaccounts.getaccesstoken",
+		hint:     "the Kubernetes service account can't act as the Google service account; grant it roles/iam.workloadIdentityUser on the Google service account and annotate it with iam.gke.io/gcp-service-account",
+	},
+	{
+		fragment: "iam policy binding",
+		hint:     "the Kubernetes service account can't act as the Google service account; grant it roles/iam.workloadIdentityUser on the Google service account and annotate it with iam.gke.io/gcp-service-account",
+	},
+	{
+		fragment: "invalid_client",
+		hint:     "the credentials are malformed or were revoked; download them again",
+	},
+}
+
+// authTokenSource retries transient failures to get a token and explains
+// how to fix the other ones.
+type authTokenSource struct {
+	base  oauth2.TokenSource
+	sleep func(time.Duration)
+}
+
+func newAuthTokenSource(base oauth2.TokenSource) *authTokenSource {
+	return &authTokenSource{base: base, sleep: time.Sleep}
+}
+
+func (s *authTokenSource) Token() (*oauth2.Token, error) {
+	var err error
+	for attempt := 1; ; attempt++ {
+		var token *oauth2.Token
+		if token, err = s.base.Token(); err == nil {
+			return token, nil
+		}
+		if attempt == tokenRetryAttempts || !isTransientAuthError(err) {
+			break
+		}
+		pluginMetrics.addCounter(tokenRetriesCounter, "Number of retried requests for access tokens.", nil, 1)
+		s.sleep(time.Duration(attempt) * tokenRetryBackoff)
+	}
+	return nil, classifyAuthError(err)
+}
+
+// isTransientAuthError reports whether getting a token failed in a way that
+// may succeed when retried.
+func isTransientAuthError(err error) bool {
+	var retrieveErr *oauth2.RetrieveError
+	if stderrors.As(err, &retrieveErr) && retrieveErr.Response != nil {
+		code := retrieveErr.Response.StatusCode
+		return code == http.StatusTooManyRequests || code >= http.StatusInternalServerError
+	}
+
+	var netErr net.Error
+	return stderrors.As(err, &netErr) && netErr.Timeout()
+}
+
+// classifyAuthError adds a remediation hint to errors getting a token, if
+// the cause is recognized.
+func classifyAuthError(err error) error {
+	msg := strings.ToLower(err.Error())
+	for _, h := range authErrorHints {
+		if strings.Contains(msg, h.fragment) {
+			return errors.Wrapf(err, "authentication with Google Cloud failed: %s", h.hint)
+		}
+	}
+	return errors.Wrap(err, "authentication with Google Cloud failed")
+}
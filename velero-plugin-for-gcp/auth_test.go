@@ -0,0 +1,121 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/oauth2"
+)
+
+type fakeTokenSource struct {
+	errs  []error
+	calls int
+}
+
+func (s *fakeTokenSource) Token() (*oauth2.Token, error) {
+	s.calls++
+	if len(s.errs) > 0 {
+		err := s.errs[0]
+		s.errs = s.errs[1:]
+		return nil, err
+	}
+	return &oauth2.Token{AccessToken: "ya29.token"}, nil
+}
+
+func retrieveError(code int, body string) error {
+	return &oauth2.RetrieveError{
+		Response: &http.Response{StatusCode: code, Status: http.StatusText(code)},
+		Body:     []byte(body),
+	}
+}
+
+func TestAuthTokenSource(t *testing.T) {
+	tests := []struct {
+		name          string
+		errs          []error
+		expectedCalls int
+		expectedErr   string
+	}{
+		{
+			name:          "success",
+			expectedCalls: 1,
+		},
+		{
+			name:          "transient token endpoint failures are retried",
+			errs:          []error{retrieveError(http.StatusServiceUnavailable, ""), retrieveError(http.StatusTooManyRequests, "")},
+			expectedCalls: 3,
+		},
+		{
+			name: "retries are bounded",
+			errs: []error{
+				retrieveError(http.StatusInternalServerError, ""),
+				retrieveError(http.StatusInternalServerError, ""),
+				retrieveError(http.StatusInternalServerError, ""),
+				retrieveError(http.StatusInternalServerError, ""),
+			},
+			expectedCalls: tokenRetryAttempts,
+			expectedErr:   "authentication with Google Cloud failed",
+		},
+		{
+			name:          "deleted keys",
+			errs:          []error{retrieveError(http.StatusBadRequest, `{"error": "invalid_grant", "error_description": "Invalid JWT Signature."}`)},
+			expectedCalls: 1,
+			expectedErr:   "create a new key",
+		},
+		{
+			name:          "clock skew",
+			errs:          []error{retrieveError(http.StatusBadRequest, `{"error": "invalid_grant", "error_description": "Invalid JWT: Token must be a short-lived token (60 minutes) and in a reasonable timeframe. Check your iat and exp values in the JWT claim."}`)},
+			expectedCalls: 1,
+			expectedErr:   "clock",
+		},
+		{
+			name:          "disabled service account",
+			errs:          []error{retrieveError(http.StatusBadRequest, `{"error": "invalid_grant", "error_description": "Account has been disabled."}`)},
+			expectedCalls: 1,
+			expectedErr:   "gcloud iam service-accounts enable",
+		},
+		{
+			name:          "missing workload identity binding",
+			errs:          []error{retrieveError(http.StatusForbidden, "Unable to generate access token; IAM returned 403 Forbidden: Permission 'iam.serviceAccounts.getAccessToken' denied")},
+			expectedCalls: 1,
+			expectedErr:   "roles/iam.workloadIdentityUser",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			base := &fakeTokenSource{errs: test.errs}
+			ts := newAuthTokenSource(base)
+			ts.sleep = func(time.Duration) {}
+
+			token, err := ts.Token()
+			assert.Equal(t, test.expectedCalls, base.calls)
+			if test.expectedErr != "" {
+				require.Error(t, err)
+				assert.Contains(t, err.Error(), test.expectedErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, "ya29.token", token.AccessToken)
+		})
+	}
+}
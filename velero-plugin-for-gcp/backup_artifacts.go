@@ -0,0 +1,393 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/pflag"
+	api "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	"github.com/vmware-tanzu/velero/pkg/plugin/framework"
+	"github.com/vmware-tanzu/velero/pkg/plugin/velero"
+	file "google.golang.org/api/file/v1"
+	sqladmin "google.golang.org/api/sqladmin/v1beta4"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+const (
+	gcBackupArtifactsCommand = "gc-backup-artifacts"
+
+	filestoreBackupKind = "filestore-backup"
+	cloudSQLBackupKind  = "cloudsql-backup"
+
+	cloudSQLBackupDescriptionPrefix = "Velero backup "
+)
+
+// cloudSQLBackupRunRegexp matches the names of Cloud SQL backup artifacts.
+var cloudSQLBackupRunRegexp = regexp.MustCompile(`^projects/([^/]+)/instances/([^/]+)/backupRuns/([0-9]+)$`)
+
+// backupArtifact is a billed resource other than a snapshot that the plugin
+// created for a Velero backup: a Filestore backup or an on-demand Cloud SQL
+// backup.
+type backupArtifact struct {
+	kind    string
+	name    string
+	backup  string
+	created time.Time
+}
+
+// cloudSQLBackupDescription returns the description of the on-demand Cloud
+// SQL backups taken for a Velero backup, which identifies them later.
+func cloudSQLBackupDescription(backup *api.Backup) string {
+	return fmt.Sprintf("%s%s/%s", cloudSQLBackupDescriptionPrefix, backup.Namespace, backup.Name)
+}
+
+// parseCloudSQLBackupDescription returns the name of the Velero backup an
+// on-demand Cloud SQL backup was taken for, if the plugin took it.
+func parseCloudSQLBackupDescription(description string) (string, bool) {
+	if !strings.HasPrefix(description, cloudSQLBackupDescriptionPrefix) {
+		return "", false
+	}
+	parts := strings.Split(strings.TrimPrefix(description, cloudSQLBackupDescriptionPrefix), "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", false
+	}
+	return parts[1], true
+}
+
+// cloudSQLBackupName returns the name of a Cloud SQL backup artifact.
+func cloudSQLBackupName(project, instance string, id int64) string {
+	return fmt.Sprintf("projects/%s/instances/%s/backupRuns/%d", project, instance, id)
+}
+
+// listBackups returns the on-demand backups of the Cloud SQL instances in a
+// project the plugin took.
+func (s *sqlAdminBackuper) listBackups(ctx context.Context, project string) ([]backupArtifact, error) {
+	var instances []string
+	err := s.sql.Instances.List(project).Pages(ctx, func(page *sqladmin.InstancesListResponse) error {
+		for _, instance := range page.Items {
+			instances = append(instances, instance.Name)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "error listing Cloud SQL instances in project %s", project)
+	}
+
+	var artifacts []backupArtifact
+	for _, instance := range instances {
+		err := s.sql.BackupRuns.List(project, instance).Pages(ctx, func(page *sqladmin.BackupRunsListResponse) error {
+			for _, run := range page.Items {
+				backup, ok := parseCloudSQLBackupDescription(run.Description)
+				if run.Type != "ON_DEMAND" || !ok {
+					continue
+				}
+				created, _ := time.Parse(time.RFC3339, run.EnqueuedTime)
+				artifacts = append(artifacts, backupArtifact{
+					kind:    cloudSQLBackupKind,
+					name:    cloudSQLBackupName(project, instance, run.Id),
+					backup:  backup,
+					created: created,
+				})
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, errors.Wrapf(err, "error listing backups of Cloud SQL instance %s:%s", project, instance)
+		}
+	}
+	return artifacts, nil
+}
+
+// deleteBackup deletes a Cloud SQL backup by artifact name. Deleting a
+// backup that doesn't exist anymore succeeds.
+func (s *sqlAdminBackuper) deleteBackup(ctx context.Context, name string) error {
+	m := cloudSQLBackupRunRegexp.FindStringSubmatch(name)
+	if m == nil {
+		return errors.Errorf("invalid Cloud SQL backup name %q", name)
+	}
+	id, err := strconv.ParseInt(m[3], 10, 64)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	_, err = s.sql.BackupRuns.Delete(m[1], m[2], id).Context(ctx).Do()
+	if isNotFound(err) {
+		return nil
+	}
+	return errors.Wrapf(err, "error deleting Cloud SQL backup %s", name)
+}
+
+// listFilestoreBackupArtifacts returns the Filestore backups in the snapshot
+// project the plugin created, recognized by the tags in their description.
+func (b *VolumeSnapshotter) listFilestoreBackupArtifacts() ([]backupArtifact, error) {
+	svc, err := b.filestoreService()
+	if err != nil {
+		return nil, err
+	}
+
+	var artifacts []backupArtifact
+	err = svc.Projects.Locations.Backups.List(fmt.Sprintf("projects/%s/locations/-", b.snapshotProject)).Pages(context.TODO(), func(page *file.ListBackupsResponse) error {
+		for _, backup := range page.Backups {
+			var tags map[string]string
+			if err := json.Unmarshal([]byte(backup.Description), &tags); err != nil || tags[backupNameTag] == "" {
+				continue
+			}
+			created, _ := time.Parse(time.RFC3339, backup.CreateTime)
+			artifacts = append(artifacts, backupArtifact{
+				kind:    filestoreBackupKind,
+				name:    backup.Name,
+				backup:  tags[backupNameTag],
+				created: created,
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "error listing Filestore backups in project %s", b.snapshotProject)
+	}
+	return artifacts, nil
+}
+
+// orphanedBackupArtifacts returns the artifacts of backups that don't exist
+// anymore, e.g. because they expired while the plugin's delete item action
+// wasn't installed, and that are older than minAge.
+func orphanedBackupArtifacts(artifacts []backupArtifact, backups []api.Backup, minAge time.Duration, now time.Time) []backupArtifact {
+	existing := make(map[string]bool, len(backups))
+	for _, backup := range backups {
+		existing[backup.Name] = true
+	}
+
+	var orphans []backupArtifact
+	for _, a := range artifacts {
+		if !existing[a.backup] && now.Sub(a.created) >= minAge {
+			orphans = append(orphans, a)
+		}
+	}
+	sort.SliceStable(orphans, func(i, j int) bool { return orphans[i].created.Before(orphans[j].created) })
+	return orphans
+}
+
+func writeBackupArtifacts(w io.Writer, artifacts []backupArtifact) {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "KIND\tNAME\tBACKUP\tCREATED")
+	for _, a := range artifacts {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", a.kind, a.name, a.backup, a.created.Format(time.RFC3339))
+	}
+	tw.Flush()
+}
+
+// runGCBackupArtifacts prints, and with --delete deletes, the Filestore
+// backups and on-demand Cloud SQL backups of backups that don't exist
+// anymore. Run from a CronJob, it keeps these billed artifacts aligned with
+// the retention of Velero backups.
+func runGCBackupArtifacts(args []string, out io.Writer) int {
+	flags := pflag.NewFlagSet(gcBackupArtifactsCommand, pflag.ContinueOnError)
+	flags.SetOutput(out)
+	var (
+		location        snapshotCommandFlags
+		cloudSQLProject string
+		minAge          time.Duration
+		remove          bool
+	)
+	location.bind(flags)
+	flags.StringVar(&cloudSQLProject, "cloudsql-project", "", "also consider the on-demand backups of the Cloud SQL instances in this project")
+	flags.DurationVar(&minAge, "min-age", defaultOrphanMinAge, "only consider artifacts older than this")
+	flags.BoolVar(&remove, "delete", false, "delete the orphaned artifacts instead of only listing them")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	b, err := location.volumeSnapshotter()
+	if err != nil {
+		fmt.Fprintln(out, err)
+		return 1
+	}
+	artifacts, err := b.listFilestoreBackupArtifacts()
+	if err != nil {
+		fmt.Fprintln(out, err)
+		return 1
+	}
+
+	ctx := context.Background()
+	var sql *sqlAdminBackuper
+	if cloudSQLProject != "" {
+		opts, err := b.clients().credentials.clientOptions(ctx, sqladmin.SqlserviceAdminScope)
+		if err == nil {
+			opts, err = instrumentClientOptions(ctx, b.log, sqlAdminService, opts)
+		}
+		if err != nil {
+			fmt.Fprintln(out, err)
+			return 1
+		}
+		svc, err := sqladmin.NewService(ctx, opts...)
+		if err != nil {
+			fmt.Fprintln(out, err)
+			return 1
+		}
+		sql = &sqlAdminBackuper{sql: svc}
+		sqlArtifacts, err := sql.listBackups(ctx, cloudSQLProject)
+		if err != nil {
+			fmt.Fprintln(out, err)
+			return 1
+		}
+		artifacts = append(artifacts, sqlArtifacts...)
+	}
+
+	backups, err := b.cluster.backups()
+	if err != nil {
+		fmt.Fprintln(out, err)
+		return 1
+	}
+
+	orphans := orphanedBackupArtifacts(artifacts, backups, minAge, time.Now())
+	writeBackupArtifacts(out, orphans)
+	if !remove {
+		return 0
+	}
+
+	code := 0
+	for _, a := range orphans {
+		if a.kind == cloudSQLBackupKind {
+			err = sql.deleteBackup(ctx, a.name)
+		} else {
+			_, err = b.deleteFilestoreBackup(a.name, "")
+		}
+		if err != nil {
+			fmt.Fprintf(out, "error deleting %s %s: %v\n", a.kind, a.name, err)
+			code = 1
+			continue
+		}
+		fmt.Fprintf(out, "deleted %s %s\n", a.kind, a.name)
+	}
+	return code
+}
+
+// cloudSQLBackupDeleter deletes on-demand Cloud SQL backups.
+type cloudSQLBackupDeleter interface {
+	deleteBackup(ctx context.Context, name string) error
+}
+
+// CloudSQLCleanupAction is a delete item action that deletes the on-demand
+// Cloud SQL backups the Cloud SQL backup action recorded on workloads when
+// their Velero backup is deleted, including when it expires. It uses the
+// backup action's ConfigMap for its project and credentials.
+type CloudSQLCleanupAction struct {
+	log     logrus.FieldLogger
+	cluster veleroCluster
+
+	once      sync.Once
+	deleter   cloudSQLBackupDeleter
+	project   string
+	configErr error
+
+	lock    sync.Mutex
+	deleted map[string]bool
+}
+
+func newCloudSQLCleanupAction(logger logrus.FieldLogger) (interface{}, error) {
+	return &CloudSQLCleanupAction{log: logger, cluster: inCluster{}, deleted: make(map[string]bool)}, nil
+}
+
+func (a *CloudSQLCleanupAction) AppliesTo() (velero.ResourceSelector, error) {
+	return velero.ResourceSelector{}, nil
+}
+
+func (a *CloudSQLCleanupAction) init() error {
+	a.once.Do(func() {
+		if a.deleter != nil {
+			return
+		}
+		opts, project, _, err := newActionClientOptions(a.cluster, framework.PluginKindBackupItemAction, cloudSQLActionName, sqladmin.SqlserviceAdminScope)
+		if err != nil {
+			a.configErr = err
+			return
+		}
+		if opts, err = instrumentClientOptions(context.Background(), a.log, sqlAdminService, opts); err != nil {
+			a.configErr = err
+			return
+		}
+		svc, err := sqladmin.NewService(context.Background(), opts...)
+		if err != nil {
+			a.configErr = errors.WithStack(err)
+			return
+		}
+		a.deleter, a.project = &sqlAdminBackuper{sql: svc}, project
+	})
+	return a.configErr
+}
+
+func (a *CloudSQLCleanupAction) Execute(input *velero.DeleteItemActionExecuteInput) error {
+	obj := &unstructured.Unstructured{Object: input.Item.UnstructuredContent()}
+	value := obj.GetAnnotations()[cloudSQLBackupsAnnotation]
+	if value == "" {
+		return nil
+	}
+	var backups map[string]int64
+	if err := json.Unmarshal([]byte(value), &backups); err != nil {
+		return errors.Wrapf(err, "error parsing %s annotation", cloudSQLBackupsAnnotation)
+	}
+	if err := a.init(); err != nil {
+		return err
+	}
+
+	log := a.log.WithFields(logrus.Fields{"backup": input.Backup.Name, "kind": obj.GetKind(), "namespace": obj.GetNamespace(), "name": obj.GetName()})
+	var errs []string
+	for instance, id := range backups {
+		project, name, err := parseCloudSQLInstance(instance, a.project)
+		if err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		if err := a.delete(log, cloudSQLBackupName(project, name, id)); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		sort.Strings(errs)
+		return errors.Errorf("error cleaning up Cloud SQL backups: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// delete deletes a Cloud SQL backup once, since every workload using an
+// instance records the same backup.
+func (a *CloudSQLCleanupAction) delete(log logrus.FieldLogger, name string) error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if a.deleted[name] {
+		return nil
+	}
+	if err := a.deleter.deleteBackup(context.Background(), name); err != nil {
+		return err
+	}
+	a.deleted[name] = true
+	log.WithField("cloudSQLBackup", name).Info("Deleted Cloud SQL backup of deleted backup")
+	return nil
+}
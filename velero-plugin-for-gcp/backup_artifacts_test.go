@@ -0,0 +1,173 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	api "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	"github.com/vmware-tanzu/velero/pkg/plugin/velero"
+	file "google.golang.org/api/file/v1"
+	"google.golang.org/api/option"
+	sqladmin "google.golang.org/api/sqladmin/v1beta4"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+
+	velerotest "github.com/vmware-tanzu/velero/pkg/test"
+)
+
+func TestCloudSQLBackupDescription(t *testing.T) {
+	description := cloudSQLBackupDescription(&api.Backup{ObjectMeta: metav1.ObjectMeta{Namespace: "velero", Name: "nightly"}})
+	assert.Equal(t, "Velero backup velero/nightly", description)
+
+	backup, ok := parseCloudSQLBackupDescription(description)
+	assert.True(t, ok)
+	assert.Equal(t, "nightly", backup)
+
+	for _, description := range []string{"", "manual backup", "Velero backup nightly", "Velero backup velero/"} {
+		_, ok := parseCloudSQLBackupDescription(description)
+		assert.False(t, ok, description)
+	}
+}
+
+func TestOrphanedBackupArtifacts(t *testing.T) {
+	now := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	artifacts := []backupArtifact{
+		{kind: cloudSQLBackupKind, name: "projects/p/instances/orders/backupRuns/2", backup: "deleted", created: now.Add(-48 * time.Hour)},
+		{kind: filestoreBackupKind, name: "projects/p/locations/us-central1/backups/velero-1", backup: "deleted", created: now.Add(-72 * time.Hour)},
+		{kind: filestoreBackupKind, name: "projects/p/locations/us-central1/backups/velero-2", backup: "existing", created: now.Add(-72 * time.Hour)},
+		{kind: filestoreBackupKind, name: "projects/p/locations/us-central1/backups/velero-3", backup: "syncing", created: now.Add(-time.Hour)},
+	}
+	backups := []api.Backup{{ObjectMeta: metav1.ObjectMeta{Name: "existing"}}}
+
+	orphans := orphanedBackupArtifacts(artifacts, backups, 24*time.Hour, now)
+	require.Len(t, orphans, 2)
+	assert.Equal(t, "projects/p/locations/us-central1/backups/velero-1", orphans[0].name)
+	assert.Equal(t, "projects/p/instances/orders/backupRuns/2", orphans[1].name)
+}
+
+func TestListFilestoreBackupArtifacts(t *testing.T) {
+	svc := newFakeFilestoreService(t, func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/v1/projects/snapshot-project/locations/-/backups", r.URL.Path)
+		json.NewEncoder(w).Encode(&file.ListBackupsResponse{Backups: []*file.Backup{
+			{Name: "projects/snapshot-project/locations/us-central1/backups/velero-1", Description: `{"velero.io/backup":"nightly"}`, CreateTime: "2021-06-01T00:00:00Z"},
+			{Name: "projects/snapshot-project/locations/us-central1/backups/manual", Description: "taken by hand"},
+		}})
+	})
+	b := &VolumeSnapshotter{log: velerotest.NewLogger(), filestore: svc, snapshotProject: "snapshot-project"}
+
+	artifacts, err := b.listFilestoreBackupArtifacts()
+	require.NoError(t, err)
+	assert.Equal(t, []backupArtifact{{
+		kind:    filestoreBackupKind,
+		name:    "projects/snapshot-project/locations/us-central1/backups/velero-1",
+		backup:  "nightly",
+		created: time.Date(2021, 6, 1, 0, 0, 0, 0, time.UTC),
+	}}, artifacts)
+}
+
+func TestSQLAdminBackuperListAndDelete(t *testing.T) {
+	deleted := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodGet && r.URL.Path == "/sql/v1beta4/projects/db-project/instances":
+			json.NewEncoder(w).Encode(&sqladmin.InstancesListResponse{Items: []*sqladmin.DatabaseInstance{{Name: "orders"}}})
+		case r.Method == http.MethodGet && r.URL.Path == "/sql/v1beta4/projects/db-project/instances/orders/backupRuns":
+			json.NewEncoder(w).Encode(&sqladmin.BackupRunsListResponse{Items: []*sqladmin.BackupRun{
+				{Id: 1, Type: "ON_DEMAND", Description: "Velero backup velero/nightly", EnqueuedTime: "2021-06-01T00:00:00Z"},
+				{Id: 2, Type: "AUTOMATED"},
+				{Id: 3, Type: "ON_DEMAND", Description: "before upgrade"},
+			}})
+		case r.Method == http.MethodDelete && r.URL.Path == "/sql/v1beta4/projects/db-project/instances/orders/backupRuns/1":
+			deleted++
+			json.NewEncoder(w).Encode(&sqladmin.Operation{Name: "op-1", Status: "PENDING"})
+		case r.Method == http.MethodDelete && r.URL.Path == "/sql/v1beta4/projects/db-project/instances/orders/backupRuns/4":
+			http.Error(w, `{"error":{"code":404,"message":"not found"}}`, http.StatusNotFound)
+		default:
+			t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	svc, err := sqladmin.NewService(context.Background(), option.WithEndpoint(server.URL), option.WithoutAuthentication())
+	require.NoError(t, err)
+	s := &sqlAdminBackuper{sql: svc}
+
+	artifacts, err := s.listBackups(context.Background(), "db-project")
+	require.NoError(t, err)
+	assert.Equal(t, []backupArtifact{{
+		kind:    cloudSQLBackupKind,
+		name:    "projects/db-project/instances/orders/backupRuns/1",
+		backup:  "nightly",
+		created: time.Date(2021, 6, 1, 0, 0, 0, 0, time.UTC),
+	}}, artifacts)
+
+	require.NoError(t, s.deleteBackup(context.Background(), artifacts[0].name))
+	assert.Equal(t, 1, deleted)
+	// backups that are already gone count as deleted
+	require.NoError(t, s.deleteBackup(context.Background(), "projects/db-project/instances/orders/backupRuns/4"))
+	assert.Error(t, s.deleteBackup(context.Background(), "orders/1"))
+}
+
+type fakeCloudSQLBackupDeleter struct {
+	deleted []string
+}
+
+func (f *fakeCloudSQLBackupDeleter) deleteBackup(ctx context.Context, name string) error {
+	f.deleted = append(f.deleted, name)
+	return nil
+}
+
+func TestCloudSQLCleanupActionExecute(t *testing.T) {
+	deleter := new(fakeCloudSQLBackupDeleter)
+	action := &CloudSQLCleanupAction{log: velerotest.NewLogger(), deleter: deleter, project: "default-project", deleted: make(map[string]bool)}
+	backup := &api.Backup{ObjectMeta: metav1.ObjectMeta{Namespace: "velero", Name: "nightly"}}
+
+	workload := func(name, backups string) *unstructured.Unstructured {
+		obj := &unstructured.Unstructured{Object: map[string]interface{}{"apiVersion": "apps/v1", "kind": "Deployment"}}
+		obj.SetNamespace("shop")
+		obj.SetName(name)
+		if backups != "" {
+			obj.SetAnnotations(map[string]string{cloudSQLBackupsAnnotation: backups})
+		}
+		return obj
+	}
+
+	for _, item := range []*unstructured.Unstructured{
+		workload("api", `{"db-project:us-central1:orders":1700000000,"users":42}`),
+		// workloads sharing an instance record the same backup
+		workload("worker", `{"db-project:us-central1:orders":1700000000}`),
+		workload("web", ""),
+	} {
+		require.NoError(t, action.Execute(&velero.DeleteItemActionExecuteInput{Item: item, Backup: backup}))
+	}
+	assert.ElementsMatch(t, []string{
+		"projects/db-project/instances/orders/backupRuns/1700000000",
+		"projects/default-project/instances/users/backupRuns/42",
+	}, deleter.deleted)
+
+	err := action.Execute(&velero.DeleteItemActionExecuteInput{Item: workload("bad", "not json"), Backup: backup})
+	assert.Error(t, err)
+}
@@ -0,0 +1,307 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+const (
+	// backupForGKEConfigKey is the key of a VolumeSnapshotLocation's config
+	// holding what the plugin does with the volumes Backup for GKE also
+	// backs up.
+	backupForGKEConfigKey = "backupForGKE"
+	// backupForGKENamespacesConfigKey is the key of a VolumeSnapshotLocation's
+	// config holding the comma-separated namespaces Backup for GKE backup
+	// plans cover, or * for all of them.
+	backupForGKENamespacesConfigKey = "backupForGKENamespaces"
+	// backupForGKEBackupPlanConfigKey is the key of a VolumeSnapshotLocation's
+	// config holding the Backup for GKE backup plan references point to.
+	backupForGKEBackupPlanConfigKey = "backupForGKEBackupPlan"
+
+	// backupForGKEWarn snapshots volumes Backup for GKE backs up, and logs a
+	// warning once per backup and namespace.
+	backupForGKEWarn = "warn"
+	// backupForGKESkip fails the snapshots of those volumes.
+	backupForGKESkip = "skip"
+	// backupForGKEReference records a reference to the volume's Backup for
+	// GKE backups as its snapshot, without snapshotting it.
+	backupForGKEReference = "reference"
+
+	// backupForGKEGroup is the API group of the Backup for GKE agent's
+	// resources, which is served once the agent is enabled on the cluster.
+	backupForGKEGroup = "gkebackup.gke.io"
+	// backupForGKEReferencePrefix starts the snapshot IDs of references,
+	// which can't be snapshot names.
+	backupForGKEReferencePrefix = "backup-for-gke:"
+
+	// backupForGKECacheTTL is how long the cluster's Backup for GKE
+	// protections are used before they're read again.
+	backupForGKECacheTTL = 10 * time.Minute
+
+	backupForGKEVolumesCounter = "velero_gcp_backup_for_gke_volumes_total"
+)
+
+var (
+	// backupForGKEReferenceRegexp matches references, capturing the
+	// namespace and name of the volume's claim.
+	backupForGKEReferenceRegexp = regexp.MustCompile(`^backup-for-gke:([^/]+)/([^/]+)$`)
+
+	backupPlanRegexp = regexp.MustCompile(`^projects/[^/]+/locations/[^/]+/backupPlans/[^/]+$`)
+)
+
+func checkBackupForGKEMode(val string) error {
+	if val != backupForGKEWarn && val != backupForGKESkip && val != backupForGKEReference {
+		return errors.Errorf("expected %s, %s or %s", backupForGKEWarn, backupForGKESkip, backupForGKEReference)
+	}
+	return nil
+}
+
+func checkBackupPlan(val string) error {
+	if !backupPlanRegexp.MatchString(val) {
+		return errors.New("expected projects/PROJECT/locations/LOCATION/backupPlans/PLAN")
+	}
+	return nil
+}
+
+// isBackupForGKEReference reports whether a snapshot ID is a reference to a
+// volume's Backup for GKE backups rather than the name of a snapshot.
+func isBackupForGKEReference(snapshotID string) bool {
+	return backupForGKEReferenceRegexp.MatchString(snapshotID)
+}
+
+// backupForGKEProtections are the Backup for GKE protections of a cluster.
+type backupForGKEProtections struct {
+	// agent reports whether the Backup for GKE agent is enabled.
+	agent bool
+	// applications are the names of the ProtectedApplications by namespace.
+	applications map[string][]string
+}
+
+func (inCluster) backupForGKEProtections() (*backupForGKEProtections, error) {
+	client, err := newInClusterClient()
+	if err != nil {
+		return nil, err
+	}
+	version, err := client.preferredVersion(backupForGKEGroup)
+	if err != nil {
+		return nil, err
+	}
+	protections := &backupForGKEProtections{agent: version != "", applications: make(map[string][]string)}
+	if !protections.agent {
+		return protections, nil
+	}
+
+	apps, err := client.listResources(schema.GroupVersionResource{Group: backupForGKEGroup, Version: version, Resource: "protectedapplications"}, "")
+	if err != nil {
+		return nil, err
+	}
+	for _, app := range apps {
+		protections.applications[app.GetNamespace()] = append(protections.applications[app.GetNamespace()], app.GetName())
+	}
+	return protections, nil
+}
+
+// backupForGKEGuard coordinates snapshots with Backup for GKE, so clusters
+// protected by both don't pay for two backups of the same disks, or
+// snapshot them at the same time. A volume is backed up by Backup for GKE
+// when the agent is enabled on the cluster and the namespace of its claim
+// is covered by backupForGKENamespaces or has a ProtectedApplication. The
+// namespaces backup plans cover are only known to the Backup for GKE API,
+// which the plugin has no client for. A nil guard snapshots every volume.
+type backupForGKEGuard struct {
+	log        logrus.FieldLogger
+	cluster    veleroCluster
+	mode       string
+	all        bool
+	namespaces map[string]bool
+	plan       string
+	now        func() time.Time
+
+	lock        sync.Mutex
+	protections *backupForGKEProtections
+	fetched     time.Time
+	// warned records the warnings already logged, so each is logged once
+	// per process.
+	warned map[string]bool
+}
+
+// newBackupForGKEGuard returns the guard of a location, or nil if the
+// location doesn't set backupForGKE.
+func newBackupForGKEGuard(log logrus.FieldLogger, config map[string]string, cluster veleroCluster) *backupForGKEGuard {
+	mode := config[backupForGKEConfigKey]
+	if mode == "" {
+		return nil
+	}
+	g := &backupForGKEGuard{
+		log:        log,
+		cluster:    cluster,
+		mode:       mode,
+		namespaces: make(map[string]bool),
+		plan:       config[backupForGKEBackupPlanConfigKey],
+		now:        time.Now,
+		warned:     make(map[string]bool),
+	}
+	for _, ns := range parseList(config[backupForGKENamespacesConfigKey]) {
+		if ns == "*" {
+			g.all = true
+		}
+		g.namespaces[ns] = true
+	}
+	return g
+}
+
+// read returns the cluster's protections, read at most every
+// backupForGKECacheTTL.
+func (g *backupForGKEGuard) read() (*backupForGKEProtections, error) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	if g.protections != nil && g.now().Sub(g.fetched) < backupForGKECacheTTL {
+		return g.protections, nil
+	}
+	protections, err := g.cluster.backupForGKEProtections()
+	if err != nil {
+		return nil, err
+	}
+	g.protections, g.fetched = protections, g.now()
+	return protections, nil
+}
+
+// warnOnce logs a warning the first time it's given.
+func (g *backupForGKEGuard) warnOnce(log logrus.FieldLogger, msg string) {
+	g.lock.Lock()
+	warned := g.warned[msg]
+	g.warned[msg] = true
+	g.lock.Unlock()
+	if !warned {
+		log.Warn(msg)
+	}
+}
+
+// protection returns why Backup for GKE backs up a namespace, or "" if it
+// doesn't.
+func (g *backupForGKEGuard) protection(protections *backupForGKEProtections, namespace string) string {
+	if !protections.agent {
+		return ""
+	}
+	if g.all || g.namespaces[namespace] {
+		return fmt.Sprintf("namespace %s is in %s", namespace, backupForGKENamespacesConfigKey)
+	}
+	if apps := protections.applications[namespace]; len(apps) > 0 {
+		sort.Strings(apps)
+		return fmt.Sprintf("namespace %s has the Backup for GKE ProtectedApplications %s", namespace, strings.Join(apps, ", "))
+	}
+	return ""
+}
+
+// backupForGKEReference returns the reference recorded instead of the
+// snapshot of a volume Backup for GKE backs up, or an error if its snapshot
+// is skipped, or "" to snapshot it. Volumes whose protection can't be read
+// are snapshotted, with a warning.
+func (b *VolumeSnapshotter) backupForGKEReference(volumeID string, tags map[string]string) (string, error) {
+	g := b.backupForGKE
+	if g == nil {
+		return "", nil
+	}
+	log := b.log.WithFields(logrus.Fields{"backup": tags[backupNameTag], "volume": volumeID})
+
+	protections, err := g.read()
+	if err != nil {
+		log.WithError(err).Warn("Unable to read the Backup for GKE protections of the cluster; snapshotting the volume")
+		return "", nil
+	}
+	if !protections.agent {
+		g.warnOnce(b.log, fmt.Sprintf("%s is set, but the Backup for GKE agent isn't enabled on the cluster; snapshotting every volume", backupForGKEConfigKey))
+		return "", nil
+	}
+	claim, err := b.cluster.volumeClaim(tags[pvNameTag])
+	if err != nil {
+		log.WithError(err).Warn("Unable to read the claim of the volume to check its Backup for GKE protection; snapshotting the volume")
+		return "", nil
+	}
+	if claim == "" {
+		return "", nil
+	}
+	namespace := claim[:strings.Index(claim, "/")]
+	reason := g.protection(protections, namespace)
+	if reason == "" {
+		return "", nil
+	}
+
+	recordBackupForGKEVolume(g.mode)
+	switch g.mode {
+	case backupForGKESkip:
+		return "", errors.Errorf("skipped the snapshot of volume %s of backup %s because %s, and Backup for GKE backs it up; set %s to %s or %s to snapshot or reference it", volumeID, tags[backupNameTag], reason, backupForGKEConfigKey, backupForGKEWarn, backupForGKEReference)
+	case backupForGKEReference:
+		log.Infof("Referencing the Backup for GKE backups of the volume instead of snapshotting it because %s", reason)
+		return backupForGKEReferencePrefix + claim, nil
+	default:
+		g.warnOnce(log.WithField("namespace", namespace), fmt.Sprintf("Snapshotting volumes also backed up by Backup for GKE because %s; set %s to %s to reference its backups instead", reason, backupForGKEConfigKey, backupForGKEReference))
+		return "", nil
+	}
+}
+
+// backupForGKERestoreError explains that a referenced volume is restored
+// from Backup for GKE.
+func (b *VolumeSnapshotter) backupForGKERestoreError(snapshotID string) error {
+	m := backupForGKEReferenceRegexp.FindStringSubmatch(snapshotID)
+	plan := "its Backup for GKE backup plan"
+	if b.backupForGKE != nil && b.backupForGKE.plan != "" {
+		plan = "backup plan " + b.backupForGKE.plan
+	}
+	return errors.Errorf("the volume of claim %s/%s was backed up by Backup for GKE, not snapshotted; restore it from a backup of %s with a restore plan restoring volume data, then run the Velero restore, which keeps the restored claim", m[1], m[2], plan)
+}
+
+func recordBackupForGKEVolume(action string) {
+	pluginMetrics.addCounter(backupForGKEVolumesCounter, "Number of volumes also backed up by Backup for GKE, by the action taken.", map[string]string{"action": action}, 1)
+}
+
+// backupForGKEHealth describes the cluster's Backup for GKE protections for
+// the health check.
+func (g *backupForGKEGuard) health() (string, error) {
+	protections, err := g.read()
+	if err != nil {
+		return "", err
+	}
+	if !protections.agent {
+		return "agent not enabled", nil
+	}
+	var namespaces []string
+	for ns := range protections.applications {
+		namespaces = append(namespaces, ns)
+	}
+	for ns := range g.namespaces {
+		if _, ok := protections.applications[ns]; !ok {
+			namespaces = append(namespaces, ns)
+		}
+	}
+	sort.Strings(namespaces)
+	if len(namespaces) == 0 {
+		return fmt.Sprintf("agent enabled, no namespaces protected (%s)", g.mode), nil
+	}
+	return fmt.Sprintf("agent enabled, protecting %s (%s)", strings.Join(namespaces, ", "), g.mode), nil
+}
@@ -0,0 +1,138 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	velerotest "github.com/vmware-tanzu/velero/pkg/test"
+)
+
+// protectionReads counts the reads of a cluster's Backup for GKE
+// protections.
+type protectionReads struct {
+	*fakeCluster
+	reads int
+}
+
+func (c *protectionReads) backupForGKEProtections() (*backupForGKEProtections, error) {
+	c.reads++
+	return c.fakeCluster.backupForGKEProtections()
+}
+
+func TestBackupForGKEReference(t *testing.T) {
+	cluster := &protectionReads{fakeCluster: &fakeCluster{
+		protections: &backupForGKEProtections{agent: true, applications: map[string][]string{"shop": {"db"}}},
+		claims:      map[string]string{"pv-shop": "shop/data", "pv-web": "web/cache", "pv-free": "free/scratch"},
+	}}
+
+	config := map[string]string{backupForGKENamespacesConfigKey: "web"}
+	snapshotter := func(mode string) *VolumeSnapshotter {
+		config[backupForGKEConfigKey] = mode
+		return &VolumeSnapshotter{log: velerotest.NewLogger(), cluster: cluster, backupForGKE: newBackupForGKEGuard(velerotest.NewLogger(), config, cluster)}
+	}
+	tags := func(pv string) map[string]string {
+		return map[string]string{backupNameTag: "nightly", pvNameTag: pv}
+	}
+
+	b := snapshotter(backupForGKEReference)
+	reference, err := b.backupForGKEReference("disk-1", tags("pv-shop"))
+	require.NoError(t, err)
+	assert.Equal(t, "backup-for-gke:shop/data", reference)
+	assert.True(t, isBackupForGKEReference(reference))
+	reference, err = b.backupForGKEReference("disk-2", tags("pv-web"))
+	require.NoError(t, err)
+	assert.Equal(t, "backup-for-gke:web/cache", reference)
+	// volumes Backup for GKE doesn't back up are snapshotted
+	reference, err = b.backupForGKEReference("disk-3", tags("pv-free"))
+	require.NoError(t, err)
+	assert.Equal(t, "", reference)
+	reference, err = b.backupForGKEReference("disk-4", tags("pv-unbound"))
+	require.NoError(t, err)
+	assert.Equal(t, "", reference)
+	// protections are cached
+	assert.Equal(t, 1, cluster.reads)
+
+	b = snapshotter(backupForGKESkip)
+	_, err = b.backupForGKEReference("disk-1", tags("pv-shop"))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "skipped the snapshot of volume disk-1 of backup nightly because namespace shop has the Backup for GKE ProtectedApplications db")
+
+	b = snapshotter(backupForGKEWarn)
+	reference, err = b.backupForGKEReference("disk-1", tags("pv-shop"))
+	require.NoError(t, err)
+	assert.Equal(t, "", reference)
+
+	// without the agent, Backup for GKE backs nothing up
+	cluster.protections = &backupForGKEProtections{applications: map[string][]string{}}
+	b = snapshotter(backupForGKEReference)
+	reference, err = b.backupForGKEReference("disk-2", tags("pv-web"))
+	require.NoError(t, err)
+	assert.Equal(t, "", reference)
+
+	// volumes are snapshotted when their protection can't be read
+	cluster.err = errors.New("forbidden")
+	b = snapshotter(backupForGKESkip)
+	reference, err = b.backupForGKEReference("disk-1", tags("pv-shop"))
+	require.NoError(t, err)
+	assert.Equal(t, "", reference)
+
+	// locations without backupForGKE snapshot every volume
+	b = &VolumeSnapshotter{log: velerotest.NewLogger()}
+	reference, err = b.backupForGKEReference("disk-1", tags("pv-shop"))
+	require.NoError(t, err)
+	assert.Equal(t, "", reference)
+}
+
+func TestBackupForGKEReferenceRestore(t *testing.T) {
+	b := &VolumeSnapshotter{
+		log:          velerotest.NewLogger(),
+		backupForGKE: newBackupForGKEGuard(velerotest.NewLogger(), map[string]string{backupForGKEConfigKey: backupForGKEReference, backupForGKEBackupPlanConfigKey: "projects/p/locations/us-central1/backupPlans/daily"}, &fakeCluster{}),
+	}
+	_, err := b.createVolumeFromSnapshot("backup-for-gke:shop/data", "pd-ssd", "us-central1-a")
+	require.Error(t, err)
+	assert.Equal(t, "the volume of claim shop/data was backed up by Backup for GKE, not snapshotted; restore it from a backup of backup plan projects/p/locations/us-central1/backupPlans/daily with a restore plan restoring volume data, then run the Velero restore, which keeps the restored claim", err.Error())
+
+	deleted, err := b.deleteSnapshot("backup-for-gke:shop/data")
+	require.NoError(t, err)
+	assert.False(t, deleted)
+	assert.Equal(t, "backup-for-gke:shop/data", b.manifestSnapshot("backup-for-gke:shop/data"))
+	assert.False(t, isBackupForGKEReference("pvc-1-3f2a"))
+}
+
+func TestBackupForGKEHealth(t *testing.T) {
+	cluster := &fakeCluster{protections: &backupForGKEProtections{agent: true, applications: map[string][]string{"shop": {"db"}, "ml": {"trainer"}}}}
+	g := newBackupForGKEGuard(velerotest.NewLogger(), map[string]string{backupForGKEConfigKey: backupForGKEWarn, backupForGKENamespacesConfigKey: "web, shop"}, cluster)
+	note, err := g.health()
+	require.NoError(t, err)
+	assert.Equal(t, "agent enabled, protecting ml, shop, web (warn)", note)
+
+	g.fetched = time.Time{}
+	cluster.protections = &backupForGKEProtections{}
+	note, err = g.health()
+	require.NoError(t, err)
+	assert.Equal(t, "agent not enabled", note)
+
+	assert.NoError(t, checkBackupForGKEMode("reference"))
+	assert.Error(t, checkBackupForGKEMode("dedupe"))
+	assert.NoError(t, checkBackupPlan("projects/p/locations/us-central1/backupPlans/daily"))
+	assert.Error(t, checkBackupPlan("daily"))
+}
@@ -0,0 +1,493 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	uuid "github.com/gofrs/uuid"
+	"github.com/pkg/errors"
+	"google.golang.org/api/compute/v1"
+	"google.golang.org/api/googleapi"
+	htransport "google.golang.org/api/transport/http"
+)
+
+const (
+	// backupVaultPlanConfigKey is the key of a VolumeSnapshotLocation's
+	// config holding the Backup and DR backup plan, as
+	// projects/PROJECT/locations/REGION/backupPlans/PLAN, whose backup vault
+	// stores the backups of persistent disks instead of snapshots.
+	backupVaultPlanConfigKey = "backupVaultPlan"
+
+	// backupVaultRuleConfigKey is the ID of the backup plan's rule the
+	// on-demand backups are made with, which sets their retention.
+	backupVaultRuleConfigKey = "backupVaultRule"
+
+	diskResourceType = "compute.googleapis.com/Disk"
+
+	// vaultBackupSucceeded is the state of a backup in a vault that was
+	// made successfully.
+	vaultBackupSucceeded = "SUCCEEDED"
+)
+
+var (
+	// backupVaultTimeout bounds waiting for a disk's backup plan
+	// association to be created, for a triggered backup to be done and
+	// listed in the vault, and for a disk to be restored, and backupVaultPollInterval
+	// is how often they're checked. They are variables so tests can
+	// shorten them.
+	backupVaultTimeout      = 30 * time.Minute
+	backupVaultPollInterval = 5 * time.Second
+
+	backupVaultPlanRegexp = regexp.MustCompile(`^projects/[^/]+/locations/([^/]+)/backupPlans/[^/]+$`)
+
+	// backupVaultBackupRegexp matches the resource names of backups in
+	// backup vaults, which are used as the snapshot IDs of disks backed up
+	// to a vault.
+	backupVaultBackupRegexp = regexp.MustCompile(`^projects/[^/]+/locations/[^/]+/backupVaults/[^/]+/dataSources/[^/]+/backups/[^/]+$`)
+
+	backupPlanRuleRegexp = regexp.MustCompile(`^[a-z][a-z0-9-]{0,62}$`)
+)
+
+func checkBackupVaultPlan(val string) error {
+	if !backupVaultPlanRegexp.MatchString(val) {
+		return errors.Errorf("invalid backup plan %q, expected projects/PROJECT/locations/REGION/backupPlans/PLAN", val)
+	}
+	return nil
+}
+
+func checkBackupPlanRule(val string) error {
+	if !backupPlanRuleRegexp.MatchString(val) {
+		return errors.Errorf("invalid backup plan rule ID %q", val)
+	}
+	return nil
+}
+
+// isBackupVaultBackup reports whether a snapshot ID is the name of a backup
+// in a Backup and DR backup vault rather than of a disk snapshot.
+func isBackupVaultBackup(snapshotID string) bool {
+	return backupVaultBackupRegexp.MatchString(snapshotID)
+}
+
+// The Backup and DR API has no client in the version of google.golang.org/api
+// the plugin builds with, so its requests are made directly, through the same
+// instrumented HTTP client as the other APIs. These are the fields of its
+// resources the plugin uses.
+type backupDROperation struct {
+	Name  string `json:"name"`
+	Done  bool   `json:"done"`
+	Error *struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	} `json:"error,omitempty"`
+	// Response is the resource the operation created or updated, once it's
+	// done.
+	Response *struct {
+		Name string `json:"name"`
+	} `json:"response,omitempty"`
+}
+
+type backupPlanAssociation struct {
+	Name         string `json:"name,omitempty"`
+	Resource     string `json:"resource"`
+	ResourceType string `json:"resourceType"`
+	BackupPlan   string `json:"backupPlan"`
+	DataSource   string `json:"dataSource,omitempty"`
+}
+
+type vaultBackup struct {
+	Name                     string `json:"name"`
+	State                    string `json:"state"`
+	ResourceSizeBytes        int64  `json:"resourceSizeBytes,string,omitempty"`
+	EnforcedRetentionEndTime string `json:"enforcedRetentionEndTime,omitempty"`
+	DiskBackupProperties     *struct {
+		SizeGb int64  `json:"sizeGb,string,omitempty"`
+		Type   string `json:"type,omitempty"`
+	} `json:"diskBackupProperties,omitempty"`
+}
+
+type vaultBackupList struct {
+	Backups       []vaultBackup `json:"backups"`
+	NextPageToken string        `json:"nextPageToken"`
+}
+
+// backupDRClient returns the HTTP client of the Backup and DR API and the
+// URL its requests are relative to, creating them when first needed.
+func (b *VolumeSnapshotter) backupDRClient() (*http.Client, string, error) {
+	b.lazyClientsLock.Lock()
+	defer b.lazyClientsLock.Unlock()
+	if b.backupDRHTTP == nil {
+		ctx := context.TODO()
+		opts, err := b.clients().credentials.clientOptions(ctx, parseScopes(b.config, compute.CloudPlatformScope)...)
+		if err != nil {
+			return nil, "", err
+		}
+		endpoint, err := locationEndpoint(b.config, b.log)
+		if err != nil {
+			return nil, "", err
+		}
+		opts = append(opts, endpointOptions(endpoint, "")...)
+		if opts, err = instrumentClientOptions(ctx, b.log, backupDRService, opts); err != nil {
+			return nil, "", err
+		}
+		client, base, err := htransport.NewClient(ctx, opts...)
+		if err != nil {
+			return nil, "", errors.WithStack(err)
+		}
+		b.backupDRHTTP, b.backupDRBase = client, strings.TrimSuffix(base, "/")+"/v1/"
+	}
+	return b.backupDRHTTP, b.backupDRBase, nil
+}
+
+// backupDRRequest makes a request of the Backup and DR API to a path
+// relative to its version, encoding in as its body if it isn't nil and
+// decoding the response into out.
+func (b *VolumeSnapshotter) backupDRRequest(ctx context.Context, method, path, reason string, in, out interface{}) error {
+	client, base, err := b.backupDRClient()
+	if err != nil {
+		return err
+	}
+	var body bytes.Buffer
+	if in != nil {
+		if err := json.NewEncoder(&body).Encode(in); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	req, err := http.NewRequestWithContext(ctx, method, googleapi.ResolveRelative(base, path), &body)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if reason != "" {
+		req.Header.Set(requestReasonHeader, reason)
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer res.Body.Close()
+	if err := googleapi.CheckResponse(res); err != nil {
+		return err
+	}
+	if out == nil {
+		return nil
+	}
+	return errors.WithStack(json.NewDecoder(res.Body).Decode(out))
+}
+
+// waitForBackupDROperation polls an operation until it's done, for at most
+// backupVaultTimeout, updating op with its latest state.
+func (b *VolumeSnapshotter) waitForBackupDROperation(op *backupDROperation, what string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), backupVaultTimeout)
+	defer cancel()
+	for !op.Done {
+		select {
+		case <-ctx.Done():
+			return errors.Errorf("timed out waiting for %s", what)
+		case <-time.After(backupVaultPollInterval):
+		}
+		name := op.Name
+		*op = backupDROperation{}
+		if err := b.backupDRRequest(ctx, http.MethodGet, name, "", nil, op); err != nil {
+			if ctx.Err() != nil {
+				return errors.Errorf("timed out waiting for %s", what)
+			}
+			return errors.Wrapf(err, "error waiting for %s", what)
+		}
+	}
+	if op.Error != nil {
+		return errors.Errorf("%s failed: %s", what, op.Error.Message)
+	}
+	return nil
+}
+
+// createBackupVaultBackup backs up a disk to the vault of the location's
+// backup plan and returns the backup's resource name. Backup and DR backs up
+// disks with a backup plan association, so the disk is associated with the
+// plan first if it isn't yet, and the backup is made on demand with the
+// location's rule.
+func (b *VolumeSnapshotter) createBackupVaultBackup(volumeID, volumeAZ string, tags map[string]string) (string, error) {
+	plan := b.config[backupVaultPlanConfigKey]
+	planRegion := backupVaultPlanRegexp.FindStringSubmatch(plan)[1]
+	region, err := parseRegion(volumeAZ)
+	if err != nil {
+		return "", err
+	}
+	disk := fmt.Sprintf("projects/%s/zones/%s/disks/%s", b.volumeProject, volumeAZ, volumeID)
+	if isMultiZone(volumeAZ) {
+		disk = fmt.Sprintf("projects/%s/regions/%s/disks/%s", b.volumeProject, region, volumeID)
+	}
+	if region != planRegion {
+		return "", errors.Errorf("disk %s is in region %s, but backup plan %s is in %s; Backup and DR backs disks up with a backup plan of their region", disk, region, plan, planRegion)
+	}
+	if err := b.residency.check("backup vault backup of "+disk, planRegion); err != nil {
+		return "", err
+	}
+
+	reason := requestReason(backupOperation, tags[backupNameTag])
+	ctx := context.Background()
+	association, err := b.backupPlanAssociation(ctx, disk, plan, planRegion, reason)
+	if err != nil {
+		return "", err
+	}
+
+	// the trigger's operation ends once the backup is done, and names the
+	// backup when its response is the backup. Otherwise the new backup is
+	// the one the vault didn't list before.
+	existing, err := b.listVaultBackups(ctx, association.DataSource)
+	if err != nil {
+		return "", err
+	}
+	op := new(backupDROperation)
+	if err := b.backupDRRequest(ctx, http.MethodPost, association.Name+":triggerBackup", reason, map[string]string{"ruleId": b.config[backupVaultRuleConfigKey]}, op); err != nil {
+		return "", errors.Wrapf(err, "error backing up disk %s with backup plan %s", disk, plan)
+	}
+	trigger := op.Name
+	if err := b.waitForBackupDROperation(op, "the backup of disk "+disk+" with backup plan "+plan); err != nil {
+		return "", err
+	}
+	name, err := b.triggeredVaultBackup(ctx, op, association, existing)
+	if err != nil {
+		return "", err
+	}
+	backup, err := b.getVaultBackup(name)
+	if err != nil {
+		return "", err
+	}
+	if backup.State != vaultBackupSucceeded {
+		return "", errors.Errorf("backup %s of disk %s is %s, not %s", name, disk, backup.State, vaultBackupSucceeded)
+	}
+	if err := b.retention.checkEnforced(name, backup.EnforcedRetentionEndTime); err != nil {
+		return "", err
+	}
+	b.journal.record(name, trigger, b.snapshotProject, tags)
+	return name, nil
+}
+
+// triggeredVaultBackup returns the name of the backup a done trigger
+// operation created: the backup its response names, or else the backup of
+// the association's data source that isn't among the existing ones.
+func (b *VolumeSnapshotter) triggeredVaultBackup(ctx context.Context, op *backupDROperation, association *backupPlanAssociation, existing map[string]bool) (string, error) {
+	if op.Response != nil && isBackupVaultBackup(op.Response.Name) {
+		return op.Response.Name, nil
+	}
+	return b.waitForVaultBackup(ctx, association, existing)
+}
+
+// backupPlanAssociation returns the association of a disk with a backup plan,
+// creating it if the disk isn't associated yet. Associations created by the
+// plugin have an ID derived from the disk's name.
+func (b *VolumeSnapshotter) backupPlanAssociation(ctx context.Context, disk, plan, region, reason string) (*backupPlanAssociation, error) {
+	parent := fmt.Sprintf("projects/%s/locations/%s", b.volumeProject, region)
+	id := fmt.Sprintf("velero-%x", sha256.Sum256([]byte(disk)))[:63]
+	name := parent + "/backupPlanAssociations/" + id
+
+	association := new(backupPlanAssociation)
+	err := b.backupDRRequest(ctx, http.MethodGet, name, reason, nil, association)
+	if isNotFound(err) {
+		op := new(backupDROperation)
+		create := &backupPlanAssociation{Resource: disk, ResourceType: diskResourceType, BackupPlan: plan}
+		path := parent + "/backupPlanAssociations?backupPlanAssociationId=" + url.QueryEscape(id)
+		if err := b.backupDRRequest(ctx, http.MethodPost, path, reason, create, op); err != nil {
+			return nil, errors.Wrapf(err, "error associating disk %s with backup plan %s", disk, plan)
+		}
+		if err := b.waitForBackupDROperation(op, "the association of disk "+disk+" with backup plan "+plan); err != nil {
+			return nil, err
+		}
+		association = new(backupPlanAssociation)
+		err = b.backupDRRequest(ctx, http.MethodGet, name, reason, nil, association)
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "error getting the backup plan association of disk %s", disk)
+	}
+	if association.BackupPlan != plan {
+		return nil, errors.Errorf("disk %s is associated with backup plan %s, not %s", disk, association.BackupPlan, plan)
+	}
+	return association, nil
+}
+
+// listVaultBackups returns the names of a data source's backups.
+func (b *VolumeSnapshotter) listVaultBackups(ctx context.Context, dataSource string) (map[string]bool, error) {
+	names := make(map[string]bool)
+	if dataSource == "" {
+		return names, nil
+	}
+	token := ""
+	for {
+		path := dataSource + "/backups"
+		if token != "" {
+			path += "?pageToken=" + url.QueryEscape(token)
+		}
+		var page vaultBackupList
+		if err := b.backupDRRequest(ctx, http.MethodGet, path, "", nil, &page); err != nil {
+			return nil, errors.Wrapf(err, "error listing the backups of %s", dataSource)
+		}
+		for _, backup := range page.Backups {
+			names[backup.Name] = true
+		}
+		if token = page.NextPageToken; token == "" {
+			return names, nil
+		}
+	}
+}
+
+// waitForVaultBackup polls an association's data source until it has a
+// backup that isn't among the existing ones, for at most backupVaultTimeout.
+// The data source of a new association is only known once it's read again.
+func (b *VolumeSnapshotter) waitForVaultBackup(ctx context.Context, association *backupPlanAssociation, existing map[string]bool) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, backupVaultTimeout)
+	defer cancel()
+	for {
+		if association.DataSource == "" {
+			if err := b.backupDRRequest(ctx, http.MethodGet, association.Name, "", nil, association); err != nil && ctx.Err() == nil {
+				return "", errors.Wrapf(err, "error getting backup plan association %s", association.Name)
+			}
+		}
+		if association.DataSource != "" {
+			backups, err := b.listVaultBackups(ctx, association.DataSource)
+			if err != nil && ctx.Err() == nil {
+				return "", err
+			}
+			for name := range backups {
+				if !existing[name] {
+					return name, nil
+				}
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return "", errors.Errorf("timed out waiting for the backup of %s to be listed in its backup vault", association.Resource)
+		case <-time.After(backupVaultPollInterval):
+		}
+	}
+}
+
+// getVaultBackup reads a backup in a backup vault.
+func (b *VolumeSnapshotter) getVaultBackup(name string) (*vaultBackup, error) {
+	backup := new(vaultBackup)
+	if err := b.backupDRRequest(context.Background(), http.MethodGet, name, "", nil, backup); err != nil {
+		return nil, errors.Wrapf(err, "error getting backup %s", name)
+	}
+	return backup, nil
+}
+
+// createDiskFromVaultBackup restores a disk from a backup in a backup vault,
+// with the size of the backed up disk, waits for it to be created and
+// returns its name.
+func (b *VolumeSnapshotter) createDiskFromVaultBackup(backupName, volumeType, volumeAZ string) (string, error) {
+	for _, zone := range strings.Split(volumeAZ, zoneSeparator) {
+		if err := b.residency.check("zone of restored volume", zone); err != nil {
+			return "", err
+		}
+	}
+	backup, err := b.getVaultBackup(backupName)
+	if err != nil {
+		return "", err
+	}
+	if backup.DiskBackupProperties == nil {
+		return "", errors.Errorf("backup %s isn't the backup of a disk", backupName)
+	}
+	if volumeType == "" {
+		volumeType = backup.DiskBackupProperties.Type
+	}
+
+	uid, err := uuid.NewV4()
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	name := "restore-" + uid.String()
+	request := map[string]interface{}{
+		"diskRestoreProperties": map[string]interface{}{
+			"name":   name,
+			"sizeGb": fmt.Sprint(backup.DiskBackupProperties.SizeGb),
+			"type":   volumeType,
+			"labels": restoreArtifactLabels(nil),
+		},
+	}
+
+	// the cluster may have no nodes in some of the zones a regional disk
+	// was replicated to
+	if isMultiZone(volumeAZ) {
+		volumeAZ = b.restoreZones(volumeAZ)
+	}
+	zones := strings.Split(volumeAZ, zoneSeparator)
+	ref := diskRef{project: b.volumeProject, location: volumeAZ, name: name}
+	if isMultiZone(volumeAZ) {
+		region, err := parseRegion(volumeAZ)
+		if err != nil {
+			return "", err
+		}
+		zoneURLs, err := b.getZoneURLs(volumeAZ)
+		if err != nil {
+			return "", err
+		}
+		request["regionDiskTargetEnvironment"] = map[string]interface{}{"project": b.volumeProject, "region": region, "replicaZones": zoneURLs}
+		ref = diskRef{project: b.volumeProject, location: region, name: name, regional: true}
+	} else {
+		request["diskTargetEnvironment"] = map[string]string{"project": b.volumeProject, "zone": volumeAZ}
+	}
+
+	// the restore's operation ends once the disk is created, so the
+	// throttle doesn't need to track it
+	b.restoreThrottle.wait(zones)
+	op := new(backupDROperation)
+	if err := b.backupDRRequest(context.Background(), http.MethodPost, backupName+":restore", "", request, op); err != nil {
+		return "", errors.Wrapf(err, "error restoring backup %s", backupName)
+	}
+	if err := b.waitForBackupDROperation(op, "the restore of backup "+backupName); err != nil {
+		return "", err
+	}
+	b.bindDiskTags(ref, "")
+	return name, nil
+}
+
+// deleteVaultBackup deletes a backup in a backup vault, and reports whether
+// it was deleted. A backup whose enforced retention hasn't ended can't be
+// deleted, so it's left for the vault to delete once it has.
+func (b *VolumeSnapshotter) deleteVaultBackup(backupName string) (bool, error) {
+	backup, err := b.getVaultBackup(backupName)
+	if isNotFound(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if end, err := time.Parse(time.RFC3339Nano, backup.EnforcedRetentionEndTime); err == nil && time.Now().Before(end) {
+		b.log.Warnf("Backup %s is retained by its backup vault until %s, leaving it for the vault to delete", backupName, end.Format(time.RFC3339))
+		return false, nil
+	}
+
+	err = b.backupDRRequest(context.Background(), http.MethodDelete, backupName, "", nil, nil)
+	if isNotFound(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, errors.Wrapf(err, "error deleting backup %s", backupName)
+	}
+	return true, nil
+}
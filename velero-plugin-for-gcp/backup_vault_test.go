@@ -0,0 +1,215 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	velerotest "github.com/vmware-tanzu/velero/pkg/test"
+)
+
+const (
+	testBackupPlan   = "projects/vault-project/locations/us-central1/backupPlans/daily"
+	testDataSource   = "projects/vault-project/locations/us-central1/backupVaults/vault/dataSources/ds-1"
+	testVaultBackup1 = testDataSource + "/backups/b-1"
+	testVaultBackup2 = testDataSource + "/backups/b-2"
+)
+
+// newFakeBackupDRSnapshotter returns a snapshotter backing up disks to the
+// vault of testBackupPlan, whose Backup and DR requests are served by the
+// handler.
+func newFakeBackupDRSnapshotter(t *testing.T, handler http.HandlerFunc) *VolumeSnapshotter {
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+
+	original := backupVaultPollInterval
+	t.Cleanup(func() { backupVaultPollInterval = original })
+	backupVaultPollInterval = time.Millisecond
+
+	return &VolumeSnapshotter{
+		log:             velerotest.NewLogger(),
+		volumeProject:   "volume-project",
+		snapshotProject: "snapshot-project",
+		config:          map[string]string{backupVaultPlanConfigKey: testBackupPlan, backupVaultRuleConfigKey: "on-demand"},
+		backupDRHTTP:    server.Client(),
+		backupDRBase:    server.URL + "/v1/",
+	}
+}
+
+func TestBackupVaultIDs(t *testing.T) {
+	assert.True(t, isBackupVaultBackup(testVaultBackup1))
+	assert.False(t, isBackupVaultBackup("projects/p/locations/us-central1/backups/velero-1"))
+	assert.False(t, isBackupVaultBackup("pvc-1-snapshot"))
+
+	assert.NoError(t, checkBackupVaultPlan(testBackupPlan))
+	assert.Error(t, checkBackupVaultPlan("daily"))
+	assert.NoError(t, checkBackupPlanRule("on-demand"))
+	assert.Error(t, checkBackupPlanRule("On Demand"))
+}
+
+func TestCreateBackupVaultBackup(t *testing.T) {
+	const disk = "projects/volume-project/zones/us-central1-a/disks/pvc-1"
+	var lock sync.Mutex
+	var association *backupPlanAssociation
+	var triggered map[string]string
+	response, state := testVaultBackup2, vaultBackupSucceeded
+	b := newFakeBackupDRSnapshotter(t, func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		switch {
+		case r.Method == http.MethodGet && strings.HasPrefix(r.URL.Path, "/v1/projects/volume-project/locations/us-central1/backupPlanAssociations/velero-"):
+			if association == nil {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			json.NewEncoder(w).Encode(association)
+		case r.Method == http.MethodPost && r.URL.Path == "/v1/projects/volume-project/locations/us-central1/backupPlanAssociations":
+			assert.True(t, strings.HasPrefix(r.URL.Query().Get("backupPlanAssociationId"), "velero-"))
+			association = new(backupPlanAssociation)
+			require.NoError(t, json.NewDecoder(r.Body).Decode(association))
+			association.Name = "projects/volume-project/locations/us-central1/backupPlanAssociations/" + r.URL.Query().Get("backupPlanAssociationId")
+			association.DataSource = testDataSource
+			json.NewEncoder(w).Encode(&backupDROperation{Name: "operations/associate"})
+		case r.Method == http.MethodGet && r.URL.Path == "/v1/operations/associate":
+			json.NewEncoder(w).Encode(&backupDROperation{Name: "operations/associate", Done: true})
+		case r.Method == http.MethodGet && r.URL.Path == "/v1/"+testDataSource+"/backups":
+			backups := []vaultBackup{{Name: testVaultBackup1}}
+			if triggered != nil {
+				backups = append(backups, vaultBackup{Name: testVaultBackup2})
+			}
+			json.NewEncoder(w).Encode(&vaultBackupList{Backups: backups})
+		case r.Method == http.MethodPost && association != nil && r.URL.Path == "/v1/"+association.Name+":triggerBackup":
+			assert.Equal(t, "velero/backup/nightly", r.Header.Get(requestReasonHeader))
+			require.NoError(t, json.NewDecoder(r.Body).Decode(&triggered))
+			json.NewEncoder(w).Encode(&backupDROperation{Name: "operations/trigger"})
+		case r.Method == http.MethodGet && r.URL.Path == "/v1/operations/trigger":
+			op := &backupDROperation{Name: "operations/trigger", Done: true}
+			if response != "" {
+				op.Response = &struct {
+					Name string `json:"name"`
+				}{Name: response}
+			}
+			json.NewEncoder(w).Encode(op)
+		case r.Method == http.MethodGet && r.URL.Path == "/v1/"+testVaultBackup2:
+			json.NewEncoder(w).Encode(&vaultBackup{Name: testVaultBackup2, State: state})
+		default:
+			t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	})
+
+	name, err := b.createBackupVaultBackup("pvc-1", "us-central1-a", map[string]string{backupNameTag: "nightly"})
+	require.NoError(t, err)
+	assert.Equal(t, testVaultBackup2, name, "the trigger operation names the new backup")
+	assert.Equal(t, disk, association.Resource)
+	assert.Equal(t, diskResourceType, association.ResourceType)
+	assert.Equal(t, testBackupPlan, association.BackupPlan)
+	assert.Equal(t, map[string]string{"ruleId": "on-demand"}, triggered)
+
+	// without a backup in the operation's response, the backup that wasn't
+	// in the vault before is the new one
+	response, triggered = "", nil
+	name, err = b.createBackupVaultBackup("pvc-1", "us-central1-a", map[string]string{backupNameTag: "nightly"})
+	require.NoError(t, err)
+	assert.Equal(t, testVaultBackup2, name)
+
+	// backups that didn't succeed aren't used
+	response, state = testVaultBackup2, "FAILED"
+	_, err = b.createBackupVaultBackup("pvc-1", "us-central1-a", map[string]string{backupNameTag: "nightly"})
+	assert.EqualError(t, err, "backup "+testVaultBackup2+" of disk "+disk+" is FAILED, not SUCCEEDED")
+
+	// disks associated with another plan aren't backed up
+	association.BackupPlan = "projects/vault-project/locations/us-central1/backupPlans/weekly"
+	_, err = b.createBackupVaultBackup("pvc-1", "us-central1-a", map[string]string{backupNameTag: "nightly"})
+	assert.EqualError(t, err, "disk "+disk+" is associated with backup plan projects/vault-project/locations/us-central1/backupPlans/weekly, not "+testBackupPlan)
+
+	// nor are disks in another region than the plan
+	_, err = b.createBackupVaultBackup("pvc-2", "europe-west1-b", nil)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "is in region europe-west1, but backup plan "+testBackupPlan+" is in us-central1")
+}
+
+func TestCreateDiskFromVaultBackup(t *testing.T) {
+	var restore map[string]interface{}
+	b := newFakeBackupDRSnapshotter(t, func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodGet && r.URL.Path == "/v1/"+testVaultBackup1:
+			w.Write([]byte(`{"name": "` + testVaultBackup1 + `", "state": "SUCCEEDED", "diskBackupProperties": {"sizeGb": "10", "type": "pd-balanced"}}`))
+		case r.Method == http.MethodPost && r.URL.Path == "/v1/"+testVaultBackup1+":restore":
+			require.NoError(t, json.NewDecoder(r.Body).Decode(&restore))
+			json.NewEncoder(w).Encode(&backupDROperation{Name: "operations/restore", Done: true})
+		default:
+			t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	})
+
+	name, err := b.CreateVolumeFromSnapshot(testVaultBackup1, "", "us-central1-a", nil)
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(name, "restore-"))
+	assert.Equal(t, map[string]interface{}{"project": "volume-project", "zone": "us-central1-a"}, restore["diskTargetEnvironment"])
+	assert.Equal(t, map[string]interface{}{
+		"name":   name,
+		"sizeGb": "10",
+		"type":   "pd-balanced",
+		"labels": map[string]interface{}{restoredFromLabel: ""},
+	}, restore["diskRestoreProperties"])
+
+	details, err := b.describeSnapshot(b.manifestSnapshot(testVaultBackup1))
+	require.NoError(t, err)
+	assert.Equal(t, snapshotDetails{Status: "READY", DiskSizeGB: 10}, details)
+}
+
+func TestDeleteVaultBackup(t *testing.T) {
+	retention := time.Now().Add(time.Hour)
+	deleted := 0
+	b := newFakeBackupDRSnapshotter(t, func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodGet && r.URL.Path == "/v1/"+testVaultBackup1:
+			json.NewEncoder(w).Encode(&vaultBackup{Name: testVaultBackup1, EnforcedRetentionEndTime: retention.Format(time.RFC3339Nano)})
+		case r.Method == http.MethodDelete && r.URL.Path == "/v1/"+testVaultBackup1:
+			deleted++
+			json.NewEncoder(w).Encode(&backupDROperation{Name: "operations/delete"})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	})
+
+	// backups whose enforced retention hasn't ended are left to the vault
+	existed, err := b.deleteSnapshot(testVaultBackup1)
+	require.NoError(t, err)
+	assert.False(t, existed)
+	assert.Equal(t, 0, deleted)
+
+	retention = time.Now().Add(-time.Hour)
+	existed, err = b.deleteSnapshot(testVaultBackup1)
+	require.NoError(t, err)
+	assert.True(t, existed)
+	assert.Equal(t, 1, deleted)
+
+	existed, err = b.deleteSnapshot(testVaultBackup2)
+	require.NoError(t, err)
+	assert.False(t, existed)
+}
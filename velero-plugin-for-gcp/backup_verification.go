@@ -0,0 +1,450 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/pflag"
+	api "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	"github.com/vmware-tanzu/velero/pkg/volume"
+)
+
+const (
+	// verifyBackupsCommand verifies the backups stored in GCS backup storage
+	// locations, e.g. from a CronJob:
+	// `/plugins/velero-plugin-for-gcp verify-backups`.
+	verifyBackupsCommand = "verify-backups"
+
+	backupVerifiedGauge         = "velero_gcp_backup_verified"
+	backupVerificationTimeGauge = "velero_gcp_backup_verification_timestamp_seconds"
+
+	verificationPassed = "Passed"
+	verificationFailed = "Failed"
+)
+
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+// backupVerification is the result of verifying a backup, written next to
+// the backup's files as backups/BACKUP/BACKUP-gcp-verification.json.
+type backupVerification struct {
+	Backup     string    `json:"backup"`
+	Schedule   string    `json:"schedule,omitempty"`
+	VerifiedAt time.Time `json:"verifiedAt"`
+	Status     string    `json:"status"`
+	Objects    int       `json:"objects"`
+	// Bytes is the size of the objects whose checksums were verified.
+	Bytes     int64    `json:"bytes,omitempty"`
+	Snapshots int      `json:"snapshots"`
+	Problems  []string `json:"problems,omitempty"`
+}
+
+// verificationStore reads the objects of backups and writes their
+// verification results.
+type verificationStore interface {
+	ListObjects(bucket, prefix string) ([]string, error)
+	GetObject(bucket, key string) (io.ReadCloser, error)
+	PutObject(bucket, key string, body io.Reader) error
+	objectCRC32C(bucket, key string) (uint32, error)
+}
+
+// objectCRC32C returns the CRC32C checksum GCS computed for an object when
+// it was uploaded.
+func (o *ObjectStore) objectCRC32C(bucket, key string) (uint32, error) {
+	attrs, err := o.clients().bucketWriter.getAttrs(bucket, key)
+	if err != nil {
+		return 0, errors.WithStack(err)
+	}
+	return attrs.CRC32C, nil
+}
+
+// snapshotLookup returns the status of a snapshot taken in a
+// VolumeSnapshotLocation, and whether it still exists.
+type snapshotLookup func(location, snapshotID string) (string, bool, error)
+
+// backupVerifier verifies the backups of a backup storage location.
+type backupVerifier struct {
+	store     verificationStore
+	bucket    string
+	prefix    string
+	checksums bool
+	snapshots snapshotLookup
+	now       func() time.Time
+}
+
+func verificationKey(prefix, backup string) string {
+	return path.Join(prefix, "backups", backup, backup+"-gcp-verification.json")
+}
+
+// verify checks that a backup's metadata and contents are in the bucket,
+// that its objects match the checksums GCS recorded when they were uploaded,
+// that its manifests can be read, and that the snapshots it references
+// still exist and are ready.
+func (v *backupVerifier) verify(backup *api.Backup) backupVerification {
+	result := backupVerification{
+		Backup:     backup.Name,
+		Schedule:   backup.Labels[scheduleNameLabel],
+		VerifiedAt: v.now().UTC(),
+	}
+	problem := func(format string, args ...interface{}) {
+		result.Problems = append(result.Problems, fmt.Sprintf(format, args...))
+	}
+
+	dir := path.Join(v.prefix, "backups", backup.Name) + "/"
+	keys, err := v.store.ListObjects(v.bucket, dir)
+	if err != nil {
+		problem("error listing the backup's objects: %v", err)
+	}
+	present := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		if key == verificationKey(v.prefix, backup.Name) {
+			continue
+		}
+		present[strings.TrimPrefix(key, dir)] = true
+		result.Objects++
+		if !v.checksums {
+			continue
+		}
+		n, err := v.verifyChecksum(key)
+		result.Bytes += n
+		if err != nil {
+			problem("%v", err)
+		}
+	}
+	if err == nil {
+		for _, file := range []string{backupMetadataFile, backup.Name + ".tar.gz"} {
+			if !present[file] {
+				problem("object %s is missing", dir+file)
+			}
+		}
+	}
+
+	if present[backupMetadataFile] {
+		stored := new(api.Backup)
+		if err := v.decode(dir+backupMetadataFile, false, stored); err != nil {
+			problem("%v", err)
+		} else if stored.Name != backup.Name {
+			problem("%s is the metadata of backup %s", dir+backupMetadataFile, stored.Name)
+		}
+	}
+
+	if file := backup.Name + "-gcp-volumes.json"; present[file] {
+		if err := v.decode(dir+file, false, new(volumeManifest)); err != nil {
+			problem("%v", err)
+		}
+	}
+
+	file := backup.Name + "-volumesnapshots.json.gz"
+	if !present[file] {
+		if backup.Status.VolumeSnapshotsCompleted > 0 && err == nil {
+			problem("object %s is missing", dir+file)
+		}
+	} else {
+		var snapshots []*volume.Snapshot
+		if err := v.decode(dir+file, true, &snapshots); err != nil {
+			problem("%v", err)
+		}
+		for _, s := range snapshots {
+			if s.Status.Phase != volume.SnapshotPhaseCompleted || s.Status.ProviderSnapshotID == "" {
+				continue
+			}
+			result.Snapshots++
+			status, found, err := v.snapshots(s.Spec.Location, s.Status.ProviderSnapshotID)
+			switch {
+			case err != nil:
+				problem("unable to check snapshot %s of persistent volume %s: %v", s.Status.ProviderSnapshotID, s.Spec.PersistentVolumeName, err)
+			case !found:
+				problem("snapshot %s of persistent volume %s doesn't exist anymore", s.Status.ProviderSnapshotID, s.Spec.PersistentVolumeName)
+			case status != "READY":
+				problem("snapshot %s of persistent volume %s is %s", s.Status.ProviderSnapshotID, s.Spec.PersistentVolumeName, status)
+			}
+		}
+	}
+
+	result.Status = verificationPassed
+	if len(result.Problems) > 0 {
+		result.Status = verificationFailed
+	}
+	return result
+}
+
+// verifyChecksum reads an object and compares its CRC32C checksum with the
+// one GCS recorded. It returns the number of bytes read.
+func (v *backupVerifier) verifyChecksum(key string) (int64, error) {
+	expected, err := v.store.objectCRC32C(v.bucket, key)
+	if err != nil {
+		return 0, errors.Wrapf(err, "error getting the checksum of object %s", key)
+	}
+	body, err := v.store.GetObject(v.bucket, key)
+	if err != nil {
+		return 0, errors.Wrapf(err, "error reading object %s", key)
+	}
+	defer body.Close()
+
+	buf := copyBuffers.Get().(*[]byte)
+	defer copyBuffers.Put(buf)
+
+	h := crc32.New(crc32cTable)
+	n, err := io.CopyBuffer(h, body, *buf)
+	if err != nil {
+		return n, errors.Wrapf(err, "error reading object %s", key)
+	}
+	if actual := h.Sum32(); actual != expected {
+		return n, errors.Errorf("object %s has CRC32C checksum %08x, but %08x was recorded when it was uploaded", key, actual, expected)
+	}
+	return n, nil
+}
+
+// decode decodes a JSON object, optionally gzipped.
+func (v *backupVerifier) decode(key string, gzipped bool, obj interface{}) error {
+	body, err := v.store.GetObject(v.bucket, key)
+	if err != nil {
+		return errors.Wrapf(err, "error reading object %s", key)
+	}
+	defer body.Close()
+
+	var r io.Reader = body
+	if gzipped {
+		gz, err := gzip.NewReader(body)
+		if err != nil {
+			return errors.Wrapf(err, "error decompressing object %s", key)
+		}
+		defer gz.Close()
+		r = gz
+	}
+	if err := json.NewDecoder(r).Decode(obj); err != nil {
+		return errors.Wrapf(err, "error decoding object %s", key)
+	}
+	return nil
+}
+
+// record writes the result of a verification next to the backup's files
+// and publishes it as metrics.
+func (v *backupVerifier) record(result backupVerification) error {
+	labels := map[string]string{"backup": result.Backup, "schedule": result.Schedule}
+	verified := 0.0
+	if result.Status == verificationPassed {
+		verified = 1
+	}
+	pluginMetrics.setGauge(backupVerifiedGauge, "Whether the last verification of a backup passed.", labels, verified)
+	pluginMetrics.setGauge(backupVerificationTimeGauge, "Time of the last verification of a backup, in seconds since the epoch.", labels, float64(result.VerifiedAt.Unix()))
+
+	data, err := json.MarshalIndent(result, "", "  ")
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	key := verificationKey(v.prefix, result.Backup)
+	return errors.Wrapf(v.store.PutObject(v.bucket, key, bytes.NewReader(data)), "error writing %s", key)
+}
+
+// newVerificationStore returns the object store of a backup storage
+// location.
+func newVerificationStore(log logrus.FieldLogger, location *api.BackupStorageLocation) (verificationStore, error) {
+	config := map[string]string{"bucket": location.Spec.ObjectStorage.Bucket, "prefix": location.Spec.ObjectStorage.Prefix}
+	for k, v := range location.Spec.Config {
+		config[k] = v
+	}
+	o := newObjectStore(log)
+	if err := o.Init(config); err != nil {
+		return nil, err
+	}
+	return o, nil
+}
+
+// snapshotLocationLookup looks snapshots up in the GCP VolumeSnapshotLocations,
+// initializing a volume snapshotter for each location the first time one of
+// its snapshots is looked up.
+func snapshotLocationLookup(log logrus.FieldLogger, locations []api.VolumeSnapshotLocation) snapshotLookup {
+	snapshotters := make(map[string]*VolumeSnapshotter)
+	return func(name, snapshotID string) (string, bool, error) {
+		b, ok := snapshotters[name]
+		if !ok {
+			var location *api.VolumeSnapshotLocation
+			for i := range locations {
+				if locations[i].Name == name {
+					location = &locations[i]
+				}
+			}
+			if location == nil {
+				return "", false, errors.Errorf("VolumeSnapshotLocation %s not found", name)
+			}
+			if !isGCPProvider(location.Spec.Provider) {
+				return "", false, errors.Errorf("VolumeSnapshotLocation %s isn't a GCP location", name)
+			}
+			b = newVolumeSnapshotter(log)
+			if err := b.Init(location.Spec.Config); err != nil {
+				return "", false, err
+			}
+			snapshotters[name] = b
+		}
+
+		// the data of references is in Backup for GKE, which the plugin
+		// can't read
+		if isBackupForGKEReference(snapshotID) {
+			return "READY", true, nil
+		}
+		details, err := b.describeSnapshot(b.manifestSnapshot(snapshotID))
+		if isNotFound(err) {
+			return "", false, nil
+		}
+		if err != nil {
+			return "", false, err
+		}
+		return details.Status, true, nil
+	}
+}
+
+// verifyBackups verifies the completed backups of the cluster in GCS backup
+// storage locations, or only the named one, and returns whether all passed.
+// newStore returns the object store of a backup storage location.
+func verifyBackups(log logrus.FieldLogger, out io.Writer, cluster veleroCluster, newStore func(logrus.FieldLogger, *api.BackupStorageLocation) (verificationStore, error), name string, checksums bool) (bool, error) {
+	backups, err := cluster.backups()
+	if err != nil {
+		return false, err
+	}
+	storageLocations, err := cluster.backupStorageLocations()
+	if err != nil {
+		return false, err
+	}
+	snapshotLocations, err := cluster.volumeSnapshotLocations()
+	if err != nil {
+		return false, err
+	}
+	snapshots := snapshotLocationLookup(log, snapshotLocations)
+
+	verifiers := make(map[string]*backupVerifier)
+	verifier := func(locationName string) (*backupVerifier, error) {
+		if v, ok := verifiers[locationName]; ok {
+			return v, nil
+		}
+		for i := range storageLocations {
+			location := &storageLocations[i]
+			if location.Name != locationName {
+				continue
+			}
+			if !isGCPProvider(location.Spec.Provider) || location.Spec.ObjectStorage == nil {
+				return nil, nil
+			}
+			store, err := newStore(log, location)
+			if err != nil {
+				return nil, err
+			}
+			v := &backupVerifier{
+				store:     store,
+				bucket:    location.Spec.ObjectStorage.Bucket,
+				prefix:    location.Spec.ObjectStorage.Prefix,
+				checksums: checksums,
+				snapshots: snapshots,
+				now:       time.Now,
+			}
+			verifiers[locationName] = v
+			return v, nil
+		}
+		return nil, errors.Errorf("BackupStorageLocation %s not found in namespace %s", locationName, veleroNamespace())
+	}
+
+	tw := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "BACKUP\tSTATUS\tOBJECTS\tSNAPSHOTS\tPROBLEMS")
+	passed, found := true, false
+	for i := range backups {
+		backup := &backups[i]
+		if name != "" && backup.Name != name {
+			continue
+		}
+		found = true
+		if backup.Status.Phase != api.BackupPhaseCompleted && backup.Status.Phase != api.BackupPhasePartiallyFailed {
+			continue
+		}
+		v, err := verifier(backup.Spec.StorageLocation)
+		if err != nil {
+			return false, err
+		}
+		if v == nil {
+			continue
+		}
+
+		result := v.verify(backup)
+		if err := v.record(result); err != nil {
+			log.WithError(err).Warnf("Unable to record the verification of backup %s", backup.Name)
+		}
+		if result.Status != verificationPassed {
+			passed = false
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%d\t%s\n", result.Backup, result.Status, result.Objects, result.Snapshots, strings.Join(result.Problems, "; "))
+	}
+	tw.Flush()
+	if name != "" && !found {
+		return false, errors.Errorf("backup %s not found", name)
+	}
+	return passed, nil
+}
+
+// runVerifyBackups verifies backups once, or every interval when one is
+// given, exposing the results as metrics.
+func runVerifyBackups(args []string, out io.Writer) int {
+	flags := pflag.NewFlagSet(verifyBackupsCommand, pflag.ContinueOnError)
+	flags.SetOutput(out)
+	var (
+		name      string
+		checksums bool
+		interval  time.Duration
+	)
+	flags.StringVar(&name, "backup", "", "only verify this backup")
+	flags.BoolVar(&checksums, "checksums", true, "read every object of the backups to verify its checksum")
+	flags.DurationVar(&interval, "interval", 0, "verify the backups again at this interval instead of exiting")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	logger := logrus.New()
+	logger.SetOutput(os.Stderr)
+	startMetricsServer(logger)
+	startCloudMonitoring(logger)
+
+	for {
+		code := 0
+		passed, err := verifyBackups(logger, out, inCluster{}, newVerificationStore, name, checksums)
+		if err != nil {
+			fmt.Fprintln(out, err)
+			code = 1
+		} else if !passed {
+			code = 1
+		}
+		if pluginMetricsPusher != nil {
+			if err := pluginMetricsPusher.push(context.Background(), pluginMetrics); err != nil {
+				logger.WithError(err).Warn("Error writing metrics to Cloud Monitoring")
+			}
+		}
+		if interval <= 0 {
+			return code
+		}
+		time.Sleep(interval)
+	}
+}
@@ -0,0 +1,212 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	api "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	velerotest "github.com/vmware-tanzu/velero/pkg/test"
+	"github.com/vmware-tanzu/velero/pkg/volume"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+type fakeVerificationStore struct {
+	objects map[string][]byte
+	crcs    map[string]uint32
+}
+
+func (s *fakeVerificationStore) put(key string, data []byte) {
+	s.objects[key] = data
+	s.crcs[key] = crc32.Checksum(data, crc32cTable)
+}
+
+func (s *fakeVerificationStore) ListObjects(bucket, prefix string) ([]string, error) {
+	var keys []string
+	for key := range s.objects {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+func (s *fakeVerificationStore) GetObject(bucket, key string) (io.ReadCloser, error) {
+	data, ok := s.objects[key]
+	if !ok {
+		return nil, errors.New("object doesn't exist")
+	}
+	return ioutil.NopCloser(bytes.NewReader(data)), nil
+}
+
+func (s *fakeVerificationStore) PutObject(bucket, key string, body io.Reader) error {
+	data, err := ioutil.ReadAll(body)
+	if err != nil {
+		return err
+	}
+	s.put(key, data)
+	return nil
+}
+
+func (s *fakeVerificationStore) objectCRC32C(bucket, key string) (uint32, error) {
+	return s.crcs[key], nil
+}
+
+func TestBackupVerifierVerify(t *testing.T) {
+	defer func(registry *metricsRegistry) { pluginMetrics = registry }(pluginMetrics)
+	pluginMetrics = newMetricsRegistry()
+
+	backup := &api.Backup{
+		ObjectMeta: metav1.ObjectMeta{Name: "nightly-1", Labels: map[string]string{scheduleNameLabel: "nightly"}},
+		Status:     api.BackupStatus{Phase: api.BackupPhaseCompleted, VolumeSnapshotsCompleted: 2},
+	}
+	metadata, err := json.Marshal(backup)
+	require.NoError(t, err)
+
+	var snapshots bytes.Buffer
+	gz := gzip.NewWriter(&snapshots)
+	require.NoError(t, json.NewEncoder(gz).Encode([]*volume.Snapshot{
+		{Spec: volume.SnapshotSpec{Location: "default", PersistentVolumeName: "pv-1"}, Status: volume.SnapshotStatus{ProviderSnapshotID: "snap-1", Phase: volume.SnapshotPhaseCompleted}},
+		{Spec: volume.SnapshotSpec{Location: "default", PersistentVolumeName: "pv-2"}, Status: volume.SnapshotStatus{ProviderSnapshotID: "snap-2", Phase: volume.SnapshotPhaseCompleted}},
+		{Spec: volume.SnapshotSpec{Location: "default", PersistentVolumeName: "pv-3"}, Status: volume.SnapshotStatus{Phase: volume.SnapshotPhaseFailed}},
+	}))
+	require.NoError(t, gz.Close())
+
+	store := &fakeVerificationStore{objects: make(map[string][]byte), crcs: make(map[string]uint32)}
+	store.put("velero/backups/nightly-1/velero-backup.json", metadata)
+	store.put("velero/backups/nightly-1/nightly-1.tar.gz", []byte("contents"))
+	store.put("velero/backups/nightly-1/nightly-1-volumesnapshots.json.gz", snapshots.Bytes())
+
+	existing := map[string]string{"snap-1": "READY", "snap-2": "READY"}
+	now := time.Date(2021, 10, 1, 12, 0, 0, 0, time.UTC)
+	v := &backupVerifier{
+		store:     store,
+		bucket:    "bucket",
+		prefix:    "velero",
+		checksums: true,
+		snapshots: func(location, id string) (string, bool, error) {
+			assert.Equal(t, "default", location)
+			status, ok := existing[id]
+			return status, ok, nil
+		},
+		now: func() time.Time { return now },
+	}
+
+	result := v.verify(backup)
+	assert.Equal(t, backupVerification{
+		Backup:     "nightly-1",
+		Schedule:   "nightly",
+		VerifiedAt: now,
+		Status:     verificationPassed,
+		Objects:    3,
+		Bytes:      int64(len(metadata) + len("contents") + snapshots.Len()),
+		Snapshots:  2,
+	}, result)
+	require.NoError(t, v.record(result))
+
+	// the verification object isn't verified itself
+	stored := new(backupVerification)
+	require.NoError(t, json.Unmarshal(store.objects["velero/backups/nightly-1/nightly-1-gcp-verification.json"], stored))
+	assert.Equal(t, verificationPassed, stored.Status)
+	assert.Equal(t, 3, v.verify(backup).Objects)
+
+	// corrupted objects and deleted snapshots fail the verification
+	store.objects["velero/backups/nightly-1/nightly-1.tar.gz"] = []byte("corrupted")
+	delete(existing, "snap-1")
+	existing["snap-2"] = "FAILED"
+	result = v.verify(backup)
+	assert.Equal(t, verificationFailed, result.Status)
+	require.Len(t, result.Problems, 3)
+	assert.Contains(t, result.Problems[0], "object velero/backups/nightly-1/nightly-1.tar.gz has CRC32C checksum")
+	assert.Equal(t, "snapshot snap-1 of persistent volume pv-1 doesn't exist anymore", result.Problems[1])
+	assert.Equal(t, "snapshot snap-2 of persistent volume pv-2 is FAILED", result.Problems[2])
+
+	// missing objects fail the verification
+	v.checksums = false
+	delete(store.objects, "velero/backups/nightly-1/nightly-1.tar.gz")
+	delete(store.objects, "velero/backups/nightly-1/nightly-1-volumesnapshots.json.gz")
+	result = v.verify(backup)
+	assert.Equal(t, []string{
+		"object velero/backups/nightly-1/nightly-1.tar.gz is missing",
+		"object velero/backups/nightly-1/nightly-1-volumesnapshots.json.gz is missing",
+	}, result.Problems)
+	require.NoError(t, v.record(result))
+
+	values := make(map[string]float64)
+	pluginMetrics.each(func(m *metric, s *sample) {
+		values[m.name+labelString(s.labels)] = s.value
+	})
+	assert.Equal(t, map[string]float64{
+		`velero_gcp_backup_verified{backup="nightly-1",schedule="nightly"}`:                       0,
+		`velero_gcp_backup_verification_timestamp_seconds{backup="nightly-1",schedule="nightly"}`: float64(now.Unix()),
+	}, values)
+}
+
+func TestVerifyBackups(t *testing.T) {
+	defer func(registry *metricsRegistry) { pluginMetrics = registry }(pluginMetrics)
+	pluginMetrics = newMetricsRegistry()
+
+	store := &fakeVerificationStore{objects: make(map[string][]byte), crcs: make(map[string]uint32)}
+	store.put("backups/b1/velero-backup.json", []byte(`{"metadata":{"name":"b1"}}`))
+	store.put("backups/b1/b1.tar.gz", []byte("contents"))
+
+	cluster := &fakeCluster{
+		backupList: []api.Backup{
+			{ObjectMeta: metav1.ObjectMeta{Name: "b1"}, Spec: api.BackupSpec{StorageLocation: "default"}, Status: api.BackupStatus{Phase: api.BackupPhaseCompleted}},
+			{ObjectMeta: metav1.ObjectMeta{Name: "b2"}, Spec: api.BackupSpec{StorageLocation: "default"}, Status: api.BackupStatus{Phase: api.BackupPhaseCompleted}},
+			{ObjectMeta: metav1.ObjectMeta{Name: "b3"}, Spec: api.BackupSpec{StorageLocation: "default"}, Status: api.BackupStatus{Phase: api.BackupPhaseInProgress}},
+			{ObjectMeta: metav1.ObjectMeta{Name: "b4"}, Spec: api.BackupSpec{StorageLocation: "aws"}, Status: api.BackupStatus{Phase: api.BackupPhaseCompleted}},
+		},
+		storageLocations: []api.BackupStorageLocation{
+			{ObjectMeta: metav1.ObjectMeta{Name: "default"}, Spec: api.BackupStorageLocationSpec{Provider: "velero.io/gcp", StorageType: api.StorageType{ObjectStorage: &api.ObjectStorageLocation{Bucket: "bucket"}}}},
+			{ObjectMeta: metav1.ObjectMeta{Name: "aws"}, Spec: api.BackupStorageLocationSpec{Provider: "aws", StorageType: api.StorageType{ObjectStorage: &api.ObjectStorageLocation{Bucket: "bucket"}}}},
+		},
+	}
+	newStore := func(logrus.FieldLogger, *api.BackupStorageLocation) (verificationStore, error) { return store, nil }
+
+	var out bytes.Buffer
+	passed, err := verifyBackups(velerotest.NewLogger(), &out, cluster, newStore, "", false)
+	require.NoError(t, err)
+	assert.False(t, passed)
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	require.Len(t, lines, 3)
+	assert.Regexp(t, `^b1\s+Passed\s+2\s+0\s*$`, lines[1])
+	assert.Regexp(t, `^b2\s+Failed\s+0\s+0\s+object backups/b2/velero-backup.json is missing; object backups/b2/b2.tar.gz is missing$`, lines[2])
+	assert.Contains(t, store.objects, "backups/b1/b1-gcp-verification.json")
+
+	out.Reset()
+	passed, err = verifyBackups(velerotest.NewLogger(), &out, cluster, newStore, "b1", true)
+	require.NoError(t, err)
+	assert.True(t, passed)
+
+	_, err = verifyBackups(velerotest.NewLogger(), &out, cluster, newStore, "b5", true)
+	assert.EqualError(t, err, "backup b5 not found")
+}
@@ -0,0 +1,406 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	pubsub "google.golang.org/api/pubsub/v1"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// budgetSubscriptionConfigKey is the key of a VolumeSnapshotLocation's
+	// config holding the Pub/Sub subscription, as
+	// projects/PROJECT/subscriptions/SUBSCRIPTION, to the topic Cloud
+	// Billing budgets send their notifications to.
+	budgetSubscriptionConfigKey = "budgetSubscription"
+	// budgetThresholdConfigKey is the key of a VolumeSnapshotLocation's
+	// config holding the percentage of a budget's amount above which
+	// scheduled backups are throttled.
+	budgetThresholdConfigKey = "budgetThreshold"
+	// budgetActionConfigKey is the key of a VolumeSnapshotLocation's config
+	// holding what happens to the snapshots of throttled backups.
+	budgetActionConfigKey = "budgetAction"
+
+	// budgetActionArchive takes the snapshots of throttled backups as
+	// archive snapshots.
+	budgetActionArchive = "archive"
+	// budgetActionSkip fails the snapshots of throttled backups.
+	budgetActionSkip = "skip"
+
+	defaultBudgetThreshold = 100
+
+	// budgetCriticalLabel is the label of backups, set in their schedules'
+	// templates, whose snapshots are never throttled.
+	budgetCriticalLabel = "gcp.velero.io/budget-critical"
+
+	// budgetStateLabel labels the ConfigMaps keeping the last state of the
+	// budgets notifying a subscription.
+	budgetStateLabel = "gcp.velero.io/budget-state"
+
+	budgetExceededReason  = "BudgetExceeded"
+	budgetThrottleCounter = "velero_gcp_budget_throttled_snapshots_total"
+
+	// budgetCheckInterval is how long the state of the budgets is used
+	// before the subscription is pulled again.
+	budgetCheckInterval = 5 * time.Minute
+	// budgetStateMaxAge is how long the state of a budget is used. Cloud
+	// Billing notifies several times a day, so a budget that wasn't heard of
+	// for longer was deleted or stopped notifying the topic.
+	budgetStateMaxAge = 48 * time.Hour
+	// budgetPullTimeout bounds how long reading the budgets may delay a
+	// snapshot.
+	budgetPullTimeout = 30 * time.Second
+	maxBudgetMessages = 100
+)
+
+var pubsubSubscriptionRegexp = regexp.MustCompile(`^projects/[^/]+/subscriptions/[^/]+$`)
+
+func checkPubSubSubscription(val string) error {
+	if !pubsubSubscriptionRegexp.MatchString(val) {
+		return errors.New("expected projects/PROJECT/subscriptions/SUBSCRIPTION")
+	}
+	return nil
+}
+
+func checkBudgetThreshold(val string) error {
+	if n, err := strconv.Atoi(val); err != nil || n <= 0 {
+		return errors.New("expected a positive percentage of the budget's amount, e.g. 90")
+	}
+	return nil
+}
+
+func checkBudgetAction(val string) error {
+	if val != budgetActionArchive && val != budgetActionSkip {
+		return errors.Errorf("expected %s or %s", budgetActionArchive, budgetActionSkip)
+	}
+	return nil
+}
+
+// budgetNotification is the JSON payload of the messages Cloud Billing
+// budgets publish.
+type budgetNotification struct {
+	BudgetDisplayName string  `json:"budgetDisplayName"`
+	CostAmount        float64 `json:"costAmount"`
+	BudgetAmount      float64 `json:"budgetAmount"`
+	CurrencyCode      string  `json:"currencyCode"`
+}
+
+// budgetState is the cost of a budget's current interval when it last
+// notified.
+type budgetState struct {
+	Name     string    `json:"name"`
+	Cost     float64   `json:"cost"`
+	Amount   float64   `json:"amount"`
+	Currency string    `json:"currency"`
+	Updated  time.Time `json:"updated"`
+}
+
+// percent returns the cost as a percentage of the budget's amount.
+func (s budgetState) percent() float64 {
+	if s.Amount <= 0 {
+		return 0
+	}
+	return s.Cost / s.Amount * 100
+}
+
+// parseBudgetNotification returns the ID and state of the budget a message
+// is from, or false if it isn't a budget notification.
+func parseBudgetNotification(m *pubsub.PubsubMessage) (string, budgetState, bool) {
+	id := m.Attributes["budgetId"]
+	if id == "" {
+		return "", budgetState{}, false
+	}
+	data, err := base64.StdEncoding.DecodeString(m.Data)
+	if err != nil {
+		return "", budgetState{}, false
+	}
+	var n budgetNotification
+	if err := json.Unmarshal(data, &n); err != nil {
+		return "", budgetState{}, false
+	}
+	published, err := time.Parse(time.RFC3339Nano, m.PublishTime)
+	if err != nil {
+		return "", budgetState{}, false
+	}
+	name := n.BudgetDisplayName
+	if name == "" {
+		name = id
+	}
+	return id, budgetState{Name: name, Cost: n.CostAmount, Amount: n.BudgetAmount, Currency: n.CurrencyCode, Updated: published}, true
+}
+
+// budgetStore reads and writes the ConfigMap keeping the state of the
+// budgets.
+type budgetStore interface {
+	getConfigMap(namespace, name string) (*v1.ConfigMap, error)
+	createConfigMap(configMap *v1.ConfigMap) error
+	patchConfigMap(namespace, name string, data map[string]string) error
+}
+
+// newBudgetStore returns the client the state of the budgets is kept with.
+func newBudgetStore() (budgetStore, error) {
+	return newInClusterClient()
+}
+
+// budgetGuard throttles the snapshots of scheduled backups while a Cloud
+// Billing budget is over the threshold. Budgets only publish their state to
+// Pub/Sub, and a pulled message is gone once acknowledged, so the last state
+// of each budget is kept in a ConfigMap shared by the plugin's processes.
+// Reading the budgets is best effort: when they can't be read, snapshots are
+// taken as the last known state allows. A nil guard throttles nothing.
+type budgetGuard struct {
+	log          logrus.FieldLogger
+	subscription string
+	threshold    int
+	action       string
+	credentials  locationCredentials
+	namespace    string
+	now          func() time.Time
+
+	lock    sync.Mutex
+	svc     *pubsub.Service
+	store   budgetStore
+	checked time.Time
+	budgets map[string]budgetState
+}
+
+// newBudgetGuard returns the guard of the budgets notifying the
+// subscription in the config, or nil if none is configured.
+func newBudgetGuard(log logrus.FieldLogger, config map[string]string, credentials locationCredentials) *budgetGuard {
+	subscription := config[budgetSubscriptionConfigKey]
+	if subscription == "" {
+		return nil
+	}
+	threshold := defaultBudgetThreshold
+	if val := config[budgetThresholdConfigKey]; val != "" {
+		threshold, _ = strconv.Atoi(val)
+	}
+	action := config[budgetActionConfigKey]
+	if action == "" {
+		action = budgetActionArchive
+	}
+	return &budgetGuard{
+		log:          log.WithField("subscription", subscription),
+		subscription: subscription,
+		threshold:    threshold,
+		action:       action,
+		credentials:  credentials,
+		namespace:    veleroNamespace(),
+		now:          time.Now,
+	}
+}
+
+func (g *budgetGuard) service(ctx context.Context) (*pubsub.Service, error) {
+	if g.svc == nil {
+		opts, err := g.credentials.clientOptions(ctx, pubsub.PubsubScope)
+		if err != nil {
+			return nil, err
+		}
+		if opts, err = instrumentClientOptions(ctx, g.log, pubsubService, opts); err != nil {
+			return nil, err
+		}
+		if g.svc, err = pubsub.NewService(ctx, opts...); err != nil {
+			return nil, errors.WithStack(err)
+		}
+	}
+	return g.svc, nil
+}
+
+// budgetConfigMapName returns the name of the ConfigMap keeping the state of
+// the budgets notifying a subscription.
+func budgetConfigMapName(subscription string) string {
+	return fmt.Sprintf("velero-gcp-budget-%x", sha256.Sum256([]byte(subscription)))[:50]
+}
+
+// exceeded returns the budgets over the threshold, by name.
+func (g *budgetGuard) exceeded() []budgetState {
+	now := g.now()
+	var res []budgetState
+	for _, s := range g.states() {
+		if now.Sub(s.Updated) <= budgetStateMaxAge && s.percent() >= float64(g.threshold) {
+			res = append(res, s)
+		}
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Name < res[j].Name })
+	return res
+}
+
+// states returns the state of the budgets, pulling their notifications at
+// most every budgetCheckInterval.
+func (g *budgetGuard) states() map[string]budgetState {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	now := g.now()
+	if !g.checked.IsZero() && now.Sub(g.checked) < budgetCheckInterval {
+		return g.budgets
+	}
+	g.checked = now
+
+	ctx, cancel := context.WithTimeout(context.Background(), budgetPullTimeout)
+	defer cancel()
+	budgets, err := g.refresh(ctx)
+	if err != nil {
+		g.log.WithError(err).Warn("Unable to read the state of the budgets, throttling snapshots as their last known state allows")
+		return g.budgets
+	}
+	g.budgets = budgets
+	return budgets
+}
+
+// refresh reads the kept state of the budgets, updates it with the
+// notifications pulled from the subscription, and acknowledges them.
+func (g *budgetGuard) refresh(ctx context.Context) (map[string]budgetState, error) {
+	if g.store == nil {
+		store, err := newBudgetStore()
+		if err != nil {
+			return nil, err
+		}
+		g.store = store
+	}
+
+	name := budgetConfigMapName(g.subscription)
+	err := g.store.createConfigMap(&v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: g.namespace,
+			Labels:    map[string]string{budgetStateLabel: "true"},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	configMap, err := g.store.getConfigMap(g.namespace, name)
+	if err != nil {
+		return nil, err
+	}
+	budgets := make(map[string]budgetState, len(configMap.Data))
+	for id, data := range configMap.Data {
+		var s budgetState
+		if err := json.Unmarshal([]byte(data), &s); err == nil {
+			budgets[id] = s
+		}
+	}
+
+	svc, err := g.service(ctx)
+	if err != nil {
+		return nil, err
+	}
+	res, err := svc.Projects.Subscriptions.Pull(g.subscription, &pubsub.PullRequest{MaxMessages: maxBudgetMessages, ReturnImmediately: true}).Context(ctx).Do()
+	if err != nil {
+		return nil, errors.Wrapf(err, "error pulling budget notifications from %s", g.subscription)
+	}
+	var ackIDs []string
+	changed := make(map[string]string)
+	for _, m := range res.ReceivedMessages {
+		ackIDs = append(ackIDs, m.AckId)
+		if m.Message == nil {
+			continue
+		}
+		id, s, ok := parseBudgetNotification(m.Message)
+		if !ok {
+			g.log.WithField("messageID", m.Message.MessageId).Debug("Ignoring a message that isn't a budget notification")
+			continue
+		}
+		// messages are delivered out of order
+		if prev, ok := budgets[id]; ok && !s.Updated.After(prev.Updated) {
+			continue
+		}
+		data, err := json.Marshal(s)
+		if err != nil {
+			continue
+		}
+		budgets[id] = s
+		changed[id] = string(data)
+	}
+	if len(changed) > 0 {
+		if err := g.store.patchConfigMap(g.namespace, name, changed); err != nil {
+			return nil, err
+		}
+	}
+	// messages are only acknowledged once their state is kept, so failures
+	// have them delivered again
+	if len(ackIDs) > 0 {
+		if _, err := svc.Projects.Subscriptions.Acknowledge(g.subscription, &pubsub.AcknowledgeRequest{AckIds: ackIDs}).Context(ctx).Do(); err != nil {
+			g.log.WithError(err).Warn("Unable to acknowledge the budget notifications")
+		}
+	}
+	return budgets, nil
+}
+
+// describeBudgets explains which budgets are over the threshold.
+func describeBudgets(budgets []budgetState, threshold int) string {
+	parts := make([]string, 0, len(budgets))
+	for _, s := range budgets {
+		parts = append(parts, fmt.Sprintf("%q (%.0f%% of %.2f %s)", s.Name, s.percent(), s.Amount, s.Currency))
+	}
+	noun := "budget"
+	if len(budgets) > 1 {
+		noun = "budgets"
+	}
+	return fmt.Sprintf("%s %s exceeded the budgetThreshold of %d%%", noun, strings.Join(parts, ", "), threshold)
+}
+
+// budgetThrottle returns whether the snapshot of a volume of a backup is
+// taken as an archive snapshot because a budget is over the threshold, or
+// an error if it's skipped. Only scheduled backups not labeled critical are
+// throttled, and Filestore volumes, which have no archive tier, are always
+// skipped.
+func (b *VolumeSnapshotter) budgetThrottle(volumeID string, tags map[string]string) (bool, error) {
+	budget := b.clients().budget
+	if budget == nil || tags[scheduleNameLabel] == "" {
+		return false, nil
+	}
+	if critical, _ := strconv.ParseBool(tags[budgetCriticalLabel]); critical {
+		return false, nil
+	}
+	exceeded := budget.exceeded()
+	if len(exceeded) == 0 {
+		return false, nil
+	}
+
+	reason := describeBudgets(exceeded, budget.threshold)
+	if budget.action == budgetActionSkip || isFilestoreVolume(volumeID) {
+		recordBudgetThrottle(budgetActionSkip)
+		return false, errors.Errorf("skipped the snapshot of volume %s of scheduled backup %s because %s; label the schedule's backups %s=true to always snapshot their volumes", volumeID, tags[backupNameTag], reason, budgetCriticalLabel)
+	}
+
+	recordBudgetThrottle(budgetActionArchive)
+	msg := fmt.Sprintf("Creating an archive snapshot of volume %s because %s", volumeID, reason)
+	b.log.WithFields(logrus.Fields{"backup": tags[backupNameTag], "volume": volumeID}).Warn(msg)
+	b.snapshotEvent(tags, v1.EventTypeWarning, budgetExceededReason, msg)
+	return true, nil
+}
+
+func recordBudgetThrottle(action string) {
+	pluginMetrics.addCounter(budgetThrottleCounter, "Number of snapshots of scheduled backups skipped or taken as archive snapshots because a budget was exceeded, by action.", map[string]string{"action": action}, 1)
+}
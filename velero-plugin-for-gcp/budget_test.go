@@ -0,0 +1,289 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	velerotest "github.com/vmware-tanzu/velero/pkg/test"
+	"google.golang.org/api/compute/v1"
+	"google.golang.org/api/option"
+	pubsub "google.golang.org/api/pubsub/v1"
+	v1 "k8s.io/api/core/v1"
+)
+
+func TestCheckBudgetConfig(t *testing.T) {
+	assert.NoError(t, checkPubSubSubscription("projects/p/subscriptions/budgets"))
+	assert.Error(t, checkPubSubSubscription("projects/p/topics/budgets"))
+	for _, val := range []string{"90", "100", "150"} {
+		assert.NoError(t, checkBudgetThreshold(val), val)
+	}
+	for _, val := range []string{"", "0", "-10", "0.9"} {
+		assert.Error(t, checkBudgetThreshold(val), val)
+	}
+	assert.NoError(t, checkBudgetAction("archive"))
+	assert.NoError(t, checkBudgetAction("skip"))
+	assert.Error(t, checkBudgetAction("downgrade"))
+}
+
+// budgetMessage returns a notification of a budget published at a time.
+func budgetMessage(id, name string, cost, amount float64, published time.Time) *pubsub.ReceivedMessage {
+	data, _ := json.Marshal(map[string]interface{}{
+		"budgetDisplayName":      name,
+		"alertThresholdExceeded": 1.0,
+		"costAmount":             cost,
+		"costIntervalStart":      "2026-10-01T07:00:00Z",
+		"budgetAmount":           amount,
+		"budgetAmountType":       "SPECIFIED_AMOUNT",
+		"currencyCode":           "USD",
+	})
+	return &pubsub.ReceivedMessage{
+		AckId: "ack-" + id + "-" + published.Format(time.RFC3339),
+		Message: &pubsub.PubsubMessage{
+			Attributes:  map[string]string{"billingAccountId": "01D4EE-079462-DFD6EC", "budgetId": id, "schemaVersion": "1.0"},
+			Data:        base64.StdEncoding.EncodeToString(data),
+			PublishTime: published.Format(time.RFC3339Nano),
+		},
+	}
+}
+
+func TestParseBudgetNotification(t *testing.T) {
+	published := time.Date(2026, 10, 16, 8, 0, 0, 0, time.UTC)
+	id, state, ok := parseBudgetNotification(budgetMessage("b-1", "prod", 1120, 1000, published).Message)
+	require.True(t, ok)
+	assert.Equal(t, "b-1", id)
+	assert.Equal(t, budgetState{Name: "prod", Cost: 1120, Amount: 1000, Currency: "USD", Updated: published}, state)
+	assert.InDelta(t, 112, state.percent(), 0.001)
+
+	_, _, ok = parseBudgetNotification(&pubsub.PubsubMessage{Data: base64.StdEncoding.EncodeToString([]byte("{}"))})
+	assert.False(t, ok)
+	assert.Equal(t, 0.0, budgetState{Cost: 10}.percent())
+}
+
+// fakeBudgetStore keeps the budgets' ConfigMap in memory.
+type fakeBudgetStore struct {
+	configMap *v1.ConfigMap
+	patches   int
+}
+
+func (s *fakeBudgetStore) getConfigMap(namespace, name string) (*v1.ConfigMap, error) {
+	if s.configMap == nil {
+		return nil, errors.Errorf("ConfigMap %s not found", name)
+	}
+	configMap := *s.configMap
+	return &configMap, nil
+}
+
+func (s *fakeBudgetStore) createConfigMap(configMap *v1.ConfigMap) error {
+	if s.configMap == nil {
+		s.configMap = configMap
+	}
+	return nil
+}
+
+func (s *fakeBudgetStore) patchConfigMap(namespace, name string, data map[string]string) error {
+	s.patches++
+	if s.configMap.Data == nil {
+		s.configMap.Data = make(map[string]string)
+	}
+	for k, v := range data {
+		s.configMap.Data[k] = v
+	}
+	return nil
+}
+
+// fakeSubscription is a Pub/Sub API delivering messages until they're
+// acknowledged.
+type fakeSubscription struct {
+	messages []*pubsub.ReceivedMessage
+	pulls    int
+}
+
+func (f *fakeSubscription) service(t *testing.T) *pubsub.Service {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/projects/p/subscriptions/budgets:pull"):
+			f.pulls++
+			json.NewEncoder(w).Encode(&pubsub.PullResponse{ReceivedMessages: f.messages})
+		case strings.HasSuffix(r.URL.Path, "/projects/p/subscriptions/budgets:acknowledge"):
+			var req pubsub.AcknowledgeRequest
+			require.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+			acked := make(map[string]bool)
+			for _, id := range req.AckIds {
+				acked[id] = true
+			}
+			var left []*pubsub.ReceivedMessage
+			for _, m := range f.messages {
+				if !acked[m.AckId] {
+					left = append(left, m)
+				}
+			}
+			f.messages = left
+			w.Write([]byte("{}"))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(server.Close)
+
+	svc, err := pubsub.NewService(context.Background(), option.WithEndpoint(server.URL), option.WithoutAuthentication())
+	require.NoError(t, err)
+	return svc
+}
+
+func newTestBudgetGuard(t *testing.T, config map[string]string, sub *fakeSubscription, store *fakeBudgetStore, now *time.Time) *budgetGuard {
+	config[budgetSubscriptionConfigKey] = "projects/p/subscriptions/budgets"
+	g := newBudgetGuard(velerotest.NewLogger(), config, locationCredentials{})
+	g.svc, g.store, g.namespace = sub.service(t), store, "velero"
+	g.now = func() time.Time { return *now }
+	return g
+}
+
+func TestBudgetGuard(t *testing.T) {
+	now := time.Date(2026, 10, 16, 8, 0, 0, 0, time.UTC)
+	sub := &fakeSubscription{messages: []*pubsub.ReceivedMessage{
+		budgetMessage("b-1", "prod", 1120, 1000, now.Add(-time.Hour)),
+		// an older notification delivered later
+		budgetMessage("b-1", "prod", 800, 1000, now.Add(-2*time.Hour)),
+		budgetMessage("b-2", "dev", 50, 100, now.Add(-time.Hour)),
+		{AckId: "not-a-budget", Message: &pubsub.PubsubMessage{Data: "e30="}},
+	}}
+	store := new(fakeBudgetStore)
+	g := newTestBudgetGuard(t, map[string]string{}, sub, store, &now)
+	assert.Equal(t, defaultBudgetThreshold, g.threshold)
+	assert.Equal(t, budgetActionArchive, g.action)
+
+	exceeded := g.exceeded()
+	require.Len(t, exceeded, 1)
+	assert.Equal(t, "prod", exceeded[0].Name)
+	assert.Empty(t, sub.messages)
+	assert.Equal(t, budgetConfigMapName("projects/p/subscriptions/budgets"), store.configMap.Name)
+	assert.Equal(t, "true", store.configMap.Labels[budgetStateLabel])
+	assert.Len(t, store.configMap.Data, 2)
+	assert.Equal(t, `budget "prod" (112% of 1000.00 USD) exceeded the budgetThreshold of 100%`, describeBudgets(exceeded, g.threshold))
+
+	// the state is reused for a while
+	g.exceeded()
+	assert.Equal(t, 1, sub.pulls)
+
+	// other processes see the kept state, and thresholds below 100% catch
+	// budgets before they're spent
+	other := newTestBudgetGuard(t, map[string]string{budgetThresholdConfigKey: "50"}, &fakeSubscription{}, store, &now)
+	exceeded = other.exceeded()
+	require.Len(t, exceeded, 2)
+	assert.Equal(t, "dev", exceeded[0].Name)
+	assert.Equal(t, `budgets "dev" (50% of 100.00 USD), "prod" (112% of 1000.00 USD) exceeded the budgetThreshold of 50%`, describeBudgets(exceeded, other.threshold))
+
+	// newer notifications update the state
+	now = now.Add(budgetCheckInterval)
+	sub.messages = []*pubsub.ReceivedMessage{budgetMessage("b-1", "prod", 0, 1000, now)}
+	assert.Empty(t, g.exceeded())
+	assert.Equal(t, 2, store.patches)
+
+	// budgets not heard of for long are ignored
+	now = now.Add(budgetCheckInterval)
+	sub.messages = []*pubsub.ReceivedMessage{budgetMessage("b-3", "old", 200, 100, now.Add(-budgetStateMaxAge-time.Minute))}
+	assert.Empty(t, g.exceeded())
+}
+
+func TestBudgetThrottle(t *testing.T) {
+	defer func(registry *metricsRegistry) { pluginMetrics = registry }(pluginMetrics)
+	pluginMetrics = newMetricsRegistry()
+
+	now := time.Date(2026, 10, 16, 8, 0, 0, 0, time.UTC)
+	over := budgetMessage("b-1", "prod", 1120, 1000, now.Add(-time.Hour))
+	var created map[string]interface{}
+	gce := newFakeComputeService(t, func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/aggregated/disks"):
+			json.NewEncoder(w).Encode(&compute.DiskAggregatedList{})
+		case strings.HasSuffix(r.URL.Path, "/projects/budget-project/regions/us-central1/disks/pvc-1"):
+			json.NewEncoder(w).Encode(&compute.Disk{Name: "pvc-1", SizeGb: 10})
+		case strings.HasSuffix(r.URL.Path, "/projects/budget-project/regions/us-central1/disks/pvc-1/createSnapshot"):
+			assert.Equal(t, "velero/backup/nightly-1", r.Header.Get(requestReasonHeader))
+			require.NoError(t, json.NewDecoder(r.Body).Decode(&created))
+			json.NewEncoder(w).Encode(&compute.Operation{Name: "op-1"})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	})
+	b := (&VolumeSnapshotter{
+		log:             velerotest.NewLogger(),
+		computeHTTP:     http.DefaultClient,
+		volumeProject:   "budget-project",
+		snapshotProject: "budget-project",
+	}).withClients(&snapshotterClients{
+		gce: gce,
+	})
+	tags := map[string]string{backupNameTag: "nightly-1", scheduleNameLabel: "nightly", pvNameTag: "pv-1"}
+
+	// without a guard, or within budget, nothing is throttled
+	archive, err := b.budgetThrottle("pvc-1", tags)
+	require.NoError(t, err)
+	assert.False(t, archive)
+	b.setClients(func(c *snapshotterClients) {
+		c.budget = newTestBudgetGuard(t, map[string]string{}, &fakeSubscription{}, new(fakeBudgetStore), &now)
+	})
+	archive, err = b.budgetThrottle("pvc-1", tags)
+	require.NoError(t, err)
+	assert.False(t, archive)
+
+	// over budget, scheduled backups get archive snapshots, while manual
+	// and critical backups don't
+	now = now.Add(budgetCheckInterval)
+	b.setClients(func(c *snapshotterClients) {
+		c.budget = newTestBudgetGuard(t, map[string]string{}, &fakeSubscription{messages: []*pubsub.ReceivedMessage{over}}, new(fakeBudgetStore), &now)
+	})
+	snapshot, err := b.createVolumeSnapshot("pvc-1", "us-central1-a__us-central1-b", tags)
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(snapshot, "pvc-1-"))
+	assert.Equal(t, archiveSnapshotType, created["snapshotType"])
+	assert.Equal(t, archiveSnapshotTier, created["labels"].(map[string]interface{})[snapshotTierLabel])
+
+	archive, err = b.budgetThrottle("pvc-1", map[string]string{backupNameTag: "manual"})
+	require.NoError(t, err)
+	assert.False(t, archive)
+	archive, err = b.budgetThrottle("pvc-1", map[string]string{backupNameTag: "nightly-1", scheduleNameLabel: "nightly", budgetCriticalLabel: "true"})
+	require.NoError(t, err)
+	assert.False(t, archive)
+
+	// Filestore volumes have no archive tier, so they're skipped
+	_, err = b.budgetThrottle("modeInstance/us-central1-c/pvc-1/vol1", tags)
+	require.Error(t, err)
+
+	b.clients().budget.action = budgetActionSkip
+	_, err = b.createVolumeSnapshot("pvc-1", "us-central1-a__us-central1-b", tags)
+	require.Error(t, err)
+	assert.Equal(t, `skipped the snapshot of volume pvc-1 of scheduled backup nightly-1 because budget "prod" (112% of 1000.00 USD) exceeded the budgetThreshold of 100%; label the schedule's backups gcp.velero.io/budget-critical=true to always snapshot their volumes`, err.Error())
+
+	values := make(map[string]float64)
+	pluginMetrics.each(func(m *metric, s *sample) {
+		values[m.name+labelString(s.labels)] = s.value
+	})
+	assert.Equal(t, 1.0, values[`velero_gcp_budget_throttled_snapshots_total{action="archive"}`])
+	assert.Equal(t, 2.0, values[`velero_gcp_budget_throttled_snapshots_total{action="skip"}`])
+}
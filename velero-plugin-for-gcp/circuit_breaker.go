@@ -0,0 +1,243 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// circuitBreakerEnvVar disables the circuit breaker when set to false.
+	circuitBreakerEnvVar = "VELERO_GCP_PLUGIN_CIRCUIT_BREAKER"
+
+	// breakerWindow is the period the failure rate of an API is measured
+	// over.
+	breakerWindow = time.Minute
+	// breakerMinRequests is the number of requests in a window below which
+	// the breaker doesn't trip, so a few failures don't.
+	breakerMinRequests = 20
+	// breakerFailureRatio is the share of failed requests in a window at
+	// which the breaker trips.
+	breakerFailureRatio = 0.5
+	// breakerCooldown is how long a tripped breaker fails requests before
+	// letting one through to probe for recovery.
+	breakerCooldown = 30 * time.Second
+
+	breakerOpenGauge       = "velero_gcp_circuit_breaker_open"
+	breakerRejectedCounter = "velero_gcp_circuit_breaker_rejected_total"
+)
+
+func circuitBreakerEnabled() bool {
+	enabled, err := strconv.ParseBool(os.Getenv(circuitBreakerEnvVar))
+	return err != nil || enabled
+}
+
+// circuitOpenError is returned for requests the breaker of an API rejected.
+// It isn't transient, so the plugin and the client libraries don't retry it.
+type circuitOpenError struct {
+	service  string
+	scope    string
+	failures int
+	requests int
+	retry    time.Duration
+}
+
+func (e *circuitOpenError) Error() string {
+	return fmt.Sprintf("GCP %s API requests %s are failing fast because %d of %d requests failed with server or network errors; the API is probed again in %s. Check the GCP status dashboard and the plugin's network access to the API",
+		e.service, e.scope, e.failures, e.requests, e.retry.Round(time.Second))
+}
+
+// circuitBreaker stops making requests to an API while most of them fail
+// with server or network errors, so a backup fails the rest of its items
+// quickly instead of retrying each of them for a long time. It closes again
+// once a probe request succeeds. Rate limited requests don't count as
+// failures; they're retried with backoff.
+type circuitBreaker struct {
+	log     logrus.FieldLogger
+	service string
+	// endpoint and project are the host and the GCP project of the requests
+	// the breaker counts, so an outage of one regional endpoint or one
+	// project's resources doesn't fail the requests to the others.
+	endpoint string
+	project  string
+	now      func() time.Time
+
+	lock sync.Mutex
+	// requests and failures count the outcomes of the requests made since
+	// windowStart while the breaker is closed.
+	requests    int
+	failures    int
+	windowStart time.Time
+	// openedAt is when the breaker tripped, if it's open. tripFailures and
+	// tripRequests are the counts it tripped at.
+	openedAt     time.Time
+	tripFailures int
+	tripRequests int
+	probing      bool
+}
+
+var (
+	circuitBreakersLock sync.Mutex
+	// circuitBreakers holds the breaker of each API, endpoint and project,
+	// which all of the process's clients of the API share.
+	circuitBreakers = make(map[string]*circuitBreaker)
+)
+
+// circuitBreakerFor returns the breaker of the requests to an API endpoint
+// about a project's resources. The project is empty for APIs whose requests
+// don't name one, such as Cloud Storage's.
+func circuitBreakerFor(log logrus.FieldLogger, service, endpoint, project string) *circuitBreaker {
+	circuitBreakersLock.Lock()
+	defer circuitBreakersLock.Unlock()
+	key := service + " " + endpoint + " " + project
+	b, ok := circuitBreakers[key]
+	if !ok {
+		b = &circuitBreaker{
+			log:      log.WithFields(logrus.Fields{"service": service, "endpoint": endpoint, "project": project}),
+			service:  service,
+			endpoint: endpoint,
+			project:  project,
+			now:      time.Now,
+		}
+		circuitBreakers[key] = b
+	}
+	return b
+}
+
+// scope describes the requests the breaker counts.
+func (b *circuitBreaker) scope() string {
+	if b.project == "" {
+		return "to " + b.endpoint
+	}
+	return fmt.Sprintf("to %s for project %s", b.endpoint, b.project)
+}
+
+func (b *circuitBreaker) labels() map[string]string {
+	return map[string]string{"service": b.service, "endpoint": b.endpoint, "project": b.project}
+}
+
+// allow returns an error if the breaker is open, or lets the request
+// through. Once the cooldown has passed, a single request is let through
+// to probe the API.
+func (b *circuitBreaker) allow() error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if b.openedAt.IsZero() {
+		return nil
+	}
+	wait := breakerCooldown - b.now().Sub(b.openedAt)
+	if wait <= 0 && !b.probing {
+		b.probing = true
+		return nil
+	}
+	if wait < 0 {
+		wait = 0
+	}
+	pluginMetrics.addCounter(breakerRejectedCounter, "Number of GCP API requests rejected by an open circuit breaker.", b.labels(), 1)
+	return &circuitOpenError{service: b.service, scope: b.scope(), failures: b.tripFailures, requests: b.tripRequests, retry: wait}
+}
+
+// record counts the outcome of a request the breaker let through, and trips
+// or closes the breaker.
+func (b *circuitBreaker) record(failed bool) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	now := b.now()
+	if !b.openedAt.IsZero() {
+		if !b.probing {
+			// a request let through before the breaker tripped
+			return
+		}
+		b.probing = false
+		if failed {
+			b.openedAt = now
+			b.log.Warnf("GCP %s API requests %s are still failing, failing them fast for another %s", b.service, b.scope(), breakerCooldown)
+			return
+		}
+		b.log.Infof("GCP %s API requests %s recovered, resuming them", b.service, b.scope())
+		b.openedAt = time.Time{}
+		b.requests, b.failures, b.windowStart = 0, 0, now
+		b.setGauge(0)
+		return
+	}
+
+	if now.Sub(b.windowStart) >= breakerWindow {
+		b.requests, b.failures, b.windowStart = 0, 0, now
+	}
+	b.requests++
+	if failed {
+		b.failures++
+	}
+	if b.requests >= breakerMinRequests && float64(b.failures) >= breakerFailureRatio*float64(b.requests) {
+		b.openedAt = now
+		b.tripFailures, b.tripRequests = b.failures, b.requests
+		b.log.Warnf("%d of %d GCP %s API requests %s failed with server or network errors in the last %s; failing them fast for %s before probing the API again",
+			b.failures, b.requests, b.service, b.scope(), now.Sub(b.windowStart).Round(time.Second), breakerCooldown)
+		b.setGauge(1)
+	}
+}
+
+// abandon lets another request probe the API if a probe was canceled.
+func (b *circuitBreaker) abandon() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.probing = false
+}
+
+func (b *circuitBreaker) setGauge(v float64) {
+	pluginMetrics.setGauge(breakerOpenGauge, "Whether the circuit breaker of a GCP API endpoint and project is open, failing requests fast.", b.labels(), v)
+}
+
+// circuitBreakerTransport makes requests through the circuit breaker of
+// their API, endpoint and project.
+type circuitBreakerTransport struct {
+	log     logrus.FieldLogger
+	service string
+	base    http.RoundTripper
+}
+
+func (t *circuitBreakerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	_, project := auditResource(req.URL)
+	breaker := circuitBreakerFor(t.log, t.service, req.URL.Host, project)
+	if err := breaker.allow(); err != nil {
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		return nil, err
+	}
+
+	res, err := t.base.RoundTrip(req)
+	switch {
+	case err != nil && req.Context().Err() != nil:
+		// requests canceled by the caller don't say anything about the API
+		breaker.abandon()
+	case err != nil:
+		breaker.record(true)
+	default:
+		breaker.record(res.StatusCode >= http.StatusInternalServerError)
+	}
+	return res, err
+}
@@ -0,0 +1,171 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/api/compute/v1"
+	"google.golang.org/api/option"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	defer func(registry *metricsRegistry) { pluginMetrics = registry }(pluginMetrics)
+	pluginMetrics = newMetricsRegistry()
+
+	logger, hook := logtest.NewNullLogger()
+	now := time.Now()
+	breaker := &circuitBreaker{log: logger, service: computeService, endpoint: "compute.googleapis.com", project: "p", now: func() time.Time { return now }}
+
+	// failures below the minimum number of requests don't trip the breaker
+	for i := 0; i < breakerMinRequests-1; i++ {
+		require.NoError(t, breaker.allow())
+		breaker.record(true)
+	}
+	// and neither do failures spread over windows
+	now = now.Add(breakerWindow)
+	for i := 0; i < breakerMinRequests-1; i++ {
+		require.NoError(t, breaker.allow())
+		breaker.record(i%3 == 0)
+	}
+	require.NoError(t, breaker.allow())
+	breaker.record(false)
+	assert.Empty(t, hook.AllEntries())
+
+	now = now.Add(breakerWindow)
+	for i := 0; i < breakerMinRequests; i++ {
+		require.NoError(t, breaker.allow())
+		breaker.record(true)
+	}
+	require.Len(t, hook.AllEntries(), 1)
+	assert.Equal(t, logrus.WarnLevel, hook.LastEntry().Level)
+	assert.Contains(t, hook.LastEntry().Message, "20 of 20 GCP compute API requests to compute.googleapis.com for project p failed with server or network errors")
+
+	err := breaker.allow()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "GCP compute API requests to compute.googleapis.com for project p are failing fast because 20 of 20 requests failed with server or network errors; the API is probed again in 30s")
+	assert.Equal(t, fatalError, classifyError(err), "rejected requests aren't retried")
+
+	// once the cooldown passed, a single request probes the API
+	now = now.Add(breakerCooldown)
+	require.NoError(t, breaker.allow())
+	assert.Error(t, breaker.allow())
+	breaker.record(true)
+	assert.Error(t, breaker.allow(), "a failed probe opens the breaker again")
+
+	now = now.Add(breakerCooldown)
+	require.NoError(t, breaker.allow())
+	breaker.record(false)
+	assert.NoError(t, breaker.allow())
+	assert.Equal(t, logrus.InfoLevel, hook.LastEntry().Level)
+
+	values := make(map[string]float64)
+	pluginMetrics.each(func(m *metric, s *sample) {
+		values[m.name+labelString(s.labels)] = s.value
+	})
+	assert.Equal(t, map[string]float64{
+		`velero_gcp_circuit_breaker_open{endpoint="compute.googleapis.com",project="p",service="compute"}`:           0,
+		`velero_gcp_circuit_breaker_rejected_total{endpoint="compute.googleapis.com",project="p",service="compute"}`: 3,
+	}, values)
+}
+
+func TestCircuitBreakerTransport(t *testing.T) {
+	failing := true
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if failing {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		if r.URL.Path == "/compute/v1/projects/p/zones/z/disks/throttled" {
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		w.Write([]byte(`{"name":"d"}`))
+	}))
+	defer server.Close()
+
+	defer func(breakers map[string]*circuitBreaker) { circuitBreakers = breakers }(circuitBreakers)
+	circuitBreakers = make(map[string]*circuitBreaker)
+	serverURL, err := url.Parse(server.URL)
+	require.NoError(t, err)
+	now := time.Now()
+	breaker := circuitBreakerFor(logrus.New(), computeService, serverURL.Host, "p")
+	breaker.now = func() time.Time { return now }
+	transport := &circuitBreakerTransport{log: logrus.New(), service: computeService, base: http.DefaultTransport}
+	gce, err := compute.NewService(context.Background(),
+		option.WithEndpoint(server.URL+"/compute/v1/"),
+		option.WithHTTPClient(&http.Client{Transport: transport}),
+	)
+	require.NoError(t, err)
+
+	for i := 0; i < breakerMinRequests; i++ {
+		_, err = gce.Disks.Get("p", "z", "d").Do()
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "503")
+	}
+	_, err = gce.Disks.Get("p", "z", "d").Do()
+	var open *circuitOpenError
+	assert.True(t, errors.As(err, &open))
+
+	// the requests for other projects have breakers of their own
+	failing = false
+	_, err = gce.Disks.Get("q", "z", "d").Do()
+	require.NoError(t, err)
+	_, err = gce.Disks.Get("p", "z", "d").Do()
+	assert.True(t, errors.As(err, &open))
+
+	failing = false
+	now = now.Add(breakerCooldown)
+	_, err = gce.Disks.Get("p", "z", "d").Do()
+	require.NoError(t, err)
+
+	// rate limited requests aren't failures
+	for i := 0; i < breakerMinRequests; i++ {
+		gce.Disks.Get("p", "z", "throttled").Do()
+	}
+	_, err = gce.Disks.Get("p", "z", "d").Do()
+	assert.NoError(t, err)
+
+	// canceled probes let another request probe the API
+	breaker.openedAt = now.Add(-breakerCooldown)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, server.URL+"/compute/v1/projects/p/zones/z/disks/d", nil)
+	_, err = transport.RoundTrip(req)
+	assert.Error(t, err)
+	assert.False(t, breaker.probing)
+}
+
+func TestCircuitBreakerEnabled(t *testing.T) {
+	defer os.Unsetenv(circuitBreakerEnvVar)
+
+	os.Unsetenv(circuitBreakerEnvVar)
+	assert.True(t, circuitBreakerEnabled())
+	os.Setenv(circuitBreakerEnvVar, "false")
+	assert.False(t, circuitBreakerEnabled())
+}
@@ -0,0 +1,208 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// clientsReloadBackoff is how long the clients of a location are kept
+	// after rebuilding them failed before it's attempted again, doubling
+	// with each further failure up to maxClientsReloadBackoff.
+	clientsReloadBackoff    = 10 * time.Second
+	maxClientsReloadBackoff = 5 * time.Minute
+)
+
+var (
+	sharedTransportOnce sync.Once
+	sharedTransport     *http.Transport
+)
+
+// sharedBaseTransport returns the transport the API clients of all locations
+// make their requests through, so they share one pool of connections
+// instead of each opening their own, and requests to an API reuse the
+// connections and TLS sessions earlier requests to it opened. It's set up
+// the way the client libraries set up their own.
+func sharedBaseTransport() *http.Transport {
+	sharedTransportOnce.Do(func() {
+		sharedTransport = http.DefaultTransport.(*http.Transport).Clone()
+		sharedTransport.MaxIdleConnsPerHost = 100
+	})
+	return sharedTransport
+}
+
+// locationClientCache holds the API clients built for each location, so
+// initializing a location that was already initialized in the process, as
+// Velero does for each controller and operation using it, reuses its
+// clients instead of building new ones. Clients are keyed by the endpoint
+// and credentials they were built with, and forgotten when their requests
+// can't reach GCP or their credentials are rejected, so they're rebuilt
+// with a newly selected endpoint and credentials read again.
+type locationClientCache struct {
+	lock    sync.Mutex
+	clients map[string]map[string]interface{}
+}
+
+// locationClients is the process's cache of location API clients.
+var locationClients = &locationClientCache{clients: make(map[string]map[string]interface{})}
+
+// locationKey identifies a location's clients by its kind, its config, the
+// endpoint selected for it and the version of its credentials.
+func locationKey(kind string, config map[string]string, endpoint string, credentials locationCredentials) string {
+	keys := make([]string, 0, len(config))
+	for k := range config {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var b strings.Builder
+	b.WriteString(kind)
+	for _, k := range keys {
+		b.WriteString("\x00" + k + "=" + config[k])
+	}
+	b.WriteString("\x00endpoint=" + endpoint)
+	b.WriteString("\x00credentials=" + credentials.version())
+	return b.String()
+}
+
+// get returns the location's client for a service, building it the first
+// time. Errors aren't cached.
+func (c *locationClientCache) get(location, service string, build func() (interface{}, error)) (interface{}, error) {
+	c.lock.Lock()
+	client, ok := c.clients[location][service]
+	c.lock.Unlock()
+	if ok {
+		return client, nil
+	}
+
+	client, err := build()
+	if err != nil {
+		return nil, err
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.clients[location] == nil {
+		c.clients[location] = make(map[string]interface{})
+	}
+	c.clients[location][service] = client
+	return client, nil
+}
+
+// forget drops the clients of a location, whose credentials changed or whose
+// requests failed.
+func (c *locationClientCache) forget(location string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	delete(c.clients, location)
+}
+
+// forgotten reports whether the clients of a location were forgotten since
+// they were built.
+func (c *locationClientCache) forgotten(location string) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	_, ok := c.clients[location]
+	return !ok
+}
+
+type locationKeyContextKey struct{}
+
+// withLocationKey returns a context building the clients of a location,
+// whose requests forget its clients when they fail.
+func withLocationKey(ctx context.Context, location string) context.Context {
+	return context.WithValue(ctx, locationKeyContextKey{}, location)
+}
+
+func locationKeyFrom(ctx context.Context) string {
+	location, _ := ctx.Value(locationKeyContextKey{}).(string)
+	return location
+}
+
+// evictingTransport forgets the clients of a location, and the endpoint
+// probes, when a request can't reach GCP or its credentials are rejected.
+type evictingTransport struct {
+	location string
+	base     http.RoundTripper
+}
+
+func (t *evictingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	res, err := t.base.RoundTrip(req)
+	switch {
+	case err != nil && req.Context().Err() == nil, err == nil && res.StatusCode == http.StatusUnauthorized:
+		locationClients.forget(t.location)
+		endpointProbes.forget()
+	}
+	return res, err
+}
+
+// clientsReload rebuilds the clients of an object store or volume snapshotter
+// when its credentials changed or its clients were forgotten, one call at a
+// time. The rebuilt clients replace the current ones only once they're
+// built, and the current ones are kept after a failed rebuild, which isn't
+// attempted again until its backoff passed, so every call doesn't repeat it.
+type clientsReload struct {
+	lock     sync.Mutex
+	failures int
+	retry    time.Time
+	now      func() time.Time
+}
+
+// reload rebuilds the clients identified by key in locationClients if the
+// watcher saw the credentials change or the clients were forgotten.
+func (r *clientsReload) reload(log logrus.FieldLogger, watcher *credentialsWatcher, key string, rebuild func() error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	now := time.Now
+	if r.now != nil {
+		now = r.now
+	}
+	if now().Before(r.retry) {
+		return
+	}
+
+	switch {
+	case watcher.changed():
+		log.Info("Credentials changed, rebuilding GCP clients")
+		locationClients.forget(key)
+	case key != "" && locationClients.forgotten(key):
+		log.Info("GCP requests failed, rebuilding GCP clients")
+	default:
+		return
+	}
+
+	if err := rebuild(); err != nil {
+		backoff := clientsReloadBackoff << r.failures
+		if backoff > maxClientsReloadBackoff || backoff <= 0 {
+			backoff = maxClientsReloadBackoff
+		}
+		r.failures++
+		r.retry = now().Add(backoff)
+		log.WithError(err).Warnf("Unable to rebuild GCP clients, continuing with the existing ones and retrying in %s", backoff)
+		return
+	}
+	r.failures, r.retry = 0, time.Time{}
+}
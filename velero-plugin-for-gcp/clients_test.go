@@ -0,0 +1,256 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	velerotest "github.com/vmware-tanzu/velero/pkg/test"
+)
+
+func TestLocationKey(t *testing.T) {
+	credentials := locationCredentials{json: []byte(`{"type":"service_account"}`)}
+	key := locationKey("VolumeSnapshotLocation", map[string]string{projectKey: "p", snapshotLocationKey: "us"}, "", credentials)
+	assert.Equal(t, key, locationKey("VolumeSnapshotLocation", map[string]string{snapshotLocationKey: "us", projectKey: "p"}, "", credentials))
+	assert.NotEqual(t, key, locationKey("VolumeSnapshotLocation", map[string]string{projectKey: "p"}, "", credentials))
+	assert.NotEqual(t, key, locationKey("BackupStorageLocation", map[string]string{projectKey: "p", snapshotLocationKey: "us"}, "", credentials))
+
+	// clients built for another endpoint or with rotated credentials
+	// aren't reused
+	assert.NotEqual(t, key, locationKey("VolumeSnapshotLocation", map[string]string{projectKey: "p", snapshotLocationKey: "us"}, "private.googleapis.com", credentials))
+	rotated := locationCredentials{json: []byte(`{"type":"service_account","private_key_id":"2"}`)}
+	assert.NotEqual(t, key, locationKey("VolumeSnapshotLocation", map[string]string{projectKey: "p", snapshotLocationKey: "us"}, "", rotated))
+	assert.NotEqual(t, key, locationKey("VolumeSnapshotLocation", map[string]string{projectKey: "p", snapshotLocationKey: "us"}, "", locationCredentials{file: "/credentials/cloud"}))
+}
+
+func TestEvictingTransport(t *testing.T) {
+	defer func(cache *locationClientCache) { locationClients = cache }(locationClients)
+	locationClients = &locationClientCache{clients: make(map[string]map[string]interface{})}
+
+	status := http.StatusOK
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(status) }))
+	defer server.Close()
+	client := &http.Client{Transport: &evictingTransport{location: "location", base: http.DefaultTransport}}
+	cache := func() {
+		_, err := locationClients.get("location", computeService, func() (interface{}, error) { return client, nil })
+		require.NoError(t, err)
+	}
+
+	cache()
+	_, err := client.Get(server.URL)
+	require.NoError(t, err)
+	assert.False(t, locationClients.forgotten("location"))
+
+	// rejected credentials
+	status = http.StatusUnauthorized
+	_, err = client.Get(server.URL)
+	require.NoError(t, err)
+	assert.True(t, locationClients.forgotten("location"))
+
+	// unreachable endpoints
+	cache()
+	server.Close()
+	_, err = client.Get(server.URL)
+	require.Error(t, err)
+	assert.True(t, locationClients.forgotten("location"))
+}
+
+func TestLocationClientCache(t *testing.T) {
+	cache := &locationClientCache{clients: make(map[string]map[string]interface{})}
+	builds := 0
+	build := func() (interface{}, error) {
+		builds++
+		return &builds, nil
+	}
+
+	first, err := cache.get("location", computeService, build)
+	require.NoError(t, err)
+	second, err := cache.get("location", computeService, build)
+	require.NoError(t, err)
+	assert.Same(t, first, second)
+	assert.Equal(t, 1, builds)
+
+	_, err = cache.get("location", filestoreService, build)
+	require.NoError(t, err)
+	_, err = cache.get("other", computeService, build)
+	require.NoError(t, err)
+	assert.Equal(t, 3, builds)
+
+	cache.forget("location")
+	_, err = cache.get("location", computeService, build)
+	require.NoError(t, err)
+	assert.Equal(t, 4, builds)
+
+	// errors aren't cached
+	_, err = cache.get("failing", computeService, func() (interface{}, error) { return nil, errors.New("no credentials") })
+	assert.Error(t, err)
+	_, err = cache.get("failing", computeService, build)
+	assert.NoError(t, err)
+}
+
+func TestInitReusesLocationClients(t *testing.T) {
+	defer func(cache *locationClientCache) { locationClients = cache }(locationClients)
+	locationClients = &locationClientCache{clients: make(map[string]map[string]interface{})}
+
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	require.NoError(t, ioutil.WriteFile(tokenFile, []byte("token"), 0600))
+
+	vslConfig := map[string]string{projectKey: "my-project", accessTokenFileConfigKey: tokenFile}
+	b1 := newVolumeSnapshotter(velerotest.NewLogger())
+	require.NoError(t, b1.Init(vslConfig))
+	b2 := newVolumeSnapshotter(velerotest.NewLogger())
+	require.NoError(t, b2.Init(vslConfig))
+	assert.Same(t, b1.clients().gce, b2.clients().gce)
+
+	locationClients.forget(b1.clients().clientsKey)
+	b3 := newVolumeSnapshotter(velerotest.NewLogger())
+	require.NoError(t, b3.Init(vslConfig))
+	assert.NotSame(t, b1.clients().gce, b3.clients().gce)
+
+	// clients forgotten after their requests failed are rebuilt on the
+	// next call
+	locationClients.forget(b3.clients().clientsKey)
+	b3.reloadCredentials()
+	assert.False(t, locationClients.forgotten(b3.clients().clientsKey))
+	assert.NotSame(t, b1.clients().gce, b3.clients().gce)
+
+	bslConfig := map[string]string{"bucket": "b", serviceAccountConfig: "velero@my-project.iam.gserviceaccount.com", accessTokenFileConfigKey: tokenFile}
+	o1 := newObjectStore(velerotest.NewLogger())
+	require.NoError(t, o1.Init(bslConfig))
+	o2 := newObjectStore(velerotest.NewLogger())
+	require.NoError(t, o2.Init(bslConfig))
+	assert.Same(t, o1.clients().client, o2.clients().client)
+
+	// calls in flight keep using the clients they started with while
+	// others rebuild them
+	snapshotterKey, storeKey := b3.clients().clientsKey, o1.clients().clientsKey
+	inFlight, inFlightStore := b3.clients(), o1.clients()
+	gce, bucketWriter := inFlight.gce, inFlightStore.bucketWriter
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			locationClients.forget(snapshotterKey)
+			require.NoError(t, b3.ready())
+			assert.NotNil(t, b3.clients().gce)
+		}()
+		go func() {
+			defer wg.Done()
+			locationClients.forget(storeKey)
+			require.NoError(t, o1.ready())
+			assert.NotNil(t, o1.clients().bucketWriter)
+		}()
+	}
+	wg.Wait()
+	assert.False(t, locationClients.forgotten(snapshotterKey))
+	assert.False(t, locationClients.forgotten(storeKey))
+	assert.Same(t, gce, inFlight.gce)
+	assert.NotSame(t, gce, b3.clients().gce)
+	assert.Same(t, bucketWriter, inFlightStore.bucketWriter)
+}
+
+func TestClientsReloadBackoff(t *testing.T) {
+	defer func(cache *locationClientCache) { locationClients = cache }(locationClients)
+	locationClients = &locationClientCache{clients: make(map[string]map[string]interface{})}
+
+	now := time.Now()
+	r := &clientsReload{now: func() time.Time { return now }}
+	attempts := 0
+	rebuild := func() error {
+		attempts++
+		return errors.New("unable to reach GCP")
+	}
+
+	// the clients of the location were forgotten, and rebuilding them fails
+	r.reload(velerotest.NewLogger(), nil, "location", rebuild)
+	r.reload(velerotest.NewLogger(), nil, "location", rebuild)
+	assert.Equal(t, 1, attempts, "a failed rebuild isn't repeated by every call")
+
+	now = now.Add(clientsReloadBackoff)
+	r.reload(velerotest.NewLogger(), nil, "location", rebuild)
+	assert.Equal(t, 2, attempts)
+
+	now = now.Add(clientsReloadBackoff)
+	r.reload(velerotest.NewLogger(), nil, "location", rebuild)
+	assert.Equal(t, 2, attempts, "the backoff doubles")
+	now = now.Add(clientsReloadBackoff)
+	r.reload(velerotest.NewLogger(), nil, "location", rebuild)
+	assert.Equal(t, 3, attempts)
+
+	now = now.Add(maxClientsReloadBackoff)
+	r.reload(velerotest.NewLogger(), nil, "location", func() error {
+		attempts++
+		_, err := locationClients.get("location", computeService, func() (interface{}, error) { return "client", nil })
+		return err
+	})
+	assert.Equal(t, 4, attempts)
+	assert.Zero(t, r.failures)
+
+	// clients that weren't forgotten aren't rebuilt
+	r.reload(velerotest.NewLogger(), nil, "location", rebuild)
+	assert.Equal(t, 4, attempts)
+}
+
+func TestReloadCredentialsOnlyRebuildsClients(t *testing.T) {
+	defer func(cache *locationClientCache) { locationClients = cache }(locationClients)
+	locationClients = &locationClientCache{clients: make(map[string]map[string]interface{})}
+
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	require.NoError(t, ioutil.WriteFile(tokenFile, []byte("token"), 0600))
+
+	b := newVolumeSnapshotter(velerotest.NewLogger())
+	require.NoError(t, b.Init(map[string]string{projectKey: "my-project", accessTokenFileConfigKey: tokenFile}))
+	watcher, gce := b.credentialsWatcher, b.clients().gce
+
+	locationClients.forget(b.clients().clientsKey)
+	b.reloadCredentials()
+	assert.NotSame(t, gce, b.clients().gce)
+	assert.Same(t, watcher, b.credentialsWatcher)
+	assert.Equal(t, "my-project", b.snapshotProject)
+}
+
+// withClients sets the clients of a snapshotter built by a test.
+func (b *VolumeSnapshotter) withClients(c *snapshotterClients) *VolumeSnapshotter {
+	b.current.Store(c)
+	return b
+}
+
+// setClients replaces the clients of a snapshotter with a copy changed by
+// update.
+func (b *VolumeSnapshotter) setClients(update func(c *snapshotterClients)) {
+	c := *b.clients()
+	update(&c)
+	b.current.Store(&c)
+}
+
+// setClients replaces the clients of an object store with a copy changed by
+// update.
+func (o *ObjectStore) setClients(update func(c *objectStoreClients)) {
+	c := *o.clients()
+	update(&c)
+	o.current.Store(&c)
+}
@@ -0,0 +1,354 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	veleroplugin "github.com/vmware-tanzu/velero/pkg/plugin/framework"
+	"github.com/vmware-tanzu/velero/pkg/plugin/velero"
+	logging "google.golang.org/api/logging/v2"
+)
+
+const (
+	// cloudLoggingProjectEnvVar is the environment variable holding the
+	// project the plugin's logs are written to in Cloud Logging. They are
+	// only written when it is set.
+	cloudLoggingProjectEnvVar = "VELERO_GCP_PLUGIN_CLOUD_LOGGING_PROJECT"
+
+	// cloudLoggingLevelEnvVar is the environment variable holding the least
+	// severe level of the entries written, e.g. "warning".
+	cloudLoggingLevelEnvVar = "VELERO_GCP_PLUGIN_CLOUD_LOGGING_LEVEL"
+
+	// cloudLoggingClusterEnvVar is the environment variable holding the
+	// cluster the logs are written for, as
+	// projects/PROJECT/locations/LOCATION/clusters/NAME, for clusters whose
+	// name can't be read from the metadata server.
+	cloudLoggingClusterEnvVar = "VELERO_GCP_PLUGIN_CLOUD_LOGGING_CLUSTER"
+
+	// cloudLoggingLogID is the ID of the log the entries are written to.
+	cloudLoggingLogID = "velero-plugin-for-gcp"
+
+	// backupLogLabel and restoreLogLabel are the labels of entries logged
+	// with the name of a backup or restore.
+	backupLogLabel  = "velero.io/backup"
+	restoreLogLabel = "velero.io/restore"
+
+	// logSourceField is the field Velero's plugin logger records the
+	// source location of entries in.
+	logSourceField = "logSource"
+)
+
+var (
+	cloudLoggingOnce sync.Once
+
+	// logEntryQueueSize is how many entries can wait to be written before
+	// new ones are dropped.
+	logEntryQueueSize = 1024
+	// maxLogEntryBatch is the most entries written in one request.
+	maxLogEntryBatch = 500
+)
+
+// withCloudLogging returns an initializer starting to write the logs of the
+// plugin process to Cloud Logging, if enabled, before initializing the
+// plugin. Velero gives every plugin of a process the same logger.
+func withCloudLogging(initializer veleroplugin.HandlerInitializer) veleroplugin.HandlerInitializer {
+	return func(logger logrus.FieldLogger) (interface{}, error) {
+		startCloudLogging(logger)
+		return initializer(logger)
+	}
+}
+
+// startCloudLogging starts writing the entries of the logger to Cloud
+// Logging, if a project is configured. It is safe to call more than once.
+func startCloudLogging(log logrus.FieldLogger) {
+	cloudLoggingOnce.Do(func() {
+		project := os.Getenv(cloudLoggingProjectEnvVar)
+		if project == "" {
+			return
+		}
+
+		var logger *logrus.Logger
+		switch l := log.(type) {
+		case *logrus.Logger:
+			logger = l
+		case *logrus.Entry:
+			logger = l.Logger
+		default:
+			log.Warnf("Unable to write logs to Cloud Logging: unsupported logger %T", log)
+			return
+		}
+		// errors writing entries are logged without writing them too
+		log = unhookedLogger(logger).WithField("project", project)
+
+		level := logrus.InfoLevel
+		if val := os.Getenv(cloudLoggingLevelEnvVar); val != "" {
+			parsed, err := logrus.ParseLevel(val)
+			if err != nil {
+				log.Warnf("Invalid %s %q; using %s", cloudLoggingLevelEnvVar, val, level)
+			} else {
+				level = parsed
+			}
+		}
+
+		svc, err := newCloudLoggingService(context.Background())
+		if err != nil {
+			log.WithError(err).Warn("Unable to write logs to Cloud Logging")
+			return
+		}
+
+		h := newCloudLoggingHook(log, svc, project, cloudLoggingResource(log, project, inCluster{}), level)
+		go h.run()
+		logger.AddHook(h)
+	})
+}
+
+// unhookedLogger returns a logger writing like logger, without the hooks
+// added later.
+func unhookedLogger(logger *logrus.Logger) *logrus.Logger {
+	l := logrus.New()
+	l.Out = logger.Out
+	l.Formatter = logger.Formatter
+	l.SetLevel(logger.GetLevel())
+	hooks := make(logrus.LevelHooks)
+	for level, h := range logger.Hooks {
+		hooks[level] = append([]logrus.Hook(nil), h...)
+	}
+	l.ReplaceHooks(hooks)
+	return l
+}
+
+// newCloudLoggingService creates a Cloud Logging client with the
+// credentials from the environment, like item actions without a ConfigMap.
+func newCloudLoggingService(ctx context.Context) (*logging.Service, error) {
+	credentials, err := newLocationCredentials(platformSecrets{}, map[string]string{}, volumeSnapshotterCredentialsEnvVar)
+	if err != nil {
+		return nil, err
+	}
+	opts, err := credentials.clientOptions(ctx, logging.LoggingWriteScope)
+	if err != nil {
+		return nil, err
+	}
+	svc, err := logging.NewService(ctx, opts...)
+	return svc, errors.WithStack(err)
+}
+
+// cloudLoggingResource returns the resource the logs are written for: the
+// cluster Velero runs in, if known, or the project otherwise.
+func cloudLoggingResource(log logrus.FieldLogger, project string, cluster veleroCluster) *logging.MonitoredResource {
+	name := os.Getenv(cloudLoggingClusterEnvVar)
+	if name != "" && !clusterNameRegexp.MatchString(name) {
+		log.Warnf("Invalid %s %q, expected projects/PROJECT/locations/LOCATION/clusters/NAME", cloudLoggingClusterEnvVar, name)
+		name = ""
+	} else if name == "" {
+		name, _ = cluster.name()
+	}
+	if name == "" {
+		return &logging.MonitoredResource{Type: "global", Labels: map[string]string{"project_id": project}}
+	}
+
+	// name is projects/PROJECT/locations/LOCATION/clusters/NAME
+	parts := strings.Split(name, "/")
+	return &logging.MonitoredResource{
+		Type: "k8s_cluster",
+		Labels: map[string]string{
+			"project_id":   parts[1],
+			"location":     parts[3],
+			"cluster_name": parts[5],
+		},
+	}
+}
+
+// cloudLoggingHook writes the entries of a logger to Cloud Logging in the
+// background, so the plugin's operations never wait for it.
+type cloudLoggingHook struct {
+	log       logrus.FieldLogger
+	svc       *logging.Service
+	project   string
+	resource  *logging.MonitoredResource
+	levels    []logrus.Level
+	processID string
+	queue     chan *logging.LogEntry
+}
+
+func newCloudLoggingHook(log logrus.FieldLogger, svc *logging.Service, project string, resource *logging.MonitoredResource, level logrus.Level) *cloudLoggingHook {
+	id := make([]byte, 8)
+	rand.Read(id)
+	var levels []logrus.Level
+	for _, l := range logrus.AllLevels {
+		if l <= level {
+			levels = append(levels, l)
+		}
+	}
+	return &cloudLoggingHook{
+		log:       log,
+		svc:       svc,
+		project:   project,
+		resource:  resource,
+		levels:    levels,
+		processID: hex.EncodeToString(id),
+		queue:     make(chan *logging.LogEntry, logEntryQueueSize),
+	}
+}
+
+func (h *cloudLoggingHook) Levels() []logrus.Level {
+	return h.levels
+}
+
+// Fire schedules an entry to be written, dropping it if too many entries
+// are waiting.
+func (h *cloudLoggingHook) Fire(entry *logrus.Entry) error {
+	select {
+	case h.queue <- h.logEntry(entry):
+	default:
+	}
+	return nil
+}
+
+func (h *cloudLoggingHook) run() {
+	for first := range h.queue {
+		batch := []*logging.LogEntry{first}
+	drain:
+		for len(batch) < maxLogEntryBatch {
+			select {
+			case e := <-h.queue:
+				batch = append(batch, e)
+			default:
+				break drain
+			}
+		}
+		if err := h.write(context.Background(), batch); err != nil {
+			h.log.WithError(err).Warnf("Unable to write %d log entries to Cloud Logging", len(batch))
+		}
+	}
+}
+
+// write writes entries to the plugin's log, keeping the valid ones if others
+// are rejected.
+func (h *cloudLoggingHook) write(ctx context.Context, entries []*logging.LogEntry) error {
+	req := &logging.WriteLogEntriesRequest{
+		LogName:        fmt.Sprintf("projects/%s/logs/%s", h.project, cloudLoggingLogID),
+		Resource:       h.resource,
+		Labels:         map[string]string{processIDLabel: h.processID},
+		Entries:        entries,
+		PartialSuccess: true,
+	}
+	_, err := h.svc.Entries.Write(req).Context(ctx).Do()
+	return errors.Wrapf(err, "error writing %d log entries", len(entries))
+}
+
+// logEntry converts an entry to a structured log entry, whose payload has
+// the message and fields of the entry. Entries naming a backup or restore
+// are labeled with it, and are part of the same trace as its spans.
+func (h *cloudLoggingHook) logEntry(entry *logrus.Entry) *logging.LogEntry {
+	e := &logging.LogEntry{
+		Severity:  logSeverity(entry.Level),
+		Timestamp: entry.Time.UTC().Format(time.RFC3339Nano),
+	}
+
+	payload := map[string]interface{}{"message": entry.Message}
+	for k, v := range entry.Data {
+		switch {
+		// fields of Velero's hooks for the plugin protocol
+		case strings.HasPrefix(k, "@"):
+			continue
+		case k == logSourceField:
+			e.SourceLocation = logSourceLocation(fmt.Sprint(v))
+			continue
+		}
+		if err, ok := v.(error); ok {
+			v = err.Error()
+		} else if _, err := json.Marshal(v); err != nil {
+			v = fmt.Sprint(v)
+		}
+		payload[k] = v
+	}
+	e.JsonPayload, _ = json.Marshal(payload)
+
+	for _, c := range []struct{ field, label string }{{"backup", backupLogLabel}, {"restore", restoreLogLabel}} {
+		val, ok := entry.Data[c.field]
+		if !ok {
+			continue
+		}
+		// the field may be namespace/name
+		name := fmt.Sprint(val)
+		name = name[strings.LastIndex(name, "/")+1:]
+		if name == "" {
+			continue
+		}
+		if e.Labels == nil {
+			e.Labels = make(map[string]string)
+		}
+		e.Labels[c.label] = name
+		if e.Trace == "" {
+			id := traceIDFor(c.field, name)
+			e.Trace = fmt.Sprintf("projects/%s/traces/%s", h.project, hex.EncodeToString(id[:]))
+		}
+	}
+	return e
+}
+
+// restoreName returns the name of the restore of a restore item action's
+// input, for logging.
+func restoreName(input *velero.RestoreItemActionExecuteInput) string {
+	if input.Restore == nil {
+		return ""
+	}
+	return input.Restore.Name
+}
+
+// logSeverity returns the Cloud Logging severity of a level.
+func logSeverity(level logrus.Level) string {
+	switch level {
+	case logrus.PanicLevel:
+		return "ALERT"
+	case logrus.FatalLevel:
+		return "CRITICAL"
+	case logrus.ErrorLevel:
+		return "ERROR"
+	case logrus.WarnLevel:
+		return "WARNING"
+	case logrus.InfoLevel:
+		return "INFO"
+	default:
+		return "DEBUG"
+	}
+}
+
+// logSourceLocation parses the FILE:LINE source location of an entry.
+func logSourceLocation(source string) *logging.LogEntrySourceLocation {
+	i := strings.LastIndex(source, ":")
+	if i < 0 {
+		return &logging.LogEntrySourceLocation{File: source}
+	}
+	line, err := strconv.ParseInt(source[i+1:], 10, 64)
+	if err != nil {
+		return &logging.LogEntrySourceLocation{File: source}
+	}
+	return &logging.LogEntrySourceLocation{File: source[:i], Line: line}
+}
@@ -0,0 +1,136 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	velerotest "github.com/vmware-tanzu/velero/pkg/test"
+	logging "google.golang.org/api/logging/v2"
+	"google.golang.org/api/option"
+)
+
+func TestCloudLoggingResource(t *testing.T) {
+	defer os.Unsetenv(cloudLoggingClusterEnvVar)
+	log := velerotest.NewLogger()
+
+	cluster := &fakeCluster{}
+	assert.Equal(t, &logging.MonitoredResource{Type: "global", Labels: map[string]string{"project_id": "logs"}}, cloudLoggingResource(log, "logs", cluster))
+
+	cluster.clusterName = "projects/p/locations/us-central1/clusters/prod"
+	assert.Equal(t, &logging.MonitoredResource{
+		Type:   "k8s_cluster",
+		Labels: map[string]string{"project_id": "p", "location": "us-central1", "cluster_name": "prod"},
+	}, cloudLoggingResource(log, "logs", cluster))
+
+	// the environment names clusters outside of GKE
+	os.Setenv(cloudLoggingClusterEnvVar, "projects/q/locations/on-prem/clusters/dc1")
+	assert.Equal(t, "dc1", cloudLoggingResource(log, "logs", cluster).Labels["cluster_name"])
+	os.Setenv(cloudLoggingClusterEnvVar, "dc1")
+	assert.Equal(t, "global", cloudLoggingResource(log, "logs", cluster).Type)
+}
+
+func TestCloudLoggingHook(t *testing.T) {
+	requests := make(chan *logging.WriteLogEntriesRequest, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/v2/entries:write", r.URL.Path)
+		req := new(logging.WriteLogEntriesRequest)
+		require.NoError(t, json.NewDecoder(r.Body).Decode(req))
+		requests <- req
+		w.Write([]byte("{}"))
+	}))
+	defer server.Close()
+	svc, err := logging.NewService(context.Background(), option.WithEndpoint(server.URL), option.WithoutAuthentication())
+	require.NoError(t, err)
+
+	resource := &logging.MonitoredResource{Type: "global", Labels: map[string]string{"project_id": "logs"}}
+	h := newCloudLoggingHook(velerotest.NewLogger(), svc, "logs", resource, logrus.InfoLevel)
+	h.processID = "p1"
+	go h.run()
+
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+	logger.AddHook(h)
+	logger.WithFields(logrus.Fields{"backup": "velero/nightly", "volume": "pvc-1", logSourceField: "velero-plugin-for-gcp/budget.go:402"}).
+		WithError(errors.New("over budget")).Warn("Archiving the snapshot")
+	logger.Debug("not written")
+
+	var req *logging.WriteLogEntriesRequest
+	select {
+	case req = <-requests:
+	case <-time.After(10 * time.Second):
+		t.Fatal("no entries were written")
+	}
+	assert.Equal(t, "projects/logs/logs/velero-plugin-for-gcp", req.LogName)
+	assert.Equal(t, resource, req.Resource)
+	assert.Equal(t, map[string]string{processIDLabel: "p1"}, req.Labels)
+	assert.True(t, req.PartialSuccess)
+	require.Len(t, req.Entries, 1)
+
+	entry := req.Entries[0]
+	assert.Equal(t, "WARNING", entry.Severity)
+	assert.Equal(t, map[string]string{backupLogLabel: "nightly"}, entry.Labels)
+	id := traceIDFor("backup", "nightly")
+	assert.Equal(t, "projects/logs/traces/"+hex.EncodeToString(id[:]), entry.Trace)
+	assert.Equal(t, &logging.LogEntrySourceLocation{File: "velero-plugin-for-gcp/budget.go", Line: 402}, entry.SourceLocation)
+	var payload map[string]interface{}
+	require.NoError(t, json.Unmarshal(entry.JsonPayload, &payload))
+	assert.Equal(t, map[string]interface{}{
+		"message": "Archiving the snapshot",
+		"backup":  "velero/nightly",
+		"volume":  "pvc-1",
+		"error":   "over budget",
+	}, payload)
+}
+
+func TestLogEntry(t *testing.T) {
+	h := newCloudLoggingHook(velerotest.NewLogger(), nil, "logs", nil, logrus.DebugLevel)
+	assert.Equal(t, []logrus.Level{logrus.PanicLevel, logrus.FatalLevel, logrus.ErrorLevel, logrus.WarnLevel, logrus.InfoLevel, logrus.DebugLevel}, h.Levels())
+
+	entry := h.logEntry(&logrus.Entry{
+		Level:   logrus.DebugLevel,
+		Time:    time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+		Message: "Restoring",
+		Data:    logrus.Fields{"restore": "nightly-1", "@level": "debug", "channel": make(chan int)},
+	})
+	assert.Equal(t, "DEBUG", entry.Severity)
+	assert.Equal(t, "2024-01-01T00:00:00Z", entry.Timestamp)
+	assert.Equal(t, map[string]string{restoreLogLabel: "nightly-1"}, entry.Labels)
+	assert.NotEmpty(t, entry.Trace)
+	var payload map[string]interface{}
+	require.NoError(t, json.Unmarshal(entry.JsonPayload, &payload))
+	assert.Equal(t, "Restoring", payload["message"])
+	assert.NotContains(t, payload, "@level")
+	assert.IsType(t, "", payload["channel"])
+
+	// entries without a backup or restore aren't correlated
+	entry = h.logEntry(&logrus.Entry{Level: logrus.InfoLevel, Message: "Initialized", Data: logrus.Fields{"restore": ""}})
+	assert.Empty(t, entry.Labels)
+	assert.Empty(t, entry.Trace)
+}
@@ -0,0 +1,290 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	monitoring "google.golang.org/api/monitoring/v3"
+)
+
+const (
+	// cloudMonitoringProjectEnvVar is the environment variable holding the
+	// project the plugin's metrics are written to in Cloud Monitoring. They
+	// are only written when it is set.
+	cloudMonitoringProjectEnvVar = "VELERO_GCP_PLUGIN_CLOUD_MONITORING_PROJECT"
+
+	// cloudMonitoringIntervalEnvVar is the environment variable holding how
+	// often metrics are written, e.g. "30s".
+	cloudMonitoringIntervalEnvVar = "VELERO_GCP_PLUGIN_CLOUD_MONITORING_INTERVAL"
+
+	defaultCloudMonitoringInterval = time.Minute
+
+	// cloudMonitoringMetricPrefix is the prefix of the types of the custom
+	// metrics, followed by the Prometheus name without its velero_gcp_
+	// prefix.
+	cloudMonitoringMetricPrefix = "custom.googleapis.com/velero/"
+
+	// maxTimeSeriesPerRequest is the most time series Cloud Monitoring
+	// accepts in one request.
+	maxTimeSeriesPerRequest = 200
+
+	// processIDLabel identifies the plugin process that wrote a time series,
+	// since Velero runs several plugin processes at once, and each one's
+	// cumulative metrics start from zero.
+	processIDLabel = "process_id"
+)
+
+var (
+	cloudMonitoringOnce sync.Once
+
+	// minCloudMonitoringSpacing is the least time between two writes, below
+	// Cloud Monitoring's limit of one point per time series every 5s.
+	minCloudMonitoringSpacing = 10 * time.Second
+
+	// pluginMetricsPusher writes metrics to Cloud Monitoring, if enabled.
+	pluginMetricsPusher *cloudMonitoringPusher
+)
+
+func cloudMonitoringEnabled() bool {
+	return os.Getenv(cloudMonitoringProjectEnvVar) != ""
+}
+
+// startCloudMonitoring starts writing the plugin's metrics to Cloud
+// Monitoring, if a project is configured. It is safe to call more than
+// once.
+func startCloudMonitoring(log logrus.FieldLogger) {
+	cloudMonitoringOnce.Do(func() {
+		project := os.Getenv(cloudMonitoringProjectEnvVar)
+		if project == "" {
+			return
+		}
+		log = log.WithField("project", project)
+
+		interval := defaultCloudMonitoringInterval
+		if val := os.Getenv(cloudMonitoringIntervalEnvVar); val != "" {
+			parsed, err := time.ParseDuration(val)
+			if err != nil || parsed < minCloudMonitoringSpacing {
+				log.Warnf("Invalid %s %q, expected a duration of at least %s; using %s", cloudMonitoringIntervalEnvVar, val, minCloudMonitoringSpacing, interval)
+			} else {
+				interval = parsed
+			}
+		}
+
+		svc, err := newCloudMonitoringService(context.Background(), log)
+		if err != nil {
+			log.WithError(err).Warn("Unable to write metrics to Cloud Monitoring")
+			return
+		}
+
+		p := newCloudMonitoringPusher(log, svc, project, monitoredResource(project, inCluster{}))
+		pluginMetricsPusher = p
+		go p.run(interval)
+	})
+}
+
+// newCloudMonitoringService creates a Cloud Monitoring client with the
+// credentials from the environment, like item actions without a ConfigMap.
+func newCloudMonitoringService(ctx context.Context, log logrus.FieldLogger) (*monitoring.Service, error) {
+	credentials, err := newLocationCredentials(platformSecrets{}, map[string]string{}, volumeSnapshotterCredentialsEnvVar)
+	if err != nil {
+		return nil, err
+	}
+	opts, err := credentials.clientOptions(ctx, monitoring.MonitoringWriteScope)
+	if err != nil {
+		return nil, err
+	}
+	svc, err := monitoring.NewService(ctx, opts...)
+	return svc, errors.WithStack(err)
+}
+
+// monitoredResource returns the resource the metrics are written for: the
+// Velero container when running in GKE, or the project otherwise.
+func monitoredResource(project string, cluster veleroCluster) *monitoring.MonitoredResource {
+	name, err := cluster.name()
+	if err != nil {
+		return &monitoring.MonitoredResource{Type: "global", Labels: map[string]string{"project_id": project}}
+	}
+	// name is projects/PROJECT/locations/LOCATION/clusters/NAME
+	parts := strings.Split(name, "/")
+	if len(parts) != 6 {
+		return &monitoring.MonitoredResource{Type: "global", Labels: map[string]string{"project_id": project}}
+	}
+
+	namespace := "velero"
+	if data, err := ioutil.ReadFile(serviceAccountDir + "/namespace"); err == nil {
+		namespace = strings.TrimSpace(string(data))
+	}
+	pod, _ := os.Hostname()
+	return &monitoring.MonitoredResource{
+		Type: "k8s_container",
+		Labels: map[string]string{
+			"project_id":     project,
+			"location":       parts[3],
+			"cluster_name":   parts[5],
+			"namespace_name": namespace,
+			"pod_name":       pod,
+			"container_name": "velero",
+		},
+	}
+}
+
+// cloudMonitoringPusher periodically writes the plugin's metrics to Cloud
+// Monitoring as custom metrics. Gauges are written as gauges, and counters
+// and histograms as cumulative metrics starting when the process started.
+type cloudMonitoringPusher struct {
+	log       logrus.FieldLogger
+	svc       *monitoring.Service
+	project   string
+	resource  *monitoring.MonitoredResource
+	processID string
+	start     time.Time
+	now       func() time.Time
+	trigger   chan struct{}
+}
+
+func newCloudMonitoringPusher(log logrus.FieldLogger, svc *monitoring.Service, project string, resource *monitoring.MonitoredResource) *cloudMonitoringPusher {
+	id := make([]byte, 8)
+	rand.Read(id)
+	return &cloudMonitoringPusher{
+		log:       log,
+		svc:       svc,
+		project:   project,
+		resource:  resource,
+		processID: hex.EncodeToString(id),
+		start:     time.Now(),
+		now:       time.Now,
+		trigger:   make(chan struct{}, 1),
+	}
+}
+
+// pushSoon makes the pusher write the metrics as soon as it may, e.g. after
+// a snapshot, since Velero stops plugin processes when backups complete.
+func (p *cloudMonitoringPusher) pushSoon() {
+	if p == nil {
+		return
+	}
+	select {
+	case p.trigger <- struct{}{}:
+	default:
+	}
+}
+
+func (p *cloudMonitoringPusher) run(interval time.Duration) {
+	var last time.Time
+	for {
+		select {
+		case <-p.trigger:
+		case <-time.After(interval):
+		}
+		if wait := minCloudMonitoringSpacing - time.Since(last); wait > 0 {
+			time.Sleep(wait)
+		}
+		last = time.Now()
+		if err := p.push(context.Background(), pluginMetrics); err != nil {
+			p.log.WithError(err).Warn("Error writing metrics to Cloud Monitoring")
+		}
+	}
+}
+
+// push writes the current value of every metric in the registry.
+func (p *cloudMonitoringPusher) push(ctx context.Context, registry *metricsRegistry) error {
+	series := p.timeSeries(registry)
+	for len(series) > 0 {
+		n := len(series)
+		if n > maxTimeSeriesPerRequest {
+			n = maxTimeSeriesPerRequest
+		}
+		req := &monitoring.CreateTimeSeriesRequest{TimeSeries: series[:n]}
+		if _, err := p.svc.Projects.TimeSeries.Create("projects/"+p.project, req).Context(ctx).Do(); err != nil {
+			return errors.Wrapf(err, "error writing %d time series", n)
+		}
+		series = series[n:]
+	}
+	return nil
+}
+
+// timeSeries returns a time series with one point for each sample in the
+// registry.
+func (p *cloudMonitoringPusher) timeSeries(registry *metricsRegistry) []*monitoring.TimeSeries {
+	end := p.now().UTC().Format(time.RFC3339Nano)
+	start := p.start.UTC().Format(time.RFC3339Nano)
+
+	var series []*monitoring.TimeSeries
+	registry.each(func(m *metric, s *sample) {
+		labels := make(map[string]string, len(s.labels)+1)
+		for k, v := range s.labels {
+			labels[k] = v
+		}
+		labels[processIDLabel] = p.processID
+
+		ts := &monitoring.TimeSeries{
+			Metric:   &monitoring.Metric{Type: cloudMonitoringMetricPrefix + strings.TrimPrefix(m.name, "velero_gcp_"), Labels: labels},
+			Resource: p.resource,
+		}
+		interval := &monitoring.TimeInterval{StartTime: start, EndTime: end}
+		value := s.value
+		switch m.kind {
+		case "gauge":
+			ts.MetricKind, ts.ValueType = "GAUGE", "DOUBLE"
+			interval.StartTime = ""
+			ts.Points = []*monitoring.Point{{Interval: interval, Value: &monitoring.TypedValue{DoubleValue: &value}}}
+		case "counter":
+			ts.MetricKind, ts.ValueType = "CUMULATIVE", "DOUBLE"
+			ts.Points = []*monitoring.Point{{Interval: interval, Value: &monitoring.TypedValue{DoubleValue: &value}}}
+		case "histogram":
+			ts.MetricKind, ts.ValueType = "CUMULATIVE", "DISTRIBUTION"
+			ts.Points = []*monitoring.Point{{Interval: interval, Value: &monitoring.TypedValue{DistributionValue: distribution(s)}}}
+		default:
+			return
+		}
+		series = append(series, ts)
+	})
+	return series
+}
+
+// distribution converts a histogram sample, whose counts aren't cumulated,
+// to a distribution whose last bucket counts the observations above the
+// largest bound.
+func distribution(s *sample) *monitoring.Distribution {
+	counts := make([]int64, len(s.counts)+1)
+	overflow := int64(s.value)
+	for i, c := range s.counts {
+		counts[i] = int64(c)
+		overflow -= int64(c)
+	}
+	counts[len(s.counts)] = overflow
+
+	d := &monitoring.Distribution{
+		Count:         int64(s.value),
+		BucketOptions: &monitoring.BucketOptions{ExplicitBuckets: &monitoring.Explicit{Bounds: s.buckets}},
+		BucketCounts:  counts,
+	}
+	if s.value > 0 {
+		d.Mean = s.sum / s.value
+	}
+	return d
+}
@@ -0,0 +1,117 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	monitoring "google.golang.org/api/monitoring/v3"
+	"google.golang.org/api/option"
+
+	velerotest "github.com/vmware-tanzu/velero/pkg/test"
+)
+
+func newTestPusher(t *testing.T, handler http.HandlerFunc) *cloudMonitoringPusher {
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+
+	svc, err := monitoring.NewService(context.Background(), option.WithEndpoint(server.URL), option.WithoutAuthentication())
+	require.NoError(t, err)
+	p := newCloudMonitoringPusher(velerotest.NewLogger(), svc, "my-project", &monitoring.MonitoredResource{Type: "global", Labels: map[string]string{"project_id": "my-project"}})
+	p.processID = "p1"
+	p.start = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	p.now = func() time.Time { return p.start.Add(time.Minute) }
+	return p
+}
+
+func TestCloudMonitoringTimeSeries(t *testing.T) {
+	registry := newMetricsRegistry()
+	registry.setGauge(inventoryCountGauge, "help", map[string]string{"schedule": "daily"}, 3)
+	registry.addCounter(snapshotsCounter, "help", map[string]string{"schedule": "daily", "outcome": "success"}, 2)
+	registry.observeHistogram(snapshotDuration, "help", map[string]string{"schedule": "daily"}, []float64{1, 10}, 0.5)
+	registry.observeHistogram(snapshotDuration, "help", map[string]string{"schedule": "daily"}, []float64{1, 10}, 20)
+
+	p := newTestPusher(t, nil)
+	series := p.timeSeries(registry)
+	require.Len(t, series, 3)
+	sort.Slice(series, func(i, j int) bool { return series[i].Metric.Type < series[j].Metric.Type })
+
+	gauge := series[0]
+	assert.Equal(t, "custom.googleapis.com/velero/backup_inventory_count", gauge.Metric.Type)
+	assert.Equal(t, map[string]string{"schedule": "daily", processIDLabel: "p1"}, gauge.Metric.Labels)
+	assert.Equal(t, "global", gauge.Resource.Type)
+	assert.Equal(t, "GAUGE", gauge.MetricKind)
+	assert.Equal(t, "", gauge.Points[0].Interval.StartTime)
+	assert.Equal(t, "2024-01-01T00:01:00Z", gauge.Points[0].Interval.EndTime)
+	assert.Equal(t, 3.0, *gauge.Points[0].Value.DoubleValue)
+
+	histogram := series[1]
+	assert.Equal(t, "custom.googleapis.com/velero/snapshot_duration_seconds", histogram.Metric.Type)
+	assert.Equal(t, "CUMULATIVE", histogram.MetricKind)
+	assert.Equal(t, "DISTRIBUTION", histogram.ValueType)
+	assert.Equal(t, "2024-01-01T00:00:00Z", histogram.Points[0].Interval.StartTime)
+	d := histogram.Points[0].Value.DistributionValue
+	assert.Equal(t, int64(2), d.Count)
+	assert.Equal(t, 10.25, d.Mean)
+	assert.Equal(t, []float64{1, 10}, d.BucketOptions.ExplicitBuckets.Bounds)
+	assert.Equal(t, []int64{1, 0, 1}, []int64(d.BucketCounts))
+
+	counter := series[2]
+	assert.Equal(t, "custom.googleapis.com/velero/snapshots_total", counter.Metric.Type)
+	assert.Equal(t, "CUMULATIVE", counter.MetricKind)
+	assert.Equal(t, "DOUBLE", counter.ValueType)
+	assert.Equal(t, 2.0, *counter.Points[0].Value.DoubleValue)
+}
+
+func TestCloudMonitoringPush(t *testing.T) {
+	var sizes []int
+	p := newTestPusher(t, func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/v3/projects/my-project/timeSeries", r.URL.Path)
+		var req monitoring.CreateTimeSeriesRequest
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+		sizes = append(sizes, len(req.TimeSeries))
+		w.Write([]byte("{}"))
+	})
+
+	registry := newMetricsRegistry()
+	for i := 0; i < maxTimeSeriesPerRequest+1; i++ {
+		registry.setGauge(inventoryCountGauge, "help", map[string]string{"schedule": strconv.Itoa(i)}, 1)
+	}
+	require.NoError(t, p.push(context.Background(), registry))
+	assert.Equal(t, []int{maxTimeSeriesPerRequest, 1}, sizes)
+}
+
+func TestMonitoredResource(t *testing.T) {
+	cluster := &fakeCluster{}
+	assert.Equal(t, &monitoring.MonitoredResource{Type: "global", Labels: map[string]string{"project_id": "p"}}, monitoredResource("p", cluster))
+
+	cluster.clusterName = "projects/p/locations/us-central1/clusters/prod"
+	resource := monitoredResource("p", cluster)
+	assert.Equal(t, "k8s_container", resource.Type)
+	assert.Equal(t, "us-central1", resource.Labels["location"])
+	assert.Equal(t, "prod", resource.Labels["cluster_name"])
+	assert.Equal(t, "velero", resource.Labels["container_name"])
+}
@@ -0,0 +1,218 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	api "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	"github.com/vmware-tanzu/velero/pkg/plugin/framework"
+	"github.com/vmware-tanzu/velero/pkg/plugin/velero"
+	sqladmin "google.golang.org/api/sqladmin/v1beta4"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+const (
+	cloudSQLActionName = "velero.io/gcp-cloudsql"
+
+	// cloudSQLInstancesAnnotation lists the Cloud SQL instances a workload
+	// uses, by connection name (PROJECT:REGION:INSTANCE) or by name in the
+	// action's project.
+	cloudSQLInstancesAnnotation = "gcp.velero.io/cloudsql-instances"
+	// cloudSQLBackupsAnnotation records the IDs of the on-demand backups
+	// taken of the instances, as a JSON object from instance to backup ID.
+	cloudSQLBackupsAnnotation = "gcp.velero.io/cloudsql-backups"
+
+	cloudSQLBackupTimeout = 30 * time.Minute
+)
+
+// cloudSQLPollInterval is how often the status of Cloud SQL backups is
+// checked. It is a variable so tests can shorten it.
+var cloudSQLPollInterval = 5 * time.Second
+
+// cloudSQLBackuper takes on-demand backups of Cloud SQL instances.
+type cloudSQLBackuper interface {
+	// backup takes a backup of an instance, waits for it to complete and
+	// returns its ID.
+	backup(ctx context.Context, project, instance, description string) (int64, error)
+}
+
+type sqlAdminBackuper struct {
+	sql *sqladmin.Service
+}
+
+func (s *sqlAdminBackuper) backup(ctx context.Context, project, instance, description string) (int64, error) {
+	call := s.sql.BackupRuns.Insert(project, instance, &sqladmin.BackupRun{Description: description})
+	setRequestReason(call, requestReasonFrom(ctx))
+	op, err := call.Context(ctx).Do()
+	if err != nil {
+		return 0, errors.Wrapf(err, "error starting backup of Cloud SQL instance %s:%s", project, instance)
+	}
+
+	for op.Status != "DONE" {
+		select {
+		case <-ctx.Done():
+			return 0, errors.Errorf("timed out waiting for backup of Cloud SQL instance %s:%s", project, instance)
+		case <-time.After(cloudSQLPollInterval):
+		}
+		if op, err = s.sql.Operations.Get(project, op.Name).Context(ctx).Do(); err != nil {
+			return 0, errors.Wrapf(err, "error getting backup operation of Cloud SQL instance %s:%s", project, instance)
+		}
+	}
+	if op.Error != nil && len(op.Error.Errors) > 0 {
+		return 0, errors.Errorf("backup of Cloud SQL instance %s:%s failed: %s", project, instance, op.Error.Errors[0].Message)
+	}
+	if op.BackupContext == nil {
+		return 0, errors.Errorf("backup operation of Cloud SQL instance %s:%s has no backup ID", project, instance)
+	}
+	return op.BackupContext.BackupId, nil
+}
+
+// CloudSQLAction is a backup item action that takes on-demand backups of the
+// Cloud SQL instances listed in the cloudSQLInstancesAnnotation of workloads
+// as they are backed up, and records the backup IDs on them, so applications
+// and their databases are backed up together. Each instance is backed up
+// once per Velero backup.
+type CloudSQLAction struct {
+	log     logrus.FieldLogger
+	cluster veleroCluster
+
+	once      sync.Once
+	backuper  cloudSQLBackuper
+	project   string
+	configErr error
+
+	lock    sync.Mutex
+	backups map[string]int64
+}
+
+func newCloudSQLAction(logger logrus.FieldLogger) (interface{}, error) {
+	return &CloudSQLAction{log: logger, cluster: inCluster{}, backups: make(map[string]int64)}, nil
+}
+
+func (a *CloudSQLAction) AppliesTo() (velero.ResourceSelector, error) {
+	return velero.ResourceSelector{}, nil
+}
+
+func (a *CloudSQLAction) init() error {
+	a.once.Do(func() {
+		if a.backuper != nil {
+			return
+		}
+		opts, project, _, err := newActionClientOptions(a.cluster, framework.PluginKindBackupItemAction, cloudSQLActionName, sqladmin.SqlserviceAdminScope)
+		if err != nil {
+			a.configErr = err
+			return
+		}
+		if opts, err = instrumentClientOptions(context.Background(), a.log, sqlAdminService, opts); err != nil {
+			a.configErr = err
+			return
+		}
+		svc, err := sqladmin.NewService(context.Background(), opts...)
+		if err != nil {
+			a.configErr = errors.WithStack(err)
+			return
+		}
+		a.backuper, a.project = &sqlAdminBackuper{sql: svc}, project
+	})
+	return a.configErr
+}
+
+// parseCloudSQLInstance returns the project and name of an instance given by
+// connection name or by name.
+func parseCloudSQLInstance(instance, defaultProject string) (string, string, error) {
+	parts := strings.Split(instance, ":")
+	switch {
+	case len(parts) == 1 && defaultProject != "":
+		return defaultProject, parts[0], nil
+	case len(parts) == 3 && parts[0] != "" && parts[2] != "":
+		return parts[0], parts[2], nil
+	case len(parts) == 4 && parts[0] != "" && parts[3] != "":
+		// domain-scoped projects, e.g. example.com:project:region:instance
+		return parts[0] + ":" + parts[1], parts[3], nil
+	}
+	return "", "", errors.Errorf("invalid Cloud SQL instance %q in %s annotation, expected PROJECT:REGION:INSTANCE", instance, cloudSQLInstancesAnnotation)
+}
+
+func (a *CloudSQLAction) Execute(item runtime.Unstructured, backup *api.Backup) (runtime.Unstructured, []velero.ResourceIdentifier, error) {
+	obj := &unstructured.Unstructured{Object: item.UnstructuredContent()}
+	instances := parseList(obj.GetAnnotations()[cloudSQLInstancesAnnotation])
+	if len(instances) == 0 {
+		return item, nil, nil
+	}
+	if err := a.init(); err != nil {
+		return nil, nil, err
+	}
+
+	log := a.log.WithFields(logrus.Fields{"kind": obj.GetKind(), "namespace": obj.GetNamespace(), "name": obj.GetName()})
+	backups := make(map[string]int64, len(instances))
+	for _, instance := range instances {
+		project, name, err := parseCloudSQLInstance(instance, a.project)
+		if err != nil {
+			return nil, nil, err
+		}
+		id, err := a.backupInstance(log, backup, project, name)
+		if err != nil {
+			return nil, nil, err
+		}
+		backups[instance] = id
+	}
+
+	data, err := json.Marshal(backups)
+	if err != nil {
+		return nil, nil, errors.WithStack(err)
+	}
+	annotations := obj.GetAnnotations()
+	annotations[cloudSQLBackupsAnnotation] = string(data)
+	obj.SetAnnotations(annotations)
+	return obj, nil, nil
+}
+
+// backupInstance returns the ID of the backup of an instance taken for a
+// Velero backup, taking it if this is the first workload using the instance.
+func (a *CloudSQLAction) backupInstance(log logrus.FieldLogger, backup *api.Backup, project, instance string) (int64, error) {
+	// holding the lock while the backup runs keeps other workloads using
+	// the instance from starting another one
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	key := fmt.Sprintf("%s/%s:%s", backup.UID, project, instance)
+	if id, ok := a.backups[key]; ok {
+		return id, nil
+	}
+
+	log.Infof("Taking on-demand backup of Cloud SQL instance %s:%s", project, instance)
+	ctx, cancel := context.WithTimeout(context.Background(), cloudSQLBackupTimeout)
+	defer cancel()
+	ctx = withRequestReason(ctx, requestReason(backupOperation, backup.Name))
+	id, err := a.backuper.backup(ctx, project, instance, cloudSQLBackupDescription(backup))
+	if err != nil {
+		return 0, err
+	}
+	log.Infof("Cloud SQL instance %s:%s backed up as backup %d", project, instance, id)
+
+	a.backups[key] = id
+	return id, nil
+}
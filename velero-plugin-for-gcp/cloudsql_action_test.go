@@ -0,0 +1,144 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	api "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	"google.golang.org/api/option"
+	sqladmin "google.golang.org/api/sqladmin/v1beta4"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+
+	velerotest "github.com/vmware-tanzu/velero/pkg/test"
+)
+
+type fakeCloudSQLBackuper struct {
+	backups []string
+}
+
+func (f *fakeCloudSQLBackuper) backup(ctx context.Context, project, instance, description string) (int64, error) {
+	f.backups = append(f.backups, project+":"+instance)
+	return int64(len(f.backups)), nil
+}
+
+func TestParseCloudSQLInstance(t *testing.T) {
+	tests := []struct {
+		instance        string
+		expectedProject string
+		expectedName    string
+		expectedErr     bool
+	}{
+		{instance: "db-project:us-central1:orders", expectedProject: "db-project", expectedName: "orders"},
+		{instance: "example.com:db-project:us-central1:orders", expectedProject: "example.com:db-project", expectedName: "orders"},
+		{instance: "orders", expectedProject: "default-project", expectedName: "orders"},
+		{instance: "db-project:orders", expectedErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.instance, func(t *testing.T) {
+			project, name, err := parseCloudSQLInstance(test.instance, "default-project")
+			if test.expectedErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, test.expectedProject, project)
+			assert.Equal(t, test.expectedName, name)
+		})
+	}
+}
+
+func TestCloudSQLActionExecute(t *testing.T) {
+	backuper := &fakeCloudSQLBackuper{}
+	action := &CloudSQLAction{log: velerotest.NewLogger(), backups: make(map[string]int64), backuper: backuper, project: "default-project"}
+	action.once.Do(func() {})
+
+	newItem := func(instances string) *unstructured.Unstructured {
+		item := &unstructured.Unstructured{}
+		item.SetKind("Deployment")
+		item.SetNamespace("shop")
+		item.SetName("orders")
+		if instances != "" {
+			item.SetAnnotations(map[string]string{cloudSQLInstancesAnnotation: instances})
+		}
+		return item
+	}
+	backup := &api.Backup{ObjectMeta: metav1.ObjectMeta{Namespace: "velero", Name: "nightly", UID: "uid-1"}}
+
+	out, _, err := action.Execute(newItem("db-project:us-central1:orders, catalog"), backup)
+	require.NoError(t, err)
+	assert.Equal(t, `{"catalog":2,"db-project:us-central1:orders":1}`, out.(*unstructured.Unstructured).GetAnnotations()[cloudSQLBackupsAnnotation])
+
+	// other workloads using an instance share its backup
+	out, _, err = action.Execute(newItem("default-project:us-central1:catalog"), backup)
+	require.NoError(t, err)
+	assert.Equal(t, `{"default-project:us-central1:catalog":2}`, out.(*unstructured.Unstructured).GetAnnotations()[cloudSQLBackupsAnnotation])
+
+	// but not across Velero backups
+	backup.UID = "uid-2"
+	_, _, err = action.Execute(newItem("catalog"), backup)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"db-project:orders", "default-project:catalog", "default-project:catalog"}, backuper.backups)
+
+	out, _, err = action.Execute(newItem(""), backup)
+	require.NoError(t, err)
+	assert.Nil(t, out.(*unstructured.Unstructured).GetAnnotations())
+}
+
+func TestSQLAdminBackuper(t *testing.T) {
+	defer func(orig time.Duration) { cloudSQLPollInterval = orig }(cloudSQLPollInterval)
+	cloudSQLPollInterval = time.Millisecond
+
+	polls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodPost && r.URL.Path == "/sql/v1beta4/projects/db-project/instances/orders/backupRuns":
+			run := new(sqladmin.BackupRun)
+			require.NoError(t, json.NewDecoder(r.Body).Decode(run))
+			assert.Equal(t, "Velero backup velero/nightly", run.Description)
+			json.NewEncoder(w).Encode(&sqladmin.Operation{Name: "op-1", Status: "PENDING"})
+		case r.Method == http.MethodGet && r.URL.Path == "/sql/v1beta4/projects/db-project/operations/op-1":
+			polls++
+			op := &sqladmin.Operation{Name: "op-1", Status: "RUNNING"}
+			if polls > 1 {
+				op.Status, op.BackupContext = "DONE", &sqladmin.BackupContext{BackupId: 1700000000}
+			}
+			json.NewEncoder(w).Encode(op)
+		default:
+			t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	svc, err := sqladmin.NewService(context.Background(), option.WithEndpoint(server.URL), option.WithoutAuthentication())
+	require.NoError(t, err)
+
+	id, err := (&sqlAdminBackuper{sql: svc}).backup(context.Background(), "db-project", "orders", "Velero backup velero/nightly")
+	require.NoError(t, err)
+	assert.Equal(t, int64(1700000000), id)
+	assert.Equal(t, 2, polls)
+}
@@ -0,0 +1,282 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"path"
+	"regexp"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/compute/metadata"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	api "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	"github.com/vmware-tanzu/velero/pkg/plugin/framework"
+	"github.com/vmware-tanzu/velero/pkg/plugin/velero"
+	"google.golang.org/api/container/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+const (
+	clusterContextActionName = "velero.io/gcp-cluster-context"
+
+	// clusterConfigKey is the key of the action's ConfigMap holding the
+	// resource name of the cluster, for clusters whose nodes don't expose
+	// it in their metadata.
+	clusterConfigKey = "cluster"
+)
+
+// clusterNameRegexp matches GKE cluster resource names.
+var clusterNameRegexp = regexp.MustCompile(`^projects/[^/]+/locations/[^/]+/clusters/[^/]+$`)
+
+// clusterContext is the GKE cluster a backup was taken in, as recorded in
+// the backup's directory of its backup storage location.
+type clusterContext struct {
+	Backup         string            `json:"backup"`
+	Cluster        string            `json:"cluster"`
+	Name           string            `json:"name"`
+	Location       string            `json:"location"`
+	MasterVersion  string            `json:"masterVersion"`
+	ReleaseChannel string            `json:"releaseChannel,omitempty"`
+	Autopilot      bool              `json:"autopilot,omitempty"`
+	Network        clusterNetwork    `json:"network"`
+	NodePools      []clusterNodePool `json:"nodePools,omitempty"`
+	WorkloadPool   string            `json:"workloadPool,omitempty"`
+	Recorded       time.Time         `json:"recorded"`
+}
+
+type clusterNetwork struct {
+	Network          string `json:"network"`
+	Subnetwork       string `json:"subnetwork,omitempty"`
+	DatapathProvider string `json:"datapathProvider,omitempty"`
+	IPAliases        bool   `json:"ipAliases,omitempty"`
+	PodCIDR          string `json:"podCidr,omitempty"`
+	ServiceCIDR      string `json:"serviceCidr,omitempty"`
+	PrivateNodes     bool   `json:"privateNodes,omitempty"`
+}
+
+type clusterNodePool struct {
+	Name        string   `json:"name"`
+	Version     string   `json:"version"`
+	Locations   []string `json:"locations,omitempty"`
+	MachineType string   `json:"machineType,omitempty"`
+	DiskType    string   `json:"diskType,omitempty"`
+	DiskSizeGB  int64    `json:"diskSizeGb,omitempty"`
+	ImageType   string   `json:"imageType,omitempty"`
+}
+
+// clusterGetter returns a GKE cluster by resource name.
+type clusterGetter func(ctx context.Context, name string) (*container.Cluster, error)
+
+// ClusterContextAction is a backup item action that records the GKE
+// cluster a backup is taken in, with its version, node pools and network
+// configuration, next to the backup's other files, so restores and audits
+// can check the destination cluster is compatible. It runs once per backup,
+// on the first item backed up.
+type ClusterContextAction struct {
+	log     logrus.FieldLogger
+	cluster veleroCluster
+	now     func() time.Time
+	// newStore returns the object store of a backup storage location.
+	newStore func(log logrus.FieldLogger, location *api.BackupStorageLocation) (manifestStore, error)
+
+	once        sync.Once
+	clusterName string
+	getCluster  clusterGetter
+	initErr     error
+
+	lock     sync.Mutex
+	recorded map[string]bool
+}
+
+func newClusterContextAction(logger logrus.FieldLogger) (interface{}, error) {
+	return &ClusterContextAction{
+		log:      logger,
+		cluster:  inCluster{},
+		now:      time.Now,
+		newStore: newManifestStore,
+		recorded: make(map[string]bool),
+	}, nil
+}
+
+func (a *ClusterContextAction) AppliesTo() (velero.ResourceSelector, error) {
+	return velero.ResourceSelector{}, nil
+}
+
+// name returns the resource name of the cluster from the metadata server of
+// the plugin's node.
+func (inCluster) name() (string, error) {
+	if !metadata.OnGCE() {
+		return "", errors.New("the metadata server is unavailable; set the cluster in the action's ConfigMap")
+	}
+	project, err := metadata.ProjectID()
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	name, err := metadata.InstanceAttributeValue("cluster-name")
+	if err != nil {
+		return "", errors.Wrap(err, "error reading the cluster name from the metadata server")
+	}
+	location, err := metadata.InstanceAttributeValue("cluster-location")
+	if err != nil {
+		return "", errors.Wrap(err, "error reading the cluster location from the metadata server")
+	}
+	return fmt.Sprintf("projects/%s/locations/%s/clusters/%s", project, location, name), nil
+}
+
+// init creates the GKE client from the action's ConfigMap, which can hold
+// the same credentials settings as a VolumeSnapshotLocation.
+func (a *ClusterContextAction) init() error {
+	a.once.Do(func() {
+		if a.getCluster != nil {
+			return
+		}
+
+		opts, _, config, err := newActionClientOptions(a.cluster, framework.PluginKindBackupItemAction, clusterContextActionName, container.CloudPlatformScope)
+		if err != nil {
+			a.initErr = err
+			return
+		}
+		if a.clusterName = config[clusterConfigKey]; a.clusterName == "" {
+			if a.clusterName, err = a.cluster.name(); err != nil {
+				a.initErr = err
+				return
+			}
+		}
+		if !clusterNameRegexp.MatchString(a.clusterName) {
+			a.initErr = errors.Errorf("invalid cluster %q, expected projects/PROJECT/locations/LOCATION/clusters/NAME", a.clusterName)
+			return
+		}
+
+		gke, err := container.NewService(context.Background(), opts...)
+		if err != nil {
+			a.initErr = errors.WithStack(err)
+			return
+		}
+		a.getCluster = func(ctx context.Context, name string) (*container.Cluster, error) {
+			return gke.Projects.Locations.Clusters.Get(name).Context(ctx).Do()
+		}
+	})
+	return a.initErr
+}
+
+func (a *ClusterContextAction) Execute(item runtime.Unstructured, backup *api.Backup) (runtime.Unstructured, []velero.ResourceIdentifier, error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	key := backup.Namespace + "/" + backup.Name
+	if a.recorded[key] {
+		return item, nil, nil
+	}
+	a.recorded[key] = true
+
+	// the cluster context is informational, so failures to record it don't
+	// fail the backup
+	log := a.log.WithField("backup", key)
+	if err := a.record(backup.Name); err != nil {
+		log.WithError(err).Warn("Unable to record the backup's GKE cluster context")
+	} else {
+		log.Info("Recorded the backup's GKE cluster context")
+	}
+	return item, nil, nil
+}
+
+func (a *ClusterContextAction) record(backup string) error {
+	if err := a.init(); err != nil {
+		return err
+	}
+	cluster, err := a.getCluster(context.Background(), a.clusterName)
+	if err != nil {
+		return errors.Wrapf(err, "error getting cluster %s", a.clusterName)
+	}
+	c := newClusterContext(a.clusterName, cluster)
+	c.Backup, c.Recorded = backup, a.now().UTC()
+
+	location, err := a.cluster.backupStorageLocation(backup)
+	if err != nil {
+		return err
+	}
+	if !isGCPProvider(location.Spec.Provider) || location.Spec.ObjectStorage == nil {
+		return errors.Errorf("backup storage location %s isn't a GCS bucket", location.Name)
+	}
+	store, err := a.newStore(a.log, location)
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	return store.PutObject(location.Spec.ObjectStorage.Bucket, clusterContextKey(location.Spec.ObjectStorage.Prefix, backup), bytes.NewReader(data))
+}
+
+// clusterContextKey returns the key of a backup's cluster context, next to
+// the other files of the backup.
+func clusterContextKey(prefix, backup string) string {
+	return path.Join(prefix, "backups", backup, backup+"-gcp-cluster.json")
+}
+
+// newClusterContext returns the context to record of a cluster.
+func newClusterContext(name string, cluster *container.Cluster) clusterContext {
+	c := clusterContext{
+		Cluster:       name,
+		Name:          cluster.Name,
+		Location:      cluster.Location,
+		MasterVersion: cluster.CurrentMasterVersion,
+		Network: clusterNetwork{
+			Network:    cluster.Network,
+			Subnetwork: cluster.Subnetwork,
+		},
+	}
+	if cluster.ReleaseChannel != nil {
+		c.ReleaseChannel = cluster.ReleaseChannel.Channel
+	}
+	if cluster.Autopilot != nil {
+		c.Autopilot = cluster.Autopilot.Enabled
+	}
+	if cluster.WorkloadIdentityConfig != nil {
+		c.WorkloadPool = cluster.WorkloadIdentityConfig.WorkloadPool
+	}
+	if cluster.NetworkConfig != nil {
+		c.Network.DatapathProvider = cluster.NetworkConfig.DatapathProvider
+	}
+	if p := cluster.IpAllocationPolicy; p != nil {
+		c.Network.IPAliases = p.UseIpAliases
+		c.Network.PodCIDR = p.ClusterIpv4CidrBlock
+		c.Network.ServiceCIDR = p.ServicesIpv4CidrBlock
+	}
+	if cluster.PrivateClusterConfig != nil {
+		c.Network.PrivateNodes = cluster.PrivateClusterConfig.EnablePrivateNodes
+	}
+
+	for _, pool := range cluster.NodePools {
+		p := clusterNodePool{Name: pool.Name, Version: pool.Version, Locations: pool.Locations}
+		if pool.Config != nil {
+			p.MachineType = pool.Config.MachineType
+			p.DiskType = pool.Config.DiskType
+			p.DiskSizeGB = pool.Config.DiskSizeGb
+			p.ImageType = pool.Config.ImageType
+		}
+		c.NodePools = append(c.NodePools, p)
+	}
+	return c
+}
@@ -0,0 +1,142 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	api "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	"google.golang.org/api/container/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+
+	velerotest "github.com/vmware-tanzu/velero/pkg/test"
+)
+
+func TestClusterContextActionExecute(t *testing.T) {
+	const name = "projects/p/locations/us-central1/clusters/prod"
+
+	store := &fakeManifestStore{objects: make(map[string][]byte)}
+	location := &api.BackupStorageLocation{
+		ObjectMeta: metav1.ObjectMeta{Name: "default"},
+		Spec: api.BackupStorageLocationSpec{
+			Provider:    "gcp",
+			StorageType: api.StorageType{ObjectStorage: &api.ObjectStorageLocation{Bucket: "bucket", Prefix: "cluster"}},
+		},
+	}
+
+	gets := 0
+	action := &ClusterContextAction{
+		log:         velerotest.NewLogger(),
+		cluster:     &fakeCluster{location: location},
+		now:         func() time.Time { return time.Date(2021, 1, 2, 3, 4, 5, 0, time.UTC) },
+		newStore:    func(logrus.FieldLogger, *api.BackupStorageLocation) (manifestStore, error) { return store, nil },
+		clusterName: name,
+		recorded:    make(map[string]bool),
+		getCluster: func(ctx context.Context, cluster string) (*container.Cluster, error) {
+			gets++
+			assert.Equal(t, name, cluster)
+			return &container.Cluster{
+				Name:                 "prod",
+				Location:             "us-central1",
+				CurrentMasterVersion: "1.21.5-gke.1302",
+				ReleaseChannel:       &container.ReleaseChannel{Channel: "REGULAR"},
+				Network:              "default",
+				Subnetwork:           "nodes",
+				NetworkConfig:        &container.NetworkConfig{DatapathProvider: "ADVANCED_DATAPATH"},
+				IpAllocationPolicy: &container.IPAllocationPolicy{
+					UseIpAliases:          true,
+					ClusterIpv4CidrBlock:  "10.0.0.0/14",
+					ServicesIpv4CidrBlock: "10.4.0.0/20",
+				},
+				PrivateClusterConfig:   &container.PrivateClusterConfig{EnablePrivateNodes: true},
+				WorkloadIdentityConfig: &container.WorkloadIdentityConfig{WorkloadPool: "p.svc.id.goog"},
+				NodePools: []*container.NodePool{
+					{
+						Name:      "default-pool",
+						Version:   "1.21.5-gke.1302",
+						Locations: []string{"us-central1-a", "us-central1-b"},
+						Config:    &container.NodeConfig{MachineType: "e2-standard-4", DiskType: "pd-balanced", DiskSizeGb: 100, ImageType: "COS_CONTAINERD"},
+					},
+				},
+			}, nil
+		},
+	}
+
+	backup := &api.Backup{ObjectMeta: metav1.ObjectMeta{Namespace: "velero", Name: "backup-1"}}
+	item := &unstructured.Unstructured{Object: map[string]interface{}{"apiVersion": "v1", "kind": "Namespace", "metadata": map[string]interface{}{"name": "app"}}}
+	for i := 0; i < 2; i++ {
+		updated, additional, err := action.Execute(item, backup)
+		require.NoError(t, err)
+		assert.Equal(t, item, updated)
+		assert.Empty(t, additional)
+	}
+	// the cluster context is recorded once per backup
+	assert.Equal(t, 1, gets)
+
+	data, ok := store.objects["bucket/cluster/backups/backup-1/backup-1-gcp-cluster.json"]
+	require.True(t, ok)
+	var recorded clusterContext
+	require.NoError(t, json.Unmarshal(data, &recorded))
+	assert.Equal(t, clusterContext{
+		Backup:         "backup-1",
+		Cluster:        name,
+		Name:           "prod",
+		Location:       "us-central1",
+		MasterVersion:  "1.21.5-gke.1302",
+		ReleaseChannel: "REGULAR",
+		Network: clusterNetwork{
+			Network:          "default",
+			Subnetwork:       "nodes",
+			DatapathProvider: "ADVANCED_DATAPATH",
+			IPAliases:        true,
+			PodCIDR:          "10.0.0.0/14",
+			ServiceCIDR:      "10.4.0.0/20",
+			PrivateNodes:     true,
+		},
+		NodePools: []clusterNodePool{
+			{
+				Name:        "default-pool",
+				Version:     "1.21.5-gke.1302",
+				Locations:   []string{"us-central1-a", "us-central1-b"},
+				MachineType: "e2-standard-4",
+				DiskType:    "pd-balanced",
+				DiskSizeGB:  100,
+				ImageType:   "COS_CONTAINERD",
+			},
+		},
+		WorkloadPool: "p.svc.id.goog",
+		Recorded:     action.now(),
+	}, recorded)
+}
+
+func TestClusterContextActionFailureDoesNotFailBackup(t *testing.T) {
+	action := &ClusterContextAction{log: velerotest.NewLogger(), now: time.Now, recorded: make(map[string]bool)}
+	action.once.Do(func() {})
+	action.initErr = assert.AnError
+
+	item := &unstructured.Unstructured{Object: map[string]interface{}{"kind": "Namespace"}}
+	updated, _, err := action.Execute(item, &api.Backup{ObjectMeta: metav1.ObjectMeta{Name: "backup-1"}})
+	require.NoError(t, err)
+	assert.Equal(t, item, updated)
+}
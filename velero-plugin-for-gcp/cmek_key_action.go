@@ -0,0 +1,165 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/vmware-tanzu/velero/pkg/plugin/framework"
+	"github.com/vmware-tanzu/velero/pkg/plugin/velero"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	cmekKeyActionName = "velero.io/gcp-cmek-key"
+
+	// keysConfigKey is the key of the action's ConfigMap holding a YAML map
+	// of source to destination Cloud KMS keys, key rings or locations.
+	keysConfigKey = "keys"
+)
+
+// CMEKKeyAction is a restore item action that replaces the Cloud KMS keys
+// restored StorageClasses encrypt new disks with, and that PVCs refer to in
+// annotations, according to a configured mapping, for restores into a
+// project or cluster whose disks are encrypted with other keys.
+type CMEKKeyAction struct {
+	log     logrus.FieldLogger
+	cluster veleroCluster
+
+	once      sync.Once
+	mapping   kmsKeyMapping
+	configErr error
+}
+
+// kmsKeyMapping maps Cloud KMS key names. Its source entries are either
+// whole key names or prefixes of them, such as a key ring, in which case
+// the rest of the name is kept, e.g. mapping
+// projects/a/locations/us/keyRings/r to projects/b/locations/us/keyRings/r
+// maps every key in the key ring to the key of the same name in project b.
+type kmsKeyMapping map[string]string
+
+func newCMEKKeyAction(logger logrus.FieldLogger) (interface{}, error) {
+	return &CMEKKeyAction{log: logger, cluster: inCluster{}}, nil
+}
+
+func (a *CMEKKeyAction) AppliesTo() (velero.ResourceSelector, error) {
+	return velero.ResourceSelector{
+		IncludedResources: []string{"storageclasses", "persistentvolumeclaims"},
+	}, nil
+}
+
+func (a *CMEKKeyAction) loadConfig() (kmsKeyMapping, error) {
+	a.once.Do(func() {
+		var data map[string]string
+		data, a.configErr = a.cluster.pluginConfig(framework.PluginKindRestoreItemAction, cmekKeyActionName)
+		if a.configErr != nil {
+			return
+		}
+		if err := yaml.Unmarshal([]byte(data[keysConfigKey]), &a.mapping); err != nil {
+			a.configErr = errors.Wrapf(err, "error parsing %s in the %s ConfigMap", keysConfigKey, cmekKeyActionName)
+		}
+	})
+	return a.mapping, a.configErr
+}
+
+// key returns the key a key is mapped to, using the longest matching source
+// entry, and whether it is mapped.
+func (m kmsKeyMapping) key(key string) (string, bool) {
+	var source string
+	for s := range m {
+		if (key == s || strings.HasPrefix(key, strings.TrimSuffix(s, "/")+"/")) && len(s) > len(source) {
+			source = s
+		}
+	}
+	if source == "" {
+		return key, false
+	}
+	return m[source] + key[len(source):], true
+}
+
+// mapKey maps a key, or else the key the item had in the backup, since
+// other actions, such as the region action, may have changed it already.
+func (m kmsKeyMapping) mapKey(key, backedUp string) (string, bool) {
+	if mapped, ok := m.key(key); ok {
+		return mapped, true
+	}
+	if backedUp != "" && backedUp != key {
+		return m.key(backedUp)
+	}
+	return key, false
+}
+
+func (a *CMEKKeyAction) Execute(input *velero.RestoreItemActionExecuteInput) (*velero.RestoreItemActionExecuteOutput, error) {
+	obj := &unstructured.Unstructured{Object: input.Item.UnstructuredContent()}
+
+	mapping, err := a.loadConfig()
+	if err != nil {
+		return nil, err
+	}
+	if len(mapping) == 0 {
+		return velero.NewRestoreItemActionExecuteOutput(obj), nil
+	}
+
+	var fromBackup *unstructured.Unstructured
+	if input.ItemFromBackup != nil {
+		fromBackup = &unstructured.Unstructured{Object: input.ItemFromBackup.UnstructuredContent()}
+	} else {
+		fromBackup = obj.DeepCopy()
+	}
+	log := a.log.WithFields(logrus.Fields{"restore": restoreName(input), "kind": obj.GetKind(), "namespace": obj.GetNamespace(), "name": obj.GetName()})
+
+	switch obj.GetKind() {
+	case "StorageClass":
+		key, found, err := unstructured.NestedString(obj.Object, "parameters", kmsKeyParameter)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		if !found {
+			break
+		}
+		backedUp, _, _ := unstructured.NestedString(fromBackup.Object, "parameters", kmsKeyParameter)
+		if mapped, ok := mapping.mapKey(key, backedUp); ok && mapped != key {
+			log.Infof("Replacing Cloud KMS key %s with %s", key, mapped)
+			if err := unstructured.SetNestedField(obj.Object, mapped, "parameters", kmsKeyParameter); err != nil {
+				return nil, errors.WithStack(err)
+			}
+		}
+	case "PersistentVolumeClaim":
+		annotations := obj.GetAnnotations()
+		backedUp := fromBackup.GetAnnotations()
+		changed := false
+		for name, value := range annotations {
+			if !kmsKeyRegexp.MatchString(value) && !kmsKeyRegexp.MatchString(backedUp[name]) {
+				continue
+			}
+			if mapped, ok := mapping.mapKey(value, backedUp[name]); ok && mapped != value {
+				log.Infof("Replacing Cloud KMS key %s with %s in annotation %s", value, mapped, name)
+				annotations[name] = mapped
+				changed = true
+			}
+		}
+		if changed {
+			obj.SetAnnotations(annotations)
+		}
+	}
+
+	return velero.NewRestoreItemActionExecuteOutput(obj), nil
+}
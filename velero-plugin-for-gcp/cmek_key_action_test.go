@@ -0,0 +1,101 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vmware-tanzu/velero/pkg/plugin/velero"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+
+	velerotest "github.com/vmware-tanzu/velero/pkg/test"
+)
+
+func TestKMSKeyMapping(t *testing.T) {
+	m := kmsKeyMapping{
+		"projects/a/locations/us/keyRings/r":                "projects/b/locations/us/keyRings/r",
+		"projects/a/locations/us/keyRings/r/cryptoKeys/k2":  "projects/b/locations/us/keyRings/other/cryptoKeys/k",
+		"projects/a/locations/us/keyRings/ring/cryptoKeys/": "projects/c/locations/us/keyRings/ring/cryptoKeys/",
+	}
+
+	tests := []struct {
+		key      string
+		expected string
+		mapped   bool
+	}{
+		{key: "projects/a/locations/us/keyRings/r/cryptoKeys/k", expected: "projects/b/locations/us/keyRings/r/cryptoKeys/k", mapped: true},
+		{key: "projects/a/locations/us/keyRings/r/cryptoKeys/k2", expected: "projects/b/locations/us/keyRings/other/cryptoKeys/k", mapped: true},
+		{key: "projects/a/locations/us/keyRings/ring/cryptoKeys/k", expected: "projects/c/locations/us/keyRings/ring/cryptoKeys/k", mapped: true},
+		{key: "projects/a/locations/us/keyRings/r2/cryptoKeys/k", expected: "projects/a/locations/us/keyRings/r2/cryptoKeys/k"},
+	}
+	for _, test := range tests {
+		key, mapped := m.key(test.key)
+		assert.Equal(t, test.expected, key, test.key)
+		assert.Equal(t, test.mapped, mapped, test.key)
+	}
+
+	key, mapped := m.mapKey("projects/a/locations/europe/keyRings/r/cryptoKeys/k", "projects/a/locations/us/keyRings/r/cryptoKeys/k")
+	assert.True(t, mapped)
+	assert.Equal(t, "projects/b/locations/us/keyRings/r/cryptoKeys/k", key)
+}
+
+func TestCMEKKeyActionExecute(t *testing.T) {
+	cluster := &fakeCluster{configs: map[string]map[string]string{
+		cmekKeyActionName: {keysConfigKey: "projects/src/locations/us/keyRings/disks: projects/dst/locations/us/keyRings/disks"},
+	}}
+	action := &CMEKKeyAction{log: velerotest.NewLogger(), cluster: cluster}
+
+	storageClass := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion":  "storage.k8s.io/v1",
+		"kind":        "StorageClass",
+		"metadata":    map[string]interface{}{"name": "encrypted"},
+		"provisioner": pdCSIDriver,
+		"parameters": map[string]interface{}{
+			"type":          "pd-balanced",
+			kmsKeyParameter: "projects/src/locations/us/keyRings/disks/cryptoKeys/k",
+		},
+	}}
+	out, err := action.Execute(&velero.RestoreItemActionExecuteInput{Item: storageClass, ItemFromBackup: storageClass.DeepCopy()})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{
+		"type":          "pd-balanced",
+		kmsKeyParameter: "projects/dst/locations/us/keyRings/disks/cryptoKeys/k",
+	}, out.UpdatedItem.UnstructuredContent()["parameters"])
+
+	pvc := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "v1",
+		"kind":       "PersistentVolumeClaim",
+		"metadata": map[string]interface{}{
+			"name":      "data",
+			"namespace": "app",
+			"annotations": map[string]interface{}{
+				"example.com/kms-key": "projects/src/locations/us/keyRings/disks/cryptoKeys/k",
+				"example.com/other":   "projects/src/locations/us/keyRings/other/cryptoKeys/k",
+				"example.com/note":    "projects/src/locations/us/keyRings/disks",
+			},
+		},
+	}}
+	out, err = action.Execute(&velero.RestoreItemActionExecuteInput{Item: pvc, ItemFromBackup: pvc.DeepCopy()})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{
+		"example.com/kms-key": "projects/dst/locations/us/keyRings/disks/cryptoKeys/k",
+		"example.com/other":   "projects/src/locations/us/keyRings/other/cryptoKeys/k",
+		"example.com/note":    "projects/src/locations/us/keyRings/disks",
+	}, out.UpdatedItem.(*unstructured.Unstructured).GetAnnotations())
+}
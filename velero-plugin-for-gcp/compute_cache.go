@@ -0,0 +1,267 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"google.golang.org/api/compute/v1"
+)
+
+const (
+	// diskLookupTTL is how long a disk read during a backup is reused.
+	// Velero reads each persistent volume's disk from the disk metadata
+	// action, GetVolumeInfo and CreateSnapshot in quick succession; the
+	// disk's attachments, which the snapshot throttle uses, can change
+	// over a longer time.
+	diskLookupTTL = 2 * time.Minute
+	// diskListThreshold is the number of a project's disks read one at a
+	// time after which all of its disks are listed instead, so backing up
+	// hundreds of volumes takes a few aggregated list requests rather than
+	// a request per volume, while backing up a few volumes of a project
+	// with thousands of disks doesn't list them all.
+	diskListThreshold = 3
+
+	computeLookupsCounter = "velero_gcp_compute_lookups_total"
+)
+
+// computeLookupCache caches the disks and zones the plugin reads from the
+// Compute Engine API, so backing up a persistent volume reads its disk once
+// instead of once per plugin call, and backing up many volumes lists their
+// project's disks instead of reading each of them. Velero starts the plugin
+// process for each backup and restore, so the cache lasts for one of them,
+// and is shared by the volume snapshotter and the item actions.
+type computeLookupCache struct {
+	now func() time.Time
+
+	lock   sync.Mutex
+	disks  map[diskRef]cachedDisk
+	pruned time.Time
+	// projects counts the disks read one at a time in each project, and
+	// when its disks were last listed.
+	projects map[string]*projectDiskLookups
+	// zones holds the self links of zones, which don't change.
+	zones map[string]string
+
+	// listLock is held while listing disks, so volumes backed up at once
+	// wait for one listing of their project's disks.
+	listLock sync.Mutex
+}
+
+type projectDiskLookups struct {
+	reads  int
+	listed time.Time
+}
+
+// diskLister lists the zonal and regional disks of a project.
+type diskLister func(project string) (map[diskRef]*compute.Disk, error)
+
+type cachedDisk struct {
+	disk    *compute.Disk
+	fetched time.Time
+}
+
+// computeLookups is the process's cache of Compute Engine reads.
+var computeLookups = newComputeLookupCache()
+
+func newComputeLookupCache() *computeLookupCache {
+	return &computeLookupCache{
+		now:      time.Now,
+		disks:    make(map[diskRef]cachedDisk),
+		projects: make(map[string]*projectDiskLookups),
+		zones:    make(map[string]string),
+	}
+}
+
+// disk returns a disk read or listed within diskLookupTTL, or reads it with
+// get. Once diskListThreshold disks of the project were read, its disks
+// are listed with list, if given, and disks the listing didn't include,
+// such as those created since, are read with get. Errors aren't cached.
+func (c *computeLookupCache) disk(ref diskRef, list diskLister, get func() (*compute.Disk, error)) (*compute.Disk, error) {
+	if disk, ok := c.cachedDisk(ref); ok {
+		recordComputeLookup("disk", true)
+		return disk, nil
+	}
+
+	if list != nil && c.shouldList(ref.project) {
+		if disk, ok := c.listDisks(ref, list); ok {
+			return disk, nil
+		}
+	}
+
+	recordComputeLookup("disk", false)
+	now := c.now()
+	disk, err := get()
+	if err != nil {
+		return nil, err
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.disks[ref] = cachedDisk{disk: disk, fetched: now}
+	c.prune(now)
+	return disk, nil
+}
+
+func (c *computeLookupCache) cachedDisk(ref diskRef) (*compute.Disk, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	cached, ok := c.disks[ref]
+	if !ok || c.now().Sub(cached.fetched) >= diskLookupTTL {
+		return nil, false
+	}
+	return cached.disk, true
+}
+
+// shouldList counts a disk about to be read on its own, and reports whether
+// the project's disks should be listed instead. They aren't listed again
+// within diskLookupTTL of the last listing, whether it succeeded or not.
+func (c *computeLookupCache) shouldList(project string) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	p, ok := c.projects[project]
+	if !ok {
+		p = &projectDiskLookups{}
+		c.projects[project] = p
+	}
+	if !p.listed.IsZero() && c.now().Sub(p.listed) < diskLookupTTL {
+		return false
+	}
+	p.reads++
+	return p.reads >= diskListThreshold
+}
+
+// listDisks lists the disks of a disk's project into the cache, and returns
+// the disk if the listing included it.
+func (c *computeLookupCache) listDisks(ref diskRef, list diskLister) (*compute.Disk, bool) {
+	c.listLock.Lock()
+	defer c.listLock.Unlock()
+
+	// another volume's lookup may have listed the disks while this one
+	// waited
+	if disk, ok := c.cachedDisk(ref); ok {
+		recordComputeLookup("disk", true)
+		return disk, true
+	}
+	c.lock.Lock()
+	listed := c.projects[ref.project].listed
+	c.lock.Unlock()
+	if !listed.IsZero() && c.now().Sub(listed) < diskLookupTTL {
+		return nil, false
+	}
+
+	recordComputeLookup("disk_list", false)
+	now := c.now()
+	disks, err := list(ref.project)
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.projects[ref.project].listed = now
+	c.projects[ref.project].reads = 0
+	if err != nil {
+		return nil, false
+	}
+	for key, disk := range disks {
+		c.disks[key] = cachedDisk{disk: disk, fetched: now}
+	}
+	c.prune(now)
+	if disk, ok := disks[ref]; ok {
+		recordComputeLookup("disk", false)
+		return disk, true
+	}
+	return nil, false
+}
+
+// prune drops expired disks once in a while, so large clusters' disks don't
+// accumulate. It must be called with the lock held.
+func (c *computeLookupCache) prune(now time.Time) {
+	if now.Sub(c.pruned) < diskLookupTTL {
+		return
+	}
+	for key, cached := range c.disks {
+		if now.Sub(cached.fetched) >= diskLookupTTL {
+			delete(c.disks, key)
+		}
+	}
+	c.pruned = now
+}
+
+// listProjectDisks lists the zonal and regional disks of a project with
+// aggregated list requests.
+func listProjectDisks(ctx context.Context, gce *compute.Service, project string) (map[diskRef]*compute.Disk, error) {
+	disks := make(map[diskRef]*compute.Disk)
+	err := gce.Disks.AggregatedList(project).MaxResults(500).Pages(ctx, func(page *compute.DiskAggregatedList) error {
+		for scope, list := range page.Items {
+			for _, disk := range list.Disks {
+				ref := diskRef{project: project, name: disk.Name}
+				switch {
+				case strings.HasPrefix(scope, "zones/"):
+					ref.location = strings.TrimPrefix(scope, "zones/")
+				case strings.HasPrefix(scope, "regions/"):
+					ref.location, ref.regional = strings.TrimPrefix(scope, "regions/"), true
+				default:
+					continue
+				}
+				disks[ref] = disk
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "error listing the disks of project %s", project)
+	}
+	return disks, nil
+}
+
+// zoneURL returns the self link of a zone, reading it with get the first
+// time.
+func (c *computeLookupCache) zoneURL(project, zone string, get func() (*compute.Zone, error)) (string, error) {
+	key := project + "/" + zone
+	c.lock.Lock()
+	url, ok := c.zones[key]
+	c.lock.Unlock()
+	if ok {
+		recordComputeLookup("zone", true)
+		return url, nil
+	}
+
+	recordComputeLookup("zone", false)
+	z, err := get()
+	if err != nil {
+		return "", err
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.zones[key] = z.SelfLink
+	return z.SelfLink, nil
+}
+
+func recordComputeLookup(resource string, hit bool) {
+	result := "miss"
+	if hit {
+		result = "hit"
+	}
+	pluginMetrics.addCounter(computeLookupsCounter, "Number of Compute Engine disk and zone reads and disk listings, by whether they were served from the plugin's cache.", map[string]string{
+		"resource": resource,
+		"result":   result,
+	}, 1)
+}
@@ -0,0 +1,219 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	velerotest "github.com/vmware-tanzu/velero/pkg/test"
+	"google.golang.org/api/compute/v1"
+)
+
+func TestComputeLookupCacheDisks(t *testing.T) {
+	defer func(registry *metricsRegistry) { pluginMetrics = registry }(pluginMetrics)
+	pluginMetrics = newMetricsRegistry()
+
+	cache := newComputeLookupCache()
+	now := time.Now()
+	cache.now = func() time.Time { return now }
+
+	reads := 0
+	get := func() (*compute.Disk, error) {
+		reads++
+		return &compute.Disk{Name: "disk-1", Type: "pd-ssd"}, nil
+	}
+	ref := diskRef{project: "p", location: "us-central1-a", name: "disk-1"}
+
+	disk, err := cache.disk(ref, nil, get)
+	require.NoError(t, err)
+	assert.Equal(t, "pd-ssd", disk.Type)
+	_, err = cache.disk(ref, nil, get)
+	require.NoError(t, err)
+	assert.Equal(t, 1, reads)
+
+	// regional disks with the same name are different disks
+	_, err = cache.disk(diskRef{project: "p", location: "us-central1", name: "disk-1", regional: true}, nil, get)
+	require.NoError(t, err)
+	assert.Equal(t, 2, reads)
+
+	// disks are read again once they expire, and expired disks are dropped
+	now = now.Add(diskLookupTTL)
+	_, err = cache.disk(ref, nil, get)
+	require.NoError(t, err)
+	assert.Equal(t, 3, reads)
+	assert.Len(t, cache.disks, 1)
+
+	// errors aren't cached
+	missing := diskRef{project: "p", location: "us-central1-a", name: "missing"}
+	_, err = cache.disk(missing, nil, func() (*compute.Disk, error) { return nil, errors.New("not found") })
+	assert.Error(t, err)
+	_, err = cache.disk(missing, nil, get)
+	assert.NoError(t, err)
+
+	values := make(map[string]float64)
+	pluginMetrics.each(func(m *metric, s *sample) {
+		values[m.name+labelString(s.labels)] = s.value
+	})
+	assert.Equal(t, map[string]float64{
+		`velero_gcp_compute_lookups_total{resource="disk",result="hit"}`:  1,
+		`velero_gcp_compute_lookups_total{resource="disk",result="miss"}`: 5,
+	}, values)
+}
+
+func TestComputeLookupCacheZones(t *testing.T) {
+	cache := newComputeLookupCache()
+	reads := 0
+	get := func() (*compute.Zone, error) {
+		reads++
+		return &compute.Zone{SelfLink: "https://compute/zones/us-central1-a"}, nil
+	}
+
+	for i := 0; i < 3; i++ {
+		url, err := cache.zoneURL("p", "us-central1-a", get)
+		require.NoError(t, err)
+		assert.Equal(t, "https://compute/zones/us-central1-a", url)
+	}
+	assert.Equal(t, 1, reads)
+
+	_, err := cache.zoneURL("other", "us-central1-a", get)
+	require.NoError(t, err)
+	assert.Equal(t, 2, reads)
+}
+
+func TestBackupReadsDiskOnce(t *testing.T) {
+	defer func(cache *computeLookupCache) { computeLookups = cache }(computeLookups)
+	computeLookups = newComputeLookupCache()
+
+	reads := 0
+	gce := newFakeComputeService(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			reads++
+			json.NewEncoder(w).Encode(&compute.Disk{Name: "disk-1", Type: "pd-standard"})
+			return
+		}
+		json.NewEncoder(w).Encode(&compute.Operation{})
+	})
+	b := (&VolumeSnapshotter{log: velerotest.NewLogger(), volumeProject: "p", snapshotProject: "p"}).withClients(&snapshotterClients{gce: gce})
+
+	volumeType, _, err := b.GetVolumeInfo("disk-1", "us-central1-a")
+	require.NoError(t, err)
+	assert.Equal(t, "pd-standard", volumeType)
+	_, err = b.CreateSnapshot("disk-1", "us-central1-a", map[string]string{backupNameTag: "b1"})
+	require.NoError(t, err)
+	assert.Equal(t, 1, reads)
+}
+
+func TestComputeLookupCacheListsDisks(t *testing.T) {
+	defer func(registry *metricsRegistry) { pluginMetrics = registry }(pluginMetrics)
+	pluginMetrics = newMetricsRegistry()
+
+	cache := newComputeLookupCache()
+	now := time.Now()
+	cache.now = func() time.Time { return now }
+
+	reads, lists := 0, 0
+	get := func() (*compute.Disk, error) {
+		reads++
+		return &compute.Disk{Name: "read"}, nil
+	}
+	var listErr error
+	list := func(project string) (map[diskRef]*compute.Disk, error) {
+		lists++
+		disks := make(map[diskRef]*compute.Disk)
+		for i := 0; i < 10; i++ {
+			disks[diskRef{project: project, location: "us-central1-a", name: fmt.Sprintf("disk-%d", i)}] = &compute.Disk{Name: "listed"}
+		}
+		return disks, listErr
+	}
+	ref := func(i int) diskRef {
+		return diskRef{project: "p", location: "us-central1-a", name: fmt.Sprintf("disk-%d", i)}
+	}
+
+	// the first disks are read on their own, then the project's are listed
+	for i := 0; i < 10; i++ {
+		_, err := cache.disk(ref(i), list, get)
+		require.NoError(t, err)
+	}
+	assert.Equal(t, diskListThreshold-1, reads)
+	assert.Equal(t, 1, lists)
+	disk, err := cache.disk(ref(9), list, get)
+	require.NoError(t, err)
+	assert.Equal(t, "listed", disk.Name)
+
+	// disks created since the listing are read, without listing again
+	for i := 10; i < 10+diskListThreshold; i++ {
+		_, err := cache.disk(ref(i), list, get)
+		require.NoError(t, err)
+	}
+	assert.Equal(t, 2*diskListThreshold-1, reads)
+	assert.Equal(t, 1, lists)
+
+	// failed listings fall back to reading disks
+	now = now.Add(diskLookupTTL)
+	listErr = errors.New("permission denied")
+	for i := 0; i < 10; i++ {
+		disk, err := cache.disk(ref(i), list, get)
+		require.NoError(t, err)
+		assert.Equal(t, "read", disk.Name)
+	}
+	assert.Equal(t, 2, lists)
+
+	values := make(map[string]float64)
+	pluginMetrics.each(func(m *metric, s *sample) {
+		values[m.name+labelString(s.labels)] = s.value
+	})
+	assert.Equal(t, map[string]float64{
+		`velero_gcp_compute_lookups_total{resource="disk",result="hit"}`:       8,
+		`velero_gcp_compute_lookups_total{resource="disk",result="miss"}`:      16,
+		`velero_gcp_compute_lookups_total{resource="disk_list",result="miss"}`: 2,
+	}, values)
+}
+
+func TestListProjectDisks(t *testing.T) {
+	gce := newFakeComputeService(t, func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/projects/p/aggregated/disks", r.URL.Path)
+		if r.URL.Query().Get("pageToken") == "" {
+			json.NewEncoder(w).Encode(&compute.DiskAggregatedList{
+				Items: map[string]compute.DisksScopedList{
+					"zones/us-central1-a": {Disks: []*compute.Disk{{Name: "zonal"}}},
+					"zones/us-central1-b": {},
+				},
+				NextPageToken: "next",
+			})
+			return
+		}
+		json.NewEncoder(w).Encode(&compute.DiskAggregatedList{
+			Items: map[string]compute.DisksScopedList{
+				"regions/us-central1": {Disks: []*compute.Disk{{Name: "regional"}}},
+			},
+		})
+	})
+
+	disks, err := listProjectDisks(context.Background(), gce, "p")
+	require.NoError(t, err)
+	assert.Len(t, disks, 2)
+	assert.Equal(t, "zonal", disks[diskRef{project: "p", location: "us-central1-a", name: "zonal"}].Name)
+	assert.Equal(t, "regional", disks[diskRef{project: "p", location: "us-central1", name: "regional", regional: true}].Name)
+}
@@ -0,0 +1,263 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	api "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	"github.com/vmware-tanzu/velero/pkg/plugin/framework"
+	"github.com/vmware-tanzu/velero/pkg/plugin/velero"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	configConnectorActionName = "velero.io/gcp-config-connector"
+
+	// skipOwnedConfigKey and pauseActuationConfigKey are the keys of the
+	// restore action's ConfigMap choosing whether Config Connector
+	// resources owned by other objects are skipped, and whether Config
+	// Connector is paused in the restored namespaces.
+	skipOwnedConfigKey      = "skipOwned"
+	pauseActuationConfigKey = "pauseActuation"
+
+	configConnectorGroup        = "cnrm.cloud.google.com"
+	configConnectorContextName  = "configconnectorcontext.core.cnrm.cloud.google.com"
+	configConnectorProjectIDKey = "cnrm.cloud.google.com/project-id"
+	actuationModePaused         = "Paused"
+)
+
+var (
+	configConnectorContextsResource = schema.GroupResource{Group: "core.cnrm.cloud.google.com", Resource: "configconnectorcontexts"}
+	secretsResource                 = schema.GroupResource{Resource: "secrets"}
+)
+
+// isConfigConnectorResource reports whether an object is a Config Connector
+// resource or one of its configuration objects.
+func isConfigConnectorResource(obj *unstructured.Unstructured) bool {
+	group := obj.GroupVersionKind().Group
+	return group == configConnectorGroup || strings.HasSuffix(group, "."+configConnectorGroup)
+}
+
+// ConfigConnectorBackupAction is a backup item action that includes the
+// ConfigConnectorContext configuring Config Connector in the namespace of
+// Config Connector resources and the Secrets their sensitive fields refer
+// to, so restored resources are reconciled the same way.
+type ConfigConnectorBackupAction struct {
+	log logrus.FieldLogger
+}
+
+func newConfigConnectorBackupAction(logger logrus.FieldLogger) (interface{}, error) {
+	return &ConfigConnectorBackupAction{log: logger}, nil
+}
+
+func (a *ConfigConnectorBackupAction) AppliesTo() (velero.ResourceSelector, error) {
+	// Config Connector has a group per service, which resource selectors
+	// can't match
+	return velero.ResourceSelector{}, nil
+}
+
+func (a *ConfigConnectorBackupAction) Execute(item runtime.Unstructured, backup *api.Backup) (runtime.Unstructured, []velero.ResourceIdentifier, error) {
+	obj := &unstructured.Unstructured{Object: item.UnstructuredContent()}
+	if !isConfigConnectorResource(obj) || obj.GetNamespace() == "" {
+		return item, nil, nil
+	}
+
+	var additional []velero.ResourceIdentifier
+	if obj.GetKind() != "ConfigConnectorContext" {
+		additional = append(additional, velero.ResourceIdentifier{GroupResource: configConnectorContextsResource, Namespace: obj.GetNamespace(), Name: configConnectorContextName})
+	}
+	for _, name := range secretKeyRefs(obj.Object["spec"]) {
+		additional = append(additional, velero.ResourceIdentifier{GroupResource: secretsResource, Namespace: obj.GetNamespace(), Name: name})
+	}
+	return item, additional, nil
+}
+
+// secretKeyRefs returns the names of the Secrets referred to by the
+// secretKeyRef fields in a value, sorted.
+func secretKeyRefs(value interface{}) []string {
+	names := make(map[string]bool)
+	var walk func(interface{})
+	walk = func(value interface{}) {
+		switch v := value.(type) {
+		case map[string]interface{}:
+			for key, field := range v {
+				if ref, ok := field.(map[string]interface{}); ok && key == "secretKeyRef" {
+					if name, ok := ref["name"].(string); ok && name != "" {
+						names[name] = true
+					}
+					continue
+				}
+				walk(field)
+			}
+		case []interface{}:
+			for _, field := range v {
+				walk(field)
+			}
+		}
+	}
+	walk(value)
+
+	sorted := make([]string, 0, len(names))
+	for name := range names {
+		sorted = append(sorted, name)
+	}
+	sort.Strings(sorted)
+	return sorted
+}
+
+type configConnectorConfig struct {
+	skipOwned      bool
+	pauseActuation bool
+	projects       map[string]string
+}
+
+// ConfigConnectorRestoreAction is a restore item action that keeps Config
+// Connector from creating or changing cloud resources unexpectedly when its
+// resources are restored: it can skip resources owned by other objects,
+// which their owners recreate, remaps the projects resources refer to, and
+// can pause Config Connector in the restored namespaces.
+type ConfigConnectorRestoreAction struct {
+	log     logrus.FieldLogger
+	cluster veleroCluster
+
+	once      sync.Once
+	config    configConnectorConfig
+	configErr error
+}
+
+func newConfigConnectorRestoreAction(logger logrus.FieldLogger) (interface{}, error) {
+	return &ConfigConnectorRestoreAction{log: logger, cluster: inCluster{}}, nil
+}
+
+func (a *ConfigConnectorRestoreAction) AppliesTo() (velero.ResourceSelector, error) {
+	return velero.ResourceSelector{}, nil
+}
+
+func (a *ConfigConnectorRestoreAction) loadConfig() (configConnectorConfig, error) {
+	a.once.Do(func() {
+		var data map[string]string
+		data, a.configErr = a.cluster.pluginConfig(framework.PluginKindRestoreItemAction, configConnectorActionName)
+		if a.configErr != nil {
+			return
+		}
+		a.config, a.configErr = parseConfigConnectorConfig(data)
+	})
+	return a.config, a.configErr
+}
+
+func parseConfigConnectorConfig(data map[string]string) (configConnectorConfig, error) {
+	var c configConnectorConfig
+	for key, value := range map[string]*bool{skipOwnedConfigKey: &c.skipOwned, pauseActuationConfigKey: &c.pauseActuation} {
+		if data[key] == "" {
+			continue
+		}
+		enabled, err := strconv.ParseBool(data[key])
+		if err != nil {
+			return c, errors.Wrapf(err, "error parsing %s in the %s ConfigMap", key, configConnectorActionName)
+		}
+		*value = enabled
+	}
+	if err := yaml.Unmarshal([]byte(data[projectsConfigKey]), &c.projects); err != nil {
+		return c, errors.Wrapf(err, "error parsing %s in the %s ConfigMap", projectsConfigKey, configConnectorActionName)
+	}
+	return c, nil
+}
+
+func (a *ConfigConnectorRestoreAction) Execute(input *velero.RestoreItemActionExecuteInput) (*velero.RestoreItemActionExecuteOutput, error) {
+	obj := &unstructured.Unstructured{Object: input.Item.UnstructuredContent()}
+
+	config, err := a.loadConfig()
+	if err != nil {
+		return nil, err
+	}
+	log := a.log.WithFields(logrus.Fields{"restore": restoreName(input), "kind": obj.GetKind(), "namespace": obj.GetNamespace(), "name": obj.GetName()})
+
+	// namespaces set the project of the Config Connector resources in them
+	if project, ok := obj.GetAnnotations()[configConnectorProjectIDKey]; ok && len(config.projects) > 0 {
+		if mapped, ok := config.projects[project]; ok {
+			log.Infof("Updating %s annotation from %s to %s", configConnectorProjectIDKey, project, mapped)
+			annotations := obj.GetAnnotations()
+			annotations[configConnectorProjectIDKey] = mapped
+			obj.SetAnnotations(annotations)
+		}
+	}
+
+	if !isConfigConnectorResource(obj) {
+		return velero.NewRestoreItemActionExecuteOutput(obj), nil
+	}
+
+	if config.skipOwned && len(obj.GetOwnerReferences()) > 0 {
+		log.Info("Skipping Config Connector resource owned by another object, which recreates it")
+		return velero.NewRestoreItemActionExecuteOutput(obj).WithoutRestore(), nil
+	}
+
+	switch obj.GetKind() {
+	case "ConfigConnector", "ConfigConnectorContext":
+		if config.pauseActuation {
+			log.Info("Pausing Config Connector until the restore is verified")
+			if err := unstructured.SetNestedField(obj.Object, actuationModePaused, "spec", "actuationMode"); err != nil {
+				return nil, errors.WithStack(err)
+			}
+		}
+	default:
+		if len(config.projects) > 0 {
+			if spec, ok := obj.Object["spec"]; ok {
+				remapExternalRefs(spec, config.projects)
+			}
+		}
+	}
+	return velero.NewRestoreItemActionExecuteOutput(obj), nil
+}
+
+// remapExternalRefs replaces project IDs in the external fields of the
+// resource references in a value, e.g. projectRef or networkRef, which
+// refer to resources Config Connector doesn't manage by project and name.
+func remapExternalRefs(value interface{}, projects map[string]string) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, field := range v {
+			if ref, ok := field.(map[string]interface{}); ok && strings.HasSuffix(key, "Ref") {
+				if external, ok := ref["external"].(string); ok {
+					ref["external"] = replaceProjectIDs(external, projects)
+				}
+			}
+			if refs, ok := field.([]interface{}); ok && strings.HasSuffix(key, "Refs") {
+				for _, r := range refs {
+					if ref, ok := r.(map[string]interface{}); ok {
+						if external, ok := ref["external"].(string); ok {
+							ref["external"] = replaceProjectIDs(external, projects)
+						}
+					}
+				}
+			}
+			remapExternalRefs(field, projects)
+		}
+	case []interface{}:
+		for _, field := range v {
+			remapExternalRefs(field, projects)
+		}
+	}
+}
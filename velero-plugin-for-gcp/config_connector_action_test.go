@@ -0,0 +1,191 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vmware-tanzu/velero/pkg/plugin/velero"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+
+	velerotest "github.com/vmware-tanzu/velero/pkg/test"
+)
+
+func TestConfigConnectorBackupActionExecute(t *testing.T) {
+	tests := []struct {
+		name     string
+		item     map[string]interface{}
+		expected []velero.ResourceIdentifier
+	}{
+		{
+			name: "resource with a secret",
+			item: map[string]interface{}{
+				"apiVersion": "sql.cnrm.cloud.google.com/v1beta1",
+				"kind":       "SQLUser",
+				"metadata":   map[string]interface{}{"namespace": "db", "name": "app"},
+				"spec": map[string]interface{}{
+					"instanceRef": map[string]interface{}{"name": "main"},
+					"password": map[string]interface{}{
+						"valueFrom": map[string]interface{}{
+							"secretKeyRef": map[string]interface{}{"name": "app-password", "key": "password"},
+						},
+					},
+				},
+			},
+			expected: []velero.ResourceIdentifier{
+				{GroupResource: configConnectorContextsResource, Namespace: "db", Name: configConnectorContextName},
+				{GroupResource: secretsResource, Namespace: "db", Name: "app-password"},
+			},
+		},
+		{
+			name: "other resources are ignored",
+			item: map[string]interface{}{
+				"apiVersion": "v1",
+				"kind":       "ConfigMap",
+				"metadata":   map[string]interface{}{"namespace": "db", "name": "app"},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			action := &ConfigConnectorBackupAction{log: velerotest.NewLogger()}
+			_, additional, err := action.Execute(&unstructured.Unstructured{Object: test.item}, nil)
+			require.NoError(t, err)
+			assert.Equal(t, test.expected, additional)
+		})
+	}
+}
+
+func TestConfigConnectorRestoreActionExecute(t *testing.T) {
+	config := map[string]string{
+		skipOwnedConfigKey:      "true",
+		pauseActuationConfigKey: "true",
+		projectsConfigKey:       "prod: dr",
+	}
+
+	tests := []struct {
+		name         string
+		item         map[string]interface{}
+		expected     map[string]interface{}
+		expectedSkip bool
+	}{
+		{
+			name: "project references are remapped",
+			item: map[string]interface{}{
+				"apiVersion": "compute.cnrm.cloud.google.com/v1beta1",
+				"kind":       "ComputeSubnetwork",
+				"metadata": map[string]interface{}{
+					"name":        "subnet",
+					"annotations": map[string]interface{}{configConnectorProjectIDKey: "prod"},
+				},
+				"spec": map[string]interface{}{
+					"networkRef": map[string]interface{}{"external": "projects/prod/global/networks/vpc"},
+					"projectRef": map[string]interface{}{"external": "prod-2"},
+				},
+			},
+			expected: map[string]interface{}{
+				"apiVersion": "compute.cnrm.cloud.google.com/v1beta1",
+				"kind":       "ComputeSubnetwork",
+				"metadata": map[string]interface{}{
+					"name":        "subnet",
+					"annotations": map[string]interface{}{configConnectorProjectIDKey: "dr"},
+				},
+				"spec": map[string]interface{}{
+					"networkRef": map[string]interface{}{"external": "projects/dr/global/networks/vpc"},
+					"projectRef": map[string]interface{}{"external": "prod-2"},
+				},
+			},
+		},
+		{
+			name: "namespace project is remapped",
+			item: map[string]interface{}{
+				"apiVersion": "v1",
+				"kind":       "Namespace",
+				"metadata": map[string]interface{}{
+					"name":        "db",
+					"annotations": map[string]interface{}{configConnectorProjectIDKey: "prod"},
+				},
+			},
+			expected: map[string]interface{}{
+				"apiVersion": "v1",
+				"kind":       "Namespace",
+				"metadata": map[string]interface{}{
+					"name":        "db",
+					"annotations": map[string]interface{}{configConnectorProjectIDKey: "dr"},
+				},
+			},
+		},
+		{
+			name: "contexts are paused",
+			item: map[string]interface{}{
+				"apiVersion": "core.cnrm.cloud.google.com/v1beta1",
+				"kind":       "ConfigConnectorContext",
+				"metadata":   map[string]interface{}{"namespace": "db", "name": configConnectorContextName},
+				"spec":       map[string]interface{}{"googleServiceAccount": "kcc@prod.iam.gserviceaccount.com"},
+			},
+			expected: map[string]interface{}{
+				"apiVersion": "core.cnrm.cloud.google.com/v1beta1",
+				"kind":       "ConfigConnectorContext",
+				"metadata":   map[string]interface{}{"namespace": "db", "name": configConnectorContextName},
+				"spec": map[string]interface{}{
+					"googleServiceAccount": "kcc@prod.iam.gserviceaccount.com",
+					"actuationMode":        actuationModePaused,
+				},
+			},
+		},
+		{
+			name: "owned resources are skipped",
+			item: map[string]interface{}{
+				"apiVersion": "iam.cnrm.cloud.google.com/v1beta1",
+				"kind":       "IAMPolicyMember",
+				"metadata": map[string]interface{}{
+					"namespace": "db",
+					"name":      "member",
+					"ownerReferences": []interface{}{
+						map[string]interface{}{"apiVersion": "example.com/v1", "kind": "App", "name": "app", "uid": "123"},
+					},
+				},
+			},
+			expectedSkip: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cluster := &fakeCluster{configs: map[string]map[string]string{configConnectorActionName: config}}
+			action := &ConfigConnectorRestoreAction{log: velerotest.NewLogger(), cluster: cluster}
+			out, err := action.Execute(&velero.RestoreItemActionExecuteInput{Item: &unstructured.Unstructured{Object: test.item}})
+			require.NoError(t, err)
+			assert.Equal(t, test.expectedSkip, out.SkipRestore)
+			if !test.expectedSkip {
+				assert.Equal(t, test.expected, out.UpdatedItem.UnstructuredContent())
+			}
+		})
+	}
+}
+
+func TestParseConfigConnectorConfig(t *testing.T) {
+	_, err := parseConfigConnectorConfig(map[string]string{skipOwnedConfigKey: "maybe"})
+	assert.Error(t, err)
+
+	config, err := parseConfigConnectorConfig(nil)
+	require.NoError(t, err)
+	assert.Equal(t, configConnectorConfig{}, config)
+}
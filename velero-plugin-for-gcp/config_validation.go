@@ -0,0 +1,344 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	// projectIDRegexp matches project IDs, including domain-scoped ones
+	// like example.com:my-project.
+	projectIDRegexp = regexp.MustCompile(`^([a-z0-9.-]+:)?[a-z][a-z0-9-]{4,28}[a-z0-9]$`)
+
+	// storageLocationRegexp matches the regions and multi-regions snapshots
+	// can be stored in, e.g. us-central1 or us.
+	storageLocationRegexp = regexp.MustCompile(`^[a-z]+(-[a-z]+[0-9]+)?$`)
+
+	kmsKeyRegexp = regexp.MustCompile(`^projects/[^/]+/locations/[^/]+/keyRings/[^/]+/cryptoKeys/[^/]+$`)
+
+	serviceAccountEmailRegexp = regexp.MustCompile(`^[^@\s/]+@[^@\s/]+\.[^@\s/]+$`)
+
+	pubsubTopicRegexp = regexp.MustCompile(`^projects/[^/]+/topics/[^/]+$`)
+)
+
+// configCheck checks the value of a config key.
+type configCheck func(val string) error
+
+// objectStoreConfigChecks are the checks of the values of BackupStorageLocation
+// config keys.
+var objectStoreConfigChecks = map[string]configCheck{
+	kmsKeyNameConfigKey:                 checkKMSKey,
+	serviceAccountConfig:                checkServiceAccount,
+	requireCMEKConfigKey:                checkBool,
+	uploadChunkSizeConfigKey:            checkNonNegativeInt,
+	inventoryIntervalConfigKey:          checkPositiveDuration,
+	secretManagerEncryptionKeyConfigKey: checkSecretVersion,
+	pubsubTopicConfigKey:                checkPubSubTopic,
+	kubernetesEventsConfigKey:           checkBool,
+	listIndexMaxAgeConfigKey:            checkPositiveDuration,
+	downloadReadAheadConfigKey:          checkNonNegativeInt,
+	metadataEncryptionKeyConfigKey:      checkKMSKey,
+	allowPlaintextMetadataConfigKey:     checkBool,
+	allowedRegionsConfigKey:             checkAllowedRegions,
+	estimateCostsConfigKey:              checkBool,
+	storagePricesConfigKey:              checkStoragePrices,
+	tierObjectsAfterConfigKey:           checkPositiveDuration,
+	tierObjectsStorageClassConfigKey:    checkTierStorageClass,
+	orgPolicyChecksConfigKey:            checkBool,
+	drKMSKeyNameConfigKey:               checkKMSKey,
+}
+
+// volumeSnapshotterConfigChecks are the checks of the values of
+// VolumeSnapshotLocation config keys.
+var volumeSnapshotterConfigChecks = map[string]configCheck{
+	projectKey:                       checkProjectID,
+	snapshotLocationKey:              checkStorageLocation,
+	volumeManifestConfigKey:          checkBool,
+	maxSnapshotsPerInstanceConfigKey: checkNonNegativeInt,
+	maxRestoresPerZoneConfigKey:      checkNonNegativeInt,
+	pubsubTopicConfigKey:             checkPubSubTopic,
+	quotaCheckIntervalConfigKey:      checkPositiveDuration,
+	quotaWarningThresholdConfigKey:   checkPercentage,
+	kubernetesEventsConfigKey:        checkBool,
+	operationJournalConfigKey:        checkBool,
+	minimumRetentionConfigKey:        checkPositiveDuration,
+	archiveSnapshotsAfterConfigKey:   checkPositiveDuration,
+	allowedRegionsConfigKey:          checkAllowedRegions,
+	budgetSubscriptionConfigKey:      checkPubSubSubscription,
+	budgetThresholdConfigKey:         checkBudgetThreshold,
+	budgetActionConfigKey:            checkBudgetAction,
+	orgPolicyChecksConfigKey:         checkBool,
+	drProjectConfigKey:               checkProjectID,
+	drSnapshotLocationConfigKey:      checkStorageLocation,
+	drKMSKeyNameConfigKey:            checkKMSKey,
+	backupForGKEConfigKey:            checkBackupForGKEMode,
+	backupForGKEBackupPlanConfigKey:  checkBackupPlan,
+	resourceTagsConfigKey:            checkResourceTags,
+	backupVaultPlanConfigKey:         checkBackupVaultPlan,
+	backupVaultRuleConfigKey:         checkBackupPlanRule,
+}
+
+// credentialsConfigChecks are the checks of the values of the credentials
+// config keys both kinds of locations have.
+var credentialsConfigChecks = map[string]configCheck{
+	credentialsJSONConfigKey:           checkJSON,
+	credentialsSecretConfigKey:         checkSecretRef,
+	secretManagerCredentialsConfigKey:  checkSecretVersion,
+	fleetMembershipConfigKey:           checkFleetMembership,
+	fleetServiceAccountConfigKey:       checkServiceAccount,
+	impersonateServiceAccountConfigKey: checkServiceAccount,
+	impersonateDelegatesConfigKey:      checkServiceAccounts,
+	quotaProjectConfigKey:              checkProjectID,
+}
+
+// configDependencies are config keys that only have an effect along with
+// another key.
+var configDependencies = map[string]string{
+	impersonateDelegatesConfigKey:    impersonateServiceAccountConfigKey,
+	fleetTokenFileConfigKey:          fleetMembershipConfigKey,
+	fleetServiceAccountConfigKey:     fleetMembershipConfigKey,
+	clientCertificateFileConfigKey:   clientKeyFileConfigKey,
+	clientKeyFileConfigKey:           clientCertificateFileConfigKey,
+	quotaWarningThresholdConfigKey:   quotaCheckIntervalConfigKey,
+	storagePricesConfigKey:           estimateCostsConfigKey,
+	tierObjectsStorageClassConfigKey: tierObjectsAfterConfigKey,
+	budgetThresholdConfigKey:         budgetSubscriptionConfigKey,
+	budgetActionConfigKey:            budgetSubscriptionConfigKey,
+	drPrefixConfigKey:                drBucketConfigKey,
+	drSnapshotLocationConfigKey:      drProjectConfigKey,
+	backupForGKENamespacesConfigKey:  backupForGKEConfigKey,
+	backupForGKEBackupPlanConfigKey:  backupForGKEConfigKey,
+	backupVaultPlanConfigKey:         backupVaultRuleConfigKey,
+	backupVaultRuleConfigKey:         backupVaultPlanConfigKey,
+}
+
+// exclusiveConfigKeys are sets of config keys at most one of which can be
+// set.
+var exclusiveConfigKeys = [][]string{
+	credentialSourceKeys,
+	{kmsKeyNameConfigKey, secretManagerEncryptionKeyConfigKey},
+}
+
+// validateConfig checks a location's config before any client is created, so
+// typos and conflicting settings fail the location when it's created rather
+// than the first backup using it. Every problem found is reported at once.
+func validateConfig(kind string, config map[string]string, validKeys []string, checks ...map[string]configCheck) error {
+	valid := make(map[string]bool, len(validKeys))
+	for _, k := range validKeys {
+		valid[k] = true
+	}
+
+	var problems []string
+	keys := make([]string, 0, len(config))
+	for k := range config {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		if !valid[k] {
+			problem := fmt.Sprintf("unknown key %q", k)
+			if suggestion := suggestConfigKey(k, validKeys); suggestion != "" {
+				problem += fmt.Sprintf(", did you mean %q?", suggestion)
+			}
+			problems = append(problems, problem)
+			continue
+		}
+		if config[k] == "" {
+			continue
+		}
+		if required, ok := configDependencies[k]; ok && config[required] == "" {
+			problems = append(problems, fmt.Sprintf("%s requires %s to be set", k, required))
+		}
+		for _, c := range checks {
+			if check, ok := c[k]; ok {
+				if err := check(config[k]); err != nil {
+					problems = append(problems, fmt.Sprintf("invalid %s %q: %v", k, config[k], err))
+				}
+			}
+		}
+	}
+
+	for _, set := range exclusiveConfigKeys {
+		var configured []string
+		for _, k := range set {
+			if config[k] != "" {
+				configured = append(configured, k)
+			}
+		}
+		if len(configured) > 1 {
+			problems = append(problems, fmt.Sprintf("only one of %s can be set, got %s", strings.Join(set, ", "), strings.Join(configured, " and ")))
+		}
+	}
+
+	if len(problems) > 0 {
+		return errors.Errorf("invalid %s config: %s", kind, strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// suggestConfigKey returns the valid key an unknown key is most likely a typo
+// of, if any.
+func suggestConfigKey(key string, validKeys []string) string {
+	best, bestDistance := "", 3
+	for _, k := range validKeys {
+		if strings.EqualFold(k, key) {
+			return k
+		}
+		if d := editDistance(strings.ToLower(k), strings.ToLower(key)); d < bestDistance {
+			best, bestDistance = k, d
+		}
+	}
+	return best
+}
+
+// editDistance returns the Levenshtein distance between two strings.
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur := make([]int, len(b)+1)
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = cur[j-1] + 1
+			if d := prev[j] + 1; d < cur[j] {
+				cur[j] = d
+			}
+			if d := prev[j-1] + cost; d < cur[j] {
+				cur[j] = d
+			}
+		}
+		prev = cur
+	}
+	return prev[len(b)]
+}
+
+func checkProjectID(val string) error {
+	if !projectIDRegexp.MatchString(val) {
+		return errors.New("expected a project ID, e.g. my-project")
+	}
+	return nil
+}
+
+func checkStorageLocation(val string) error {
+	if !storageLocationRegexp.MatchString(val) {
+		return errors.New("expected a region or multi-region, e.g. us-central1 or us")
+	}
+	return nil
+}
+
+func checkKMSKey(val string) error {
+	if !kmsKeyRegexp.MatchString(val) {
+		return errors.New("expected projects/PROJECT/locations/LOCATION/keyRings/KEY_RING/cryptoKeys/KEY")
+	}
+	return nil
+}
+
+func checkPubSubTopic(val string) error {
+	if !pubsubTopicRegexp.MatchString(val) {
+		return errors.New("expected projects/PROJECT/topics/TOPIC")
+	}
+	return nil
+}
+
+func checkServiceAccount(val string) error {
+	if !serviceAccountEmailRegexp.MatchString(val) {
+		return errors.New("expected a service account email, e.g. velero@my-project.iam.gserviceaccount.com")
+	}
+	return nil
+}
+
+func checkServiceAccounts(val string) error {
+	for _, sa := range parseList(val) {
+		if err := checkServiceAccount(sa); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func checkSecretVersion(val string) error {
+	if !secretVersionRegexp.MatchString(val) {
+		return errors.New("expected projects/PROJECT/secrets/SECRET[/versions/VERSION]")
+	}
+	return nil
+}
+
+func checkSecretRef(val string) error {
+	namespace, _, _, err := parseSecretRef(val)
+	if err != nil {
+		return errors.New("expected namespace/name/key")
+	}
+	return checkSecretNamespace(namespace)
+}
+
+func checkFleetMembership(val string) error {
+	if !fleetMembershipRegexp.MatchString(val) {
+		return errors.New("expected projects/PROJECT_ID/locations/LOCATION/memberships/MEMBERSHIP")
+	}
+	return nil
+}
+
+func checkJSON(val string) error {
+	if !json.Valid([]byte(val)) {
+		return errors.New("expected the contents of a JSON credentials file")
+	}
+	return nil
+}
+
+func checkBool(val string) error {
+	if _, err := strconv.ParseBool(val); err != nil {
+		return errors.New("expected true or false")
+	}
+	return nil
+}
+
+func checkNonNegativeInt(val string) error {
+	if n, err := strconv.Atoi(val); err != nil || n < 0 {
+		return errors.New("expected a non-negative integer")
+	}
+	return nil
+}
+
+func checkPercentage(val string) error {
+	if n, err := strconv.Atoi(val); err != nil || n <= 0 || n > 100 {
+		return errors.New("expected a percentage between 1 and 100")
+	}
+	return nil
+}
+
+func checkPositiveDuration(val string) error {
+	if d, err := time.ParseDuration(val); err != nil || d <= 0 {
+		return errors.New("expected a positive duration, e.g. 1h")
+	}
+	return nil
+}
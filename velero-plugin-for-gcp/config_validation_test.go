@@ -0,0 +1,136 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	velerotest "github.com/vmware-tanzu/velero/pkg/test"
+)
+
+func TestValidateConfig(t *testing.T) {
+	validKeys := []string{
+		projectKey,
+		snapshotLocationKey,
+		kmsKeyNameConfigKey,
+		secretManagerEncryptionKeyConfigKey,
+		credentialsFileConfigKey,
+		credentialsJSONConfigKey,
+		impersonateServiceAccountConfigKey,
+		impersonateDelegatesConfigKey,
+		requireCMEKConfigKey,
+		pubsubTopicConfigKey,
+	}
+	checks := []map[string]configCheck{objectStoreConfigChecks, volumeSnapshotterConfigChecks, credentialsConfigChecks}
+
+	tests := []struct {
+		name     string
+		config   map[string]string
+		expected []string
+	}{
+		{
+			name: "valid config",
+			config: map[string]string{
+				projectKey:                         "example.com:my-project",
+				snapshotLocationKey:                "us-central1",
+				kmsKeyNameConfigKey:                "projects/p/locations/us/keyRings/r/cryptoKeys/k",
+				impersonateServiceAccountConfigKey: "velero@my-project.iam.gserviceaccount.com",
+				impersonateDelegatesConfigKey:      "a@my-project.iam.gserviceaccount.com,b@my-project.iam.gserviceaccount.com",
+				requireCMEKConfigKey:               "true",
+				pubsubTopicConfigKey:               "projects/p/topics/velero-events",
+			},
+		},
+		{
+			name:   "empty values are unset",
+			config: map[string]string{projectKey: "", impersonateDelegatesConfigKey: ""},
+		},
+		{
+			name:     "unknown keys suggest the key they're likely a typo of",
+			config:   map[string]string{"kmsKeyname": "x", "snapshotLocaton": "us", "bogus": "x"},
+			expected: []string{`unknown key "bogus"`, `unknown key "kmsKeyname", did you mean "kmsKeyName"?`, `unknown key "snapshotLocaton", did you mean "snapshotLocation"?`},
+		},
+		{
+			name: "exclusive keys",
+			config: map[string]string{
+				credentialsFileConfigKey:            "/credentials/cloud",
+				credentialsJSONConfigKey:            "{}",
+				kmsKeyNameConfigKey:                 "projects/p/locations/us/keyRings/r/cryptoKeys/k",
+				secretManagerEncryptionKeyConfigKey: "projects/p/secrets/s",
+			},
+			expected: []string{"got credentialsFile and credentialsJSON", "got kmsKeyName and secretManagerEncryptionKey"},
+		},
+		{
+			name:     "dependent keys",
+			config:   map[string]string{impersonateDelegatesConfigKey: "a@my-project.iam.gserviceaccount.com"},
+			expected: []string{"impersonateDelegates requires impersonateServiceAccount to be set"},
+		},
+		{
+			name: "malformed values",
+			config: map[string]string{
+				projectKey:                         "My_Project",
+				snapshotLocationKey:                "us-central1-a",
+				kmsKeyNameConfigKey:                "my-key",
+				impersonateServiceAccountConfigKey: "velero",
+				credentialsJSONConfigKey:           "{",
+				requireCMEKConfigKey:               "yes please",
+				pubsubTopicConfigKey:               "velero-events",
+			},
+			expected: []string{
+				`invalid project "My_Project"`,
+				`invalid snapshotLocation "us-central1-a"`,
+				`invalid kmsKeyName "my-key"`,
+				`invalid impersonateServiceAccount "velero"`,
+				`invalid credentialsJSON "{"`,
+				`invalid requireCMEK "yes please"`,
+				`invalid pubsubTopic "velero-events"`,
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := validateConfig("VolumeSnapshotLocation", test.config, validKeys, checks...)
+			if len(test.expected) == 0 {
+				assert.NoError(t, err)
+				return
+			}
+			require.Error(t, err)
+			for _, e := range test.expected {
+				assert.Contains(t, err.Error(), e)
+			}
+		})
+	}
+}
+
+func TestEditDistance(t *testing.T) {
+	assert.Equal(t, 0, editDistance("project", "project"))
+	assert.Equal(t, 1, editDistance("project", "projct"))
+	assert.Equal(t, 2, editDistance("kmsKeyName", "kmsKeyNmae"))
+	assert.Equal(t, 3, editDistance("", "abc"))
+}
+
+func TestInitRejectsInvalidConfig(t *testing.T) {
+	err := newObjectStore(velerotest.NewLogger()).Init(map[string]string{"bucket": "b", "kmsKeyNam": "k", uploadChunkSizeConfigKey: "-1"})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), `invalid BackupStorageLocation config: unknown key "kmsKeyNam", did you mean "kmsKeyName"?; invalid uploadChunkSizeMB "-1"`)
+
+	err = newVolumeSnapshotter(velerotest.NewLogger()).Init(map[string]string{projectKey: "p"})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), `invalid VolumeSnapshotLocation config: invalid project "p"`)
+}
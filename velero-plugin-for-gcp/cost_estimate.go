@@ -0,0 +1,212 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// estimateCostsConfigKey is the key of a BackupStorageLocation's config
+	// enabling the estimate of the monthly storage cost of each backup,
+	// computed along with the backup inventory.
+	estimateCostsConfigKey = "estimateCosts"
+	// storagePricesConfigKey is the key of a BackupStorageLocation's config
+	// overriding the prices costs are estimated with, as comma-separated
+	// CLASS=PRICE pairs, in a currency per GiB per month.
+	storagePricesConfigKey = "storagePrices"
+
+	// snapshotPriceClass is the storagePrices entry of snapshots, next to
+	// the Cloud Storage classes.
+	snapshotPriceClass = "SNAPSHOT"
+
+	// backupCostAnnotation is the annotation of Backups holding their
+	// estimated monthly cost.
+	backupCostAnnotation = "gcp.velero.io/estimated-monthly-cost"
+
+	backupCostGauge = "velero_gcp_backup_estimated_monthly_cost"
+
+	bytesPerGiB = 1 << 30
+)
+
+// defaultStoragePrices are list prices, in USD per GiB per month, of
+// regional Cloud Storage classes and standard snapshots in us-central1.
+// Prices vary with the location and contract, so storagePrices overrides
+// them.
+var defaultStoragePrices = map[string]float64{
+	"STANDARD":                     0.020,
+	"REGIONAL":                     0.020,
+	"MULTI_REGIONAL":               0.026,
+	"DURABLE_REDUCED_AVAILABILITY": 0.020,
+	"NEARLINE":                     0.010,
+	"COLDLINE":                     0.004,
+	"ARCHIVE":                      0.0012,
+	snapshotPriceClass:             0.050,
+}
+
+// storagePrices are the prices per GiB per month costs are estimated with,
+// by Cloud Storage class, and of snapshots.
+type storagePrices map[string]float64
+
+// parseStoragePrices returns the default prices, overridden by the
+// config's CLASS=PRICE pairs.
+func parseStoragePrices(val string) (storagePrices, error) {
+	prices := make(storagePrices, len(defaultStoragePrices))
+	for class, price := range defaultStoragePrices {
+		prices[class] = price
+	}
+	for _, pair := range parseList(val) {
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 {
+			return nil, errors.Errorf("invalid price %q, expected CLASS=PRICE, e.g. NEARLINE=0.01", pair)
+		}
+		price, err := strconv.ParseFloat(strings.TrimSpace(parts[1]), 64)
+		if err != nil || price < 0 || math.IsInf(price, 0) {
+			return nil, errors.Errorf("invalid price %q, expected a non-negative number", parts[1])
+		}
+		prices[strings.ToUpper(strings.TrimSpace(parts[0]))] = price
+	}
+	return prices, nil
+}
+
+func checkStoragePrices(val string) error {
+	_, err := parseStoragePrices(val)
+	return err
+}
+
+// price returns the price of a storage class, objects without a known
+// class being priced as STANDARD.
+func (p storagePrices) price(class string) float64 {
+	if price, ok := p[strings.ToUpper(class)]; ok {
+		return price
+	}
+	return p["STANDARD"]
+}
+
+// backupCost is the estimated monthly cost of storing a backup: its
+// objects in the bucket, and its snapshots as recorded in its volume
+// manifest.
+type backupCost struct {
+	Monthly       float64 `json:"monthly"`
+	Objects       float64 `json:"objects"`
+	Snapshots     float64 `json:"snapshots"`
+	ObjectBytes   int64   `json:"objectBytes"`
+	SnapshotBytes int64   `json:"snapshotBytes"`
+	// Estimated is set if the stored size of some snapshots isn't known
+	// yet, in which case their disk size is counted.
+	Estimated bool `json:"estimated,omitempty"`
+}
+
+// estimateBackupCost returns the cost of a backup whose objects take the
+// given bytes by storage class, and whose snapshots are in the manifest.
+func estimateBackupCost(prices storagePrices, objectBytes map[string]int64, manifest *volumeManifest) backupCost {
+	var cost backupCost
+	for class, n := range objectBytes {
+		cost.ObjectBytes += n
+		cost.Objects += float64(n) / bytesPerGiB * prices.price(class)
+	}
+	if manifest != nil {
+		for _, v := range manifest.Volumes {
+			// snapshots are incremental, so what a snapshot stores is
+			// only known once it's ready
+			n := v.StorageBytes
+			if !v.final() {
+				n, cost.Estimated = v.DiskSizeGB*bytesPerGiB, true
+			}
+			cost.SnapshotBytes += n
+		}
+		cost.Snapshots = float64(cost.SnapshotBytes) / bytesPerGiB * prices.price(snapshotPriceClass)
+	}
+	cost.Objects, cost.Snapshots = roundCost(cost.Objects), roundCost(cost.Snapshots)
+	cost.Monthly = roundCost(cost.Objects + cost.Snapshots)
+	return cost
+}
+
+// roundCost rounds a cost to a hundredth of a cent.
+func roundCost(cost float64) float64 {
+	return math.Round(cost*10000) / 10000
+}
+
+// annotateBackup sets an annotation of a Backup in Velero's namespace.
+func (inCluster) annotateBackup(backup, key, value string) error {
+	client, err := newInClusterClient()
+	if err != nil {
+		return err
+	}
+	return client.annotateBackup(veleroNamespace(), backup, key, value)
+}
+
+// costReporter publishes the estimated costs of the backups in a location:
+// each backup's as an annotation, logged when it changes, and each
+// schedule's total as a metric.
+type costReporter struct {
+	log     logrus.FieldLogger
+	cluster veleroCluster
+	prices  storagePrices
+	// reported is the annotation last set on each backup, so backups are
+	// only annotated when their estimate changes.
+	reported map[string]string
+}
+
+// report publishes the costs of the backups, by name, created by the
+// schedules of the inventory.
+func (r *costReporter) report(bucket, prefix string, costs map[string]backupCost, scheduleOf func(backup string) string) {
+	match := map[string]string{"bucket": bucket, "prefix": prefix}
+	pluginMetrics.deleteMatching(backupCostGauge, match)
+
+	totals := make(map[string]float64)
+	for backup, cost := range costs {
+		totals[scheduleOf(backup)] += cost.Monthly
+
+		data, err := json.Marshal(cost)
+		if err != nil {
+			continue
+		}
+		value := string(data)
+		if r.reported[backup] == value {
+			continue
+		}
+		r.log.WithFields(logrus.Fields{
+			"backup":        backup,
+			"monthlyCost":   cost.Monthly,
+			"objectBytes":   cost.ObjectBytes,
+			"snapshotBytes": cost.SnapshotBytes,
+		}).Info("Estimated the monthly storage cost of the backup")
+		if err := r.cluster.annotateBackup(backup, backupCostAnnotation, value); err != nil {
+			// backups being deleted, or not yet synced, have no Backup
+			r.log.WithError(err).WithField("backup", backup).Debug("Unable to annotate the backup with its estimated cost")
+			continue
+		}
+		r.reported[backup] = value
+	}
+	for backup := range r.reported {
+		if _, ok := costs[backup]; !ok {
+			delete(r.reported, backup)
+		}
+	}
+
+	for schedule, total := range totals {
+		labels := map[string]string{"bucket": bucket, "prefix": prefix, "schedule": schedule}
+		pluginMetrics.setGauge(backupCostGauge, "Estimated monthly cost of storing the backups stored in the location, by schedule.", labels, roundCost(total))
+	}
+}
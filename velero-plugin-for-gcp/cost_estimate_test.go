@@ -0,0 +1,128 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	velerotest "github.com/vmware-tanzu/velero/pkg/test"
+)
+
+func TestParseStoragePrices(t *testing.T) {
+	prices, err := parseStoragePrices("")
+	require.NoError(t, err)
+	assert.Equal(t, 0.010, prices.price("NEARLINE"))
+	assert.Equal(t, 0.020, prices.price(""))
+
+	prices, err = parseStoragePrices("nearline=0.015, SNAPSHOT=0.029")
+	require.NoError(t, err)
+	assert.Equal(t, 0.015, prices.price("NEARLINE"))
+	assert.Equal(t, 0.029, prices.price(snapshotPriceClass))
+	assert.Equal(t, 0.004, prices.price("COLDLINE"))
+
+	for _, val := range []string{"NEARLINE", "NEARLINE=cheap", "NEARLINE=-1", "NEARLINE=+Inf"} {
+		assert.Error(t, checkStoragePrices(val), val)
+	}
+}
+
+func TestEstimateBackupCost(t *testing.T) {
+	prices, err := parseStoragePrices("")
+	require.NoError(t, err)
+
+	// objects are priced by storage class
+	cost := estimateBackupCost(prices, map[string]int64{"STANDARD": 50 * bytesPerGiB, "ARCHIVE": 100 * bytesPerGiB}, nil)
+	assert.Equal(t, backupCost{Monthly: 1.12, Objects: 1.12, ObjectBytes: 150 * bytesPerGiB}, cost)
+
+	// snapshots are priced by what they store, or their disk size until
+	// that's known
+	manifest := &volumeManifest{Volumes: []volumeManifestEntry{
+		{snapshotDetails: snapshotDetails{Status: "READY", DiskSizeGB: 100, StorageBytes: 10 * bytesPerGiB}},
+		{snapshotDetails: snapshotDetails{Status: "FAILED", DiskSizeGB: 100}},
+	}}
+	cost = estimateBackupCost(prices, map[string]int64{"STANDARD": bytesPerGiB}, manifest)
+	assert.Equal(t, backupCost{Monthly: 0.52, Objects: 0.02, Snapshots: 0.5, ObjectBytes: bytesPerGiB, SnapshotBytes: 10 * bytesPerGiB}, cost)
+
+	manifest.Volumes = append(manifest.Volumes, volumeManifestEntry{snapshotDetails: snapshotDetails{Status: "UPLOADING", DiskSizeGB: 20}})
+	cost = estimateBackupCost(prices, nil, manifest)
+	assert.Equal(t, 1.5, cost.Snapshots)
+	assert.True(t, cost.Estimated)
+}
+
+// deletedBackup is a cluster whose backup named "deleted" can't be
+// annotated.
+type deletedBackup struct {
+	*fakeCluster
+}
+
+func (c deletedBackup) annotateBackup(backup, key, value string) error {
+	if backup == "deleted" {
+		return errors.New("not found")
+	}
+	return c.fakeCluster.annotateBackup(backup, key, value)
+}
+
+func TestCostReporter(t *testing.T) {
+	defer func(registry *metricsRegistry) { pluginMetrics = registry }(pluginMetrics)
+	pluginMetrics = newMetricsRegistry()
+
+	cluster := &fakeCluster{}
+	annotations := func() map[string]string {
+		costs := make(map[string]string)
+		for backup, annotations := range cluster.annotations {
+			costs[backup] = annotations[backupCostAnnotation]
+		}
+		return costs
+	}
+	schedules := map[string]string{"nightly-1": "nightly", "nightly-2": "nightly"}
+	scheduleOf := func(backup string) string { return schedules[backup] }
+
+	r := &costReporter{log: velerotest.NewLogger(), cluster: deletedBackup{cluster}, reported: make(map[string]string)}
+	r.report("bucket", "", map[string]backupCost{
+		"nightly-1": {Monthly: 1.25},
+		"nightly-2": {Monthly: 0.5, Estimated: true},
+		"manual":    {Monthly: 0.1},
+		"deleted":   {Monthly: 3},
+	}, scheduleOf)
+	assert.Equal(t, map[string]string{
+		"nightly-1": `{"monthly":1.25,"objects":0,"snapshots":0,"objectBytes":0,"snapshotBytes":0}`,
+		"nightly-2": `{"monthly":0.5,"objects":0,"snapshots":0,"objectBytes":0,"snapshotBytes":0,"estimated":true}`,
+		"manual":    `{"monthly":0.1,"objects":0,"snapshots":0,"objectBytes":0,"snapshotBytes":0}`,
+	}, annotations())
+
+	values := make(map[string]float64)
+	pluginMetrics.each(func(m *metric, s *sample) {
+		values[m.name+labelString(s.labels)] = s.value
+	})
+	assert.Equal(t, map[string]float64{
+		`velero_gcp_backup_estimated_monthly_cost{bucket="bucket",prefix="",schedule=""}`:        3.1,
+		`velero_gcp_backup_estimated_monthly_cost{bucket="bucket",prefix="",schedule="nightly"}`: 1.75,
+	}, values)
+
+	// backups are only annotated again when their estimate changes
+	cluster.annotations = nil
+	r.report("bucket", "", map[string]backupCost{
+		"nightly-1": {Monthly: 1.25},
+		"nightly-2": {Monthly: 0.75},
+	}, scheduleOf)
+	assert.Equal(t, map[string]string{
+		"nightly-2": `{"monthly":0.75,"objects":0,"snapshots":0,"objectBytes":0,"snapshotBytes":0}`,
+	}, annotations())
+	assert.Len(t, r.reported, 2)
+}
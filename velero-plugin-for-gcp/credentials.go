@@ -0,0 +1,380 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+	"google.golang.org/api/impersonate"
+	"google.golang.org/api/option"
+)
+
+const (
+	impersonateServiceAccountConfigKey = "impersonateServiceAccount"
+	impersonateDelegatesConfigKey      = "impersonateDelegates"
+	scopesConfigKey                    = "scopes"
+	quotaProjectConfigKey              = "quotaProject"
+	credentialsJSONConfigKey           = "credentialsJSON"
+
+	// credentialsJSONEnvVar holds the content of a credentials JSON file,
+	// used instead of application default credentials.
+	credentialsJSONEnvVar = "GOOGLE_APPLICATION_CREDENTIALS_JSON"
+
+	// objectStoreCredentialsEnvVar and volumeSnapshotterCredentialsEnvVar
+	// name the credentials files used by locations of each plugin kind that
+	// don't configure their own, so storage and compute permissions can be
+	// held by separate identities.
+	objectStoreCredentialsEnvVar       = "VELERO_GCP_OBJECT_STORE_CREDENTIALS"
+	volumeSnapshotterCredentialsEnvVar = "VELERO_GCP_VOLUME_SNAPSHOTTER_CREDENTIALS"
+
+	scopePrefix = "https://www.googleapis.com/auth/"
+
+	serviceAccountCredentials  = "service_account"
+	externalAccountCredentials = "external_account"
+)
+
+// credentialSourceKeys are the config keys selecting a location's base
+// identity. At most one of them can be set.
+var credentialSourceKeys = []string{
+	credentialsFileConfigKey,
+	credentialsJSONConfigKey,
+	credentialsSecretConfigKey,
+	secretManagerCredentialsConfigKey,
+	accessTokenFileConfigKey,
+	fleetMembershipConfigKey,
+}
+
+// impersonationURLRegexp matches the service_account_impersonation_url of
+// external_account credentials, capturing the service account's email.
+var impersonationURLRegexp = regexp.MustCompile(`/serviceAccounts/([^/:]+):generateAccessToken$`)
+
+// credentialsJSON holds the fields of a credentials JSON file the plugin
+// needs to tell the supported credential types apart.
+type credentialsJSON struct {
+	Type                           string `json:"type"`
+	ServiceAccountImpersonationURL string `json:"service_account_impersonation_url"`
+	QuotaProjectID                 string `json:"quota_project_id"`
+}
+
+func parseCredentialsJSON(b []byte) credentialsJSON {
+	var f credentialsJSON
+	// credentials that aren't valid JSON are reported by the client
+	// libraries, so just return the zero value here.
+	_ = json.Unmarshal(b, &f)
+	return f
+}
+
+// impersonatedServiceAccount returns the email of the service account that
+// federated (external_account) credentials are exchanged for, if any.
+func (f credentialsJSON) impersonatedServiceAccount() string {
+	if m := impersonationURLRegexp.FindStringSubmatch(f.ServiceAccountImpersonationURL); m != nil {
+		return m[1]
+	}
+	return ""
+}
+
+// parseScopes returns the OAuth2 scopes configured for a location's API
+// clients, or defaultScopes if there are none. Scopes may omit the
+// "https://www.googleapis.com/auth/" prefix, e.g. "devstorage.read_write".
+func parseScopes(config map[string]string, defaultScopes ...string) []string {
+	scopes := parseList(config[scopesConfigKey])
+	if len(scopes) == 0 {
+		return defaultScopes
+	}
+	for i, scope := range scopes {
+		if !strings.HasPrefix(scope, "https://") {
+			scopes[i] = scopePrefix + scope
+		}
+	}
+	return scopes
+}
+
+// locationCredentials describes the identity a location's API clients
+// authenticate as.
+type locationCredentials struct {
+	// file is the credentials file from the location's config. When file,
+	// json and tokenSource are all unset, application default credentials
+	// are used.
+	file string
+	// json is the content of the credentials, given directly or read from a
+	// Kubernetes Secret or Secret Manager.
+	json []byte
+	// secretName is the Secret Manager secret the credentials are read
+	// from, and secretVersion the version that was read.
+	secretName    string
+	secretVersion string
+	// secrets reads the secrets the credentials are configured with.
+	secrets secretSource
+	// tokenSource supplies pre-issued access tokens.
+	tokenSource oauth2.TokenSource
+	// impersonate is the service account the base identity is exchanged for.
+	impersonate string
+	// delegates is the chain of service accounts the base identity goes
+	// through to impersonate the target, in order. Each one must be able to
+	// create tokens for the next, and the last for the target.
+	delegates []string
+	// quotaProject is the project API quota and billing are attributed to,
+	// instead of the credentials' own project.
+	quotaProject string
+	// clientCert is presented to Google APIs when mTLS is enforced.
+	clientCert *tls.Certificate
+}
+
+// newLocationCredentials returns the credentials configured for a location,
+// including those of its credential profile. If the location doesn't
+// configure any, the credentials file named by
+// defaultFileEnvVar, if set, is used before the environment's generic
+// credentials. Credentials in Secrets are read from secrets.
+func newLocationCredentials(secrets secretSource, config map[string]string, defaultFileEnvVar string) (locationCredentials, error) {
+	config, err := applyCredentialProfile(config)
+	if err != nil {
+		return locationCredentials{}, err
+	}
+
+	c := locationCredentials{
+		file:         config[credentialsFileConfigKey],
+		impersonate:  config[impersonateServiceAccountConfigKey],
+		delegates:    parseList(config[impersonateDelegatesConfigKey]),
+		quotaProject: config[quotaProjectConfigKey],
+		secrets:      secrets,
+	}
+	if len(c.delegates) > 0 && c.impersonate == "" {
+		return c, errors.Errorf("%s requires %s to be set", impersonateDelegatesConfigKey, impersonateServiceAccountConfigKey)
+	}
+
+	clientCert, err := loadClientCertificate(config)
+	if err != nil {
+		return c, err
+	}
+	c.clientCert = clientCert
+
+	var configured []string
+	for _, key := range credentialSourceKeys {
+		if config[key] != "" {
+			configured = append(configured, key)
+		}
+	}
+	if len(configured) > 1 {
+		return c, errors.Errorf("only one of %s can be set, got %s", strings.Join(credentialSourceKeys, ", "), strings.Join(configured, " and "))
+	}
+
+	switch {
+	case c.file != "":
+	case config[credentialsJSONConfigKey] != "":
+		c.json = []byte(config[credentialsJSONConfigKey])
+	case config[credentialsSecretConfigKey] != "":
+		ref := config[credentialsSecretConfigKey]
+		namespace, name, key, err := parseSecretRef(ref)
+		if err != nil {
+			return c, err
+		}
+		if err := checkSecretNamespace(namespace); err != nil {
+			return c, errors.Wrapf(err, "invalid %s %q", credentialsSecretConfigKey, ref)
+		}
+		if c.json, err = secrets.credentialsSecret(namespace, name, key); err != nil {
+			return c, errors.Wrapf(err, "error reading credentials from %s %s", credentialsSecretConfigKey, ref)
+		}
+	case config[secretManagerCredentialsConfigKey] != "":
+		c.secretName = config[secretManagerCredentialsConfigKey]
+		secret, err := secrets.secretManagerSecret(context.Background(), c.secretName, c.sharedOptions()...)
+		if err != nil {
+			return c, err
+		}
+		c.json, c.secretVersion = secret.data, secret.version
+	case config[fleetMembershipConfigKey] != "":
+		if c.json, err = fleetCredentialsJSON(config); err != nil {
+			return c, err
+		}
+	case config[accessTokenFileConfigKey] != "":
+		c.tokenSource = newFileTokenSource(config[accessTokenFileConfigKey])
+	// Nothing is configured for the location, so the environment may
+	// provide the credentials before falling back to application default
+	// credentials.
+	case defaultFileEnvVar != "" && os.Getenv(defaultFileEnvVar) != "":
+		c.file = os.Getenv(defaultFileEnvVar)
+	case os.Getenv(credentialsJSONEnvVar) != "":
+		c.json = []byte(os.Getenv(credentialsJSONEnvVar))
+	case os.Getenv(accessTokenEnvVar) != "":
+		c.tokenSource = oauth2.StaticTokenSource(&oauth2.Token{AccessToken: os.Getenv(accessTokenEnvVar), TokenType: "Bearer"})
+	}
+	return c, nil
+}
+
+// version identifies the source and content of the credentials, so clients
+// built with credentials that were since rotated, such as a Secret that was
+// updated, aren't reused.
+func (c locationCredentials) version() string {
+	h := sha256.New()
+	for _, part := range append([]string{c.file, c.secretName, c.secretVersion, c.impersonate, c.quotaProject}, c.delegates...) {
+		h.Write([]byte(part + "\x00"))
+	}
+	h.Write(c.json)
+	if c.file != "" {
+		if info, err := os.Stat(c.file); err == nil {
+			h.Write([]byte(info.ModTime().String()))
+		}
+	}
+	if c.clientCert != nil && len(c.clientCert.Certificate) > 0 {
+		h.Write(c.clientCert.Certificate[0])
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// find returns the credentials configured for the location, falling back to
+// application default credentials with the given scopes.
+func (c locationCredentials) find(ctx context.Context, scopes ...string) (*google.Credentials, error) {
+	credentialsJSON, err := c.configuredJSON()
+	if err != nil {
+		return nil, err
+	}
+
+	var creds *google.Credentials
+	switch {
+	case credentialsJSON != nil:
+		creds, err = google.CredentialsFromJSON(ctx, credentialsJSON, scopes...)
+	case c.tokenSource != nil:
+		// access tokens don't identify a project or service account
+		creds = &google.Credentials{TokenSource: c.tokenSource}
+	default:
+		creds, err = google.FindDefaultCredentials(ctx, scopes...)
+	}
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return creds, nil
+}
+
+// secretVersionCheck returns a check for new versions of the Secret Manager
+// secret the credentials are read from, or nil if they aren't read from a
+// secret or the version is pinned.
+func (c locationCredentials) secretVersionCheck() versionCheck {
+	m := secretVersionRegexp.FindStringSubmatch(c.secretName)
+	if m == nil || (m[1] != "" && m[1] != "/versions/latest") {
+		return nil
+	}
+	return func() (string, error) {
+		secret, err := c.secrets.secretManagerSecret(context.Background(), c.secretName, c.sharedOptions()...)
+		return secret.version, err
+	}
+}
+
+// configuredJSON returns the content of the credentials configured for the
+// location, or nil if application default credentials should be used.
+func (c locationCredentials) configuredJSON() ([]byte, error) {
+	if c.json != nil {
+		return c.json, nil
+	}
+	if c.file == "" {
+		return nil, nil
+	}
+	b, err := ioutil.ReadFile(c.file)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error reading provided credentials file %v", c.file)
+	}
+	return b, nil
+}
+
+// delegateNames returns the delegation chain as IAM resource names.
+func (c locationCredentials) delegateNames() []string {
+	var names []string
+	for _, d := range c.delegates {
+		names = append(names, "projects/-/serviceAccounts/"+d)
+	}
+	return names
+}
+
+// baseOptions returns the client options selecting the base identity, before
+// any impersonation.
+func (c locationCredentials) baseOptions() []option.ClientOption {
+	opts := c.sharedOptions()
+	switch {
+	case c.tokenSource != nil:
+		opts = append(opts, option.WithTokenSource(c.tokenSource))
+	case c.json != nil:
+		opts = append(opts, option.WithCredentialsJSON(c.json))
+	case c.file != "":
+		opts = append(opts, option.WithCredentialsFile(c.file))
+	}
+	return opts
+}
+
+// sharedOptions returns the client options all of the location's API
+// clients use, whatever identity they authenticate as.
+func (c locationCredentials) sharedOptions() []option.ClientOption {
+	var opts []option.ClientOption
+	if c.quotaProject != "" {
+		opts = append(opts, option.WithQuotaProject(c.quotaProject))
+	}
+	if c.clientCert != nil {
+		cert := c.clientCert
+		opts = append(opts, option.WithClientCertSource(func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return cert, nil
+		}))
+	}
+	return opts
+}
+
+// clientOptions returns the client options authenticating as the location's
+// identity with the given scopes.
+func (c locationCredentials) clientOptions(ctx context.Context, scopes ...string) ([]option.ClientOption, error) {
+	opts := c.sharedOptions()
+
+	ts, quotaProject, err := c.accessTokenSource(ctx, scopes...)
+	if err != nil {
+		return nil, err
+	}
+	// the client libraries only pick up the credentials' quota project
+	// when they load the credentials themselves
+	if c.quotaProject == "" && quotaProject != "" {
+		opts = append(opts, option.WithQuotaProject(quotaProject))
+	}
+	return append([]option.ClientOption{option.WithTokenSource(newAuthTokenSource(ts))}, opts...), nil
+}
+
+// accessTokenSource returns the source of access tokens for the location's
+// identity with the given scopes, and the quota project of its credentials,
+// if any.
+func (c locationCredentials) accessTokenSource(ctx context.Context, scopes ...string) (oauth2.TokenSource, string, error) {
+	if c.impersonate != "" {
+		ts, err := impersonate.CredentialsTokenSource(ctx, impersonate.CredentialsConfig{
+			TargetPrincipal: c.impersonate,
+			Scopes:          scopes,
+			Delegates:       c.delegates,
+		}, c.baseOptions()...)
+		if err != nil {
+			return nil, "", errors.Wrapf(err, "error impersonating service account %s", c.impersonate)
+		}
+		return ts, "", nil
+	}
+
+	creds, err := c.find(ctx, scopes...)
+	if err != nil {
+		return nil, "", err
+	}
+	return creds.TokenSource, parseCredentialsJSON(creds.JSON).QuotaProjectID, nil
+}
@@ -0,0 +1,177 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseCredentialsJSON(t *testing.T) {
+	tests := []struct {
+		name                  string
+		json                  string
+		expectedType          string
+		expectedImpersonation string
+	}{
+		{
+			name:         "service account key",
+			json:         `{"type": "service_account", "client_email": "velero@my-project.iam.gserviceaccount.com"}`,
+			expectedType: serviceAccountCredentials,
+		},
+		{
+			name: "external account impersonating a service account",
+			json: `{
+				"type": "external_account",
+				"audience": "//iam.googleapis.com/projects/123/locations/global/workloadIdentityPools/pool/providers/eks",
+				"service_account_impersonation_url": "https://iamcredentials.googleapis.com/v1/projects/-/serviceAccounts/velero@my-project.iam.gserviceaccount.com:generateAccessToken"
+			}`,
+			expectedType:          externalAccountCredentials,
+			expectedImpersonation: "velero@my-project.iam.gserviceaccount.com",
+		},
+		{
+			name:         "external account with direct resource access",
+			json:         `{"type": "external_account", "audience": "//iam.googleapis.com/projects/123/locations/global/workloadIdentityPools/pool/providers/oidc"}`,
+			expectedType: externalAccountCredentials,
+		},
+		{
+			name: "invalid JSON",
+			json: `not JSON`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			f := parseCredentialsJSON([]byte(test.json))
+			assert.Equal(t, test.expectedType, f.Type)
+			assert.Equal(t, test.expectedImpersonation, f.impersonatedServiceAccount())
+		})
+	}
+}
+
+const testServiceAccountJSON = `{"type": "service_account", "client_email": "velero@my-project.iam.gserviceaccount.com", "quota_project_id": "key-project"}`
+
+func TestLocationCredentials(t *testing.T) {
+	t.Setenv(credentialsJSONEnvVar, "")
+	t.Setenv(accessTokenEnvVar, "")
+	secrets := &fakeSecrets{}
+
+	c, err := newLocationCredentials(secrets, map[string]string{}, "")
+	require.NoError(t, err)
+	assert.Empty(t, c.baseOptions())
+
+	c, err = newLocationCredentials(secrets, map[string]string{credentialsJSONConfigKey: testServiceAccountJSON}, "")
+	require.NoError(t, err)
+	opts, err := c.clientOptions(context.Background(), "scope")
+	require.NoError(t, err)
+	assert.Len(t, opts, 2, "token source and the key's quota project")
+
+	c, err = newLocationCredentials(secrets, map[string]string{
+		credentialsFileConfigKey:           "/credentials/cloud",
+		impersonateServiceAccountConfigKey: "tenant@my-project.iam.gserviceaccount.com",
+		impersonateDelegatesConfigKey:      "org@broker.iam.gserviceaccount.com, folder@broker.iam.gserviceaccount.com",
+	}, "")
+	require.NoError(t, err)
+	assert.Equal(t, locationCredentials{
+		secrets:     secrets,
+		file:        "/credentials/cloud",
+		impersonate: "tenant@my-project.iam.gserviceaccount.com",
+		delegates:   []string{"org@broker.iam.gserviceaccount.com", "folder@broker.iam.gserviceaccount.com"},
+	}, c)
+	assert.Len(t, c.baseOptions(), 1)
+	assert.Equal(t, []string{
+		"projects/-/serviceAccounts/org@broker.iam.gserviceaccount.com",
+		"projects/-/serviceAccounts/folder@broker.iam.gserviceaccount.com",
+	}, c.delegateNames())
+
+	_, err = newLocationCredentials(secrets, map[string]string{
+		impersonateDelegatesConfigKey: "org@broker.iam.gserviceaccount.com",
+	}, "")
+	assert.Error(t, err, "delegates without a target service account are rejected")
+}
+
+func TestParseScopes(t *testing.T) {
+	assert.Equal(t, []string{"https://www.googleapis.com/auth/devstorage.read_write"},
+		parseScopes(map[string]string{}, "https://www.googleapis.com/auth/devstorage.read_write"))
+
+	assert.Equal(t, []string{
+		"https://www.googleapis.com/auth/devstorage.read_only",
+		"https://www.googleapis.com/auth/compute",
+	}, parseScopes(map[string]string{
+		scopesConfigKey: "devstorage.read_only, https://www.googleapis.com/auth/compute",
+	}, "https://www.googleapis.com/auth/cloud-platform"))
+}
+
+func TestLocationCredentialsQuotaProject(t *testing.T) {
+	c, err := newLocationCredentials(&fakeSecrets{}, map[string]string{
+		credentialsJSONConfigKey: testServiceAccountJSON,
+		quotaProjectConfigKey:    "billing-project",
+	}, "")
+	require.NoError(t, err)
+	assert.Equal(t, "billing-project", c.quotaProject)
+	assert.Len(t, c.sharedOptions(), 1)
+	assert.Len(t, c.baseOptions(), 2)
+
+	opts, err := c.clientOptions(context.Background(), "scope")
+	require.NoError(t, err)
+	assert.Len(t, opts, 2, "the configured quota project overrides the key's")
+}
+
+func TestLocationCredentialsJSON(t *testing.T) {
+	t.Setenv(accessTokenEnvVar, "")
+	t.Setenv(credentialsJSONEnvVar, `{"type": "external_account"}`)
+
+	c, err := newLocationCredentials(&fakeSecrets{}, map[string]string{credentialsJSONConfigKey: `{"type": "service_account"}`}, "")
+	require.NoError(t, err)
+	b, err := c.configuredJSON()
+	require.NoError(t, err)
+	assert.Equal(t, `{"type": "service_account"}`, string(b), "config takes precedence over the environment")
+
+	c, err = newLocationCredentials(&fakeSecrets{}, map[string]string{}, "")
+	require.NoError(t, err)
+	b, err = c.configuredJSON()
+	require.NoError(t, err)
+	assert.Equal(t, `{"type": "external_account"}`, string(b))
+
+	_, err = newLocationCredentials(&fakeSecrets{}, map[string]string{
+		credentialsFileConfigKey: "/credentials/cloud",
+		credentialsJSONConfigKey: `{"type": "service_account"}`,
+	}, "")
+	assert.EqualError(t, err, "only one of credentialsFile, credentialsJSON, credentialsSecret, secretManagerCredentials, accessTokenFile, fleetMembership can be set, got credentialsFile and credentialsJSON")
+}
+
+func TestLocationCredentialsDefaultFile(t *testing.T) {
+	t.Setenv(credentialsJSONEnvVar, `{"type": "external_account"}`)
+	t.Setenv(objectStoreCredentialsEnvVar, "/credentials/storage")
+	t.Setenv(volumeSnapshotterCredentialsEnvVar, "/credentials/compute")
+
+	c, err := newLocationCredentials(&fakeSecrets{}, map[string]string{}, objectStoreCredentialsEnvVar)
+	require.NoError(t, err)
+	assert.Equal(t, "/credentials/storage", c.file)
+	assert.Nil(t, c.json)
+
+	c, err = newLocationCredentials(&fakeSecrets{}, map[string]string{}, volumeSnapshotterCredentialsEnvVar)
+	require.NoError(t, err)
+	assert.Equal(t, "/credentials/compute", c.file)
+
+	c, err = newLocationCredentials(&fakeSecrets{}, map[string]string{credentialsFileConfigKey: "/credentials/cloud"}, objectStoreCredentialsEnvVar)
+	require.NoError(t, err)
+	assert.Equal(t, "/credentials/cloud", c.file, "the location's own credentials take precedence")
+}
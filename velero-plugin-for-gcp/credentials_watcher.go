@@ -0,0 +1,145 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	// credentialsCheckInterval is how often, at most, the credentials files
+	// are checked for changes.
+	credentialsCheckInterval = 30 * time.Second
+
+	// versionCheckInterval is how often, at most, credentials that aren't
+	// stored in files are checked for new versions.
+	versionCheckInterval = 5 * time.Minute
+
+	applicationCredentialsEnvVar = "GOOGLE_APPLICATION_CREDENTIALS"
+)
+
+type fileState struct {
+	modTime time.Time
+	size    int64
+	exists  bool
+}
+
+// credentialsWatcher detects when credentials files are replaced, e.g. when
+// short-lived federated credentials are refreshed by an external agent, so
+// clients can be rebuilt without restarting Velero.
+type credentialsWatcher struct {
+	lock      sync.Mutex
+	paths     []string
+	states    map[string]fileState
+	lastCheck time.Time
+	now       func() time.Time
+
+	version          string
+	versionCheck     versionCheck
+	lastVersionCheck time.Time
+}
+
+// versionCheck returns the current version of credentials that aren't
+// stored in a file, e.g. the latest version of a Secret Manager secret.
+type versionCheck func() (string, error)
+
+// newCredentialsWatcher returns a watcher for the location's credentials
+// file, or the application default credentials file if it has none, plus any
+// additional credentials files.
+func newCredentialsWatcher(credentialsFile string, additional ...string) *credentialsWatcher {
+	if credentialsFile == "" {
+		credentialsFile = os.Getenv(applicationCredentialsEnvVar)
+	}
+
+	var watched []string
+	for _, p := range append([]string{credentialsFile}, additional...) {
+		if p != "" {
+			watched = append(watched, p)
+		}
+	}
+
+	w := &credentialsWatcher{
+		paths:  watched,
+		states: make(map[string]fileState),
+		now:    time.Now,
+	}
+	for _, p := range w.paths {
+		w.states[p] = statFile(p)
+	}
+	w.lastCheck = w.now()
+	return w
+}
+
+func statFile(path string) fileState {
+	info, err := os.Stat(path)
+	if err != nil {
+		return fileState{}
+	}
+	return fileState{modTime: info.ModTime(), size: info.Size(), exists: true}
+}
+
+// watchVersion makes the watcher also report changes to the version of
+// credentials that aren't stored in a file. A nil check is ignored.
+func (w *credentialsWatcher) watchVersion(current string, check versionCheck) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	w.version = current
+	w.versionCheck = check
+	w.lastVersionCheck = w.now()
+}
+
+// changed reports whether any watched file or version was modified since the
+// last time changed returned true. Files are checked at most once per
+// interval, and versions at most once per version check interval.
+func (w *credentialsWatcher) changed() bool {
+	if w == nil || (len(w.paths) == 0 && w.versionCheck == nil) {
+		return false
+	}
+
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	now := w.now()
+	if now.Sub(w.lastCheck) < credentialsCheckInterval {
+		return false
+	}
+	w.lastCheck = now
+
+	changed := false
+	for _, p := range w.paths {
+		state := statFile(p)
+		if state != w.states[p] {
+			w.states[p] = state
+			// a file being removed during rotation isn't something we
+			// can reload from, so wait for the new one to appear
+			changed = changed || state.exists
+		}
+	}
+
+	if w.versionCheck != nil && now.Sub(w.lastVersionCheck) >= versionCheckInterval {
+		w.lastVersionCheck = now
+		// the current credentials keep being used if the check fails
+		if version, err := w.versionCheck(); err == nil && version != w.version {
+			w.version = version
+			changed = true
+		}
+	}
+	return changed
+}
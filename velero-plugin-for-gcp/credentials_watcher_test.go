@@ -0,0 +1,72 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCredentialsWatcher(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "credentials.json")
+	require.NoError(t, ioutil.WriteFile(path, []byte(`{"type": "service_account"}`), 0600))
+
+	w := newCredentialsWatcher(path)
+	now := w.lastCheck
+	w.now = func() time.Time { return now }
+
+	// unchanged
+	now = now.Add(credentialsCheckInterval)
+	assert.False(t, w.changed())
+
+	// changes are only noticed once the check interval has passed
+	require.NoError(t, ioutil.WriteFile(path, []byte(`{"type": "external_account"}`), 0600))
+	require.NoError(t, os.Chtimes(path, now.Add(time.Minute), now.Add(time.Minute)))
+	now = now.Add(time.Second)
+	assert.False(t, w.changed())
+	now = now.Add(credentialsCheckInterval)
+	assert.True(t, w.changed())
+
+	// a change is only reported once
+	now = now.Add(credentialsCheckInterval)
+	assert.False(t, w.changed())
+
+	// removed files aren't reported until they come back
+	require.NoError(t, os.Remove(path))
+	now = now.Add(credentialsCheckInterval)
+	assert.False(t, w.changed())
+	require.NoError(t, ioutil.WriteFile(path, []byte(`{"type": "service_account"}`), 0600))
+	now = now.Add(credentialsCheckInterval)
+	assert.True(t, w.changed())
+}
+
+func TestCredentialsWatcherDefaultCredentials(t *testing.T) {
+	t.Setenv(applicationCredentialsEnvVar, "/var/run/secrets/adc.json")
+
+	assert.Equal(t, []string{"/var/run/secrets/adc.json"}, newCredentialsWatcher("").paths)
+	assert.Equal(t, []string{"/credentials/cloud", "/credentials/read-only"}, newCredentialsWatcher("/credentials/cloud", "/credentials/read-only").paths)
+
+	var w *credentialsWatcher
+	assert.False(t, w.changed(), "nil watchers never report changes")
+}
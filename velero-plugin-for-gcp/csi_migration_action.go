@@ -0,0 +1,163 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/vmware-tanzu/velero/pkg/plugin/framework"
+	"github.com/vmware-tanzu/velero/pkg/plugin/velero"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+const (
+	csiMigrationActionName = "velero.io/gcp-csi-migration"
+
+	inTreePDProvisioner     = "kubernetes.io/gce-pd"
+	provisionedByAnnotation = "pv.kubernetes.io/provisioned-by"
+	migratedToAnnotation    = "pv.kubernetes.io/migrated-to"
+
+	// unspecifiedProject is the project of volume handles the PD CSI driver
+	// resolves to its own project, as used by Kubernetes' CSI migration.
+	unspecifiedProject = "UNSPECIFIED"
+)
+
+// CSIMigrationAction is a restore item action that converts persistent
+// volumes using the in-tree gcePersistentDisk volume plugin, which newer
+// Kubernetes versions no longer include, to the PD CSI driver, the same way
+// Kubernetes' CSI migration translates them.
+type CSIMigrationAction struct {
+	log     logrus.FieldLogger
+	cluster veleroCluster
+
+	once      sync.Once
+	project   string
+	configErr error
+}
+
+func newCSIMigrationAction(logger logrus.FieldLogger) (interface{}, error) {
+	return &CSIMigrationAction{log: logger, cluster: inCluster{}}, nil
+}
+
+func (a *CSIMigrationAction) AppliesTo() (velero.ResourceSelector, error) {
+	return velero.ResourceSelector{
+		IncludedResources: []string{"persistentvolumes"},
+	}, nil
+}
+
+// loadProject returns the project of the volume handles of converted
+// volumes, from the action's ConfigMap if there is one.
+func (a *CSIMigrationAction) loadProject() (string, error) {
+	a.once.Do(func() {
+		var data map[string]string
+		data, a.configErr = a.cluster.pluginConfig(framework.PluginKindRestoreItemAction, csiMigrationActionName)
+		a.project = data[projectKey]
+		if a.project == "" {
+			a.project = unspecifiedProject
+		}
+	})
+	return a.project, a.configErr
+}
+
+func (a *CSIMigrationAction) Execute(input *velero.RestoreItemActionExecuteInput) (*velero.RestoreItemActionExecuteOutput, error) {
+	pv := new(v1.PersistentVolume)
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(input.Item.UnstructuredContent(), pv); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if pv.Spec.GCEPersistentDisk == nil {
+		return velero.NewRestoreItemActionExecuteOutput(input.Item), nil
+	}
+
+	project, err := a.loadProject()
+	if err != nil {
+		return nil, err
+	}
+	if err := migrateToCSI(pv, project); err != nil {
+		return nil, err
+	}
+	a.log.WithField("persistentVolume", pv.Name).Infof("Converted in-tree persistent disk volume to %s with volume handle %s", pdCSIDriver, pv.Spec.CSI.VolumeHandle)
+
+	res, err := runtime.DefaultUnstructuredConverter.ToUnstructured(pv)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return velero.NewRestoreItemActionExecuteOutput(&unstructured.Unstructured{Object: res}), nil
+}
+
+// migrateToCSI replaces the gcePersistentDisk source of a persistent volume
+// with the equivalent PD CSI driver source.
+func migrateToCSI(pv *v1.PersistentVolume, project string) error {
+	pd := pv.Spec.GCEPersistentDisk
+
+	zone := pv.Labels[zoneLabel]
+	if zone == "" {
+		zone = pv.Labels[betaZoneLabel]
+	}
+	if zone == "" {
+		return errors.Errorf("unable to convert persistent volume %s to %s: it has no %s or %s label", pv.Name, pdCSIDriver, zoneLabel, betaZoneLabel)
+	}
+
+	handle := fmt.Sprintf("projects/%s/zones/%s/disks/%s", project, zone, pd.PDName)
+	if isMultiZone(zone) {
+		region, err := parseRegion(zone)
+		if err != nil {
+			return err
+		}
+		handle = fmt.Sprintf("projects/%s/regions/%s/disks/%s", project, region, pd.PDName)
+	}
+
+	csi := &v1.CSIPersistentVolumeSource{
+		Driver:       pdCSIDriver,
+		VolumeHandle: handle,
+		FSType:       pd.FSType,
+		ReadOnly:     pd.ReadOnly,
+	}
+	if pd.Partition != 0 {
+		csi.VolumeAttributes = map[string]string{"partition": strconv.Itoa(int(pd.Partition))}
+	}
+	pv.Spec.GCEPersistentDisk = nil
+	pv.Spec.CSI = csi
+
+	// in-tree volumes could rely on their zone labels for scheduling, CSI
+	// volumes need node affinity
+	if pv.Spec.NodeAffinity == nil || pv.Spec.NodeAffinity.Required == nil {
+		pv.Spec.NodeAffinity = &v1.VolumeNodeAffinity{
+			Required: &v1.NodeSelector{
+				NodeSelectorTerms: []v1.NodeSelectorTerm{{
+					MatchExpressions: []v1.NodeSelectorRequirement{{
+						Key:      gkeZoneLabel,
+						Operator: v1.NodeSelectorOpIn,
+						Values:   strings.Split(zone, zoneSeparator),
+					}},
+				}},
+			},
+		}
+	}
+
+	if pv.Annotations[provisionedByAnnotation] == inTreePDProvisioner {
+		pv.Annotations[provisionedByAnnotation] = pdCSIDriver
+	}
+	delete(pv.Annotations, migratedToAnnotation)
+	return nil
+}
@@ -0,0 +1,105 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestMigrateToCSI(t *testing.T) {
+	zoneAffinity := func(key string, zones ...string) *v1.VolumeNodeAffinity {
+		return &v1.VolumeNodeAffinity{Required: &v1.NodeSelector{NodeSelectorTerms: []v1.NodeSelectorTerm{{
+			MatchExpressions: []v1.NodeSelectorRequirement{{Key: key, Operator: v1.NodeSelectorOpIn, Values: zones}},
+		}}}}
+	}
+
+	tests := []struct {
+		name                string
+		project             string
+		labels              map[string]string
+		annotations         map[string]string
+		source              *v1.GCEPersistentDiskVolumeSource
+		affinity            *v1.VolumeNodeAffinity
+		expectedCSI         *v1.CSIPersistentVolumeSource
+		expectedAffinity    *v1.VolumeNodeAffinity
+		expectedAnnotations map[string]string
+		expectedErr         bool
+	}{
+		{
+			name:        "zonal disk",
+			project:     unspecifiedProject,
+			labels:      map[string]string{betaZoneLabel: "us-central1-a"},
+			annotations: map[string]string{provisionedByAnnotation: inTreePDProvisioner, migratedToAnnotation: pdCSIDriver},
+			source:      &v1.GCEPersistentDiskVolumeSource{PDName: "pvc-1", FSType: "ext4"},
+			expectedCSI: &v1.CSIPersistentVolumeSource{
+				Driver:       pdCSIDriver,
+				VolumeHandle: "projects/UNSPECIFIED/zones/us-central1-a/disks/pvc-1",
+				FSType:       "ext4",
+			},
+			expectedAffinity:    zoneAffinity(gkeZoneLabel, "us-central1-a"),
+			expectedAnnotations: map[string]string{provisionedByAnnotation: pdCSIDriver},
+		},
+		{
+			name:     "regional disk keeps its node affinity",
+			project:  "my-project",
+			labels:   map[string]string{zoneLabel: "us-central1-a__us-central1-b"},
+			source:   &v1.GCEPersistentDiskVolumeSource{PDName: "pvc-2", Partition: 1, ReadOnly: true},
+			affinity: zoneAffinity(zoneLabel, "us-central1-a", "us-central1-b"),
+			expectedCSI: &v1.CSIPersistentVolumeSource{
+				Driver:           pdCSIDriver,
+				VolumeHandle:     "projects/my-project/regions/us-central1/disks/pvc-2",
+				ReadOnly:         true,
+				VolumeAttributes: map[string]string{"partition": "1"},
+			},
+			expectedAffinity: zoneAffinity(zoneLabel, "us-central1-a", "us-central1-b"),
+		},
+		{
+			name:        "volume without zone label",
+			project:     unspecifiedProject,
+			source:      &v1.GCEPersistentDiskVolumeSource{PDName: "pvc-3"},
+			expectedErr: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			pv := &v1.PersistentVolume{
+				ObjectMeta: metav1.ObjectMeta{Name: "pv", Labels: test.labels, Annotations: test.annotations},
+				Spec: v1.PersistentVolumeSpec{
+					PersistentVolumeSource: v1.PersistentVolumeSource{GCEPersistentDisk: test.source},
+					NodeAffinity:           test.affinity,
+				},
+			}
+
+			err := migrateToCSI(pv, test.project)
+			if test.expectedErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Nil(t, pv.Spec.GCEPersistentDisk)
+			assert.Equal(t, test.expectedCSI, pv.Spec.CSI)
+			assert.Equal(t, test.expectedAffinity, pv.Spec.NodeAffinity)
+			assert.Equal(t, test.expectedAnnotations, pv.Annotations)
+		})
+	}
+}
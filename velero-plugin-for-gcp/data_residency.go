@@ -0,0 +1,168 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+	"google.golang.org/api/compute/v1"
+)
+
+// allowedRegionsConfigKey is the key of a location's config holding the
+// comma-separated regions, multi-regions and dual-regions its data may be
+// written to.
+const allowedRegionsConfigKey = "allowedRegions"
+
+var (
+	// residencyLocationRegexp matches the locations allowedRegions lists,
+	// e.g. us-central1, eu or eur4.
+	residencyLocationRegexp = regexp.MustCompile(`^[a-z]+[0-9]*(-[a-z]+[0-9]+)?$`)
+
+	// zoneRegexp matches zones, with the zone's region as its submatch.
+	zoneRegexp = regexp.MustCompile(`^([a-z]+-[a-z]+[0-9]+)-[a-z]$`)
+
+	// kmsKeyLocationRegexp matches Cloud KMS key names, with the key's
+	// location as its submatch.
+	kmsKeyLocationRegexp = regexp.MustCompile(`^projects/[^/]+/locations/([^/]+)/`)
+)
+
+func checkAllowedRegions(val string) error {
+	regions := parseList(val)
+	if len(regions) == 0 {
+		return errors.New("expected a comma-separated list of regions, e.g. europe-west3,europe-west4")
+	}
+	for _, region := range regions {
+		if !residencyLocationRegexp.MatchString(region) {
+			return errors.Errorf("invalid region %q, expected a region, multi-region or dual-region, e.g. europe-west3, eu or eur4", region)
+		}
+	}
+	return nil
+}
+
+// residencyPolicy keeps a location's data in the regions its config allows,
+// for sovereign cloud and Assured Workloads deployments. Where the data
+// would be written is checked before writing it: the bucket's location and
+// default key, the snapshot location and the location of the Cloud KMS keys
+// used. A location is allowed if it's listed, or if it's a zone of a listed
+// region; multi-regions and dual-regions must be listed themselves. A nil
+// policy allows everything.
+type residencyPolicy struct {
+	allowed []string
+
+	lock     sync.Mutex
+	verified map[string]bool
+}
+
+// newResidencyPolicy returns the policy of the allowed regions in the
+// config, or nil if none are.
+func newResidencyPolicy(config map[string]string) *residencyPolicy {
+	allowed := parseList(config[allowedRegionsConfigKey])
+	if len(allowed) == 0 {
+		return nil
+	}
+	return &residencyPolicy{allowed: allowed}
+}
+
+// allows reports whether data may be written to a location.
+func (p *residencyPolicy) allows(location string) bool {
+	location = strings.ToLower(location)
+	region := location
+	if m := zoneRegexp.FindStringSubmatch(location); m != nil {
+		region = m[1]
+	}
+	for _, allowed := range p.allowed {
+		if location == allowed || region == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// check returns an error if what's described would be written outside the
+// allowed regions.
+func (p *residencyPolicy) check(what, location string) error {
+	if p == nil || p.allows(location) {
+		return nil
+	}
+	return errors.Errorf("%s is in %s, which isn't one of the %s %s", what, strings.ToLower(location), allowedRegionsConfigKey, strings.Join(p.allowed, ","))
+}
+
+// checkKMSKey returns an error if a Cloud KMS key that's set is outside
+// the allowed regions.
+func (p *residencyPolicy) checkKMSKey(what, keyName string) error {
+	if p == nil || keyName == "" {
+		return nil
+	}
+	m := kmsKeyLocationRegexp.FindStringSubmatch(keyName)
+	if m == nil {
+		return errors.Errorf("unable to determine the location of %s %s", what, keyName)
+	}
+	return p.check(what+" "+keyName, m[1])
+}
+
+// verify runs a check of a resource once it passes, so resources whose
+// location must be read, like buckets, are only read once.
+func (p *residencyPolicy) verify(resource string, check func() error) error {
+	if p == nil {
+		return nil
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.verified[resource] {
+		return nil
+	}
+	if err := check(); err != nil {
+		return err
+	}
+	if p.verified == nil {
+		p.verified = make(map[string]bool)
+	}
+	p.verified[resource] = true
+	return nil
+}
+
+// ensureResidency returns an error if the bucket, or its default Cloud KMS
+// key, is outside the allowed regions.
+func (o *ObjectStore) ensureResidency(bucket string) error {
+	return o.residency.verify(bucket, func() error {
+		attrs, err := o.clients().bucketWriter.getBucketAttrs(bucket)
+		if err != nil {
+			return errors.Wrapf(err, "error getting attributes of bucket %s to verify its location", bucket)
+		}
+		if err := o.residency.check("bucket "+bucket, attrs.Location); err != nil {
+			return err
+		}
+		if attrs.Encryption != nil {
+			return o.residency.checkKMSKey("default key of bucket "+bucket, attrs.Encryption.DefaultKMSKeyName)
+		}
+		return nil
+	})
+}
+
+// checkSnapshotResidency returns an error if snapshotting a disk would
+// write outside the allowed regions: snapshots of disks encrypted with a
+// Cloud KMS key are encrypted with the same key.
+func (b *VolumeSnapshotter) checkSnapshotResidency(disk *compute.Disk) error {
+	if disk.DiskEncryptionKey == nil {
+		return nil
+	}
+	return b.residency.checkKMSKey("key of disk "+disk.Name, disk.DiskEncryptionKey.KmsKeyName)
+}
@@ -0,0 +1,139 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"cloud.google.com/go/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	velerotest "github.com/vmware-tanzu/velero/pkg/test"
+	"google.golang.org/api/compute/v1"
+)
+
+func TestResidencyPolicy(t *testing.T) {
+	var unrestricted *residencyPolicy
+	assert.Nil(t, newResidencyPolicy(map[string]string{}))
+	assert.NoError(t, unrestricted.check("bucket b", "US"))
+	assert.NoError(t, unrestricted.checkKMSKey("key", "projects/p/locations/global/keyRings/r/cryptoKeys/k"))
+
+	p := newResidencyPolicy(map[string]string{allowedRegionsConfigKey: "europe-west3, eur4"})
+	for location, allowed := range map[string]bool{
+		"europe-west3":   true,
+		"EUROPE-WEST3":   true,
+		"europe-west3-b": true,
+		"EUR4":           true,
+		"europe-west4":   false,
+		"eu":             false,
+		"us-central1-a":  false,
+		"global":         false,
+	} {
+		assert.Equal(t, allowed, p.allows(location), location)
+	}
+
+	err := p.check("bucket b", "EU")
+	require.Error(t, err)
+	assert.Equal(t, "bucket b is in eu, which isn't one of the allowedRegions europe-west3,eur4", err.Error())
+
+	assert.NoError(t, p.checkKMSKey("kmsKeyName", ""))
+	assert.NoError(t, p.checkKMSKey("kmsKeyName", "projects/p/locations/europe-west3/keyRings/r/cryptoKeys/k"))
+	assert.Error(t, p.checkKMSKey("kmsKeyName", "projects/p/locations/global/keyRings/r/cryptoKeys/k"))
+	assert.Error(t, p.checkKMSKey("kmsKeyName", "k"))
+}
+
+func TestCheckAllowedRegions(t *testing.T) {
+	for _, val := range []string{"europe-west3", "eu,nam4", "us-central1, us-east1"} {
+		assert.NoError(t, checkAllowedRegions(val), val)
+	}
+	for _, val := range []string{"", " , ", "europe-west3-a", "projects/p/locations/eu", "Europe"} {
+		assert.Error(t, checkAllowedRegions(val), val)
+	}
+}
+
+func TestObjectStoreResidency(t *testing.T) {
+	err := newObjectStore(velerotest.NewLogger()).Init(map[string]string{
+		allowedRegionsConfigKey: "europe-west3",
+		kmsKeyNameConfigKey:     "projects/p/locations/us/keyRings/r/cryptoKeys/k",
+	})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "kmsKeyName projects/p/locations/us/keyRings/r/cryptoKeys/k is in us")
+
+	o := newObjectStore(velerotest.NewLogger())
+	writer := newFakeWriter(newMockWriteCloser(nil, nil))
+	writer.bucketAttrs = &storage.BucketAttrs{Location: "US"}
+	o.setClients(func(c *objectStoreClients) { c.bucketWriter = writer })
+	o.residency = newResidencyPolicy(map[string]string{allowedRegionsConfigKey: "europe-west3"})
+
+	// nothing is written to buckets outside the allowed regions
+	err = o.PutObject("bucket", "backups/b1/b1.tar.gz", strings.NewReader("contents"))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "bucket bucket is in us")
+
+	writer.bucketAttrs = &storage.BucketAttrs{
+		Location:   "EUROPE-WEST3",
+		Encryption: &storage.BucketEncryption{DefaultKMSKeyName: "projects/p/locations/global/keyRings/r/cryptoKeys/k"},
+	}
+	assert.Error(t, o.PutObject("bucket", "backups/b1/b1.tar.gz", strings.NewReader("contents")))
+
+	writer.bucketAttrs.Encryption.DefaultKMSKeyName = "projects/p/locations/europe-west3/keyRings/r/cryptoKeys/k"
+	require.NoError(t, o.PutObject("bucket", "backups/b1/b1.tar.gz", strings.NewReader("contents")))
+
+	// buckets are only verified once
+	writer.bucketAttrs = &storage.BucketAttrs{Location: "US"}
+	assert.NoError(t, o.PutObject("bucket", "backups/b1/b1.tar.gz", strings.NewReader("contents")))
+}
+
+func TestVolumeSnapshotterResidency(t *testing.T) {
+	for _, config := range []map[string]string{
+		{allowedRegionsConfigKey: "europe-west3"},
+		{allowedRegionsConfigKey: "europe-west3", snapshotLocationKey: "eu"},
+	} {
+		assert.Error(t, newVolumeSnapshotter(velerotest.NewLogger()).Init(config), config)
+	}
+
+	var inserted []string
+	gce := newFakeComputeService(t, func(w http.ResponseWriter, r *http.Request) {
+		inserted = append(inserted, r.URL.Path)
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+	b := (&VolumeSnapshotter{
+		log:             velerotest.NewLogger(),
+		volumeProject:   "p",
+		snapshotProject: "p",
+		residency:       newResidencyPolicy(map[string]string{allowedRegionsConfigKey: "europe-west3"}),
+	}).withClients(&snapshotterClients{
+		gce: gce,
+	})
+
+	// volumes aren't restored outside the allowed regions
+	_, err := b.createVolumeFromSnapshot("snap-1", "pd-standard", "europe-west3-a__us-central1-a")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "zone of restored volume is in us-central1-a")
+	assert.Empty(t, inserted)
+
+	// nor are disks whose key is outside them snapshotted
+	assert.NoError(t, b.checkSnapshotResidency(&compute.Disk{Name: "disk-1"}))
+	err = b.checkSnapshotResidency(&compute.Disk{
+		Name:              "disk-1",
+		DiskEncryptionKey: &compute.CustomerEncryptionKey{KmsKeyName: "projects/p/locations/us-central1/keyRings/r/cryptoKeys/k/cryptoKeyVersions/1"},
+	})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "key of disk disk-1")
+}
@@ -0,0 +1,243 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	api "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	"github.com/vmware-tanzu/velero/pkg/plugin/framework"
+	"github.com/vmware-tanzu/velero/pkg/plugin/velero"
+	"google.golang.org/api/cloudresourcemanager/v3"
+	"google.golang.org/api/compute/v1"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+const (
+	diskMetadataActionName = "velero.io/gcp-disk-metadata"
+
+	// diskMetadataAnnotation is the annotation of backed up persistent
+	// volumes holding the JSON encoded metadata of their disk.
+	diskMetadataAnnotation = "gcp.velero.io/disk-metadata"
+
+	zoneLabel     = "topology.kubernetes.io/zone"
+	betaZoneLabel = "failure-domain.beta.kubernetes.io/zone"
+)
+
+// diskMetadata is the metadata of the disk backing a persistent volume, as
+// recorded in the diskMetadataAnnotation.
+type diskMetadata struct {
+	Name             string            `json:"name"`
+	Project          string            `json:"project"`
+	Zone             string            `json:"zone,omitempty"`
+	Region           string            `json:"region,omitempty"`
+	ReplicaZones     []string          `json:"replicaZones,omitempty"`
+	Type             string            `json:"type"`
+	SizeGB           int64             `json:"sizeGb"`
+	Labels           map[string]string `json:"labels,omitempty"`
+	ResourcePolicies []string          `json:"resourcePolicies,omitempty"`
+	KMSKeyName       string            `json:"kmsKeyName,omitempty"`
+	ProvisionedIOPS  int64             `json:"provisionedIops,omitempty"`
+	Tags             []diskTag         `json:"tags,omitempty"`
+}
+
+// diskRef identifies a zonal or regional persistent disk.
+type diskRef struct {
+	project  string
+	location string
+	name     string
+	regional bool
+}
+
+// diskGetter returns a persistent disk.
+type diskGetter func(ctx context.Context, ref diskRef) (*compute.Disk, error)
+
+// DiskMetadataAction is a backup item action that records the type, labels,
+// tags, resource policies, encryption key and provisioned performance of the
+// disks backing persistent volumes as annotations, so restores can recreate
+// equivalent disks.
+type DiskMetadataAction struct {
+	log     logrus.FieldLogger
+	cluster veleroCluster
+
+	once    sync.Once
+	project string
+	getDisk diskGetter
+	tags    diskTagBinder
+	initErr error
+}
+
+func newDiskMetadataAction(logger logrus.FieldLogger) (interface{}, error) {
+	return &DiskMetadataAction{log: logger, cluster: inCluster{}}, nil
+}
+
+func (a *DiskMetadataAction) AppliesTo() (velero.ResourceSelector, error) {
+	return velero.ResourceSelector{
+		IncludedResources: []string{"persistentvolumes"},
+	}, nil
+}
+
+// init creates the compute client from the action's ConfigMap, which can
+// hold the same credentials settings and project as a VolumeSnapshotLocation.
+func (a *DiskMetadataAction) init() error {
+	a.once.Do(func() {
+		if a.getDisk != nil {
+			return
+		}
+
+		opts, project, config, err := newActionClientOptions(a.cluster, framework.PluginKindBackupItemAction, diskMetadataActionName, compute.ComputeReadonlyScope, cloudresourcemanager.CloudPlatformReadOnlyScope)
+		if err != nil {
+			a.initErr = err
+			return
+		}
+		gce, err := newActionComputeClient(a.log, config, opts)
+		if err != nil {
+			a.initErr = err
+			return
+		}
+		a.project = project
+		a.tags = newTagBindings(a.log, opts)
+		a.getDisk = func(ctx context.Context, ref diskRef) (*compute.Disk, error) {
+			// the volume snapshotter reuses the disk for the volume's snapshot
+			list := func(project string) (map[diskRef]*compute.Disk, error) {
+				return listProjectDisks(ctx, gce, project)
+			}
+			return computeLookups.disk(ref, list, func() (*compute.Disk, error) {
+				if ref.regional {
+					return gce.RegionDisks.Get(ref.project, ref.location, ref.name).Context(ctx).Do()
+				}
+				return gce.Disks.Get(ref.project, ref.location, ref.name).Context(ctx).Do()
+			})
+		}
+	})
+	return a.initErr
+}
+
+func (a *DiskMetadataAction) Execute(item runtime.Unstructured, backup *api.Backup) (runtime.Unstructured, []velero.ResourceIdentifier, error) {
+	pv := new(v1.PersistentVolume)
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(item.UnstructuredContent(), pv); err != nil {
+		return nil, nil, errors.WithStack(err)
+	}
+
+	log := a.log.WithField("persistentVolume", pv.Name)
+
+	// the metadata is best effort, so failures to get it don't fail the
+	// backup
+	if err := a.init(); err != nil {
+		log.WithError(err).Warn("Unable to record disk metadata")
+		return item, nil, nil
+	}
+
+	ref, ok := pvDiskRef(pv, a.project)
+	if !ok {
+		return item, nil, nil
+	}
+
+	disk, err := a.getDisk(context.Background(), ref)
+	if err != nil {
+		log.WithError(err).Warnf("Unable to get disk %s to record its metadata", ref.name)
+		return item, nil, nil
+	}
+
+	m := newDiskMetadata(ref, disk)
+	if a.tags != nil {
+		if m.Tags, err = a.tags.list(context.Background(), ref, disk.Id); err != nil {
+			log.WithError(err).Warnf("Unable to record the tags of disk %s", ref.name)
+		}
+	}
+
+	metadata, err := json.Marshal(m)
+	if err != nil {
+		return nil, nil, errors.WithStack(err)
+	}
+
+	obj := &unstructured.Unstructured{Object: item.UnstructuredContent()}
+	annotations := obj.GetAnnotations()
+	if annotations == nil {
+		annotations = make(map[string]string)
+	}
+	annotations[diskMetadataAnnotation] = string(metadata)
+	obj.SetAnnotations(annotations)
+
+	return obj, nil, nil
+}
+
+// pvDiskRef returns the persistent disk backing a persistent volume, if it
+// is backed by one.
+func pvDiskRef(pv *v1.PersistentVolume, defaultProject string) (diskRef, bool) {
+	if pv.Spec.CSI != nil {
+		handle := pv.Spec.CSI.VolumeHandle
+		if pv.Spec.CSI.Driver != pdCSIDriver || !pdVolRegexp.MatchString(handle) {
+			return diskRef{}, false
+		}
+		// projects/{project}/{zones|regions}/{location}/disks/{name}
+		parts := strings.Split(handle, "/")
+		return diskRef{project: parts[1], location: parts[3], name: parts[5], regional: parts[2] == "regions"}, true
+	}
+
+	if pv.Spec.GCEPersistentDisk == nil || pv.Spec.GCEPersistentDisk.PDName == "" || defaultProject == "" {
+		return diskRef{}, false
+	}
+	zone := pv.Labels[zoneLabel]
+	if zone == "" {
+		zone = pv.Labels[betaZoneLabel]
+	}
+	if zone == "" {
+		return diskRef{}, false
+	}
+	ref := diskRef{project: defaultProject, location: zone, name: pv.Spec.GCEPersistentDisk.PDName}
+	if isMultiZone(zone) {
+		region, err := parseRegion(zone)
+		if err != nil {
+			return diskRef{}, false
+		}
+		ref.location, ref.regional = region, true
+	}
+	return ref, true
+}
+
+func newDiskMetadata(ref diskRef, disk *compute.Disk) diskMetadata {
+	m := diskMetadata{
+		Name:             disk.Name,
+		Project:          ref.project,
+		Type:             path.Base(disk.Type),
+		SizeGB:           disk.SizeGb,
+		Labels:           disk.Labels,
+		ResourcePolicies: disk.ResourcePolicies,
+		ProvisionedIOPS:  disk.ProvisionedIops,
+	}
+	if ref.regional {
+		m.Region = ref.location
+	} else {
+		m.Zone = ref.location
+	}
+	for _, zone := range disk.ReplicaZones {
+		m.ReplicaZones = append(m.ReplicaZones, path.Base(zone))
+	}
+	if disk.DiskEncryptionKey != nil {
+		m.KMSKeyName = disk.DiskEncryptionKey.KmsKeyName
+	}
+	return m
+}
@@ -0,0 +1,206 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/api/compute/v1"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+
+	velerotest "github.com/vmware-tanzu/velero/pkg/test"
+)
+
+func TestPVDiskRef(t *testing.T) {
+	tests := []struct {
+		name     string
+		pv       *v1.PersistentVolume
+		expected diskRef
+		ok       bool
+	}{
+		{
+			name: "CSI zonal disk",
+			pv: &v1.PersistentVolume{Spec: v1.PersistentVolumeSpec{PersistentVolumeSource: v1.PersistentVolumeSource{
+				CSI: &v1.CSIPersistentVolumeSource{Driver: pdCSIDriver, VolumeHandle: "projects/disk-project/zones/us-central1-a/disks/pvc-1"},
+			}}},
+			expected: diskRef{project: "disk-project", location: "us-central1-a", name: "pvc-1"},
+			ok:       true,
+		},
+		{
+			name: "CSI regional disk",
+			pv: &v1.PersistentVolume{Spec: v1.PersistentVolumeSpec{PersistentVolumeSource: v1.PersistentVolumeSource{
+				CSI: &v1.CSIPersistentVolumeSource{Driver: pdCSIDriver, VolumeHandle: "projects/disk-project/regions/us-central1/disks/pvc-1"},
+			}}},
+			expected: diskRef{project: "disk-project", location: "us-central1", name: "pvc-1", regional: true},
+			ok:       true,
+		},
+		{
+			name: "other CSI driver",
+			pv: &v1.PersistentVolume{Spec: v1.PersistentVolumeSpec{PersistentVolumeSource: v1.PersistentVolumeSource{
+				CSI: &v1.CSIPersistentVolumeSource{Driver: "filestore.csi.storage.gke.io", VolumeHandle: "modeInstance/us-central1/fs/share"},
+			}}},
+		},
+		{
+			name: "in-tree disk",
+			pv: &v1.PersistentVolume{
+				ObjectMeta: metav1.ObjectMeta{Labels: map[string]string{betaZoneLabel: "us-central1-b"}},
+				Spec: v1.PersistentVolumeSpec{PersistentVolumeSource: v1.PersistentVolumeSource{
+					GCEPersistentDisk: &v1.GCEPersistentDiskVolumeSource{PDName: "pd-1"},
+				}},
+			},
+			expected: diskRef{project: "default-project", location: "us-central1-b", name: "pd-1"},
+			ok:       true,
+		},
+		{
+			name: "in-tree regional disk",
+			pv: &v1.PersistentVolume{
+				ObjectMeta: metav1.ObjectMeta{Labels: map[string]string{zoneLabel: "us-central1-a__us-central1-b"}},
+				Spec: v1.PersistentVolumeSpec{PersistentVolumeSource: v1.PersistentVolumeSource{
+					GCEPersistentDisk: &v1.GCEPersistentDiskVolumeSource{PDName: "pd-1"},
+				}},
+			},
+			expected: diskRef{project: "default-project", location: "us-central1", name: "pd-1", regional: true},
+			ok:       true,
+		},
+		{
+			name: "in-tree disk without zone",
+			pv: &v1.PersistentVolume{Spec: v1.PersistentVolumeSpec{PersistentVolumeSource: v1.PersistentVolumeSource{
+				GCEPersistentDisk: &v1.GCEPersistentDiskVolumeSource{PDName: "pd-1"},
+			}}},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ref, ok := pvDiskRef(test.pv, "default-project")
+			assert.Equal(t, test.ok, ok)
+			assert.Equal(t, test.expected, ref)
+		})
+	}
+}
+
+func TestDiskMetadataActionExecute(t *testing.T) {
+	pv := &v1.PersistentVolume{
+		TypeMeta:   metav1.TypeMeta{APIVersion: "v1", Kind: "PersistentVolume"},
+		ObjectMeta: metav1.ObjectMeta{Name: "pv-1"},
+		Spec: v1.PersistentVolumeSpec{PersistentVolumeSource: v1.PersistentVolumeSource{
+			CSI: &v1.CSIPersistentVolumeSource{Driver: pdCSIDriver, VolumeHandle: "projects/disk-project/zones/us-central1-a/disks/pvc-1"},
+		}},
+	}
+	content, err := runtime.DefaultUnstructuredConverter.ToUnstructured(pv)
+	require.NoError(t, err)
+
+	action := &DiskMetadataAction{log: velerotest.NewLogger()}
+	action.getDisk = func(_ context.Context, ref diskRef) (*compute.Disk, error) {
+		assert.Equal(t, diskRef{project: "disk-project", location: "us-central1-a", name: "pvc-1"}, ref)
+		return &compute.Disk{
+			Name:              "pvc-1",
+			Type:              "https://www.googleapis.com/compute/v1/projects/disk-project/zones/us-central1-a/diskTypes/pd-extreme",
+			SizeGb:            100,
+			Labels:            map[string]string{"team": "db"},
+			ResourcePolicies:  []string{"https://www.googleapis.com/compute/v1/projects/disk-project/regions/us-central1/resourcePolicies/daily"},
+			DiskEncryptionKey: &compute.CustomerEncryptionKey{KmsKeyName: "projects/kms/locations/us-central1/keyRings/r/cryptoKeys/k/cryptoKeyVersions/1"},
+			ProvisionedIops:   10000,
+		}, nil
+	}
+
+	out, _, err := action.Execute(&unstructured.Unstructured{Object: content}, nil)
+	require.NoError(t, err)
+
+	annotations := (&unstructured.Unstructured{Object: out.UnstructuredContent()}).GetAnnotations()
+	var metadata diskMetadata
+	require.NoError(t, json.Unmarshal([]byte(annotations[diskMetadataAnnotation]), &metadata))
+	assert.Equal(t, diskMetadata{
+		Name:             "pvc-1",
+		Project:          "disk-project",
+		Zone:             "us-central1-a",
+		Type:             "pd-extreme",
+		SizeGB:           100,
+		Labels:           map[string]string{"team": "db"},
+		ResourcePolicies: []string{"https://www.googleapis.com/compute/v1/projects/disk-project/regions/us-central1/resourcePolicies/daily"},
+		KMSKeyName:       "projects/kms/locations/us-central1/keyRings/r/cryptoKeys/k/cryptoKeyVersions/1",
+		ProvisionedIOPS:  10000,
+	}, metadata)
+
+	// failing to get the disk doesn't fail the backup
+	action.getDisk = func(context.Context, diskRef) (*compute.Disk, error) {
+		return nil, errors.New("forbidden")
+	}
+	fresh, err := runtime.DefaultUnstructuredConverter.ToUnstructured(pv)
+	require.NoError(t, err)
+	out, _, err = action.Execute(&unstructured.Unstructured{Object: fresh}, nil)
+	require.NoError(t, err)
+	assert.Empty(t, (&unstructured.Unstructured{Object: out.UnstructuredContent()}).GetAnnotations())
+}
+
+type fakeDiskTags struct {
+	tags  []diskTag
+	bound []string
+	err   error
+}
+
+func (f *fakeDiskTags) list(_ context.Context, ref diskRef, id uint64) ([]diskTag, error) {
+	return f.tags, f.err
+}
+
+func (f *fakeDiskTags) bind(_ context.Context, ref diskRef, id uint64, value string) error {
+	if f.err != nil {
+		return f.err
+	}
+	f.bound = append(f.bound, diskResourceName(ref, id)+" "+value)
+	return nil
+}
+
+func TestDiskMetadataActionRecordsTags(t *testing.T) {
+	pv := &v1.PersistentVolume{
+		TypeMeta:   metav1.TypeMeta{APIVersion: "v1", Kind: "PersistentVolume"},
+		ObjectMeta: metav1.ObjectMeta{Name: "pv-1"},
+		Spec: v1.PersistentVolumeSpec{PersistentVolumeSource: v1.PersistentVolumeSource{
+			CSI: &v1.CSIPersistentVolumeSource{Driver: pdCSIDriver, VolumeHandle: "projects/disk-project/zones/us-central1-a/disks/pvc-1"},
+		}},
+	}
+	content, err := runtime.DefaultUnstructuredConverter.ToUnstructured(pv)
+	require.NoError(t, err)
+
+	tags := &fakeDiskTags{tags: []diskTag{{Value: "tagValues/1", NamespacedName: "123/env/prod"}}}
+	action := &DiskMetadataAction{log: velerotest.NewLogger(), tags: tags}
+	action.getDisk = func(context.Context, diskRef) (*compute.Disk, error) {
+		return &compute.Disk{Name: "pvc-1", Id: 42}, nil
+	}
+
+	out, _, err := action.Execute(&unstructured.Unstructured{Object: content}, nil)
+	require.NoError(t, err)
+	var metadata diskMetadata
+	require.NoError(t, json.Unmarshal([]byte((&unstructured.Unstructured{Object: out.UnstructuredContent()}).GetAnnotations()[diskMetadataAnnotation]), &metadata))
+	assert.Equal(t, tags.tags, metadata.Tags)
+
+	// failing to list tags still records the rest of the metadata
+	tags.err = errors.New("forbidden")
+	fresh, err := runtime.DefaultUnstructuredConverter.ToUnstructured(pv)
+	require.NoError(t, err)
+	out, _, err = action.Execute(&unstructured.Unstructured{Object: fresh}, nil)
+	require.NoError(t, err)
+	assert.Contains(t, (&unstructured.Unstructured{Object: out.UnstructuredContent()}).GetAnnotations(), diskMetadataAnnotation)
+}
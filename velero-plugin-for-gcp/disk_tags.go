@@ -0,0 +1,296 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/vmware-tanzu/velero/pkg/plugin/framework"
+	"github.com/vmware-tanzu/velero/pkg/plugin/velero"
+	"google.golang.org/api/cloudresourcemanager/v3"
+	"google.golang.org/api/compute/v1"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/option"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	diskTagsActionName = "velero.io/gcp-disk-tags"
+
+	// tagValuesConfigKey maps the tag values bound to backed up disks, by
+	// ID or namespaced name, to the tag values to bind to their restored
+	// disks, e.g. when restoring into another organization.
+	tagValuesConfigKey = "tagValues"
+)
+
+// diskTag is a tag value bound to a disk, as recorded in the disk's metadata.
+type diskTag struct {
+	// Value is the tag value's name, tagValues/ID.
+	Value string `json:"value"`
+	// NamespacedName is the tag value's namespaced name,
+	// ORGANIZATION_ID/KEY/VALUE, if it could be read.
+	NamespacedName string `json:"namespacedName,omitempty"`
+}
+
+// diskTagBinder lists and creates the tag bindings of disks.
+type diskTagBinder interface {
+	list(ctx context.Context, ref diskRef, id uint64) ([]diskTag, error)
+	bind(ctx context.Context, ref diskRef, id uint64, value string) error
+}
+
+// diskResourceName returns the full resource name of a disk that tags are
+// bound to, which names the disk by its numeric ID.
+func diskResourceName(ref diskRef, id uint64) string {
+	scope := "zones"
+	if ref.regional {
+		scope = "regions"
+	}
+	return fmt.Sprintf("//compute.googleapis.com/projects/%s/%s/%s/disks/%d", ref.project, scope, ref.location, id)
+}
+
+// tagsEndpoint returns the Resource Manager endpoint managing the tags of
+// resources in a location, or the global endpoint for an empty location.
+func tagsEndpoint(location string) string {
+	if location == "" {
+		return ""
+	}
+	return fmt.Sprintf("https://%s-cloudresourcemanager.googleapis.com/", location)
+}
+
+// tagBindings manages the tag bindings of disks and snapshots with the
+// Resource Manager API. The tags of zonal and regional resources are managed through
+// endpoints in their location.
+type tagBindings struct {
+	log  logrus.FieldLogger
+	opts []option.ClientOption
+	// endpoint returns the endpoint of a location, see tagsEndpoint.
+	endpoint func(location string) string
+
+	lock     sync.Mutex
+	services map[string]*cloudresourcemanager.Service
+}
+
+func newTagBindings(log logrus.FieldLogger, opts []option.ClientOption) *tagBindings {
+	return &tagBindings{log: log, opts: opts, endpoint: tagsEndpoint, services: make(map[string]*cloudresourcemanager.Service)}
+}
+
+func (t *tagBindings) service(ctx context.Context, location string) (*cloudresourcemanager.Service, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if svc, ok := t.services[location]; ok {
+		return svc, nil
+	}
+	opts := t.opts
+	if endpoint := t.endpoint(location); endpoint != "" {
+		opts = append(append([]option.ClientOption(nil), opts...), option.WithEndpoint(endpoint))
+	}
+	opts, err := instrumentClientOptions(ctx, t.log, resourceManagerService, opts)
+	if err != nil {
+		return nil, err
+	}
+	svc, err := cloudresourcemanager.NewService(ctx, opts...)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	t.services[location] = svc
+	return svc, nil
+}
+
+func (t *tagBindings) list(ctx context.Context, ref diskRef, id uint64) ([]diskTag, error) {
+	svc, err := t.service(ctx, ref.location)
+	if err != nil {
+		return nil, err
+	}
+	var tags []diskTag
+	err = svc.TagBindings.List().Parent(diskResourceName(ref, id)).Pages(ctx, func(page *cloudresourcemanager.ListTagBindingsResponse) error {
+		for _, binding := range page.TagBindings {
+			tags = append(tags, diskTag{Value: binding.TagValue})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "error listing tags of disk %s", ref.name)
+	}
+	if len(tags) == 0 {
+		return nil, nil
+	}
+
+	// namespaced names identify tag values across organizations, but are
+	// only informational, so failing to read them is fine
+	global, err := t.service(ctx, "")
+	if err != nil {
+		return tags, nil
+	}
+	for i := range tags {
+		if value, err := global.TagValues.Get(tags[i].Value).Context(ctx).Do(); err == nil {
+			tags[i].NamespacedName = value.NamespacedName
+		}
+	}
+	return tags, nil
+}
+
+func (t *tagBindings) bind(ctx context.Context, ref diskRef, id uint64, value string) error {
+	return errors.WithMessagef(t.bindResource(ctx, ref.location, diskResourceName(ref, id), value), "disk %s", ref.name)
+}
+
+// bindResource binds a tag value to the resource with a full resource name,
+// whose tags are managed through the endpoint of a location. Values already
+// bound are fine.
+func (t *tagBindings) bindResource(ctx context.Context, location, resource, value string) error {
+	svc, err := t.service(ctx, location)
+	if err != nil {
+		return err
+	}
+	call := svc.TagBindings.Create(&cloudresourcemanager.TagBinding{Parent: resource, TagValue: value})
+	setRequestReason(call, requestReasonFrom(ctx))
+	_, err = call.Context(ctx).Do()
+	if gcpErr, ok := err.(*googleapi.Error); ok && gcpErr.Code == http.StatusConflict {
+		return nil
+	}
+	return errors.Wrapf(err, "error binding tag value %s", value)
+}
+
+// DiskTagsAction is a restore item action that binds the tags recorded in
+// the disk metadata of backed up persistent volumes to their restored disks,
+// since IAM conditions and organization policies based on tags otherwise
+// don't apply to them anymore.
+type DiskTagsAction struct {
+	log     logrus.FieldLogger
+	cluster veleroCluster
+
+	once      sync.Once
+	project   string
+	getDisk   diskGetter
+	tags      diskTagBinder
+	values    map[string]string
+	configErr error
+}
+
+func newDiskTagsAction(logger logrus.FieldLogger) (interface{}, error) {
+	return &DiskTagsAction{log: logger, cluster: inCluster{}}, nil
+}
+
+func (a *DiskTagsAction) AppliesTo() (velero.ResourceSelector, error) {
+	return velero.ResourceSelector{
+		IncludedResources: []string{"persistentvolumes"},
+	}, nil
+}
+
+// loadConfig creates the clients from the action's ConfigMap, which can hold
+// the same credentials settings and project as a VolumeSnapshotLocation, and
+// reads the tag value mapping.
+func (a *DiskTagsAction) loadConfig() error {
+	a.once.Do(func() {
+		opts, project, config, err := newActionClientOptions(a.cluster, framework.PluginKindRestoreItemAction, diskTagsActionName, compute.ComputeReadonlyScope, cloudresourcemanager.CloudPlatformScope)
+		if err != nil {
+			a.configErr = err
+			return
+		}
+		if err := yaml.Unmarshal([]byte(config[tagValuesConfigKey]), &a.values); err != nil {
+			a.configErr = errors.Wrapf(err, "error parsing %s in the %s ConfigMap", tagValuesConfigKey, diskTagsActionName)
+			return
+		}
+		if a.getDisk != nil {
+			return
+		}
+		gce, err := newActionComputeClient(a.log, config, opts)
+		if err != nil {
+			a.configErr = err
+			return
+		}
+		a.project = project
+		a.getDisk = func(ctx context.Context, ref diskRef) (*compute.Disk, error) {
+			if ref.regional {
+				return gce.RegionDisks.Get(ref.project, ref.location, ref.name).Context(ctx).Do()
+			}
+			return gce.Disks.Get(ref.project, ref.location, ref.name).Context(ctx).Do()
+		}
+		a.tags = newTagBindings(a.log, opts)
+	})
+	return a.configErr
+}
+
+func (a *DiskTagsAction) Execute(input *velero.RestoreItemActionExecuteInput) (*velero.RestoreItemActionExecuteOutput, error) {
+	output := velero.NewRestoreItemActionExecuteOutput(input.Item)
+	if input.ItemFromBackup == nil {
+		return output, nil
+	}
+	backedUp := new(v1.PersistentVolume)
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(input.ItemFromBackup.UnstructuredContent(), backedUp); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	var metadata diskMetadata
+	if data := backedUp.Annotations[diskMetadataAnnotation]; data == "" || json.Unmarshal([]byte(data), &metadata) != nil || len(metadata.Tags) == 0 {
+		return output, nil
+	}
+
+	pv := new(v1.PersistentVolume)
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(input.Item.UnstructuredContent(), pv); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	// disks that weren't restored from snapshots still have their tags
+	if pvVolumeID(pv) == pvVolumeID(backedUp) {
+		return output, nil
+	}
+	if err := a.loadConfig(); err != nil {
+		return nil, err
+	}
+
+	log := a.log.WithField("persistentVolume", pv.Name)
+	ref, ok := pvDiskRef(pv, a.project)
+	if !ok {
+		return output, nil
+	}
+
+	// tags are best effort like the rest of the disk metadata, but
+	// missing ones are logged as warnings since policies may depend on them
+	ctx := context.Background()
+	if input.Restore != nil {
+		ctx = withRequestReason(ctx, requestReason(restoreOperation, input.Restore.Name))
+	}
+	disk, err := a.getDisk(ctx, ref)
+	if err != nil {
+		log.WithError(err).Warnf("Unable to get restored disk %s to bind its tags", ref.name)
+		return output, nil
+	}
+	for _, tag := range metadata.Tags {
+		value := tag.Value
+		if mapped, ok := a.values[tag.Value]; ok {
+			value = mapped
+		} else if mapped, ok := a.values[tag.NamespacedName]; ok && tag.NamespacedName != "" {
+			value = mapped
+		}
+		if value == "" {
+			continue
+		}
+		if err := a.tags.bind(ctx, ref, disk.Id, value); err != nil {
+			log.WithError(err).Warnf("Unable to bind tag value %s to restored disk %s", value, ref.name)
+			continue
+		}
+		log.Infof("Bound tag value %s to restored disk %s", value, ref.name)
+	}
+	return output, nil
+}
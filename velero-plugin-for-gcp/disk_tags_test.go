@@ -0,0 +1,138 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vmware-tanzu/velero/pkg/plugin/velero"
+	"google.golang.org/api/cloudresourcemanager/v3"
+	"google.golang.org/api/compute/v1"
+	"google.golang.org/api/option"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+
+	velerotest "github.com/vmware-tanzu/velero/pkg/test"
+)
+
+func TestDiskResourceName(t *testing.T) {
+	assert.Equal(t, "//compute.googleapis.com/projects/p/zones/us-central1-a/disks/42", diskResourceName(diskRef{project: "p", location: "us-central1-a", name: "pvc-1"}, 42))
+	assert.Equal(t, "//compute.googleapis.com/projects/p/regions/us-central1/disks/42", diskResourceName(diskRef{project: "p", location: "us-central1", name: "pvc-1", regional: true}, 42))
+}
+
+func TestTagBindings(t *testing.T) {
+	var created []cloudresourcemanager.TagBinding
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodGet && r.URL.Path == "/us-central1-a/v3/tagBindings":
+			assert.Equal(t, "//compute.googleapis.com/projects/p/zones/us-central1-a/disks/42", r.URL.Query().Get("parent"))
+			json.NewEncoder(w).Encode(&cloudresourcemanager.ListTagBindingsResponse{TagBindings: []*cloudresourcemanager.TagBinding{
+				{TagValue: "tagValues/1"},
+				{TagValue: "tagValues/2"},
+			}})
+		case r.Method == http.MethodGet && r.URL.Path == "/global/v3/tagValues/1":
+			json.NewEncoder(w).Encode(&cloudresourcemanager.TagValue{NamespacedName: "123/env/prod"})
+		case r.Method == http.MethodPost && r.URL.Path == "/us-central1-a/v3/tagBindings":
+			var binding cloudresourcemanager.TagBinding
+			require.NoError(t, json.NewDecoder(r.Body).Decode(&binding))
+			created = append(created, binding)
+			if binding.TagValue == "tagValues/2" {
+				w.WriteHeader(http.StatusConflict)
+				return
+			}
+			json.NewEncoder(w).Encode(&cloudresourcemanager.Operation{})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	b := newTagBindings(velerotest.NewLogger(), []option.ClientOption{option.WithoutAuthentication()})
+	b.endpoint = func(location string) string {
+		if location == "" {
+			return server.URL + "/global/"
+		}
+		return server.URL + "/" + location + "/"
+	}
+	ref := diskRef{project: "p", location: "us-central1-a", name: "pvc-1"}
+	tags, err := b.list(context.Background(), ref, 42)
+	require.NoError(t, err)
+	assert.Equal(t, []diskTag{{Value: "tagValues/1", NamespacedName: "123/env/prod"}, {Value: "tagValues/2"}}, tags)
+
+	require.NoError(t, b.bind(context.Background(), ref, 42, "tagValues/1"))
+	require.NoError(t, b.bind(context.Background(), ref, 42, "tagValues/2"), "existing bindings are fine")
+	require.Len(t, created, 2)
+	assert.Equal(t, cloudresourcemanager.TagBinding{Parent: "//compute.googleapis.com/projects/p/zones/us-central1-a/disks/42", TagValue: "tagValues/1"}, created[0])
+}
+
+func TestDiskTagsActionExecute(t *testing.T) {
+	newPV := func(handle string, tags ...diskTag) *unstructured.Unstructured {
+		pv := &v1.PersistentVolume{
+			TypeMeta:   metav1.TypeMeta{APIVersion: "v1", Kind: "PersistentVolume"},
+			ObjectMeta: metav1.ObjectMeta{Name: "pv-1"},
+			Spec: v1.PersistentVolumeSpec{PersistentVolumeSource: v1.PersistentVolumeSource{
+				CSI: &v1.CSIPersistentVolumeSource{Driver: pdCSIDriver, VolumeHandle: handle},
+			}},
+		}
+		if len(tags) > 0 {
+			data, err := json.Marshal(diskMetadata{Name: "pvc-1", Tags: tags})
+			require.NoError(t, err)
+			pv.Annotations = map[string]string{diskMetadataAnnotation: string(data)}
+		}
+		content, err := runtime.DefaultUnstructuredConverter.ToUnstructured(pv)
+		require.NoError(t, err)
+		return &unstructured.Unstructured{Object: content}
+	}
+
+	tags := &fakeDiskTags{}
+	action := &DiskTagsAction{
+		log:    velerotest.NewLogger(),
+		tags:   tags,
+		values: map[string]string{"tagValues/2": "tagValues/20", "123/env/staging": "tagValues/30"},
+		getDisk: func(_ context.Context, ref diskRef) (*compute.Disk, error) {
+			assert.Equal(t, diskRef{project: "p", location: "us-central1-a", name: "restore-1"}, ref)
+			return &compute.Disk{Id: 42}, nil
+		},
+	}
+	action.once.Do(func() {})
+
+	backedUp := newPV("projects/p/zones/us-central1-a/disks/pvc-1", diskTag{Value: "tagValues/1"}, diskTag{Value: "tagValues/2"}, diskTag{Value: "tagValues/3", NamespacedName: "123/env/staging"})
+	_, err := action.Execute(&velero.RestoreItemActionExecuteInput{
+		Item:           newPV("projects/p/zones/us-central1-a/disks/restore-1"),
+		ItemFromBackup: backedUp,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []string{
+		"//compute.googleapis.com/projects/p/zones/us-central1-a/disks/42 tagValues/1",
+		"//compute.googleapis.com/projects/p/zones/us-central1-a/disks/42 tagValues/20",
+		"//compute.googleapis.com/projects/p/zones/us-central1-a/disks/42 tagValues/30",
+	}, tags.bound)
+
+	// disks that weren't restored from snapshots keep their tags
+	tags.bound = nil
+	_, err = action.Execute(&velero.RestoreItemActionExecuteInput{Item: backedUp, ItemFromBackup: backedUp})
+	require.NoError(t, err)
+	assert.Empty(t, tags.bound)
+}
@@ -0,0 +1,608 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"cloud.google.com/go/storage"
+	uuid "github.com/gofrs/uuid"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/pflag"
+	api "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	"google.golang.org/api/compute/v1"
+	"google.golang.org/api/iterator"
+)
+
+const (
+	replicateBackupsCommand = "replicate-backups"
+
+	// drBucketConfigKey is the key of a BackupStorageLocation's config
+	// holding the secondary bucket its backups are replicated to.
+	drBucketConfigKey = "drBucket"
+	// drPrefixConfigKey is the key of a BackupStorageLocation's config
+	// holding the prefix of the replicated backups in the secondary bucket,
+	// the location's prefix by default.
+	drPrefixConfigKey = "drPrefix"
+	// drProjectConfigKey is the key of a VolumeSnapshotLocation's config
+	// holding the secondary project its snapshots are copied to.
+	drProjectConfigKey = "drProject"
+	// drSnapshotLocationConfigKey is the key of a VolumeSnapshotLocation's
+	// config holding the storage location of the copies, the original's by
+	// default.
+	drSnapshotLocationConfigKey = "drSnapshotLocation"
+	// drKMSKeyNameConfigKey is the key of a location's config holding the
+	// Cloud KMS key the replicated objects or snapshot copies are encrypted
+	// with, instead of the originals' keys.
+	drKMSKeyNameConfigKey = "drKmsKeyName"
+
+	// drCopyOfLabel labels the disk holding a snapshot's data while it's
+	// copied to the secondary project with the snapshot's name.
+	drCopyOfLabel = "velero-dr-copy-of"
+	// drSourceProjectLabel labels the copies with the project of the
+	// original snapshot.
+	drSourceProjectLabel = "velero-dr-source-project"
+
+	drReplicationsCounter = "velero_gcp_dr_replications_total"
+)
+
+// drManifest records where a backup was replicated, written next to the
+// replicated backup's files as backups/BACKUP/BACKUP-gcp-dr.json.
+type drManifest struct {
+	Backup     string    `json:"backup"`
+	Replicated time.Time `json:"replicated"`
+	// Source is the bucket and prefix the backup was replicated from.
+	Source    drObjectLocation `json:"source"`
+	Objects   int              `json:"objects"`
+	Snapshots []drSnapshot     `json:"snapshots,omitempty"`
+	// VolumeSnapshotLocations are the projects and storage locations of
+	// the copies by VolumeSnapshotLocation, to configure the locations of
+	// the same names restores from the secondary bucket use.
+	VolumeSnapshotLocations map[string]map[string]string `json:"volumeSnapshotLocations,omitempty"`
+}
+
+type drObjectLocation struct {
+	Bucket string `json:"bucket"`
+	Prefix string `json:"prefix,omitempty"`
+}
+
+// drSnapshot is a copy of a snapshot in the secondary project, which has the
+// original's name.
+type drSnapshot struct {
+	Name                   string `json:"name"`
+	VolumeSnapshotLocation string `json:"volumeSnapshotLocation"`
+	SourceProject          string `json:"sourceProject"`
+	Project                string `json:"project"`
+}
+
+func drManifestKey(prefix, backup string) string {
+	return path.Join(prefix, "backups", backup, backup+"-gcp-dr.json")
+}
+
+// drObjectTarget is the replication target of a BackupStorageLocation.
+type drObjectTarget struct {
+	store      *ObjectStore
+	bucket     string
+	prefix     string
+	drBucket   string
+	drPrefix   string
+	kmsKeyName string
+}
+
+// drSnapshotTarget is the replication target of a VolumeSnapshotLocation.
+type drSnapshotTarget struct {
+	location         string
+	snapshotter      *VolumeSnapshotter
+	project          string
+	snapshotLocation string
+	kmsKeyName       string
+}
+
+// replicateBackupObjects copies the objects of a backup to the secondary
+// bucket, except its metadata, which is returned to be copied once the rest
+// of the backup is replicated. Objects already copied are skipped, so an
+// interrupted replication resumes where it stopped. It returns the number
+// of objects of the backup.
+func (t *drObjectTarget) replicateBackupObjects(backup string) (int, *storage.ObjectAttrs, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), storageListTimeout)
+	defer cancel()
+
+	copied := make(map[string]uint32)
+	iter := t.store.clients().readClient.Bucket(t.drBucket).Objects(ctx, &storage.Query{Prefix: path.Join(t.drPrefix, "backups", backup) + "/"})
+	for {
+		attrs, err := iter.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return 0, nil, errors.Wrapf(err, "error listing the replicated objects of backup %s", backup)
+		}
+		copied[attrs.Name] = attrs.CRC32C
+	}
+
+	var (
+		objects  []*storage.ObjectAttrs
+		metadata *storage.ObjectAttrs
+	)
+	srcPrefix := path.Join(t.prefix, "backups", backup) + "/"
+	iter = t.store.clients().readClient.Bucket(t.bucket).Objects(ctx, &storage.Query{Prefix: srcPrefix})
+	for {
+		attrs, err := iter.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return 0, nil, errors.Wrapf(err, "error listing objects of backup %s", backup)
+		}
+		if path.Base(attrs.Name) == backupMetadataFile {
+			metadata = attrs
+			continue
+		}
+		objects = append(objects, attrs)
+	}
+	if metadata == nil {
+		return 0, nil, errors.Errorf("backup %s has no %s in bucket %s", backup, backupMetadataFile, t.bucket)
+	}
+
+	for _, attrs := range objects {
+		if crc, ok := copied[t.drKey(attrs.Name)]; ok && crc == attrs.CRC32C {
+			continue
+		}
+		if err := t.copyObject(attrs); err != nil {
+			return 0, nil, err
+		}
+	}
+	return len(objects) + 1, metadata, nil
+}
+
+// drKey returns the key of an object's copy in the secondary bucket.
+func (t *drObjectTarget) drKey(key string) string {
+	return path.Join(t.drPrefix, strings.TrimPrefix(strings.TrimPrefix(key, t.prefix), "/"))
+}
+
+// copyObject copies an object to the secondary bucket, keeping its metadata
+// and encryption, or encrypting it with the target's key.
+func (t *drObjectTarget) copyObject(attrs *storage.ObjectAttrs) error {
+	ctx, cancel := context.WithTimeout(context.Background(), tierObjectTimeout)
+	defer cancel()
+
+	clients := t.store.clients()
+	src := clients.client.Bucket(attrs.Bucket).Object(attrs.Name).Generation(attrs.Generation)
+	dst := clients.client.Bucket(t.drBucket).Object(t.drKey(attrs.Name))
+	if clients.encryptionKey != nil {
+		src, dst = src.Key(clients.encryptionKey), dst.Key(clients.encryptionKey)
+	}
+	copier := dst.CopierFrom(src)
+	copier.ContentType = attrs.ContentType
+	copier.ContentEncoding = attrs.ContentEncoding
+	copier.ContentLanguage = attrs.ContentLanguage
+	copier.ContentDisposition = attrs.ContentDisposition
+	copier.CacheControl = attrs.CacheControl
+	copier.Metadata = attrs.Metadata
+	switch {
+	case t.kmsKeyName != "" && clients.encryptionKey == nil:
+		copier.DestinationKMSKeyName = t.kmsKeyName
+	case attrs.KMSKeyName != "":
+		copier.DestinationKMSKeyName = kmsCryptoKey(attrs.KMSKeyName)
+	}
+	if _, err := copier.Run(ctx); err != nil {
+		return errors.Wrapf(err, "error copying object %s to bucket %s", attrs.Name, t.drBucket)
+	}
+	return nil
+}
+
+// replicated reports whether a backup was replicated to the secondary bucket,
+// which its metadata, copied last, is only once it's complete.
+func (t *drObjectTarget) replicated(backup string) (bool, error) {
+	return t.store.ObjectExists(t.drBucket, path.Join(t.drPrefix, "backups", backup, backupMetadataFile))
+}
+
+// writeManifest writes the DR manifest of a backup to the secondary bucket.
+func (t *drObjectTarget) writeManifest(manifest *drManifest) error {
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	key := drManifestKey(t.drPrefix, manifest.Backup)
+	return errors.Wrapf(t.store.PutObject(t.drBucket, key, bytes.NewReader(data)), "error writing %s to bucket %s", key, t.drBucket)
+}
+
+// drCopyDisk returns the disk holding a snapshot's data while it's copied to
+// a project, or nil if there's none.
+func (b *VolumeSnapshotter) drCopyDisk(project, snapshot string) (*compute.Disk, error) {
+	var disk *compute.Disk
+	filter := fmt.Sprintf("labels.%s=%q", drCopyOfLabel, snapshot)
+	err := b.clients().gce.Disks.AggregatedList(project).Filter(filter).Pages(context.TODO(), func(page *compute.DiskAggregatedList) error {
+		for _, scoped := range page.Items {
+			for _, d := range scoped.Disks {
+				if d.Labels[drCopyOfLabel] == snapshot {
+					disk = d
+				}
+			}
+		}
+		return nil
+	})
+	return disk, errors.Wrapf(err, "error listing the disks copying snapshot %s in project %s", snapshot, project)
+}
+
+// replicateSnapshot copies a snapshot to the target's project with the same
+// name, description and labels. Snapshots can't be copied across projects,
+// so it's restored to a disk in the project, which is snapshotted and
+// deleted. The disk is labeled with the snapshot's name, so a copy that was
+// interrupted resumes from where it stopped. It returns whether the
+// snapshot was copied, which it isn't if the copy already exists.
+func (t *drSnapshotTarget) replicateSnapshot(snapshot *compute.Snapshot) (bool, error) {
+	b := t.snapshotter
+	gce := b.clients().gce
+	existing, err := gce.Snapshots.Get(t.project, snapshot.Name).Do()
+	if err != nil && !isNotFound(err) {
+		return false, errors.Wrapf(err, "error getting snapshot %s in project %s", snapshot.Name, t.project)
+	}
+	disk, err := b.drCopyDisk(t.project, snapshot.Name)
+	if err != nil {
+		return false, err
+	}
+	if existing != nil && existing.Status == "READY" {
+		// only the disk may be left to delete
+		if disk == nil {
+			return false, nil
+		}
+		return false, t.deleteCopyDisk(disk)
+	}
+
+	if existing == nil {
+		if disk == nil {
+			if disk, err = t.createCopyDisk(snapshot); err != nil {
+				return false, err
+			}
+		}
+		zone := path.Base(disk.Zone)
+		err = waitForTiering("disk "+disk.Name, func() (bool, error) {
+			d, err := gce.Disks.Get(t.project, zone, disk.Name).Do()
+			if err != nil {
+				return false, errors.Wrapf(err, "error getting disk %s", disk.Name)
+			}
+			if d.Status == "FAILED" {
+				return false, errors.Errorf("disk %s restored from snapshot %s failed", disk.Name, snapshot.Name)
+			}
+			disk = d
+			return d.Status == "READY", nil
+		})
+		if err != nil {
+			return false, err
+		}
+		if _, err := gce.Disks.CreateSnapshot(t.project, zone, disk.Name, t.copyOf(snapshot)).Do(); err != nil {
+			return false, errors.Wrapf(err, "error copying snapshot %s to project %s", snapshot.Name, t.project)
+		}
+	}
+
+	err = waitForTiering("copy of snapshot "+snapshot.Name, func() (bool, error) {
+		s, err := gce.Snapshots.Get(t.project, snapshot.Name).Do()
+		if err != nil {
+			return false, errors.Wrapf(err, "error getting snapshot %s in project %s", snapshot.Name, t.project)
+		}
+		if s.Status == "FAILED" {
+			return false, errors.Errorf("copy of snapshot %s in project %s failed", snapshot.Name, t.project)
+		}
+		return s.Status == "READY", nil
+	})
+	if err != nil {
+		return false, err
+	}
+	b.log.WithField("snapshot", snapshot.Name).Infof("Copied snapshot %s to project %s", snapshot.Name, t.project)
+	if disk == nil {
+		return true, nil
+	}
+	return true, t.deleteCopyDisk(disk)
+}
+
+// createCopyDisk restores a snapshot to a disk in the target's project, in
+// its source disk's zone, or a zone of its source disk's region.
+func (t *drSnapshotTarget) createCopyDisk(snapshot *compute.Snapshot) (*compute.Disk, error) {
+	zone, err := t.snapshotter.tieringZone(snapshot)
+	if err != nil {
+		return nil, err
+	}
+	uid, err := uuid.NewV4()
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	disk := &compute.Disk{
+		Name:           "dr-copy-" + uid.String(),
+		SourceSnapshot: snapshot.SelfLink,
+		Type:           fmt.Sprintf("projects/%s/zones/%s/diskTypes/pd-standard", t.project, zone),
+		Labels:         map[string]string{drCopyOfLabel: snapshot.Name},
+	}
+	if key := t.encryptionKey(snapshot); key != "" {
+		disk.DiskEncryptionKey = &compute.CustomerEncryptionKey{KmsKeyName: key}
+	}
+	if _, err := t.snapshotter.clients().gce.Disks.Insert(t.project, zone, disk).Do(); err != nil {
+		return nil, errors.Wrapf(err, "error restoring snapshot %s to a disk in project %s", snapshot.Name, t.project)
+	}
+	disk.Zone = zone
+	return disk, nil
+}
+
+func (t *drSnapshotTarget) deleteCopyDisk(disk *compute.Disk) error {
+	_, err := t.snapshotter.clients().gce.Disks.Delete(t.project, path.Base(disk.Zone), disk.Name).Do()
+	if err != nil && !isNotFound(err) {
+		return errors.Wrapf(err, "error deleting disk %s in project %s", disk.Name, t.project)
+	}
+	return nil
+}
+
+// encryptionKey returns the Cloud KMS key to encrypt a snapshot's copy
+// with: the target's, or the snapshot's own.
+func (t *drSnapshotTarget) encryptionKey(snapshot *compute.Snapshot) string {
+	if t.kmsKeyName != "" {
+		return t.kmsKeyName
+	}
+	if snapshot.SnapshotEncryptionKey != nil && snapshot.SnapshotEncryptionKey.KmsKeyName != "" {
+		return kmsCryptoKey(snapshot.SnapshotEncryptionKey.KmsKeyName)
+	}
+	return ""
+}
+
+// copyOf returns the copy of a snapshot to create in the target's project.
+// Copies are standard snapshots, even of archive snapshots.
+func (t *drSnapshotTarget) copyOf(snapshot *compute.Snapshot) *compute.Snapshot {
+	labels := map[string]string{drSourceProjectLabel: sanitizeLabelValue(t.snapshotter.snapshotProject)}
+	for k, v := range snapshot.Labels {
+		if k != snapshotTierLabel {
+			labels[k] = v
+		}
+	}
+	c := &compute.Snapshot{
+		Name:             snapshot.Name,
+		Description:      snapshot.Description,
+		Labels:           labels,
+		StorageLocations: snapshot.StorageLocations,
+	}
+	if t.snapshotLocation != "" {
+		c.StorageLocations = []string{t.snapshotLocation}
+	}
+	if key := t.encryptionKey(snapshot); key != "" {
+		c.SnapshotEncryptionKey = &compute.CustomerEncryptionKey{KmsKeyName: key}
+	}
+	return c
+}
+
+// drObjectTargets returns the replication targets of the GCP backup storage
+// locations with drBucket set, by name.
+func drObjectTargets(log logrus.FieldLogger, locations []api.BackupStorageLocation) (map[string]*drObjectTarget, error) {
+	targets := make(map[string]*drObjectTarget)
+	for i := range locations {
+		location := &locations[i]
+		drBucket := location.Spec.Config[drBucketConfigKey]
+		if !isGCPProvider(location.Spec.Provider) || location.Spec.ObjectStorage == nil || drBucket == "" {
+			continue
+		}
+		drPrefix, ok := location.Spec.Config[drPrefixConfigKey]
+		if !ok {
+			drPrefix = location.Spec.ObjectStorage.Prefix
+		}
+		store, err := newTieringObjectStore(log, location)
+		if err != nil {
+			return nil, errors.WithMessagef(err, "BackupStorageLocation %s", location.Name)
+		}
+		targets[location.Name] = &drObjectTarget{
+			store:      store,
+			bucket:     location.Spec.ObjectStorage.Bucket,
+			prefix:     location.Spec.ObjectStorage.Prefix,
+			drBucket:   drBucket,
+			drPrefix:   drPrefix,
+			kmsKeyName: location.Spec.Config[drKMSKeyNameConfigKey],
+		}
+	}
+	return targets, nil
+}
+
+// drSnapshotTargets returns the replication targets of the GCP volume
+// snapshot locations with drProject set.
+func drSnapshotTargets(log logrus.FieldLogger, locations []api.VolumeSnapshotLocation) ([]*drSnapshotTarget, error) {
+	var targets []*drSnapshotTarget
+	for _, location := range locations {
+		project := location.Spec.Config[drProjectConfigKey]
+		if !isGCPProvider(location.Spec.Provider) || project == "" {
+			continue
+		}
+		b := newVolumeSnapshotter(log)
+		if err := b.Init(location.Spec.Config); err != nil {
+			return nil, errors.WithMessagef(err, "VolumeSnapshotLocation %s", location.Name)
+		}
+		targets = append(targets, &drSnapshotTarget{
+			location:         location.Name,
+			snapshotter:      b,
+			project:          project,
+			snapshotLocation: location.Spec.Config[drSnapshotLocationConfigKey],
+			kmsKeyName:       location.Spec.Config[drKMSKeyNameConfigKey],
+		})
+	}
+	return targets, nil
+}
+
+// replicateBackup copies the snapshots of a backup to the secondary projects
+// of the snapshot targets, and its objects to the secondary bucket of the
+// object target, followed by its DR manifest and, last, its metadata.
+// Snapshots listed under several targets sharing a project are copied once.
+func replicateBackup(backup string, target *drObjectTarget, snapshotTargets []*drSnapshotTarget, now time.Time) (*drManifest, error) {
+	manifest := &drManifest{
+		Backup:     backup,
+		Replicated: now.UTC(),
+		Source:     drObjectLocation{Bucket: target.bucket, Prefix: target.prefix},
+	}
+	listed := make(map[string]bool)
+	for _, t := range snapshotTargets {
+		source := t.snapshotter.snapshotProject
+		if listed[source] {
+			continue
+		}
+		listed[source] = true
+
+		snapshots, err := t.snapshotter.backupSnapshots(backup)
+		if err != nil {
+			return nil, err
+		}
+		sort.Slice(snapshots, func(i, j int) bool { return snapshots[i].Name < snapshots[j].Name })
+		for _, s := range snapshots {
+			if s.Status != "READY" {
+				return nil, errors.Errorf("snapshot %s of backup %s is %s", s.Name, backup, s.Status)
+			}
+			if _, err := t.replicateSnapshot(s); err != nil {
+				return nil, err
+			}
+			manifest.Snapshots = append(manifest.Snapshots, drSnapshot{Name: s.Name, VolumeSnapshotLocation: t.location, SourceProject: source, Project: t.project})
+		}
+		if manifest.VolumeSnapshotLocations == nil {
+			manifest.VolumeSnapshotLocations = make(map[string]map[string]string)
+		}
+		config := map[string]string{projectKey: t.project}
+		if t.snapshotLocation != "" {
+			config[snapshotLocationKey] = t.snapshotLocation
+		}
+		manifest.VolumeSnapshotLocations[t.location] = config
+	}
+
+	objects, metadata, err := target.replicateBackupObjects(backup)
+	if err != nil {
+		return nil, err
+	}
+	manifest.Objects = objects
+	if err := target.writeManifest(manifest); err != nil {
+		return nil, err
+	}
+	return manifest, target.copyObject(metadata)
+}
+
+// replicateBackups replicates the completed backups of the GCP backup
+// storage locations with a secondary bucket, or only the named one, that
+// weren't replicated yet, and returns whether every replication succeeded.
+func replicateBackups(log logrus.FieldLogger, out io.Writer, cluster veleroCluster, name string, now time.Time) (bool, error) {
+	backups, err := cluster.backups()
+	if err != nil {
+		return false, err
+	}
+	storageLocations, err := cluster.backupStorageLocations()
+	if err != nil {
+		return false, err
+	}
+	snapshotLocations, err := cluster.volumeSnapshotLocations()
+	if err != nil {
+		return false, err
+	}
+	objectTargets, err := drObjectTargets(log, storageLocations)
+	if err != nil {
+		return false, err
+	}
+	snapshotTargets, err := drSnapshotTargets(log, snapshotLocations)
+	if err != nil {
+		return false, err
+	}
+
+	sort.Slice(backups, func(i, j int) bool { return backups[i].Name < backups[j].Name })
+	tw := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "BACKUP\tBUCKET\tOBJECTS\tSNAPSHOTS\tPROBLEMS")
+	succeeded, found := true, false
+	for i := range backups {
+		backup := &backups[i]
+		if name != "" && backup.Name != name {
+			continue
+		}
+		found = true
+		target := objectTargets[backup.Spec.StorageLocation]
+		if target == nil || backup.Status.Phase != api.BackupPhaseCompleted && backup.Status.Phase != api.BackupPhasePartiallyFailed {
+			continue
+		}
+		done, err := target.replicated(backup.Name)
+		if err == nil && done {
+			continue
+		}
+
+		result := "succeeded"
+		manifest := &drManifest{}
+		if err == nil {
+			manifest, err = replicateBackup(backup.Name, target, snapshotTargets, now)
+		}
+		problem := ""
+		if err != nil {
+			succeeded, result, problem = false, "failed", err.Error()
+			manifest = &drManifest{}
+			log.WithError(err).WithField("backup", backup.Name).Warn("Unable to replicate the backup")
+		} else {
+			log.WithField("backup", backup.Name).Infof("Replicated the backup to bucket %s", target.drBucket)
+		}
+		pluginMetrics.addCounter(drReplicationsCounter, "Backups replicated to their secondary bucket and projects, by result.", map[string]string{"result": result}, 1)
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%d\t%s\n", backup.Name, target.drBucket, manifest.Objects, len(manifest.Snapshots), problem)
+	}
+	tw.Flush()
+	if name != "" && !found {
+		return false, errors.Errorf("backup %s not found", name)
+	}
+	return succeeded, nil
+}
+
+// runReplicateBackups replicates the backups not yet replicated once, or
+// every interval when one is given.
+func runReplicateBackups(args []string, out io.Writer) int {
+	flags := pflag.NewFlagSet(replicateBackupsCommand, pflag.ContinueOnError)
+	flags.SetOutput(out)
+	var (
+		name     string
+		interval time.Duration
+	)
+	flags.StringVar(&name, "backup", "", "only replicate this backup")
+	flags.DurationVar(&interval, "interval", 0, "replicate new backups again at this interval instead of exiting")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	logger := logrus.New()
+	logger.SetOutput(os.Stderr)
+	startMetricsServer(logger)
+	startCloudMonitoring(logger)
+
+	for {
+		code := 0
+		succeeded, err := replicateBackups(logger, out, inCluster{}, name, time.Now())
+		if err != nil {
+			fmt.Fprintln(out, err)
+			code = 1
+		} else if !succeeded {
+			code = 1
+		}
+		if pluginMetricsPusher != nil {
+			if err := pluginMetricsPusher.push(context.Background(), pluginMetrics); err != nil {
+				logger.WithError(err).Warn("Error writing metrics to Cloud Monitoring")
+			}
+		}
+		if interval <= 0 {
+			return code
+		}
+		time.Sleep(interval)
+	}
+}
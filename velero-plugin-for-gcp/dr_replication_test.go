@@ -0,0 +1,228 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	velerotest "github.com/vmware-tanzu/velero/pkg/test"
+	"google.golang.org/api/compute/v1"
+	"google.golang.org/api/option"
+)
+
+// fakeDRCompute is a Compute Engine API keeping the disks and snapshots of
+// project dr.
+type fakeDRCompute struct {
+	lock      sync.Mutex
+	disks     map[string]*compute.Disk
+	snapshots map[string]*compute.Snapshot
+	requests  []string
+}
+
+func (f *fakeDRCompute) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.requests = append(f.requests, r.Method+" "+r.URL.Path)
+	p := strings.TrimPrefix(r.URL.Path, "/projects/dr/")
+	switch {
+	case strings.HasPrefix(p, "global/snapshots/"):
+		s, ok := f.snapshots[path.Base(p)]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(s)
+	case p == "aggregated/disks":
+		list := &compute.DiskAggregatedList{Items: map[string]compute.DisksScopedList{}}
+		for _, d := range f.disks {
+			scoped := list.Items["zones/"+path.Base(d.Zone)]
+			scoped.Disks = append(scoped.Disks, d)
+			list.Items["zones/"+path.Base(d.Zone)] = scoped
+		}
+		json.NewEncoder(w).Encode(list)
+	case strings.HasSuffix(p, "/disks") && r.Method == http.MethodPost:
+		disk := new(compute.Disk)
+		json.NewDecoder(r.Body).Decode(disk)
+		disk.Status, disk.Zone = "READY", path.Dir(p)
+		f.disks[disk.Name] = disk
+		json.NewEncoder(w).Encode(&compute.Operation{})
+	case strings.HasSuffix(p, "/createSnapshot"):
+		s := new(compute.Snapshot)
+		json.NewDecoder(r.Body).Decode(s)
+		s.Status = "READY"
+		f.snapshots[s.Name] = s
+		json.NewEncoder(w).Encode(&compute.Operation{})
+	case strings.Contains(p, "/disks/"):
+		disk, ok := f.disks[path.Base(p)]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if r.Method == http.MethodDelete {
+			delete(f.disks, disk.Name)
+		}
+		json.NewEncoder(w).Encode(disk)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func TestReplicateSnapshot(t *testing.T) {
+	defer func(interval time.Duration) { tieringPollInterval = interval }(tieringPollInterval)
+	tieringPollInterval = 0
+
+	fake := &fakeDRCompute{disks: make(map[string]*compute.Disk), snapshots: make(map[string]*compute.Snapshot)}
+	target := &drSnapshotTarget{
+		location: "default",
+		snapshotter: (&VolumeSnapshotter{
+			log:             velerotest.NewLogger(),
+			snapshotProject: "prod",
+		}).withClients(&snapshotterClients{
+			gce: newFakeComputeService(t, fake.ServeHTTP),
+		}),
+		project:          "dr",
+		snapshotLocation: "us-east1",
+	}
+	snapshot := &compute.Snapshot{
+		Name:                  "snap-1",
+		Status:                "READY",
+		SelfLink:              "projects/prod/global/snapshots/snap-1",
+		SourceDisk:            "projects/prod/zones/us-central1-a/disks/pvc-1",
+		Description:           `{"velero.io/backup":"nightly"}`,
+		Labels:                map[string]string{backupLabel: "nightly", snapshotTierLabel: archiveSnapshotTier},
+		StorageLocations:      []string{"us"},
+		SnapshotEncryptionKey: &compute.CustomerEncryptionKey{KmsKeyName: testKeyName + "/cryptoKeyVersions/1"},
+	}
+
+	copied, err := target.replicateSnapshot(snapshot)
+	require.NoError(t, err)
+	assert.True(t, copied)
+	assert.Empty(t, fake.disks)
+	require.Contains(t, fake.snapshots, "snap-1")
+	c := fake.snapshots["snap-1"]
+	assert.Equal(t, `{"velero.io/backup":"nightly"}`, c.Description)
+	assert.Equal(t, map[string]string{backupLabel: "nightly", drSourceProjectLabel: "prod"}, c.Labels)
+	assert.Equal(t, []string{"us-east1"}, c.StorageLocations)
+	assert.Equal(t, testKeyName, c.SnapshotEncryptionKey.KmsKeyName)
+
+	// copies are only made once
+	fake.requests = nil
+	copied, err = target.replicateSnapshot(snapshot)
+	require.NoError(t, err)
+	assert.False(t, copied)
+	assert.Equal(t, []string{"GET /projects/dr/global/snapshots/snap-1", "GET /projects/dr/aggregated/disks"}, fake.requests)
+}
+
+func TestReplicateSnapshotResumes(t *testing.T) {
+	defer func(interval time.Duration) { tieringPollInterval = interval }(tieringPollInterval)
+	tieringPollInterval = 0
+
+	// the disk was restored but not snapshotted
+	fake := &fakeDRCompute{
+		disks: map[string]*compute.Disk{
+			"dr-copy-1": {Name: "dr-copy-1", Zone: "projects/dr/zones/us-central1-a", Status: "READY", Labels: map[string]string{drCopyOfLabel: "snap-1"}},
+		},
+		snapshots: make(map[string]*compute.Snapshot),
+	}
+	target := &drSnapshotTarget{
+		snapshotter: (&VolumeSnapshotter{log: velerotest.NewLogger(), snapshotProject: "prod"}).withClients(&snapshotterClients{gce: newFakeComputeService(t, fake.ServeHTTP)}),
+		project:     "dr",
+	}
+
+	copied, err := target.replicateSnapshot(&compute.Snapshot{Name: "snap-1", Status: "READY", StorageLocations: []string{"us"}})
+	require.NoError(t, err)
+	assert.True(t, copied)
+	assert.Empty(t, fake.disks)
+	assert.Equal(t, []string{"us"}, fake.snapshots["snap-1"].StorageLocations)
+	assert.NotContains(t, fake.requests, "POST /projects/dr/zones/us-central1-a/disks")
+}
+
+func TestReplicateBackupObjects(t *testing.T) {
+	var (
+		lock   sync.Mutex
+		copies []string
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodGet && strings.HasSuffix(r.URL.Path, "/b/dr-bucket/o"):
+			assert.Equal(t, "dr/backups/nightly/", r.URL.Query().Get("prefix"))
+			json.NewEncoder(w).Encode(map[string]interface{}{"items": []map[string]interface{}{
+				{"name": "dr/backups/nightly/nightly-logs.gz", "bucket": "dr-bucket", "crc32c": "AAAAAQ=="},
+				{"name": "dr/backups/nightly/nightly.tar.gz", "bucket": "dr-bucket", "crc32c": "AAAAAw=="},
+			}})
+		case r.Method == http.MethodGet && strings.HasSuffix(r.URL.Path, "/b/bucket/o"):
+			assert.Equal(t, "velero/backups/nightly/", r.URL.Query().Get("prefix"))
+			json.NewEncoder(w).Encode(map[string]interface{}{"items": []map[string]interface{}{
+				{"name": "velero/backups/nightly/velero-backup.json", "bucket": "bucket", "generation": "1"},
+				{"name": "velero/backups/nightly/nightly-logs.gz", "bucket": "bucket", "generation": "2", "crc32c": "AAAAAQ=="},
+				{"name": "velero/backups/nightly/nightly.tar.gz", "bucket": "bucket", "generation": "3", "crc32c": "AAAAAg==", "kmsKeyName": testKeyName + "/cryptoKeyVersions/1"},
+			}})
+		case r.Method == http.MethodPost && strings.Contains(r.URL.Path, "/rewriteTo/"):
+			lock.Lock()
+			copies = append(copies, r.URL.Path[strings.Index(r.URL.Path, "/o/")+3:])
+			lock.Unlock()
+			if strings.HasSuffix(r.URL.Path, "nightly.tar.gz") {
+				assert.Equal(t, testKeyName, r.URL.Query().Get("destinationKmsKeyName"))
+			}
+			body := make(map[string]interface{})
+			json.NewDecoder(r.Body).Decode(&body)
+			json.NewEncoder(w).Encode(map[string]interface{}{"done": true, "resource": body})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+	client, err := storage.NewClient(context.Background(), option.WithEndpoint(server.URL+"/storage/v1/"), option.WithoutAuthentication())
+	require.NoError(t, err)
+
+	o := newObjectStore(velerotest.NewLogger())
+	o.setClients(func(c *objectStoreClients) { c.client, c.readClient = client, client })
+	target := &drObjectTarget{store: o, bucket: "bucket", prefix: "velero", drBucket: "dr-bucket", drPrefix: "dr"}
+
+	// objects already copied are skipped, and the metadata is left to copy
+	n, metadata, err := target.replicateBackupObjects("nightly")
+	require.NoError(t, err)
+	assert.Equal(t, 3, n)
+	assert.Equal(t, "velero/backups/nightly/velero-backup.json", metadata.Name)
+	require.Len(t, copies, 1)
+	dst, err := url.PathUnescape(copies[0])
+	require.NoError(t, err)
+	assert.Equal(t, "velero/backups/nightly/nightly.tar.gz/rewriteTo/b/dr-bucket/o/dr/backups/nightly/nightly.tar.gz", dst)
+}
+
+func TestDRKeys(t *testing.T) {
+	assert.Equal(t, "dr/backups/nightly/nightly-gcp-dr.json", drManifestKey("dr", "nightly"))
+	assert.Equal(t, "backups/nightly/nightly-gcp-dr.json", drManifestKey("", "nightly"))
+
+	target := &drObjectTarget{prefix: "velero", drPrefix: ""}
+	assert.Equal(t, "backups/nightly/nightly.tar.gz", target.drKey("velero/backups/nightly/nightly.tar.gz"))
+	target = &drObjectTarget{prefix: "", drPrefix: "dr"}
+	assert.Equal(t, "dr/backups/nightly/nightly.tar.gz", target.drKey("backups/nightly/nightly.tar.gz"))
+}
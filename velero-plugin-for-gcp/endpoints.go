@@ -0,0 +1,165 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/api/option"
+)
+
+const (
+	endpointsConfigKey = "endpoints"
+
+	// defaultEndpoint is the placeholder used in the endpoints list for the
+	// endpoint the client libraries would use on their own.
+	defaultEndpoint = "default"
+
+	endpointProbeTimeout = 5 * time.Second
+	// endpointProbeTTL is how long the result of probing an endpoint is
+	// used before it's probed again.
+	endpointProbeTTL = time.Minute
+)
+
+// endpointProbe checks whether an API host can be reached.
+type endpointProbe func(host string) error
+
+func dialEndpoint(host string) error {
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(host, "443"), endpointProbeTimeout)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// endpointProbeCache remembers the results of probing endpoints for
+// endpointProbeTTL, so initializing locations doesn't dial the endpoints
+// each time, while an endpoint that went down is noticed.
+type endpointProbeCache struct {
+	lock    sync.Mutex
+	probe   endpointProbe
+	now     func() time.Time
+	results map[string]endpointProbeResult
+}
+
+type endpointProbeResult struct {
+	err    error
+	probed time.Time
+}
+
+// endpointProbes is the process's cache of endpoint probes.
+var endpointProbes = &endpointProbeCache{probe: dialEndpoint, now: time.Now, results: make(map[string]endpointProbeResult)}
+
+// check probes an endpoint, unless it was probed less than
+// endpointProbeTTL ago.
+func (c *endpointProbeCache) check(host string) error {
+	c.lock.Lock()
+	result, ok := c.results[host]
+	c.lock.Unlock()
+	if ok && c.now().Sub(result.probed) < endpointProbeTTL {
+		return result.err
+	}
+
+	err := c.probe(host)
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.results[host] = endpointProbeResult{err: err, probed: c.now()}
+	return err
+}
+
+// forget drops the results of the probes, so the endpoints are probed
+// again, after requests through them failed.
+func (c *endpointProbeCache) forget() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.results = make(map[string]endpointProbeResult)
+}
+
+// parseList splits a comma-separated config value, such as
+// "private.googleapis.com,restricted.googleapis.com,default", preserving order.
+func parseList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		items = append(items, item)
+	}
+	return items
+}
+
+// selectEndpoint returns the first endpoint in the list that passes the probe.
+// The default endpoint is always considered healthy, since reaching it is
+// what the client libraries would attempt anyway.
+func selectEndpoint(endpoints []string, probe endpointProbe, log logrus.FieldLogger) (string, error) {
+	var errs []string
+	for _, e := range endpoints {
+		if e == defaultEndpoint {
+			return e, nil
+		}
+		if err := probe(e); err != nil {
+			log.WithError(err).Warnf("API endpoint %s is unreachable, trying next endpoint", e)
+			errs = append(errs, e+": "+err.Error())
+			continue
+		}
+		return e, nil
+	}
+	return "", errors.Errorf("none of the configured endpoints are reachable: %s", strings.Join(errs, "; "))
+}
+
+// locationEndpoint returns the first healthy endpoint in a location's
+// comma-separated list, or "" if it doesn't set one.
+func locationEndpoint(config map[string]string, log logrus.FieldLogger) (string, error) {
+	endpoints := parseList(config[endpointsConfigKey])
+	if len(endpoints) == 0 {
+		return "", nil
+	}
+
+	endpoint, err := selectEndpoint(endpoints, endpointProbes.check, log)
+	if err != nil {
+		return "", err
+	}
+	log.Debugf("Using API endpoint %s", endpoint)
+	return endpoint, nil
+}
+
+// endpointOptions returns the client options needed to route a service's API
+// calls through an endpoint selected by locationEndpoint. basePath is the
+// service's path, e.g. "storage/v1/".
+func endpointOptions(endpoint, basePath string) []option.ClientOption {
+	if endpoint == "" || endpoint == defaultEndpoint {
+		return nil
+	}
+	return []option.ClientOption{option.WithEndpoint("https://" + endpoint + "/" + basePath)}
+}
+
+// endpointClientOptions returns the client options needed to route a service's
+// API calls through the first healthy endpoint in the comma-separated list.
+// basePath is the service's path, e.g. "storage/v1/".
+func endpointClientOptions(config map[string]string, basePath string, log logrus.FieldLogger) ([]option.ClientOption, error) {
+	endpoint, err := locationEndpoint(config, log)
+	if err != nil {
+		return nil, err
+	}
+	return endpointOptions(endpoint, basePath), nil
+}
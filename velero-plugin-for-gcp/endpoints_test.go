@@ -0,0 +1,115 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	velerotest "github.com/vmware-tanzu/velero/pkg/test"
+)
+
+func TestParseList(t *testing.T) {
+	assert.Nil(t, parseList(""))
+	assert.Equal(t,
+		[]string{"private.googleapis.com", "restricted.googleapis.com", "default"},
+		parseList(" private.googleapis.com, restricted.googleapis.com,,default "),
+	)
+}
+
+func TestSelectEndpoint(t *testing.T) {
+	tests := []struct {
+		name        string
+		endpoints   []string
+		unreachable map[string]bool
+		expected    string
+		expectedErr bool
+	}{
+		{
+			name:      "first healthy endpoint wins",
+			endpoints: []string{"private.googleapis.com", "restricted.googleapis.com"},
+			expected:  "private.googleapis.com",
+		},
+		{
+			name:        "unreachable endpoints are skipped",
+			endpoints:   []string{"private.googleapis.com", "restricted.googleapis.com"},
+			unreachable: map[string]bool{"private.googleapis.com": true},
+			expected:    "restricted.googleapis.com",
+		},
+		{
+			name:        "default is used when everything before it is unreachable",
+			endpoints:   []string{"private.googleapis.com", "default"},
+			unreachable: map[string]bool{"private.googleapis.com": true},
+			expected:    "default",
+		},
+		{
+			name:        "error when no endpoint is reachable",
+			endpoints:   []string{"private.googleapis.com", "restricted.googleapis.com"},
+			unreachable: map[string]bool{"private.googleapis.com": true, "restricted.googleapis.com": true},
+			expectedErr: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			probe := func(host string) error {
+				if test.unreachable[host] {
+					return errors.New("connection refused")
+				}
+				return nil
+			}
+
+			endpoint, err := selectEndpoint(test.endpoints, probe, velerotest.NewLogger())
+			if test.expectedErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, test.expected, endpoint)
+		})
+	}
+}
+
+func TestEndpointProbeCache(t *testing.T) {
+	now := time.Unix(0, 0)
+	probes := 0
+	cache := &endpointProbeCache{
+		probe: func(host string) error {
+			probes++
+			return errors.New("connection refused")
+		},
+		now:     func() time.Time { return now },
+		results: make(map[string]endpointProbeResult),
+	}
+
+	assert.Error(t, cache.check("private.googleapis.com"))
+	assert.Error(t, cache.check("private.googleapis.com"))
+	assert.Equal(t, 1, probes)
+
+	// endpoints are probed again once their results are stale, or were
+	// forgotten because requests through them failed
+	now = now.Add(endpointProbeTTL)
+	assert.Error(t, cache.check("private.googleapis.com"))
+	assert.Equal(t, 2, probes)
+	cache.forget()
+	assert.Error(t, cache.check("private.googleapis.com"))
+	assert.Equal(t, 3, probes)
+}
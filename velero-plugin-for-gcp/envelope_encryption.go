@@ -0,0 +1,376 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"strings"
+
+	"github.com/pkg/errors"
+	"google.golang.org/api/cloudkms/v1"
+)
+
+const (
+	// metadataEncryptionKeyConfigKey is the key of a BackupStorageLocation's
+	// config naming the Cloud KMS key that wraps the data keys Velero's
+	// metadata files are encrypted with before they're uploaded.
+	metadataEncryptionKeyConfigKey = "metadataEncryptionKey"
+
+	// allowPlaintextMetadataConfigKey is the key of a BackupStorageLocation's
+	// config allowing metadata files that aren't encrypted to be read while
+	// metadataEncryptionKey is set, to migrate a location with existing
+	// backups.
+	allowPlaintextMetadataConfigKey = "allowPlaintextMetadata"
+
+	// envelopeMetadataKey is the GCS metadata key marking objects encrypted
+	// by the plugin, so they aren't handed out as signed URLs.
+	envelopeMetadataKey   = "velero-gcp-encryption"
+	envelopeMetadataValue = "kms-envelope-v1"
+
+	// envelopeSegmentSize is the size of the plaintext segments objects
+	// are encrypted in, so uploads and downloads are streamed.
+	envelopeSegmentSize = 64 << 10
+	// envelopeOverhead is the size of the tag GCM adds to each segment.
+	envelopeOverhead = 16
+)
+
+// envelopeMagic starts every object encrypted by the plugin.
+var envelopeMagic = []byte("VGCPENV1")
+
+// keyWrapper encrypts and decrypts data keys with a key encryption key.
+type keyWrapper interface {
+	wrap(keyName string, dataKey []byte) ([]byte, error)
+	unwrap(keyName string, wrapped []byte) ([]byte, error)
+}
+
+// kmsKeyWrapper wraps data keys with a Cloud KMS key.
+type kmsKeyWrapper struct {
+	// service returns the Cloud KMS client, which is created when first
+	// needed.
+	service func() (*cloudkms.Service, error)
+}
+
+func (w *kmsKeyWrapper) wrap(keyName string, dataKey []byte) ([]byte, error) {
+	kms, err := w.service()
+	if err != nil {
+		return nil, err
+	}
+	res, err := kms.Projects.Locations.KeyRings.CryptoKeys.Encrypt(keyName, &cloudkms.EncryptRequest{
+		Plaintext: base64.StdEncoding.EncodeToString(dataKey),
+	}).Do()
+	if err != nil {
+		return nil, errors.Wrapf(err, "error wrapping data key with Cloud KMS key %s", keyName)
+	}
+	return base64.StdEncoding.DecodeString(res.Ciphertext)
+}
+
+func (w *kmsKeyWrapper) unwrap(keyName string, wrapped []byte) ([]byte, error) {
+	kms, err := w.service()
+	if err != nil {
+		return nil, err
+	}
+	res, err := kms.Projects.Locations.KeyRings.CryptoKeys.Decrypt(keyName, &cloudkms.DecryptRequest{
+		Ciphertext: base64.StdEncoding.EncodeToString(wrapped),
+	}).Do()
+	if err != nil {
+		return nil, errors.Wrapf(err, "error unwrapping data key with Cloud KMS key %s", keyName)
+	}
+	return base64.StdEncoding.DecodeString(res.Plaintext)
+}
+
+// envelopeEncryption encrypts Velero's metadata files client-side, each with
+// its own AES-256 data key wrapped by a Cloud KMS key and stored at the
+// start of the object. Backup tarballs are left to GCS's encryption, since
+// encrypting them would keep file system backup and debugging tools from
+// reading them.
+//
+// Objects are encrypted in segments with AES-GCM, each sealed with its
+// number and whether it's the last, so a truncated or reordered object
+// fails to decrypt instead of being read short. The object's header, the
+// name of the Cloud KMS key and the wrapped data key, is authenticated with
+// every segment, so it can't be swapped.
+type envelopeEncryption struct {
+	// keyName is the Cloud KMS key new objects are encrypted with, empty if
+	// they aren't. Objects encrypted before are read whatever it is.
+	keyName string
+	wrapper keyWrapper
+	// allowPlaintext is whether objects that aren't encrypted are read when
+	// keyName is set. Otherwise they're rejected, so a metadata file
+	// replaced in the bucket by one that isn't encrypted isn't trusted.
+	allowPlaintext bool
+}
+
+// encrypts reports whether an object uploaded with the given key is
+// encrypted.
+func (e *envelopeEncryption) encrypts(key string) bool {
+	return e != nil && e.keyName != "" && isMetadataObject(key)
+}
+
+// isMetadataObject reports whether an object is one of Velero's metadata
+// files: the files of backups other than their tarball, and the files of
+// restores.
+func isMetadataObject(key string) bool {
+	parts := strings.Split(key, "/")
+	n := len(parts)
+	if n < 3 {
+		return false
+	}
+	switch parts[n-3] {
+	case strings.TrimSuffix(backupsDir, "/"):
+		return parts[n-1] != parts[n-2]+".tar.gz"
+	case "restores":
+		return true
+	}
+	return false
+}
+
+// encryptingWriter returns a writer that encrypts what's written to it into
+// w, and closes w when closed.
+func (e *envelopeEncryption) encryptingWriter(w io.WriteCloser) (io.WriteCloser, error) {
+	dataKey := make([]byte, encryptionKeySize)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	wrapped, err := e.wrapper.wrap(e.keyName, dataKey)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newEnvelopeAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	header := envelopeHeader([]byte(e.keyName), wrapped)
+	return &encryptingWriter{dst: w, aead: aead, header: header, aad: header}, nil
+}
+
+// decryptingReader returns a reader of r's plaintext if r was encrypted by
+// the plugin. Objects that aren't encrypted are read as is, unless a key is
+// set and they aren't allowed.
+func (e *envelopeEncryption) decryptingReader(r io.ReadCloser) (io.ReadCloser, error) {
+	buffered := bufio.NewReaderSize(r, envelopeSegmentSize+envelopeOverhead)
+	magic, err := buffered.Peek(len(envelopeMagic))
+	if err != nil && err != io.EOF {
+		return nil, errors.WithStack(err)
+	}
+	if !bytes.Equal(magic, envelopeMagic) {
+		if e != nil && e.keyName != "" && !e.allowPlaintext {
+			return nil, errors.Errorf("object isn't encrypted although %s is set, set %s to read objects uploaded before it was", metadataEncryptionKeyConfigKey, allowPlaintextMetadataConfigKey)
+		}
+		return &bufferedReadCloser{Reader: buffered, Closer: r}, nil
+	}
+	if e == nil || e.wrapper == nil {
+		return nil, errors.New("object is encrypted with a Cloud KMS key but no key wrapper is configured")
+	}
+
+	if _, err := buffered.Discard(len(envelopeMagic)); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	keyName, err := readEnvelopeField(buffered)
+	if err != nil {
+		return nil, err
+	}
+	wrapped, err := readEnvelopeField(buffered)
+	if err != nil {
+		return nil, err
+	}
+	dataKey, err := e.wrapper.unwrap(string(keyName), wrapped)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newEnvelopeAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	return &decryptingReader{src: buffered, closer: r, aead: aead, aad: envelopeHeader(keyName, wrapped)}, nil
+}
+
+// envelopeHeader returns the header starting an encrypted object.
+func envelopeHeader(keyName, wrapped []byte) []byte {
+	header := new(bytes.Buffer)
+	header.Write(envelopeMagic)
+	writeEnvelopeField(header, keyName)
+	writeEnvelopeField(header, wrapped)
+	return header.Bytes()
+}
+
+func newEnvelopeAEAD(dataKey []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(dataKey)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	aead, err := cipher.NewGCM(block)
+	return aead, errors.WithStack(err)
+}
+
+// envelopeNonce returns the nonce of a segment: its number, and whether
+// it's the last one in the final byte. Each object has its own data key, so
+// nonces only need to be unique within an object.
+func envelopeNonce(segment uint64, last bool) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce[3:11], segment)
+	if last {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+func writeEnvelopeField(buf *bytes.Buffer, field []byte) {
+	var size [2]byte
+	binary.BigEndian.PutUint16(size[:], uint16(len(field)))
+	buf.Write(size[:])
+	buf.Write(field)
+}
+
+func readEnvelopeField(r io.Reader) ([]byte, error) {
+	var size [2]byte
+	if _, err := io.ReadFull(r, size[:]); err != nil {
+		return nil, errors.Wrap(err, "error reading encrypted object header")
+	}
+	field := make([]byte, binary.BigEndian.Uint16(size[:]))
+	if _, err := io.ReadFull(r, field); err != nil {
+		return nil, errors.Wrap(err, "error reading encrypted object header")
+	}
+	return field, nil
+}
+
+// encryptingWriter seals what's written to it in segments. A full segment
+// is only sealed once more is written, so the last one is always sealed as
+// such on Close, even if it's empty.
+type encryptingWriter struct {
+	dst  io.WriteCloser
+	aead cipher.AEAD
+	// header is written before the first segment.
+	header []byte
+	// aad is the header, authenticated with every segment.
+	aad     []byte
+	segment uint64
+	buf     []byte
+}
+
+func (w *encryptingWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		if len(w.buf) == envelopeSegmentSize {
+			if err := w.seal(false); err != nil {
+				return written, err
+			}
+		}
+		n := envelopeSegmentSize - len(w.buf)
+		if n > len(p) {
+			n = len(p)
+		}
+		w.buf = append(w.buf, p[:n]...)
+		p = p[n:]
+		written += n
+	}
+	return written, nil
+}
+
+func (w *encryptingWriter) seal(last bool) error {
+	if w.header != nil {
+		if _, err := w.dst.Write(w.header); err != nil {
+			return err
+		}
+		w.header = nil
+	}
+	sealed := w.aead.Seal(nil, envelopeNonce(w.segment, last), w.buf, w.aad)
+	w.segment++
+	w.buf = w.buf[:0]
+	_, err := w.dst.Write(sealed)
+	return err
+}
+
+// Close seals the last segment and closes the destination, which for an
+// upload is when it's committed.
+func (w *encryptingWriter) Close() error {
+	if err := w.seal(true); err != nil {
+		w.dst.Close()
+		return err
+	}
+	return w.dst.Close()
+}
+
+// decryptingReader opens the segments of an encrypted object as they're
+// read.
+type decryptingReader struct {
+	src     *bufio.Reader
+	closer  io.Closer
+	aead    cipher.AEAD
+	aad     []byte
+	segment uint64
+	current []byte
+	done    bool
+}
+
+func (r *decryptingReader) Read(p []byte) (int, error) {
+	for len(r.current) == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+		if err := r.open(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.current)
+	r.current = r.current[n:]
+	return n, nil
+}
+
+func (r *decryptingReader) open() error {
+	sealed := make([]byte, envelopeSegmentSize+envelopeOverhead)
+	n, err := io.ReadFull(r.src, sealed)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		if err == io.EOF {
+			return errors.New("encrypted object is truncated")
+		}
+		return err
+	}
+	// the last segment is the one nothing follows
+	last := err == io.ErrUnexpectedEOF
+	if !last {
+		if _, peekErr := r.src.Peek(1); peekErr == io.EOF {
+			last = true
+		}
+	}
+
+	plaintext, openErr := r.aead.Open(sealed[:0], envelopeNonce(r.segment, last), sealed[:n], r.aad)
+	if openErr != nil {
+		return errors.New("encrypted object is corrupted, truncated or was modified")
+	}
+	r.segment++
+	r.current, r.done = plaintext, last
+	return nil
+}
+
+func (r *decryptingReader) Close() error {
+	return r.closer.Close()
+}
+
+// bufferedReadCloser reads through a buffer, and closes the underlying
+// reader.
+type bufferedReadCloser struct {
+	io.Reader
+	io.Closer
+}
@@ -0,0 +1,214 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"cloud.google.com/go/storage"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	velerotest "github.com/vmware-tanzu/velero/pkg/test"
+)
+
+// fakeKeyWrapper "wraps" data keys by prefixing them with the key's name.
+type fakeKeyWrapper struct {
+	unwraps int
+}
+
+func (w *fakeKeyWrapper) wrap(keyName string, dataKey []byte) ([]byte, error) {
+	return append([]byte(keyName+":"), dataKey...), nil
+}
+
+func (w *fakeKeyWrapper) unwrap(keyName string, wrapped []byte) ([]byte, error) {
+	w.unwraps++
+	if !bytes.HasPrefix(wrapped, []byte(keyName+":")) {
+		return nil, errors.New("wrong key")
+	}
+	return wrapped[len(keyName)+1:], nil
+}
+
+// bufferWriteCloser records what's written to it and whether it's closed.
+type bufferWriteCloser struct {
+	bytes.Buffer
+	closed bool
+}
+
+func (b *bufferWriteCloser) Close() error {
+	b.closed = true
+	return nil
+}
+
+func encryptForTest(t *testing.T, e *envelopeEncryption, plaintext []byte) []byte {
+	dst := new(bufferWriteCloser)
+	w, err := e.encryptingWriter(dst)
+	require.NoError(t, err)
+	// write in uneven pieces, to cross segment boundaries
+	for len(plaintext) > 0 {
+		n := 1000
+		if n > len(plaintext) {
+			n = len(plaintext)
+		}
+		_, err := w.Write(plaintext[:n])
+		require.NoError(t, err)
+		plaintext = plaintext[n:]
+	}
+	require.NoError(t, w.Close())
+	assert.True(t, dst.closed)
+	return dst.Bytes()
+}
+
+func decryptForTest(e *envelopeEncryption, ciphertext []byte) ([]byte, error) {
+	r, err := e.decryptingReader(ioutil.NopCloser(bytes.NewReader(ciphertext)))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
+
+func TestIsMetadataObject(t *testing.T) {
+	for key, expected := range map[string]bool{
+		"backups/b1/velero-backup.json":              true,
+		"prefix/backups/b1/b1-resource-list.json.gz": true,
+		"backups/b1/b1-logs.gz":                      true,
+		"backups/b1/b1.tar.gz":                       false,
+		"restores/r1/restore-r1-logs.gz":             true,
+		"restic/default/data/00/0011":                false,
+		"plugins/gcp/backup-list-index.json":         false,
+		"velero-backup.json":                         false,
+	} {
+		assert.Equal(t, expected, isMetadataObject(key), key)
+	}
+
+	var disabled *envelopeEncryption
+	assert.False(t, disabled.encrypts("backups/b1/velero-backup.json"))
+	assert.False(t, (&envelopeEncryption{}).encrypts("backups/b1/velero-backup.json"))
+	assert.True(t, (&envelopeEncryption{keyName: "k"}).encrypts("backups/b1/velero-backup.json"))
+}
+
+func TestEnvelopeEncryptionRoundTrip(t *testing.T) {
+	wrapper := new(fakeKeyWrapper)
+	e := &envelopeEncryption{keyName: "projects/p/locations/l/keyRings/r/cryptoKeys/k", wrapper: wrapper}
+
+	for _, size := range []int{0, 1, envelopeSegmentSize, envelopeSegmentSize + 1, 3*envelopeSegmentSize + 123} {
+		plaintext := bytes.Repeat([]byte("velero"), size/6+1)[:size]
+		ciphertext := encryptForTest(t, e, plaintext)
+		assert.True(t, bytes.HasPrefix(ciphertext, envelopeMagic))
+		if size > 0 {
+			assert.NotContains(t, string(ciphertext), "velerovelero")
+		}
+
+		decrypted, err := decryptForTest(e, ciphertext)
+		require.NoError(t, err, size)
+		assert.Equal(t, plaintext, decrypted, size)
+	}
+
+	// objects encrypted with another key are read with the key they name
+	other := &envelopeEncryption{keyName: "projects/p/locations/l/keyRings/r/cryptoKeys/old", wrapper: wrapper}
+	decrypted, err := decryptForTest(e, encryptForTest(t, other, []byte("old backup")))
+	require.NoError(t, err)
+	assert.Equal(t, "old backup", string(decrypted))
+
+	// objects that aren't encrypted are read as is, even without a key
+	decrypted, err = decryptForTest(nil, []byte(`{"kind":"Backup"}`))
+	require.NoError(t, err)
+	assert.Equal(t, `{"kind":"Backup"}`, string(decrypted))
+	_, err = decryptForTest(nil, encryptForTest(t, e, []byte("secret")))
+	assert.Error(t, err)
+
+	// but are rejected once a key is set, unless they're allowed while
+	// migrating
+	_, err = decryptForTest(e, []byte(`{"kind":"Backup"}`))
+	assert.EqualError(t, err, "object isn't encrypted although metadataEncryptionKey is set, set allowPlaintextMetadata to read objects uploaded before it was")
+	migrating := &envelopeEncryption{keyName: e.keyName, wrapper: wrapper, allowPlaintext: true}
+	decrypted, err = decryptForTest(migrating, []byte(`{"kind":"Backup"}`))
+	require.NoError(t, err)
+	assert.Equal(t, `{"kind":"Backup"}`, string(decrypted))
+}
+
+func TestEnvelopeEncryptionTampering(t *testing.T) {
+	e := &envelopeEncryption{keyName: "k", wrapper: new(fakeKeyWrapper)}
+	plaintext := bytes.Repeat([]byte{1}, 2*envelopeSegmentSize+10)
+	ciphertext := encryptForTest(t, e, plaintext)
+
+	// dropping the last segment, or part of it, is detected
+	for _, truncated := range [][]byte{
+		ciphertext[:len(ciphertext)-(10+envelopeOverhead)],
+		ciphertext[:len(ciphertext)-1],
+	} {
+		_, err := decryptForTest(e, truncated)
+		assert.Error(t, err)
+	}
+
+	modified := append([]byte(nil), ciphertext...)
+	modified[len(modified)/2] ^= 1
+	_, err := decryptForTest(e, modified)
+	assert.Error(t, err)
+
+	// the header is authenticated: naming another key the data key unwraps
+	// with is detected
+	modified = append([]byte(nil), ciphertext...)
+	keyName, wrapped := len(envelopeMagic)+2, len(envelopeMagic)+5
+	require.Equal(t, "k", string(modified[keyName:keyName+1]))
+	require.Equal(t, "k:", string(modified[wrapped:wrapped+2]))
+	modified[keyName], modified[wrapped] = 'j', 'j'
+	_, err = decryptForTest(e, modified)
+	assert.EqualError(t, err, "encrypted object is corrupted, truncated or was modified")
+}
+
+// envelopeBucketWriter uploads into a buffer.
+type envelopeBucketWriter struct {
+	*fakeWriter
+	uploaded *bufferWriteCloser
+	metadata map[string]string
+}
+
+func (w *envelopeBucketWriter) getWriteCloser(bucket, key string) io.WriteCloser {
+	w.uploaded = new(bufferWriteCloser)
+	return w.uploaded
+}
+
+func (w *envelopeBucketWriter) getAttrs(bucket, key string) (*storage.ObjectAttrs, error) {
+	return &storage.ObjectAttrs{Metadata: w.metadata}, nil
+}
+
+func TestPutObjectEncryptsMetadata(t *testing.T) {
+	o := newObjectStore(velerotest.NewLogger())
+	bucketWriter := &envelopeBucketWriter{fakeWriter: newFakeWriter(nil)}
+	o.setClients(func(c *objectStoreClients) { c.bucketWriter = bucketWriter })
+	o.envelope = &envelopeEncryption{keyName: "k", wrapper: new(fakeKeyWrapper)}
+
+	require.NoError(t, o.PutObject("bucket", "backups/b1/velero-backup.json", strings.NewReader(`{"kind":"Backup"}`)))
+	assert.True(t, bytes.HasPrefix(bucketWriter.uploaded.Bytes(), envelopeMagic))
+	decrypted, err := decryptForTest(o.envelope, bucketWriter.uploaded.Bytes())
+	require.NoError(t, err)
+	assert.Equal(t, `{"kind":"Backup"}`, string(decrypted))
+
+	require.NoError(t, o.PutObject("bucket", "backups/b1/b1.tar.gz", strings.NewReader("tarball")))
+	assert.Equal(t, "tarball", bucketWriter.uploaded.String())
+
+	// encrypted objects aren't handed out as signed URLs
+	bucketWriter.metadata = map[string]string{envelopeMetadataKey: envelopeMetadataValue}
+	_, err = o.CreateSignedURL("bucket", "backups/b1/b1-logs.gz", 0)
+	assert.Error(t, err)
+}
@@ -0,0 +1,330 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"time"
+
+	uuid "github.com/gofrs/uuid"
+	"github.com/pkg/errors"
+	file "google.golang.org/api/file/v1"
+	v1 "k8s.io/api/core/v1"
+)
+
+const (
+	filestoreCSIDriver = "filestore.csi.storage.gke.io"
+
+	// filestoreNetworkConfigKey is the VPC network instances restored from
+	// Filestore backups are connected to, if not the source instance's.
+	filestoreNetworkConfigKey = "filestoreNetwork"
+
+	// filestoreNetworkLabel is the Filestore backup label recording the
+	// network of the source instance.
+	filestoreNetworkLabel = "velero-network"
+
+	defaultFilestoreNetwork = "default"
+)
+
+var (
+	// filestoreRestoreTimeout bounds waiting for a restored instance to
+	// become ready, and filestorePollInterval is how often it's checked.
+	// They are variables so tests can shorten them.
+	filestoreRestoreTimeout = 30 * time.Minute
+	filestorePollInterval   = 10 * time.Second
+
+	// filestoreVolRegexp matches the volume handles of Filestore CSI
+	// volumes, capturing the instance's location and name and the share.
+	filestoreVolRegexp = regexp.MustCompile(`^modeInstance/([^/]+)/([^/]+)/([^/]+)$`)
+
+	// filestoreBackupRegexp matches the resource names of Filestore
+	// backups, which are used as the snapshot IDs of Filestore volumes.
+	filestoreBackupRegexp = regexp.MustCompile(`^projects/[^/]+/locations/[^/]+/backups/[^/]+$`)
+
+	filestoreInstanceRegexp = regexp.MustCompile(`^projects/[^/]+/locations/([^/]+)/instances/([^/]+)$`)
+)
+
+// isFilestoreVolume reports whether a volume ID is the handle of a Filestore
+// CSI volume rather than the name of a persistent disk.
+func isFilestoreVolume(volumeID string) bool {
+	return filestoreVolRegexp.MatchString(volumeID)
+}
+
+// isFilestoreBackup reports whether a snapshot ID is the name of a Filestore
+// backup rather than of a disk snapshot.
+func isFilestoreBackup(snapshotID string) bool {
+	return filestoreBackupRegexp.MatchString(snapshotID)
+}
+
+func (b *VolumeSnapshotter) filestoreService() (*file.Service, error) {
+	b.lazyClientsLock.Lock()
+	defer b.lazyClientsLock.Unlock()
+	if b.filestore == nil {
+		clientOptions, err := b.clients().credentials.clientOptions(context.TODO(), file.CloudPlatformScope)
+		if err != nil {
+			return nil, err
+		}
+		if clientOptions, err = instrumentClientOptions(context.TODO(), b.log, filestoreService, clientOptions); err != nil {
+			return nil, err
+		}
+		if b.filestore, err = file.NewService(context.TODO(), clientOptions...); err != nil {
+			return nil, errors.WithStack(err)
+		}
+	}
+	return b.filestore, nil
+}
+
+// createFilestoreBackup backs up the share of a Filestore CSI volume and
+// returns the backup's resource name. Backups are stored in the region of
+// the instance.
+func (b *VolumeSnapshotter) createFilestoreBackup(volumeID string, tags map[string]string) (string, error) {
+	svc, err := b.filestoreService()
+	if err != nil {
+		return "", err
+	}
+
+	m := filestoreVolRegexp.FindStringSubmatch(volumeID)
+	location, instanceID, share := m[1], m[2], m[3]
+	instanceName := fmt.Sprintf("projects/%s/locations/%s/instances/%s", b.volumeProject, location, instanceID)
+
+	instance, err := svc.Projects.Locations.Instances.Get(instanceName).Do()
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+
+	region, err := parseRegion(location)
+	if err != nil {
+		return "", err
+	}
+	if err := b.residency.check("Filestore backup of "+instanceName, region); err != nil {
+		return "", err
+	}
+
+	labels := snapshotLabels(tags)
+	if len(instance.Networks) > 0 {
+		if labels == nil {
+			labels = make(map[string]string)
+		}
+		labels[filestoreNetworkLabel] = sanitizeLabelValue(instance.Networks[0].Network)
+	}
+
+	uid, err := uuid.NewV4()
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	backupID := "velero-" + uid.String()
+
+	backup := &file.Backup{
+		SourceInstance:  instanceName,
+		SourceFileShare: share,
+		Description:     getSnapshotTags(tags, "", b.log),
+		Labels:          labels,
+	}
+	parent := fmt.Sprintf("projects/%s/locations/%s", b.snapshotProject, region)
+	call := svc.Projects.Locations.Backups.Create(parent, backup).BackupId(backupID)
+	setRequestReason(call, requestReason(backupOperation, tags[backupNameTag]))
+	op, err := call.Do()
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	b.journal.record(parent+"/backups/"+backupID, op.Name, b.snapshotProject, tags)
+	return parent + "/backups/" + backupID, nil
+}
+
+// createFilestoreInstance creates a Filestore instance from a backup, in the
+// location and with the tier, capacity and share name of the source
+// instance, waits for it to become ready and returns its volume handle.
+func (b *VolumeSnapshotter) createFilestoreInstance(backupName string) (string, error) {
+	svc, err := b.filestoreService()
+	if err != nil {
+		return "", err
+	}
+
+	backup, err := svc.Projects.Locations.Backups.Get(backupName).Do()
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	m := filestoreInstanceRegexp.FindStringSubmatch(backup.SourceInstance)
+	if m == nil {
+		return "", errors.Errorf("unable to determine the location of Filestore backup %s from its source instance %q", backupName, backup.SourceInstance)
+	}
+	location := m[1]
+	if err := b.residency.check("Filestore instance restored from "+backupName, location); err != nil {
+		return "", err
+	}
+
+	network := b.config[filestoreNetworkConfigKey]
+	if network == "" {
+		network = backup.Labels[filestoreNetworkLabel]
+	}
+	if network == "" {
+		network = defaultFilestoreNetwork
+	}
+
+	uid, err := uuid.NewV4()
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	instanceID := "restore-" + uid.String()
+
+	instance := &file.Instance{
+		Tier: backup.SourceInstanceTier,
+		FileShares: []*file.FileShareConfig{{
+			Name:         backup.SourceFileShare,
+			CapacityGb:   backup.CapacityGb,
+			SourceBackup: backupName,
+		}},
+		Networks: []*file.NetworkConfig{{
+			Network: network,
+			Modes:   []string{"MODE_IPV4"},
+		}},
+		Labels: restoreArtifactLabels(backup.Labels),
+	}
+	parent := fmt.Sprintf("projects/%s/locations/%s", b.volumeProject, location)
+	call := svc.Projects.Locations.Instances.Create(parent, instance).InstanceId(instanceID)
+	setRequestReason(call, snapshotBackupReason(backup.Description))
+	if _, err := call.Do(); err != nil {
+		return "", errors.WithStack(err)
+	}
+
+	// the volume can only be used once the instance has an IP address.
+	// Velero doesn't know about the instance unless it's returned, so don't
+	// leave it behind if it never becomes ready.
+	name := parent + "/instances/" + instanceID
+	if _, err := b.waitForFilestoreInstance(svc, name); err != nil {
+		if deleteErr := b.deleteRestoreArtifact(restoreArtifact{kind: restoredInstanceKind, name: name}); deleteErr != nil {
+			b.log.WithError(deleteErr).Warnf("Unable to delete Filestore instance %s that failed to be restored", name)
+		}
+		return "", err
+	}
+	return fmt.Sprintf("modeInstance/%s/%s/%s", location, instanceID, backup.SourceFileShare), nil
+}
+
+// waitForFilestoreInstance polls an instance until it's ready, for at most
+// filestoreRestoreTimeout. The deadline also bounds the requests made while
+// polling, so a slow request can't make the wait outlast it.
+func (b *VolumeSnapshotter) waitForFilestoreInstance(svc *file.Service, name string) (*file.Instance, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), filestoreRestoreTimeout)
+	defer cancel()
+	for {
+		instance, err := svc.Projects.Locations.Instances.Get(name).Context(ctx).Do()
+		if ctx.Err() != nil {
+			return nil, errors.Errorf("timed out waiting for Filestore instance %s to become ready", name)
+		}
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		switch instance.State {
+		case "READY":
+			return instance, nil
+		case "ERROR":
+			return nil, errors.Errorf("Filestore instance %s failed to be created: %s", name, instance.StatusMessage)
+		}
+		select {
+		case <-ctx.Done():
+			return nil, errors.Errorf("timed out waiting for Filestore instance %s to become ready", name)
+		case <-time.After(filestorePollInterval):
+		}
+	}
+}
+
+// setFilestoreVolumeID points a Filestore CSI volume at another instance.
+func (b *VolumeSnapshotter) setFilestoreVolumeID(pv *v1.PersistentVolume, volumeID string) error {
+	svc, err := b.filestoreService()
+	if err != nil {
+		return err
+	}
+
+	m := filestoreVolRegexp.FindStringSubmatch(volumeID)
+	if m == nil {
+		return errors.Errorf("invalid volume ID for CSI driver %s, expected modeInstance/{location}/{instance}/{share}, got %s", filestoreCSIDriver, volumeID)
+	}
+	instance, err := svc.Projects.Locations.Instances.Get(fmt.Sprintf("projects/%s/locations/%s/instances/%s", b.volumeProject, m[1], m[2])).Do()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if len(instance.Networks) == 0 || len(instance.Networks[0].IpAddresses) == 0 {
+		return errors.Errorf("Filestore instance %s has no IP address", instance.Name)
+	}
+
+	pv.Spec.CSI.VolumeHandle = volumeID
+	if pv.Spec.CSI.VolumeAttributes == nil {
+		pv.Spec.CSI.VolumeAttributes = make(map[string]string)
+	}
+	pv.Spec.CSI.VolumeAttributes["ip"] = instance.Networks[0].IpAddresses[0]
+	pv.Spec.CSI.VolumeAttributes["volume"] = m[3]
+	return nil
+}
+
+// deleteFilestoreBackup deletes a Filestore backup, and reports whether it
+// existed. The reason, if any, identifies the operation deleting it.
+func (b *VolumeSnapshotter) deleteFilestoreBackup(backupName, reason string) (bool, error) {
+	svc, err := b.filestoreService()
+	if err != nil {
+		return false, err
+	}
+
+	call := svc.Projects.Locations.Backups.Delete(backupName)
+	setRequestReason(call, reason)
+	_, err = call.Do()
+	if isNotFound(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, errors.WithStack(err)
+	}
+	return true, nil
+}
+
+// deleteBackupFilestoreBackups deletes the Filestore backups created for a
+// Velero backup in any region, including any that aren't recorded in the
+// backup because it only partially succeeded. It returns the names of the
+// deleted Filestore backups.
+func (b *VolumeSnapshotter) deleteBackupFilestoreBackups(backupName string) ([]string, error) {
+	svc, err := b.filestoreService()
+	if err != nil {
+		return nil, err
+	}
+
+	var backups []*file.Backup
+	filter := fmt.Sprintf("labels.%s=%q", backupLabel, sanitizeLabelValue(backupName))
+	err = svc.Projects.Locations.Backups.List(fmt.Sprintf("projects/%s/locations/-", b.snapshotProject)).Filter(filter).Pages(context.TODO(), func(page *file.ListBackupsResponse) error {
+		backups = append(backups, page.Backups...)
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "error listing Filestore backups of backup %s", backupName)
+	}
+
+	var deleted []string
+	for _, backup := range backups {
+		// labels are sanitized, so make sure the Filestore backup really
+		// belongs to this backup before deleting it
+		var tags map[string]string
+		if err := json.Unmarshal([]byte(backup.Description), &tags); err != nil || tags[backupNameTag] != backupName {
+			continue
+		}
+		if _, err := b.deleteFilestoreBackup(backup.Name, requestReason(backupDeletionOperation, backupName)); err != nil {
+			return deleted, errors.Wrapf(err, "error deleting Filestore backup %s of backup %s", backup.Name, backupName)
+		}
+		deleted = append(deleted, backup.Name)
+	}
+	return deleted, nil
+}
@@ -0,0 +1,207 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	file "google.golang.org/api/file/v1"
+	"google.golang.org/api/option"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+
+	velerotest "github.com/vmware-tanzu/velero/pkg/test"
+)
+
+func newFakeFilestoreService(t *testing.T, handler http.HandlerFunc) *file.Service {
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+
+	svc, err := file.NewService(context.Background(), option.WithEndpoint(server.URL), option.WithoutAuthentication())
+	require.NoError(t, err)
+	return svc
+}
+
+func TestFilestoreIDs(t *testing.T) {
+	assert.True(t, isFilestoreVolume("modeInstance/us-central1-c/pvc-1/vol1"))
+	assert.False(t, isFilestoreVolume("pvc-1"))
+	assert.True(t, isFilestoreBackup("projects/p/locations/us-central1/backups/velero-1"))
+	assert.False(t, isFilestoreBackup("pvc-1-snapshot"))
+}
+
+func TestFilestoreVolumeID(t *testing.T) {
+	svc := newFakeFilestoreService(t, func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/v1/projects/volume-project/locations/us-central1-c/instances/restore-1", r.URL.Path)
+		json.NewEncoder(w).Encode(&file.Instance{
+			Name:     "projects/volume-project/locations/us-central1-c/instances/restore-1",
+			Networks: []*file.NetworkConfig{{Network: "default", IpAddresses: []string{"10.0.0.2"}}},
+		})
+	})
+	b := &VolumeSnapshotter{log: velerotest.NewLogger(), filestore: svc, volumeProject: "volume-project"}
+
+	pv := &v1.PersistentVolume{Spec: v1.PersistentVolumeSpec{PersistentVolumeSource: v1.PersistentVolumeSource{
+		CSI: &v1.CSIPersistentVolumeSource{
+			Driver:           filestoreCSIDriver,
+			VolumeHandle:     "modeInstance/us-central1-c/pvc-1/vol1",
+			VolumeAttributes: map[string]string{"ip": "10.0.0.1", "volume": "vol1"},
+		},
+	}}}
+	content, err := runtime.DefaultUnstructuredConverter.ToUnstructured(pv)
+	require.NoError(t, err)
+
+	volumeID, err := b.GetVolumeID(&unstructured.Unstructured{Object: content})
+	require.NoError(t, err)
+	assert.Equal(t, "modeInstance/us-central1-c/pvc-1/vol1", volumeID)
+
+	updated, err := b.SetVolumeID(&unstructured.Unstructured{Object: content}, "modeInstance/us-central1-c/restore-1/vol1")
+	require.NoError(t, err)
+	res := new(v1.PersistentVolume)
+	require.NoError(t, runtime.DefaultUnstructuredConverter.FromUnstructured(updated.UnstructuredContent(), res))
+	assert.Equal(t, "modeInstance/us-central1-c/restore-1/vol1", res.Spec.CSI.VolumeHandle)
+	assert.Equal(t, map[string]string{"ip": "10.0.0.2", "volume": "vol1"}, res.Spec.CSI.VolumeAttributes)
+}
+
+func TestCreateFilestoreBackup(t *testing.T) {
+	var created file.Backup
+	svc := newFakeFilestoreService(t, func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodGet && r.URL.Path == "/v1/projects/volume-project/locations/us-central1-c/instances/pvc-1":
+			json.NewEncoder(w).Encode(&file.Instance{Networks: []*file.NetworkConfig{{Network: "shared-vpc"}}})
+		case r.Method == http.MethodPost && r.URL.Path == "/v1/projects/snapshot-project/locations/us-central1/backups":
+			assert.True(t, strings.HasPrefix(r.URL.Query().Get("backupId"), "velero-"))
+			require.NoError(t, json.NewDecoder(r.Body).Decode(&created))
+			json.NewEncoder(w).Encode(&file.Operation{})
+		default:
+			t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	})
+	b := &VolumeSnapshotter{log: velerotest.NewLogger(), filestore: svc, volumeProject: "volume-project", snapshotProject: "snapshot-project"}
+
+	name, err := b.createFilestoreBackup("modeInstance/us-central1-c/pvc-1/vol1", map[string]string{backupNameTag: "nightly"})
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(name, "projects/snapshot-project/locations/us-central1/backups/velero-"))
+	assert.True(t, isFilestoreBackup(name))
+
+	assert.Equal(t, "projects/volume-project/locations/us-central1-c/instances/pvc-1", created.SourceInstance)
+	assert.Equal(t, "vol1", created.SourceFileShare)
+	assert.Equal(t, map[string]string{backupLabel: "nightly", filestoreNetworkLabel: "shared-vpc"}, created.Labels)
+}
+
+func TestCreateFilestoreInstance(t *testing.T) {
+	const backupName = "projects/snapshot-project/locations/us-central1/backups/velero-1"
+	var created file.Instance
+	svc := newFakeFilestoreService(t, func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodGet && r.URL.Path == "/v1/"+backupName:
+			json.NewEncoder(w).Encode(&file.Backup{
+				SourceInstance:     "projects/volume-project/locations/us-central1-c/instances/pvc-1",
+				SourceFileShare:    "vol1",
+				SourceInstanceTier: "BASIC_HDD",
+				CapacityGb:         1024,
+				Labels:             map[string]string{filestoreNetworkLabel: "shared-vpc", backupLabel: "nightly"},
+			})
+		case r.Method == http.MethodPost && r.URL.Path == "/v1/projects/volume-project/locations/us-central1-c/instances":
+			require.NoError(t, json.NewDecoder(r.Body).Decode(&created))
+			json.NewEncoder(w).Encode(&file.Operation{})
+		case r.Method == http.MethodGet && strings.HasPrefix(r.URL.Path, "/v1/projects/volume-project/locations/us-central1-c/instances/restore-"):
+			json.NewEncoder(w).Encode(&file.Instance{State: "READY"})
+		default:
+			t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	})
+	b := &VolumeSnapshotter{log: velerotest.NewLogger(), filestore: svc, volumeProject: "volume-project"}
+
+	volumeID, err := b.CreateVolumeFromSnapshot(backupName, "", "us-central1-c", nil)
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(volumeID, "modeInstance/us-central1-c/restore-"))
+	assert.True(t, strings.HasSuffix(volumeID, "/vol1"))
+
+	assert.Equal(t, "BASIC_HDD", created.Tier)
+	require.Len(t, created.FileShares, 1)
+	assert.Equal(t, file.FileShareConfig{Name: "vol1", CapacityGb: 1024, SourceBackup: backupName}, *created.FileShares[0])
+	require.Len(t, created.Networks, 1)
+	assert.Equal(t, "shared-vpc", created.Networks[0].Network)
+	assert.Equal(t, map[string]string{restoredFromLabel: "nightly"}, created.Labels)
+}
+
+func TestDeleteBackupFilestoreBackups(t *testing.T) {
+	var deleted []string
+	svc := newFakeFilestoreService(t, func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodGet && r.URL.Path == "/v1/projects/snapshot-project/locations/-/backups":
+			assert.Equal(t, `labels.velero-backup="nightly"`, r.URL.Query().Get("filter"))
+			json.NewEncoder(w).Encode(&file.ListBackupsResponse{Backups: []*file.Backup{
+				{Name: "projects/snapshot-project/locations/us-central1/backups/velero-1", Description: `{"velero.io/backup":"nightly"}`},
+				{Name: "projects/snapshot-project/locations/europe-west1/backups/velero-2", Description: `{"velero.io/backup":"nightly"}`},
+				{Name: "projects/snapshot-project/locations/us-central1/backups/other", Description: `{"velero.io/backup":"Nightly"}`},
+			}})
+		case r.Method == http.MethodDelete:
+			deleted = append(deleted, strings.TrimPrefix(r.URL.Path, "/v1/"))
+			json.NewEncoder(w).Encode(&file.Operation{})
+		default:
+			t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	})
+	b := &VolumeSnapshotter{log: velerotest.NewLogger(), filestore: svc, snapshotProject: "snapshot-project"}
+
+	names, err := b.deleteBackupFilestoreBackups("nightly")
+	require.NoError(t, err)
+	expected := []string{
+		"projects/snapshot-project/locations/us-central1/backups/velero-1",
+		"projects/snapshot-project/locations/europe-west1/backups/velero-2",
+	}
+	assert.Equal(t, expected, names)
+	assert.Equal(t, expected, deleted)
+}
+
+func TestWaitForFilestoreInstanceDeadline(t *testing.T) {
+	defer func(timeout, interval time.Duration) {
+		filestoreRestoreTimeout, filestorePollInterval = timeout, interval
+	}(filestoreRestoreTimeout, filestorePollInterval)
+	filestoreRestoreTimeout, filestorePollInterval = 100*time.Millisecond, 10*time.Millisecond
+
+	// requests that don't complete are cut short by the deadline
+	hang := make(chan struct{})
+	defer close(hang)
+	svc := newFakeFilestoreService(t, func(w http.ResponseWriter, r *http.Request) {
+		<-hang
+	})
+	b := &VolumeSnapshotter{log: velerotest.NewLogger()}
+
+	start := time.Now()
+	_, err := b.waitForFilestoreInstance(svc, "projects/p/locations/us-central1-a/instances/i")
+	assert.EqualError(t, err, "timed out waiting for Filestore instance projects/p/locations/us-central1-a/instances/i to become ready")
+	assert.Less(t, int64(time.Since(start)), int64(5*time.Second))
+
+	creating := newFakeFilestoreService(t, func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(&file.Instance{State: "CREATING"})
+	})
+	_, err = b.waitForFilestoreInstance(creating, "projects/p/locations/us-central1-a/instances/i")
+	assert.EqualError(t, err, "timed out waiting for Filestore instance projects/p/locations/us-central1-a/instances/i to become ready")
+}
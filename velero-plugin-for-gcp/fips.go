@@ -0,0 +1,44 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"os"
+	"strconv"
+
+	"github.com/pkg/errors"
+)
+
+// fipsModeEnvVar enables FIPS mode, which requires the plugin to be built
+// with FIPS-validated crypto (GOEXPERIMENT=boringcrypto) and restricts it to
+// approved algorithms.
+const fipsModeEnvVar = "VELERO_GCP_FIPS_MODE"
+
+// fipsMode reports whether FIPS mode is enabled.
+func fipsMode() bool {
+	enabled, _ := strconv.ParseBool(os.Getenv(fipsModeEnvVar))
+	return enabled
+}
+
+// checkFIPSMode returns an error if FIPS mode is enabled but the plugin
+// wasn't built with FIPS-validated crypto.
+func checkFIPSMode() error {
+	if fipsMode() && !fipsCryptoEnabled() {
+		return errors.Errorf("%s is set, but this build of the plugin doesn't use FIPS-validated crypto; use an image built with FIPS=true", fipsModeEnvVar)
+	}
+	return nil
+}
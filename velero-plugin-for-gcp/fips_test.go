@@ -0,0 +1,37 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckFIPSMode(t *testing.T) {
+	t.Setenv(fipsModeEnvVar, "")
+	assert.False(t, fipsMode())
+	assert.NoError(t, checkFIPSMode())
+
+	t.Setenv(fipsModeEnvVar, "true")
+	assert.True(t, fipsMode())
+	if fipsCryptoEnabled() {
+		assert.NoError(t, checkFIPSMode())
+	} else {
+		assert.Error(t, checkFIPSMode(), "FIPS mode can't be enabled without FIPS-validated crypto")
+	}
+}
@@ -0,0 +1,91 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"regexp"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	fleetMembershipConfigKey     = "fleetMembership"
+	fleetTokenFileConfigKey      = "fleetTokenFile"
+	fleetServiceAccountConfigKey = "fleetServiceAccount"
+
+	// defaultFleetTokenFile is where the fleet workload identity setup
+	// mounts the projected Kubernetes service account token.
+	defaultFleetTokenFile = "/var/run/secrets/tokens/gcp-ksa/token"
+)
+
+var (
+	fleetMembershipRegexp = regexp.MustCompile(`^projects/([^/]+)/locations/[^/]+/memberships/[^/]+$`)
+	projectNumberRegexp   = regexp.MustCompile(`^[0-9]+$`)
+)
+
+type credentialSource struct {
+	File string `json:"file"`
+}
+
+type externalAccountJSON struct {
+	Type                           string           `json:"type"`
+	Audience                       string           `json:"audience"`
+	SubjectTokenType               string           `json:"subject_token_type"`
+	TokenURL                       string           `json:"token_url"`
+	ServiceAccountImpersonationURL string           `json:"service_account_impersonation_url,omitempty"`
+	CredentialSource               credentialSource `json:"credential_source"`
+}
+
+// fleetCredentialsJSON returns the external_account credentials that exchange
+// the Kubernetes service account token of a fleet-registered cluster for
+// Google credentials. Unlike GKE workload identity, which gets tokens from the
+// metadata server, fleet workload identity exchanges the token with the STS
+// API, using the fleet's workload identity pool and the membership as the
+// identity provider.
+func fleetCredentialsJSON(config map[string]string) ([]byte, error) {
+	membership := config[fleetMembershipConfigKey]
+	m := fleetMembershipRegexp.FindStringSubmatch(membership)
+	if m == nil {
+		return nil, errors.Errorf("invalid %s %q, expected projects/PROJECT_ID/locations/LOCATION/memberships/MEMBERSHIP", fleetMembershipConfigKey, membership)
+	}
+	project := m[1]
+	if projectNumberRegexp.MatchString(project) {
+		return nil, errors.Errorf("%s must name the fleet host project by ID rather than number, since the workload identity pool is PROJECT_ID.svc.id.goog", fleetMembershipConfigKey)
+	}
+
+	tokenFile := config[fleetTokenFileConfigKey]
+	if tokenFile == "" {
+		tokenFile = defaultFleetTokenFile
+	}
+	if _, err := os.Stat(tokenFile); err != nil {
+		return nil, errors.Wrapf(err, "fleet workload identity token %v is not available; mount a projected service account token with audience %s.svc.id.goog there", tokenFile, project)
+	}
+
+	creds := externalAccountJSON{
+		Type:             externalAccountCredentials,
+		Audience:         "identitynamespace:" + project + ".svc.id.goog:https://gkehub.googleapis.com/" + membership,
+		SubjectTokenType: "urn:ietf:params:oauth:token-type:jwt",
+		TokenURL:         "https://sts.googleapis.com/v1/token",
+		CredentialSource: credentialSource{File: tokenFile},
+	}
+	if sa := config[fleetServiceAccountConfigKey]; sa != "" {
+		creds.ServiceAccountImpersonationURL = "https://iamcredentials.googleapis.com/v1/projects/-/serviceAccounts/" + sa + ":generateAccessToken"
+	}
+	return json.Marshal(creds)
+}
@@ -0,0 +1,125 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFleetCredentialsJSON(t *testing.T) {
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	require.NoError(t, ioutil.WriteFile(tokenFile, []byte("ksa-token"), 0600))
+
+	tests := []struct {
+		name        string
+		config      map[string]string
+		expected    externalAccountJSON
+		expectedErr string
+	}{
+		{
+			name: "membership is the identity provider in the audience",
+			config: map[string]string{
+				fleetMembershipConfigKey: "projects/fleet-host/locations/global/memberships/cluster-1",
+				fleetTokenFileConfigKey:  tokenFile,
+			},
+			expected: externalAccountJSON{
+				Type:             externalAccountCredentials,
+				Audience:         "identitynamespace:fleet-host.svc.id.goog:https://gkehub.googleapis.com/projects/fleet-host/locations/global/memberships/cluster-1",
+				SubjectTokenType: "urn:ietf:params:oauth:token-type:jwt",
+				TokenURL:         "https://sts.googleapis.com/v1/token",
+				CredentialSource: credentialSource{File: tokenFile},
+			},
+		},
+		{
+			name: "service account is impersonated",
+			config: map[string]string{
+				fleetMembershipConfigKey:     "projects/fleet-host/locations/global/memberships/cluster-1",
+				fleetTokenFileConfigKey:      tokenFile,
+				fleetServiceAccountConfigKey: "velero@my-project.iam.gserviceaccount.com",
+			},
+			expected: externalAccountJSON{
+				Type:                           externalAccountCredentials,
+				Audience:                       "identitynamespace:fleet-host.svc.id.goog:https://gkehub.googleapis.com/projects/fleet-host/locations/global/memberships/cluster-1",
+				SubjectTokenType:               "urn:ietf:params:oauth:token-type:jwt",
+				TokenURL:                       "https://sts.googleapis.com/v1/token",
+				ServiceAccountImpersonationURL: "https://iamcredentials.googleapis.com/v1/projects/-/serviceAccounts/velero@my-project.iam.gserviceaccount.com:generateAccessToken",
+				CredentialSource:               credentialSource{File: tokenFile},
+			},
+		},
+		{
+			name:        "invalid membership",
+			config:      map[string]string{fleetMembershipConfigKey: "cluster-1", fleetTokenFileConfigKey: tokenFile},
+			expectedErr: "invalid fleetMembership",
+		},
+		{
+			name:        "project number",
+			config:      map[string]string{fleetMembershipConfigKey: "projects/123456/locations/global/memberships/cluster-1", fleetTokenFileConfigKey: tokenFile},
+			expectedErr: "rather than number",
+		},
+		{
+			name:        "missing token",
+			config:      map[string]string{fleetMembershipConfigKey: "projects/fleet-host/locations/global/memberships/cluster-1", fleetTokenFileConfigKey: filepath.Join(t.TempDir(), "missing")},
+			expectedErr: "mount a projected service account token with audience fleet-host.svc.id.goog",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			data, err := fleetCredentialsJSON(test.config)
+			if test.expectedErr != "" {
+				require.Error(t, err)
+				assert.Contains(t, err.Error(), test.expectedErr)
+				return
+			}
+			require.NoError(t, err)
+
+			var actual externalAccountJSON
+			require.NoError(t, json.Unmarshal(data, &actual))
+			assert.Equal(t, test.expected, actual)
+		})
+	}
+}
+
+func TestLocationCredentialsFleet(t *testing.T) {
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	require.NoError(t, ioutil.WriteFile(tokenFile, []byte("ksa-token"), 0600))
+
+	c, err := newLocationCredentials(&fakeSecrets{}, map[string]string{
+		fleetMembershipConfigKey:     "projects/fleet-host/locations/global/memberships/cluster-1",
+		fleetTokenFileConfigKey:      tokenFile,
+		fleetServiceAccountConfigKey: "velero@my-project.iam.gserviceaccount.com",
+	}, "")
+	require.NoError(t, err)
+
+	data, err := c.configuredJSON()
+	require.NoError(t, err)
+	creds := parseCredentialsJSON(data)
+	assert.Equal(t, externalAccountCredentials, creds.Type)
+	assert.Equal(t, "velero@my-project.iam.gserviceaccount.com", creds.impersonatedServiceAccount())
+
+	_, err = newLocationCredentials(&fakeSecrets{}, map[string]string{
+		fleetMembershipConfigKey: "projects/fleet-host/locations/global/memberships/cluster-1",
+		credentialsFileConfigKey: "/credentials/cloud",
+	}, "")
+	assert.Error(t, err)
+}
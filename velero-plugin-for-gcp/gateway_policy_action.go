@@ -0,0 +1,170 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	api "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	"github.com/vmware-tanzu/velero/pkg/plugin/velero"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+const gatewayPolicyActionName = "velero.io/gcp-gateway-policy"
+
+// gatewayPolicyResources are the resources of the GKE Gateway policies by
+// kind, which attach GCP settings to Gateways and Services by referring to
+// them.
+var gatewayPolicyResources = map[string]schema.GroupResource{
+	"GCPGatewayPolicy":  {Group: "networking.gke.io", Resource: "gcpgatewaypolicies"},
+	"HealthCheckPolicy": {Group: "networking.gke.io", Resource: "healthcheckpolicies"},
+	"GCPBackendPolicy":  {Group: "networking.gke.io", Resource: "gcpbackendpolicies"},
+}
+
+// policyTargetResources are the resources of the kinds Gateway policies can
+// target.
+var policyTargetResources = map[schema.GroupKind]schema.GroupResource{
+	{Group: "gateway.networking.k8s.io", Kind: "Gateway"}: {Group: "gateway.networking.k8s.io", Resource: "gateways"},
+	{Group: "", Kind: "Service"}:                          {Resource: "services"},
+	{Group: "net.gke.io", Kind: "ServiceImport"}:          {Group: "net.gke.io", Resource: "serviceimports"},
+}
+
+func (inCluster) gatewayPolicies(namespace string) ([]unstructured.Unstructured, error) {
+	client, err := newInClusterClient()
+	if err != nil {
+		return nil, err
+	}
+
+	var policies []unstructured.Unstructured
+	for _, kind := range []string{"GCPGatewayPolicy", "HealthCheckPolicy", "GCPBackendPolicy"} {
+		resource := gatewayPolicyResources[kind]
+		list, err := client.listResources(resource.WithVersion("v1"), namespace)
+		if err != nil {
+			return nil, err
+		}
+		policies = append(policies, list...)
+	}
+	return policies, nil
+}
+
+// policyTarget returns the group, kind, namespace and name of the object a
+// Gateway policy targets.
+func policyTarget(policy *unstructured.Unstructured) (schema.GroupKind, string, string) {
+	ref, _, _ := unstructured.NestedStringMap(policy.Object, "spec", "targetRef")
+	namespace := ref["namespace"]
+	if namespace == "" {
+		namespace = policy.GetNamespace()
+	}
+	return schema.GroupKind{Group: ref["group"], Kind: ref["kind"]}, namespace, ref["name"]
+}
+
+// GatewayPolicyBackupAction is a backup item action that backs up GKE
+// Gateway policies along with the Gateways and Services they target, and
+// the other way around, so restored Gateways keep their GCP settings.
+type GatewayPolicyBackupAction struct {
+	log     logrus.FieldLogger
+	cluster veleroCluster
+}
+
+func newGatewayPolicyBackupAction(logger logrus.FieldLogger) (interface{}, error) {
+	return &GatewayPolicyBackupAction{log: logger, cluster: inCluster{}}, nil
+}
+
+func (a *GatewayPolicyBackupAction) AppliesTo() (velero.ResourceSelector, error) {
+	resources := []string{"services", "gateways.gateway.networking.k8s.io", "serviceimports.net.gke.io"}
+	for _, resource := range gatewayPolicyResources {
+		resources = append(resources, resource.String())
+	}
+	return velero.ResourceSelector{IncludedResources: resources}, nil
+}
+
+func (a *GatewayPolicyBackupAction) Execute(item runtime.Unstructured, backup *api.Backup) (runtime.Unstructured, []velero.ResourceIdentifier, error) {
+	obj := &unstructured.Unstructured{Object: item.UnstructuredContent()}
+	gk := obj.GroupVersionKind().GroupKind()
+
+	if _, ok := gatewayPolicyResources[gk.Kind]; ok && gk.Group == "networking.gke.io" {
+		var additional []velero.ResourceIdentifier
+		target, namespace, name := policyTarget(obj)
+		if resource, ok := policyTargetResources[target]; ok && name != "" {
+			additional = append(additional, velero.ResourceIdentifier{GroupResource: resource, Namespace: namespace, Name: name})
+		}
+		// IAP OAuth client secrets of backend policies
+		if secret, _, _ := unstructured.NestedString(obj.Object, "spec", "default", "iap", "oauth2ClientSecret", "name"); secret != "" {
+			additional = append(additional, velero.ResourceIdentifier{GroupResource: secretsResource, Namespace: obj.GetNamespace(), Name: secret})
+		}
+		return item, additional, nil
+	}
+
+	log := a.log.WithField(obj.GetKind(), obj.GetNamespace()+"/"+obj.GetName())
+	policies, err := a.cluster.gatewayPolicies(obj.GetNamespace())
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "error listing the Gateway policies of %s %s/%s", obj.GetKind(), obj.GetNamespace(), obj.GetName())
+	}
+
+	var additional []velero.ResourceIdentifier
+	for i := range policies {
+		policy := &policies[i]
+		target, namespace, name := policyTarget(policy)
+		resource, ok := gatewayPolicyResources[policy.GetKind()]
+		if !ok || target != gk || namespace != obj.GetNamespace() || name != obj.GetName() {
+			continue
+		}
+		log.Infof("Adding %s %s targeting it", resource.Resource, policy.GetName())
+		additional = append(additional, velero.ResourceIdentifier{GroupResource: resource, Namespace: policy.GetNamespace(), Name: policy.GetName()})
+	}
+	return item, additional, nil
+}
+
+// GatewayPolicyRestoreAction is a restore item action that points restored
+// GKE Gateway policies targeting objects in other namespaces at the
+// namespaces those are restored into.
+type GatewayPolicyRestoreAction struct {
+	log logrus.FieldLogger
+}
+
+func newGatewayPolicyRestoreAction(logger logrus.FieldLogger) (interface{}, error) {
+	return &GatewayPolicyRestoreAction{log: logger}, nil
+}
+
+func (a *GatewayPolicyRestoreAction) AppliesTo() (velero.ResourceSelector, error) {
+	var resources []string
+	for _, resource := range gatewayPolicyResources {
+		resources = append(resources, resource.String())
+	}
+	return velero.ResourceSelector{IncludedResources: resources}, nil
+}
+
+func (a *GatewayPolicyRestoreAction) Execute(input *velero.RestoreItemActionExecuteInput) (*velero.RestoreItemActionExecuteOutput, error) {
+	obj := &unstructured.Unstructured{Object: input.Item.UnstructuredContent()}
+
+	namespace, found, err := unstructured.NestedString(obj.Object, "spec", "targetRef", "namespace")
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if !found || namespace == "" || input.Restore == nil {
+		return velero.NewRestoreItemActionExecuteOutput(obj), nil
+	}
+	if mapped, ok := input.Restore.Spec.NamespaceMapping[namespace]; ok {
+		a.log.Infof("Updating the target namespace of %s %s/%s from %s to %s", obj.GetKind(), obj.GetNamespace(), obj.GetName(), namespace, mapped)
+		if err := unstructured.SetNestedField(obj.Object, mapped, "spec", "targetRef", "namespace"); err != nil {
+			return nil, errors.WithStack(err)
+		}
+	}
+	return velero.NewRestoreItemActionExecuteOutput(obj), nil
+}
@@ -0,0 +1,114 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	api "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	"github.com/vmware-tanzu/velero/pkg/plugin/velero"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+
+	velerotest "github.com/vmware-tanzu/velero/pkg/test"
+)
+
+func testGatewayPolicy(kind, name string, targetRef map[string]interface{}) unstructured.Unstructured {
+	return unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "networking.gke.io/v1",
+		"kind":       kind,
+		"metadata":   map[string]interface{}{"namespace": "shop", "name": name},
+		"spec":       map[string]interface{}{"targetRef": targetRef},
+	}}
+}
+
+func TestGatewayPolicyBackupActionExecute(t *testing.T) {
+	policies := []unstructured.Unstructured{
+		testGatewayPolicy("HealthCheckPolicy", "store-hc", map[string]interface{}{"group": "", "kind": "Service", "name": "store"}),
+		testGatewayPolicy("GCPBackendPolicy", "store-backend", map[string]interface{}{"group": "", "kind": "Service", "name": "store"}),
+		testGatewayPolicy("GCPBackendPolicy", "cart-backend", map[string]interface{}{"group": "", "kind": "Service", "name": "cart"}),
+		testGatewayPolicy("GCPGatewayPolicy", "external", map[string]interface{}{"group": "gateway.networking.k8s.io", "kind": "Gateway", "name": "store"}),
+	}
+
+	backendPolicy := testGatewayPolicy("GCPBackendPolicy", "iap", map[string]interface{}{"group": "", "kind": "Service", "name": "admin", "namespace": "admin"})
+	require.NoError(t, unstructured.SetNestedField(backendPolicy.Object, "iap-client", "spec", "default", "iap", "oauth2ClientSecret", "name"))
+
+	tests := []struct {
+		name     string
+		item     *unstructured.Unstructured
+		expected []velero.ResourceIdentifier
+	}{
+		{
+			name: "service includes the policies targeting it",
+			item: &unstructured.Unstructured{Object: map[string]interface{}{
+				"apiVersion": "v1",
+				"kind":       "Service",
+				"metadata":   map[string]interface{}{"namespace": "shop", "name": "store"},
+			}},
+			expected: []velero.ResourceIdentifier{
+				{GroupResource: gatewayPolicyResources["HealthCheckPolicy"], Namespace: "shop", Name: "store-hc"},
+				{GroupResource: gatewayPolicyResources["GCPBackendPolicy"], Namespace: "shop", Name: "store-backend"},
+			},
+		},
+		{
+			name: "gateway includes the policies targeting it",
+			item: &unstructured.Unstructured{Object: map[string]interface{}{
+				"apiVersion": "gateway.networking.k8s.io/v1beta1",
+				"kind":       "Gateway",
+				"metadata":   map[string]interface{}{"namespace": "shop", "name": "store"},
+			}},
+			expected: []velero.ResourceIdentifier{
+				{GroupResource: gatewayPolicyResources["GCPGatewayPolicy"], Namespace: "shop", Name: "external"},
+			},
+		},
+		{
+			name: "policy includes its target and IAP secret",
+			item: &backendPolicy,
+			expected: []velero.ResourceIdentifier{
+				{GroupResource: schema.GroupResource{Resource: "services"}, Namespace: "admin", Name: "admin"},
+				{GroupResource: secretsResource, Namespace: "shop", Name: "iap-client"},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			action := &GatewayPolicyBackupAction{log: velerotest.NewLogger(), cluster: &fakeCluster{policies: map[string][]unstructured.Unstructured{"shop": policies}}}
+			_, additional, err := action.Execute(test.item, nil)
+			require.NoError(t, err)
+			assert.Equal(t, test.expected, additional)
+		})
+	}
+}
+
+func TestGatewayPolicyRestoreActionExecute(t *testing.T) {
+	restore := &api.Restore{Spec: api.RestoreSpec{NamespaceMapping: map[string]string{"admin": "admin-dr"}}}
+
+	policy := testGatewayPolicy("GCPBackendPolicy", "iap", map[string]interface{}{"kind": "Service", "name": "admin", "namespace": "admin"})
+	action := &GatewayPolicyRestoreAction{log: velerotest.NewLogger()}
+	out, err := action.Execute(&velero.RestoreItemActionExecuteInput{Item: &policy, Restore: restore})
+	require.NoError(t, err)
+	namespace, _, _ := unstructured.NestedString(out.UpdatedItem.UnstructuredContent(), "spec", "targetRef", "namespace")
+	assert.Equal(t, "admin-dr", namespace)
+
+	local := testGatewayPolicy("HealthCheckPolicy", "hc", map[string]interface{}{"kind": "Service", "name": "store"})
+	out, err = action.Execute(&velero.RestoreItemActionExecuteInput{Item: local.DeepCopy(), Restore: restore})
+	require.NoError(t, err)
+	assert.Equal(t, local.Object, out.UpdatedItem.UnstructuredContent())
+}
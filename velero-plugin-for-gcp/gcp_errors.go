@@ -0,0 +1,237 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	stderrors "errors"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"golang.org/x/oauth2"
+	"google.golang.org/api/googleapi"
+)
+
+// errorClass is the kind of failure an error from a GCP API represents,
+// which decides how the plugin handles it:
+//
+//   - notFoundError: the resource doesn't exist. Deleting it succeeds, and
+//     other operations fail.
+//   - permissionError: the plugin's identity isn't allowed to make the call,
+//     or the API is disabled. The operation fails without being retried.
+//   - perimeterError: VPC Service Controls blocked the call, because the
+//     plugin or the resource is outside a service perimeter. The operation
+//     fails without being retried.
+//   - quotaError: a quota is exhausted. The operation fails without being
+//     retried, since quotas don't free up within a backup.
+//   - transientError: the API is unavailable, overloaded or rate limiting
+//     the plugin. Idempotent calls are retried before the operation fails.
+//   - fatalError: anything else, such as invalid requests. The operation
+//     fails.
+//
+// Errors the volume snapshotter returns fail only the volume they are for,
+// so Velero marks the backup or restore PartiallyFailed, while errors the
+// object store returns fail the whole backup or restore.
+type errorClass string
+
+const (
+	notFoundError   errorClass = "NotFound"
+	permissionError errorClass = "PermissionDenied"
+	perimeterError  errorClass = "PerimeterViolation"
+	quotaError      errorClass = "QuotaExceeded"
+	transientError  errorClass = "Transient"
+	fatalError      errorClass = "Fatal"
+
+	volumeSnapshotterComponent = "volume-snapshotter"
+	objectStoreComponent       = "object-store"
+
+	pluginErrorsCounter = "velero_gcp_errors_total"
+
+	transientRetryAttempts = 3
+	transientRetryBackoff  = time.Second
+)
+
+// classifyError returns the class of an error returned by a GCP API call,
+// through any wrapping.
+func classifyError(err error) errorClass {
+	if stderrors.Is(err, storage.ErrObjectNotExist) || stderrors.Is(err, storage.ErrBucketNotExist) {
+		return notFoundError
+	}
+
+	var apiErr *googleapi.Error
+	if stderrors.As(err, &apiErr) {
+		switch {
+		case apiErr.Code == http.StatusNotFound || apiErr.Code == http.StatusGone:
+			return notFoundError
+		case hasErrorReason(apiErr, "quotaExceeded"):
+			return quotaError
+		// Compute Engine rejects requests over its rate limits with a 403
+		case apiErr.Code == http.StatusTooManyRequests || hasErrorReason(apiErr, "rateLimitExceeded", "userRateLimitExceeded"):
+			return transientError
+		case isTransientStatus(apiErr.Code):
+			return transientError
+		case apiErr.Code == http.StatusForbidden && isPerimeterViolation(apiErr):
+			return perimeterError
+		case apiErr.Code == http.StatusUnauthorized || apiErr.Code == http.StatusForbidden:
+			return permissionError
+		}
+		return fatalError
+	}
+
+	var retrieveErr *oauth2.RetrieveError
+	if stderrors.As(err, &retrieveErr) {
+		if isTransientAuthError(err) {
+			return transientError
+		}
+		return permissionError
+	}
+
+	var netErr net.Error
+	if stderrors.Is(err, context.DeadlineExceeded) || (stderrors.As(err, &netErr) && netErr.Timeout()) {
+		return transientError
+	}
+	return fatalError
+}
+
+func hasErrorReason(apiErr *googleapi.Error, reasons ...string) bool {
+	for _, reason := range reasons {
+		for _, item := range apiErr.Errors {
+			if item.Reason == reason {
+				return true
+			}
+		}
+		// the errors of some APIs are only in the body
+		if strings.Contains(apiErr.Body, `"`+reason+`"`) {
+			return true
+		}
+	}
+	return false
+}
+
+// isPerimeterViolation reports whether VPC Service Controls rejected a call.
+// APIs report it with the SECURITY_POLICY_VIOLATED reason of the error's
+// details, Cloud Storage with the vpcServiceControls reason, and all of them
+// with the violation's unique identifier in the message.
+func isPerimeterViolation(apiErr *googleapi.Error) bool {
+	return hasErrorReason(apiErr, "SECURITY_POLICY_VIOLATED", "vpcServiceControls") ||
+		strings.Contains(apiErr.Message, vpcServiceControlsIDMarker) ||
+		strings.Contains(apiErr.Body, vpcServiceControlsIDMarker)
+}
+
+// vpcServiceControlsIDMarker precedes the unique identifier of a VPC Service
+// Controls violation in error messages, which finds the violation in the
+// audit logs.
+const vpcServiceControlsIDMarker = "vpcServiceControlsUniqueIdentifier"
+
+var (
+	vpcServiceControlsIDRegexp = regexp.MustCompile(vpcServiceControlsIDMarker + `\W*([A-Za-z0-9_-]+)`)
+	servicePerimeterRegexp     = regexp.MustCompile(`accessPolicies/[0-9]+/servicePerimeters/[A-Za-z0-9_]+`)
+)
+
+// perimeterViolation returns the service perimeter named in a VPC Service
+// Controls violation, which only some APIs include, and the violation's
+// unique identifier.
+func perimeterViolation(err error) (string, string) {
+	var apiErr *googleapi.Error
+	if !stderrors.As(err, &apiErr) {
+		return "", ""
+	}
+	text := apiErr.Message + " " + apiErr.Body
+	var id string
+	if m := vpcServiceControlsIDRegexp.FindStringSubmatch(text); m != nil {
+		id = m[1]
+	}
+	return servicePerimeterRegexp.FindString(text), id
+}
+
+// isNotFound reports whether an error means the resource doesn't exist.
+func isNotFound(err error) bool {
+	return err != nil && classifyError(err) == notFoundError
+}
+
+// classifiedError is an error returned to Velero that needs the user to
+// act, with advice on fixing it.
+type classifiedError struct {
+	class errorClass
+	err   error
+}
+
+func (e *classifiedError) Error() string {
+	switch e.class {
+	case quotaError:
+		return e.err.Error() + " (quota exceeded; request a quota increase or free up resources)"
+	case perimeterError:
+		return e.err.Error() + " (" + perimeterAdvice(e.err) + ")"
+	}
+	return e.err.Error() + " (permission denied; check the plugin's IAM roles, e.g. with the audit-permissions command, and that the API is enabled)"
+}
+
+// perimeterAdvice explains a VPC Service Controls violation and how to fix
+// it.
+func perimeterAdvice(err error) string {
+	perimeter, id := perimeterViolation(err)
+	advice := "blocked by VPC Service Controls"
+	if perimeter != "" {
+		advice += " perimeter " + perimeter
+	}
+	if id != "" {
+		advice += "; the audit logs entry with protoPayload.metadata.vpcServiceControlsUniqueId=" + id + " names the perimeter and the violated rule"
+	}
+	return advice + "; run Velero inside the perimeter or add an ingress rule for the plugin's identity, and keep the bucket, disks and snapshot project in the same perimeter or allow them with egress rules"
+}
+
+func (e *classifiedError) Cause() error  { return e.err }
+func (e *classifiedError) Unwrap() error { return e.err }
+
+// reportError classifies an error a plugin component returns to Velero and
+// counts it. Permission, perimeter and quota errors get advice on fixing them added to
+// their message; other errors are returned as they are.
+func reportError(component, operation string, err error) error {
+	if err == nil {
+		return nil
+	}
+	if _, ok := err.(*classifiedError); ok {
+		return err
+	}
+	class := classifyError(err)
+	pluginMetrics.addCounter(pluginErrorsCounter, "Number of errors the plugin returned to Velero, by class.", map[string]string{
+		"component": component,
+		"operation": operation,
+		"class":     string(class),
+	}, 1)
+	if class != permissionError && class != quotaError && class != perimeterError {
+		return err
+	}
+	return &classifiedError{class: class, err: err}
+}
+
+// retryTransient calls fn until it succeeds, fails with an error that isn't
+// transient, or has been called transientRetryAttempts times, backing off
+// between calls with sleep. Only idempotent calls can be retried.
+func retryTransient(sleep func(time.Duration), fn func() error) error {
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil || attempt == transientRetryAttempts || classifyError(err) != transientError {
+			return err
+		}
+		sleep(time.Duration(attempt) * transientRetryBackoff)
+	}
+}
@@ -0,0 +1,172 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	velerotest "github.com/vmware-tanzu/velero/pkg/test"
+	"golang.org/x/oauth2"
+	"google.golang.org/api/compute/v1"
+	"google.golang.org/api/googleapi"
+)
+
+func TestClassifyError(t *testing.T) {
+	tests := []struct {
+		name     string
+		err      error
+		expected errorClass
+	}{
+		{name: "missing object", err: errors.WithStack(storage.ErrObjectNotExist), expected: notFoundError},
+		{name: "missing snapshot", err: errors.Wrap(&googleapi.Error{Code: http.StatusNotFound}, "error getting snapshot"), expected: notFoundError},
+		{name: "missing permission", err: &googleapi.Error{Code: http.StatusForbidden, Errors: []googleapi.ErrorItem{{Reason: "forbidden"}}}, expected: permissionError},
+		{name: "invalid credentials", err: &googleapi.Error{Code: http.StatusUnauthorized}, expected: permissionError},
+		{name: "revoked key", err: &oauth2.RetrieveError{Body: []byte("invalid_grant")}, expected: permissionError},
+		{name: "VPC Service Controls", err: &googleapi.Error{Code: http.StatusForbidden, Message: "Request is prohibited by organization's policy. vpcServiceControlsUniqueIdentifier: abc123"}, expected: perimeterError},
+		{name: "VPC Service Controls in Cloud Storage", err: &googleapi.Error{Code: http.StatusForbidden, Errors: []googleapi.ErrorItem{{Reason: "vpcServiceControls"}}}, expected: perimeterError},
+		{name: "VPC Service Controls in details", err: &googleapi.Error{Code: http.StatusForbidden, Body: `{"error":{"details":[{"@type":"type.googleapis.com/google.rpc.ErrorInfo","reason":"SECURITY_POLICY_VIOLATED"}]}}`}, expected: perimeterError},
+		{name: "exhausted quota", err: &googleapi.Error{Code: http.StatusForbidden, Errors: []googleapi.ErrorItem{{Reason: "quotaExceeded"}}}, expected: quotaError},
+		{name: "exhausted quota in body", err: &googleapi.Error{Code: http.StatusForbidden, Body: `{"error":{"errors":[{"reason":"quotaExceeded"}]}}`}, expected: quotaError},
+		{name: "compute rate limit", err: &googleapi.Error{Code: http.StatusForbidden, Errors: []googleapi.ErrorItem{{Reason: "rateLimitExceeded"}}}, expected: transientError},
+		{name: "too many requests", err: &googleapi.Error{Code: http.StatusTooManyRequests}, expected: transientError},
+		{name: "unavailable", err: &googleapi.Error{Code: http.StatusServiceUnavailable}, expected: transientError},
+		{name: "timeout", err: errors.WithStack(context.DeadlineExceeded), expected: transientError},
+		{name: "invalid request", err: &googleapi.Error{Code: http.StatusBadRequest}, expected: fatalError},
+		{name: "other error", err: errors.New("invalid volume ID"), expected: fatalError},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert.Equal(t, test.expected, classifyError(test.err))
+		})
+	}
+
+	assert.False(t, isNotFound(nil))
+	assert.True(t, isNotFound(&googleapi.Error{Code: http.StatusNotFound}))
+}
+
+func TestReportError(t *testing.T) {
+	defer func(registry *metricsRegistry) { pluginMetrics = registry }(pluginMetrics)
+	pluginMetrics = newMetricsRegistry()
+
+	assert.NoError(t, reportError(objectStoreComponent, "PutObject", nil))
+
+	err := errors.New("error writing")
+	assert.Equal(t, err, reportError(objectStoreComponent, "PutObject", err), "errors that don't need the user to act are returned as they are")
+
+	err = reportError(volumeSnapshotterComponent, "CreateSnapshot", &googleapi.Error{Code: http.StatusForbidden, Message: "Required 'compute.disks.createSnapshot' permission"})
+	assert.Contains(t, err.Error(), "Required 'compute.disks.createSnapshot' permission (permission denied; check the plugin's IAM roles")
+	assert.Equal(t, err, reportError(volumeSnapshotterComponent, "CreateSnapshot", err), "errors are reported once")
+	var apiErr *googleapi.Error
+	assert.True(t, errors.As(err, &apiErr))
+
+	err = reportError(volumeSnapshotterComponent, "CreateSnapshot", &googleapi.Error{Code: http.StatusForbidden, Errors: []googleapi.ErrorItem{{Reason: "quotaExceeded"}}})
+	assert.Contains(t, err.Error(), "(quota exceeded; request a quota increase or free up resources)")
+
+	err = reportError(objectStoreComponent, "GetObject", &googleapi.Error{
+		Code:    http.StatusForbidden,
+		Message: "Request is prohibited by organization's policy. vpcServiceControlsUniqueIdentifier: Xy-12_z",
+		Body:    `{"error":{"details":[{"violations":[{"type":"VPC_SERVICE_CONTROLS","subject":"Xy-12_z","description":"accessPolicies/123/servicePerimeters/backups"}]}]}}`,
+	})
+	assert.Contains(t, err.Error(), "(blocked by VPC Service Controls perimeter accessPolicies/123/servicePerimeters/backups; the audit logs entry with protoPayload.metadata.vpcServiceControlsUniqueId=Xy-12_z names")
+	perimeter, id := perimeterViolation(errors.Wrap(&googleapi.Error{Code: http.StatusForbidden, Message: "vpcServiceControlsUniqueIdentifier: abc"}, "error reading object"))
+	assert.Equal(t, "", perimeter)
+	assert.Equal(t, "abc", id)
+
+	values := make(map[string]float64)
+	pluginMetrics.each(func(m *metric, s *sample) {
+		values[m.name+labelString(s.labels)] = s.value
+	})
+	assert.Equal(t, map[string]float64{
+		`velero_gcp_errors_total{class="Fatal",component="object-store",operation="PutObject"}`:                       1,
+		`velero_gcp_errors_total{class="PerimeterViolation",component="object-store",operation="GetObject"}`:          1,
+		`velero_gcp_errors_total{class="PermissionDenied",component="volume-snapshotter",operation="CreateSnapshot"}`: 1,
+		`velero_gcp_errors_total{class="QuotaExceeded",component="volume-snapshotter",operation="CreateSnapshot"}`:    1,
+	}, values)
+}
+
+func TestRetryTransient(t *testing.T) {
+	var sleeps []time.Duration
+	sleep := func(d time.Duration) { sleeps = append(sleeps, d) }
+
+	calls := 0
+	err := retryTransient(sleep, func() error {
+		calls++
+		if calls < 3 {
+			return &googleapi.Error{Code: http.StatusServiceUnavailable}
+		}
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []time.Duration{time.Second, 2 * time.Second}, sleeps)
+
+	// errors that aren't transient aren't retried
+	calls = 0
+	err = retryTransient(sleep, func() error {
+		calls++
+		return &googleapi.Error{Code: http.StatusForbidden}
+	})
+	assert.Error(t, err)
+	assert.Equal(t, 1, calls)
+
+	// retries stop after the last attempt
+	calls = 0
+	err = retryTransient(sleep, func() error {
+		calls++
+		return &googleapi.Error{Code: http.StatusInternalServerError}
+	})
+	assert.Error(t, err)
+	assert.Equal(t, transientRetryAttempts, calls)
+}
+
+func TestDeleteSnapshotRetriesTransientErrors(t *testing.T) {
+	requests := 0
+	gce := newFakeComputeService(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			// the snapshot's retention
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		requests++
+		switch requests {
+		case 1:
+			w.WriteHeader(http.StatusServiceUnavailable)
+		case 2:
+			json.NewEncoder(w).Encode(&compute.Operation{})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	})
+	b := (&VolumeSnapshotter{log: velerotest.NewLogger(), sleep: func(time.Duration) {}, snapshotProject: "p"}).withClients(&snapshotterClients{gce: gce})
+
+	deleted, err := b.deleteSnapshot("disk-1-snap")
+	require.NoError(t, err)
+	assert.True(t, deleted)
+	assert.Equal(t, 2, requests)
+
+	// deleting snapshots that are already gone succeeds
+	deleted, err = b.deleteSnapshot("disk-1-snap")
+	require.NoError(t, err)
+	assert.False(t, deleted)
+}
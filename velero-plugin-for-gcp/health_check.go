@@ -0,0 +1,356 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	stderrors "errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/pflag"
+	api "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	"google.golang.org/api/compute/v1"
+	"google.golang.org/api/googleapi"
+	iam "google.golang.org/api/iam/v1"
+	"google.golang.org/api/iterator"
+)
+
+const (
+	// healthCheckCommand checks that the plugin can reach and use the GCP
+	// APIs of Velero's locations, e.g. from a readiness probe:
+	// `/plugins/velero-plugin-for-gcp health-check`.
+	healthCheckCommand = "health-check"
+
+	// defaultMaxLatency is how long a check can take before it fails even
+	// though it succeeded.
+	defaultMaxLatency = 5 * time.Second
+
+	// healthCheckTimeout is how long a check can take before it's
+	// abandoned.
+	healthCheckTimeout = 30 * time.Second
+)
+
+// healthCheck is a check of a location's credentials, keys or API.
+type healthCheck struct {
+	location string
+	name     string
+	target   string
+	// run performs the check and returns a note about its result, if any.
+	run func(ctx context.Context) (string, error)
+}
+
+type healthResult struct {
+	healthCheck
+	latency time.Duration
+	note    string
+	err     error
+}
+
+// runHealthChecks runs the checks in order. Checks that succeed but take
+// longer than maxLatency fail.
+func runHealthChecks(ctx context.Context, checks []healthCheck, maxLatency time.Duration) []healthResult {
+	results := make([]healthResult, 0, len(checks))
+	for _, check := range checks {
+		checkCtx, cancel := context.WithTimeout(ctx, healthCheckTimeout)
+		start := time.Now()
+		note, err := check.run(checkCtx)
+		latency := time.Since(start)
+		cancel()
+
+		if err == nil && maxLatency > 0 && latency > maxLatency {
+			err = errors.Errorf("took %s, longer than the maximum of %s", latency.Round(time.Millisecond), maxLatency)
+		}
+		results = append(results, healthResult{healthCheck: check, latency: latency, note: note, err: err})
+	}
+	return results
+}
+
+// writeHealthReport prints the results as a table followed by the overall
+// result, and reports whether every check passed.
+func writeHealthReport(w io.Writer, results []healthResult) bool {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "LOCATION\tCHECK\tTARGET\tLATENCY\tSTATUS")
+
+	ok := true
+	for _, r := range results {
+		status := "ok"
+		switch {
+		case r.err != nil:
+			status = "FAILED: " + r.err.Error()
+			ok = false
+		case r.note != "":
+			status = "ok (" + r.note + ")"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", r.location, r.name, r.target, r.latency.Round(time.Millisecond), status)
+	}
+	tw.Flush()
+
+	if ok {
+		fmt.Fprintln(w, "PASS")
+	} else {
+		fmt.Fprintln(w, "FAIL")
+	}
+	return ok
+}
+
+// initCheck reports a location whose plugin couldn't be initialized, e.g.
+// because its config is invalid or its credentials can't be loaded.
+func initCheck(location string, err error) healthCheck {
+	return healthCheck{location: location, name: "init", run: func(context.Context) (string, error) {
+		return "", err
+	}}
+}
+
+// credentialsCheck checks that an access token can be obtained for the
+// location's identity.
+func credentialsCheck(location string, credentials locationCredentials, scopes []string) healthCheck {
+	target := credentials.impersonate
+	if target == "" {
+		target = credentials.file
+	}
+	return healthCheck{location: location, name: "credentials", target: target, run: func(ctx context.Context) (string, error) {
+		ts, _, err := credentials.accessTokenSource(ctx, scopes...)
+		if err != nil {
+			return "", err
+		}
+		if _, err := ts.Token(); err != nil {
+			return "", errors.Wrap(err, "error getting an access token")
+		}
+		return "", nil
+	}}
+}
+
+// serviceAccountKeyCheck checks that the service account key the location
+// uses, if any, is enabled and hasn't expired, with getKey. It returns no
+// check for other credentials.
+func serviceAccountKeyCheck(location string, credentials locationCredentials, getKey keyStatusGetter) (healthCheck, bool) {
+	credsJSON, err := credentials.configuredJSON()
+	if err != nil {
+		return healthCheck{}, false
+	}
+	var key serviceAccountKeyJSON
+	if err := json.Unmarshal(credsJSON, &key); err != nil || key.Type != serviceAccountCredentials || key.ClientEmail == "" || key.PrivateKeyID == "" {
+		return healthCheck{}, false
+	}
+
+	name := "projects/-/serviceAccounts/" + key.ClientEmail + "/keys/" + key.PrivateKeyID
+	return healthCheck{location: location, name: "service account key", target: key.ClientEmail + "/" + key.PrivateKeyID, run: func(ctx context.Context) (string, error) {
+		opts, err := credentials.clientOptions(ctx, iam.CloudPlatformScope)
+		if err != nil {
+			return "", err
+		}
+		status, err := getKey(ctx, name, opts...)
+		var apiErr *googleapi.Error
+		if stderrors.As(err, &apiErr) && apiErr.Code == http.StatusForbidden {
+			return "not permitted to check its status", nil
+		}
+		if err != nil {
+			return "", err
+		}
+		switch {
+		case status.disabled:
+			return "", errors.New("the key is disabled")
+		case !status.validBefore.IsZero() && !status.validBefore.After(time.Now()):
+			return "", errors.Errorf("the key expired at %s", status.validBefore.Format(time.RFC3339))
+		case !status.validBefore.IsZero() && time.Until(status.validBefore) < keyExpiryWarningPeriod:
+			return "expires at " + status.validBefore.Format(time.RFC3339), nil
+		}
+		return "", nil
+	}}, true
+}
+
+// backupLocationChecks returns the checks of a backup storage location: its
+// credentials, listing its bucket, and its service account and Cloud KMS
+// keys.
+func backupLocationChecks(log logrus.FieldLogger, location *api.BackupStorageLocation) []healthCheck {
+	name := "BackupStorageLocation/" + location.Name
+	config := map[string]string{"bucket": location.Spec.ObjectStorage.Bucket, "prefix": location.Spec.ObjectStorage.Prefix}
+	for k, v := range location.Spec.Config {
+		config[k] = v
+	}
+	o := newObjectStore(log)
+	if err := o.Init(config); err != nil {
+		return []healthCheck{initCheck(name, err)}
+	}
+	clients := o.clients()
+
+	bucket, prefix := config["bucket"], config["prefix"]
+	checks := []healthCheck{
+		credentialsCheck(name, clients.credentials, parseScopes(config, storage.ScopeReadWrite)),
+		{location: name, name: "storage", target: "gs://" + bucket, run: func(ctx context.Context) (string, error) {
+			_, err := clients.readClient.Bucket(bucket).Objects(ctx, &storage.Query{Prefix: prefix}).Next()
+			if err != nil && err != iterator.Done {
+				return "", errors.Wrapf(err, "error listing bucket %s", bucket)
+			}
+			return "", nil
+		}},
+	}
+	if check, ok := serviceAccountKeyCheck(name, clients.credentials, getServiceAccountKey); ok {
+		checks = append(checks, check)
+	}
+	if o.kmsKeyName != "" {
+		checks = append(checks, healthCheck{location: name, name: "kms key", target: o.kmsKeyName, run: func(ctx context.Context) (string, error) {
+			kms, err := newKMSService(ctx, clients.credentials)
+			if err != nil {
+				return "", errors.WithStack(err)
+			}
+			return "", verifyKMSKey(kms, o.kmsKeyName)
+		}})
+	}
+	if clients.orgPolicies != nil {
+		checks = append(checks, healthCheck{location: name, name: "org policies", target: "gs://" + bucket, run: func(context.Context) (string, error) {
+			violations, err := o.bucketOrgPolicyViolations(bucket)
+			if err != nil {
+				return "", err
+			}
+			return orgPolicyHealth(violations)
+		}})
+	}
+	return checks
+}
+
+// snapshotLocationChecks returns the checks of a volume snapshot location:
+// its credentials, reading its projects from Compute Engine, and its service
+// account key.
+func snapshotLocationChecks(log logrus.FieldLogger, location *api.VolumeSnapshotLocation) []healthCheck {
+	name := "VolumeSnapshotLocation/" + location.Name
+	b := newVolumeSnapshotter(log)
+	if err := b.Init(location.Spec.Config); err != nil {
+		return []healthCheck{initCheck(name, err)}
+	}
+	clients := b.clients()
+
+	checks := []healthCheck{credentialsCheck(name, clients.credentials, parseScopes(location.Spec.Config, compute.ComputeScope))}
+	projects := []string{b.volumeProject}
+	if b.snapshotProject != b.volumeProject {
+		projects = append(projects, b.snapshotProject)
+	}
+	for _, project := range projects {
+		project := project
+		checks = append(checks, healthCheck{location: name, name: "compute", target: "projects/" + project, run: func(ctx context.Context) (string, error) {
+			_, err := clients.gce.Projects.Get(project).Fields("name").Context(ctx).Do()
+			return "", errors.Wrapf(err, "error getting project %s", project)
+		}})
+	}
+	if check, ok := serviceAccountKeyCheck(name, clients.credentials, getServiceAccountKey); ok {
+		checks = append(checks, check)
+	}
+	if clients.orgPolicies != nil {
+		checks = append(checks, healthCheck{location: name, name: "org policies", target: "projects/" + b.snapshotProject, run: func(context.Context) (string, error) {
+			return orgPolicyHealth(clients.orgPolicies.snapshotViolations(b.snapshotProject, b.snapshotLocation, nil))
+		}})
+	}
+	if b.backupForGKE != nil {
+		checks = append(checks, healthCheck{location: name, name: "backup for gke", target: "apis/" + backupForGKEGroup, run: func(context.Context) (string, error) {
+			return b.backupForGKE.health()
+		}})
+	}
+	return checks
+}
+
+// locationHealthChecks returns the checks of the named GCP backup and volume
+// snapshot locations, or of all of them if none are named.
+func locationHealthChecks(log logrus.FieldLogger, cluster veleroCluster, backupLocations, snapshotLocations []string) ([]healthCheck, error) {
+	all := len(backupLocations) == 0 && len(snapshotLocations) == 0
+	var checks []healthCheck
+
+	if all || len(backupLocations) > 0 {
+		locations, err := cluster.backupStorageLocations()
+		if err != nil {
+			return nil, err
+		}
+		found := make(map[string]bool)
+		for i := range locations {
+			location := &locations[i]
+			if !isGCPProvider(location.Spec.Provider) || location.Spec.ObjectStorage == nil || !(all || containsString(backupLocations, location.Name)) {
+				continue
+			}
+			found[location.Name] = true
+			checks = append(checks, backupLocationChecks(log, location)...)
+		}
+		for _, name := range backupLocations {
+			if !found[name] {
+				return nil, errors.Errorf("GCP BackupStorageLocation %s not found in namespace %s", name, veleroNamespace())
+			}
+		}
+	}
+
+	if all || len(snapshotLocations) > 0 {
+		locations, err := cluster.volumeSnapshotLocations()
+		if err != nil {
+			return nil, err
+		}
+		found := make(map[string]bool)
+		for i := range locations {
+			location := &locations[i]
+			if !isGCPProvider(location.Spec.Provider) || !(all || containsString(snapshotLocations, location.Name)) {
+				continue
+			}
+			found[location.Name] = true
+			checks = append(checks, snapshotLocationChecks(log, location)...)
+		}
+		for _, name := range snapshotLocations {
+			if !found[name] {
+				return nil, errors.Errorf("GCP VolumeSnapshotLocation %s not found in namespace %s", name, veleroNamespace())
+			}
+		}
+	}
+
+	if len(checks) == 0 {
+		return nil, errors.Errorf("no GCP locations found in namespace %s", veleroNamespace())
+	}
+	return checks, nil
+}
+
+// runHealthCheck checks the credentials, keys and API endpoints of Velero's
+// GCP locations and prints a pass/fail report. It returns the process exit
+// code, so it can be used as a readiness probe.
+func runHealthCheck(args []string, out io.Writer) int {
+	flags := pflag.NewFlagSet(healthCheckCommand, pflag.ContinueOnError)
+	flags.SetOutput(out)
+	var (
+		backupLocations, snapshotLocations []string
+		maxLatency                         time.Duration
+	)
+	flags.StringSliceVar(&backupLocations, "backup-location", nil, "BackupStorageLocations to check; all GCP locations are checked if no location is given")
+	flags.StringSliceVar(&snapshotLocations, "snapshot-location", nil, "VolumeSnapshotLocations to check; all GCP locations are checked if no location is given")
+	flags.DurationVar(&maxLatency, "max-latency", defaultMaxLatency, "fail checks that take longer than this; 0 disables the limit")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	logger := logrus.New()
+	logger.SetOutput(os.Stderr)
+	checks, err := locationHealthChecks(logger, inCluster{}, backupLocations, snapshotLocations)
+	if err != nil {
+		fmt.Fprintln(out, err)
+		return 1
+	}
+	if !writeHealthReport(out, runHealthChecks(context.Background(), checks, maxLatency)) {
+		return 1
+	}
+	return 0
+}
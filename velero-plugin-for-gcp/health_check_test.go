@@ -0,0 +1,162 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	api "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	velerotest "github.com/vmware-tanzu/velero/pkg/test"
+	"golang.org/x/oauth2"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/option"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+type failingTokenSource struct{}
+
+func (failingTokenSource) Token() (*oauth2.Token, error) {
+	return nil, errors.New("invalid_grant")
+}
+
+func TestRunHealthChecks(t *testing.T) {
+	checks := []healthCheck{
+		{location: "BackupStorageLocation/default", name: "storage", target: "gs://bucket", run: func(context.Context) (string, error) {
+			return "", nil
+		}},
+		{location: "BackupStorageLocation/default", name: "kms key", run: func(context.Context) (string, error) {
+			return "", errors.New("permission denied")
+		}},
+		{location: "VolumeSnapshotLocation/default", name: "compute", run: func(context.Context) (string, error) {
+			time.Sleep(20 * time.Millisecond)
+			return "", nil
+		}},
+		{location: "VolumeSnapshotLocation/default", name: "service account key", run: func(ctx context.Context) (string, error) {
+			_, ok := ctx.Deadline()
+			assert.True(t, ok, "checks have a timeout")
+			return "expires soon", nil
+		}},
+	}
+
+	results := runHealthChecks(context.Background(), checks, 10*time.Millisecond)
+	require.Len(t, results, 4)
+	assert.NoError(t, results[0].err)
+	assert.EqualError(t, results[1].err, "permission denied")
+	assert.Contains(t, results[2].err.Error(), "longer than the maximum of 10ms")
+	assert.NoError(t, results[3].err)
+	assert.Equal(t, "expires soon", results[3].note)
+
+	buf := new(bytes.Buffer)
+	assert.False(t, writeHealthReport(buf, results))
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	require.Len(t, lines, 6)
+	assert.Regexp(t, `^BackupStorageLocation/default\s+storage\s+gs://bucket\s+\S+\s+ok$`, lines[1])
+	assert.Regexp(t, `kms key\s+\S+\s+FAILED: permission denied$`, lines[2])
+	assert.Regexp(t, `ok \(expires soon\)$`, lines[4])
+	assert.Equal(t, "FAIL", lines[5])
+
+	// without a maximum latency, slow checks pass
+	buf.Reset()
+	assert.True(t, writeHealthReport(buf, runHealthChecks(context.Background(), checks[2:], 0)))
+	assert.True(t, strings.HasSuffix(buf.String(), "PASS\n"))
+}
+
+func TestCredentialsCheck(t *testing.T) {
+	check := credentialsCheck("VolumeSnapshotLocation/default", locationCredentials{tokenSource: oauth2.StaticTokenSource(&oauth2.Token{AccessToken: "token"})}, nil)
+	_, err := check.run(context.Background())
+	assert.NoError(t, err)
+
+	check = credentialsCheck("VolumeSnapshotLocation/default", locationCredentials{tokenSource: failingTokenSource{}}, nil)
+	_, err = check.run(context.Background())
+	assert.EqualError(t, err, "error getting an access token: invalid_grant")
+
+	check = credentialsCheck("VolumeSnapshotLocation/default", locationCredentials{file: "/credentials/missing"}, nil)
+	assert.Equal(t, "/credentials/missing", check.target)
+	_, err = check.run(context.Background())
+	assert.Contains(t, err.Error(), "error reading provided credentials file /credentials/missing")
+}
+
+func TestServiceAccountKeyCheck(t *testing.T) {
+	_, ok := serviceAccountKeyCheck("BackupStorageLocation/default", locationCredentials{tokenSource: failingTokenSource{}}, getServiceAccountKey)
+	assert.False(t, ok, "only service account keys are checked")
+
+	credentials := locationCredentials{json: []byte(`{"type":"service_account","client_email":"velero@my-project.iam.gserviceaccount.com","private_key_id":"key-1"}`)}
+	check, ok := serviceAccountKeyCheck("BackupStorageLocation/default", credentials, getServiceAccountKey)
+	require.True(t, ok)
+	assert.Equal(t, "velero@my-project.iam.gserviceaccount.com/key-1", check.target)
+
+	tests := []struct {
+		name         string
+		status       keyStatus
+		err          error
+		expectedNote string
+		expectedErr  string
+	}{
+		{name: "valid key"},
+		{name: "key expiring soon", status: keyStatus{validBefore: time.Now().Add(24 * time.Hour)}, expectedNote: "expires at"},
+		{name: "expired key", status: keyStatus{validBefore: time.Now().Add(-time.Hour)}, expectedErr: "the key expired at"},
+		{name: "disabled key", status: keyStatus{disabled: true}, expectedErr: "the key is disabled"},
+		{name: "deleted key", err: &googleapi.Error{Code: http.StatusNotFound, Message: "not found"}, expectedErr: "not found"},
+		{name: "missing permission to check the key", err: &googleapi.Error{Code: http.StatusForbidden}, expectedNote: "not permitted to check its status"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			check, _ := serviceAccountKeyCheck("BackupStorageLocation/default", credentials, func(_ context.Context, name string, _ ...option.ClientOption) (keyStatus, error) {
+				assert.Equal(t, "projects/-/serviceAccounts/velero@my-project.iam.gserviceaccount.com/keys/key-1", name)
+				return test.status, test.err
+			})
+			note, err := check.run(context.Background())
+			assert.Contains(t, note, test.expectedNote)
+			if test.expectedErr == "" {
+				assert.NoError(t, err)
+			} else {
+				require.Error(t, err)
+				assert.Contains(t, err.Error(), test.expectedErr)
+			}
+		})
+	}
+}
+
+func TestLocationHealthChecks(t *testing.T) {
+	cluster := &fakeCluster{
+		storageLocations: []api.BackupStorageLocation{
+			{ObjectMeta: metav1.ObjectMeta{Name: "aws"}, Spec: api.BackupStorageLocationSpec{Provider: "aws", StorageType: api.StorageType{ObjectStorage: &api.ObjectStorageLocation{Bucket: "bucket"}}}},
+		},
+		snapshotLocations: []api.VolumeSnapshotLocation{
+			{ObjectMeta: metav1.ObjectMeta{Name: "default"}, Spec: api.VolumeSnapshotLocationSpec{Provider: "velero.io/gcp", Config: map[string]string{"unknown": "value"}}},
+		},
+	}
+
+	_, err := locationHealthChecks(velerotest.NewLogger(), cluster, []string{"aws"}, nil)
+	assert.EqualError(t, err, "GCP BackupStorageLocation aws not found in namespace velero")
+
+	checks, err := locationHealthChecks(velerotest.NewLogger(), cluster, nil, nil)
+	require.NoError(t, err)
+	require.Len(t, checks, 1)
+	assert.Equal(t, "VolumeSnapshotLocation/default", checks[0].location)
+	assert.Equal(t, "init", checks[0].name)
+	_, err = checks[0].run(context.Background())
+	assert.Error(t, err)
+}
@@ -0,0 +1,114 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"sort"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	api "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	"github.com/vmware-tanzu/velero/pkg/plugin/velero"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+const (
+	ingressConfigActionName = "velero.io/gcp-ingress-config"
+
+	backendConfigAnnotation     = "cloud.google.com/backend-config"
+	betaBackendConfigAnnotation = "beta.cloud.google.com/backend-config"
+	frontendConfigAnnotation    = "networking.gke.io/v1beta1.FrontendConfig"
+)
+
+var (
+	backendConfigsResource  = schema.GroupResource{Group: "cloud.google.com", Resource: "backendconfigs"}
+	frontendConfigsResource = schema.GroupResource{Group: "networking.gke.io", Resource: "frontendconfigs"}
+)
+
+// backendConfigRefs is the value of the backend config annotation of a
+// Service, naming the BackendConfig used for all its ports and for
+// individual ports.
+type backendConfigRefs struct {
+	Default string            `json:"default"`
+	Ports   map[string]string `json:"ports"`
+}
+
+// IngressConfigAction is a backup item action that includes the
+// BackendConfigs and FrontendConfigs GKE ingress settings are stored in
+// along with the Services and Ingresses referring to them, so restored
+// ingresses behave the same.
+type IngressConfigAction struct {
+	log logrus.FieldLogger
+}
+
+func newIngressConfigAction(logger logrus.FieldLogger) (interface{}, error) {
+	return &IngressConfigAction{log: logger}, nil
+}
+
+func (a *IngressConfigAction) AppliesTo() (velero.ResourceSelector, error) {
+	return velero.ResourceSelector{
+		IncludedResources: []string{"services", "ingresses"},
+	}, nil
+}
+
+func (a *IngressConfigAction) Execute(item runtime.Unstructured, backup *api.Backup) (runtime.Unstructured, []velero.ResourceIdentifier, error) {
+	obj := &unstructured.Unstructured{Object: item.UnstructuredContent()}
+	annotations := obj.GetAnnotations()
+
+	var additional []velero.ResourceIdentifier
+	switch obj.GetKind() {
+	case "Service":
+		names := make(map[string]bool)
+		for _, key := range []string{backendConfigAnnotation, betaBackendConfigAnnotation} {
+			value := annotations[key]
+			if value == "" {
+				continue
+			}
+			var refs backendConfigRefs
+			if err := json.Unmarshal([]byte(value), &refs); err != nil {
+				return nil, nil, errors.Wrapf(err, "error parsing %s annotation of service %s/%s", key, obj.GetNamespace(), obj.GetName())
+			}
+			if refs.Default != "" {
+				names[refs.Default] = true
+			}
+			for _, name := range refs.Ports {
+				names[name] = true
+			}
+		}
+
+		sorted := make([]string, 0, len(names))
+		for name := range names {
+			sorted = append(sorted, name)
+		}
+		sort.Strings(sorted)
+		for _, name := range sorted {
+			additional = append(additional, velero.ResourceIdentifier{GroupResource: backendConfigsResource, Namespace: obj.GetNamespace(), Name: name})
+		}
+	case "Ingress":
+		if name := annotations[frontendConfigAnnotation]; name != "" {
+			additional = append(additional, velero.ResourceIdentifier{GroupResource: frontendConfigsResource, Namespace: obj.GetNamespace(), Name: name})
+		}
+	}
+
+	for _, id := range additional {
+		a.log.Infof("Adding %s %s/%s referenced by %s %s/%s", id.Resource, id.Namespace, id.Name, obj.GetKind(), obj.GetNamespace(), obj.GetName())
+	}
+	return item, additional, nil
+}
@@ -0,0 +1,96 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vmware-tanzu/velero/pkg/plugin/velero"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+
+	velerotest "github.com/vmware-tanzu/velero/pkg/test"
+)
+
+func TestIngressConfigActionExecute(t *testing.T) {
+	tests := []struct {
+		name        string
+		kind        string
+		annotations map[string]string
+		expected    []velero.ResourceIdentifier
+		expectedErr bool
+	}{
+		{
+			name: "service with default and per-port backend configs",
+			kind: "Service",
+			annotations: map[string]string{
+				backendConfigAnnotation: `{"default": "shared", "ports": {"80": "http", "443": "shared"}}`,
+			},
+			expected: []velero.ResourceIdentifier{
+				{GroupResource: backendConfigsResource, Namespace: "shop", Name: "http"},
+				{GroupResource: backendConfigsResource, Namespace: "shop", Name: "shared"},
+			},
+		},
+		{
+			name:        "service with beta backend config",
+			kind:        "Service",
+			annotations: map[string]string{betaBackendConfigAnnotation: `{"ports": {"http": "legacy"}}`},
+			expected: []velero.ResourceIdentifier{
+				{GroupResource: backendConfigsResource, Namespace: "shop", Name: "legacy"},
+			},
+		},
+		{
+			name:        "service with malformed backend config",
+			kind:        "Service",
+			annotations: map[string]string{backendConfigAnnotation: `shared`},
+			expectedErr: true,
+		},
+		{
+			name:        "ingress with frontend config",
+			kind:        "Ingress",
+			annotations: map[string]string{frontendConfigAnnotation: "https-redirect"},
+			expected: []velero.ResourceIdentifier{
+				{GroupResource: frontendConfigsResource, Namespace: "shop", Name: "https-redirect"},
+			},
+		},
+		{
+			name: "ingress without frontend config",
+			kind: "Ingress",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			item := &unstructured.Unstructured{}
+			item.SetKind(test.kind)
+			item.SetNamespace("shop")
+			item.SetName("frontend")
+			item.SetAnnotations(test.annotations)
+
+			action := &IngressConfigAction{log: velerotest.NewLogger()}
+			out, additional, err := action.Execute(item, nil)
+			if test.expectedErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, item, out)
+			assert.Equal(t, test.expected, additional)
+		})
+	}
+}
@@ -0,0 +1,380 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/pflag"
+	"google.golang.org/api/iterator"
+)
+
+const (
+	collectInventoryCommand = "collect-inventory"
+
+	// inventoryIntervalConfigKey was the interval at which the plugin
+	// computed a location's inventory. Velero runs a plugin process for
+	// each operation, so the inventory is computed by the collect-inventory
+	// command instead, and the key is only accepted to warn about it.
+	inventoryIntervalConfigKey = "inventoryInterval"
+
+	backupsDir          = "backups/"
+	backupMetadataFile  = "velero-backup.json"
+	scheduleNameLabel   = "velero.io/schedule-name"
+	inventoryCountGauge = "velero_gcp_backup_inventory_count"
+	inventoryBytesGauge = "velero_gcp_backup_inventory_bytes"
+)
+
+// backupInventory is the number and total size of the backups created by a
+// schedule.
+type backupInventory struct {
+	count int
+	bytes int64
+}
+
+type inventoryCollector struct {
+	log    logrus.FieldLogger
+	client *storage.Client
+	bucket string
+	prefix string
+	// encryptionKey is the customer-supplied key backups are encrypted
+	// with, if any.
+	encryptionKey []byte
+	// envelope decrypts backup metadata encrypted client-side.
+	envelope *envelopeEncryption
+	// schedules caches the schedule each backup was created by, since a
+	// backup's metadata doesn't change once it's uploaded. Backups that
+	// aren't listed anymore are forgotten after each pass.
+	schedules map[string]string
+	// costs reports the estimated cost of each backup, if enabled.
+	costs *costReporter
+	// manifests caches the volume manifests whose snapshots are all ready,
+	// which don't change anymore.
+	manifests map[string]*volumeManifest
+}
+
+// newInventoryCollector returns the collector of the count and size of the
+// backups under the location's prefix.
+func (o *ObjectStore) newInventoryCollector(config map[string]string) (*inventoryCollector, error) {
+	prefix := config["prefix"]
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+
+	var costs *costReporter
+	if estimate, _ := strconv.ParseBool(config[estimateCostsConfigKey]); estimate {
+		prices, err := parseStoragePrices(config[storagePricesConfigKey])
+		if err != nil {
+			return nil, err
+		}
+		costs = &costReporter{cluster: o.cluster, prices: prices, reported: make(map[string]string)}
+	}
+
+	location := config["bucket"] + "/" + prefix
+	c := &inventoryCollector{
+		log:           o.log.WithField("location", location),
+		client:        o.clients().readClient,
+		bucket:        config["bucket"],
+		prefix:        prefix,
+		encryptionKey: o.clients().encryptionKey,
+		envelope:      o.envelope,
+		schedules:     make(map[string]string),
+		costs:         costs,
+		manifests:     make(map[string]*volumeManifest),
+	}
+	if costs != nil {
+		costs.log = c.log
+	}
+	return c, nil
+}
+
+// inventoryCollectors returns the collectors of the GCP backup storage
+// locations, or only of the named one.
+func inventoryCollectors(log logrus.FieldLogger, cluster veleroCluster, name string) ([]*inventoryCollector, error) {
+	locations, err := cluster.backupStorageLocations()
+	if err != nil {
+		return nil, err
+	}
+
+	var collectors []*inventoryCollector
+	for i := range locations {
+		location := &locations[i]
+		if name != "" && location.Name != name {
+			continue
+		}
+		if !isGCPProvider(location.Spec.Provider) || location.Spec.ObjectStorage == nil {
+			if name != "" {
+				return nil, errors.Errorf("BackupStorageLocation %s isn't a GCP location", name)
+			}
+			continue
+		}
+
+		config := map[string]string{"bucket": location.Spec.ObjectStorage.Bucket, "prefix": location.Spec.ObjectStorage.Prefix}
+		for k, v := range location.Spec.Config {
+			config[k] = v
+		}
+		o := newObjectStore(log.WithField("backupStorageLocation", location.Name))
+		if err := o.Init(config); err != nil {
+			return nil, errors.Wrapf(err, "error initializing BackupStorageLocation %s", location.Name)
+		}
+		c, err := o.newInventoryCollector(config)
+		if err != nil {
+			return nil, errors.Wrapf(err, "error initializing BackupStorageLocation %s", location.Name)
+		}
+		collectors = append(collectors, c)
+	}
+	if name != "" && len(collectors) == 0 {
+		return nil, errors.Errorf("BackupStorageLocation %s not found in namespace %s", name, veleroNamespace())
+	}
+	return collectors, nil
+}
+
+// runCollectInventory computes the inventory of the backup storage
+// locations once, or every interval when one is given. Velero runs a plugin
+// process for each operation, so the inventory is computed by this command,
+// run as a sidecar or CronJob, rather than by every process listing the
+// bucket again.
+func runCollectInventory(args []string, out io.Writer) int {
+	flags := pflag.NewFlagSet(collectInventoryCommand, pflag.ContinueOnError)
+	flags.SetOutput(out)
+	var (
+		name     string
+		interval time.Duration
+	)
+	flags.StringVar(&name, "location", "", "only compute the inventory of this BackupStorageLocation")
+	flags.DurationVar(&interval, "interval", 0, "compute the inventory again at this interval instead of exiting")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	logger := logrus.New()
+	logger.SetOutput(os.Stderr)
+	startMetricsServer(logger)
+	startCloudMonitoring(logger)
+
+	collectors, err := inventoryCollectors(logger, inCluster{}, name)
+	if err != nil {
+		fmt.Fprintln(out, err)
+		return 1
+	}
+	for {
+		code := 0
+		for _, c := range collectors {
+			if err := c.collect(); err != nil {
+				c.log.WithError(err).Warn("Error computing backup inventory")
+				code = 1
+			}
+		}
+		if pluginMetricsPusher != nil {
+			if err := pluginMetricsPusher.push(context.Background(), pluginMetrics); err != nil {
+				logger.WithError(err).Warn("Error writing metrics to Cloud Monitoring")
+			}
+		}
+		if interval <= 0 {
+			return code
+		}
+		time.Sleep(interval)
+	}
+}
+
+func (c *inventoryCollector) collect() error {
+	ctx := context.Background()
+	backupsPrefix := c.prefix + backupsDir
+
+	sizes := make(map[string]int64)
+	// classes is the size of each backup's objects by storage class, and
+	// manifests the backups with a volume manifest, for their cost
+	classes := make(map[string]map[string]int64)
+	manifests := make(map[string]bool)
+	iter := c.client.Bucket(c.bucket).Objects(ctx, &storage.Query{Prefix: backupsPrefix})
+	for {
+		obj, err := iter.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return errors.WithStack(err)
+		}
+
+		if backup := backupNameFromKey(backupsPrefix, obj.Name); backup != "" {
+			sizes[backup] += obj.Size
+			if classes[backup] == nil {
+				classes[backup] = make(map[string]int64)
+			}
+			classes[backup][obj.StorageClass] += obj.Size
+			if obj.Name == volumeManifestKey(c.prefix, backup) {
+				manifests[backup] = true
+			}
+		}
+	}
+
+	inventory := summarizeBySchedule(sizes, func(backup string) string {
+		return c.scheduleOf(ctx, backupsPrefix, backup)
+	})
+	c.pruneSchedules(sizes)
+
+	match := map[string]string{"bucket": c.bucket, "prefix": c.prefix}
+	pluginMetrics.deleteMatching(inventoryCountGauge, match)
+	pluginMetrics.deleteMatching(inventoryBytesGauge, match)
+	for schedule, inv := range inventory {
+		labels := map[string]string{"bucket": c.bucket, "prefix": c.prefix, "schedule": schedule}
+		pluginMetrics.setGauge(inventoryCountGauge, "Number of backups stored in the location.", labels, float64(inv.count))
+		pluginMetrics.setGauge(inventoryBytesGauge, "Total size in bytes of the backups stored in the location.", labels, float64(inv.bytes))
+	}
+
+	if c.costs != nil {
+		costs := make(map[string]backupCost, len(classes))
+		for backup, objectBytes := range classes {
+			var manifest *volumeManifest
+			if manifests[backup] {
+				manifest = c.volumeManifest(ctx, backup)
+			}
+			costs[backup] = estimateBackupCost(c.costs.prices, objectBytes, manifest)
+		}
+		for backup := range c.manifests {
+			if !manifests[backup] {
+				delete(c.manifests, backup)
+			}
+		}
+		c.costs.report(c.bucket, c.prefix, costs, func(backup string) string {
+			return c.scheduleOf(ctx, backupsPrefix, backup)
+		})
+	}
+
+	return nil
+}
+
+// volumeManifest returns the volume manifest of a backup, or nil if it
+// can't be read.
+func (c *inventoryCollector) volumeManifest(ctx context.Context, backup string) *volumeManifest {
+	if manifest, ok := c.manifests[backup]; ok {
+		return manifest
+	}
+
+	r, err := c.client.Bucket(c.bucket).Object(volumeManifestKey(c.prefix, backup)).Key(c.encryptionKey).NewReader(ctx)
+	if err != nil {
+		return nil
+	}
+	body, err := c.envelope.decryptingReader(r)
+	if err != nil {
+		r.Close()
+		c.log.WithError(err).Warnf("Unable to decrypt volume manifest of backup %s", backup)
+		return nil
+	}
+	defer body.Close()
+
+	manifest := new(volumeManifest)
+	if err := json.NewDecoder(body).Decode(manifest); err != nil {
+		c.log.WithError(err).Warnf("Unable to decode volume manifest of backup %s", backup)
+		return nil
+	}
+	for _, v := range manifest.Volumes {
+		if !v.final() {
+			return manifest
+		}
+	}
+	c.manifests[backup] = manifest
+	return manifest
+}
+
+// pruneSchedules forgets the schedules of the backups that weren't listed,
+// so the cache of a long-running collector doesn't grow with every backup
+// the location ever had.
+func (c *inventoryCollector) pruneSchedules(listed map[string]int64) {
+	for backup := range c.schedules {
+		if _, ok := listed[backup]; !ok {
+			delete(c.schedules, backup)
+		}
+	}
+}
+
+// scheduleOf returns the name of the schedule that created the backup, or
+// an empty string for backups not created by a schedule.
+func (c *inventoryCollector) scheduleOf(ctx context.Context, backupsPrefix, backup string) string {
+	if schedule, ok := c.schedules[backup]; ok {
+		return schedule
+	}
+
+	r, err := c.client.Bucket(c.bucket).Object(backupsPrefix + backup + "/" + backupMetadataFile).Key(c.encryptionKey).NewReader(ctx)
+	if err != nil {
+		// the backup may still be uploading, so don't cache the result
+		return ""
+	}
+	body, err := c.envelope.decryptingReader(r)
+	if err != nil {
+		r.Close()
+		c.log.WithError(err).Warnf("Unable to decrypt metadata of backup %s", backup)
+		return ""
+	}
+	defer body.Close()
+
+	var metadata struct {
+		Metadata struct {
+			Labels map[string]string `json:"labels"`
+		} `json:"metadata"`
+	}
+	if err := json.NewDecoder(body).Decode(&metadata); err != nil {
+		c.log.WithError(err).Warnf("Unable to decode metadata of backup %s", backup)
+		return ""
+	}
+
+	schedule := metadata.Metadata.Labels[scheduleNameLabel]
+	c.schedules[backup] = schedule
+	return schedule
+}
+
+// backupNameFromKey returns the name of the backup an object under the
+// backups directory belongs to.
+func backupNameFromKey(backupsPrefix, key string) string {
+	rest := strings.TrimPrefix(key, backupsPrefix)
+	if rest == key {
+		return ""
+	}
+
+	parts := strings.SplitN(rest, "/", 2)
+	if len(parts) != 2 {
+		return ""
+	}
+	return parts[0]
+}
+
+// summarizeBySchedule groups per-backup sizes by the schedule that created
+// each backup.
+func summarizeBySchedule(sizes map[string]int64, scheduleOf func(backup string) string) map[string]*backupInventory {
+	res := make(map[string]*backupInventory)
+	for backup, size := range sizes {
+		schedule := scheduleOf(backup)
+		inv, ok := res[schedule]
+		if !ok {
+			inv = new(backupInventory)
+			res[schedule] = inv
+		}
+		inv.count++
+		inv.bytes += size
+	}
+	return res
+}
@@ -0,0 +1,87 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	api "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	velerotest "github.com/vmware-tanzu/velero/pkg/test"
+)
+
+func TestBackupNameFromKey(t *testing.T) {
+	tests := []struct {
+		key      string
+		expected string
+	}{
+		{key: "prefix/backups/b1/velero-backup.json", expected: "b1"},
+		{key: "prefix/backups/b1/b1-logs.gz", expected: "b1"},
+		{key: "prefix/backups/b1", expected: ""},
+		{key: "prefix/restores/r1/restore-r1-logs.gz", expected: ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.key, func(t *testing.T) {
+			assert.Equal(t, test.expected, backupNameFromKey("prefix/backups/", test.key))
+		})
+	}
+}
+
+func TestSummarizeBySchedule(t *testing.T) {
+	sizes := map[string]int64{
+		"daily-1":  100,
+		"daily-2":  150,
+		"weekly-1": 1000,
+		"adhoc":    10,
+	}
+	schedules := map[string]string{
+		"daily-1":  "daily",
+		"daily-2":  "daily",
+		"weekly-1": "weekly",
+	}
+
+	res := summarizeBySchedule(sizes, func(backup string) string { return schedules[backup] })
+
+	assert.Equal(t, map[string]*backupInventory{
+		"daily":  {count: 2, bytes: 250},
+		"weekly": {count: 1, bytes: 1000},
+		"":       {count: 1, bytes: 10},
+	}, res)
+}
+
+func TestPruneSchedules(t *testing.T) {
+	c := &inventoryCollector{schedules: map[string]string{"daily-1": "daily", "daily-2": "daily", "adhoc": ""}}
+	c.pruneSchedules(map[string]int64{"daily-2": 150, "weekly-1": 1000})
+	assert.Equal(t, map[string]string{"daily-2": "daily"}, c.schedules)
+}
+
+func TestInventoryCollectors(t *testing.T) {
+	location := api.BackupStorageLocation{Spec: api.BackupStorageLocationSpec{Provider: "aws"}}
+	location.Name = "aws"
+	cluster := &fakeCluster{storageLocations: []api.BackupStorageLocation{location}}
+
+	collectors, err := inventoryCollectors(velerotest.NewLogger(), cluster, "")
+	require.NoError(t, err)
+	assert.Empty(t, collectors)
+
+	_, err = inventoryCollectors(velerotest.NewLogger(), cluster, "aws")
+	assert.EqualError(t, err, "BackupStorageLocation aws isn't a GCP location")
+	_, err = inventoryCollectors(velerotest.NewLogger(), cluster, "default")
+	assert.EqualError(t, err, "BackupStorageLocation default not found in namespace "+veleroNamespace())
+}
@@ -0,0 +1,218 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	stderrors "errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/oauth2"
+	"google.golang.org/api/googleapi"
+	iam "google.golang.org/api/iam/v1"
+	"google.golang.org/api/option"
+)
+
+const (
+	// keyCheckInterval is how often the status of service account keys is
+	// checked after the check on Init.
+	keyCheckInterval = 6 * time.Hour
+
+	// keyExpiryWarningPeriod is how long before a key expires warnings
+	// start being logged.
+	keyExpiryWarningPeriod = 14 * 24 * time.Hour
+
+	keyValidGauge  = "velero_gcp_service_account_key_valid"
+	keyExpiryGauge = "velero_gcp_service_account_key_expiry_timestamp_seconds"
+)
+
+var (
+	// keyChecks records the key being checked for each service account in
+	// this process, since Velero initializes a new plugin for every
+	// operation. A check stops once its key is no longer the current one.
+	keyChecks     = make(map[string]string)
+	keyChecksLock sync.Mutex
+)
+
+// serviceAccountKeyJSON holds the fields of a service account key file that
+// identify the key.
+type serviceAccountKeyJSON struct {
+	Type         string `json:"type"`
+	ClientEmail  string `json:"client_email"`
+	PrivateKeyID string `json:"private_key_id"`
+}
+
+// keyStatus is the state of a service account key according to IAM.
+type keyStatus struct {
+	disabled bool
+	// validBefore is when the key expires, or zero if it doesn't.
+	validBefore time.Time
+}
+
+// keyStatusGetter returns the status of a service account key.
+type keyStatusGetter func(ctx context.Context, name string, opts ...option.ClientOption) (keyStatus, error)
+
+// getServiceAccountKey returns the status of a service account key from IAM.
+func getServiceAccountKey(ctx context.Context, name string, opts ...option.ClientOption) (keyStatus, error) {
+	svc, err := iam.NewService(ctx, opts...)
+	if err != nil {
+		return keyStatus{}, errors.WithStack(err)
+	}
+	key, err := svc.Projects.ServiceAccounts.Keys.Get(name).Context(ctx).Do()
+	if err != nil {
+		return keyStatus{}, errors.Wrapf(err, "error getting service account key %s", name)
+	}
+
+	status := keyStatus{disabled: key.Disabled}
+	if key.ValidBeforeTime != "" {
+		if status.validBefore, err = time.Parse(time.RFC3339, key.ValidBeforeTime); err != nil {
+			return keyStatus{}, errors.Wrapf(err, "error parsing expiry time of service account key %s", name)
+		}
+		// keys that don't expire are valid until the end of year 9999
+		if status.validBefore.Year() == 9999 {
+			status.validBefore = time.Time{}
+		}
+	}
+	return status, nil
+}
+
+type keyChecker struct {
+	log    logrus.FieldLogger
+	email  string
+	keyID  string
+	opts   []option.ClientOption
+	getKey keyStatusGetter
+	now    func() time.Time
+}
+
+// startKeyCheck checks the status of the service account key in credsJSON on
+// Init and periodically afterwards, logging warnings and publishing metrics
+// when the key is invalid, disabled or about to expire, before backups start
+// failing. Credentials other than service account keys are ignored.
+func startKeyCheck(log logrus.FieldLogger, credsJSON []byte, credentials locationCredentials) {
+	var key serviceAccountKeyJSON
+	if err := json.Unmarshal(credsJSON, &key); err != nil || key.Type != serviceAccountCredentials || key.ClientEmail == "" || key.PrivateKeyID == "" {
+		return
+	}
+
+	ctx := context.Background()
+	opts, err := credentials.clientOptions(ctx, iam.CloudPlatformScope)
+	if err != nil {
+		log.WithError(err).Info("Unable to check the status of the service account key")
+		return
+	}
+
+	keyChecksLock.Lock()
+	previous, running := keyChecks[key.ClientEmail]
+	keyChecks[key.ClientEmail] = key.PrivateKeyID
+	keyChecksLock.Unlock()
+	if running && previous == key.PrivateKeyID {
+		return
+	}
+	if running {
+		pluginMetrics.deleteMatching(keyValidGauge, map[string]string{"key_id": previous})
+		pluginMetrics.deleteMatching(keyExpiryGauge, map[string]string{"key_id": previous})
+	}
+
+	c := &keyChecker{
+		log:    log.WithFields(logrus.Fields{"serviceAccount": key.ClientEmail, "keyID": key.PrivateKeyID}),
+		email:  key.ClientEmail,
+		keyID:  key.PrivateKeyID,
+		opts:   opts,
+		getKey: getServiceAccountKey,
+		now:    time.Now,
+	}
+	c.check(ctx)
+	go c.run()
+}
+
+func (c *keyChecker) run() {
+	for {
+		time.Sleep(keyCheckInterval)
+
+		keyChecksLock.Lock()
+		current := keyChecks[c.email] == c.keyID
+		keyChecksLock.Unlock()
+		if !current {
+			return
+		}
+		c.check(context.Background())
+	}
+}
+
+// check looks up the key's status and reports whether it is still usable.
+func (c *keyChecker) check(ctx context.Context) bool {
+	labels := map[string]string{"service_account": c.email, "key_id": c.keyID}
+	setValid := func(valid bool) {
+		value := 0.0
+		if valid {
+			value = 1
+		}
+		pluginMetrics.setGauge(keyValidGauge, "Whether the service account key the plugin uses is valid (1) or not (0).", labels, value)
+	}
+
+	status, err := c.getKey(ctx, "projects/-/serviceAccounts/"+c.email+"/keys/"+c.keyID, c.opts...)
+	if err != nil {
+		var retrieveErr *oauth2.RetrieveError
+		var apiErr *googleapi.Error
+		switch {
+		case stderrors.As(err, &retrieveErr):
+			// the key can't even be used to get a token
+			setValid(false)
+			c.log.WithError(err).Warn("Service account key is no longer valid, backups will fail until the credentials are replaced")
+			return false
+		case stderrors.As(err, &apiErr) && apiErr.Code == http.StatusNotFound:
+			setValid(false)
+			c.log.Warn("Service account key was deleted, backups will fail until the credentials are replaced")
+			return false
+		case stderrors.As(err, &apiErr) && apiErr.Code == http.StatusForbidden:
+			c.log.Debug("Not permitted to check the status of the service account key; grant iam.serviceAccountKeys.get on the service account to enable the check")
+		default:
+			c.log.WithError(err).Info("Unable to check the status of the service account key")
+		}
+		return true
+	}
+
+	if status.disabled {
+		setValid(false)
+		c.log.Warn("Service account key is disabled, backups will fail until it is enabled or the credentials are replaced")
+		return false
+	}
+
+	if status.validBefore.IsZero() {
+		setValid(true)
+		return true
+	}
+	pluginMetrics.setGauge(keyExpiryGauge, "When the service account key the plugin uses expires, in seconds since the epoch.", labels, float64(status.validBefore.Unix()))
+
+	remaining := status.validBefore.Sub(c.now())
+	switch {
+	case remaining <= 0:
+		setValid(false)
+		c.log.WithField("expired", status.validBefore.Format(time.RFC3339)).Warn("Service account key has expired, backups will fail until the credentials are replaced")
+		return false
+	case remaining < keyExpiryWarningPeriod:
+		c.log.WithField("expires", status.validBefore.Format(time.RFC3339)).Warnf("Service account key expires in %s, replace the credentials before then", remaining.Round(time.Hour))
+	}
+	setValid(true)
+	return true
+}
@@ -0,0 +1,109 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/oauth2"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/option"
+
+	velerotest "github.com/vmware-tanzu/velero/pkg/test"
+)
+
+func TestKeyCheckerCheck(t *testing.T) {
+	defer func(registry *metricsRegistry) { pluginMetrics = registry }(pluginMetrics)
+
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name          string
+		status        keyStatus
+		err           error
+		expectedValid bool
+		expectedGauge string
+	}{
+		{
+			name:          "key without expiry",
+			expectedValid: true,
+			expectedGauge: `velero_gcp_service_account_key_valid{key_id="key-1",service_account="velero@my-project.iam.gserviceaccount.com"} 1`,
+		},
+		{
+			name:          "key expiring soon is still valid",
+			status:        keyStatus{validBefore: now.Add(24 * time.Hour)},
+			expectedValid: true,
+			expectedGauge: `velero_gcp_service_account_key_expiry_timestamp_seconds{key_id="key-1",service_account="velero@my-project.iam.gserviceaccount.com"} 1.767312e+09`,
+		},
+		{
+			name:          "expired key",
+			status:        keyStatus{validBefore: now.Add(-time.Hour)},
+			expectedGauge: `velero_gcp_service_account_key_valid{key_id="key-1",service_account="velero@my-project.iam.gserviceaccount.com"} 0`,
+		},
+		{
+			name:          "disabled key",
+			status:        keyStatus{disabled: true},
+			expectedGauge: `velero_gcp_service_account_key_valid{key_id="key-1",service_account="velero@my-project.iam.gserviceaccount.com"} 0`,
+		},
+		{
+			name:          "deleted key",
+			err:           errors.Wrap(&googleapi.Error{Code: http.StatusNotFound}, "error getting service account key"),
+			expectedGauge: `velero_gcp_service_account_key_valid{key_id="key-1",service_account="velero@my-project.iam.gserviceaccount.com"} 0`,
+		},
+		{
+			name:          "key that can't get tokens",
+			err:           errors.Wrap(&oauth2.RetrieveError{Body: []byte("invalid_grant")}, "authentication with Google Cloud failed"),
+			expectedGauge: `velero_gcp_service_account_key_valid{key_id="key-1",service_account="velero@my-project.iam.gserviceaccount.com"} 0`,
+		},
+		{
+			name:          "missing permission to check the key",
+			err:           &googleapi.Error{Code: http.StatusForbidden},
+			expectedValid: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			pluginMetrics = newMetricsRegistry()
+			c := &keyChecker{
+				log:   velerotest.NewLogger(),
+				email: "velero@my-project.iam.gserviceaccount.com",
+				keyID: "key-1",
+				getKey: func(_ context.Context, name string, _ ...option.ClientOption) (keyStatus, error) {
+					assert.Equal(t, "projects/-/serviceAccounts/velero@my-project.iam.gserviceaccount.com/keys/key-1", name)
+					return test.status, test.err
+				},
+				now: func() time.Time { return now },
+			}
+			assert.Equal(t, test.expectedValid, c.check(context.Background()))
+
+			buf := new(bytes.Buffer)
+			pluginMetrics.write(buf)
+			if test.expectedGauge == "" {
+				assert.Empty(t, buf.String())
+			} else {
+				assert.Contains(t, buf.String(), test.expectedGauge)
+			}
+		})
+	}
+}
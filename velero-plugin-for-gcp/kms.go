@@ -0,0 +1,112 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/pkg/errors"
+	"google.golang.org/api/cloudkms/v1"
+	"google.golang.org/api/googleapi"
+)
+
+const (
+	// kmsKeyVersionTag is the snapshot tag recording the Cloud KMS key version
+	// that encrypted the snapshotted disk.
+	kmsKeyVersionTag = "velero.io/kms-key-version"
+
+	cryptoKeyVersionsSegment = "/cryptoKeyVersions/"
+)
+
+func newKMSService(ctx context.Context, creds locationCredentials) (*cloudkms.Service, error) {
+	clientOptions, err := creds.clientOptions(ctx, cloudkms.CloudPlatformScope)
+	if err != nil {
+		return nil, err
+	}
+	return cloudkms.NewService(ctx, clientOptions...)
+}
+
+// kmsKeyUnusableError reports a Cloud KMS key version that definitely can't
+// decrypt data: it is disabled, scheduled for destruction or destroyed.
+type kmsKeyUnusableError struct {
+	msg string
+}
+
+func (e *kmsKeyUnusableError) Error() string {
+	return e.msg
+}
+
+// isKMSKeyUnusable reports whether an error returned by verifyKMSKey means
+// the key version definitely can't be used, rather than that it couldn't be
+// read. The plugin's service account often can't read keys the Compute
+// Engine service agent can use, so only the former should fail a restore.
+func isKMSKeyUnusable(err error) bool {
+	_, ok := errors.Cause(err).(*kmsKeyUnusableError)
+	return ok
+}
+
+// verifyKMSKey checks that the Cloud KMS key, or key version, with the given
+// resource name can still be used, and returns an error explaining how to fix
+// it otherwise. Names without a version are checked against the key's primary
+// version. Errors for key versions that are definitely unusable satisfy
+// isKMSKeyUnusable.
+func verifyKMSKey(kms *cloudkms.Service, name string) error {
+	var version *cloudkms.CryptoKeyVersion
+	var err error
+
+	if strings.Contains(name, cryptoKeyVersionsSegment) {
+		version, err = kms.Projects.Locations.KeyRings.CryptoKeys.CryptoKeyVersions.Get(name).Do()
+	} else {
+		var key *cloudkms.CryptoKey
+		key, err = kms.Projects.Locations.KeyRings.CryptoKeys.Get(name).Do()
+		if key != nil {
+			version = key.Primary
+		}
+	}
+
+	if gcpErr, ok := err.(*googleapi.Error); ok {
+		switch gcpErr.Code {
+		case http.StatusNotFound:
+			return errors.Errorf("Cloud KMS key %s no longer exists; it must be restored or re-imported before this data can be decrypted", name)
+		case http.StatusForbidden:
+			return errors.Errorf("permission denied reading Cloud KMS key %s; grant the Velero service account roles/cloudkms.viewer and roles/cloudkms.cryptoKeyEncrypterDecrypter on the key", name)
+		}
+	}
+	if err != nil {
+		return errors.Wrapf(err, "error getting Cloud KMS key %s", name)
+	}
+
+	if version == nil {
+		return errors.Errorf("Cloud KMS key %s has no primary version; it may have been rotated to a version that was later destroyed", name)
+	}
+
+	switch version.State {
+	case "ENABLED":
+		return nil
+	case "DISABLED":
+		return errors.WithStack(&kmsKeyUnusableError{fmt.Sprintf("Cloud KMS key version %s is disabled; re-enable it with `gcloud kms keys versions enable` before restoring", version.Name)})
+	case "DESTROY_SCHEDULED":
+		return errors.WithStack(&kmsKeyUnusableError{fmt.Sprintf("Cloud KMS key version %s is scheduled for destruction; cancel it with `gcloud kms keys versions restore` and re-enable it before restoring", version.Name)})
+	case "DESTROYED":
+		return errors.WithStack(&kmsKeyUnusableError{fmt.Sprintf("Cloud KMS key version %s has been destroyed; data encrypted with it can no longer be decrypted", version.Name)})
+	default:
+		return errors.Errorf("Cloud KMS key version %s is in state %s and cannot be used", version.Name, version.State)
+	}
+}
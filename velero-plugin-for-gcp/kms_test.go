@@ -0,0 +1,167 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	velerotest "github.com/vmware-tanzu/velero/pkg/test"
+	"google.golang.org/api/cloudkms/v1"
+	"google.golang.org/api/compute/v1"
+	"google.golang.org/api/option"
+)
+
+const testKeyName = "projects/p/locations/l/keyRings/r/cryptoKeys/k"
+
+func newFakeKMSService(t *testing.T, handler http.HandlerFunc) *cloudkms.Service {
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+
+	kms, err := cloudkms.NewService(context.Background(), option.WithEndpoint(server.URL), option.WithoutAuthentication())
+	require.NoError(t, err)
+	return kms
+}
+
+func TestVerifyKMSKey(t *testing.T) {
+	tests := []struct {
+		name        string
+		keyName     string
+		status      int
+		response    interface{}
+		expectedErr string
+		unusable    bool
+	}{
+		{
+			name:     "enabled key version",
+			keyName:  testKeyName + "/cryptoKeyVersions/1",
+			status:   http.StatusOK,
+			response: &cloudkms.CryptoKeyVersion{Name: testKeyName + "/cryptoKeyVersions/1", State: "ENABLED"},
+		},
+		{
+			name:     "key without version uses the primary version",
+			keyName:  testKeyName,
+			status:   http.StatusOK,
+			response: &cloudkms.CryptoKey{Name: testKeyName, Primary: &cloudkms.CryptoKeyVersion{Name: testKeyName + "/cryptoKeyVersions/3", State: "ENABLED"}},
+		},
+		{
+			name:        "disabled key version",
+			keyName:     testKeyName + "/cryptoKeyVersions/1",
+			status:      http.StatusOK,
+			response:    &cloudkms.CryptoKeyVersion{Name: testKeyName + "/cryptoKeyVersions/1", State: "DISABLED"},
+			expectedErr: "is disabled",
+			unusable:    true,
+		},
+		{
+			name:        "destroyed key version",
+			keyName:     testKeyName + "/cryptoKeyVersions/1",
+			status:      http.StatusOK,
+			response:    &cloudkms.CryptoKeyVersion{Name: testKeyName + "/cryptoKeyVersions/1", State: "DESTROYED"},
+			expectedErr: "has been destroyed",
+			unusable:    true,
+		},
+		{
+			name:        "key without primary version",
+			keyName:     testKeyName,
+			status:      http.StatusOK,
+			response:    &cloudkms.CryptoKey{Name: testKeyName},
+			expectedErr: "has no primary version",
+		},
+		{
+			name:        "missing key",
+			keyName:     testKeyName,
+			status:      http.StatusNotFound,
+			expectedErr: "no longer exists",
+		},
+		{
+			name:        "permission denied",
+			keyName:     testKeyName,
+			status:      http.StatusForbidden,
+			expectedErr: "roles/cloudkms.viewer",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			kms := newFakeKMSService(t, func(w http.ResponseWriter, r *http.Request) {
+				assert.True(t, strings.HasSuffix(r.URL.Path, test.keyName))
+				w.WriteHeader(test.status)
+				if test.response != nil {
+					json.NewEncoder(w).Encode(test.response)
+				}
+			})
+
+			err := verifyKMSKey(kms, test.keyName)
+			if test.expectedErr != "" {
+				require.Error(t, err)
+				assert.Contains(t, err.Error(), test.expectedErr)
+				assert.Equal(t, test.unusable, isKMSKeyUnusable(err))
+				return
+			}
+			assert.NoError(t, err)
+		})
+	}
+}
+
+func TestVerifySnapshotKMSKey(t *testing.T) {
+	state := "DISABLED"
+	status := http.StatusOK
+	kms := newFakeKMSService(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(&cloudkms.CryptoKeyVersion{Name: testKeyName + "/cryptoKeyVersions/1", State: state})
+	})
+	b := &VolumeSnapshotter{log: velerotest.NewLogger(), kms: kms}
+	snapshot := &compute.Snapshot{Name: "snap-1", SnapshotEncryptionKey: &compute.CustomerEncryptionKey{KmsKeyName: testKeyName + "/cryptoKeyVersions/1"}}
+
+	err := b.verifySnapshotKMSKey(snapshot)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "unable to restore from snapshot snap-1")
+
+	// keys the plugin can't read may still be usable by the Compute Engine
+	// service agent
+	status = http.StatusForbidden
+	assert.NoError(t, b.verifySnapshotKMSKey(snapshot))
+	status = http.StatusNotFound
+	assert.NoError(t, b.verifySnapshotKMSKey(snapshot))
+
+	status = http.StatusOK
+	state = "PENDING_GENERATION"
+	assert.NoError(t, b.verifySnapshotKMSKey(snapshot))
+	state = "ENABLED"
+	assert.NoError(t, b.verifySnapshotKMSKey(snapshot))
+}
+
+func TestWithKMSKeyVersionTag(t *testing.T) {
+	tags := map[string]string{"velero.io/backup": "b1"}
+
+	assert.Equal(t, tags, withKMSKeyVersionTag(tags, &compute.Disk{}))
+
+	res := withKMSKeyVersionTag(tags, &compute.Disk{
+		DiskEncryptionKey: &compute.CustomerEncryptionKey{KmsKeyName: testKeyName + "/cryptoKeyVersions/2"},
+	})
+	assert.Equal(t, map[string]string{
+		"velero.io/backup": "b1",
+		kmsKeyVersionTag:   testKeyName + "/cryptoKeyVersions/2",
+	}, res)
+	assert.Len(t, tags, 1, "input tags must not be modified")
+}
@@ -0,0 +1,356 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/pkg/errors"
+	api "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	veleroclient "github.com/vmware-tanzu/velero/pkg/generated/clientset/versioned"
+	"github.com/vmware-tanzu/velero/pkg/plugin/framework"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+// kubeRequestTimeout bounds each request to the Kubernetes API server.
+const kubeRequestTimeout = 30 * time.Second
+
+// kubeClient is the client of the Kubernetes API server the plugin runs in,
+// authenticated as the Velero pod's service account. All of the plugin's
+// Kubernetes API calls go through its methods.
+type kubeClient struct {
+	kube    kubernetes.Interface
+	velero  veleroclient.Interface
+	dynamic dynamic.Interface
+}
+
+// veleroCluster is the cluster Velero runs in, which the plugin reads its
+// configuration and Velero's resources from. inCluster reads them with the
+// in-cluster client; tests use fakes.
+type veleroCluster interface {
+	// name returns the resource name of the cluster.
+	name() (string, error)
+	// pluginConfig returns the data of the ConfigMap configuring an item
+	// action, or nil if there is none.
+	pluginConfig(kind framework.PluginKind, name string) (map[string]string, error)
+	// eventSink returns the client Kubernetes Events are created with.
+	eventSink() (eventSink, error)
+
+	backups() ([]api.Backup, error)
+	// annotateBackup sets an annotation of a Backup.
+	annotateBackup(backup, key, value string) error
+	backupStorageLocations() ([]api.BackupStorageLocation, error)
+	// backupStorageLocation returns the BackupStorageLocation of a backup.
+	backupStorageLocation(backup string) (*api.BackupStorageLocation, error)
+	volumeSnapshotLocations() ([]api.VolumeSnapshotLocation, error)
+
+	persistentVolumes() ([]v1.PersistentVolume, error)
+	// volumeClaim returns the namespace and name of the claim a persistent
+	// volume is bound to.
+	volumeClaim(volume string) (string, error)
+	// namespaceVolumes returns the pods and persistent volume claims in a
+	// namespace.
+	namespaceVolumes(namespace string) ([]v1.Pod, []v1.PersistentVolumeClaim, error)
+	// nodeZones returns the zones of the cluster's nodes.
+	nodeZones() ([]string, error)
+	// gatewayPolicies returns the Gateway policies in a namespace.
+	gatewayPolicies(namespace string) ([]unstructured.Unstructured, error)
+	// backupForGKEProtections returns the Backup for GKE protections.
+	backupForGKEProtections() (*backupForGKEProtections, error)
+}
+
+// inCluster is the cluster the plugin runs in. Each read creates an
+// in-cluster client, since most plugin processes only read once.
+type inCluster struct{}
+
+func newInClusterClient() (*kubeClient, error) {
+	config, err := rest.InClusterConfig()
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to reach the Kubernetes API server")
+	}
+	config.Timeout = kubeRequestTimeout
+
+	kube, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	velero, err := veleroclient.NewForConfig(config)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	dyn, err := dynamic.NewForConfig(config)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return &kubeClient{kube: kube, velero: velero, dynamic: dyn}, nil
+}
+
+// kubeError describes the error of a request about a resource, with the
+// access the Velero service account needs if it was denied.
+func kubeError(err error, action, resource, access string) error {
+	switch {
+	case apierrors.IsNotFound(err):
+		return errors.Errorf("%s not found", resource)
+	case apierrors.IsForbidden(err):
+		return errors.Errorf("permission denied %s %s; the Velero service account needs %s", action, resource, access)
+	default:
+		return errors.Wrapf(err, "error %s %s", action, resource)
+	}
+}
+
+// secretValue returns the value of a key in a Secret.
+func (c *kubeClient) secretValue(namespace, name, key string) ([]byte, error) {
+	secret, err := c.kube.CoreV1().Secrets(namespace).Get(context.Background(), name, metav1.GetOptions{})
+	if err != nil {
+		return nil, kubeError(err, "getting", fmt.Sprintf("secret %s/%s", namespace, name), "get access to secrets in namespace "+namespace)
+	}
+	value, ok := secret.Data[key]
+	if !ok {
+		return nil, errors.Errorf("secret %s/%s has no key %s", namespace, name, key)
+	}
+	return value, nil
+}
+
+// pluginConfig returns the data of the ConfigMap configuring an item action,
+// or nil if there is none.
+func (c *kubeClient) pluginConfig(namespace string, kind framework.PluginKind, name string) (map[string]string, error) {
+	selector := fmt.Sprintf("velero.io/plugin-config,%s=%s", name, kind)
+	configMaps, err := c.listConfigMaps(namespace, selector)
+	if err != nil {
+		return nil, err
+	}
+
+	switch len(configMaps) {
+	case 0:
+		return nil, nil
+	case 1:
+		return configMaps[0].Data, nil
+	default:
+		var names []string
+		for _, item := range configMaps {
+			names = append(names, item.Name)
+		}
+		return nil, errors.Errorf("found more than one ConfigMap matching label selector %q: %v", selector, names)
+	}
+}
+
+// listConfigMaps lists the ConfigMaps in a namespace matching a label
+// selector.
+func (c *kubeClient) listConfigMaps(namespace, selector string) ([]v1.ConfigMap, error) {
+	list, err := c.kube.CoreV1().ConfigMaps(namespace).List(context.Background(), metav1.ListOptions{LabelSelector: selector})
+	if err != nil {
+		return nil, kubeError(err, "listing", fmt.Sprintf("ConfigMaps matching %q", selector), "list access to configmaps in namespace "+namespace)
+	}
+	return list.Items, nil
+}
+
+// getConfigMap returns a ConfigMap.
+func (c *kubeClient) getConfigMap(namespace, name string) (*v1.ConfigMap, error) {
+	configMap, err := c.kube.CoreV1().ConfigMaps(namespace).Get(context.Background(), name, metav1.GetOptions{})
+	if err != nil {
+		return nil, kubeError(err, "getting", "ConfigMap "+name, "get access to configmaps in namespace "+namespace)
+	}
+	return configMap, nil
+}
+
+// createConfigMap creates a ConfigMap in its namespace. Creating one that
+// already exists succeeds.
+func (c *kubeClient) createConfigMap(configMap *v1.ConfigMap) error {
+	_, err := c.kube.CoreV1().ConfigMaps(configMap.Namespace).Create(context.Background(), configMap, metav1.CreateOptions{})
+	if err != nil && !apierrors.IsAlreadyExists(err) {
+		return kubeError(err, "creating", "ConfigMap "+configMap.Name, "create access to configmaps in namespace "+configMap.Namespace)
+	}
+	return nil
+}
+
+// patchConfigMap sets keys of the data of a ConfigMap.
+func (c *kubeClient) patchConfigMap(namespace, name string, data map[string]string) error {
+	patch, err := json.Marshal(map[string]interface{}{"data": data})
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if _, err := c.kube.CoreV1().ConfigMaps(namespace).Patch(context.Background(), name, types.MergePatchType, patch, metav1.PatchOptions{}); err != nil {
+		return kubeError(err, "patching", "ConfigMap "+name, "patch access to configmaps in namespace "+namespace)
+	}
+	return nil
+}
+
+// deleteConfigMap deletes a ConfigMap. Deleting one that doesn't exist
+// succeeds.
+func (c *kubeClient) deleteConfigMap(namespace, name string) error {
+	err := c.kube.CoreV1().ConfigMaps(namespace).Delete(context.Background(), name, metav1.DeleteOptions{})
+	if err != nil && !apierrors.IsNotFound(err) {
+		return kubeError(err, "deleting", "ConfigMap "+name, "delete access to configmaps in namespace "+namespace)
+	}
+	return nil
+}
+
+// createEvent creates an event in its namespace.
+func (c *kubeClient) createEvent(event *v1.Event) error {
+	if _, err := c.kube.CoreV1().Events(event.Namespace).Create(context.Background(), event, metav1.CreateOptions{}); err != nil {
+		return kubeError(err, "creating", "event "+event.Name, "create access to events in namespace "+event.Namespace)
+	}
+	return nil
+}
+
+// getPersistentVolume returns a persistent volume.
+func (c *kubeClient) getPersistentVolume(name string) (*v1.PersistentVolume, error) {
+	pv, err := c.kube.CoreV1().PersistentVolumes().Get(context.Background(), name, metav1.GetOptions{})
+	if err != nil {
+		return nil, kubeError(err, "getting", "persistent volume "+name, "get access to persistentvolumes")
+	}
+	return pv, nil
+}
+
+// listPersistentVolumes lists the cluster's persistent volumes.
+func (c *kubeClient) listPersistentVolumes() ([]v1.PersistentVolume, error) {
+	list, err := c.kube.CoreV1().PersistentVolumes().List(context.Background(), metav1.ListOptions{})
+	if err != nil {
+		return nil, kubeError(err, "listing", "persistent volumes", "list access to persistentvolumes")
+	}
+	return list.Items, nil
+}
+
+// listNodes lists the cluster's nodes.
+func (c *kubeClient) listNodes() ([]v1.Node, error) {
+	list, err := c.kube.CoreV1().Nodes().List(context.Background(), metav1.ListOptions{})
+	if err != nil {
+		return nil, kubeError(err, "listing", "nodes", "list access to nodes")
+	}
+	return list.Items, nil
+}
+
+// listPods lists the pods in a namespace.
+func (c *kubeClient) listPods(namespace string) ([]v1.Pod, error) {
+	list, err := c.kube.CoreV1().Pods(namespace).List(context.Background(), metav1.ListOptions{})
+	if err != nil {
+		return nil, kubeError(err, "listing", "pods", "list access to pods in namespace "+namespace)
+	}
+	return list.Items, nil
+}
+
+// listPersistentVolumeClaims lists the persistent volume claims in a
+// namespace.
+func (c *kubeClient) listPersistentVolumeClaims(namespace string) ([]v1.PersistentVolumeClaim, error) {
+	list, err := c.kube.CoreV1().PersistentVolumeClaims(namespace).List(context.Background(), metav1.ListOptions{})
+	if err != nil {
+		return nil, kubeError(err, "listing", "persistent volume claims", "list access to persistentvolumeclaims in namespace "+namespace)
+	}
+	return list.Items, nil
+}
+
+// getBackup returns a Velero backup.
+func (c *kubeClient) getBackup(namespace, name string) (*api.Backup, error) {
+	backup, err := c.velero.VeleroV1().Backups(namespace).Get(context.Background(), name, metav1.GetOptions{})
+	if err != nil {
+		return nil, kubeError(err, "getting", "backup "+name, "get access to backups in namespace "+namespace)
+	}
+	return backup, nil
+}
+
+// listBackups lists the Velero backups in a namespace.
+func (c *kubeClient) listBackups(namespace string) ([]api.Backup, error) {
+	list, err := c.velero.VeleroV1().Backups(namespace).List(context.Background(), metav1.ListOptions{})
+	if err != nil {
+		return nil, kubeError(err, "listing", "backups", "list access to backups in namespace "+namespace)
+	}
+	return list.Items, nil
+}
+
+// annotateBackup sets an annotation of a Velero backup.
+func (c *kubeClient) annotateBackup(namespace, name, key, value string) error {
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{"annotations": map[string]string{key: value}},
+	})
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if _, err := c.velero.VeleroV1().Backups(namespace).Patch(context.Background(), name, types.MergePatchType, patch, metav1.PatchOptions{}); err != nil {
+		return kubeError(err, "patching", "backup "+name, "patch access to backups in namespace "+namespace)
+	}
+	return nil
+}
+
+// getBackupStorageLocation returns a BackupStorageLocation.
+func (c *kubeClient) getBackupStorageLocation(namespace, name string) (*api.BackupStorageLocation, error) {
+	location, err := c.velero.VeleroV1().BackupStorageLocations(namespace).Get(context.Background(), name, metav1.GetOptions{})
+	if err != nil {
+		return nil, kubeError(err, "getting", "backup storage location "+name, "get access to backupstoragelocations in namespace "+namespace)
+	}
+	return location, nil
+}
+
+// listBackupStorageLocations lists the BackupStorageLocations in a
+// namespace.
+func (c *kubeClient) listBackupStorageLocations(namespace string) ([]api.BackupStorageLocation, error) {
+	list, err := c.velero.VeleroV1().BackupStorageLocations(namespace).List(context.Background(), metav1.ListOptions{})
+	if err != nil {
+		return nil, kubeError(err, "listing", "backup storage locations", "list access to backupstoragelocations in namespace "+namespace)
+	}
+	return list.Items, nil
+}
+
+// listVolumeSnapshotLocations lists the VolumeSnapshotLocations in a
+// namespace.
+func (c *kubeClient) listVolumeSnapshotLocations(namespace string) ([]api.VolumeSnapshotLocation, error) {
+	list, err := c.velero.VeleroV1().VolumeSnapshotLocations(namespace).List(context.Background(), metav1.ListOptions{})
+	if err != nil {
+		return nil, kubeError(err, "listing", "VolumeSnapshotLocations", "list access to volumesnapshotlocations in namespace "+namespace)
+	}
+	return list.Items, nil
+}
+
+// listResources lists the resources of a kind the plugin has no typed client
+// for in a namespace, or in all namespaces if namespace is empty. Resources
+// whose API isn't served, e.g. because their CRD isn't installed, are an
+// empty list.
+func (c *kubeClient) listResources(resource schema.GroupVersionResource, namespace string) ([]unstructured.Unstructured, error) {
+	list, err := c.dynamic.Resource(resource).Namespace(namespace).List(context.Background(), metav1.ListOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, kubeError(err, "listing", resource.GroupResource().String(), "list access to them")
+	}
+	return list.Items, nil
+}
+
+// preferredVersion returns the preferred version of an API group, or an
+// empty string if the API server doesn't serve the group.
+func (c *kubeClient) preferredVersion(group string) (string, error) {
+	groups, err := c.kube.Discovery().ServerGroups()
+	if err != nil {
+		return "", errors.Wrap(err, "error listing API groups")
+	}
+	for _, g := range groups.Groups {
+		if g.Name == group {
+			return g.PreferredVersion.Version, nil
+		}
+	}
+	return "", nil
+}
@@ -0,0 +1,300 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	api "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	velerofake "github.com/vmware-tanzu/velero/pkg/generated/clientset/versioned/fake"
+	"github.com/vmware-tanzu/velero/pkg/plugin/framework"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	fakediscovery "k8s.io/client-go/discovery/fake"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+// fakeCluster is a veleroCluster holding its resources in memory. Reads of
+// resources it doesn't hold return nothing, and err fails every read.
+type fakeCluster struct {
+	clusterName string
+	// configs are the ConfigMaps of the item actions, by action name.
+	configs map[string]map[string]string
+	// configReads counts the reads of the ConfigMaps.
+	configReads       int
+	sink              eventSink
+	backupList        []api.Backup
+	storageLocations  []api.BackupStorageLocation
+	snapshotLocations []api.VolumeSnapshotLocation
+	// location is the BackupStorageLocation of every backup.
+	location *api.BackupStorageLocation
+	volumes  []v1.PersistentVolume
+	// claims are the claims of the persistent volumes, by volume.
+	claims       map[string]string
+	pods         []v1.Pod
+	volumeClaims []v1.PersistentVolumeClaim
+	zones        []string
+	// policies are the Gateway policies, by namespace.
+	policies    map[string][]unstructured.Unstructured
+	protections *backupForGKEProtections
+	// annotations are the annotations set on the backups, by backup and
+	// key.
+	annotations map[string]map[string]string
+	err         error
+}
+
+func (c *fakeCluster) name() (string, error) {
+	if c.err == nil && c.clusterName == "" {
+		return "", errors.New("not running in GKE")
+	}
+	return c.clusterName, c.err
+}
+
+func (c *fakeCluster) pluginConfig(_ framework.PluginKind, name string) (map[string]string, error) {
+	c.configReads++
+	return c.configs[name], c.err
+}
+
+func (c *fakeCluster) eventSink() (eventSink, error) {
+	if c.err == nil && c.sink == nil {
+		return nil, errors.New("not running in a cluster")
+	}
+	return c.sink, c.err
+}
+
+func (c *fakeCluster) backups() ([]api.Backup, error) {
+	return c.backupList, c.err
+}
+
+func (c *fakeCluster) annotateBackup(backup, key, value string) error {
+	if c.err != nil {
+		return c.err
+	}
+	if c.annotations == nil {
+		c.annotations = make(map[string]map[string]string)
+	}
+	if c.annotations[backup] == nil {
+		c.annotations[backup] = make(map[string]string)
+	}
+	c.annotations[backup][key] = value
+	return nil
+}
+
+func (c *fakeCluster) backupStorageLocations() ([]api.BackupStorageLocation, error) {
+	return c.storageLocations, c.err
+}
+
+func (c *fakeCluster) backupStorageLocation(backup string) (*api.BackupStorageLocation, error) {
+	if c.err == nil && c.location == nil {
+		return nil, errors.Errorf("backup %s not found", backup)
+	}
+	return c.location, c.err
+}
+
+func (c *fakeCluster) volumeSnapshotLocations() ([]api.VolumeSnapshotLocation, error) {
+	return c.snapshotLocations, c.err
+}
+
+func (c *fakeCluster) persistentVolumes() ([]v1.PersistentVolume, error) {
+	return c.volumes, c.err
+}
+
+func (c *fakeCluster) volumeClaim(volume string) (string, error) {
+	return c.claims[volume], c.err
+}
+
+func (c *fakeCluster) namespaceVolumes(namespace string) ([]v1.Pod, []v1.PersistentVolumeClaim, error) {
+	var pods []v1.Pod
+	for _, pod := range c.pods {
+		if pod.Namespace == namespace {
+			pods = append(pods, pod)
+		}
+	}
+	var claims []v1.PersistentVolumeClaim
+	for _, claim := range c.volumeClaims {
+		if claim.Namespace == namespace {
+			claims = append(claims, claim)
+		}
+	}
+	return pods, claims, c.err
+}
+
+func (c *fakeCluster) nodeZones() ([]string, error) {
+	return c.zones, c.err
+}
+
+func (c *fakeCluster) gatewayPolicies(namespace string) ([]unstructured.Unstructured, error) {
+	return c.policies[namespace], c.err
+}
+
+func (c *fakeCluster) backupForGKEProtections() (*backupForGKEProtections, error) {
+	if c.err == nil && c.protections == nil {
+		return &backupForGKEProtections{}, nil
+	}
+	return c.protections, c.err
+}
+
+// newFakeKubeClient returns a client of an in-memory API server holding the
+// objects, which denies every request in the locked namespace.
+func newFakeKubeClient(objects ...runtime.Object) *kubeClient {
+	kube := fake.NewSimpleClientset(objects...)
+	kube.PrependReactor("*", "*", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if action.GetNamespace() != "locked" {
+			return false, nil, nil
+		}
+		return true, nil, apierrors.NewForbidden(action.GetResource().GroupResource(), "", nil)
+	})
+	return &kubeClient{kube: kube, velero: velerofake.NewSimpleClientset()}
+}
+
+func TestSecretValue(t *testing.T) {
+	client := newFakeKubeClient(&v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "velero", Name: "gcp-credentials"},
+		Data:       map[string][]byte{"cloud": []byte("{}")},
+	})
+
+	value, err := client.secretValue("velero", "gcp-credentials", "cloud")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("{}"), value)
+
+	_, err = client.secretValue("velero", "gcp-credentials", "missing")
+	assert.EqualError(t, err, "secret velero/gcp-credentials has no key missing")
+
+	_, err = client.secretValue("velero", "missing", "cloud")
+	assert.EqualError(t, err, "secret velero/missing not found")
+
+	_, err = client.secretValue("locked", "gcp-credentials", "cloud")
+	assert.EqualError(t, err, "permission denied getting secret locked/gcp-credentials; the Velero service account needs get access to secrets in namespace locked")
+}
+
+func TestPluginConfig(t *testing.T) {
+	pluginConfig := func(name string, labels map[string]string, data map[string]string) *v1.ConfigMap {
+		return &v1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Namespace: "velero", Name: name, Labels: labels}, Data: data}
+	}
+	client := newFakeKubeClient(
+		pluginConfig("gcp-workload-identity", map[string]string{"velero.io/plugin-config": "", "velero.io/gcp-workload-identity": "RestoreItemAction"}, map[string]string{"projects": "old: new"}),
+		pluginConfig("a", map[string]string{"velero.io/plugin-config": "", "velero.io/duplicate": "RestoreItemAction"}, nil),
+		pluginConfig("b", map[string]string{"velero.io/plugin-config": "", "velero.io/duplicate": "RestoreItemAction"}, nil),
+	)
+
+	data, err := client.pluginConfig("velero", framework.PluginKindRestoreItemAction, "velero.io/gcp-workload-identity")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"projects": "old: new"}, data)
+
+	data, err = client.pluginConfig("velero", framework.PluginKindRestoreItemAction, "velero.io/unconfigured")
+	require.NoError(t, err)
+	assert.Nil(t, data)
+
+	_, err = client.pluginConfig("velero", framework.PluginKindRestoreItemAction, "velero.io/duplicate")
+	assert.Error(t, err)
+
+	_, err = client.pluginConfig("locked", framework.PluginKindRestoreItemAction, "velero.io/gcp-workload-identity")
+	assert.Contains(t, err.Error(), "permission denied")
+}
+
+func TestKubeClientConfigMaps(t *testing.T) {
+	client := newFakeKubeClient()
+
+	require.NoError(t, client.createConfigMap(&v1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Namespace: "velero", Name: "entry"}, Data: map[string]string{"a": "b"}}))
+	require.NoError(t, client.createConfigMap(&v1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Namespace: "velero", Name: "entry"}}), "creating an existing ConfigMap succeeds")
+	require.NoError(t, client.patchConfigMap("velero", "entry", map[string]string{"c": "d"}))
+	configMap, err := client.getConfigMap("velero", "entry")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"a": "b", "c": "d"}, configMap.Data)
+
+	err = client.createConfigMap(&v1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Namespace: "locked", Name: "entry"}})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "needs create access to configmaps in namespace locked")
+
+	assert.NoError(t, client.deleteConfigMap("velero", "entry"))
+	assert.NoError(t, client.deleteConfigMap("velero", "gone"), "deleting a missing ConfigMap succeeds")
+	_, err = client.getConfigMap("velero", "entry")
+	assert.EqualError(t, err, "ConfigMap entry not found")
+}
+
+func TestCreateEvent(t *testing.T) {
+	client := newFakeKubeClient()
+
+	require.NoError(t, client.createEvent(&v1.Event{ObjectMeta: metav1.ObjectMeta{Namespace: "app", Name: "data.1"}, Reason: snapshotStartedReason}))
+	events, err := client.kube.CoreV1().Events("app").List(context.Background(), metav1.ListOptions{})
+	require.NoError(t, err)
+	require.Len(t, events.Items, 1)
+	assert.Equal(t, snapshotStartedReason, events.Items[0].Reason)
+
+	err = client.createEvent(&v1.Event{ObjectMeta: metav1.ObjectMeta{Namespace: "locked"}})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "needs create access to events in namespace locked")
+}
+
+func TestKubeClientBackups(t *testing.T) {
+	client := newFakeKubeClient()
+	client.velero = velerofake.NewSimpleClientset(&api.Backup{ObjectMeta: metav1.ObjectMeta{Namespace: "velero", Name: "nightly"}})
+
+	require.NoError(t, client.annotateBackup("velero", "nightly", "velero.io/cost", "1.5"))
+	backup, err := client.getBackup("velero", "nightly")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"velero.io/cost": "1.5"}, backup.Annotations)
+
+	_, err = client.getBackup("velero", "weekly")
+	assert.EqualError(t, err, "backup weekly not found")
+}
+
+func TestKubeClientResources(t *testing.T) {
+	client := newFakeKubeClient()
+	protectedApplications := schema.GroupVersionResource{Group: backupForGKEGroup, Version: "v1", Resource: "protectedapplications"}
+	app := &unstructured.Unstructured{}
+	app.SetAPIVersion(backupForGKEGroup + "/v1")
+	app.SetKind("ProtectedApplication")
+	app.SetNamespace("shop")
+	app.SetName("db")
+	client.dynamic = dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), map[schema.GroupVersionResource]string{
+		protectedApplications: "ProtectedApplicationList",
+		gatewayPolicyResources["GCPGatewayPolicy"].WithVersion("v1"): "GCPGatewayPolicyList",
+	}, app)
+
+	version, err := client.preferredVersion(backupForGKEGroup)
+	require.NoError(t, err)
+	assert.Empty(t, version, "the group isn't served")
+
+	client.kube.Discovery().(*fakediscovery.FakeDiscovery).Resources = []*metav1.APIResourceList{{GroupVersion: backupForGKEGroup + "/v1"}}
+	version, err = client.preferredVersion(backupForGKEGroup)
+	require.NoError(t, err)
+	assert.Equal(t, "v1", version)
+
+	apps, err := client.listResources(protectedApplications, "")
+	require.NoError(t, err)
+	require.Len(t, apps, 1)
+	assert.Equal(t, "db", apps[0].GetName())
+
+	// resources whose CRD isn't installed are an empty list
+	client.dynamic.(*dynamicfake.FakeDynamicClient).PrependReactor("list", "gcpgatewaypolicies", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, apierrors.NewNotFound(action.GetResource().GroupResource(), "")
+	})
+	policies, err := client.listResources(gatewayPolicyResources["GCPGatewayPolicy"].WithVersion("v1"), "shop")
+	require.NoError(t, err)
+	assert.Empty(t, policies)
+}
@@ -0,0 +1,253 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	api "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// kubernetesEventsConfigKey enables Kubernetes Events for the snapshots
+	// and uploads of a location.
+	kubernetesEventsConfigKey = "kubernetesEvents"
+
+	// eventComponent is the source and reporting controller of the events.
+	eventComponent = "velero-plugin-for-gcp"
+
+	snapshotStartedReason   = "SnapshotStarted"
+	snapshotCompletedReason = "SnapshotCompleted"
+	snapshotFailedReason    = "SnapshotFailed"
+	uploadProgressReason    = "UploadProgress"
+	uploadCompletedReason   = "UploadCompleted"
+	uploadFailedReason      = "UploadFailed"
+
+	// uploadMilestoneBytes is how often the progress of an upload is
+	// reported. Uploads of backup contents and of objects at least this
+	// large also report their completion.
+	uploadMilestoneBytes = 1 << 30
+)
+
+// eventSink reads the objects events are about and creates the events.
+type eventSink interface {
+	getBackup(namespace, name string) (*api.Backup, error)
+	getPersistentVolume(name string) (*v1.PersistentVolume, error)
+	createEvent(event *v1.Event) error
+}
+
+func (inCluster) eventSink() (eventSink, error) {
+	return newInClusterClient()
+}
+
+// kubeEventRecorder creates Kubernetes Events on the Backups and the
+// PersistentVolumeClaims the plugin's snapshots and uploads are for, so
+// `kubectl describe` and event-based tooling show the plugin's activity.
+// Recording is best effort: failures are logged and never fail the
+// operation. A nil recorder records nothing.
+type kubeEventRecorder struct {
+	log  logrus.FieldLogger
+	sink eventSink
+	now  func() time.Time
+	host string
+
+	lock sync.Mutex
+	// refs records the objects already looked up, by resource and name.
+	refs map[string]*v1.ObjectReference
+}
+
+// newKubeEventRecorder returns an event recorder if the location enables
+// Kubernetes Events, or nil otherwise. The events are created in cluster.
+func newKubeEventRecorder(log logrus.FieldLogger, config map[string]string, cluster veleroCluster) *kubeEventRecorder {
+	if enabled, _ := strconv.ParseBool(config[kubernetesEventsConfigKey]); !enabled {
+		return nil
+	}
+	sink, err := cluster.eventSink()
+	if err != nil {
+		log.WithError(err).Warn("Unable to create Kubernetes Events")
+		return nil
+	}
+	host, _ := os.Hostname()
+	return &kubeEventRecorder{
+		log:  log,
+		sink: sink,
+		now:  time.Now,
+		host: host,
+		refs: make(map[string]*v1.ObjectReference),
+	}
+}
+
+// backup records an event on a Velero backup.
+func (r *kubeEventRecorder) backup(name, eventType, reason, message string) {
+	if r == nil || name == "" {
+		return
+	}
+	ref, err := r.reference("backups/"+name, func() (*v1.ObjectReference, error) {
+		backup, err := r.sink.getBackup(veleroNamespace(), name)
+		if err != nil {
+			return nil, err
+		}
+		return &v1.ObjectReference{
+			APIVersion: api.SchemeGroupVersion.String(),
+			Kind:       "Backup",
+			Namespace:  backup.Namespace,
+			Name:       backup.Name,
+			UID:        backup.UID,
+		}, nil
+	})
+	r.record(ref, err, eventType, reason, message)
+}
+
+// volume records an event on the claim a persistent volume is bound to, if
+// any.
+func (r *kubeEventRecorder) volume(pvName, eventType, reason, message string) {
+	if r == nil || pvName == "" {
+		return
+	}
+	ref, err := r.reference("persistentvolumes/"+pvName, func() (*v1.ObjectReference, error) {
+		pv, err := r.sink.getPersistentVolume(pvName)
+		if err != nil {
+			return nil, err
+		}
+		if pv.Spec.ClaimRef == nil {
+			return nil, nil
+		}
+		return &v1.ObjectReference{
+			APIVersion: "v1",
+			Kind:       "PersistentVolumeClaim",
+			Namespace:  pv.Spec.ClaimRef.Namespace,
+			Name:       pv.Spec.ClaimRef.Name,
+			UID:        pv.Spec.ClaimRef.UID,
+		}, nil
+	})
+	r.record(ref, err, eventType, reason, message)
+}
+
+// reference returns the object an event is about, by resource and name,
+// looking it up the first time.
+func (r *kubeEventRecorder) reference(key string, lookup func() (*v1.ObjectReference, error)) (*v1.ObjectReference, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if ref, ok := r.refs[key]; ok {
+		return ref, nil
+	}
+	ref, err := lookup()
+	if err != nil {
+		return nil, err
+	}
+	r.refs[key] = ref
+	return ref, nil
+}
+
+func (r *kubeEventRecorder) record(ref *v1.ObjectReference, err error, eventType, reason, message string) {
+	if err != nil {
+		r.log.WithError(err).WithField("reason", reason).Warn("Unable to create Kubernetes Event")
+		return
+	}
+	if ref == nil {
+		return
+	}
+
+	now := metav1.NewTime(r.now())
+	event := &v1.Event{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      fmt.Sprintf("%s.%x", ref.Name, now.UnixNano()),
+			Namespace: ref.Namespace,
+		},
+		InvolvedObject:      *ref,
+		Reason:              reason,
+		Message:             message,
+		Type:                eventType,
+		Source:              v1.EventSource{Component: eventComponent, Host: r.host},
+		FirstTimestamp:      now,
+		LastTimestamp:       now,
+		Count:               1,
+		ReportingController: eventComponent,
+		ReportingInstance:   r.host,
+	}
+	if err := r.sink.createEvent(event); err != nil {
+		r.log.WithError(err).WithField("reason", reason).Warn("Unable to create Kubernetes Event")
+	}
+}
+
+// uploadProgressReader records an event each time another milestone of an
+// upload is read.
+type uploadProgressReader struct {
+	io.Reader
+	report func(n int64)
+	read   int64
+}
+
+func (u *uploadProgressReader) Read(p []byte) (int, error) {
+	n, err := u.Reader.Read(p)
+	before := u.read / uploadMilestoneBytes
+	u.read += int64(n)
+	if u.read/uploadMilestoneBytes > before {
+		u.report(u.read)
+	}
+	return n, err
+}
+
+// watchUpload records UploadProgress events on the backup an object belongs
+// to while it's uploaded.
+func (r *kubeEventRecorder) watchUpload(bucket, key string, body io.Reader) io.Reader {
+	backup, _ := backupObject(key)
+	if r == nil || backup == "" {
+		return body
+	}
+	return &uploadProgressReader{Reader: body, report: func(n int64) {
+		r.backup(backup, v1.EventTypeNormal, uploadProgressReason, fmt.Sprintf("Uploaded %s of gs://%s/%s", formatBytes(n), bucket, key))
+	}}
+}
+
+// uploaded records the completion of the upload of a backup's contents or
+// of a large object of a backup, or the failure of any upload of a backup.
+func (r *kubeEventRecorder) uploaded(bucket, key string, n int64, err error) {
+	backup, file := backupObject(key)
+	if r == nil || backup == "" {
+		return
+	}
+	switch {
+	case err != nil:
+		r.backup(backup, v1.EventTypeWarning, uploadFailedReason, fmt.Sprintf("Error uploading gs://%s/%s: %v", bucket, key, err))
+	case file == backup+".tar.gz" || n >= uploadMilestoneBytes:
+		r.backup(backup, v1.EventTypeNormal, uploadCompletedReason, fmt.Sprintf("Uploaded gs://%s/%s (%s)", bucket, key, formatBytes(n)))
+	}
+}
+
+// formatBytes formats a size in the largest binary unit it is at least one
+// of.
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit && exp < 3; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGT"[exp])
+}
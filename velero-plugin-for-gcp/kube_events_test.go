@@ -0,0 +1,184 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	api "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	velerotest "github.com/vmware-tanzu/velero/pkg/test"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+type fakeEventSink struct {
+	objects map[string]interface{}
+	gets    int
+	events  []*v1.Event
+	err     error
+}
+
+func (s *fakeEventSink) getBackup(namespace, name string) (*api.Backup, error) {
+	s.gets++
+	backup, ok := s.objects[namespace+"/"+name].(*api.Backup)
+	if !ok {
+		return nil, errors.Errorf("backup %s not found", name)
+	}
+	return backup, nil
+}
+
+func (s *fakeEventSink) getPersistentVolume(name string) (*v1.PersistentVolume, error) {
+	s.gets++
+	pv, ok := s.objects[name].(*v1.PersistentVolume)
+	if !ok {
+		return nil, errors.Errorf("persistent volume %s not found", name)
+	}
+	return pv, nil
+}
+
+func (s *fakeEventSink) createEvent(event *v1.Event) error {
+	if s.err != nil {
+		return s.err
+	}
+	s.events = append(s.events, event)
+	return nil
+}
+
+func newFakeEventRecorder(log logrus.FieldLogger) (*kubeEventRecorder, *fakeEventSink) {
+	sink := &fakeEventSink{objects: map[string]interface{}{
+		"velero/b1": &api.Backup{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "velero", Name: "b1", UID: "backup-uid"},
+		},
+		"pv-1": &v1.PersistentVolume{
+			Spec: v1.PersistentVolumeSpec{ClaimRef: &v1.ObjectReference{Namespace: "app", Name: "data", UID: "claim-uid"}},
+		},
+		"pv-unbound": &v1.PersistentVolume{},
+	}}
+	now := time.Unix(1700000000, 0)
+	return &kubeEventRecorder{
+		log:  log,
+		sink: sink,
+		now:  func() time.Time { return now },
+		host: "velero-0",
+		refs: make(map[string]*v1.ObjectReference),
+	}, sink
+}
+
+func TestKubeEventRecorder(t *testing.T) {
+	logger, hook := logtest.NewNullLogger()
+	recorder, sink := newFakeEventRecorder(logger)
+
+	recorder.backup("b1", v1.EventTypeNormal, snapshotStartedReason, "Creating snapshot of volume disk-1")
+	recorder.volume("pv-1", v1.EventTypeWarning, snapshotFailedReason, "Error creating snapshot")
+	recorder.backup("b1", v1.EventTypeNormal, snapshotCompletedReason, "Created snapshot")
+	require.Len(t, sink.events, 3)
+	assert.Equal(t, 2, sink.gets, "objects are looked up once")
+
+	event := sink.events[0]
+	assert.Equal(t, "velero", event.Namespace)
+	assert.Equal(t, "b1.17979cfe362a0000", event.Name)
+	assert.Equal(t, v1.ObjectReference{APIVersion: "velero.io/v1", Kind: "Backup", Namespace: "velero", Name: "b1", UID: "backup-uid"}, event.InvolvedObject)
+	assert.Equal(t, snapshotStartedReason, event.Reason)
+	assert.Equal(t, v1.EventTypeNormal, event.Type)
+	assert.Equal(t, v1.EventSource{Component: eventComponent, Host: "velero-0"}, event.Source)
+	assert.Equal(t, int32(1), event.Count)
+
+	event = sink.events[1]
+	assert.Equal(t, "app", event.Namespace)
+	assert.Equal(t, v1.ObjectReference{APIVersion: "v1", Kind: "PersistentVolumeClaim", Namespace: "app", Name: "data", UID: "claim-uid"}, event.InvolvedObject)
+	assert.Equal(t, v1.EventTypeWarning, event.Type)
+
+	// volumes without a claim and missing objects get no events
+	recorder.volume("pv-unbound", v1.EventTypeNormal, snapshotStartedReason, "")
+	recorder.backup("missing", v1.EventTypeNormal, snapshotStartedReason, "")
+	assert.Len(t, sink.events, 3)
+	require.Len(t, hook.AllEntries(), 1)
+	assert.Equal(t, logrus.WarnLevel, hook.LastEntry().Level)
+
+	sink.err = errors.New("forbidden")
+	recorder.backup("b1", v1.EventTypeNormal, snapshotStartedReason, "")
+	assert.Len(t, hook.AllEntries(), 2)
+
+	// a nil recorder records nothing
+	var disabled *kubeEventRecorder
+	disabled.backup("b1", v1.EventTypeNormal, snapshotStartedReason, "")
+	disabled.uploaded("bucket", "backups/b1/b1.tar.gz", 1, nil)
+}
+
+func TestNewKubeEventRecorder(t *testing.T) {
+	cluster := &fakeCluster{sink: &fakeEventSink{}}
+	assert.Nil(t, newKubeEventRecorder(velerotest.NewLogger(), map[string]string{}, cluster))
+	assert.Nil(t, newKubeEventRecorder(velerotest.NewLogger(), map[string]string{kubernetesEventsConfigKey: "false"}, cluster))
+	assert.NotNil(t, newKubeEventRecorder(velerotest.NewLogger(), map[string]string{kubernetesEventsConfigKey: "true"}, cluster))
+
+	// outside a cluster, events aren't recorded
+	assert.Nil(t, newKubeEventRecorder(velerotest.NewLogger(), map[string]string{kubernetesEventsConfigKey: "true"}, &fakeCluster{}))
+}
+
+func TestPutObjectKubeEvents(t *testing.T) {
+	recorder, sink := newFakeEventRecorder(velerotest.NewLogger())
+	o := newObjectStore(velerotest.NewLogger())
+	o.kubeEvents = recorder
+
+	o.setClients(func(c *objectStoreClients) { c.bucketWriter = newFakeWriter(newMockWriteCloser(nil, nil)) })
+	require.NoError(t, o.PutObject("bucket", "backups/b1/b1-logs.gz", strings.NewReader("logs")))
+	assert.Empty(t, sink.events, "small objects don't report their upload")
+
+	require.NoError(t, o.PutObject("bucket", "backups/b1/b1.tar.gz", strings.NewReader("contents")))
+	require.Len(t, sink.events, 1)
+	assert.Equal(t, uploadCompletedReason, sink.events[0].Reason)
+	assert.Equal(t, "Uploaded gs://bucket/backups/b1/b1.tar.gz (8 B)", sink.events[0].Message)
+
+	o.setClients(func(c *objectStoreClients) {
+		c.bucketWriter = newFakeWriter(newMockWriteCloser(errors.New("error writing"), nil))
+	})
+	require.Error(t, o.PutObject("bucket", "backups/b1/b1-volumesnapshots.json.gz", strings.NewReader("snapshots")))
+	require.Len(t, sink.events, 2)
+	assert.Equal(t, uploadFailedReason, sink.events[1].Reason)
+	assert.Equal(t, v1.EventTypeWarning, sink.events[1].Type)
+
+	// objects outside of backups have no events
+	require.Error(t, o.PutObject("bucket", "restores/r1/restore-r1-logs.gz", strings.NewReader("logs")))
+	assert.Len(t, sink.events, 2)
+}
+
+func TestUploadProgressReader(t *testing.T) {
+	var reported []int64
+	reader := &uploadProgressReader{
+		Reader: strings.NewReader("abcdef"),
+		report: func(n int64) { reported = append(reported, n) },
+		read:   uploadMilestoneBytes - 4,
+	}
+	buf := make([]byte, 3)
+	reader.Read(buf)
+	assert.Empty(t, reported)
+	reader.Read(buf)
+	assert.Equal(t, []int64{uploadMilestoneBytes + 2}, reported)
+}
+
+func TestFormatBytes(t *testing.T) {
+	assert.Equal(t, "512 B", formatBytes(512))
+	assert.Equal(t, "1.5 KiB", formatBytes(1536))
+	assert.Equal(t, "2.0 GiB", formatBytes(2<<30))
+}
@@ -0,0 +1,116 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	stderrors "errors"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/compute/metadata"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// initRetryInterval is the least time between two attempts to connect a
+// component whose initialization was deferred, so calls made while GCP is
+// unavailable fail quickly instead of each waiting for it.
+var initRetryInterval = 10 * time.Second
+
+// isTransientInitError reports whether an error initializing a component is
+// likely to go away on its own: the errors GCP APIs are retried for, and
+// failures to reach the APIs or the metadata server, which are common while
+// the node's network or the GKE metadata server start up.
+func isTransientInitError(err error) bool {
+	if classifyError(err) == transientError || isTransientAuthError(err) {
+		return true
+	}
+	var netErr net.Error
+	if stderrors.As(err, &netErr) {
+		return true
+	}
+	var metadataErr *metadata.Error
+	return stderrors.As(err, &metadataErr) && (metadataErr.Code == http.StatusTooManyRequests || metadataErr.Code >= http.StatusInternalServerError)
+}
+
+// deferredInit connects a component that couldn't reach GCP when Velero
+// initialized it, the first time it's used once GCP is reachable again,
+// instead of failing it until the Velero pod restarts.
+type deferredInit struct {
+	log       logrus.FieldLogger
+	component string
+	connect   func() error
+	now       func() time.Time
+
+	lock      sync.Mutex
+	done      bool
+	err       error
+	attempted time.Time
+}
+
+// connectWithRetries connects a component, retrying transient errors a few
+// times, backing off with sleep. If it still fails transiently and defer is
+// set, the error is logged and a deferredInit is returned, which connects
+// the component when it's first used. Other errors are returned.
+func connectWithRetries(log logrus.FieldLogger, component string, deferOnFailure bool, sleep func(time.Duration), connect func() error) (*deferredInit, error) {
+	var err error
+	for attempt := 1; attempt <= transientRetryAttempts; attempt++ {
+		if err = connect(); err == nil || !isTransientInitError(err) {
+			return nil, err
+		}
+		if attempt < transientRetryAttempts {
+			log.WithError(err).Infof("Unable to reach GCP while initializing the %s, retrying", component)
+			sleep(time.Duration(attempt) * transientRetryBackoff)
+		}
+	}
+	if !deferOnFailure {
+		return nil, err
+	}
+
+	log.WithError(err).Warnf("Unable to reach GCP while initializing the %s; it will connect when it's first used", component)
+	return &deferredInit{log: log, component: component, connect: connect, now: time.Now, err: err, attempted: time.Now()}, nil
+}
+
+// ensure connects the component if it isn't connected yet, at most once per
+// initRetryInterval, and returns the last error otherwise.
+func (d *deferredInit) ensure() error {
+	if d == nil {
+		return nil
+	}
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if d.done {
+		return nil
+	}
+	if d.now().Sub(d.attempted) >= initRetryInterval {
+		d.attempted = d.now()
+		if d.err = d.connect(); d.err == nil {
+			d.done = true
+			d.log.Infof("Initialized the %s after GCP became reachable", d.component)
+			return nil
+		}
+	}
+	// connecting also runs checks, such as of organization policies, that
+	// can fail while GCP is reachable
+	if !isTransientInitError(d.err) {
+		return d.err
+	}
+	return errors.Wrapf(d.err, "the %s couldn't reach GCP when it was initialized and still can't", d.component)
+}
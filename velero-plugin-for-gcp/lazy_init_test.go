@@ -0,0 +1,133 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/compute/metadata"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	velerotest "github.com/vmware-tanzu/velero/pkg/test"
+	"google.golang.org/api/googleapi"
+)
+
+func TestIsTransientInitError(t *testing.T) {
+	refused := &url.Error{Op: "Get", URL: "http://169.254.169.254/computeMetadata/v1/project/project-id", Err: &net.OpError{Op: "dial", Err: errors.New("connection refused")}}
+	assert.True(t, isTransientInitError(errors.Wrap(refused, "error finding credentials")))
+	assert.True(t, isTransientInitError(&googleapi.Error{Code: http.StatusServiceUnavailable}))
+	assert.True(t, isTransientInitError(&metadata.Error{Code: http.StatusInternalServerError}))
+
+	assert.False(t, isTransientInitError(&metadata.Error{Code: http.StatusNotFound}))
+	assert.False(t, isTransientInitError(&googleapi.Error{Code: http.StatusForbidden}))
+	assert.False(t, isTransientInitError(errors.New("error parsing credentials file; should be JSON")))
+}
+
+func TestConnectWithRetries(t *testing.T) {
+	sleep := func(time.Duration) {}
+	unavailable := &googleapi.Error{Code: http.StatusServiceUnavailable}
+
+	// transient errors are retried
+	calls := 0
+	deferred, err := connectWithRetries(velerotest.NewLogger(), "object store", true, sleep, func() error {
+		calls++
+		if calls < transientRetryAttempts {
+			return unavailable
+		}
+		return nil
+	})
+	require.NoError(t, err)
+	assert.Nil(t, deferred)
+	assert.Equal(t, transientRetryAttempts, calls)
+
+	// other errors fail right away
+	calls = 0
+	_, err = connectWithRetries(velerotest.NewLogger(), "object store", true, sleep, func() error {
+		calls++
+		return errors.New("invalid credentials")
+	})
+	assert.EqualError(t, err, "invalid credentials")
+	assert.Equal(t, 1, calls)
+
+	// transient errors fail once retried, unless connecting can be deferred
+	_, err = connectWithRetries(velerotest.NewLogger(), "object store", false, sleep, func() error { return unavailable })
+	assert.Equal(t, unavailable, err)
+
+	deferred, err = connectWithRetries(velerotest.NewLogger(), "object store", true, sleep, func() error { return unavailable })
+	require.NoError(t, err)
+	require.NotNil(t, deferred)
+}
+
+func TestDeferredInit(t *testing.T) {
+	now := time.Now()
+	var connectErr error = &googleapi.Error{Code: http.StatusServiceUnavailable}
+	calls := 0
+	connect := func() error {
+		calls++
+		return connectErr
+	}
+	d := &deferredInit{log: velerotest.NewLogger(), component: "object store", connect: connect, now: func() time.Time { return now }, err: connectErr, attempted: now}
+
+	// calls made right after a failed attempt fail without connecting
+	err := d.ensure()
+	require.Error(t, err)
+	assert.True(t, strings.HasPrefix(err.Error(), "the object store couldn't reach GCP when it was initialized and still can't"))
+	assert.Equal(t, 0, calls)
+
+	now = now.Add(initRetryInterval)
+	assert.Error(t, d.ensure())
+	assert.Equal(t, 1, calls)
+
+	// errors of the checks run after connecting are returned as they are
+	now = now.Add(initRetryInterval)
+	connectErr = errors.New("bucket b violates organization policy constraint constraints/gcp.resourceLocations")
+	assert.EqualError(t, d.ensure(), "bucket b violates organization policy constraint constraints/gcp.resourceLocations")
+	assert.Equal(t, 2, calls)
+
+	now = now.Add(initRetryInterval)
+	connectErr = nil
+	assert.NoError(t, d.ensure())
+	assert.NoError(t, d.ensure())
+	assert.Equal(t, 3, calls)
+
+	assert.NoError(t, (*deferredInit)(nil).ensure())
+}
+
+func TestObjectStoreConnectsWhenFirstUsed(t *testing.T) {
+	o := newObjectStore(velerotest.NewLogger())
+	now := time.Now()
+	connectErr := errors.Wrap(&net.OpError{Op: "dial", Err: errors.New("connection refused")}, "error getting bucket attributes")
+	o.init = &deferredInit{log: o.log, component: "object store", now: func() time.Time { return now }, err: connectErr, attempted: now, connect: func() error {
+		if connectErr != nil {
+			return connectErr
+		}
+		o.setClients(func(c *objectStoreClients) { c.bucketWriter = newFakeWriter(newMockWriteCloser(nil, nil)) })
+		return nil
+	}}
+
+	assert.Error(t, o.PutObject("bucket", "backups/b1/velero-backup.json", strings.NewReader("{}")))
+
+	connectErr = nil
+	now = now.Add(initRetryInterval)
+	assert.NoError(t, o.PutObject("bucket", "backups/b1/velero-backup.json", strings.NewReader("{}")))
+}
@@ -0,0 +1,326 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	stderrors "errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/api/googleapi"
+)
+
+const (
+	// listIndexMaxAgeConfigKey enables the backup list index of a
+	// BackupStorageLocation, which Velero's backup sync reads instead of
+	// listing the backups directory, for at most this long before the
+	// directory is listed again.
+	listIndexMaxAgeConfigKey = "listIndexMaxAge"
+
+	// listIndexFile is the index object, in the directory Velero reserves
+	// for plugins under the location's prefix.
+	listIndexFile = "plugins/gcp/backup-list-index.json"
+	// maxListIndexSize bounds how much of the index object is read. An
+	// index of 100,000 backups is a few MiB.
+	maxListIndexSize = 64 << 20
+
+	listIndexCounter = "velero_gcp_list_index_lookups_total"
+)
+
+// backupListIndex is the content of the index object: the names of the
+// backups in the location.
+type backupListIndex struct {
+	// Complete is set when Backups were read from a full listing and only
+	// changed by the plugin since. Deleting a backup's objects clears it,
+	// since the plugin can't tell when its directory is gone.
+	Complete bool      `json:"complete"`
+	Listed   time.Time `json:"listed"`
+	Backups  []string  `json:"backups"`
+}
+
+// indexStore reads and writes the index object.
+type indexStore interface {
+	// read returns the object and its generation, or nil and zero if it
+	// doesn't exist.
+	read(bucket, key string) ([]byte, int64, error)
+	// write replaces the object if its generation is still the given one,
+	// creates it if the generation is zero and it doesn't exist, or writes
+	// it regardless if the generation is negative.
+	write(bucket, key string, data []byte, generation int64) error
+}
+
+// listIndex answers Velero's listings of a location's backups directory from
+// the index object, so the backup sync, which lists the directory every
+// minute, doesn't list the whole bucket on every cycle. The plugin adds the
+// backups it uploads to the index, and invalidates it when it deletes
+// backup objects; the directory is listed again and the index rewritten once
+// it's invalid or older than maxAge. Writes are conditional on the index's
+// generation, so concurrent uploads and listings by other plugin processes
+// don't lose each other's updates. A nil index lists the bucket every time.
+type listIndex struct {
+	log           logrus.FieldLogger
+	store         indexStore
+	backupsPrefix string
+	key           string
+	maxAge        time.Duration
+	now           func() time.Time
+
+	lock sync.Mutex
+	// indexed records the backups already known to be in the index.
+	indexed map[string]bool
+}
+
+// newListIndex returns the location's index if it's enabled, or nil
+// otherwise.
+func newListIndex(log logrus.FieldLogger, config map[string]string, store indexStore) (*listIndex, error) {
+	val := config[listIndexMaxAgeConfigKey]
+	if val == "" {
+		return nil, nil
+	}
+	maxAge, err := time.ParseDuration(val)
+	if err != nil || maxAge <= 0 {
+		return nil, errors.Errorf("%s must be a positive duration, got %q", listIndexMaxAgeConfigKey, val)
+	}
+
+	prefix := config["prefix"]
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	return &listIndex{
+		log:           log,
+		store:         store,
+		backupsPrefix: prefix + backupsDir,
+		key:           prefix + listIndexFile,
+		maxAge:        maxAge,
+		now:           time.Now,
+		indexed:       make(map[string]bool),
+	}, nil
+}
+
+// covers reports whether a listing is of the indexed backups directory.
+func (l *listIndex) covers(prefix, delimiter string) bool {
+	return l != nil && prefix == l.backupsPrefix && delimiter == "/"
+}
+
+// read returns the index and its generation, or an empty index and zero if
+// there is none yet.
+func (l *listIndex) read(bucket string) (*backupListIndex, int64, error) {
+	data, generation, err := l.store.read(bucket, l.key)
+	if err != nil {
+		return nil, 0, err
+	}
+	index := new(backupListIndex)
+	if data == nil {
+		return index, 0, nil
+	}
+	if err := json.Unmarshal(data, index); err != nil {
+		// a corrupt index is replaced by the next listing
+		l.log.WithError(errors.WithStack(err)).Warn("Unable to decode the backup list index")
+		return new(backupListIndex), generation, nil
+	}
+	return index, generation, nil
+}
+
+func (l *listIndex) write(bucket string, index *backupListIndex, generation int64) error {
+	data, err := json.Marshal(index)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	return l.store.write(bucket, l.key, data, generation)
+}
+
+// list returns the backup directories from the index if it's complete and
+// recent, or from list otherwise, rewriting the index with them.
+func (l *listIndex) list(bucket string, list func() ([]string, error)) ([]string, error) {
+	index, generation, readErr := l.read(bucket)
+	if readErr != nil {
+		l.log.WithError(readErr).Debug("Unable to read the backup list index, listing the backups")
+	} else if index.Complete && l.now().Sub(index.Listed) < l.maxAge {
+		pluginMetrics.addCounter(listIndexCounter, "Number of listings of backups answered by the list index, by result.", map[string]string{"result": "hit"}, 1)
+		prefixes := make([]string, 0, len(index.Backups))
+		for _, backup := range index.Backups {
+			prefixes = append(prefixes, l.backupsPrefix+backup+"/")
+		}
+		return prefixes, nil
+	}
+	pluginMetrics.addCounter(listIndexCounter, "Number of listings of backups answered by the list index, by result.", map[string]string{"result": "miss"}, 1)
+
+	listed := l.now()
+	prefixes, err := list()
+	if err != nil || readErr != nil {
+		return prefixes, err
+	}
+
+	index = &backupListIndex{Complete: true, Listed: listed.UTC()}
+	for _, prefix := range prefixes {
+		index.Backups = append(index.Backups, strings.TrimSuffix(strings.TrimPrefix(prefix, l.backupsPrefix), "/"))
+	}
+	// the write fails if a backup was uploaded or deleted while listing,
+	// and the next listing tries again
+	if err := l.write(bucket, index, generation); err != nil {
+		l.log.WithError(err).Debug("Unable to update the backup list index")
+	}
+	return prefixes, nil
+}
+
+// update changes the index with change, which reports whether it changed
+// anything, retrying if another process updates the index at the same time.
+func (l *listIndex) update(bucket string, change func(index *backupListIndex) bool) error {
+	var err error
+	for attempt := 0; attempt < transientRetryAttempts; attempt++ {
+		index, generation, readErr := l.read(bucket)
+		if readErr != nil {
+			return readErr
+		}
+		if !change(index) {
+			return nil
+		}
+		if err = l.write(bucket, index, generation); err == nil || !isPreconditionFailed(err) {
+			return err
+		}
+	}
+	return err
+}
+
+// invalidate overwrites the index with an incomplete one, so the next
+// listing lists the backups, when it couldn't be updated.
+func (l *listIndex) invalidate(bucket string, cause error) {
+	l.log.WithError(cause).Debug("Unable to update the backup list index, invalidating it")
+	if err := l.write(bucket, &backupListIndex{}, -1); err != nil {
+		l.log.WithError(err).Warnf("Unable to update or invalidate the backup list index; listings may miss backups for up to %s", l.maxAge)
+	}
+}
+
+// added adds the backup an uploaded object belongs to to the index.
+func (l *listIndex) added(bucket, key string) {
+	if l == nil {
+		return
+	}
+	backup := backupNameFromKey(l.backupsPrefix, key)
+	if backup == "" {
+		return
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.indexed[backup] {
+		return
+	}
+
+	err := l.update(bucket, func(index *backupListIndex) bool {
+		for _, b := range index.Backups {
+			if b == backup {
+				return false
+			}
+		}
+		index.Backups = append(index.Backups, backup)
+		sort.Strings(index.Backups)
+		return true
+	})
+	if err != nil {
+		l.invalidate(bucket, err)
+		return
+	}
+	l.indexed[backup] = true
+}
+
+// removed invalidates the index when an object of a backup is deleted.
+func (l *listIndex) removed(bucket, key string) {
+	if l == nil {
+		return
+	}
+	backup := backupNameFromKey(l.backupsPrefix, key)
+	if backup == "" {
+		return
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	delete(l.indexed, backup)
+
+	// the index is written even if it's already incomplete or missing, so
+	// a listing running meanwhile doesn't write one with the backup
+	err := l.update(bucket, func(index *backupListIndex) bool {
+		index.Complete = false
+		return true
+	})
+	if err != nil {
+		l.invalidate(bucket, err)
+	}
+}
+
+// isPreconditionFailed reports whether a conditional write failed because
+// the object changed.
+func isPreconditionFailed(err error) bool {
+	var apiErr *googleapi.Error
+	return stderrors.As(err, &apiErr) && apiErr.Code == http.StatusPreconditionFailed
+}
+
+// gcsIndexStore keeps the index object in the location's bucket, encrypted
+// like the backups.
+type gcsIndexStore struct {
+	client        *storage.Client
+	encryptionKey []byte
+	kmsKeyName    string
+}
+
+func (s *gcsIndexStore) read(bucket, key string) ([]byte, int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), storageCallTimeout)
+	defer cancel()
+	r, err := s.client.Bucket(bucket).Object(key).Key(s.encryptionKey).NewReader(ctx)
+	if isNotFound(err) {
+		return nil, 0, nil
+	}
+	if err != nil {
+		return nil, 0, errors.WithStack(err)
+	}
+	defer r.Close()
+	data, err := ioutil.ReadAll(io.LimitReader(r, maxListIndexSize))
+	if err != nil {
+		return nil, 0, errors.WithStack(err)
+	}
+	return data, r.Attrs.Generation, nil
+}
+
+func (s *gcsIndexStore) write(bucket, key string, data []byte, generation int64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), storageCallTimeout)
+	defer cancel()
+	obj := s.client.Bucket(bucket).Object(key)
+	switch {
+	case generation == 0:
+		obj = obj.If(storage.Conditions{DoesNotExist: true})
+	case generation > 0:
+		obj = obj.If(storage.Conditions{GenerationMatch: generation})
+	}
+	w := obj.Key(s.encryptionKey).NewWriter(ctx)
+	w.KMSKeyName = s.kmsKeyName
+	w.ContentType = "application/json"
+	if _, err := io.Copy(w, bytes.NewReader(data)); err != nil {
+		w.Close()
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(w.Close())
+}
@@ -0,0 +1,197 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	velerotest "github.com/vmware-tanzu/velero/pkg/test"
+	"google.golang.org/api/googleapi"
+)
+
+// fakeIndexStore keeps objects in memory and enforces the generation
+// preconditions of writes like GCS.
+type fakeIndexStore struct {
+	data        map[string][]byte
+	generations map[string]int64
+	reads       int
+	// conflicts is the number of conditional writes that fail as if
+	// another process wrote the object first.
+	conflicts int
+}
+
+func newFakeIndexStore() *fakeIndexStore {
+	return &fakeIndexStore{data: make(map[string][]byte), generations: make(map[string]int64)}
+}
+
+func (s *fakeIndexStore) read(bucket, key string) ([]byte, int64, error) {
+	s.reads++
+	return s.data[bucket+"/"+key], s.generations[bucket+"/"+key], nil
+}
+
+func (s *fakeIndexStore) write(bucket, key string, data []byte, generation int64) error {
+	name := bucket + "/" + key
+	if generation >= 0 && (s.conflicts > 0 || generation != s.generations[name]) {
+		if s.conflicts > 0 {
+			s.conflicts--
+		}
+		return &googleapi.Error{Code: http.StatusPreconditionFailed}
+	}
+	s.data[name] = data
+	s.generations[name]++
+	return nil
+}
+
+func (s *fakeIndexStore) index(t *testing.T, key string) backupListIndex {
+	var index backupListIndex
+	require.NoError(t, json.Unmarshal(s.data["bucket/"+key], &index))
+	return index
+}
+
+func newTestListIndex(t *testing.T, store indexStore, now *time.Time) *listIndex {
+	index, err := newListIndex(velerotest.NewLogger(), map[string]string{"prefix": "cluster-a", listIndexMaxAgeConfigKey: "10m"}, store)
+	require.NoError(t, err)
+	index.now = func() time.Time { return *now }
+	return index
+}
+
+func TestNewListIndex(t *testing.T) {
+	index, err := newListIndex(velerotest.NewLogger(), map[string]string{}, nil)
+	require.NoError(t, err)
+	assert.Nil(t, index)
+	assert.False(t, index.covers("backups/", "/"))
+
+	_, err = newListIndex(velerotest.NewLogger(), map[string]string{listIndexMaxAgeConfigKey: "0s"}, nil)
+	assert.Error(t, err)
+
+	index, err = newListIndex(velerotest.NewLogger(), map[string]string{"prefix": "cluster-a", listIndexMaxAgeConfigKey: "10m"}, nil)
+	require.NoError(t, err)
+	assert.Equal(t, "cluster-a/plugins/gcp/backup-list-index.json", index.key)
+	assert.True(t, index.covers("cluster-a/backups/", "/"))
+	assert.False(t, index.covers("cluster-a/", "/"))
+	assert.False(t, index.covers("cluster-a/backups/", ""))
+}
+
+func TestListIndexList(t *testing.T) {
+	defer func(registry *metricsRegistry) { pluginMetrics = registry }(pluginMetrics)
+	pluginMetrics = newMetricsRegistry()
+
+	store := newFakeIndexStore()
+	now := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	index := newTestListIndex(t, store, &now)
+	listings := 0
+	list := func() ([]string, error) {
+		listings++
+		return []string{"cluster-a/backups/b1/", "cluster-a/backups/b2/"}, nil
+	}
+
+	// the first listing lists the backups and writes the index, which the
+	// next ones read until it's too old
+	for i := 0; i < 3; i++ {
+		prefixes, err := index.list("bucket", list)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"cluster-a/backups/b1/", "cluster-a/backups/b2/"}, prefixes)
+	}
+	assert.Equal(t, 1, listings)
+	assert.Equal(t, backupListIndex{Complete: true, Listed: now, Backups: []string{"b1", "b2"}}, store.index(t, index.key))
+
+	now = now.Add(10 * time.Minute)
+	_, err := index.list("bucket", list)
+	require.NoError(t, err)
+	assert.Equal(t, 2, listings)
+
+	values := make(map[string]float64)
+	pluginMetrics.each(func(m *metric, s *sample) {
+		values[m.name+labelString(s.labels)] = s.value
+	})
+	assert.Equal(t, map[string]float64{
+		`velero_gcp_list_index_lookups_total{result="hit"}`:  2,
+		`velero_gcp_list_index_lookups_total{result="miss"}`: 2,
+	}, values)
+}
+
+func TestListIndexUploadsAndDeletes(t *testing.T) {
+	store := newFakeIndexStore()
+	now := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	index := newTestListIndex(t, store, &now)
+	_, err := index.list("bucket", func() ([]string, error) { return []string{"cluster-a/backups/b1/"}, nil })
+	require.NoError(t, err)
+
+	// uploaded backups are added to the index once
+	index.added("bucket", "cluster-a/backups/b2/velero-backup.json")
+	reads := store.reads
+	index.added("bucket", "cluster-a/backups/b2/b2.tar.gz")
+	index.added("bucket", "cluster-a/restores/r1/restore-r1-logs.gz")
+	assert.Equal(t, reads, store.reads)
+	assert.Equal(t, backupListIndex{Complete: true, Listed: now, Backups: []string{"b1", "b2"}}, store.index(t, index.key))
+
+	prefixes, err := index.list("bucket", func() ([]string, error) {
+		t.Error("unexpected listing")
+		return nil, nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"cluster-a/backups/b1/", "cluster-a/backups/b2/"}, prefixes)
+
+	// deleting a backup's objects makes the next listing list the backups
+	index.removed("bucket", "cluster-a/backups/b1/velero-backup.json")
+	assert.False(t, store.index(t, index.key).Complete)
+	listed := false
+	prefixes, err = index.list("bucket", func() ([]string, error) {
+		listed = true
+		return []string{"cluster-a/backups/b2/"}, nil
+	})
+	require.NoError(t, err)
+	assert.True(t, listed)
+	assert.Equal(t, []string{"cluster-a/backups/b2/"}, prefixes)
+	assert.True(t, store.index(t, index.key).Complete)
+}
+
+func TestListIndexConcurrentUpdates(t *testing.T) {
+	store := newFakeIndexStore()
+	now := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	index, other := newTestListIndex(t, store, &now), newTestListIndex(t, store, &now)
+
+	// a backup uploaded by another process while listing keeps the listing
+	// from writing an index without it
+	_, err := index.list("bucket", func() ([]string, error) {
+		other.added("bucket", "cluster-a/backups/b2/velero-backup.json")
+		return []string{"cluster-a/backups/b1/"}, nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, backupListIndex{Backups: []string{"b2"}}, store.index(t, index.key))
+
+	_, err = index.list("bucket", func() ([]string, error) {
+		return []string{"cluster-a/backups/b1/", "cluster-a/backups/b2/"}, nil
+	})
+	require.NoError(t, err)
+	assert.True(t, store.index(t, index.key).Complete)
+
+	// an update that keeps conflicting invalidates the index
+	store.conflicts = transientRetryAttempts
+	index.added("bucket", "cluster-a/backups/b3/velero-backup.json")
+	assert.Equal(t, backupListIndex{}, store.index(t, index.key))
+
+	// a nil index does nothing
+	var disabled *listIndex
+	disabled.added("bucket", "cluster-a/backups/b4/velero-backup.json")
+	disabled.removed("bucket", "cluster-a/backups/b4/velero-backup.json")
+}
@@ -0,0 +1,246 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/vmware-tanzu/velero/pkg/plugin/framework"
+	"github.com/vmware-tanzu/velero/pkg/plugin/velero"
+	"google.golang.org/api/compute/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	loadBalancerActionName = "velero.io/gcp-load-balancer"
+
+	// staticIPsConfigKey is the key of the action's ConfigMap choosing what
+	// happens to the static IPs of restored load balancers: "keep" them
+	// as they are, "strip" them so new IPs are allocated, or "reserve"
+	// them in the destination project first.
+	staticIPsConfigKey = "staticIPs"
+	regionConfigKey    = "region"
+	subnetsConfigKey   = "subnets"
+
+	staticIPsKeep    = "keep"
+	staticIPsStrip   = "strip"
+	staticIPsReserve = "reserve"
+
+	loadBalancerTypeAnnotation       = "networking.gke.io/load-balancer-type"
+	legacyLoadBalancerTypeAnnotation = "cloud.google.com/load-balancer-type"
+	internalSubnetAnnotation         = "networking.gke.io/internal-load-balancer-subnet"
+	loadBalancerIPsAnnotation        = "networking.gke.io/load-balancer-ip-addresses"
+)
+
+// addressReserver checks and reserves static IP addresses.
+type addressReserver interface {
+	// reserved reports whether an IP address is reserved.
+	reserved(ip string) (bool, error)
+	// reserveInternal reserves an internal IP address in a subnet, or the
+	// default subnet if subnet is empty.
+	reserveInternal(name, ip, subnet string) error
+}
+
+// gceAddresses reserves addresses in a project's region.
+type gceAddresses struct {
+	gce     *compute.Service
+	project string
+	region  string
+}
+
+func (g *gceAddresses) reserved(ip string) (bool, error) {
+	res, err := g.gce.Addresses.List(g.project, g.region).Filter(fmt.Sprintf("address=%q", ip)).Do()
+	if err != nil {
+		return false, errors.Wrapf(err, "error looking up address %s", ip)
+	}
+	return len(res.Items) > 0, nil
+}
+
+func (g *gceAddresses) reserveInternal(name, ip, subnet string) error {
+	address := &compute.Address{
+		Name:        name,
+		Address:     ip,
+		AddressType: "INTERNAL",
+		Description: "Reserved by Velero for a restored internal load balancer",
+	}
+	if subnet != "" {
+		if !strings.Contains(subnet, "/") {
+			subnet = fmt.Sprintf("projects/%s/regions/%s/subnetworks/%s", g.project, g.region, subnet)
+		}
+		address.Subnetwork = subnet
+	}
+	if _, err := g.gce.Addresses.Insert(g.project, g.region, address).Do(); err != nil {
+		return errors.Wrapf(err, "error reserving address %s", ip)
+	}
+	return nil
+}
+
+type loadBalancerConfig struct {
+	staticIPs string
+	subnets   map[string]string
+}
+
+// LoadBalancerAction is a restore item action that adapts the GCP specifics
+// of LoadBalancer Services: the static IPs they request, which may not be
+// reserved in the destination project, and the subnets of internal load
+// balancers.
+type LoadBalancerAction struct {
+	log     logrus.FieldLogger
+	cluster veleroCluster
+
+	once      sync.Once
+	config    loadBalancerConfig
+	addresses addressReserver
+	configErr error
+}
+
+func newLoadBalancerAction(logger logrus.FieldLogger) (interface{}, error) {
+	return &LoadBalancerAction{log: logger, cluster: inCluster{}}, nil
+}
+
+func (a *LoadBalancerAction) AppliesTo() (velero.ResourceSelector, error) {
+	return velero.ResourceSelector{
+		IncludedResources: []string{"services"},
+	}, nil
+}
+
+func (a *LoadBalancerAction) loadConfig() (loadBalancerConfig, error) {
+	a.once.Do(func() {
+		data, err := a.cluster.pluginConfig(framework.PluginKindRestoreItemAction, loadBalancerActionName)
+		if err != nil {
+			a.configErr = err
+			return
+		}
+		if a.config, err = parseLoadBalancerConfig(data); err != nil {
+			a.configErr = err
+			return
+		}
+		if a.config.staticIPs != staticIPsReserve || a.addresses != nil {
+			return
+		}
+
+		region := data[regionConfigKey]
+		if region == "" {
+			a.configErr = errors.Errorf("%s must be set in the %s ConfigMap to reserve static IPs", regionConfigKey, loadBalancerActionName)
+			return
+		}
+		gce, project, _, err := newActionComputeService(a.log, a.cluster, framework.PluginKindRestoreItemAction, loadBalancerActionName, compute.ComputeScope)
+		if err != nil {
+			a.configErr = err
+			return
+		}
+		a.addresses = &gceAddresses{gce: gce, project: project, region: region}
+	})
+	return a.config, a.configErr
+}
+
+func parseLoadBalancerConfig(data map[string]string) (loadBalancerConfig, error) {
+	c := loadBalancerConfig{staticIPs: data[staticIPsConfigKey]}
+	switch c.staticIPs {
+	case "":
+		c.staticIPs = staticIPsKeep
+	case staticIPsKeep, staticIPsStrip, staticIPsReserve:
+	default:
+		return c, errors.Errorf("invalid %s %q in the %s ConfigMap, expected %s, %s or %s", staticIPsConfigKey, c.staticIPs, loadBalancerActionName, staticIPsKeep, staticIPsStrip, staticIPsReserve)
+	}
+	if err := yaml.Unmarshal([]byte(data[subnetsConfigKey]), &c.subnets); err != nil {
+		return c, errors.Wrapf(err, "error parsing %s in the %s ConfigMap", subnetsConfigKey, loadBalancerActionName)
+	}
+	return c, nil
+}
+
+func (a *LoadBalancerAction) Execute(input *velero.RestoreItemActionExecuteInput) (*velero.RestoreItemActionExecuteOutput, error) {
+	obj := &unstructured.Unstructured{Object: input.Item.UnstructuredContent()}
+
+	if serviceType, _, _ := unstructured.NestedString(obj.Object, "spec", "type"); serviceType != "LoadBalancer" {
+		return velero.NewRestoreItemActionExecuteOutput(obj), nil
+	}
+
+	config, err := a.loadConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	log := a.log.WithField("service", obj.GetNamespace()+"/"+obj.GetName())
+	annotations := obj.GetAnnotations()
+	if annotations == nil {
+		annotations = make(map[string]string)
+	}
+
+	subnet := annotations[internalSubnetAnnotation]
+	if mapped, ok := config.subnets[subnet]; ok && subnet != "" {
+		log.Infof("Updating internal load balancer subnet from %s to %s", subnet, mapped)
+		subnet = mapped
+		annotations[internalSubnetAnnotation] = subnet
+	}
+
+	ip, _, _ := unstructured.NestedString(obj.Object, "spec", "loadBalancerIP")
+	strip := config.staticIPs == staticIPsStrip
+	if ip != "" && config.staticIPs == staticIPsReserve {
+		if strip, err = a.reserve(log, obj, ip, subnet, isInternalLoadBalancer(annotations)); err != nil {
+			return nil, err
+		}
+	}
+	if strip {
+		if ip != "" {
+			log.Infof("Removing static IP %s so the load balancer gets a new one", ip)
+			unstructured.RemoveNestedField(obj.Object, "spec", "loadBalancerIP")
+		}
+		delete(annotations, loadBalancerIPsAnnotation)
+	}
+
+	if len(annotations) == 0 {
+		annotations = nil
+	}
+	obj.SetAnnotations(annotations)
+	return velero.NewRestoreItemActionExecuteOutput(obj), nil
+}
+
+// reserve makes sure a load balancer's static IP is reserved in the
+// destination project and reports whether it has to be stripped instead.
+func (a *LoadBalancerAction) reserve(log logrus.FieldLogger, obj *unstructured.Unstructured, ip, subnet string, internal bool) (bool, error) {
+	reserved, err := a.addresses.reserved(ip)
+	if err != nil {
+		return false, err
+	}
+	if reserved {
+		return false, nil
+	}
+	if !internal {
+		// external IPs are allocated by Google, so they can't be
+		// reserved in another project
+		log.Warnf("Static IP %s isn't reserved in the destination project and external IPs can't be reserved by address, so the load balancer gets a new one", ip)
+		return true, nil
+	}
+
+	name := strings.TrimRight(sanitizeLabelValue("velero-"+obj.GetNamespace()+"-"+obj.GetName()), "-_")
+	if err := a.addresses.reserveInternal(name, ip, subnet); err != nil {
+		return false, err
+	}
+	log.Infof("Reserved internal IP %s as %s", ip, name)
+	return false, nil
+}
+
+func isInternalLoadBalancer(annotations map[string]string) bool {
+	return strings.EqualFold(annotations[loadBalancerTypeAnnotation], "Internal") ||
+		strings.EqualFold(annotations[legacyLoadBalancerTypeAnnotation], "Internal")
+}
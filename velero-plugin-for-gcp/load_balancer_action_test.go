@@ -0,0 +1,124 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vmware-tanzu/velero/pkg/plugin/velero"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+
+	velerotest "github.com/vmware-tanzu/velero/pkg/test"
+)
+
+type fakeAddresses struct {
+	reservedIPs map[string]bool
+	reserveds   []string
+}
+
+func (f *fakeAddresses) reserved(ip string) (bool, error) {
+	return f.reservedIPs[ip], nil
+}
+
+func (f *fakeAddresses) reserveInternal(name, ip, subnet string) error {
+	f.reserveds = append(f.reserveds, name+" "+ip+" "+subnet)
+	return nil
+}
+
+func newLoadBalancerService(ip string, annotations map[string]string) *unstructured.Unstructured {
+	svc := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "v1",
+		"kind":       "Service",
+		"metadata":   map[string]interface{}{"namespace": "shop", "name": "frontend"},
+		"spec":       map[string]interface{}{"type": "LoadBalancer", "loadBalancerIP": ip},
+	}}
+	svc.SetAnnotations(annotations)
+	return svc
+}
+
+func TestLoadBalancerActionExecute(t *testing.T) {
+	tests := []struct {
+		name                string
+		config              map[string]string
+		service             *unstructured.Unstructured
+		expectedIP          string
+		expectedAnnotations map[string]string
+		expectedReserved    []string
+	}{
+		{
+			name:       "static IPs are kept by default",
+			service:    newLoadBalancerService("35.1.2.3", nil),
+			expectedIP: "35.1.2.3",
+		},
+		{
+			name:                "strip removes static IPs",
+			config:              map[string]string{staticIPsConfigKey: staticIPsStrip},
+			service:             newLoadBalancerService("35.1.2.3", map[string]string{loadBalancerIPsAnnotation: "frontend-ip"}),
+			expectedAnnotations: nil,
+		},
+		{
+			name:       "reserve keeps IPs already reserved",
+			config:     map[string]string{staticIPsConfigKey: staticIPsReserve},
+			service:    newLoadBalancerService("35.1.2.3", nil),
+			expectedIP: "35.1.2.3",
+		},
+		{
+			name:    "reserve strips unreserved external IPs",
+			config:  map[string]string{staticIPsConfigKey: staticIPsReserve},
+			service: newLoadBalancerService("35.9.9.9", nil),
+		},
+		{
+			name:   "reserve reserves internal IPs in the mapped subnet",
+			config: map[string]string{staticIPsConfigKey: staticIPsReserve, subnetsConfigKey: "old-subnet: new-subnet"},
+			service: newLoadBalancerService("10.0.0.5", map[string]string{
+				loadBalancerTypeAnnotation: "Internal",
+				internalSubnetAnnotation:   "old-subnet",
+			}),
+			expectedIP: "10.0.0.5",
+			expectedAnnotations: map[string]string{
+				loadBalancerTypeAnnotation: "Internal",
+				internalSubnetAnnotation:   "new-subnet",
+			},
+			expectedReserved: []string{"velero-shop-frontend 10.0.0.5 new-subnet"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			addresses := &fakeAddresses{reservedIPs: map[string]bool{"35.1.2.3": true}}
+			action := &LoadBalancerAction{
+				log:       velerotest.NewLogger(),
+				cluster:   &fakeCluster{configs: map[string]map[string]string{loadBalancerActionName: test.config}},
+				addresses: addresses,
+			}
+
+			out, err := action.Execute(&velero.RestoreItemActionExecuteInput{Item: test.service})
+			require.NoError(t, err)
+
+			updated := &unstructured.Unstructured{Object: out.UpdatedItem.UnstructuredContent()}
+			ip, _, _ := unstructured.NestedString(updated.Object, "spec", "loadBalancerIP")
+			assert.Equal(t, test.expectedIP, ip)
+			assert.Equal(t, test.expectedAnnotations, updated.GetAnnotations())
+			assert.Equal(t, test.expectedReserved, addresses.reserveds)
+		})
+	}
+
+	_, err := parseLoadBalancerConfig(map[string]string{staticIPsConfigKey: "release"})
+	assert.Error(t, err)
+}
@@ -17,23 +17,79 @@ limitations under the License.
 package main
 
 import (
+	"io"
+	"os"
+
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/pflag"
 	veleroplugin "github.com/vmware-tanzu/velero/pkg/plugin/framework"
 )
 
+// commands are the commands the plugin binary runs instead of the plugin
+// server when given their name as first argument.
+var commands = map[string]func(args []string, out io.Writer) int{
+	auditPermissionsCommand:   runPermissionsAudit,
+	listSnapshotsCommand:      runListSnapshots,
+	gcOrphansCommand:          runGCOrphans,
+	verifyBackupCommand:       runVerifyBackup,
+	migrateLabelsCommand:      runMigrateLabels,
+	gcRestoreArtifactsCommand: runGCRestoreArtifacts,
+	repositoryHintsCommand:    runRepositoryHints,
+	gcBackupArtifactsCommand:  runGCBackupArtifacts,
+	verifyBackupsCommand:      runVerifyBackups,
+	healthCheckCommand:        runHealthCheck,
+	applyTieringCommand:       runApplyTiering,
+	rehearseRestoreCommand:    runRehearseRestore,
+	replicateBackupsCommand:   runReplicateBackups,
+	exportRestoredCommand:     runExportRestored,
+	collectInventoryCommand:   runCollectInventory,
+}
+
 func main() {
+	if len(os.Args) > 1 {
+		if run, ok := commands[os.Args[1]]; ok {
+			os.Exit(run(os.Args[2:], os.Stdout))
+		}
+	}
+
 	veleroplugin.NewServer().
 		BindFlags(pflag.CommandLine).
-		RegisterObjectStore("velero.io/gcp", newGCPObjectStore).
-		RegisterVolumeSnapshotter("velero.io/gcp", newGCPVolumeSnapshotter).
+		RegisterObjectStore("velero.io/gcp", withCloudLogging(newGCPObjectStore)).
+		RegisterVolumeSnapshotter("velero.io/gcp", withCloudLogging(newGCPVolumeSnapshotter)).
+		RegisterBackupItemAction(diskMetadataActionName, withCloudLogging(newDiskMetadataAction)).
+		RegisterBackupItemAction(ingressConfigActionName, withCloudLogging(newIngressConfigAction)).
+		RegisterBackupItemAction(volumeOrderActionName, withCloudLogging(newVolumeOrderAction)).
+		RegisterBackupItemAction(configConnectorActionName, withCloudLogging(newConfigConnectorBackupAction)).
+		RegisterBackupItemAction(cloudSQLActionName, withCloudLogging(newCloudSQLAction)).
+		RegisterBackupItemAction(gatewayPolicyActionName, withCloudLogging(newGatewayPolicyBackupAction)).
+		RegisterBackupItemAction(clusterContextActionName, withCloudLogging(newClusterContextAction)).
+		RegisterBackupItemAction(assetInventoryActionName, withCloudLogging(newAssetInventoryAction)).
+		RegisterRestoreItemAction(serviceAccountActionName, withCloudLogging(newServiceAccountAction)).
+		RegisterRestoreItemAction(projectIDActionName, withCloudLogging(newProjectIDAction)).
+		RegisterRestoreItemAction(storageClassRegionActionName, withCloudLogging(newStorageClassRegionAction)).
+		RegisterRestoreItemAction(cmekKeyActionName, withCloudLogging(newCMEKKeyAction)).
+		RegisterRestoreItemAction(loadBalancerActionName, withCloudLogging(newLoadBalancerAction)).
+		RegisterRestoreItemAction(negStatusActionName, withCloudLogging(newNEGStatusAction)).
+		RegisterRestoreItemAction(csiMigrationActionName, withCloudLogging(newCSIMigrationAction)).
+		RegisterRestoreItemAction(provisionerActionName, withCloudLogging(newProvisionerAction)).
+		RegisterRestoreItemAction(volumeTopologyActionName, withCloudLogging(newVolumeTopologyAction)).
+		RegisterRestoreItemAction(regionalVolumeActionName, withCloudLogging(newRegionalVolumeAction)).
+		RegisterRestoreItemAction(diskTagsActionName, withCloudLogging(newDiskTagsAction)).
+		RegisterRestoreItemAction(configConnectorActionName, withCloudLogging(newConfigConnectorRestoreAction)).
+		RegisterRestoreItemAction(gatewayPolicyActionName, withCloudLogging(newGatewayPolicyRestoreAction)).
+		RegisterDeleteItemAction(snapshotCleanupActionName, withCloudLogging(newSnapshotCleanupAction)).
+		RegisterDeleteItemAction(cloudSQLActionName, withCloudLogging(newCloudSQLCleanupAction)).
 		Serve()
 }
 
 func newGCPObjectStore(logger logrus.FieldLogger) (interface{}, error) {
-	return newObjectStore(logger), nil
+	o := newObjectStore(logger)
+	o.deferInit = true
+	return o, nil
 }
 
 func newGCPVolumeSnapshotter(logger logrus.FieldLogger) (interface{}, error) {
-	return newVolumeSnapshotter(logger), nil
+	b := newVolumeSnapshotter(logger)
+	b.deferInit = true
+	return b, nil
 }
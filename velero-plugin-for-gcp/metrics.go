@@ -0,0 +1,262 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+// metricsAddressEnvVar is the environment variable holding the address the
+// plugin serves Prometheus metrics on, e.g. ":8086". Metrics are only served
+// when it is set.
+const metricsAddressEnvVar = "VELERO_GCP_PLUGIN_METRICS_ADDRESS"
+
+// metricsRegistry holds the plugin's metrics and renders them in the
+// Prometheus text exposition format.
+type metricsRegistry struct {
+	lock    sync.Mutex
+	metrics map[string]*metric
+}
+
+type metric struct {
+	name    string
+	help    string
+	kind    string
+	samples map[string]*sample
+}
+
+type sample struct {
+	labels map[string]string
+	value  float64
+
+	// buckets are the upper bounds of a histogram's buckets, and counts
+	// the number of observations in each, not cumulated.
+	buckets []float64
+	counts  []float64
+	sum     float64
+}
+
+var (
+	pluginMetrics     = newMetricsRegistry()
+	metricsServerOnce sync.Once
+)
+
+func newMetricsRegistry() *metricsRegistry {
+	return &metricsRegistry{metrics: make(map[string]*metric)}
+}
+
+func (r *metricsRegistry) get(name, help, kind string) *metric {
+	m, ok := r.metrics[name]
+	if !ok {
+		m = &metric{name: name, help: help, kind: kind, samples: make(map[string]*sample)}
+		r.metrics[name] = m
+	}
+	return m
+}
+
+func (m *metric) sample(labels map[string]string) *sample {
+	key := labelString(labels)
+	s, ok := m.samples[key]
+	if !ok {
+		copied := make(map[string]string, len(labels))
+		for k, v := range labels {
+			copied[k] = v
+		}
+		s = &sample{labels: copied}
+		m.samples[key] = s
+	}
+	return s
+}
+
+// setGauge sets the value of the gauge with the given name and labels.
+func (r *metricsRegistry) setGauge(name, help string, labels map[string]string, value float64) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.get(name, help, "gauge").sample(labels).value = value
+}
+
+// addCounter increments the counter with the given name and labels.
+func (r *metricsRegistry) addCounter(name, help string, labels map[string]string, value float64) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.get(name, help, "counter").sample(labels).value += value
+}
+
+// observeHistogram adds an observation to the histogram with the given name
+// and labels, whose buckets have the given upper bounds, in increasing order.
+func (r *metricsRegistry) observeHistogram(name, help string, labels map[string]string, buckets []float64, value float64) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	s := r.get(name, help, "histogram").sample(labels)
+	if s.buckets == nil {
+		s.buckets, s.counts = buckets, make([]float64, len(buckets))
+	}
+	for i, bound := range s.buckets {
+		if value <= bound {
+			s.counts[i]++
+			break
+		}
+	}
+	s.value++
+	s.sum += value
+}
+
+// deleteMatching removes all samples of the named metric whose labels
+// include every label in match.
+func (r *metricsRegistry) deleteMatching(name string, match map[string]string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	m, ok := r.metrics[name]
+	if !ok {
+		return
+	}
+	for key, s := range m.samples {
+		matches := true
+		for k, v := range match {
+			if s.labels[k] != v {
+				matches = false
+				break
+			}
+		}
+		if matches {
+			delete(m.samples, key)
+		}
+	}
+}
+
+// each calls fn with every sample of every metric, in no particular order,
+// while holding the registry's lock.
+func (r *metricsRegistry) each(fn func(m *metric, s *sample)) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	for _, m := range r.metrics {
+		for _, s := range m.samples {
+			fn(m, s)
+		}
+	}
+}
+
+func (r *metricsRegistry) write(w io.Writer) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	names := make([]string, 0, len(r.metrics))
+	for name := range r.metrics {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		m := r.metrics[name]
+		fmt.Fprintf(w, "# HELP %s %s\n", m.name, m.help)
+		fmt.Fprintf(w, "# TYPE %s %s\n", m.name, m.kind)
+
+		keys := make([]string, 0, len(m.samples))
+		for key := range m.samples {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			s := m.samples[key]
+			if m.kind != "histogram" {
+				fmt.Fprintf(w, "%s%s %s\n", m.name, key, formatFloat(s.value))
+				continue
+			}
+
+			// histograms have cumulative buckets, the last one counting
+			// every observation
+			bucketLabels := make(map[string]string, len(s.labels)+1)
+			for k, v := range s.labels {
+				bucketLabels[k] = v
+			}
+			cumulative := 0.0
+			for i, bound := range s.buckets {
+				cumulative += s.counts[i]
+				bucketLabels["le"] = formatFloat(bound)
+				fmt.Fprintf(w, "%s_bucket%s %s\n", m.name, labelString(bucketLabels), formatFloat(cumulative))
+			}
+			bucketLabels["le"] = "+Inf"
+			fmt.Fprintf(w, "%s_bucket%s %s\n", m.name, labelString(bucketLabels), formatFloat(s.value))
+			fmt.Fprintf(w, "%s_sum%s %s\n", m.name, key, formatFloat(s.sum))
+			fmt.Fprintf(w, "%s_count%s %s\n", m.name, key, formatFloat(s.value))
+		}
+	}
+}
+
+func (r *metricsRegistry) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	r.write(w)
+}
+
+func formatFloat(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+// labelString renders labels as {k1="v1",k2="v2"} with keys sorted.
+func labelString(labels map[string]string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	pairs := make([]string, 0, len(keys))
+	for _, k := range keys {
+		pairs = append(pairs, fmt.Sprintf("%s=%q", k, labels[k]))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// startMetricsServer serves the plugin's metrics on the address from the
+// environment, if any. It is safe to call more than once. Only the
+// long-running commands serve metrics: Velero runs the plugin server in
+// several processes at once, which would compete for the address.
+func startMetricsServer(log logrus.FieldLogger) {
+	addr := os.Getenv(metricsAddressEnvVar)
+	if addr == "" {
+		return
+	}
+
+	metricsServerOnce.Do(func() {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", pluginMetrics)
+
+		go func() {
+			if err := http.ListenAndServe(addr, mux); err != nil {
+				log.WithError(err).Warnf("Unable to serve plugin metrics on %s", addr)
+			}
+		}()
+	})
+}
@@ -0,0 +1,71 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMetricsRegistry(t *testing.T) {
+	r := newMetricsRegistry()
+
+	r.setGauge("test_gauge", "A gauge.", map[string]string{"b": "2", "a": "1"}, 3)
+	r.setGauge("test_gauge", "A gauge.", map[string]string{"a": "x"}, 4)
+	r.setGauge("test_gauge", "A gauge.", map[string]string{"a": "x"}, 5)
+	r.addCounter("test_counter", "A counter.", nil, 1)
+	r.addCounter("test_counter", "A counter.", nil, 2)
+
+	buf := new(bytes.Buffer)
+	r.write(buf)
+	assert.Equal(t, `# HELP test_counter A counter.
+# TYPE test_counter counter
+test_counter 3
+# HELP test_gauge A gauge.
+# TYPE test_gauge gauge
+test_gauge{a="1",b="2"} 3
+test_gauge{a="x"} 5
+`, buf.String())
+
+	r.deleteMatching("test_gauge", map[string]string{"a": "1"})
+	buf.Reset()
+	r.write(buf)
+	assert.NotContains(t, buf.String(), `test_gauge{a="1",b="2"}`)
+	assert.Contains(t, buf.String(), `test_gauge{a="x"} 5`)
+}
+
+func TestMetricsRegistryHistogram(t *testing.T) {
+	r := newMetricsRegistry()
+	buckets := []float64{0.1, 1}
+	labels := map[string]string{"service": "compute"}
+	r.observeHistogram("test_seconds", "A histogram.", labels, buckets, 0.05)
+	r.observeHistogram("test_seconds", "A histogram.", labels, buckets, 0.5)
+	r.observeHistogram("test_seconds", "A histogram.", labels, buckets, 5)
+
+	buf := new(bytes.Buffer)
+	r.write(buf)
+	assert.Equal(t, `# HELP test_seconds A histogram.
+# TYPE test_seconds histogram
+test_seconds_bucket{le="0.1",service="compute"} 1
+test_seconds_bucket{le="1",service="compute"} 2
+test_seconds_bucket{le="+Inf",service="compute"} 3
+test_seconds_sum{service="compute"} 5.55
+test_seconds_count{service="compute"} 3
+`, buf.String())
+}
@@ -0,0 +1,55 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/tls"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	clientCertificateFileConfigKey = "clientCertificateFile"
+	clientKeyFileConfigKey         = "clientKeyFile"
+
+	// useClientCertificateEnvVar must be "true" for the client libraries to
+	// present client certificates.
+	useClientCertificateEnvVar = "GOOGLE_API_USE_CLIENT_CERTIFICATE"
+)
+
+// loadClientCertificate returns the client certificate configured for mTLS
+// with Google APIs, or nil if there is none.
+func loadClientCertificate(config map[string]string) (*tls.Certificate, error) {
+	certFile, keyFile := config[clientCertificateFileConfigKey], config[clientKeyFileConfigKey]
+	if certFile == "" && keyFile == "" {
+		return nil, nil
+	}
+	if certFile == "" || keyFile == "" {
+		return nil, errors.Errorf("%s and %s must be set together", clientCertificateFileConfigKey, clientKeyFileConfigKey)
+	}
+	if !strings.EqualFold(os.Getenv(useClientCertificateEnvVar), "true") {
+		return nil, errors.Errorf("%s requires the %s environment variable to be set to true on the Velero deployment", clientCertificateFileConfigKey, useClientCertificateEnvVar)
+	}
+
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error loading client certificate %v", certFile)
+	}
+	return &cert, nil
+}
@@ -0,0 +1,85 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writeClientCertificate writes a self-signed certificate and its key to dir.
+func writeClientCertificate(t *testing.T, dir string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "velero"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	certFile, keyFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+	require.NoError(t, ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	require.NoError(t, ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600))
+	return certFile, keyFile
+}
+
+func TestLoadClientCertificate(t *testing.T) {
+	certFile, keyFile := writeClientCertificate(t, t.TempDir())
+	config := map[string]string{
+		clientCertificateFileConfigKey: certFile,
+		clientKeyFileConfigKey:         keyFile,
+	}
+
+	cert, err := loadClientCertificate(map[string]string{})
+	require.NoError(t, err)
+	assert.Nil(t, cert)
+
+	_, err = loadClientCertificate(map[string]string{clientCertificateFileConfigKey: certFile})
+	assert.Error(t, err, "a certificate without a key is rejected")
+
+	t.Setenv(useClientCertificateEnvVar, "")
+	_, err = loadClientCertificate(config)
+	assert.Error(t, err, "the client libraries ignore certificates unless enabled in the environment")
+
+	t.Setenv(useClientCertificateEnvVar, "true")
+	cert, err = loadClientCertificate(config)
+	require.NoError(t, err)
+	assert.NotNil(t, cert)
+
+	c, err := newLocationCredentials(&fakeSecrets{}, config, "")
+	require.NoError(t, err)
+	assert.Len(t, c.sharedOptions(), 1)
+}
@@ -0,0 +1,101 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"github.com/sirupsen/logrus"
+	"github.com/vmware-tanzu/velero/pkg/plugin/velero"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+const negStatusActionName = "velero.io/gcp-neg-status"
+
+// controllerAnnotations are the annotations the GKE ingress and NEG
+// controllers record the cloud resources they manage in. Restored ones refer
+// to resources of the source cluster, which the controllers would try to
+// reconcile instead of creating their own.
+var controllerAnnotations = map[string][]string{
+	"Service": {
+		"cloud.google.com/neg-status",
+	},
+	"Ingress": {
+		"ingress.kubernetes.io/backends",
+		"ingress.kubernetes.io/forwarding-rule",
+		"ingress.kubernetes.io/https-forwarding-rule",
+		"ingress.kubernetes.io/target-proxy",
+		"ingress.kubernetes.io/https-target-proxy",
+		"ingress.kubernetes.io/url-map",
+		"ingress.kubernetes.io/redirect-url-map",
+		"ingress.kubernetes.io/ssl-cert",
+		"ingress.kubernetes.io/static-ip",
+	},
+}
+
+// controllerFinalizers are the finalizers the GKE ingress controller adds to
+// the Ingresses it manages, which it adds again once it takes over a
+// restored Ingress.
+var controllerFinalizers = map[string]bool{
+	"networking.gke.io/ingress-finalizer":    true,
+	"networking.gke.io/ingress-finalizer-V2": true,
+}
+
+// NEGStatusAction is a restore item action that removes the state the GKE
+// ingress and NEG controllers keep on Services and Ingresses, so they create
+// network endpoint groups and load balancers for the restored resources
+// from scratch.
+type NEGStatusAction struct {
+	log logrus.FieldLogger
+}
+
+func newNEGStatusAction(logger logrus.FieldLogger) (interface{}, error) {
+	return &NEGStatusAction{log: logger}, nil
+}
+
+func (a *NEGStatusAction) AppliesTo() (velero.ResourceSelector, error) {
+	return velero.ResourceSelector{
+		IncludedResources: []string{"services", "ingresses"},
+	}, nil
+}
+
+func (a *NEGStatusAction) Execute(input *velero.RestoreItemActionExecuteInput) (*velero.RestoreItemActionExecuteOutput, error) {
+	obj := &unstructured.Unstructured{Object: input.Item.UnstructuredContent()}
+	log := a.log.WithField(obj.GetKind(), obj.GetNamespace()+"/"+obj.GetName())
+
+	annotations := obj.GetAnnotations()
+	for _, key := range controllerAnnotations[obj.GetKind()] {
+		if _, ok := annotations[key]; ok {
+			log.Infof("Removing controller-owned annotation %s", key)
+			delete(annotations, key)
+		}
+	}
+	if len(annotations) == 0 {
+		annotations = nil
+	}
+	obj.SetAnnotations(annotations)
+
+	var finalizers []string
+	for _, f := range obj.GetFinalizers() {
+		if controllerFinalizers[f] {
+			log.Infof("Removing controller-owned finalizer %s", f)
+			continue
+		}
+		finalizers = append(finalizers, f)
+	}
+	obj.SetFinalizers(finalizers)
+
+	return velero.NewRestoreItemActionExecuteOutput(obj), nil
+}
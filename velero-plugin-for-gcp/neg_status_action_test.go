@@ -0,0 +1,94 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vmware-tanzu/velero/pkg/plugin/velero"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+
+	velerotest "github.com/vmware-tanzu/velero/pkg/test"
+)
+
+func TestNEGStatusActionExecute(t *testing.T) {
+	tests := []struct {
+		name                string
+		kind                string
+		annotations         map[string]string
+		finalizers          []string
+		expectedAnnotations map[string]string
+		expectedFinalizers  []string
+	}{
+		{
+			name: "service NEG status is removed",
+			kind: "Service",
+			annotations: map[string]string{
+				"cloud.google.com/neg":        `{"ingress": true}`,
+				"cloud.google.com/neg-status": `{"network_endpoint_groups":{"80":"k8s1-abc"},"zones":["us-central1-a"]}`,
+			},
+			expectedAnnotations: map[string]string{"cloud.google.com/neg": `{"ingress": true}`},
+		},
+		{
+			name: "ingress load balancer state and finalizers are removed",
+			kind: "Ingress",
+			annotations: map[string]string{
+				"kubernetes.io/ingress.global-static-ip-name": "web",
+				"ingress.kubernetes.io/backends":              `{"k8s1-abc":"HEALTHY"}`,
+				"ingress.kubernetes.io/url-map":               "k8s2-um-abc",
+				"ingress.kubernetes.io/forwarding-rule":       "k8s2-fr-abc",
+			},
+			finalizers:          []string{"networking.gke.io/ingress-finalizer-V2", "example.com/keep"},
+			expectedAnnotations: map[string]string{"kubernetes.io/ingress.global-static-ip-name": "web"},
+			expectedFinalizers:  []string{"example.com/keep"},
+		},
+		{
+			name:        "only state annotations are removed",
+			kind:        "Ingress",
+			annotations: map[string]string{"ingress.kubernetes.io/static-ip": "k8s2-fr-abc"},
+		},
+		{
+			name: "ingress annotations on services are kept",
+			kind: "Service",
+			annotations: map[string]string{
+				"ingress.kubernetes.io/backends": "custom",
+			},
+			expectedAnnotations: map[string]string{"ingress.kubernetes.io/backends": "custom"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			item := &unstructured.Unstructured{}
+			item.SetKind(test.kind)
+			item.SetNamespace("shop")
+			item.SetName("web")
+			item.SetAnnotations(test.annotations)
+			item.SetFinalizers(test.finalizers)
+
+			action := &NEGStatusAction{log: velerotest.NewLogger()}
+			out, err := action.Execute(&velero.RestoreItemActionExecuteInput{Item: item})
+			require.NoError(t, err)
+
+			restored := out.UpdatedItem.(*unstructured.Unstructured)
+			assert.Equal(t, test.expectedAnnotations, restored.GetAnnotations())
+			assert.Equal(t, test.expectedFinalizers, restored.GetFinalizers())
+		})
+	}
+}
@@ -0,0 +1,456 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	pubsub "google.golang.org/api/pubsub/v1"
+)
+
+const (
+	// pubsubTopicConfigKey is the config key holding the Pub/Sub topic
+	// backup lifecycle events are published to, as
+	// projects/PROJECT/topics/TOPIC.
+	pubsubTopicConfigKey = "pubsubTopic"
+
+	snapshotCreatedEvent = "SnapshotCreated"
+	snapshotDeletedEvent = "SnapshotDeleted"
+	backupUploadedEvent  = "BackupUploaded"
+	backupFinishedEvent  = "BackupFinished"
+	restoreFinishedEvent = "RestoreFinished"
+
+	// cloudEventsSpecVersion is the version of the CloudEvents spec the
+	// messages' ce- attributes follow, so Eventarc and CloudEvents SDKs
+	// read them as events in binary content mode.
+	cloudEventsSpecVersion = "1.0"
+	// cloudEventTypePrefix prefixes the event types in the ce-type
+	// attribute.
+	cloudEventTypePrefix = "io.velero.gcp."
+
+	// publishTimeout bounds how long an event may delay the operation that
+	// emitted it.
+	publishTimeout = 10 * time.Second
+
+	// maxBackupMetadataSize is the most of a backup's metadata file, or of a
+	// restore's results, read to find the backup's phase and schedule or the
+	// restore's errors and warnings.
+	maxBackupMetadataSize = 1 << 20
+)
+
+// backupFinishedFiles are the files of a backup, besides its tarball, that
+// Velero uploads last, after which the backup is finished.
+var backupFinishedFiles = []string{"-podvolumebackups.json.gz", "-volumesnapshots.json.gz", "-resource-list.json.gz"}
+
+// backupEvent is the JSON payload of the messages published for backup
+// lifecycle events. Fields that don't apply to an event are omitted.
+type backupEvent struct {
+	Type     string    `json:"type"`
+	Time     time.Time `json:"time"`
+	Backup   string    `json:"backup,omitempty"`
+	Restore  string    `json:"restore,omitempty"`
+	Schedule string    `json:"schedule,omitempty"`
+	Snapshot string    `json:"snapshot,omitempty"`
+	Volume   string    `json:"volume,omitempty"`
+	Zone     string    `json:"zone,omitempty"`
+	Project  string    `json:"project,omitempty"`
+	Bucket   string    `json:"bucket,omitempty"`
+	Object   string    `json:"object,omitempty"`
+	Bytes    int64     `json:"bytes,omitempty"`
+	Phase    string    `json:"phase,omitempty"`
+	Errors   int       `json:"errors,omitempty"`
+	Warnings int       `json:"warnings,omitempty"`
+	// Location is the gs:// URI of the directory of a finished backup or
+	// restore, and Artifacts the gs:// URIs of the files uploaded to it.
+	Location  string   `json:"location,omitempty"`
+	Artifacts []string `json:"artifacts,omitempty"`
+}
+
+// eventPublisher publishes backup lifecycle events to a Pub/Sub topic. The
+// Pub/Sub client is created with the location's credentials on the first
+// event. Publishing is best effort: failures are logged and never fail the
+// operation that emitted the event. A nil publisher publishes nothing.
+type eventPublisher struct {
+	log         logrus.FieldLogger
+	topic       string
+	credentials locationCredentials
+
+	lock sync.Mutex
+	svc  *pubsub.Service
+}
+
+// newEventPublisher returns a publisher to the topic in the config, or nil
+// if none is configured.
+func newEventPublisher(log logrus.FieldLogger, config map[string]string, credentials locationCredentials) *eventPublisher {
+	topic := config[pubsubTopicConfigKey]
+	if topic == "" {
+		return nil
+	}
+	return &eventPublisher{
+		log:         log.WithField("topic", topic),
+		topic:       topic,
+		credentials: credentials,
+	}
+}
+
+func (p *eventPublisher) service(ctx context.Context) (*pubsub.Service, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.svc == nil {
+		opts, err := p.credentials.clientOptions(ctx, pubsub.PubsubScope)
+		if err != nil {
+			return nil, err
+		}
+		if opts, err = instrumentClientOptions(ctx, p.log, pubsubService, opts); err != nil {
+			return nil, err
+		}
+		if p.svc, err = pubsub.NewService(ctx, opts...); err != nil {
+			return nil, errors.WithStack(err)
+		}
+	}
+	return p.svc, nil
+}
+
+// publish publishes an event, with its type, backup and restore as message
+// attributes so subscriptions can filter on them, and the CloudEvents
+// attributes Eventarc triggers and CloudEvents SDKs expect.
+func (p *eventPublisher) publish(event backupEvent) {
+	if p == nil {
+		return
+	}
+	if event.Time.IsZero() {
+		event.Time = time.Now().UTC()
+	}
+	log := p.log.WithField("eventType", event.Type)
+	if err := p.send(event); err != nil {
+		log.WithError(err).Warn("Error publishing backup event to Pub/Sub")
+		return
+	}
+	log.Debug("Published backup event to Pub/Sub")
+}
+
+func (p *eventPublisher) send(event backupEvent) error {
+	ctx, cancel := context.WithTimeout(context.Background(), publishTimeout)
+	defer cancel()
+
+	svc, err := p.service(ctx)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(event)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	attributes := cloudEventAttributes(event)
+	attributes["eventType"] = event.Type
+	if event.Backup != "" {
+		attributes["backup"] = event.Backup
+	}
+	if event.Restore != "" {
+		attributes["restore"] = event.Restore
+	}
+
+	req := &pubsub.PublishRequest{Messages: []*pubsub.PubsubMessage{{
+		Data:       base64.StdEncoding.EncodeToString(data),
+		Attributes: attributes,
+	}}}
+	_, err = svc.Projects.Topics.Publish(p.topic, req).Context(ctx).Do()
+	return errors.Wrapf(err, "error publishing to %s", p.topic)
+}
+
+// cloudEventAttributes returns the attributes of the Pub/Sub binding of
+// CloudEvents for an event: a message whose data is the event's JSON and
+// whose ce- attributes describe it.
+func cloudEventAttributes(event backupEvent) map[string]string {
+	id := make([]byte, 16)
+	rand.Read(id)
+
+	attributes := map[string]string{
+		"ce-specversion": cloudEventsSpecVersion,
+		"ce-id":          hex.EncodeToString(id),
+		"ce-type":        cloudEventTypePrefix + event.Type,
+		"ce-source":      "//velero.io/namespaces/" + veleroNamespace(),
+		"ce-time":        event.Time.Format(time.RFC3339Nano),
+		"content-type":   "application/json",
+	}
+	switch {
+	case event.Restore != "":
+		attributes["ce-subject"] = "restores/" + event.Restore
+	case event.Backup != "":
+		attributes["ce-subject"] = "backups/" + event.Backup
+	case event.Snapshot != "":
+		attributes["ce-subject"] = "snapshots/" + event.Snapshot
+	}
+	return attributes
+}
+
+// backupObject returns the backup an object key belongs to and the name of
+// the object within the backup's directory, for keys of the form
+// [PREFIX/]backups/BACKUP/FILE.
+func backupObject(key string) (string, string) {
+	parts := strings.Split(key, "/")
+	n := len(parts)
+	if n < 3 || parts[n-3] != strings.TrimSuffix(backupsDir, "/") {
+		return "", ""
+	}
+	return parts[n-2], parts[n-1]
+}
+
+// restoreObject returns the restore an object key belongs to and the name
+// of the object within the restore's directory, for keys of the form
+// [PREFIX/]restores/RESTORE/FILE.
+func restoreObject(key string) (string, string) {
+	parts := strings.Split(key, "/")
+	n := len(parts)
+	if n < 3 || parts[n-3] != "restores" {
+		return "", ""
+	}
+	return parts[n-2], parts[n-1]
+}
+
+// restoreResultsFile returns the name of a restore's results file, which
+// Velero uploads last, once the restore is finished.
+func restoreResultsFile(restore string) string {
+	return "restore-" + restore + "-results.gz"
+}
+
+// isParsedUpload reports whether an object is read while it's uploaded: a
+// backup's metadata file or a restore's results.
+func isParsedUpload(key string) bool {
+	if _, file := backupObject(key); file == backupMetadataFile {
+		return true
+	}
+	restore, file := restoreObject(key)
+	return restore != "" && file == restoreResultsFile(restore)
+}
+
+// backupUploadState records what's known about the backups and restores
+// being uploaded: the files uploaded to their directories, the backups'
+// phase and schedule from their metadata file, which Velero uploads before
+// their contents, and the restores' errors and warnings from their results.
+type backupUploadState struct {
+	lock     sync.Mutex
+	backups  map[string]backupMetadata
+	restores map[string]restoreResults
+	files    map[string][]string
+	// metadata holds what was read of the parsed objects being uploaded,
+	// by key.
+	metadata map[string]*bytes.Buffer
+}
+
+type backupMetadata struct {
+	phase    string
+	schedule string
+}
+
+type restoreResults struct {
+	errors   int
+	warnings int
+}
+
+// watch returns a reader of an object's body, which records the backup's
+// phase and schedule from it if it's a backup's metadata file, or the
+// restore's errors and warnings if it's a restore's results.
+func (s *backupUploadState) watch(key string, body io.Reader) io.Reader {
+	if !isParsedUpload(key) {
+		return body
+	}
+	buf := new(bytes.Buffer)
+	s.lock.Lock()
+	if s.metadata == nil {
+		s.metadata = make(map[string]*bytes.Buffer)
+	}
+	s.metadata[key] = buf
+	s.lock.Unlock()
+	return io.TeeReader(body, &limitedWriter{w: buf, n: maxBackupMetadataSize})
+}
+
+// discard drops what was read of an object whose upload failed, so failed
+// uploads don't keep it in memory.
+func (s *backupUploadState) discard(key string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.metadata, key)
+}
+
+// uploaded records that an object of a backup or restore was uploaded,
+// parsing it if it's a backup's metadata file or a restore's results.
+func (s *backupUploadState) uploaded(key string) {
+	backup, _ := backupObject(key)
+	restore, _ := restoreObject(key)
+	if backup == "" && restore == "" {
+		return
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.files == nil {
+		s.files = make(map[string][]string)
+	}
+	dir := path.Dir(key)
+	s.files[dir] = append(s.files[dir], key)
+
+	buf := s.metadata[key]
+	delete(s.metadata, key)
+	if buf == nil {
+		return
+	}
+	if backup != "" {
+		s.parseBackupMetadata(backup, buf.Bytes())
+	} else {
+		s.parseRestoreResults(restore, buf.Bytes())
+	}
+}
+
+func (s *backupUploadState) parseBackupMetadata(backup string, data []byte) {
+	var parsed struct {
+		Metadata struct {
+			Labels map[string]string `json:"labels"`
+		} `json:"metadata"`
+		Status struct {
+			Phase string `json:"phase"`
+		} `json:"status"`
+	}
+	if err := json.Unmarshal(data, &parsed); err != nil {
+		return
+	}
+	if s.backups == nil {
+		s.backups = make(map[string]backupMetadata)
+	}
+	s.backups[backup] = backupMetadata{
+		phase:    parsed.Status.Phase,
+		schedule: parsed.Metadata.Labels[scheduleNameLabel],
+	}
+}
+
+// parseRestoreResults counts the errors and warnings of a restore's
+// results, a gzipped JSON object of its warnings and errors, each made of
+// Velero's, the cluster's and the namespaces' messages.
+func (s *backupUploadState) parseRestoreResults(restore string, data []byte) {
+	type result struct {
+		Velero     []string            `json:"velero"`
+		Cluster    []string            `json:"cluster"`
+		Namespaces map[string][]string `json:"namespaces"`
+	}
+	count := func(r result) int {
+		n := len(r.Velero) + len(r.Cluster)
+		for _, messages := range r.Namespaces {
+			n += len(messages)
+		}
+		return n
+	}
+
+	zr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return
+	}
+	var parsed struct {
+		Errors   result `json:"errors"`
+		Warnings result `json:"warnings"`
+	}
+	if err := json.NewDecoder(zr).Decode(&parsed); err != nil {
+		return
+	}
+	if s.restores == nil {
+		s.restores = make(map[string]restoreResults)
+	}
+	s.restores[restore] = restoreResults{errors: count(parsed.Errors), warnings: count(parsed.Warnings)}
+}
+
+// get returns what's known about a backup from its metadata file.
+func (s *backupUploadState) get(backup string) backupMetadata {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.backups[backup]
+}
+
+// backupFinished returns the sorted keys of the files uploaded to a backup's
+// directory once its tarball and the files Velero uploads last are, and
+// forgets the backup so it's only reported once. It returns nil until then.
+func (s *backupUploadState) backupFinished(dir, backup string) []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	uploaded := make(map[string]bool)
+	for _, key := range s.files[dir] {
+		uploaded[path.Base(key)] = true
+	}
+	if !uploaded[backup+".tar.gz"] {
+		return nil
+	}
+	for _, suffix := range backupFinishedFiles {
+		if !uploaded[backup+suffix] {
+			return nil
+		}
+	}
+	files := s.files[dir]
+	delete(s.files, dir)
+	delete(s.backups, backup)
+	sort.Strings(files)
+	return files
+}
+
+// restoreFinished returns the results of a restore whose results were
+// uploaded and the sorted keys of the files uploaded to its directory, and
+// forgets the restore.
+func (s *backupUploadState) restoreFinished(dir, restore string) (restoreResults, []string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	results, files := s.restores[restore], s.files[dir]
+	delete(s.restores, restore)
+	delete(s.files, dir)
+	sort.Strings(files)
+	return results, files
+}
+
+// limitedWriter writes at most n bytes to w and discards the rest.
+type limitedWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (l *limitedWriter) Write(p []byte) (int, error) {
+	if l.n > 0 {
+		keep := p
+		if int64(len(keep)) > l.n {
+			keep = keep[:l.n]
+		}
+		written, err := l.w.Write(keep)
+		l.n -= int64(written)
+		if err != nil {
+			return written, err
+		}
+	}
+	return len(p), nil
+}
@@ -0,0 +1,265 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	velerotest "github.com/vmware-tanzu/velero/pkg/test"
+	"google.golang.org/api/compute/v1"
+	"google.golang.org/api/option"
+	pubsub "google.golang.org/api/pubsub/v1"
+)
+
+// fakeTopic is a Pub/Sub API recording the messages published to it.
+type fakeTopic struct {
+	lock     sync.Mutex
+	topics   []string
+	messages []*pubsub.PubsubMessage
+	status   int
+}
+
+func (f *fakeTopic) publisher(t *testing.T) *eventPublisher {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		f.lock.Lock()
+		defer f.lock.Unlock()
+		if f.status != 0 {
+			w.WriteHeader(f.status)
+			return
+		}
+		var req pubsub.PublishRequest
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+		f.topics = append(f.topics, strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/v1/"), ":publish"))
+		f.messages = append(f.messages, req.Messages...)
+		json.NewEncoder(w).Encode(&pubsub.PublishResponse{MessageIds: []string{"1"}})
+	}))
+	t.Cleanup(server.Close)
+
+	svc, err := pubsub.NewService(context.Background(), option.WithEndpoint(server.URL), option.WithoutAuthentication())
+	require.NoError(t, err)
+
+	p := newEventPublisher(velerotest.NewLogger(), map[string]string{pubsubTopicConfigKey: "projects/p/topics/velero-events"}, locationCredentials{})
+	p.svc = svc
+	return p
+}
+
+func (f *fakeTopic) events(t *testing.T) []backupEvent {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	var events []backupEvent
+	for _, m := range f.messages {
+		data, err := base64.StdEncoding.DecodeString(m.Data)
+		require.NoError(t, err)
+		var event backupEvent
+		require.NoError(t, json.Unmarshal(data, &event))
+		assert.Equal(t, event.Type, m.Attributes["eventType"])
+		assert.Equal(t, event.Backup, m.Attributes["backup"])
+		assert.Equal(t, event.Restore, m.Attributes["restore"])
+		assert.Equal(t, cloudEventTypePrefix+event.Type, m.Attributes["ce-type"])
+		assert.False(t, event.Time.IsZero())
+		event.Time = event.Time.UTC()
+		events = append(events, event)
+	}
+	return events
+}
+
+func TestEventPublisher(t *testing.T) {
+	assert.Nil(t, newEventPublisher(velerotest.NewLogger(), map[string]string{}, locationCredentials{}))
+	var nilPublisher *eventPublisher
+	nilPublisher.publish(backupEvent{Type: snapshotCreatedEvent})
+
+	topic := &fakeTopic{}
+	p := topic.publisher(t)
+	p.publish(backupEvent{Type: snapshotCreatedEvent, Backup: "nightly", Snapshot: "disk-1-snap", Volume: "disk-1"})
+
+	assert.Equal(t, []string{"projects/p/topics/velero-events"}, topic.topics)
+	events := topic.events(t)
+	require.Len(t, events, 1)
+	assert.Equal(t, "nightly", events[0].Backup)
+	assert.Equal(t, "disk-1-snap", events[0].Snapshot)
+	attributes := topic.messages[0].Attributes
+	assert.Len(t, attributes["ce-id"], 32)
+	assert.Equal(t, map[string]string{
+		"eventType":      snapshotCreatedEvent,
+		"backup":         "nightly",
+		"ce-specversion": "1.0",
+		"ce-id":          attributes["ce-id"],
+		"ce-type":        "io.velero.gcp.SnapshotCreated",
+		"ce-source":      "//velero.io/namespaces/velero",
+		"ce-subject":     "backups/nightly",
+		"ce-time":        events[0].Time.Format(time.RFC3339Nano),
+		"content-type":   "application/json",
+	}, attributes)
+
+	// failures are only logged
+	topic.status = http.StatusForbidden
+	p.publish(backupEvent{Type: snapshotDeletedEvent})
+	assert.Len(t, topic.messages, 1)
+}
+
+func TestBackupObject(t *testing.T) {
+	tests := []struct {
+		key            string
+		backup, object string
+	}{
+		{key: "backups/nightly/velero-backup.json", backup: "nightly", object: "velero-backup.json"},
+		{key: "cluster-a/backups/nightly/nightly.tar.gz", backup: "nightly", object: "nightly.tar.gz"},
+		{key: "restores/nightly/restore-nightly-logs.gz"},
+		{key: "backups/nightly"},
+		{key: "velero-backup.json"},
+	}
+	for _, test := range tests {
+		backup, object := backupObject(test.key)
+		assert.Equal(t, test.backup, backup, test.key)
+		assert.Equal(t, test.object, object, test.key)
+	}
+}
+
+func TestPutObjectPublishesBackupUploaded(t *testing.T) {
+	topic := &fakeTopic{}
+	o := newObjectStore(velerotest.NewLogger())
+	o.setClients(func(c *objectStoreClients) {
+		c.bucketWriter = newFakeWriter(newMockWriteCloser(nil, nil))
+		c.events = topic.publisher(t)
+	})
+
+	metadata := `{"metadata":{"name":"nightly-1","labels":{"velero.io/schedule-name":"nightly"}},"status":{"phase":"Completed"}}`
+	require.NoError(t, o.PutObject("bucket", "cluster-a/backups/nightly-1/nightly-1-logs.gz", strings.NewReader("logs")))
+	require.NoError(t, o.PutObject("bucket", "cluster-a/backups/nightly-1/velero-backup.json", strings.NewReader(metadata)))
+	assert.Empty(t, topic.messages)
+
+	require.NoError(t, o.PutObject("bucket", "cluster-a/backups/nightly-1/nightly-1.tar.gz", strings.NewReader("contents")))
+	assert.Equal(t, []backupEvent{{
+		Type:     backupUploadedEvent,
+		Time:     topic.events(t)[0].Time,
+		Backup:   "nightly-1",
+		Schedule: "nightly",
+		Phase:    "Completed",
+		Bucket:   "bucket",
+		Object:   "cluster-a/backups/nightly-1/nightly-1.tar.gz",
+		Bytes:    int64(len("contents")),
+	}}, topic.events(t))
+
+	// failed uploads publish nothing
+	o.setClients(func(c *objectStoreClients) { c.bucketWriter = newFakeWriter(newMockWriteCloser(nil, assert.AnError)) })
+	assert.Error(t, o.PutObject("bucket", "cluster-a/backups/nightly-2/nightly-2.tar.gz", strings.NewReader("contents")))
+	assert.Len(t, topic.messages, 1)
+
+	// and don't keep the metadata they read
+	assert.Error(t, o.PutObject("bucket", "cluster-a/backups/nightly-2/velero-backup.json", strings.NewReader(metadata)))
+	assert.Empty(t, o.uploads.metadata)
+}
+
+func TestPutObjectPublishesFinishedEvents(t *testing.T) {
+	topic := &fakeTopic{}
+	o := newObjectStore(velerotest.NewLogger())
+	o.setClients(func(c *objectStoreClients) {
+		c.bucketWriter = newFakeWriter(newMockWriteCloser(nil, nil))
+		c.events = topic.publisher(t)
+	})
+
+	// Velero uploads a backup's log, metadata and tarball, then its other
+	// files in any order
+	metadata := `{"metadata":{"name":"nightly-1","labels":{"velero.io/schedule-name":"nightly"}},"status":{"phase":"PartiallyFailed"}}`
+	for _, file := range []string{"nightly-1-logs.gz", "velero-backup.json", "nightly-1.tar.gz", "nightly-1-resource-list.json.gz", "nightly-1-volumesnapshots.json.gz", "nightly-1-podvolumebackups.json.gz"} {
+		require.NoError(t, o.PutObject("bucket", "cluster-a/backups/nightly-1/"+file, strings.NewReader(metadata)))
+	}
+	events := topic.events(t)
+	require.Len(t, events, 2)
+	assert.Equal(t, backupEvent{
+		Type:     backupFinishedEvent,
+		Time:     events[1].Time,
+		Backup:   "nightly-1",
+		Schedule: "nightly",
+		Phase:    "PartiallyFailed",
+		Bucket:   "bucket",
+		Location: "gs://bucket/cluster-a/backups/nightly-1/",
+		Artifacts: []string{
+			"gs://bucket/cluster-a/backups/nightly-1/nightly-1-logs.gz",
+			"gs://bucket/cluster-a/backups/nightly-1/nightly-1-podvolumebackups.json.gz",
+			"gs://bucket/cluster-a/backups/nightly-1/nightly-1-resource-list.json.gz",
+			"gs://bucket/cluster-a/backups/nightly-1/nightly-1-volumesnapshots.json.gz",
+			"gs://bucket/cluster-a/backups/nightly-1/nightly-1.tar.gz",
+			"gs://bucket/cluster-a/backups/nightly-1/velero-backup.json",
+		},
+	}, events[1])
+	assert.Equal(t, "backups/nightly-1", topic.messages[1].Attributes["ce-subject"])
+	assert.Empty(t, o.uploads.files, "finished backups are forgotten")
+
+	// a restore is finished once its results are uploaded
+	results := new(bytes.Buffer)
+	zw := gzip.NewWriter(results)
+	require.NoError(t, json.NewEncoder(zw).Encode(map[string]interface{}{
+		"warnings": map[string]interface{}{"cluster": []string{"w1"}, "namespaces": map[string][]string{"app": {"w2", "w3"}}},
+		"errors":   map[string]interface{}{"velero": []string{"e1"}},
+	}))
+	require.NoError(t, zw.Close())
+	require.NoError(t, o.PutObject("bucket", "cluster-a/restores/nightly-1-r/restore-nightly-1-r-logs.gz", strings.NewReader("logs")))
+	require.NoError(t, o.PutObject("bucket", "cluster-a/restores/nightly-1-r/restore-nightly-1-r-results.gz", results))
+
+	events = topic.events(t)
+	require.Len(t, events, 3)
+	assert.Equal(t, backupEvent{
+		Type:     restoreFinishedEvent,
+		Time:     events[2].Time,
+		Restore:  "nightly-1-r",
+		Phase:    "PartiallyFailed",
+		Errors:   1,
+		Warnings: 3,
+		Bucket:   "bucket",
+		Location: "gs://bucket/cluster-a/restores/nightly-1-r/",
+		Artifacts: []string{
+			"gs://bucket/cluster-a/restores/nightly-1-r/restore-nightly-1-r-logs.gz",
+			"gs://bucket/cluster-a/restores/nightly-1-r/restore-nightly-1-r-results.gz",
+		},
+	}, events[2])
+	assert.Equal(t, "restores/nightly-1-r", topic.messages[2].Attributes["ce-subject"])
+	assert.Empty(t, o.uploads.files)
+	assert.Empty(t, o.uploads.restores)
+}
+
+func TestDeleteSnapshotPublishesSnapshotDeleted(t *testing.T) {
+	gce := newFakeComputeService(t, func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/snapshots/gone") || strings.HasSuffix(r.URL.Path, "/snapshots/gone-archive") {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(&compute.Operation{})
+	})
+
+	topic := &fakeTopic{}
+	b := (&VolumeSnapshotter{log: velerotest.NewLogger(), snapshotProject: "snapshot-project"}).withClients(&snapshotterClients{gce: gce, events: topic.publisher(t)})
+	require.NoError(t, b.DeleteSnapshot("disk-1-snap"))
+	require.NoError(t, b.DeleteSnapshot("gone"))
+
+	events := topic.events(t)
+	require.Len(t, events, 1)
+	assert.Equal(t, backupEvent{Type: snapshotDeletedEvent, Time: events[0].Time, Snapshot: "disk-1-snap", Project: "snapshot-project"}, events[0])
+}
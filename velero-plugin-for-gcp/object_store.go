@@ -20,127 +20,523 @@ import (
 	"context"
 	"encoding/base64"
 	"io"
-	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"cloud.google.com/go/storage"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 	"golang.org/x/oauth2/google"
+	"google.golang.org/api/cloudkms/v1"
+	"google.golang.org/api/googleapi"
 	"google.golang.org/api/iamcredentials/v1"
 	"google.golang.org/api/iterator"
 	"google.golang.org/api/option"
-
-	veleroplugin "github.com/vmware-tanzu/velero/pkg/plugin/framework"
 )
 
 const (
 	kmsKeyNameConfigKey      = "kmsKeyName"
 	serviceAccountConfig     = "serviceAccount"
 	credentialsFileConfigKey = "credentialsFile"
+	requireCMEKConfigKey     = "requireCMEK"
+	uploadChunkSizeConfigKey = "uploadChunkSizeMB"
+
+	readOnlyCredentialsFileConfigKey = "readOnlyCredentialsFile"
+
+	// copyBufferSize is the size of the buffers used to stream objects to
+	// the storage writer.
+	copyBufferSize = 256 * 1024
+	// maxUploadChunkSizeMB is the largest upload chunk size allowed. Each
+	// upload holds a chunk in memory, so larger chunks let a few concurrent
+	// uploads exhaust the memory of the Velero pod.
+	maxUploadChunkSizeMB = 256
+)
+
+var (
+	// storageCallTimeout bounds a Cloud Storage metadata call or delete,
+	// including the client library's retries of transient errors, which
+	// otherwise continue until the call succeeds. It is a variable so tests
+	// can shorten it.
+	storageCallTimeout = 2 * time.Minute
+	// storageListTimeout bounds listing objects, across all pages.
+	storageListTimeout = 10 * time.Minute
 )
 
+// copyBuffers holds the fixed-size buffers PutObject streams through, so
+// memory use doesn't depend on the size of the object being uploaded.
+var copyBuffers = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, copyBufferSize)
+		return &b
+	},
+}
+
 // bucketWriter wraps the GCP SDK functions for accessing object store so they can be faked for testing.
 type bucketWriter interface {
 	// getWriteCloser returns an io.WriteCloser that can be used to upload data to the specified bucket for the specified key.
 	getWriteCloser(bucket, key string) io.WriteCloser
 	getAttrs(bucket, key string) (*storage.ObjectAttrs, error)
+	getBucketAttrs(bucket string) (*storage.BucketAttrs, error)
 }
 
 type writer struct {
 	client     *storage.Client
 	kmsKeyName string
+	// encryptionKey is the customer-supplied key objects are encrypted
+	// with, if any.
+	encryptionKey []byte
+	// chunkSize is the number of bytes buffered in memory for each chunk of
+	// a resumable upload; zero uploads the object in a single request.
+	chunkSize int
 }
 
 func (w *writer) getWriteCloser(bucket, key string) io.WriteCloser {
-	writer := w.client.Bucket(bucket).Object(key).NewWriter(context.Background())
+	writer := w.client.Bucket(bucket).Object(key).Key(w.encryptionKey).NewWriter(context.Background())
 	writer.KMSKeyName = w.kmsKeyName
+	writer.ChunkSize = w.chunkSize
 
 	return writer
 }
 
 func (w *writer) getAttrs(bucket, key string) (*storage.ObjectAttrs, error) {
-	return w.client.Bucket(bucket).Object(key).Attrs(context.Background())
+	ctx, cancel := context.WithTimeout(context.Background(), storageCallTimeout)
+	defer cancel()
+	return w.client.Bucket(bucket).Object(key).Attrs(ctx)
+}
+
+func (w *writer) getBucketAttrs(bucket string) (*storage.BucketAttrs, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), storageCallTimeout)
+	defer cancel()
+	return w.client.Bucket(bucket).Attrs(ctx)
 }
 
 type ObjectStore struct {
-	log            logrus.FieldLogger
-	client         *storage.Client
-	googleAccessID string
-	privateKey     []byte
-	bucketWriter   bucketWriter
-	iamSvc         *iamcredentials.Service
+	log         logrus.FieldLogger
+	cluster     veleroCluster
+	secrets     secretSource
+	sleep       func(time.Duration)
+	kmsKeyName  string
+	requireCMEK bool
+	kms         *cloudkms.Service
+	// config is the location's config, kept to rebuild the clients when
+	// the credentials files change.
+	config             map[string]string
+	credentialsWatcher *credentialsWatcher
+	// cmekBuckets records the buckets already verified to have a default
+	// CMEK key when requireCMEK is set.
+	cmekBuckets map[string]bool
+	cmekLock    sync.Mutex
+	kmsLock     sync.Mutex
+	// residency keeps the objects written in the allowed regions, if
+	// allowedRegions is set.
+	residency *residencyPolicy
+	// uploads records the phase and schedule of the backups being
+	// uploaded, for their events.
+	uploads backupUploadState
+	// kubeEvents creates Kubernetes Events for backup uploads, if enabled.
+	kubeEvents *kubeEventRecorder
+	// envelope encrypts Velero's metadata files client-side with a Cloud
+	// KMS key, if one is configured, and decrypts those encrypted before.
+	envelope *envelopeEncryption
+	// readAhead is how many bytes of each download are read ahead of
+	// Velero, zero to read only as Velero does.
+	readAhead int
+	// chunkSize is the resumable upload chunk size, kept to rebuild the
+	// bucket writer.
+	chunkSize int
+	// current holds the *objectStoreClients calls use. reloadCredentials
+	// replaces them instead of changing them, so calls in flight keep
+	// using the clients they loaded and don't hold up the reload.
+	current atomic.Value
+	// reload rebuilds the clients when the credentials change.
+	reload clientsReload
+	// deferInit lets Init succeed when GCP can't be reached, connecting the
+	// clients when the object store is first used instead. It's set when
+	// serving Velero, whose Init failures last until the pod restarts.
+	deferInit bool
+	// init connects the clients if that was deferred.
+	init *deferredInit
 }
 
 func newObjectStore(logger logrus.FieldLogger) *ObjectStore {
-	return &ObjectStore{log: logger}
+	return &ObjectStore{log: logger, cluster: inCluster{}, secrets: platformSecrets{}, sleep: time.Sleep}
 }
 
 func (o *ObjectStore) Init(config map[string]string) error {
-	if err := veleroplugin.ValidateObjectStoreConfigKeys(config, kmsKeyNameConfigKey, serviceAccountConfig, credentialsFileConfigKey); err != nil {
+	if err := checkFIPSMode(); err != nil {
+		return err
+	}
+	startTracing(o.log)
+	startCloudMonitoring(o.log)
+
+	if err := validateConfig("BackupStorageLocation", config, []string{
+		"bucket",
+		"prefix",
+		"caCert",
+		kmsKeyNameConfigKey,
+		serviceAccountConfig,
+		credentialsFileConfigKey,
+		credentialsSecretConfigKey,
+		credentialsJSONConfigKey,
+		accessTokenFileConfigKey,
+		endpointsConfigKey,
+		requireCMEKConfigKey,
+		uploadChunkSizeConfigKey,
+		readOnlyCredentialsFileConfigKey,
+		inventoryIntervalConfigKey,
+		estimateCostsConfigKey,
+		storagePricesConfigKey,
+		tierObjectsAfterConfigKey,
+		tierObjectsStorageClassConfigKey,
+		orgPolicyChecksConfigKey,
+		drBucketConfigKey,
+		drPrefixConfigKey,
+		drKMSKeyNameConfigKey,
+		impersonateServiceAccountConfigKey,
+		impersonateDelegatesConfigKey,
+		scopesConfigKey,
+		quotaProjectConfigKey,
+		clientCertificateFileConfigKey,
+		clientKeyFileConfigKey,
+		credentialProfileConfigKey,
+		secretManagerCredentialsConfigKey,
+		fleetMembershipConfigKey,
+		fleetTokenFileConfigKey,
+		fleetServiceAccountConfigKey,
+		secretManagerEncryptionKeyConfigKey,
+		pubsubTopicConfigKey,
+		kubernetesEventsConfigKey,
+		listIndexMaxAgeConfigKey,
+		downloadReadAheadConfigKey,
+		metadataEncryptionKeyConfigKey,
+		allowPlaintextMetadataConfigKey,
+		allowedRegionsConfigKey,
+	}, objectStoreConfigChecks, credentialsConfigChecks); err != nil {
 		return err
 	}
+	if o.kubeEvents == nil {
+		o.kubeEvents = newKubeEventRecorder(o.log, config, o.cluster)
+	}
+
+	if val, ok := config[requireCMEKConfigKey]; ok {
+		requireCMEK, err := strconv.ParseBool(val)
+		if err != nil {
+			return errors.Wrapf(err, "error parsing %s config value %q", requireCMEKConfigKey, val)
+		}
+		o.requireCMEK = requireCMEK
+	}
+	o.kmsKeyName = config[kmsKeyNameConfigKey]
+	o.residency = newResidencyPolicy(config)
+	for _, key := range []string{kmsKeyNameConfigKey, metadataEncryptionKeyConfigKey} {
+		if err := o.residency.checkKMSKey(key, config[key]); err != nil {
+			return err
+		}
+	}
+	o.envelope = &envelopeEncryption{
+		keyName: config[metadataEncryptionKeyConfigKey],
+		wrapper: &kmsKeyWrapper{service: o.kmsService},
+	}
+	if val, ok := config[allowPlaintextMetadataConfigKey]; ok {
+		allowPlaintext, err := strconv.ParseBool(val)
+		if err != nil {
+			return errors.Wrapf(err, "error parsing %s config value %q", allowPlaintextMetadataConfigKey, val)
+		}
+		o.envelope.allowPlaintext = allowPlaintext
+	}
+
+	var err error
+	if o.chunkSize, err = parseUploadChunkSize(config); err != nil {
+		return err
+	}
+	if o.readAhead, err = parseDownloadReadAhead(config); err != nil {
+		return err
+	}
+
+	o.config = config
+	// Velero initializes the object store when a backup or restore starts,
+	// so the bucket's organization policies are checked once it's
+	// connected, including when connecting is deferred to its first use
+	o.init, err = connectWithRetries(o.log, "object store", o.deferInit, o.sleep, func() error {
+		if err := o.connect(config); err != nil {
+			return err
+		}
+		return o.checkBucketOrgPolicies(config["bucket"])
+	})
+	return err
+}
+
+// connect loads the location's credentials and builds its clients, which
+// needs GCP, and for some credentials the metadata server, to be reachable.
+func (o *ObjectStore) connect(config map[string]string) error {
+	clients, creds, err := o.buildClients(config)
+	if err != nil {
+		return err
+	}
+	o.useClients(clients)
+
+	if bucket := config["bucket"]; bucket != "" {
+		if err := o.ensureCMEK(bucket); err != nil {
+			return err
+		}
+		if err := o.ensureResidency(bucket); err != nil {
+			return err
+		}
+	}
+
+	startKeyCheck(o.log, creds.JSON, clients.credentials)
+
+	o.credentialsWatcher = newCredentialsWatcher(clients.credentials.file,
+		config[readOnlyCredentialsFileConfigKey],
+		config[clientCertificateFileConfigKey],
+		config[clientKeyFileConfigKey],
+		os.Getenv(credentialProfilesEnvVar),
+	)
+	o.credentialsWatcher.watchVersion(clients.credentials.secretVersion, clients.credentials.secretVersionCheck())
+
+	if _, ok := config[inventoryIntervalConfigKey]; ok {
+		o.log.Warnf("%s is no longer used; run the %s command to compute the inventory of backups", inventoryIntervalConfigKey, collectInventoryCommand)
+	}
+	return nil
+}
+
+// objectStoreClients are the credentials of an object store and the clients
+// built with them, which are replaced as a whole when the credentials change
+// and aren't changed once in use.
+type objectStoreClients struct {
+	credentials locationCredentials
+	// clientsKey identifies the location's clients in locationClients.
+	clientsKey string
+	client     *storage.Client
+	// readClient is used for operations that only read backup data. It
+	// is the same as client unless separate read-only credentials are
+	// configured.
+	readClient     *storage.Client
+	googleAccessID string
+	privateKey     []byte
+	iamSvc         *iamcredentials.Service
+	encryptionKey  []byte
+	bucketWriter   bucketWriter
+	// events publishes backup lifecycle events, if a topic is configured.
+	events *eventPublisher
+	// orgPolicies checks the organization policies writing to the bucket
+	// breaks, if enabled.
+	orgPolicies *orgPolicyChecker
+	// listIndex answers listings of the backups from an index object, if
+	// enabled.
+	listIndex *listIndex
+}
+
+// clients returns the credentials and clients for a call to use.
+func (o *ObjectStore) clients() *objectStoreClients {
+	if c, ok := o.current.Load().(*objectStoreClients); ok {
+		return c
+	}
+	return &objectStoreClients{}
+}
+
+// buildClients loads the location's credentials and builds the clients
+// using them, without changing the object store. It also returns the
+// credentials found, for the checks done when the object store connects.
+func (o *ObjectStore) buildClients(config map[string]string) (*objectStoreClients, *google.Credentials, error) {
 	// Find default token source to extract the GoogleAccessID
 	ctx := context.Background()
+	c := &objectStoreClients{}
 
-	clientOptions := []option.ClientOption{
-		option.WithScopes(storage.ScopeReadWrite),
+	var err error
+	c.credentials, err = newLocationCredentials(o.secrets, config, objectStoreCredentialsEnvVar)
+	if err != nil {
+		return nil, nil, err
 	}
+	c.events = newEventPublisher(o.log, config, c.credentials)
+	c.orgPolicies = newOrgPolicyChecker(o.log, config, c.credentials)
 
-	// Credentials to use when creating signed URLs.
-	var creds *google.Credentials
-	var err error
+	// Prioritize the credentials in config, if they exist. Otherwise, fall
+	// back to loading default credentials for signed URLs.
+	creds, err := c.credentials.find(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	switch {
+	case c.credentials.impersonate != "":
+		// URLs are signed as the impersonated service account, using the
+		// base identity's permission to act as it.
+		err = c.initFromImpersonation()
+	case creds.JSON != nil && parseCredentialsJSON(creds.JSON).Type == serviceAccountCredentials:
+		// Using a service account key file
+		err = c.initFromKeyFile(creds)
+	default:
+		// Using compute engine credentials, which is the case if workload identity is enabled,
+		// federated (external_account) credentials or access tokens. URLs are signed with the IAM API.
+		err = c.initFromComputeEngine(config, creds)
+	}
+
+	if err != nil {
+		return nil, nil, errors.WithStack(err)
+	}
 
-	// Prioritize the credentials file path in config, if it exists
-	if credentialsFile, ok := config[credentialsFileConfigKey]; ok {
-		b, err := ioutil.ReadFile(credentialsFile)
+	endpoint, err := locationEndpoint(config, o.log)
+	if err != nil {
+		return nil, nil, err
+	}
+	location := locationKey("BackupStorageLocation", config, endpoint, c.credentials)
+	c.clientsKey = location
+	buildCtx := withLocationKey(ctx, location)
+	client, err := locationClients.get(location, storageService, func() (interface{}, error) {
+		clientOptions, err := c.credentials.clientOptions(buildCtx, parseScopes(config, storage.ScopeReadWrite)...)
 		if err != nil {
-			return errors.Wrapf(err, "error reading provided credentials file %v", credentialsFile)
+			return nil, err
 		}
-
-		creds, err = google.CredentialsFromJSON(ctx, b)
+		return o.newStorageClient(buildCtx, endpoint, clientOptions)
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	c.client = client.(*storage.Client)
+	c.readClient = c.client
+
+	if readOnlyCredentialsFile, ok := config[readOnlyCredentialsFileConfigKey]; ok {
+		readClient, err := locationClients.get(location, storageService+"-read", func() (interface{}, error) {
+			readOptions := append([]option.ClientOption{
+				option.WithScopes(storage.ScopeReadOnly),
+				option.WithCredentialsFile(readOnlyCredentialsFile),
+			}, c.credentials.sharedOptions()...)
+			return o.newStorageClient(buildCtx, endpoint, readOptions)
+		})
 		if err != nil {
-			return errors.WithStack(err)
+			return nil, nil, errors.Wrapf(err, "error creating read-only client from credentials file %v", readOnlyCredentialsFile)
 		}
+		c.readClient = readClient.(*storage.Client)
+	}
 
-		// If using a credentials file, we also need to pass it when creating the client.
-		clientOptions = append(clientOptions, option.WithCredentialsFile(credentialsFile))
-	} else {
-		// If a credentials file does not exist in the config, fall back to
-		// loading default credentials for signed URLs.
-		creds, err = google.FindDefaultCredentials(ctx)
+	if name := config[secretManagerEncryptionKeyConfigKey]; name != "" {
+		if o.kmsKeyName != "" {
+			return nil, nil, errors.Errorf("only one of %s and %s can be set", kmsKeyNameConfigKey, secretManagerEncryptionKeyConfigKey)
+		}
+		secret, err := c.credentials.secrets.secretManagerSecret(ctx, name, c.credentials.sharedOptions()...)
+		if err != nil {
+			return nil, nil, err
+		}
+		if c.encryptionKey, err = parseEncryptionKey(secret.data); err != nil {
+			return nil, nil, errors.Wrapf(err, "error reading encryption key from Secret Manager secret %s", secret.version)
+		}
 	}
 
+	c.bucketWriter = &writer{
+		client:        c.client,
+		kmsKeyName:    o.kmsKeyName,
+		encryptionKey: c.encryptionKey,
+		chunkSize:     o.chunkSize,
+	}
+	c.listIndex, err = newListIndex(o.log, config, &gcsIndexStore{client: c.client, encryptionKey: c.encryptionKey, kmsKeyName: o.kmsKeyName})
 	if err != nil {
-		return errors.WithStack(err)
+		return nil, nil, err
 	}
+	return c, creds, nil
+}
 
-	if creds.JSON != nil {
-		// Using Credentials File
-		err = o.initFromKeyFile(creds)
-	} else {
-		// Using compute engine credentials. Use this if workload identity is enabled.
-		err = o.initFromComputeEngine(config)
-	}
+// useClients replaces the object store's credentials and clients. Calls
+// using the current ones finish with them.
+func (o *ObjectStore) useClients(c *objectStoreClients) {
+	o.current.Store(c)
+	o.kmsLock.Lock()
+	o.kms = nil
+	o.kmsLock.Unlock()
+}
 
+// newStorageClient builds a Cloud Storage client for the location with the
+// given credentials options, routed through the endpoint selected for it.
+func (o *ObjectStore) newStorageClient(ctx context.Context, endpoint string, clientOptions []option.ClientOption) (*storage.Client, error) {
+	clientOptions = append(clientOptions, endpointOptions(endpoint, "storage/v1/")...)
+	clientOptions, err := instrumentClientOptions(ctx, o.log, storageService, clientOptions)
 	if err != nil {
-		return errors.WithStack(err)
+		return nil, err
 	}
 
 	client, err := storage.NewClient(ctx, clientOptions...)
+	return client, errors.WithStack(err)
+}
+
+// ready connects the clients if that was deferred, and rebuilds them if the
+// credentials changed or their requests failed.
+func (o *ObjectStore) ready() error {
+	if err := o.init.ensure(); err != nil {
+		return err
+	}
+	o.reloadCredentials()
+	return nil
+}
+
+// reloadCredentials rebuilds the credentials and clients if the credentials
+// changed since they were loaded, or the clients were forgotten because
+// their requests couldn't reach GCP or their credentials were rejected. Only
+// the credentials and clients are rebuilt; the checks and background work
+// started when the object store connected aren't repeated. If the new
+// credentials can't be loaded, the existing clients are kept, and the
+// rebuild is retried with backoff.
+func (o *ObjectStore) reloadCredentials() {
+	o.reload.reload(o.log, o.credentialsWatcher, o.clients().clientsKey, func() error {
+		clients, _, err := o.buildClients(o.config)
+		if err != nil {
+			return err
+		}
+		o.useClients(clients)
+		return nil
+	})
+}
+
+// parseUploadChunkSize returns the resumable upload chunk size in bytes from
+// the config, defaulting to the client library's default.
+func parseUploadChunkSize(config map[string]string) (int, error) {
+	val, ok := config[uploadChunkSizeConfigKey]
+	if !ok {
+		return googleapi.DefaultUploadChunkSize, nil
+	}
+
+	sizeMB, err := strconv.Atoi(val)
+	if err != nil || sizeMB < 0 {
+		return 0, errors.Errorf("%s must be a non-negative integer, got %q", uploadChunkSizeConfigKey, val)
+	}
+	if sizeMB > maxUploadChunkSizeMB {
+		return 0, errors.Errorf("%s must be at most %d, got %d; each upload buffers a chunk in memory", uploadChunkSizeConfigKey, maxUploadChunkSizeMB, sizeMB)
+	}
+	return sizeMB * 1024 * 1024, nil
+}
+
+// ensureCMEK returns an error if requireCMEK is set and objects written to the
+// bucket would not be encrypted with a customer-managed key, either because the
+// plugin is configured with kmsKeyName or because the bucket has a default one.
+func (o *ObjectStore) ensureCMEK(bucket string) error {
+	if !o.requireCMEK || o.kmsKeyName != "" {
+		return nil
+	}
+
+	o.cmekLock.Lock()
+	defer o.cmekLock.Unlock()
+	if o.cmekBuckets[bucket] {
+		return nil
+	}
+
+	attrs, err := o.clients().bucketWriter.getBucketAttrs(bucket)
 	if err != nil {
-		return errors.WithStack(err)
+		return errors.Wrapf(err, "error getting attributes of bucket %s to verify its default CMEK key", bucket)
+	}
+	if attrs.Encryption == nil || attrs.Encryption.DefaultKMSKeyName == "" {
+		return errors.Errorf("%s is set but bucket %s has no default CMEK key and no %s is configured", requireCMEKConfigKey, bucket, kmsKeyNameConfigKey)
 	}
-	o.client = client
 
-	o.bucketWriter = &writer{
-		client:     o.client,
-		kmsKeyName: config[kmsKeyNameConfigKey],
+	if o.cmekBuckets == nil {
+		o.cmekBuckets = make(map[string]bool)
 	}
+	o.cmekBuckets[bucket] = true
 	return nil
 }
 
-func (o *ObjectStore) initFromKeyFile(creds *google.Credentials) error {
+func (c *objectStoreClients) initFromKeyFile(creds *google.Credentials) error {
 	jwtConfig, err := google.JWTConfigFromJSON(creds.JSON)
 	if err != nil {
 		return errors.Wrap(err, "error parsing credentials file; should be JSON")
@@ -152,71 +548,280 @@ func (o *ObjectStore) initFromKeyFile(creds *google.Credentials) error {
 		return errors.Errorf("credentials file pointed to by %s does not contain a private key", "GOOGLE_APPLICATION_CREDENTIALS")
 	}
 
-	o.googleAccessID = jwtConfig.Email
-	o.privateKey = jwtConfig.PrivateKey
+	c.googleAccessID = jwtConfig.Email
+	c.privateKey = jwtConfig.PrivateKey
 	return nil
 }
 
-func (o *ObjectStore) initFromComputeEngine(config map[string]string) error {
+func (c *objectStoreClients) initFromImpersonation() error {
 	var err error
-	var ok bool
-	o.googleAccessID, ok = config["serviceAccount"]
-	if !ok {
+	c.googleAccessID = c.credentials.impersonate
+	c.iamSvc, err = iamcredentials.NewService(context.Background(), c.credentials.baseOptions()...)
+	return err
+}
+
+func (c *objectStoreClients) initFromComputeEngine(config map[string]string, creds *google.Credentials) error {
+	var err error
+	c.googleAccessID = config[serviceAccountConfig]
+	if c.googleAccessID == "" && creds.JSON != nil {
+		// federated credentials impersonating a service account can sign as it
+		c.googleAccessID = parseCredentialsJSON(creds.JSON).impersonatedServiceAccount()
+	}
+	if c.googleAccessID == "" {
 		return errors.Errorf("serviceAccount is expected to be provided as an item in BackupStorageLocation's config")
 	}
-	o.iamSvc, err = iamcredentials.NewService(context.Background())
+	c.iamSvc, err = iamcredentials.NewService(context.Background(), c.credentials.baseOptions()...)
 	return err
 }
 
-func (o *ObjectStore) PutObject(bucket, key string, body io.Reader) error {
-	w := o.bucketWriter.getWriteCloser(bucket, key)
+func (o *ObjectStore) PutObject(bucket, key string, body io.Reader) (err error) {
+	if err := o.ready(); err != nil {
+		return reportError(objectStoreComponent, "PutObject", err)
+	}
+	clients := o.clients()
+
+	span := startSpan("gcs.PutObject", spanKindClient, objectSpanAttributes(bucket, key))
+	var n int64
+	defer func() {
+		span.finish(err)
+		err = reportError(objectStoreComponent, "PutObject", err)
+		o.kubeEvents.uploaded(bucket, key, n, err)
+	}()
+
+	if err := o.ensureCMEK(bucket); err != nil {
+		return err
+	}
+	if err := o.ensureResidency(bucket); err != nil {
+		return err
+	}
+
+	w := clients.bucketWriter.getWriteCloser(bucket, key)
+	if o.envelope.encrypts(key) {
+		if sw, ok := w.(*storage.Writer); ok {
+			sw.Metadata = map[string]string{envelopeMetadataKey: envelopeMetadataValue}
+		}
+		encrypted, err := o.envelope.encryptingWriter(w)
+		if err != nil {
+			w.Close()
+			return err
+		}
+		w = encrypted
+	}
+
+	buf := copyBuffers.Get().(*[]byte)
+	defer copyBuffers.Put(buf)
+
+	if clients.events != nil {
+		body = o.uploads.watch(key, body)
+	}
+	body = o.kubeEvents.watchUpload(bucket, key, body)
 
 	// The writer returned by NewWriter is asynchronous, so errors aren't guaranteed
 	// until Close() is called
-	_, copyErr := io.Copy(w, body)
+	n, copyErr := io.CopyBuffer(w, body, *buf)
+	span.setAttribute("gcs.bytes", strconv.FormatInt(n, 10))
 
 	// Ensure we close w and report errors properly
 	closeErr := w.Close()
+	if copyErr != nil || closeErr != nil {
+		if clients.events != nil {
+			o.uploads.discard(key)
+		}
+	}
 	if copyErr != nil {
 		return copyErr
 	}
+	if closeErr != nil {
+		return closeErr
+	}
 
-	return closeErr
+	if clients.events != nil {
+		o.publishUpload(bucket, key, n)
+	}
+	clients.listIndex.added(bucket, key)
+	return nil
+}
+
+// publishUpload records an uploaded object of a backup or restore, and
+// publishes its events: BackupUploaded once a backup's contents are
+// uploaded, BackupFinished once the files Velero uploads last for a backup
+// are, and RestoreFinished once a restore's results are. Velero uploads a
+// backup's metadata file before its contents, so the backup events carry
+// the backup's phase and schedule.
+func (o *ObjectStore) publishUpload(bucket, key string, size int64) {
+	clients := o.clients()
+	o.uploads.uploaded(key)
+
+	if backup, file := backupObject(key); backup != "" {
+		metadata := o.uploads.get(backup)
+		if file == backup+".tar.gz" {
+			clients.events.publish(backupEvent{
+				Type:     backupUploadedEvent,
+				Backup:   backup,
+				Schedule: metadata.schedule,
+				Phase:    metadata.phase,
+				Bucket:   bucket,
+				Object:   key,
+				Bytes:    size,
+			})
+		}
+		if files := o.uploads.backupFinished(path.Dir(key), backup); files != nil {
+			clients.events.publish(backupEvent{
+				Type:      backupFinishedEvent,
+				Backup:    backup,
+				Schedule:  metadata.schedule,
+				Phase:     metadata.phase,
+				Bucket:    bucket,
+				Location:  gcsURI(bucket, path.Dir(key)+"/"),
+				Artifacts: gcsURIs(bucket, files),
+			})
+		}
+		return
+	}
+
+	restore, file := restoreObject(key)
+	if restore == "" || file != restoreResultsFile(restore) {
+		return
+	}
+	// Velero uploads the results of the restores that ran, which only
+	// failed partially if they have errors.
+	results, files := o.uploads.restoreFinished(path.Dir(key), restore)
+	phase := "Completed"
+	if results.errors > 0 {
+		phase = "PartiallyFailed"
+	}
+	clients.events.publish(backupEvent{
+		Type:      restoreFinishedEvent,
+		Restore:   restore,
+		Phase:     phase,
+		Errors:    results.errors,
+		Warnings:  results.warnings,
+		Bucket:    bucket,
+		Location:  gcsURI(bucket, path.Dir(key)+"/"),
+		Artifacts: gcsURIs(bucket, files),
+	})
+}
+
+// gcsURI returns the gs:// URI of an object.
+func gcsURI(bucket, key string) string {
+	return "gs://" + bucket + "/" + key
+}
+
+func gcsURIs(bucket string, keys []string) []string {
+	uris := make([]string, len(keys))
+	for i, key := range keys {
+		uris[i] = gcsURI(bucket, key)
+	}
+	return uris
 }
 
 func (o *ObjectStore) ObjectExists(bucket, key string) (bool, error) {
-	if _, err := o.bucketWriter.getAttrs(bucket, key); err != nil {
-		if err == storage.ErrObjectNotExist {
+	if err := o.ready(); err != nil {
+		return false, reportError(objectStoreComponent, "ObjectExists", err)
+	}
+
+	if _, err := o.clients().bucketWriter.getAttrs(bucket, key); err != nil {
+		if isNotFound(err) {
 			return false, nil
 		}
-		return false, errors.WithStack(err)
+		return false, reportError(objectStoreComponent, "ObjectExists", errors.WithStack(err))
 	}
 
 	return true, nil
 }
 
 func (o *ObjectStore) GetObject(bucket, key string) (io.ReadCloser, error) {
-	r, err := o.client.Bucket(bucket).Object(key).NewReader(context.Background())
+	if err := o.ready(); err != nil {
+		return nil, reportError(objectStoreComponent, "GetObject", err)
+	}
+	clients := o.clients()
+
+	span := startSpan("gcs.GetObject", spanKindClient, objectSpanAttributes(bucket, key))
+	r, err := clients.readClient.Bucket(bucket).Object(key).Key(clients.encryptionKey).NewReader(context.Background())
 	if err != nil {
-		return nil, errors.WithStack(err)
+		if kmsErr := o.verifyObjectKMSKey(bucket, key); kmsErr != nil {
+			span.finish(kmsErr)
+			return nil, reportError(objectStoreComponent, "GetObject", kmsErr)
+		}
+		span.finish(err)
+		return nil, reportError(objectStoreComponent, "GetObject", errors.WithStack(err))
+	}
+
+	// the object is downloaded as Velero reads it, or up to the read-ahead
+	// before
+	body := newReadAheadReader(r, o.readAhead)
+	if isMetadataObject(key) {
+		decrypted, err := o.envelope.decryptingReader(body)
+		if err != nil {
+			body.Close()
+			span.finish(err)
+			return nil, reportError(objectStoreComponent, "GetObject", errors.Wrapf(err, "error decrypting object %s", key))
+		}
+		body = decrypted
+	}
+	return &tracedReader{ReadCloser: body, span: span}, nil
+}
+
+// verifyObjectKMSKey checks the Cloud KMS key version that GCS recorded when
+// the object was written, to explain failed reads caused by rotated, disabled
+// or destroyed keys.
+func (o *ObjectStore) verifyObjectKMSKey(bucket, key string) error {
+	attrs, err := o.clients().bucketWriter.getAttrs(bucket, key)
+	if err != nil || attrs.KMSKeyName == "" {
+		return nil
+	}
+
+	kms, err := o.kmsService()
+	if err != nil {
+		return err
 	}
+	return errors.Wrapf(verifyKMSKey(kms, attrs.KMSKeyName), "unable to read object %s", key)
+}
 
-	return r, nil
+// kmsService returns the Cloud KMS client, creating it when first needed.
+func (o *ObjectStore) kmsService() (*cloudkms.Service, error) {
+	o.kmsLock.Lock()
+	defer o.kmsLock.Unlock()
+	if o.kms == nil {
+		kms, err := newKMSService(context.Background(), o.clients().credentials)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		o.kms = kms
+	}
+	return o.kms, nil
 }
 
 func (o *ObjectStore) ListCommonPrefixes(bucket, prefix, delimiter string) ([]string, error) {
+	if err := o.ready(); err != nil {
+		return nil, reportError(objectStoreComponent, "ListCommonPrefixes", err)
+	}
+	clients := o.clients()
+
+	if clients.listIndex.covers(prefix, delimiter) {
+		return clients.listIndex.list(bucket, func() ([]string, error) {
+			return o.listCommonPrefixes(bucket, prefix, delimiter)
+		})
+	}
+	return o.listCommonPrefixes(bucket, prefix, delimiter)
+}
+
+// listCommonPrefixes lists the prefixes under prefix up to the delimiter.
+func (o *ObjectStore) listCommonPrefixes(bucket, prefix, delimiter string) ([]string, error) {
 	q := &storage.Query{
 		Prefix:    prefix,
 		Delimiter: delimiter,
 	}
 
-	iter := o.client.Bucket(bucket).Objects(context.Background(), q)
+	ctx, cancel := context.WithTimeout(context.Background(), storageListTimeout)
+	defer cancel()
+	iter := o.clients().readClient.Bucket(bucket).Objects(ctx, q)
 
 	var res []string
 	for {
 		obj, err := iter.Next()
 		if err != nil && err != iterator.Done {
-			return nil, errors.WithStack(err)
+			return nil, reportError(objectStoreComponent, "ListCommonPrefixes", errors.WithStack(err))
 		}
 		if err == iterator.Done {
 			break
@@ -231,13 +836,19 @@ func (o *ObjectStore) ListCommonPrefixes(bucket, prefix, delimiter string) ([]st
 }
 
 func (o *ObjectStore) ListObjects(bucket, prefix string) ([]string, error) {
+	if err := o.ready(); err != nil {
+		return nil, reportError(objectStoreComponent, "ListObjects", err)
+	}
+
 	q := &storage.Query{
 		Prefix: prefix,
 	}
 
 	var res []string
 
-	iter := o.client.Bucket(bucket).Objects(context.Background(), q)
+	ctx, cancel := context.WithTimeout(context.Background(), storageListTimeout)
+	defer cancel()
+	iter := o.clients().readClient.Bucket(bucket).Objects(ctx, q)
 
 	for {
 		obj, err := iter.Next()
@@ -245,7 +856,7 @@ func (o *ObjectStore) ListObjects(bucket, prefix string) ([]string, error) {
 			return res, nil
 		}
 		if err != nil {
-			return nil, errors.WithStack(err)
+			return nil, reportError(objectStoreComponent, "ListObjects", errors.WithStack(err))
 		}
 
 		res = append(res, obj.Name)
@@ -253,7 +864,23 @@ func (o *ObjectStore) ListObjects(bucket, prefix string) ([]string, error) {
 }
 
 func (o *ObjectStore) DeleteObject(bucket, key string) error {
-	return errors.Wrapf(o.client.Bucket(bucket).Object(key).Delete(context.Background()), "error deleting object %s", key)
+	if err := o.ready(); err != nil {
+		return reportError(objectStoreComponent, "DeleteObject", err)
+	}
+	clients := o.clients()
+
+	// deleting an object that is already gone succeeds, like deleting
+	// snapshots
+	ctx, cancel := context.WithTimeout(context.Background(), storageCallTimeout)
+	defer cancel()
+	err := clients.client.Bucket(bucket).Object(key).Delete(ctx)
+	if err == nil || isNotFound(err) {
+		clients.listIndex.removed(bucket, key)
+	}
+	if isNotFound(err) {
+		return nil
+	}
+	return reportError(objectStoreComponent, "DeleteObject", errors.Wrapf(err, "error deleting object %s", key))
 }
 
 /*
@@ -261,9 +888,11 @@ func (o *ObjectStore) DeleteObject(bucket, key string) error {
  * https://cloud.google.com/iam/credentials/reference/rest/v1/projects.serviceAccounts/signBlob
  */
 func (o *ObjectStore) SignBytes(bytes []byte) ([]byte, error) {
-	name := "projects/-/serviceAccounts/" + o.googleAccessID
-	resp, err := o.iamSvc.Projects.ServiceAccounts.SignBlob(name, &iamcredentials.SignBlobRequest{
-		Payload: base64.StdEncoding.EncodeToString(bytes),
+	clients := o.clients()
+	name := "projects/-/serviceAccounts/" + clients.googleAccessID
+	resp, err := clients.iamSvc.Projects.ServiceAccounts.SignBlob(name, &iamcredentials.SignBlobRequest{
+		Payload:   base64.StdEncoding.EncodeToString(bytes),
+		Delegates: clients.credentials.delegateNames(),
 	}).Context(context.Background()).Do()
 
 	if err != nil {
@@ -273,17 +902,34 @@ func (o *ObjectStore) SignBytes(bytes []byte) ([]byte, error) {
 }
 
 func (o *ObjectStore) CreateSignedURL(bucket, key string, ttl time.Duration) (string, error) {
+	if err := o.ready(); err != nil {
+		return "", reportError(objectStoreComponent, "CreateSignedURL", err)
+	}
+	clients := o.clients()
+
+	// a signed URL would hand out the ciphertext of an encrypted object
+	if isMetadataObject(key) {
+		if attrs, err := clients.bucketWriter.getAttrs(bucket, key); err == nil && attrs.Metadata[envelopeMetadataKey] != "" {
+			return "", reportError(objectStoreComponent, "CreateSignedURL", errors.Errorf("object %s is encrypted with %s, so it can't be downloaded with a signed URL", key, metadataEncryptionKeyConfigKey))
+		}
+	}
+
 	options := storage.SignedURLOptions{
-		GoogleAccessID: o.googleAccessID,
+		GoogleAccessID: clients.googleAccessID,
 		Method:         "GET",
 		Expires:        time.Now().Add(ttl),
 	}
+	if fipsMode() {
+		// V4 signatures only use SHA-256
+		options.Scheme = storage.SigningSchemeV4
+	}
 
-	if o.privateKey == nil {
+	if clients.privateKey == nil {
 		options.SignBytes = o.SignBytes
 	} else {
-		options.PrivateKey = o.privateKey
+		options.PrivateKey = clients.privateKey
 	}
 
-	return storage.SignedURL(bucket, key, &options)
+	url, err := storage.SignedURL(bucket, key, &options)
+	return url, reportError(objectStoreComponent, "CreateSignedURL", err)
 }
@@ -16,14 +16,19 @@ limitations under the License.
 package main
 
 import (
+	"context"
 	"errors"
 	"io"
+	"net/http"
+	"net/http/httptest"
 	"strings"
 	"testing"
+	"time"
 
 	"cloud.google.com/go/storage"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"google.golang.org/api/option"
 
 	velerotest "github.com/vmware-tanzu/velero/pkg/test"
 )
@@ -49,6 +54,9 @@ type fakeWriter struct {
 	wc *mockWriteCloser
 
 	attrsErr error
+
+	bucketAttrs    *storage.BucketAttrs
+	bucketAttrsErr error
 }
 
 func newFakeWriter(wc *mockWriteCloser) *fakeWriter {
@@ -63,6 +71,13 @@ func (fw *fakeWriter) getAttrs(bucket, key string) (*storage.ObjectAttrs, error)
 	return new(storage.ObjectAttrs), fw.attrsErr
 }
 
+func (fw *fakeWriter) getBucketAttrs(bucket string) (*storage.BucketAttrs, error) {
+	if fw.bucketAttrs == nil {
+		return new(storage.BucketAttrs), fw.bucketAttrsErr
+	}
+	return fw.bucketAttrs, fw.bucketAttrsErr
+}
+
 func TestPutObject(t *testing.T) {
 	tests := []struct {
 		name        string
@@ -98,7 +113,7 @@ func TestPutObject(t *testing.T) {
 		t.Run(test.name, func(t *testing.T) {
 			wc := newMockWriteCloser(test.writeErr, test.closeErr)
 			o := newObjectStore(velerotest.NewLogger())
-			o.bucketWriter = newFakeWriter(wc)
+			o.setClients(func(c *objectStoreClients) { c.bucketWriter = newFakeWriter(wc) })
 
 			err := o.PutObject("bucket", "key", strings.NewReader("contents"))
 			assert.Equal(t, test.expectedErr, err)
@@ -135,7 +150,7 @@ func TestObjectExists(t *testing.T) {
 		t.Run(tc.name, func(t *testing.T) {
 			o := newObjectStore(velerotest.NewLogger())
 			w := newFakeWriter(nil)
-			o.bucketWriter = w
+			o.setClients(func(c *objectStoreClients) { c.bucketWriter = w })
 			w.attrsErr = tc.errorResponse
 
 			bucket := "b"
@@ -152,3 +167,148 @@ func TestObjectExists(t *testing.T) {
 		})
 	}
 }
+
+func TestPutObjectRequireCMEK(t *testing.T) {
+	tests := []struct {
+		name           string
+		requireCMEK    bool
+		kmsKeyName     string
+		bucketAttrs    *storage.BucketAttrs
+		bucketAttrsErr error
+		expectedErr    bool
+	}{
+		{
+			name: "not required, bucket without default key",
+		},
+		{
+			name:        "required, plugin configured with a key",
+			requireCMEK: true,
+			kmsKeyName:  "projects/p/locations/l/keyRings/r/cryptoKeys/k",
+		},
+		{
+			name:        "required, bucket has a default key",
+			requireCMEK: true,
+			bucketAttrs: &storage.BucketAttrs{
+				Encryption: &storage.BucketEncryption{DefaultKMSKeyName: "projects/p/locations/l/keyRings/r/cryptoKeys/k"},
+			},
+		},
+		{
+			name:        "required, bucket has no default key",
+			requireCMEK: true,
+			expectedErr: true,
+		},
+		{
+			name:           "required, bucket attributes cannot be read",
+			requireCMEK:    true,
+			bucketAttrsErr: errors.New("forbidden"),
+			expectedErr:    true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			w := newFakeWriter(newMockWriteCloser(nil, nil))
+			w.bucketAttrs = test.bucketAttrs
+			w.bucketAttrsErr = test.bucketAttrsErr
+
+			o := newObjectStore(velerotest.NewLogger())
+			o.setClients(func(c *objectStoreClients) { c.bucketWriter = w })
+			o.requireCMEK = test.requireCMEK
+			o.kmsKeyName = test.kmsKeyName
+
+			err := o.PutObject("bucket", "key", strings.NewReader("contents"))
+			if test.expectedErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+		})
+	}
+}
+
+func TestParseUploadChunkSize(t *testing.T) {
+	tests := []struct {
+		name        string
+		config      map[string]string
+		expected    int
+		expectedErr bool
+	}{
+		{
+			name:     "defaults to the client library default",
+			config:   map[string]string{},
+			expected: 16 * 1024 * 1024,
+		},
+		{
+			name:     "size is given in MiB",
+			config:   map[string]string{uploadChunkSizeConfigKey: "8"},
+			expected: 8 * 1024 * 1024,
+		},
+		{
+			name:     "zero disables chunking",
+			config:   map[string]string{uploadChunkSizeConfigKey: "0"},
+			expected: 0,
+		},
+		{
+			name:        "negative sizes are rejected",
+			config:      map[string]string{uploadChunkSizeConfigKey: "-1"},
+			expectedErr: true,
+		},
+		{
+			name:     "the largest size is allowed",
+			config:   map[string]string{uploadChunkSizeConfigKey: "256"},
+			expected: 256 * 1024 * 1024,
+		},
+		{
+			name:        "larger sizes are rejected",
+			config:      map[string]string{uploadChunkSizeConfigKey: "1024"},
+			expectedErr: true,
+		},
+		{
+			name:        "non-numeric sizes are rejected",
+			config:      map[string]string{uploadChunkSizeConfigKey: "lots"},
+			expectedErr: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			res, err := parseUploadChunkSize(test.config)
+			if test.expectedErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, test.expected, res)
+		})
+	}
+}
+
+func TestStorageCallsHaveDeadlines(t *testing.T) {
+	defer func(call, list time.Duration) { storageCallTimeout, storageListTimeout = call, list }(storageCallTimeout, storageListTimeout)
+	storageCallTimeout, storageListTimeout = 200*time.Millisecond, 200*time.Millisecond
+
+	// the client library retries unavailable responses until the call's
+	// context is done
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+	client, err := storage.NewClient(context.Background(), option.WithEndpoint(server.URL+"/storage/v1/"), option.WithoutAuthentication())
+	require.NoError(t, err)
+
+	o := newObjectStore(velerotest.NewLogger())
+	o.setClients(func(c *objectStoreClients) {
+		c.client, c.readClient = client, client
+		c.bucketWriter = &writer{client: client}
+	})
+
+	start := time.Now()
+	assert.Error(t, o.DeleteObject("bucket", "key"))
+	_, err = o.ObjectExists("bucket", "key")
+	assert.Error(t, err)
+	_, err = o.ListObjects("bucket", "backups/")
+	assert.Error(t, err)
+	_, err = o.ListCommonPrefixes("bucket", "backups/", "/")
+	assert.Error(t, err)
+	assert.Less(t, int64(time.Since(start)), int64(10*time.Second))
+}
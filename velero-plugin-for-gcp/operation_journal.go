@@ -0,0 +1,240 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	api "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// operationJournalConfigKey enables the operation journal of a
+	// VolumeSnapshotLocation, which records the snapshots the plugin starts
+	// in ConfigMaps in Velero's namespace, so the ones left behind by a
+	// backup that a restart of the Velero pod interrupted are deleted.
+	operationJournalConfigKey = "operationJournal"
+
+	// operationJournalLabel labels the ConfigMaps of the journal.
+	operationJournalLabel = "velero.io/gcp-operation-journal"
+	// operationJournalKey is the key of a journal ConfigMap's entry.
+	operationJournalKey = "operation"
+
+	operationJournalCounter = "velero_gcp_operation_journal_recoveries_total"
+)
+
+var (
+	// recoveredProjects records the snapshot projects whose journal entries
+	// were already recovered in this process, since every location sharing
+	// a project is initialized with the same entries.
+	recoveredProjects     = make(map[string]bool)
+	recoveredProjectsLock sync.Mutex
+)
+
+// journalEntry is a snapshot or Filestore backup the plugin started for a
+// backup.
+type journalEntry struct {
+	// Snapshot is the snapshot ID returned to Velero.
+	Snapshot string `json:"snapshot"`
+	// Operation is the name of the GCP operation creating the snapshot.
+	Operation string `json:"operation,omitempty"`
+	// Project is the project the snapshot was created in.
+	Project string `json:"project"`
+	Backup  string `json:"backup"`
+	// Pod is the Velero pod that ran the backup.
+	Pod     string    `json:"pod"`
+	Started time.Time `json:"started"`
+}
+
+// journalStore reads and writes the ConfigMaps of the journal and reads the
+// backups they refer to.
+type journalStore interface {
+	listConfigMaps(namespace, selector string) ([]v1.ConfigMap, error)
+	listBackups(namespace string) ([]api.Backup, error)
+	createConfigMap(configMap *v1.ConfigMap) error
+	deleteConfigMap(namespace, name string) error
+}
+
+// newJournalStore returns the client the journal is kept with.
+func newJournalStore() (journalStore, error) {
+	return newInClusterClient()
+}
+
+// operationJournal records the snapshots a volume snapshotter starts until
+// their backup is known to have finished. Velero 1.7 leaves the backups a
+// restart of its pod interrupts InProgress, without recording their
+// snapshots anywhere, so the journal is what lets the plugin find and
+// delete those snapshots. Recording is best effort: failures are logged and
+// never fail the snapshot. A nil journal records nothing.
+type operationJournal struct {
+	log       logrus.FieldLogger
+	store     journalStore
+	namespace string
+	host      string
+	now       func() time.Time
+}
+
+// newOperationJournal returns the journal if the location enables it, or
+// nil otherwise.
+func newOperationJournal(log logrus.FieldLogger, config map[string]string) *operationJournal {
+	if enabled, _ := strconv.ParseBool(config[operationJournalConfigKey]); !enabled {
+		return nil
+	}
+	store, err := newJournalStore()
+	if err != nil {
+		log.WithError(err).Warn("Unable to keep the operation journal")
+		return nil
+	}
+	host, _ := os.Hostname()
+	return &operationJournal{log: log, store: store, namespace: veleroNamespace(), host: host, now: time.Now}
+}
+
+// journalConfigMapName returns the name of the ConfigMap recording a
+// snapshot. Snapshot IDs of Filestore backups are resource names, so the ID
+// is hashed into a valid object name.
+func journalConfigMapName(snapshot string) string {
+	return fmt.Sprintf("velero-gcp-operation-%x", sha256.Sum256([]byte(snapshot)))[:53]
+}
+
+// record adds a snapshot that GCP accepted to the journal.
+func (j *operationJournal) record(snapshot, operation, project string, tags map[string]string) {
+	if j == nil || tags[backupNameTag] == "" {
+		return
+	}
+	entry := journalEntry{
+		Snapshot:  snapshot,
+		Operation: operation,
+		Project:   project,
+		Backup:    tags[backupNameTag],
+		Pod:       j.host,
+		Started:   j.now().UTC(),
+	}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		j.log.WithError(errors.WithStack(err)).Warn("Unable to add the snapshot to the operation journal")
+		return
+	}
+	configMap := &v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      journalConfigMapName(snapshot),
+			Namespace: j.namespace,
+			Labels: map[string]string{
+				operationJournalLabel: "true",
+				backupLabel:           sanitizeLabelValue(entry.Backup),
+			},
+		},
+		Data: map[string]string{operationJournalKey: string(data)},
+	}
+	if err := j.store.createConfigMap(configMap); err != nil {
+		j.log.WithError(err).WithField("snapshot", snapshot).Warn("Unable to add the snapshot to the operation journal")
+	}
+}
+
+// recover goes through the journal entries of a project once per process:
+//   - the entries of backups that completed are dropped, since Velero
+//     recorded their snapshots;
+//   - the snapshots of backups that failed or don't exist anymore, and of
+//     backups still in progress that another Velero pod ran, which a
+//     restart interrupted, are deleted along with their entries;
+//   - the entries of backups this pod is running are kept.
+//
+// Snapshots that can't be deleted yet, e.g. because they are still being
+// created, keep their entries, so the next process retries them.
+func (j *operationJournal) recover(project string, deleteSnapshot func(snapshot string) (bool, error)) {
+	if j == nil {
+		return
+	}
+	recoveredProjectsLock.Lock()
+	if recoveredProjects[project] {
+		recoveredProjectsLock.Unlock()
+		return
+	}
+	recoveredProjects[project] = true
+	recoveredProjectsLock.Unlock()
+
+	if err := j.recoverProject(project, deleteSnapshot); err != nil {
+		j.log.WithError(err).Warn("Unable to recover the operations in the operation journal")
+	}
+}
+
+func (j *operationJournal) recoverProject(project string, deleteSnapshot func(snapshot string) (bool, error)) error {
+	configMaps, err := j.store.listConfigMaps(j.namespace, operationJournalLabel)
+	if err != nil {
+		return err
+	}
+	if len(configMaps) == 0 {
+		return nil
+	}
+	backups, err := j.store.listBackups(j.namespace)
+	if err != nil {
+		return err
+	}
+	phases := make(map[string]api.BackupPhase)
+	for _, backup := range backups {
+		phases[backup.Name] = backup.Status.Phase
+	}
+
+	for _, configMap := range configMaps {
+		var entry journalEntry
+		if err := json.Unmarshal([]byte(configMap.Data[operationJournalKey]), &entry); err != nil {
+			j.log.WithError(errors.WithStack(err)).WithField("configMap", configMap.Name).Warn("Unable to decode the operation journal entry")
+			continue
+		}
+		if entry.Project != project {
+			continue
+		}
+		log := j.log.WithFields(logrus.Fields{"backup": entry.Backup, "snapshot": entry.Snapshot})
+
+		phase, exists := phases[entry.Backup]
+		switch {
+		case phase == api.BackupPhaseCompleted || phase == api.BackupPhasePartiallyFailed:
+			j.forget(log, configMap.Name, "adopted")
+			continue
+		case exists && phase != api.BackupPhaseFailed && phase != api.BackupPhaseFailedValidation && entry.Pod == j.host:
+			continue
+		}
+
+		// the backup failed, was deleted, or was interrupted, so nothing
+		// refers to the snapshot
+		if _, err := deleteSnapshot(entry.Snapshot); err != nil {
+			log.WithError(err).Warn("Unable to delete the snapshot of an interrupted or failed backup, it will be retried")
+			continue
+		}
+		log.Infof("Deleted the snapshot of backup %s, which didn't complete", entry.Backup)
+		j.forget(log, configMap.Name, "deleted")
+	}
+	return nil
+}
+
+// forget removes an entry from the journal.
+func (j *operationJournal) forget(log logrus.FieldLogger, name, result string) {
+	if err := j.store.deleteConfigMap(j.namespace, name); err != nil {
+		log.WithError(err).Warn("Unable to remove the snapshot from the operation journal")
+		return
+	}
+	pluginMetrics.addCounter(operationJournalCounter, "Number of operation journal entries recovered after their backup ended, by result.", map[string]string{"result": result}, 1)
+}
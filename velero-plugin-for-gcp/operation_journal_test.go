@@ -0,0 +1,155 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	api "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	velerotest "github.com/vmware-tanzu/velero/pkg/test"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+type fakeJournalStore struct {
+	configMaps map[string]*v1.ConfigMap
+	backups    []api.Backup
+}
+
+func (s *fakeJournalStore) listConfigMaps(namespace, selector string) ([]v1.ConfigMap, error) {
+	var configMaps []v1.ConfigMap
+	for _, configMap := range s.configMaps {
+		configMaps = append(configMaps, *configMap)
+	}
+	return configMaps, nil
+}
+
+func (s *fakeJournalStore) listBackups(namespace string) ([]api.Backup, error) {
+	return s.backups, nil
+}
+
+func (s *fakeJournalStore) createConfigMap(configMap *v1.ConfigMap) error {
+	s.configMaps[configMap.Name] = configMap
+	return nil
+}
+
+func (s *fakeJournalStore) deleteConfigMap(namespace, name string) error {
+	delete(s.configMaps, name)
+	return nil
+}
+
+func newTestOperationJournal(store journalStore, host string) *operationJournal {
+	return &operationJournal{log: velerotest.NewLogger(), store: store, namespace: "velero", host: host, now: func() time.Time {
+		return time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	}}
+}
+
+func TestOperationJournalRecord(t *testing.T) {
+	store := &fakeJournalStore{configMaps: make(map[string]*v1.ConfigMap)}
+	journal := newTestOperationJournal(store, "velero-1")
+
+	journal.record("disk-1-snap", "operation-1", "p", map[string]string{backupNameTag: "Nightly", pvNameTag: "pv-1"})
+	journal.record("disk-2-snap", "operation-2", "p", nil)
+	var disabled *operationJournal
+	disabled.record("disk-3-snap", "operation-3", "p", map[string]string{backupNameTag: "nightly"})
+
+	require.Len(t, store.configMaps, 1)
+	configMap := store.configMaps[journalConfigMapName("disk-1-snap")]
+	require.NotNil(t, configMap)
+	assert.Equal(t, "velero", configMap.Namespace)
+	assert.Equal(t, map[string]string{operationJournalLabel: "true", backupLabel: "nightly"}, configMap.Labels)
+	assert.JSONEq(t, `{"snapshot":"disk-1-snap","operation":"operation-1","project":"p","backup":"Nightly","pod":"velero-1","started":"2021-01-01T00:00:00Z"}`, configMap.Data[operationJournalKey])
+
+	name := journalConfigMapName("projects/p/locations/us-central1/backups/velero-" + strings.Repeat("x", 36))
+	assert.Len(t, name, 53)
+	assert.True(t, strings.HasPrefix(name, "velero-gcp-operation-"))
+}
+
+func TestOperationJournalRecover(t *testing.T) {
+	defer func(registry *metricsRegistry) { pluginMetrics = registry }(pluginMetrics)
+	pluginMetrics = newMetricsRegistry()
+	defer func() { recoveredProjects = make(map[string]bool) }()
+	recoveredProjects = make(map[string]bool)
+
+	store := &fakeJournalStore{configMaps: make(map[string]*v1.ConfigMap)}
+	backup := func(name string, phase api.BackupPhase) api.Backup {
+		return api.Backup{ObjectMeta: metav1.ObjectMeta{Name: name}, Status: api.BackupStatus{Phase: phase}}
+	}
+	store.backups = []api.Backup{
+		backup("completed", api.BackupPhaseCompleted),
+		backup("partial", api.BackupPhasePartiallyFailed),
+		backup("failed", api.BackupPhaseFailed),
+		backup("interrupted", api.BackupPhaseInProgress),
+		backup("running", api.BackupPhaseInProgress),
+	}
+
+	previous := newTestOperationJournal(store, "velero-1")
+	current := newTestOperationJournal(store, "velero-2")
+	previous.record("completed-snap", "", "p", map[string]string{backupNameTag: "completed"})
+	previous.record("partial-snap", "", "p", map[string]string{backupNameTag: "partial"})
+	previous.record("failed-snap", "", "p", map[string]string{backupNameTag: "failed"})
+	previous.record("deleted-snap", "", "p", map[string]string{backupNameTag: "deleted"})
+	previous.record("interrupted-snap", "", "p", map[string]string{backupNameTag: "interrupted"})
+	previous.record("creating-snap", "", "p", map[string]string{backupNameTag: "interrupted"})
+	previous.record("other-project-snap", "", "other", map[string]string{backupNameTag: "failed"})
+	current.record("running-snap", "", "p", map[string]string{backupNameTag: "running"})
+	store.configMaps["invalid"] = &v1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: "invalid"}, Data: map[string]string{operationJournalKey: "{"}}
+
+	var deleted []string
+	deleteSnapshot := func(snapshot string) (bool, error) {
+		if snapshot == "creating-snap" {
+			return false, errors.New("the snapshot is not ready")
+		}
+		deleted = append(deleted, snapshot)
+		return snapshot != "deleted-snap", nil
+	}
+	current.recover("p", deleteSnapshot)
+	sort.Strings(deleted)
+	assert.Equal(t, []string{"deleted-snap", "failed-snap", "interrupted-snap"}, deleted)
+
+	var remaining []string
+	for name := range store.configMaps {
+		remaining = append(remaining, name)
+	}
+	assert.ElementsMatch(t, []string{
+		journalConfigMapName("creating-snap"),
+		journalConfigMapName("other-project-snap"),
+		journalConfigMapName("running-snap"),
+		"invalid",
+	}, remaining)
+
+	values := make(map[string]float64)
+	pluginMetrics.each(func(m *metric, s *sample) {
+		values[m.name+labelString(s.labels)] = s.value
+	})
+	assert.Equal(t, map[string]float64{
+		`velero_gcp_operation_journal_recoveries_total{result="adopted"}`: 2,
+		`velero_gcp_operation_journal_recoveries_total{result="deleted"}`: 3,
+	}, values)
+
+	// the journal is only recovered once per process
+	current.recover("p", func(snapshot string) (bool, error) {
+		t.Errorf("unexpected deletion of %s", snapshot)
+		return false, nil
+	})
+}
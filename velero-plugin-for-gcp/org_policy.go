@@ -0,0 +1,483 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/iam"
+	"cloud.google.com/go/storage"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	resourcemanager "google.golang.org/api/cloudresourcemanager/v1"
+	"google.golang.org/api/compute/v1"
+)
+
+const (
+	// orgPolicyChecksConfigKey is the key of a location's config enabling
+	// the pre-flight checks of the organization policy constraints that
+	// apply to its backups and restores.
+	orgPolicyChecksConfigKey = "orgPolicyChecks"
+
+	resourceLocationsConstraint         = "constraints/gcp.resourceLocations"
+	restrictNonCMEKServicesConstraint   = "constraints/gcp.restrictNonCmekServices"
+	disableServiceAccountKeysConstraint = "constraints/iam.disableServiceAccountKeyCreation"
+	publicAccessPreventionConstraint    = "constraints/storage.publicAccessPrevention"
+
+	computeAPI = "compute.googleapis.com"
+	storageAPI = "storage.googleapis.com"
+
+	// orgPolicyCacheTTL is how long an effective policy is used before it's
+	// read again.
+	orgPolicyCacheTTL = 10 * time.Minute
+	// orgPolicyTimeout bounds how long reading a policy may delay the
+	// operation it's checked for.
+	orgPolicyTimeout = 30 * time.Second
+)
+
+var (
+	// regionRegexp matches regions.
+	regionRegexp = regexp.MustCompile(`^[a-z]+-[a-z]+[0-9]+$`)
+
+	// multiRegionLocationGroups are the prefixes of the regions in the
+	// value groups of the multi-regions, e.g. in:eu-locations.
+	multiRegionLocationGroups = map[string]string{
+		"us":   "us-",
+		"eu":   "europe-",
+		"asia": "asia-",
+	}
+)
+
+// orgPolicyViolation is an organization policy constraint a location's
+// config or resources break.
+type orgPolicyViolation struct {
+	project    string
+	constraint string
+	// problem says what breaks the constraint, and fix what to change.
+	problem string
+	fix     string
+	// blocking violations make GCP reject the operation they're checked
+	// for, so it fails before it starts; the others are warned about.
+	blocking bool
+}
+
+func (v orgPolicyViolation) String() string {
+	return fmt.Sprintf("%s of project %s: %s; %s", v.constraint, v.project, v.problem, v.fix)
+}
+
+type cachedOrgPolicy struct {
+	policy  *resourcemanager.OrgPolicy
+	fetched time.Time
+}
+
+// orgPolicyChecker evaluates the organization policy constraints that make
+// GCP reject what a location does, so backups and restores fail before
+// they start, saying what to change, rather than halfway through with a
+// generic error. Effective policies are read with the location's
+// credentials and cached. Policies that can't be read, e.g. without the
+// Organization Policy Viewer role, are warned about and not checked. A nil
+// checker checks nothing.
+type orgPolicyChecker struct {
+	log         logrus.FieldLogger
+	credentials locationCredentials
+	now         func() time.Time
+
+	lock     sync.Mutex
+	svc      *resourcemanager.Service
+	policies map[string]cachedOrgPolicy
+	// warned records the warnings already logged, so each is logged once
+	// per process.
+	warned map[string]bool
+}
+
+// newOrgPolicyChecker returns the checker of a location, or nil if the
+// location doesn't enable the checks.
+func newOrgPolicyChecker(log logrus.FieldLogger, config map[string]string, credentials locationCredentials) *orgPolicyChecker {
+	if enabled, _ := strconv.ParseBool(config[orgPolicyChecksConfigKey]); !enabled {
+		return nil
+	}
+	return &orgPolicyChecker{
+		log:         log,
+		credentials: credentials,
+		now:         time.Now,
+		policies:    make(map[string]cachedOrgPolicy),
+		warned:      make(map[string]bool),
+	}
+}
+
+func (c *orgPolicyChecker) service(ctx context.Context) (*resourcemanager.Service, error) {
+	if c.svc == nil {
+		opts, err := c.credentials.clientOptions(ctx, resourcemanager.CloudPlatformReadOnlyScope)
+		if err != nil {
+			return nil, err
+		}
+		if opts, err = instrumentClientOptions(ctx, c.log, resourceManagerService, opts); err != nil {
+			return nil, err
+		}
+		if c.svc, err = resourcemanager.NewService(ctx, opts...); err != nil {
+			return nil, errors.WithStack(err)
+		}
+	}
+	return c.svc, nil
+}
+
+// policy returns the effective policy of a constraint on a project, or nil
+// if it can't be read.
+func (c *orgPolicyChecker) policy(project, constraint string) *resourcemanager.OrgPolicy {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	key := project + "/" + constraint
+	now := c.now()
+	if cached, ok := c.policies[key]; ok && now.Sub(cached.fetched) < orgPolicyCacheTTL {
+		return cached.policy
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), orgPolicyTimeout)
+	defer cancel()
+	svc, err := c.service(ctx)
+	var policy *resourcemanager.OrgPolicy
+	if err == nil {
+		policy, err = svc.Projects.GetEffectiveOrgPolicy("projects/"+project, &resourcemanager.GetEffectiveOrgPolicyRequest{Constraint: constraint}).Context(ctx).Do()
+	}
+	if err != nil && !c.warned[key] {
+		c.warned[key] = true
+		c.log.WithError(err).WithFields(logrus.Fields{"project": project, "constraint": constraint}).Warn("Unable to read the organization policy, so it isn't checked")
+	}
+	// policies that can't be read aren't read again until they expire
+	// either, so each snapshot doesn't wait for them
+	c.policies[key] = cachedOrgPolicy{policy: policy, fetched: now}
+	return policy
+}
+
+// report returns the pre-flight error of the blocking violations of an
+// operation, and warns about the others once.
+func (c *orgPolicyChecker) report(operation string, violations []orgPolicyViolation) error {
+	var blocking []string
+	for _, v := range violations {
+		if v.blocking {
+			blocking = append(blocking, v.String())
+			continue
+		}
+		c.lock.Lock()
+		warned := c.warned[v.String()]
+		c.warned[v.String()] = true
+		c.lock.Unlock()
+		if !warned {
+			c.log.WithFields(logrus.Fields{"project": v.project, "constraint": v.constraint}).Warnf("Organization policy pre-flight check: %s; %s", v.problem, v.fix)
+		}
+	}
+	if len(blocking) == 0 {
+		return nil
+	}
+	return errors.Errorf("organization policy pre-flight check of %s failed: %s", operation, strings.Join(blocking, "; "))
+}
+
+// listPolicyAllows reports whether the effective policy of a list
+// constraint allows a value, and whether that's known, which it isn't when
+// the policy lists values matches can't evaluate, like unknown value
+// groups.
+func listPolicyAllows(policy *resourcemanager.OrgPolicy, matches func(value string) (match, known bool)) (allowed, known bool) {
+	if policy == nil || policy.ListPolicy == nil {
+		return true, true
+	}
+	list := policy.ListPolicy
+	switch list.AllValues {
+	case "ALLOW":
+		return true, true
+	case "DENY":
+		return false, true
+	}
+
+	known = true
+	for _, value := range list.DeniedValues {
+		match, ok := matches(value)
+		if match {
+			return false, true
+		}
+		known = known && ok
+	}
+	if len(list.AllowedValues) == 0 {
+		return true, known
+	}
+	for _, value := range list.AllowedValues {
+		match, ok := matches(value)
+		if match {
+			return true, known
+		}
+		known = known && ok
+	}
+	return false, known
+}
+
+// restricts reports whether the effective policy of a list constraint
+// restricts its values.
+func restricts(policy *resourcemanager.OrgPolicy) bool {
+	if policy == nil || policy.ListPolicy == nil {
+		return false
+	}
+	list := policy.ListPolicy
+	return list.AllValues == "DENY" || (list.AllValues == "" && (len(list.AllowedValues) > 0 || len(list.DeniedValues) > 0))
+}
+
+// enforced reports whether the effective policy of a boolean constraint is
+// enforced.
+func enforced(policy *resourcemanager.OrgPolicy) bool {
+	return policy != nil && policy.BooleanPolicy != nil && policy.BooleanPolicy.Enforced
+}
+
+// locationMatcher matches the values of gcp.resourceLocations with a zone,
+// region or multi-region. Values of a region, and value groups of a region
+// or multi-region, match the zones of their regions.
+func locationMatcher(location string) func(value string) (bool, bool) {
+	location = strings.ToLower(location)
+	region := location
+	if m := zoneRegexp.FindStringSubmatch(location); m != nil {
+		region = m[1]
+	}
+	return func(value string) (bool, bool) {
+		value = strings.TrimPrefix(value, "is:")
+		if group := strings.TrimPrefix(value, "in:"); group != value {
+			name := strings.TrimSuffix(group, "-locations")
+			if regionRegexp.MatchString(name) {
+				return region == name, true
+			}
+			if prefix, ok := multiRegionLocationGroups[name]; ok {
+				return location == name || strings.HasPrefix(region, prefix), true
+			}
+			return false, false
+		}
+		// values may say what kind of location they are, e.g.
+		// zones:us-central1-a
+		if i := strings.Index(value, ":"); i >= 0 {
+			value = value[i+1:]
+		}
+		return value == location || value == region, true
+	}
+}
+
+// serviceMatcher matches the values of gcp.restrictNonCmekServices with an
+// API.
+func serviceMatcher(service string) func(value string) (bool, bool) {
+	return func(value string) (bool, bool) {
+		return strings.TrimPrefix(value, "is:") == service, true
+	}
+}
+
+// requiresCMEK reports whether a project only allows an API to create
+// resources encrypted with Cloud KMS keys.
+func (c *orgPolicyChecker) requiresCMEK(project, service string) bool {
+	allowed, known := listPolicyAllows(c.policy(project, restrictNonCMEKServicesConstraint), serviceMatcher(service))
+	return !allowed && known
+}
+
+// locationViolation returns the violation of writing to a location a
+// project's gcp.resourceLocations doesn't allow, if it doesn't.
+func (c *orgPolicyChecker) locationViolation(project, what, location, fix string, blocking bool) []orgPolicyViolation {
+	allowed, known := listPolicyAllows(c.policy(project, resourceLocationsConstraint), locationMatcher(location))
+	if allowed || !known {
+		return nil
+	}
+	return []orgPolicyViolation{{
+		project:    project,
+		constraint: resourceLocationsConstraint,
+		problem:    fmt.Sprintf("%s is in %s, which isn't an allowed location", what, location),
+		fix:        fix,
+		blocking:   blocking,
+	}}
+}
+
+// credentialsViolations returns the violations of a location's credentials:
+// keys of service accounts whose project disables key creation can't be
+// replaced when they're rotated or expire.
+func (c *orgPolicyChecker) credentialsViolations() []orgPolicyViolation {
+	credsJSON, err := c.credentials.configuredJSON()
+	if err != nil {
+		return nil
+	}
+	var key struct {
+		serviceAccountKeyJSON
+		ProjectID string `json:"project_id"`
+	}
+	if err := json.Unmarshal(credsJSON, &key); err != nil || key.Type != serviceAccountCredentials || key.ProjectID == "" {
+		return nil
+	}
+	if !enforced(c.policy(key.ProjectID, disableServiceAccountKeysConstraint)) {
+		return nil
+	}
+	return []orgPolicyViolation{{
+		project:    key.ProjectID,
+		constraint: disableServiceAccountKeysConstraint,
+		problem:    fmt.Sprintf("the location authenticates with a key of service account %s, and new keys can't be created to replace it when it's rotated or expires", key.ClientEmail),
+		fix:        "use Workload Identity, or another source of credentials without keys",
+	}}
+}
+
+// snapshotViolations returns the violations of snapshotting a disk, or of
+// any snapshot if disk is nil, into a project.
+func (c *orgPolicyChecker) snapshotViolations(project, snapshotLocation string, disk *compute.Disk) []orgPolicyViolation {
+	violations := c.credentialsViolations()
+	if snapshotLocation != "" {
+		violations = append(violations, c.locationViolation(project, snapshotLocationKey, snapshotLocation, "set "+snapshotLocationKey+" to an allowed region or multi-region", true)...)
+	} else if restricts(c.policy(project, resourceLocationsConstraint)) {
+		violations = append(violations, orgPolicyViolation{
+			project:    project,
+			constraint: resourceLocationsConstraint,
+			problem:    "snapshots are stored in the multi-region nearest to their disks, which may not be an allowed location",
+			fix:        "set " + snapshotLocationKey + " to an allowed region or multi-region",
+		})
+	}
+	if disk != nil && (disk.DiskEncryptionKey == nil || disk.DiskEncryptionKey.KmsKeyName == "") && c.requiresCMEK(project, computeAPI) {
+		violations = append(violations, orgPolicyViolation{
+			project:    project,
+			constraint: restrictNonCMEKServicesConstraint,
+			problem:    fmt.Sprintf("disk %s isn't encrypted with a Cloud KMS key, and snapshots must be", disk.Name),
+			fix:        "provision the volume with a StorageClass whose disk-encryption-kms-key parameter sets a key",
+			blocking:   true,
+		})
+	}
+	return violations
+}
+
+// restoreViolations returns the violations of restoring a snapshot to disks
+// in zones of a project.
+func (c *orgPolicyChecker) restoreViolations(project string, zones []string, snapshot *compute.Snapshot) []orgPolicyViolation {
+	violations := c.credentialsViolations()
+	for _, zone := range zones {
+		violations = append(violations, c.locationViolation(project, "the restored volume's zone", zone, "restore into a cluster whose nodes are in allowed zones", true)...)
+	}
+	if snapshotKMSKey(snapshot) == "" && c.requiresCMEK(project, computeAPI) {
+		violations = append(violations, orgPolicyViolation{
+			project:    project,
+			constraint: restrictNonCMEKServicesConstraint,
+			problem:    fmt.Sprintf("snapshot %s isn't encrypted with a Cloud KMS key, so neither is the disk restored from it, and disks must be", snapshot.Name),
+			fix:        "exempt " + computeAPI + " from the constraint for the restore, or restore into a project that doesn't require Cloud KMS keys",
+			blocking:   true,
+		})
+	}
+	return violations
+}
+
+// bucketViolations returns the violations of writing backups to a bucket,
+// with a Cloud KMS key if kmsKeyName is set. members are the bucket's IAM
+// members, if they could be read.
+func (c *orgPolicyChecker) bucketViolations(attrs *storage.BucketAttrs, kmsKeyName string, members []string) []orgPolicyViolation {
+	violations := c.credentialsViolations()
+	project := strconv.FormatUint(attrs.ProjectNumber, 10)
+	violations = append(violations, c.locationViolation(project, "bucket "+attrs.Name, strings.ToLower(attrs.Location), "move the backups to a bucket in an allowed location", false)...)
+
+	hasKey := kmsKeyName != "" || (attrs.Encryption != nil && attrs.Encryption.DefaultKMSKeyName != "")
+	if !hasKey && c.requiresCMEK(project, storageAPI) {
+		violations = append(violations, orgPolicyViolation{
+			project:    project,
+			constraint: restrictNonCMEKServicesConstraint,
+			problem:    fmt.Sprintf("objects written to bucket %s aren't encrypted with a Cloud KMS key, and must be", attrs.Name),
+			fix:        "set " + kmsKeyNameConfigKey + ", or a default Cloud KMS key on the bucket",
+			blocking:   true,
+		})
+	}
+
+	var public []string
+	for _, member := range members {
+		if member == iam.AllUsers || member == iam.AllAuthenticatedUsers {
+			public = append(public, member)
+		}
+	}
+	if len(public) > 0 && enforced(c.policy(project, publicAccessPreventionConstraint)) {
+		violations = append(violations, orgPolicyViolation{
+			project:    project,
+			constraint: publicAccessPreventionConstraint,
+			problem:    fmt.Sprintf("bucket %s grants access to %s, which the constraint blocks", attrs.Name, strings.Join(public, " and ")),
+			fix:        "remove the public members from the bucket's IAM policy",
+		})
+	}
+	return violations
+}
+
+// orgPolicyHealth returns the health check result of violations: the
+// blocking ones fail it, and the others are noted.
+func orgPolicyHealth(violations []orgPolicyViolation) (string, error) {
+	var blocking, notes []string
+	for _, v := range violations {
+		if v.blocking {
+			blocking = append(blocking, v.String())
+		} else {
+			notes = append(notes, v.String())
+		}
+	}
+	if len(blocking) > 0 {
+		return "", errors.New(strings.Join(blocking, "; "))
+	}
+	return strings.Join(notes, "; "), nil
+}
+
+// checkBucketOrgPolicies returns the pre-flight error of the blocking
+// violations of writing backups to a bucket.
+func (o *ObjectStore) checkBucketOrgPolicies(bucket string) error {
+	if o.clients().orgPolicies == nil {
+		return nil
+	}
+	violations, err := o.bucketOrgPolicyViolations(bucket)
+	if err != nil {
+		return err
+	}
+	return o.clients().orgPolicies.report("bucket "+bucket, violations)
+}
+
+func (o *ObjectStore) bucketOrgPolicyViolations(bucket string) ([]orgPolicyViolation, error) {
+	clients := o.clients()
+	attrs, err := clients.bucketWriter.getBucketAttrs(bucket)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error getting attributes of bucket %s to check its organization policies", bucket)
+	}
+	var members []string
+	ctx, cancel := context.WithTimeout(context.Background(), storageCallTimeout)
+	defer cancel()
+	if policy, err := clients.client.Bucket(bucket).IAM().Policy(ctx); err == nil {
+		for _, role := range policy.Roles() {
+			members = append(members, policy.Members(role)...)
+		}
+	}
+	return clients.orgPolicies.bucketViolations(attrs, o.kmsKeyName, members), nil
+}
+
+// checkSnapshotOrgPolicies returns the pre-flight error of the blocking
+// violations of snapshotting a disk.
+func (b *VolumeSnapshotter) checkSnapshotOrgPolicies(disk *compute.Disk) error {
+	orgPolicies := b.clients().orgPolicies
+	if orgPolicies == nil {
+		return nil
+	}
+	return orgPolicies.report("the snapshot of disk "+disk.Name, orgPolicies.snapshotViolations(b.snapshotProject, b.snapshotLocation, disk))
+}
+
+// checkRestoreOrgPolicies returns the pre-flight error of the blocking
+// violations of restoring a snapshot to disks in zones.
+func (b *VolumeSnapshotter) checkRestoreOrgPolicies(snapshot *compute.Snapshot, zones []string) error {
+	orgPolicies := b.clients().orgPolicies
+	if orgPolicies == nil {
+		return nil
+	}
+	return orgPolicies.report("the restore of snapshot "+snapshot.Name, orgPolicies.restoreViolations(b.volumeProject, zones, snapshot))
+}
@@ -0,0 +1,178 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	velerotest "github.com/vmware-tanzu/velero/pkg/test"
+	resourcemanager "google.golang.org/api/cloudresourcemanager/v1"
+	"google.golang.org/api/compute/v1"
+	"google.golang.org/api/option"
+)
+
+func TestListPolicyAllows(t *testing.T) {
+	list := func(allowed, denied []string) *resourcemanager.OrgPolicy {
+		return &resourcemanager.OrgPolicy{ListPolicy: &resourcemanager.ListPolicy{AllowedValues: allowed, DeniedValues: denied}}
+	}
+	tests := []struct {
+		policy   *resourcemanager.OrgPolicy
+		location string
+		allowed  bool
+		known    bool
+	}{
+		{nil, "us-central1", true, true},
+		{&resourcemanager.OrgPolicy{ListPolicy: &resourcemanager.ListPolicy{AllValues: "DENY"}}, "us-central1", false, true},
+		{list([]string{"in:eu-locations"}, nil), "europe-west4-a", true, true},
+		{list([]string{"in:eu-locations"}, nil), "eu", true, true},
+		{list([]string{"in:eu-locations"}, nil), "us-central1", false, true},
+		{list([]string{"in:us-central1-locations"}, nil), "us-central1-f", true, true},
+		{list([]string{"in:us-central1-locations"}, nil), "us-east1", false, true},
+		{list([]string{"is:us-east1", "zones:us-central1-a"}, nil), "us-central1-a", true, true},
+		{list(nil, []string{"in:asia-locations"}), "asia-east1", false, true},
+		{list(nil, []string{"in:asia-locations"}), "us", true, true},
+		// value groups that can't be evaluated
+		{list([]string{"in:canada-locations"}, nil), "northamerica-northeast1", false, false},
+		{list([]string{"us-central1"}, []string{"in:canada-locations"}), "us-central1", true, false},
+	}
+	for _, test := range tests {
+		allowed, known := listPolicyAllows(test.policy, locationMatcher(test.location))
+		assert.Equal(t, test.allowed, allowed, "%v %s", test.policy, test.location)
+		assert.Equal(t, test.known, known, "%v %s", test.policy, test.location)
+	}
+
+	allowed, known := listPolicyAllows(list(nil, []string{"is:compute.googleapis.com"}), serviceMatcher(computeAPI))
+	assert.False(t, allowed)
+	assert.True(t, known)
+	assert.True(t, restricts(list(nil, []string{"in:asia-locations"})))
+	assert.False(t, restricts(&resourcemanager.OrgPolicy{ListPolicy: &resourcemanager.ListPolicy{AllValues: "ALLOW"}}))
+}
+
+// newTestOrgPolicyChecker returns a checker reading the effective policies
+// of each project and constraint from policies, failing for missing ones.
+func newTestOrgPolicyChecker(t *testing.T, policies map[string]*resourcemanager.OrgPolicy) (*orgPolicyChecker, *int) {
+	requests := new(int)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		*requests++
+		var req resourcemanager.GetEffectiveOrgPolicyRequest
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+		project := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/v1/projects/"), ":getEffectiveOrgPolicy")
+		policy, ok := policies[project+"/"+req.Constraint]
+		if !ok {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		json.NewEncoder(w).Encode(policy)
+	}))
+	t.Cleanup(server.Close)
+
+	svc, err := resourcemanager.NewService(context.Background(), option.WithEndpoint(server.URL), option.WithoutAuthentication())
+	require.NoError(t, err)
+	c := newOrgPolicyChecker(velerotest.NewLogger(), map[string]string{orgPolicyChecksConfigKey: "true"}, locationCredentials{})
+	c.svc = svc
+	return c, requests
+}
+
+func TestSnapshotOrgPolicies(t *testing.T) {
+	c, requests := newTestOrgPolicyChecker(t, map[string]*resourcemanager.OrgPolicy{
+		"snapshots/" + resourceLocationsConstraint:       {ListPolicy: &resourcemanager.ListPolicy{AllowedValues: []string{"in:eu-locations"}}},
+		"snapshots/" + restrictNonCMEKServicesConstraint: {ListPolicy: &resourcemanager.ListPolicy{DeniedValues: []string{"is:compute.googleapis.com"}}},
+	})
+	b := (&VolumeSnapshotter{log: velerotest.NewLogger(), snapshotProject: "snapshots", volumeProject: "volumes", snapshotLocation: "us"}).withClients(&snapshotterClients{orgPolicies: c})
+
+	// GCP would reject the snapshot's location and its disk's encryption
+	err := b.checkSnapshotOrgPolicies(&compute.Disk{Name: "pvc-1"})
+	require.Error(t, err)
+	assert.Equal(t, "organization policy pre-flight check of the snapshot of disk pvc-1 failed: "+
+		"constraints/gcp.resourceLocations of project snapshots: snapshotLocation is in us, which isn't an allowed location; set snapshotLocation to an allowed region or multi-region; "+
+		"constraints/gcp.restrictNonCmekServices of project snapshots: disk pvc-1 isn't encrypted with a Cloud KMS key, and snapshots must be; provision the volume with a StorageClass whose disk-encryption-kms-key parameter sets a key", err.Error())
+
+	b.snapshotLocation = "europe-west4"
+	assert.NoError(t, b.checkSnapshotOrgPolicies(&compute.Disk{Name: "pvc-1", DiskEncryptionKey: &compute.CustomerEncryptionKey{KmsKeyName: testKeyName}}))
+
+	// without a snapshot location, snapshots may not be stored in an
+	// allowed location, which is only warned about
+	b.snapshotLocation = ""
+	violations := c.snapshotViolations("snapshots", "", nil)
+	require.Len(t, violations, 1)
+	assert.False(t, violations[0].blocking)
+	note, err := orgPolicyHealth(violations)
+	require.NoError(t, err)
+	assert.Contains(t, note, "snapshots are stored in the multi-region nearest to their disks")
+
+	// policies are cached, including those that can't be read, which
+	// aren't checked
+	n := *requests
+	assert.NoError(t, b.checkRestoreOrgPolicies(&compute.Snapshot{Name: "snap-1"}, []string{"us-central1-a"}))
+	assert.NoError(t, b.checkRestoreOrgPolicies(&compute.Snapshot{Name: "snap-1"}, []string{"us-central1-a"}))
+	assert.Equal(t, n+2, *requests)
+	c.now = func() time.Time { return time.Now().Add(orgPolicyCacheTTL) }
+	assert.NoError(t, b.checkSnapshotOrgPolicies(&compute.Disk{Name: "pvc-1", DiskEncryptionKey: &compute.CustomerEncryptionKey{KmsKeyName: testKeyName}}))
+	assert.Equal(t, n+3, *requests)
+}
+
+func TestRestoreOrgPolicies(t *testing.T) {
+	c, _ := newTestOrgPolicyChecker(t, map[string]*resourcemanager.OrgPolicy{
+		"volumes/" + resourceLocationsConstraint:       {ListPolicy: &resourcemanager.ListPolicy{AllowedValues: []string{"in:us-central1-locations"}}},
+		"volumes/" + restrictNonCMEKServicesConstraint: {ListPolicy: &resourcemanager.ListPolicy{AllValues: "DENY"}},
+	})
+	b := (&VolumeSnapshotter{log: velerotest.NewLogger(), snapshotProject: "snapshots", volumeProject: "volumes"}).withClients(&snapshotterClients{orgPolicies: c})
+
+	err := b.checkRestoreOrgPolicies(&compute.Snapshot{Name: "snap-1"}, []string{"us-central1-a", "us-east1-b"})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "the restored volume's zone is in us-east1-b, which isn't an allowed location")
+	assert.NotContains(t, err.Error(), "us-central1-a,")
+	assert.Contains(t, err.Error(), "snapshot snap-1 isn't encrypted with a Cloud KMS key")
+
+	snapshot := &compute.Snapshot{Name: "snap-2", SnapshotEncryptionKey: &compute.CustomerEncryptionKey{KmsKeyName: testKeyName}}
+	assert.NoError(t, b.checkRestoreOrgPolicies(snapshot, []string{"us-central1-a"}))
+}
+
+func TestBucketOrgPolicies(t *testing.T) {
+	c, _ := newTestOrgPolicyChecker(t, map[string]*resourcemanager.OrgPolicy{
+		"123/" + resourceLocationsConstraint:       {ListPolicy: &resourcemanager.ListPolicy{AllowedValues: []string{"in:eu-locations"}}},
+		"123/" + restrictNonCMEKServicesConstraint: {ListPolicy: &resourcemanager.ListPolicy{DeniedValues: []string{"storage.googleapis.com"}}},
+		"123/" + publicAccessPreventionConstraint:  {BooleanPolicy: &resourcemanager.BooleanPolicy{Enforced: true}},
+	})
+	attrs := &storage.BucketAttrs{Name: "backups", Location: "US", ProjectNumber: 123}
+
+	violations := c.bucketViolations(attrs, "", []string{"user:a@example.com", "allUsers"})
+	require.Len(t, violations, 3)
+	assert.Equal(t, "constraints/gcp.resourceLocations of project 123: bucket backups is in us, which isn't an allowed location; move the backups to a bucket in an allowed location", violations[0].String())
+	assert.False(t, violations[0].blocking)
+	assert.Equal(t, "constraints/gcp.restrictNonCmekServices of project 123: objects written to bucket backups aren't encrypted with a Cloud KMS key, and must be; set kmsKeyName, or a default Cloud KMS key on the bucket", violations[1].String())
+	assert.True(t, violations[1].blocking)
+	assert.Equal(t, "constraints/storage.publicAccessPrevention of project 123: bucket backups grants access to allUsers, which the constraint blocks; remove the public members from the bucket's IAM policy", violations[2].String())
+
+	_, err := orgPolicyHealth(violations)
+	assert.Error(t, err)
+
+	// only the blocking violations fail, and the others are warned about
+	attrs.Encryption = &storage.BucketEncryption{DefaultKMSKeyName: testKeyName}
+	violations = c.bucketViolations(attrs, "", nil)
+	require.Len(t, violations, 1)
+	assert.NoError(t, c.report("bucket backups", violations))
+}
@@ -0,0 +1,122 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/vmware-tanzu/velero/pkg/plugin/framework"
+	"google.golang.org/api/compute/v1"
+	"google.golang.org/api/option"
+)
+
+const (
+	veleroNamespaceEnvVar  = "VELERO_NAMESPACE"
+	defaultVeleroNamespace = "velero"
+)
+
+// pluginConfig returns the data of the ConfigMap in Velero's namespace that
+// configures an item action, the same way Velero's own actions are
+// configured: the ConfigMap is labeled with velero.io/plugin-config and
+// <action name>: <plugin kind>. It returns nil if there is no such ConfigMap.
+func (inCluster) pluginConfig(kind framework.PluginKind, name string) (map[string]string, error) {
+	client, err := newInClusterClient()
+	if err != nil {
+		return nil, err
+	}
+	return client.pluginConfig(veleroNamespace(), kind, name)
+}
+
+// newActionClientOptions returns the client options for an item action,
+// with the credentials settings and project from the action's ConfigMap,
+// which are the same as a VolumeSnapshotLocation's. It returns the options,
+// the project and the action's config.
+func newActionClientOptions(cluster veleroCluster, kind framework.PluginKind, name string, scopes ...string) ([]option.ClientOption, string, map[string]string, error) {
+	config, err := cluster.pluginConfig(kind, name)
+	if err != nil {
+		return nil, "", nil, err
+	}
+	if config == nil {
+		config = make(map[string]string)
+	}
+	credentials, err := newLocationCredentials(platformSecrets{}, config, volumeSnapshotterCredentialsEnvVar)
+	if err != nil {
+		return nil, "", nil, err
+	}
+
+	ctx := context.Background()
+	creds, err := credentials.find(ctx, scopes...)
+	if err != nil {
+		return nil, "", nil, err
+	}
+	project := config[projectKey]
+	if project == "" {
+		project = creds.ProjectID
+	}
+
+	opts, err := credentials.clientOptions(ctx, scopes...)
+	if err != nil {
+		return nil, "", nil, err
+	}
+	return opts, project, config, nil
+}
+
+// newActionComputeService creates a compute client for an item action, see
+// newActionClientOptions.
+func newActionComputeService(log logrus.FieldLogger, cluster veleroCluster, kind framework.PluginKind, name string, scopes ...string) (*compute.Service, string, map[string]string, error) {
+	opts, project, config, err := newActionClientOptions(cluster, kind, name, scopes...)
+	if err != nil {
+		return nil, "", nil, err
+	}
+	if opts, err = instrumentClientOptions(context.Background(), log, computeService, opts); err != nil {
+		return nil, "", nil, err
+	}
+	gce, err := newActionComputeClient(log, config, opts)
+	if err != nil {
+		return nil, "", nil, err
+	}
+	return gce, project, config, nil
+}
+
+// newActionComputeClient creates an item action's compute client with its
+// client options, routed through the first healthy endpoint of the action's
+// endpoints, like the volume snapshotter's.
+func newActionComputeClient(log logrus.FieldLogger, config map[string]string, opts []option.ClientOption) (*compute.Service, error) {
+	endpoint, err := locationEndpoint(config, log)
+	if err != nil {
+		return nil, err
+	}
+	opts = append(append([]option.ClientOption{}, opts...), endpointOptions(endpoint, "compute/v1/")...)
+	gce, err := compute.NewService(context.Background(), opts...)
+	return gce, errors.WithStack(err)
+}
+
+// veleroNamespace returns the namespace Velero runs in.
+func veleroNamespace() string {
+	if ns := os.Getenv(veleroNamespaceEnvVar); ns != "" {
+		return ns
+	}
+	if ns, err := ioutil.ReadFile(serviceAccountDir + "/namespace"); err == nil && len(ns) > 0 {
+		return strings.TrimSpace(string(ns))
+	}
+	return defaultVeleroNamespace
+}
@@ -0,0 +1,54 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	velerotest "github.com/vmware-tanzu/velero/pkg/test"
+	"google.golang.org/api/option"
+)
+
+func TestVeleroNamespace(t *testing.T) {
+	t.Setenv(veleroNamespaceEnvVar, "backup-system")
+	assert.Equal(t, "backup-system", veleroNamespace())
+}
+
+func TestNewActionComputeClient(t *testing.T) {
+	defer func(probes *endpointProbeCache) { endpointProbes = probes }(endpointProbes)
+	endpointProbes = &endpointProbeCache{
+		probe:   func(host string) error { return nil },
+		now:     time.Now,
+		results: make(map[string]endpointProbeResult),
+	}
+	opts := []option.ClientOption{option.WithoutAuthentication()}
+
+	gce, err := newActionComputeClient(velerotest.NewLogger(), map[string]string{}, opts)
+	require.NoError(t, err)
+	defaultPath := gce.BasePath
+
+	// actions route their compute requests through the endpoint selected
+	// for them, like locations
+	gce, err = newActionComputeClient(velerotest.NewLogger(), map[string]string{endpointsConfigKey: "restricted.googleapis.com,default"}, opts)
+	require.NoError(t, err)
+	assert.Equal(t, "https://restricted.googleapis.com/compute/v1/", gce.BasePath)
+	assert.NotEqual(t, defaultPath, gce.BasePath)
+	assert.Len(t, opts, 1, "the action's options aren't changed")
+}
@@ -0,0 +1,113 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	credentialProfileConfigKey = "credentialProfile"
+
+	// credentialProfilesEnvVar names the file defining the credential
+	// profiles locations can select, e.g. a mounted ConfigMap:
+	//
+	//   tenant-a:
+	//     credentialsFile: /credentials/tenant-a
+	//     quotaProject: tenant-a-billing
+	//   tenant-b:
+	//     impersonateServiceAccount: velero@tenant-b.iam.gserviceaccount.com
+	credentialProfilesEnvVar = "VELERO_GCP_CREDENTIAL_PROFILES"
+)
+
+// profileKeys are the config keys a credential profile can set.
+var profileKeys = []string{
+	credentialsFileConfigKey,
+	credentialsJSONConfigKey,
+	credentialsSecretConfigKey,
+	secretManagerCredentialsConfigKey,
+	accessTokenFileConfigKey,
+	fleetMembershipConfigKey,
+	fleetTokenFileConfigKey,
+	fleetServiceAccountConfigKey,
+	impersonateServiceAccountConfigKey,
+	impersonateDelegatesConfigKey,
+	quotaProjectConfigKey,
+	clientCertificateFileConfigKey,
+	clientKeyFileConfigKey,
+}
+
+// applyCredentialProfile returns the location's config merged with the
+// settings of the credential profile it selects, if any. Settings in the
+// location's own config take precedence.
+func applyCredentialProfile(config map[string]string) (map[string]string, error) {
+	name := config[credentialProfileConfigKey]
+	if name == "" {
+		return config, nil
+	}
+
+	path := os.Getenv(credentialProfilesEnvVar)
+	if path == "" {
+		return nil, errors.Errorf("%s %q is set, but no credential profiles are defined; set %s to the profiles file", credentialProfileConfigKey, name, credentialProfilesEnvVar)
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error reading credential profiles file %v", path)
+	}
+
+	var profiles map[string]map[string]string
+	if err := yaml.Unmarshal(b, &profiles); err != nil {
+		return nil, errors.Wrapf(err, "error parsing credential profiles file %v", path)
+	}
+	profile, ok := profiles[name]
+	if !ok {
+		return nil, errors.Errorf("credential profile %q is not defined in %v", name, path)
+	}
+
+	merged := make(map[string]string, len(config)+len(profile))
+	for k, v := range profile {
+		if !isProfileKey(k) {
+			return nil, errors.Errorf("credential profile %q sets %s; only %s can be set in profiles", name, k, strings.Join(sortedProfileKeys(), ", "))
+		}
+		merged[k] = v
+	}
+	for k, v := range config {
+		merged[k] = v
+	}
+	return merged, nil
+}
+
+func isProfileKey(key string) bool {
+	for _, k := range profileKeys {
+		if k == key {
+			return true
+		}
+	}
+	return false
+}
+
+func sortedProfileKeys() []string {
+	keys := append([]string(nil), profileKeys...)
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,70 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestApplyCredentialProfile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "profiles.yaml")
+	require.NoError(t, ioutil.WriteFile(path, []byte(`
+tenant-a:
+  credentialsFile: /credentials/tenant-a
+  quotaProject: tenant-a-billing
+tenant-b:
+  impersonateServiceAccount: velero@tenant-b.iam.gserviceaccount.com
+invalid:
+  bucket: other-bucket
+`), 0600))
+
+	config := map[string]string{"bucket": "backups"}
+	merged, err := applyCredentialProfile(config)
+	require.NoError(t, err)
+	assert.Equal(t, config, merged, "locations without a profile are unchanged")
+
+	_, err = applyCredentialProfile(map[string]string{credentialProfileConfigKey: "tenant-a"})
+	assert.Error(t, err, "profiles can't be selected when none are defined")
+
+	t.Setenv(credentialProfilesEnvVar, path)
+
+	merged, err = applyCredentialProfile(map[string]string{
+		credentialProfileConfigKey: "tenant-a",
+		quotaProjectConfigKey:      "location-billing",
+	})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{
+		credentialProfileConfigKey: "tenant-a",
+		credentialsFileConfigKey:   "/credentials/tenant-a",
+		quotaProjectConfigKey:      "location-billing",
+	}, merged)
+
+	c, err := newLocationCredentials(&fakeSecrets{}, map[string]string{credentialProfileConfigKey: "tenant-b"}, "")
+	require.NoError(t, err)
+	assert.Equal(t, "velero@tenant-b.iam.gserviceaccount.com", c.impersonate)
+
+	_, err = applyCredentialProfile(map[string]string{credentialProfileConfigKey: "missing"})
+	assert.Error(t, err)
+
+	_, err = applyCredentialProfile(map[string]string{credentialProfileConfigKey: "invalid"})
+	assert.Error(t, err, "profiles can only set credential settings")
+}
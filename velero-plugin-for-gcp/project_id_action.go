@@ -0,0 +1,189 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/vmware-tanzu/velero/pkg/plugin/framework"
+	"github.com/vmware-tanzu/velero/pkg/plugin/velero"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	projectIDActionName = "velero.io/gcp-project-id"
+
+	// annotationsConfigKey and configMapKeysConfigKey are the keys of the
+	// action's ConfigMap listing the annotations and ConfigMap data keys
+	// whose values project IDs are rewritten in.
+	annotationsConfigKey   = "annotations"
+	configMapKeysConfigKey = "configMapKeys"
+)
+
+// ProjectIDAction is a restore item action that replaces project IDs
+// according to a configured mapping in selected annotations, ConfigMap keys
+// and the volume handles of CSI persistent volumes, for restores into
+// another project.
+type ProjectIDAction struct {
+	log     logrus.FieldLogger
+	cluster veleroCluster
+
+	once      sync.Once
+	config    projectIDConfig
+	configErr error
+}
+
+type projectIDConfig struct {
+	projects      map[string]string
+	annotations   []string
+	configMapKeys []string
+}
+
+func newProjectIDAction(logger logrus.FieldLogger) (interface{}, error) {
+	return &ProjectIDAction{log: logger, cluster: inCluster{}}, nil
+}
+
+func (a *ProjectIDAction) AppliesTo() (velero.ResourceSelector, error) {
+	return velero.ResourceSelector{}, nil
+}
+
+// loadConfig reads the action's configuration once, since the action is
+// executed for every item being restored.
+func (a *ProjectIDAction) loadConfig() (projectIDConfig, error) {
+	a.once.Do(func() {
+		var data map[string]string
+		data, a.configErr = a.cluster.pluginConfig(framework.PluginKindRestoreItemAction, projectIDActionName)
+		if a.configErr != nil {
+			return
+		}
+		a.config, a.configErr = parseProjectIDConfig(data)
+	})
+	return a.config, a.configErr
+}
+
+func parseProjectIDConfig(data map[string]string) (projectIDConfig, error) {
+	c := projectIDConfig{
+		annotations:   parseList(data[annotationsConfigKey]),
+		configMapKeys: parseList(data[configMapKeysConfigKey]),
+	}
+	if err := yaml.Unmarshal([]byte(data[projectsConfigKey]), &c.projects); err != nil {
+		return c, errors.Wrapf(err, "error parsing %s in the %s ConfigMap", projectsConfigKey, projectIDActionName)
+	}
+	return c, nil
+}
+
+func (a *ProjectIDAction) Execute(input *velero.RestoreItemActionExecuteInput) (*velero.RestoreItemActionExecuteOutput, error) {
+	obj := &unstructured.Unstructured{Object: input.Item.UnstructuredContent()}
+
+	config, err := a.loadConfig()
+	if err != nil {
+		return nil, err
+	}
+	if len(config.projects) == 0 {
+		return velero.NewRestoreItemActionExecuteOutput(obj), nil
+	}
+
+	log := a.log.WithFields(logrus.Fields{"restore": restoreName(input), "kind": obj.GetKind(), "namespace": obj.GetNamespace(), "name": obj.GetName()})
+
+	if annotations := obj.GetAnnotations(); len(annotations) > 0 {
+		changed := false
+		for _, key := range config.annotations {
+			if value, ok := annotations[key]; ok {
+				if rewritten := replaceProjectIDs(value, config.projects); rewritten != value {
+					log.Infof("Rewriting project IDs in annotation %s", key)
+					annotations[key] = rewritten
+					changed = true
+				}
+			}
+		}
+		if changed {
+			obj.SetAnnotations(annotations)
+		}
+	}
+
+	switch obj.GetKind() {
+	case "ConfigMap":
+		for _, key := range config.configMapKeys {
+			value, found, err := unstructured.NestedString(obj.Object, "data", key)
+			if err != nil {
+				return nil, errors.WithStack(err)
+			}
+			if !found {
+				continue
+			}
+			if rewritten := replaceProjectIDs(value, config.projects); rewritten != value {
+				log.Infof("Rewriting project IDs in ConfigMap key %s", key)
+				if err := unstructured.SetNestedField(obj.Object, rewritten, "data", key); err != nil {
+					return nil, errors.WithStack(err)
+				}
+			}
+		}
+	case "PersistentVolume":
+		handle, found, err := unstructured.NestedString(obj.Object, "spec", "csi", "volumeHandle")
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		if !found {
+			break
+		}
+		if rewritten := replaceProjectIDs(handle, config.projects); rewritten != handle {
+			log.Infof("Rewriting volume handle from %s to %s", handle, rewritten)
+			if err := unstructured.SetNestedField(obj.Object, rewritten, "spec", "csi", "volumeHandle"); err != nil {
+				return nil, errors.WithStack(err)
+			}
+		}
+	}
+
+	return velero.NewRestoreItemActionExecuteOutput(obj), nil
+}
+
+// replaceProjectIDs replaces whole occurrences of the mapped project IDs in
+// s, leaving longer IDs that merely contain a mapped one, e.g. "prod-2"
+// when mapping "prod", untouched. Since project IDs consist of lowercase
+// letters, digits and hyphens, a whole occurrence is a maximal run of them.
+func replaceProjectIDs(s string, projects map[string]string) string {
+	var b strings.Builder
+	start := -1
+	for i := 0; i <= len(s); i++ {
+		if i < len(s) && isProjectIDChar(s[i]) {
+			if start < 0 {
+				start = i
+			}
+			continue
+		}
+		if start >= 0 {
+			token := s[start:i]
+			if replacement, ok := projects[token]; ok {
+				token = replacement
+			}
+			b.WriteString(token)
+			start = -1
+		}
+		if i < len(s) {
+			b.WriteByte(s[i])
+		}
+	}
+	return b.String()
+}
+
+func isProjectIDChar(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-'
+}
@@ -0,0 +1,89 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vmware-tanzu/velero/pkg/plugin/velero"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+
+	velerotest "github.com/vmware-tanzu/velero/pkg/test"
+)
+
+func TestReplaceProjectIDs(t *testing.T) {
+	projects := map[string]string{"prod": "dr", "dr": "prod"}
+
+	tests := []struct {
+		in       string
+		expected string
+	}{
+		{in: "prod", expected: "dr"},
+		{in: "projects/prod/zones/us-central1-a/disks/pvc-1", expected: "projects/dr/zones/us-central1-a/disks/pvc-1"},
+		{in: "app@prod.iam.gserviceaccount.com", expected: "app@dr.iam.gserviceaccount.com"},
+		{in: "prod-2 and my-prod stay", expected: "prod-2 and my-prod stay"},
+		{in: "swap prod,dr", expected: "swap dr,prod"},
+		{in: "", expected: ""},
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.expected, replaceProjectIDs(test.in, projects), test.in)
+	}
+}
+
+func TestProjectIDActionExecute(t *testing.T) {
+	cluster := &fakeCluster{configs: map[string]map[string]string{projectIDActionName: {
+		projectsConfigKey:      "old-project: new-project",
+		annotationsConfigKey:   "example.com/project, cnrm.cloud.google.com/project-id",
+		configMapKeysConfigKey: "PROJECT_ID",
+	}}}
+	action := &ProjectIDAction{log: velerotest.NewLogger(), cluster: cluster}
+
+	configMap := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "v1",
+		"kind":       "ConfigMap",
+		"metadata": map[string]interface{}{
+			"name":        "app",
+			"annotations": map[string]interface{}{"example.com/project": "old-project", "other": "old-project"},
+		},
+		"data": map[string]interface{}{"PROJECT_ID": "old-project", "OTHER": "old-project"},
+	}}
+	out, err := action.Execute(&velero.RestoreItemActionExecuteInput{Item: configMap})
+	require.NoError(t, err)
+	updated := &unstructured.Unstructured{Object: out.UpdatedItem.UnstructuredContent()}
+	assert.Equal(t, map[string]string{"example.com/project": "new-project", "other": "old-project"}, updated.GetAnnotations())
+	assert.Equal(t, map[string]interface{}{"PROJECT_ID": "new-project", "OTHER": "old-project"}, updated.Object["data"])
+
+	pv := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "v1",
+		"kind":       "PersistentVolume",
+		"metadata":   map[string]interface{}{"name": "pv-1"},
+		"spec": map[string]interface{}{
+			"csi": map[string]interface{}{
+				"driver":       "pd.csi.storage.gke.io",
+				"volumeHandle": "projects/old-project/zones/us-central1-a/disks/pvc-1",
+			},
+		},
+	}}
+	out, err = action.Execute(&velero.RestoreItemActionExecuteInput{Item: pv})
+	require.NoError(t, err)
+	handle, _, _ := unstructured.NestedString(out.UpdatedItem.UnstructuredContent(), "spec", "csi", "volumeHandle")
+	assert.Equal(t, "projects/new-project/zones/us-central1-a/disks/pvc-1", handle)
+
+	assert.Equal(t, 1, cluster.configReads, "the config is only read once")
+}
@@ -0,0 +1,183 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/vmware-tanzu/velero/pkg/plugin/framework"
+	"github.com/vmware-tanzu/velero/pkg/plugin/velero"
+	storagev1 "k8s.io/api/storage/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	provisionerActionName = "velero.io/gcp-provisioner"
+
+	// provisionersConfigKey and volumeBindingModesConfigKey are the keys of
+	// the action's ConfigMap holding YAML maps of source to destination
+	// provisioner and CSI driver names, and of StorageClass names to the
+	// volume binding mode to restore them with, where "*" matches every
+	// StorageClass.
+	provisionersConfigKey       = "provisioners"
+	volumeBindingModesConfigKey = "volumeBindingModes"
+
+	allStorageClasses = "*"
+
+	storageProvisionerAnnotation     = "volume.kubernetes.io/storage-provisioner"
+	betaStorageProvisionerAnnotation = "volume.beta.kubernetes.io/storage-provisioner"
+)
+
+// ProvisionerAction is a restore item action that renames the provisioners
+// of restored StorageClasses, the CSI drivers of persistent volumes and the
+// provisioners PVCs are annotated with, and sets the volume binding mode of
+// StorageClasses, according to its ConfigMap, for restores into clusters
+// whose GCP CSI drivers are installed under other names or that need
+// another binding mode, where volumes would otherwise stay pending.
+type ProvisionerAction struct {
+	log     logrus.FieldLogger
+	cluster veleroCluster
+
+	once      sync.Once
+	config    provisionerConfig
+	configErr error
+}
+
+type provisionerConfig struct {
+	provisioners       map[string]string
+	volumeBindingModes map[string]storagev1.VolumeBindingMode
+}
+
+func newProvisionerAction(logger logrus.FieldLogger) (interface{}, error) {
+	return &ProvisionerAction{log: logger, cluster: inCluster{}}, nil
+}
+
+func (a *ProvisionerAction) AppliesTo() (velero.ResourceSelector, error) {
+	return velero.ResourceSelector{
+		IncludedResources: []string{"storageclasses", "persistentvolumes", "persistentvolumeclaims"},
+	}, nil
+}
+
+func (a *ProvisionerAction) loadConfig() (provisionerConfig, error) {
+	a.once.Do(func() {
+		var data map[string]string
+		data, a.configErr = a.cluster.pluginConfig(framework.PluginKindRestoreItemAction, provisionerActionName)
+		if a.configErr != nil {
+			return
+		}
+		a.config, a.configErr = parseProvisionerConfig(data)
+	})
+	return a.config, a.configErr
+}
+
+func parseProvisionerConfig(data map[string]string) (provisionerConfig, error) {
+	var c provisionerConfig
+	if err := yaml.Unmarshal([]byte(data[provisionersConfigKey]), &c.provisioners); err != nil {
+		return c, errors.Wrapf(err, "error parsing %s in the %s ConfigMap", provisionersConfigKey, provisionerActionName)
+	}
+	if err := yaml.Unmarshal([]byte(data[volumeBindingModesConfigKey]), &c.volumeBindingModes); err != nil {
+		return c, errors.Wrapf(err, "error parsing %s in the %s ConfigMap", volumeBindingModesConfigKey, provisionerActionName)
+	}
+	for class, mode := range c.volumeBindingModes {
+		if mode != storagev1.VolumeBindingImmediate && mode != storagev1.VolumeBindingWaitForFirstConsumer {
+			return c, errors.Errorf("invalid volume binding mode %q for StorageClass %s in the %s ConfigMap, expected %s or %s", mode, class, provisionerActionName, storagev1.VolumeBindingImmediate, storagev1.VolumeBindingWaitForFirstConsumer)
+		}
+	}
+	return c, nil
+}
+
+func (c provisionerConfig) empty() bool {
+	return len(c.provisioners) == 0 && len(c.volumeBindingModes) == 0
+}
+
+// volumeBindingMode returns the binding mode to restore a StorageClass with,
+// if any.
+func (c provisionerConfig) volumeBindingMode(class string) (storagev1.VolumeBindingMode, bool) {
+	if mode, ok := c.volumeBindingModes[class]; ok {
+		return mode, true
+	}
+	mode, ok := c.volumeBindingModes[allStorageClasses]
+	return mode, ok
+}
+
+func (a *ProvisionerAction) Execute(input *velero.RestoreItemActionExecuteInput) (*velero.RestoreItemActionExecuteOutput, error) {
+	obj := &unstructured.Unstructured{Object: input.Item.UnstructuredContent()}
+
+	config, err := a.loadConfig()
+	if err != nil {
+		return nil, err
+	}
+	if config.empty() {
+		return velero.NewRestoreItemActionExecuteOutput(obj), nil
+	}
+
+	log := a.log.WithFields(logrus.Fields{"restore": restoreName(input), "kind": obj.GetKind(), "namespace": obj.GetNamespace(), "name": obj.GetName()})
+
+	// renameField replaces the provisioner or driver name in a field, if it
+	// is mapped
+	renameField := func(fields ...string) error {
+		name, found, err := unstructured.NestedString(obj.Object, fields...)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		if mapped, ok := config.provisioners[name]; found && ok && mapped != name {
+			log.Infof("Replacing provisioner %s with %s", name, mapped)
+			return errors.WithStack(unstructured.SetNestedField(obj.Object, mapped, fields...))
+		}
+		return nil
+	}
+
+	switch obj.GetKind() {
+	case "StorageClass":
+		if err := renameField("provisioner"); err != nil {
+			return nil, err
+		}
+		if mode, ok := config.volumeBindingMode(obj.GetName()); ok {
+			current, _, _ := unstructured.NestedString(obj.Object, "volumeBindingMode")
+			if current != string(mode) {
+				log.Infof("Setting volume binding mode to %s", mode)
+				if err := unstructured.SetNestedField(obj.Object, string(mode), "volumeBindingMode"); err != nil {
+					return nil, errors.WithStack(err)
+				}
+			}
+		}
+	case "PersistentVolume":
+		if err := renameField("spec", "csi", "driver"); err != nil {
+			return nil, err
+		}
+	}
+
+	// PVs record the provisioner that created them, and PVCs the
+	// provisioner expected to provision them
+	if annotations := obj.GetAnnotations(); len(annotations) > 0 {
+		changed := false
+		for _, key := range []string{provisionedByAnnotation, storageProvisionerAnnotation, betaStorageProvisionerAnnotation} {
+			if mapped, ok := config.provisioners[annotations[key]]; ok && annotations[key] != "" && mapped != annotations[key] {
+				annotations[key] = mapped
+				changed = true
+			}
+		}
+		if changed {
+			obj.SetAnnotations(annotations)
+		}
+	}
+
+	return velero.NewRestoreItemActionExecuteOutput(obj), nil
+}
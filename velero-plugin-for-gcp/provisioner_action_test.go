@@ -0,0 +1,150 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vmware-tanzu/velero/pkg/plugin/velero"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+
+	velerotest "github.com/vmware-tanzu/velero/pkg/test"
+)
+
+func TestParseProvisionerConfig(t *testing.T) {
+	c, err := parseProvisionerConfig(map[string]string{
+		provisionersConfigKey:       "kubernetes.io/gce-pd: pd.csi.storage.gke.io",
+		volumeBindingModesConfigKey: "'*': WaitForFirstConsumer\nfast: Immediate",
+	})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{inTreePDProvisioner: pdCSIDriver}, c.provisioners)
+
+	mode, ok := c.volumeBindingMode("fast")
+	assert.True(t, ok)
+	assert.EqualValues(t, "Immediate", mode)
+	mode, ok = c.volumeBindingMode("standard")
+	assert.True(t, ok)
+	assert.EqualValues(t, "WaitForFirstConsumer", mode)
+
+	_, err = parseProvisionerConfig(map[string]string{volumeBindingModesConfigKey: "fast: Later"})
+	assert.Error(t, err)
+}
+
+func TestProvisionerActionExecute(t *testing.T) {
+	cluster := &fakeCluster{configs: map[string]map[string]string{provisionerActionName: {
+		provisionersConfigKey:       "pd.csi.storage.gke.io: pd.csi.storage.example.com",
+		volumeBindingModesConfigKey: "standard-rwo: WaitForFirstConsumer",
+	}}}
+	action := &ProvisionerAction{log: velerotest.NewLogger(), cluster: cluster}
+
+	tests := []struct {
+		name     string
+		item     map[string]interface{}
+		expected map[string]interface{}
+	}{
+		{
+			name: "StorageClass",
+			item: map[string]interface{}{
+				"apiVersion":        "storage.k8s.io/v1",
+				"kind":              "StorageClass",
+				"metadata":          map[string]interface{}{"name": "standard-rwo"},
+				"provisioner":       pdCSIDriver,
+				"volumeBindingMode": "Immediate",
+			},
+			expected: map[string]interface{}{
+				"apiVersion":        "storage.k8s.io/v1",
+				"kind":              "StorageClass",
+				"metadata":          map[string]interface{}{"name": "standard-rwo"},
+				"provisioner":       "pd.csi.storage.example.com",
+				"volumeBindingMode": "WaitForFirstConsumer",
+			},
+		},
+		{
+			name: "StorageClass of another provisioner",
+			item: map[string]interface{}{
+				"apiVersion":  "storage.k8s.io/v1",
+				"kind":        "StorageClass",
+				"metadata":    map[string]interface{}{"name": "nfs"},
+				"provisioner": "example.com/nfs",
+			},
+			expected: map[string]interface{}{
+				"apiVersion":  "storage.k8s.io/v1",
+				"kind":        "StorageClass",
+				"metadata":    map[string]interface{}{"name": "nfs"},
+				"provisioner": "example.com/nfs",
+			},
+		},
+		{
+			name: "PersistentVolume",
+			item: map[string]interface{}{
+				"apiVersion": "v1",
+				"kind":       "PersistentVolume",
+				"metadata": map[string]interface{}{
+					"name":        "pv-1",
+					"annotations": map[string]interface{}{provisionedByAnnotation: pdCSIDriver},
+				},
+				"spec": map[string]interface{}{"csi": map[string]interface{}{"driver": pdCSIDriver, "volumeHandle": "projects/p/zones/z/disks/d"}},
+			},
+			expected: map[string]interface{}{
+				"apiVersion": "v1",
+				"kind":       "PersistentVolume",
+				"metadata": map[string]interface{}{
+					"name":        "pv-1",
+					"annotations": map[string]interface{}{provisionedByAnnotation: "pd.csi.storage.example.com"},
+				},
+				"spec": map[string]interface{}{"csi": map[string]interface{}{"driver": "pd.csi.storage.example.com", "volumeHandle": "projects/p/zones/z/disks/d"}},
+			},
+		},
+		{
+			name: "PersistentVolumeClaim",
+			item: map[string]interface{}{
+				"apiVersion": "v1",
+				"kind":       "PersistentVolumeClaim",
+				"metadata": map[string]interface{}{
+					"name":      "data",
+					"namespace": "app",
+					"annotations": map[string]interface{}{
+						storageProvisionerAnnotation:     pdCSIDriver,
+						betaStorageProvisionerAnnotation: pdCSIDriver,
+					},
+				},
+			},
+			expected: map[string]interface{}{
+				"apiVersion": "v1",
+				"kind":       "PersistentVolumeClaim",
+				"metadata": map[string]interface{}{
+					"name":      "data",
+					"namespace": "app",
+					"annotations": map[string]interface{}{
+						storageProvisionerAnnotation:     "pd.csi.storage.example.com",
+						betaStorageProvisionerAnnotation: "pd.csi.storage.example.com",
+					},
+				},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			out, err := action.Execute(&velero.RestoreItemActionExecuteInput{Item: &unstructured.Unstructured{Object: test.item}})
+			require.NoError(t, err)
+			assert.Equal(t, test.expected, out.UpdatedItem.UnstructuredContent())
+		})
+	}
+}
@@ -0,0 +1,262 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/api/compute/v1"
+)
+
+const (
+	quotaCheckIntervalConfigKey    = "quotaCheckInterval"
+	quotaWarningThresholdConfigKey = "quotaWarningThreshold"
+
+	defaultQuotaWarningThreshold = 80
+
+	quotaUsageGauge = "velero_gcp_quota_usage"
+	quotaLimitGauge = "velero_gcp_quota_limit"
+
+	// globalQuotaRegion is the region label of project-wide quotas.
+	globalQuotaRegion = "global"
+)
+
+// watchedQuotas are the Compute Engine quotas snapshots and restores
+// consume: snapshots count against the project's SNAPSHOTS quota, and disks
+// created from them against their region's disk quotas.
+var watchedQuotas = map[string]bool{
+	"SNAPSHOTS":      true,
+	"DISKS_TOTAL_GB": true,
+	"SSD_TOTAL_GB":   true,
+}
+
+var (
+	// quotaMonitors records the quota monitor of each pair of volume and
+	// snapshot projects, since Velero initializes a new volume snapshotter
+	// for every operation.
+	quotaMonitors     = make(map[string]*quotaMonitor)
+	quotaMonitorsLock sync.Mutex
+)
+
+// quotaScope is a project's global quotas, or the quotas of one of its
+// regions.
+type quotaScope struct {
+	project string
+	region  string
+}
+
+func (s quotaScope) String() string {
+	if s.region == "" {
+		return s.project
+	}
+	return s.project + "/" + s.region
+}
+
+type quotaReading struct {
+	time   time.Time
+	quotas []*compute.Quota
+}
+
+// quotaMonitor periodically reads the watched quotas of the projects and
+// regions the plugin snapshots and restores disks in, publishes their usage
+// and limits as metrics, and warns when the usage of one crosses the
+// threshold.
+type quotaMonitor struct {
+	log       logrus.FieldLogger
+	gce       *compute.Service
+	interval  time.Duration
+	threshold float64
+	now       func() time.Time
+
+	lock     sync.Mutex
+	readings map[quotaScope]*quotaReading
+	// exceeded records the quotas whose usage was above the threshold when
+	// they were last read, so crossings are only logged once.
+	exceeded map[string]bool
+	// warned records the operations already warned about a quota, so a
+	// backup of many volumes is warned once.
+	warned map[string]bool
+}
+
+// startQuotaMonitor starts periodically reading the quotas of the location's
+// projects, if a quota check interval is configured.
+func (b *VolumeSnapshotter) startQuotaMonitor(config map[string]string) error {
+	val, ok := config[quotaCheckIntervalConfigKey]
+	if !ok {
+		return nil
+	}
+	interval, err := time.ParseDuration(val)
+	if err != nil || interval <= 0 {
+		return errors.Errorf("%s must be a positive duration, got %q", quotaCheckIntervalConfigKey, val)
+	}
+
+	threshold := defaultQuotaWarningThreshold
+	if val, ok := config[quotaWarningThresholdConfigKey]; ok {
+		if threshold, err = strconv.Atoi(val); err != nil || threshold <= 0 || threshold > 100 {
+			return errors.Errorf("%s must be a percentage between 1 and 100, got %q", quotaWarningThresholdConfigKey, val)
+		}
+	}
+
+	key := b.volumeProject + "/" + b.snapshotProject
+	quotaMonitorsLock.Lock()
+	defer quotaMonitorsLock.Unlock()
+	if m, ok := quotaMonitors[key]; ok {
+		// use the latest client, whose credentials may have changed
+		m.lock.Lock()
+		m.gce = b.clients().gce
+		m.lock.Unlock()
+		b.quotas = m
+		return nil
+	}
+
+	m := &quotaMonitor{
+		log:       b.log,
+		gce:       b.clients().gce,
+		interval:  interval,
+		threshold: float64(threshold),
+		now:       time.Now,
+		readings:  map[quotaScope]*quotaReading{{project: b.snapshotProject}: {}},
+		exceeded:  make(map[string]bool),
+		warned:    make(map[string]bool),
+	}
+	quotaMonitors[key] = m
+	b.quotas = m
+	go m.run()
+
+	return nil
+}
+
+func (m *quotaMonitor) run() {
+	for {
+		m.lock.Lock()
+		scopes := make([]quotaScope, 0, len(m.readings))
+		for scope := range m.readings {
+			scopes = append(scopes, scope)
+		}
+		m.lock.Unlock()
+
+		for _, scope := range scopes {
+			if err := m.refresh(scope); err != nil {
+				m.log.WithError(err).WithField("scope", scope.String()).Warn("Error reading GCP quotas")
+			}
+		}
+		time.Sleep(m.interval)
+	}
+}
+
+// refresh reads the watched quotas of a scope, publishes them and logs the
+// ones whose usage crossed the threshold since they were last read.
+func (m *quotaMonitor) refresh(scope quotaScope) error {
+	m.lock.Lock()
+	gce := m.gce
+	m.lock.Unlock()
+
+	var quotas []*compute.Quota
+	if scope.region == "" {
+		project, err := gce.Projects.Get(scope.project).Fields("quotas").Do()
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		quotas = project.Quotas
+	} else {
+		region, err := gce.Regions.Get(scope.project, scope.region).Fields("quotas").Do()
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		quotas = region.Quotas
+	}
+
+	region := scope.region
+	if region == "" {
+		region = globalQuotaRegion
+	}
+	var watched []*compute.Quota
+	for _, q := range quotas {
+		if !watchedQuotas[q.Metric] {
+			continue
+		}
+		watched = append(watched, q)
+		labels := map[string]string{"project": scope.project, "region": region, "metric": q.Metric}
+		pluginMetrics.setGauge(quotaUsageGauge, "Current usage of the GCP quotas snapshots and restores consume.", labels, q.Usage)
+		pluginMetrics.setGauge(quotaLimitGauge, "Limit of the GCP quotas snapshots and restores consume.", labels, q.Limit)
+	}
+	pluginMetricsPusher.pushSoon()
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.readings[scope] = &quotaReading{time: m.now(), quotas: watched}
+	for _, q := range watched {
+		key := scope.String() + "/" + q.Metric
+		exceeded := m.exceedsThreshold(q)
+		if exceeded && !m.exceeded[key] {
+			m.log.WithField("scope", scope.String()).Warn(m.describe(q))
+		}
+		m.exceeded[key] = exceeded
+	}
+	return nil
+}
+
+// check warns in an operation's log about the quotas of a scope whose usage
+// is above the threshold, reading them first if they weren't read within
+// the interval. Each operation is warned about a quota once. A nil monitor
+// checks nothing.
+func (m *quotaMonitor) check(log logrus.FieldLogger, operation string, scope quotaScope) {
+	if m == nil {
+		return
+	}
+
+	m.lock.Lock()
+	reading := m.readings[scope]
+	stale := reading == nil || m.now().Sub(reading.time) >= m.interval
+	if reading == nil {
+		// track the scope from now on
+		m.readings[scope] = &quotaReading{}
+	}
+	m.lock.Unlock()
+
+	if stale {
+		if err := m.refresh(scope); err != nil {
+			log.WithError(err).WithField("scope", scope.String()).Warn("Error reading GCP quotas")
+			return
+		}
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for _, q := range m.readings[scope].quotas {
+		key := operation + "/" + scope.String() + "/" + q.Metric
+		if !m.exceedsThreshold(q) || m.warned[key] {
+			continue
+		}
+		m.warned[key] = true
+		log.WithField("scope", scope.String()).Warn(m.describe(q))
+	}
+}
+
+func (m *quotaMonitor) exceedsThreshold(q *compute.Quota) bool {
+	return q.Limit > 0 && q.Usage*100 >= q.Limit*m.threshold
+}
+
+func (m *quotaMonitor) describe(q *compute.Quota) string {
+	return fmt.Sprintf("GCP quota %s is %.0f%% used (%g of %g), above the warning threshold of %g%%; operations may fail once it's exhausted",
+		q.Metric, q.Usage*100/q.Limit, q.Usage, q.Limit, m.threshold)
+}
@@ -0,0 +1,116 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	logtest "github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	velerotest "github.com/vmware-tanzu/velero/pkg/test"
+	"google.golang.org/api/compute/v1"
+)
+
+func TestQuotaMonitorCheck(t *testing.T) {
+	defer func(registry *metricsRegistry) { pluginMetrics = registry }(pluginMetrics)
+	pluginMetrics = newMetricsRegistry()
+
+	snapshots := 90.0
+	requests := 0
+	gce := newFakeComputeService(t, func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		assert.Equal(t, "quotas", r.URL.Query().Get("fields"))
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/projects/snapshot-project"):
+			json.NewEncoder(w).Encode(&compute.Project{Quotas: []*compute.Quota{
+				{Metric: "SNAPSHOTS", Usage: snapshots, Limit: 100},
+				{Metric: "NETWORKS", Usage: 5, Limit: 5},
+			}})
+		case strings.HasSuffix(r.URL.Path, "/projects/volume-project/regions/us-central1"):
+			json.NewEncoder(w).Encode(&compute.Region{Quotas: []*compute.Quota{
+				{Metric: "DISKS_TOTAL_GB", Usage: 100, Limit: 4096},
+			}})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	})
+
+	now := time.Now()
+	m := &quotaMonitor{
+		log:       velerotest.NewLogger(),
+		gce:       gce,
+		interval:  time.Minute,
+		threshold: 80,
+		now:       func() time.Time { return now },
+		readings:  make(map[quotaScope]*quotaReading),
+		exceeded:  make(map[string]bool),
+		warned:    make(map[string]bool),
+	}
+	logger, hook := logtest.NewNullLogger()
+	global := quotaScope{project: "snapshot-project"}
+
+	m.check(logger, "nightly-1", global)
+	m.check(logger, "nightly-1", global)
+	require.Len(t, hook.AllEntries(), 1)
+	assert.Contains(t, hook.LastEntry().Message, "GCP quota SNAPSHOTS is 90% used (90 of 100)")
+	assert.Equal(t, 1, requests, "quotas aren't read again within the interval")
+
+	m.check(logger, "nightly-2", global)
+	assert.Len(t, hook.AllEntries(), 2)
+
+	// quotas below the threshold aren't warned about
+	hook.Reset()
+	m.check(logger, "restore", quotaScope{project: "volume-project", region: "us-central1"})
+	assert.Empty(t, hook.AllEntries())
+	assert.Equal(t, 2, requests)
+
+	// stale readings are refreshed
+	snapshots = 10
+	now = now.Add(time.Minute)
+	m.check(logger, "nightly-3", global)
+	assert.Empty(t, hook.AllEntries())
+	assert.Equal(t, 3, requests)
+
+	values := make(map[string]float64)
+	pluginMetrics.each(func(m *metric, s *sample) {
+		values[m.name+labelString(s.labels)] = s.value
+	})
+	assert.Equal(t, map[string]float64{
+		`velero_gcp_quota_usage{metric="SNAPSHOTS",project="snapshot-project",region="global"}`:         10,
+		`velero_gcp_quota_limit{metric="SNAPSHOTS",project="snapshot-project",region="global"}`:         100,
+		`velero_gcp_quota_usage{metric="DISKS_TOTAL_GB",project="volume-project",region="us-central1"}`: 100,
+		`velero_gcp_quota_limit{metric="DISKS_TOTAL_GB",project="volume-project",region="us-central1"}`: 4096,
+	}, values)
+
+	var nilMonitor *quotaMonitor
+	nilMonitor.check(logger, "nightly-1", global)
+}
+
+func TestStartQuotaMonitorInvalidConfig(t *testing.T) {
+	b := newVolumeSnapshotter(velerotest.NewLogger())
+	assert.NoError(t, b.startQuotaMonitor(map[string]string{}))
+	assert.Nil(t, b.quotas)
+
+	assert.EqualError(t, b.startQuotaMonitor(map[string]string{quotaCheckIntervalConfigKey: "often"}), `quotaCheckInterval must be a positive duration, got "often"`)
+	assert.EqualError(t, b.startQuotaMonitor(map[string]string{quotaCheckIntervalConfigKey: "10m", quotaWarningThresholdConfigKey: "120"}), `quotaWarningThreshold must be a percentage between 1 and 100, got "120"`)
+	assert.Nil(t, b.quotas)
+}
@@ -0,0 +1,141 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"io"
+	"strconv"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// downloadReadAheadConfigKey is the key of a BackupStorageLocation's
+	// config setting how many MiB of each download are read ahead of
+	// Velero.
+	downloadReadAheadConfigKey = "downloadReadAheadMB"
+
+	// maxDownloadReadAheadMB is the largest read-ahead allowed, since each
+	// download holds up to that much in memory.
+	maxDownloadReadAheadMB = 256
+
+	// readAheadChunkSize is the size of the chunks downloads are read
+	// ahead in, small enough that small objects don't allocate much.
+	readAheadChunkSize = copyBufferSize
+)
+
+// parseDownloadReadAhead returns the read-ahead of downloads in bytes from
+// the config, zero if it's disabled.
+func parseDownloadReadAhead(config map[string]string) (int, error) {
+	val, ok := config[downloadReadAheadConfigKey]
+	if !ok {
+		return 0, nil
+	}
+	sizeMB, err := strconv.Atoi(val)
+	if err != nil || sizeMB < 0 {
+		return 0, errors.Errorf("%s must be a non-negative integer, got %q", downloadReadAheadConfigKey, val)
+	}
+	if sizeMB > maxDownloadReadAheadMB {
+		return 0, errors.Errorf("%s must be at most %d, got %q", downloadReadAheadConfigKey, maxDownloadReadAheadMB, val)
+	}
+	return sizeMB << 20, nil
+}
+
+// readAheadChunk is a chunk of a download read ahead, with the error that
+// ended the download, if any.
+type readAheadChunk struct {
+	data []byte
+	err  error
+}
+
+// readAheadReader reads a download in the background, up to a fixed number
+// of bytes ahead of its reader, so the connection keeps receiving while
+// Velero processes what was already downloaded. Without it, data is only
+// requested from the connection as Velero reads, and on high-latency links
+// the TCP window drains each time Velero pauses to extract items.
+type readAheadReader struct {
+	body    io.ReadCloser
+	chunks  chan readAheadChunk
+	done    chan struct{}
+	current []byte
+	err     error
+	once    sync.Once
+}
+
+// newReadAheadReader reads body up to size bytes ahead. A size of zero
+// returns body as is.
+func newReadAheadReader(body io.ReadCloser, size int) io.ReadCloser {
+	if size <= 0 {
+		return body
+	}
+	chunks := size / readAheadChunkSize
+	if chunks < 1 {
+		chunks = 1
+	}
+	r := &readAheadReader{
+		body:   body,
+		chunks: make(chan readAheadChunk, chunks),
+		done:   make(chan struct{}),
+	}
+	go r.fill()
+	return r
+}
+
+// fill reads the download into chunks until it ends or the reader is
+// closed.
+func (r *readAheadReader) fill() {
+	defer close(r.chunks)
+	for {
+		buf := make([]byte, readAheadChunkSize)
+		n, err := io.ReadFull(r.body, buf)
+		if err == io.ErrUnexpectedEOF {
+			err = io.EOF
+		}
+		select {
+		case r.chunks <- readAheadChunk{data: buf[:n], err: err}:
+		case <-r.done:
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (r *readAheadReader) Read(p []byte) (int, error) {
+	for len(r.current) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		chunk, ok := <-r.chunks
+		if !ok {
+			return 0, errors.New("read from closed download")
+		}
+		r.current, r.err = chunk.data, chunk.err
+	}
+	n := copy(p, r.current)
+	r.current = r.current[n:]
+	return n, nil
+}
+
+// Close stops reading ahead and closes the download, which ends a read in
+// progress.
+func (r *readAheadReader) Close() error {
+	r.once.Do(func() { close(r.done) })
+	return r.body.Close()
+}
@@ -0,0 +1,112 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// countingBody counts the bytes read from it.
+type countingBody struct {
+	io.Reader
+	read int64
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.Reader.Read(p)
+	atomic.AddInt64(&b.read, int64(n))
+	return n, err
+}
+
+func (b *countingBody) Close() error { return nil }
+
+func TestParseDownloadReadAhead(t *testing.T) {
+	size, err := parseDownloadReadAhead(map[string]string{})
+	require.NoError(t, err)
+	assert.Equal(t, 0, size)
+
+	size, err = parseDownloadReadAhead(map[string]string{downloadReadAheadConfigKey: "32"})
+	require.NoError(t, err)
+	assert.Equal(t, 32<<20, size)
+
+	for _, val := range []string{"-1", "lots", "257"} {
+		_, err = parseDownloadReadAhead(map[string]string{downloadReadAheadConfigKey: val})
+		assert.Error(t, err, val)
+	}
+}
+
+func TestReadAheadReader(t *testing.T) {
+	data := make([]byte, 10*readAheadChunkSize+123)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	body := &countingBody{Reader: bytes.NewReader(data)}
+	r := newReadAheadReader(body, 4*readAheadChunkSize)
+
+	// the download is read ahead of the reader, up to the read-ahead
+	first := make([]byte, 10)
+	_, err := io.ReadFull(r, first)
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		return atomic.LoadInt64(&body.read) >= 5*readAheadChunkSize
+	}, time.Second, time.Millisecond)
+	time.Sleep(10 * time.Millisecond)
+	assert.LessOrEqual(t, atomic.LoadInt64(&body.read), int64(6*readAheadChunkSize))
+
+	rest, err := ioutil.ReadAll(r)
+	require.NoError(t, err)
+	assert.Equal(t, data, append(first, rest...))
+	require.NoError(t, r.Close())
+
+	// without a read-ahead the body is returned as is
+	assert.Equal(t, body, newReadAheadReader(body, 0))
+}
+
+func TestReadAheadReaderErrors(t *testing.T) {
+	failure := errors.New("connection reset")
+	r := newReadAheadReader(ioutil.NopCloser(io.MultiReader(bytes.NewReader([]byte("partial")), &failingReader{err: failure})), readAheadChunkSize)
+	read, err := ioutil.ReadAll(r)
+	assert.Equal(t, "partial", string(read))
+	assert.Equal(t, failure, err)
+
+	// closing stops reading ahead of a stalled download
+	pr, pw := io.Pipe()
+	defer pw.Close()
+	r = newReadAheadReader(pr, readAheadChunkSize)
+	require.NoError(t, r.Close())
+	require.Eventually(t, func() bool {
+		_, ok := <-r.(*readAheadReader).chunks
+		return !ok
+	}, time.Second, time.Millisecond)
+}
+
+type failingReader struct {
+	err error
+}
+
+func (r *failingReader) Read([]byte) (int, error) {
+	return 0, r.err
+}
@@ -0,0 +1,415 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/vmware-tanzu/velero/pkg/plugin/framework"
+	"github.com/vmware-tanzu/velero/pkg/plugin/velero"
+	"google.golang.org/api/compute/v1"
+	v1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+const (
+	regionalVolumeActionName = "velero.io/gcp-regional-volume"
+
+	// missingZonesConfigKey is the policy for regional disks replicated to
+	// zones the destination cluster has no nodes in: replace the missing
+	// zones with other zones of the cluster in the same region, zonal to
+	// restore them as zonal disks in a zone of the cluster, or keep to
+	// restore them in their original zones.
+	missingZonesConfigKey = "missingZones"
+	missingZonesReplace   = "replace"
+	missingZonesZonal     = "zonal"
+	missingZonesKeep      = "keep"
+
+	replicationTypeParameter = "replication-type"
+	regionalReplicationType  = "regional-pd"
+)
+
+func (inCluster) nodeZones() ([]string, error) {
+	client, err := newInClusterClient()
+	if err != nil {
+		return nil, err
+	}
+	nodes, err := client.listNodes()
+	if err != nil {
+		return nil, err
+	}
+	var zones []string
+	for _, node := range nodes {
+		zone := node.Labels[zoneLabel]
+		if zone == "" {
+			zone = node.Labels[betaZoneLabel]
+		}
+		if zone != "" {
+			zones = append(zones, zone)
+		}
+	}
+	return zones, nil
+}
+
+// readMissingZonesPolicy returns the configured policy for regional disks
+// replicated to zones the cluster has no nodes in.
+func readMissingZonesPolicy(cluster veleroCluster) (string, error) {
+	data, err := cluster.pluginConfig(framework.PluginKindRestoreItemAction, regionalVolumeActionName)
+	if err != nil {
+		return "", err
+	}
+	switch policy := data[missingZonesConfigKey]; policy {
+	case "":
+		return missingZonesReplace, nil
+	case missingZonesReplace, missingZonesZonal, missingZonesKeep:
+		return policy, nil
+	default:
+		return "", errors.Errorf("invalid %s %q in the %s ConfigMap, expected %s, %s or %s", missingZonesConfigKey, policy, regionalVolumeActionName, missingZonesReplace, missingZonesZonal, missingZonesKeep)
+	}
+}
+
+// adaptZones returns the zones to restore a volume replicated to zones into,
+// in a cluster with nodes in clusterZones. The zones are kept if the cluster
+// has nodes in all of them, or in none of their region, since the volume
+// can't be used either way. A single zone means the volume is restored as a
+// zonal disk.
+func adaptZones(zones, clusterZones []string, policy string) []string {
+	if policy == missingZonesKeep || len(zones) == 0 {
+		return zones
+	}
+	region, err := parseRegion(zones[0])
+	if err != nil {
+		return zones
+	}
+
+	inCluster := make(map[string]bool)
+	var available []string
+	for _, z := range clusterZones {
+		if r, err := parseRegion(z); err == nil && r == region && !inCluster[z] {
+			inCluster[z] = true
+			available = append(available, z)
+		}
+	}
+	sort.Strings(available)
+	if len(available) == 0 {
+		return zones
+	}
+
+	var present []string
+	for _, z := range zones {
+		if inCluster[z] {
+			present = append(present, z)
+		}
+	}
+	if len(present) == len(zones) {
+		return zones
+	}
+
+	if policy == missingZonesZonal {
+		if len(present) > 0 {
+			return present[:1]
+		}
+		return available[:1]
+	}
+
+	adapted := present
+	for _, z := range available {
+		if len(adapted) == len(zones) {
+			break
+		}
+		if !containsString(adapted, z) {
+			adapted = append(adapted, z)
+		}
+	}
+	return adapted
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// restoreZones returns the zones to restore a regional disk replicated to
+// the zones of volumeAZ into, joined like volumeAZ, see adaptZones. If the
+// policy or the cluster's zones can't be read, the disk is restored in its
+// original zones.
+func (b *VolumeSnapshotter) restoreZones(volumeAZ string) string {
+	policy, err := readMissingZonesPolicy(b.cluster)
+	if err != nil {
+		b.log.WithError(err).Warn("Unable to read the policy for zones missing from the cluster, restoring the disk in its original zones")
+		return volumeAZ
+	}
+	if policy == missingZonesKeep {
+		return volumeAZ
+	}
+	clusterZones, err := b.cluster.nodeZones()
+	if err != nil {
+		b.log.WithError(err).Warn("Unable to read the zones of the cluster's nodes, restoring the disk in its original zones")
+		return volumeAZ
+	}
+
+	adapted := strings.Join(adaptZones(strings.Split(volumeAZ, zoneSeparator), clusterZones, policy), zoneSeparator)
+	if adapted != volumeAZ {
+		b.log.Infof("Restoring disk replicated to %s in %s since the cluster has no nodes in some of its zones", volumeAZ, adapted)
+	}
+	return adapted
+}
+
+// RegionalVolumeAction is a restore item action that updates the zones of
+// persistent volumes whose regional disks were restored in other zones
+// because the cluster has no nodes in some of their original zones, and
+// adapts the allowed zones of regional StorageClasses the same way, so
+// claims don't stay pending.
+type RegionalVolumeAction struct {
+	log     logrus.FieldLogger
+	cluster veleroCluster
+
+	once      sync.Once
+	gce       *compute.Service
+	project   string
+	policy    string
+	zones     []string
+	configErr error
+}
+
+func newRegionalVolumeAction(logger logrus.FieldLogger) (interface{}, error) {
+	return &RegionalVolumeAction{log: logger, cluster: inCluster{}}, nil
+}
+
+func (a *RegionalVolumeAction) AppliesTo() (velero.ResourceSelector, error) {
+	return velero.ResourceSelector{
+		IncludedResources: []string{"persistentvolumes", "storageclasses.storage.k8s.io"},
+	}, nil
+}
+
+func (a *RegionalVolumeAction) loadConfig() error {
+	a.once.Do(func() {
+		if a.policy, a.configErr = readMissingZonesPolicy(a.cluster); a.configErr != nil {
+			return
+		}
+		if a.zones, a.configErr = a.cluster.nodeZones(); a.configErr != nil {
+			return
+		}
+		if a.gce == nil {
+			a.gce, a.project, _, a.configErr = newActionComputeService(a.log, a.cluster, framework.PluginKindRestoreItemAction, regionalVolumeActionName, compute.ComputeReadonlyScope)
+		}
+	})
+	return a.configErr
+}
+
+func (a *RegionalVolumeAction) Execute(input *velero.RestoreItemActionExecuteInput) (*velero.RestoreItemActionExecuteOutput, error) {
+	if input.Item.GetObjectKind().GroupVersionKind().Kind == "StorageClass" {
+		return a.executeStorageClass(input)
+	}
+
+	pv := new(v1.PersistentVolume)
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(input.Item.UnstructuredContent(), pv); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if input.ItemFromBackup == nil {
+		return velero.NewRestoreItemActionExecuteOutput(input.Item), nil
+	}
+	backedUp := new(v1.PersistentVolume)
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(input.ItemFromBackup.UnstructuredContent(), backedUp); err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	// only regional disks restored from snapshots may have been moved
+	diskName := pvDiskName(pv)
+	if diskName == "" || pvVolumeID(pv) == pvVolumeID(backedUp) || len(volumeZones(backedUp)) < 2 {
+		return velero.NewRestoreItemActionExecuteOutput(input.Item), nil
+	}
+	if err := a.loadConfig(); err != nil {
+		return nil, err
+	}
+
+	project := a.project
+	if pv.Spec.CSI != nil {
+		if m := restoredDiskRegexp.FindStringSubmatch(pv.Spec.CSI.VolumeHandle); m != nil {
+			project = m[1]
+		}
+	}
+	zones, err := diskZones(a.gce, project, diskName)
+	if err != nil {
+		return nil, err
+	}
+
+	original := pv.DeepCopy()
+	setVolumeZones(pv, project, zones)
+	if reflect.DeepEqual(original, pv) {
+		return velero.NewRestoreItemActionExecuteOutput(input.Item), nil
+	}
+	a.log.WithField("persistentVolume", pv.Name).Infof("Updated the volume for its disk restored in %s", strings.Join(zones, ", "))
+
+	res, err := runtime.DefaultUnstructuredConverter.ToUnstructured(pv)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return velero.NewRestoreItemActionExecuteOutput(&unstructured.Unstructured{Object: res}), nil
+}
+
+func (a *RegionalVolumeAction) executeStorageClass(input *velero.RestoreItemActionExecuteInput) (*velero.RestoreItemActionExecuteOutput, error) {
+	sc := new(storagev1.StorageClass)
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(input.Item.UnstructuredContent(), sc); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if sc.Parameters[replicationTypeParameter] != regionalReplicationType || len(sc.AllowedTopologies) == 0 {
+		return velero.NewRestoreItemActionExecuteOutput(input.Item), nil
+	}
+	if err := a.loadConfig(); err != nil {
+		return nil, err
+	}
+
+	zonal := false
+	for i := range sc.AllowedTopologies {
+		for j := range sc.AllowedTopologies[i].MatchLabelExpressions {
+			requirement := &sc.AllowedTopologies[i].MatchLabelExpressions[j]
+			switch requirement.Key {
+			case zoneLabel, betaZoneLabel, gkeZoneLabel:
+				requirement.Values = adaptZones(requirement.Values, a.zones, a.policy)
+				zonal = zonal || len(requirement.Values) < 2
+			}
+		}
+	}
+	if zonal {
+		// regional disks need two zones
+		sc.Parameters[replicationTypeParameter] = "none"
+	}
+
+	original := new(storagev1.StorageClass)
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(input.Item.UnstructuredContent(), original); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if reflect.DeepEqual(original, sc) {
+		return velero.NewRestoreItemActionExecuteOutput(input.Item), nil
+	}
+	a.log.Infof("Updated the allowed zones of StorageClass %s for zones the cluster has no nodes in", sc.Name)
+
+	res, err := runtime.DefaultUnstructuredConverter.ToUnstructured(sc)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return velero.NewRestoreItemActionExecuteOutput(&unstructured.Unstructured{Object: res}), nil
+}
+
+// pvDiskName returns the name of a persistent volume's disk, or an empty
+// string if it isn't a persistent disk volume.
+func pvDiskName(pv *v1.PersistentVolume) string {
+	switch {
+	case pv.Spec.CSI != nil && pv.Spec.CSI.Driver == pdCSIDriver:
+		return pv.Spec.CSI.VolumeHandle[strings.LastIndex(pv.Spec.CSI.VolumeHandle, "/")+1:]
+	case pv.Spec.GCEPersistentDisk != nil:
+		return pv.Spec.GCEPersistentDisk.PDName
+	}
+	return ""
+}
+
+// volumeZones returns the zones of a persistent volume's node affinity.
+func volumeZones(pv *v1.PersistentVolume) []string {
+	var zones []string
+	if pv.Spec.NodeAffinity == nil || pv.Spec.NodeAffinity.Required == nil {
+		return nil
+	}
+	for _, term := range pv.Spec.NodeAffinity.Required.NodeSelectorTerms {
+		for _, requirement := range term.MatchExpressions {
+			switch requirement.Key {
+			case zoneLabel, betaZoneLabel, gkeZoneLabel:
+				for _, z := range requirement.Values {
+					if !containsString(zones, z) {
+						zones = append(zones, z)
+					}
+				}
+			}
+		}
+	}
+	return zones
+}
+
+// diskZones returns the zone of a zonal disk, or the replica zones of a
+// regional disk.
+func diskZones(gce *compute.Service, project, name string) ([]string, error) {
+	var zones []string
+	err := gce.Disks.AggregatedList(project).Filter(fmt.Sprintf("name = %q", name)).Pages(context.Background(), func(page *compute.DiskAggregatedList) error {
+		for scope, list := range page.Items {
+			for _, disk := range list.Disks {
+				if disk.Name != name {
+					continue
+				}
+				if len(disk.ReplicaZones) > 0 {
+					for _, z := range disk.ReplicaZones {
+						zones = append(zones, z[strings.LastIndex(z, "/")+1:])
+					}
+				} else {
+					zones = append(zones, strings.TrimPrefix(scope, "zones/"))
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "error getting disk %s", name)
+	}
+	if len(zones) == 0 {
+		return nil, errors.Errorf("disk %s not found in project %s", name, project)
+	}
+	sort.Strings(zones)
+	return zones, nil
+}
+
+// setVolumeZones updates a persistent volume for its disk being in the given
+// zones: the zones of its node affinity and labels, and its volume handle,
+// which names the disk's zone or region.
+func setVolumeZones(pv *v1.PersistentVolume, project string, zones []string) {
+	if pv.Spec.NodeAffinity != nil && pv.Spec.NodeAffinity.Required != nil {
+		for i := range pv.Spec.NodeAffinity.Required.NodeSelectorTerms {
+			term := &pv.Spec.NodeAffinity.Required.NodeSelectorTerms[i]
+			for j := range term.MatchExpressions {
+				switch term.MatchExpressions[j].Key {
+				case zoneLabel, betaZoneLabel, gkeZoneLabel:
+					term.MatchExpressions[j].Values = append([]string(nil), zones...)
+				}
+			}
+		}
+	}
+	for _, label := range []string{zoneLabel, betaZoneLabel} {
+		if _, ok := pv.Labels[label]; ok {
+			pv.Labels[label] = strings.Join(zones, zoneSeparator)
+		}
+	}
+
+	if pv.Spec.CSI != nil && len(zones) > 0 {
+		name := pvDiskName(pv)
+		if len(zones) == 1 {
+			pv.Spec.CSI.VolumeHandle = fmt.Sprintf("projects/%s/zones/%s/disks/%s", project, zones[0], name)
+		} else if region, err := parseRegion(zones[0]); err == nil {
+			pv.Spec.CSI.VolumeHandle = fmt.Sprintf("projects/%s/regions/%s/disks/%s", project, region, name)
+		}
+	}
+}
@@ -0,0 +1,240 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vmware-tanzu/velero/pkg/plugin/velero"
+	"google.golang.org/api/compute/v1"
+	v1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+
+	velerotest "github.com/vmware-tanzu/velero/pkg/test"
+)
+
+func TestAdaptZones(t *testing.T) {
+	tests := []struct {
+		name         string
+		zones        []string
+		clusterZones []string
+		policy       string
+		expected     []string
+	}{
+		{
+			name:         "zones the cluster has nodes in are kept",
+			zones:        []string{"us-central1-a", "us-central1-b"},
+			clusterZones: []string{"us-central1-b", "us-central1-a", "us-central1-a"},
+			policy:       missingZonesReplace,
+			expected:     []string{"us-central1-a", "us-central1-b"},
+		},
+		{
+			name:         "missing zones are replaced",
+			zones:        []string{"us-central1-a", "us-central1-b"},
+			clusterZones: []string{"us-central1-f", "us-central1-b", "us-central1-c"},
+			policy:       missingZonesReplace,
+			expected:     []string{"us-central1-b", "us-central1-c"},
+		},
+		{
+			name:         "disks are restored as zonal disks in clusters with a single zone",
+			zones:        []string{"us-central1-a", "us-central1-b"},
+			clusterZones: []string{"us-central1-c"},
+			policy:       missingZonesReplace,
+			expected:     []string{"us-central1-c"},
+		},
+		{
+			name:         "zonal policy keeps a zone the cluster has nodes in",
+			zones:        []string{"us-central1-a", "us-central1-b"},
+			clusterZones: []string{"us-central1-b", "us-central1-c"},
+			policy:       missingZonesZonal,
+			expected:     []string{"us-central1-b"},
+		},
+		{
+			name:         "zonal policy picks a zone of the cluster",
+			zones:        []string{"us-central1-a", "us-central1-b"},
+			clusterZones: []string{"us-central1-f", "us-central1-c"},
+			policy:       missingZonesZonal,
+			expected:     []string{"us-central1-c"},
+		},
+		{
+			name:         "keep policy",
+			zones:        []string{"us-central1-a", "us-central1-b"},
+			clusterZones: []string{"us-central1-c", "us-central1-f"},
+			policy:       missingZonesKeep,
+			expected:     []string{"us-central1-a", "us-central1-b"},
+		},
+		{
+			name:         "zones are kept for clusters in other regions",
+			zones:        []string{"us-central1-a", "us-central1-b"},
+			clusterZones: []string{"europe-west1-b", "europe-west1-c"},
+			policy:       missingZonesReplace,
+			expected:     []string{"us-central1-a", "us-central1-b"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert.Equal(t, test.expected, adaptZones(test.zones, test.clusterZones, test.policy))
+		})
+	}
+}
+
+func TestReadMissingZonesPolicy(t *testing.T) {
+	configured := func(config map[string]string) *fakeCluster {
+		return &fakeCluster{configs: map[string]map[string]string{regionalVolumeActionName: config}}
+	}
+
+	policy, err := readMissingZonesPolicy(&fakeCluster{})
+	require.NoError(t, err)
+	assert.Equal(t, missingZonesReplace, policy)
+
+	policy, err = readMissingZonesPolicy(configured(map[string]string{missingZonesConfigKey: missingZonesZonal}))
+	require.NoError(t, err)
+	assert.Equal(t, missingZonesZonal, policy)
+
+	_, err = readMissingZonesPolicy(configured(map[string]string{missingZonesConfigKey: "drop"}))
+	assert.Error(t, err)
+}
+
+func TestRegionalVolumeActionExecute(t *testing.T) {
+	gce := newFakeComputeService(t, func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "/projects/csi-project/aggregated/disks", r.URL.Path)
+		assert.Equal(t, `name = "restore-1"`, r.URL.Query().Get("filter"))
+		json.NewEncoder(w).Encode(&compute.DiskAggregatedList{Items: map[string]compute.DisksScopedList{
+			"regions/us-central1": {Disks: []*compute.Disk{{
+				Name:         "restore-1",
+				ReplicaZones: []string{"https://www.googleapis.com/compute/v1/projects/csi-project/zones/us-central1-c", "https://www.googleapis.com/compute/v1/projects/csi-project/zones/us-central1-b"},
+			}}},
+		}})
+	})
+
+	newPV := func(handle string, zones ...string) *v1.PersistentVolume {
+		return &v1.PersistentVolume{
+			TypeMeta:   metav1.TypeMeta{APIVersion: "v1", Kind: "PersistentVolume"},
+			ObjectMeta: metav1.ObjectMeta{Name: "pv", Labels: map[string]string{zoneLabel: zones[0] + "__" + zones[1]}},
+			Spec: v1.PersistentVolumeSpec{
+				PersistentVolumeSource: v1.PersistentVolumeSource{CSI: &v1.CSIPersistentVolumeSource{Driver: pdCSIDriver, VolumeHandle: handle}},
+				NodeAffinity: &v1.VolumeNodeAffinity{Required: &v1.NodeSelector{NodeSelectorTerms: []v1.NodeSelectorTerm{{
+					MatchExpressions: []v1.NodeSelectorRequirement{{Key: zoneLabel, Operator: v1.NodeSelectorOpIn, Values: zones}},
+				}}}},
+			},
+		}
+	}
+	toUnstructured := func(obj interface{}) *unstructured.Unstructured {
+		content, err := runtime.DefaultUnstructuredConverter.ToUnstructured(obj)
+		require.NoError(t, err)
+		return &unstructured.Unstructured{Object: content}
+	}
+
+	action := &RegionalVolumeAction{log: velerotest.NewLogger(), gce: gce, project: "default-project", policy: missingZonesReplace}
+	action.once.Do(func() {})
+
+	backedUp := newPV("projects/csi-project/regions/us-central1/disks/pvc-1", "us-central1-a", "us-central1-b")
+	restored := newPV("projects/csi-project/regions/us-central1/disks/restore-1", "us-central1-a", "us-central1-b")
+	output, err := action.Execute(&velero.RestoreItemActionExecuteInput{Item: toUnstructured(restored), ItemFromBackup: toUnstructured(backedUp)})
+	require.NoError(t, err)
+
+	res := new(v1.PersistentVolume)
+	require.NoError(t, runtime.DefaultUnstructuredConverter.FromUnstructured(output.UpdatedItem.UnstructuredContent(), res))
+	assert.Equal(t, newPV("projects/csi-project/regions/us-central1/disks/restore-1", "us-central1-b", "us-central1-c"), res)
+
+	// volumes that weren't restored from snapshots are left alone
+	output, err = action.Execute(&velero.RestoreItemActionExecuteInput{Item: toUnstructured(backedUp), ItemFromBackup: toUnstructured(backedUp)})
+	require.NoError(t, err)
+	assert.Equal(t, toUnstructured(backedUp), output.UpdatedItem)
+}
+
+func TestSetVolumeZonesZonal(t *testing.T) {
+	pv := &v1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{Labels: map[string]string{betaZoneLabel: "us-central1-a__us-central1-b"}},
+		Spec: v1.PersistentVolumeSpec{
+			PersistentVolumeSource: v1.PersistentVolumeSource{CSI: &v1.CSIPersistentVolumeSource{Driver: pdCSIDriver, VolumeHandle: "projects/p/regions/us-central1/disks/restore-1"}},
+		},
+	}
+	setVolumeZones(pv, "p", []string{"us-central1-c"})
+	assert.Equal(t, "projects/p/zones/us-central1-c/disks/restore-1", pv.Spec.CSI.VolumeHandle)
+	assert.Equal(t, "us-central1-c", pv.Labels[betaZoneLabel])
+}
+
+func TestRegionalVolumeActionStorageClass(t *testing.T) {
+	newSC := func(replication string, zones ...string) *storagev1.StorageClass {
+		return &storagev1.StorageClass{
+			TypeMeta:    metav1.TypeMeta{APIVersion: "storage.k8s.io/v1", Kind: "StorageClass"},
+			ObjectMeta:  metav1.ObjectMeta{Name: "regional"},
+			Provisioner: pdCSIDriver,
+			Parameters:  map[string]string{replicationTypeParameter: replication},
+			AllowedTopologies: []v1.TopologySelectorTerm{{
+				MatchLabelExpressions: []v1.TopologySelectorLabelRequirement{{Key: zoneLabel, Values: zones}},
+			}},
+		}
+	}
+
+	tests := []struct {
+		name     string
+		policy   string
+		zones    []string
+		expected *storagev1.StorageClass
+	}{
+		{
+			name:     "missing zones are replaced",
+			policy:   missingZonesReplace,
+			zones:    []string{"us-central1-b", "us-central1-c"},
+			expected: newSC(regionalReplicationType, "us-central1-b", "us-central1-c"),
+		},
+		{
+			name:     "zonal policy makes the class zonal",
+			policy:   missingZonesZonal,
+			zones:    []string{"us-central1-b", "us-central1-c"},
+			expected: newSC("none", "us-central1-b"),
+		},
+		{
+			name:     "keep policy",
+			policy:   missingZonesKeep,
+			zones:    []string{"us-central1-b", "us-central1-c"},
+			expected: newSC(regionalReplicationType, "us-central1-a", "us-central1-b"),
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			action := &RegionalVolumeAction{log: velerotest.NewLogger(), policy: test.policy, zones: test.zones}
+			action.once.Do(func() {})
+
+			content, err := runtime.DefaultUnstructuredConverter.ToUnstructured(newSC(regionalReplicationType, "us-central1-a", "us-central1-b"))
+			require.NoError(t, err)
+			output, err := action.Execute(&velero.RestoreItemActionExecuteInput{Item: &unstructured.Unstructured{Object: content}})
+			require.NoError(t, err)
+
+			res := new(storagev1.StorageClass)
+			require.NoError(t, runtime.DefaultUnstructuredConverter.FromUnstructured(output.UpdatedItem.UnstructuredContent(), res))
+			assert.Equal(t, test.expected, res)
+		})
+	}
+}
+
+func TestRestoreZones(t *testing.T) {
+	b := &VolumeSnapshotter{log: velerotest.NewLogger(), cluster: &fakeCluster{zones: []string{"us-central1-c", "us-central1-b"}}}
+	assert.Equal(t, "us-central1-b__us-central1-c", b.restoreZones("us-central1-a__us-central1-b"))
+	assert.Equal(t, "us-central1-b__us-central1-c", b.restoreZones("us-central1-b__us-central1-c"))
+}
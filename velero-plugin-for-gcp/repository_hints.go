@@ -0,0 +1,209 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+
+	"cloud.google.com/go/storage"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/pflag"
+	api "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+)
+
+// repositoryHintsCommand is the argument that prints how Velero's file
+// system backup repository on a BackupStorageLocation compares to the
+// plugin's settings, e.g.
+// `/plugins/velero-plugin-for-gcp repository-hints --location default`.
+// The repository accesses the bucket with its own GCS client, which only
+// shares the location's bucket, prefix and credentialsFile with the plugin.
+const repositoryHintsCommand = "repository-hints"
+
+const (
+	hintOK      = "ok"
+	hintWarning = "warning"
+)
+
+// pluginOnlyCredentialKeys are the credentials settings only the plugin
+// understands. The repository authenticates with the location's
+// credentialsFile, or the Velero pod's default credentials.
+var pluginOnlyCredentialKeys = []string{
+	credentialsJSONConfigKey,
+	credentialsSecretConfigKey,
+	secretManagerCredentialsConfigKey,
+	accessTokenFileConfigKey,
+	fleetMembershipConfigKey,
+	impersonateServiceAccountConfigKey,
+	credentialProfileConfigKey,
+	quotaProjectConfigKey,
+	clientCertificateFileConfigKey,
+}
+
+// repositoryHint is advice on a setting of a location for its repository.
+type repositoryHint struct {
+	status  string
+	setting string
+	message string
+}
+
+// backupStorageLocations returns the BackupStorageLocations in Velero's
+// namespace.
+func (inCluster) backupStorageLocations() ([]api.BackupStorageLocation, error) {
+	client, err := newInClusterClient()
+	if err != nil {
+		return nil, err
+	}
+	return client.listBackupStorageLocations(veleroNamespace())
+}
+
+// repositoryHints compares the settings of a location that the repository
+// doesn't share with the plugin. bucketKey is the bucket's default Cloud KMS
+// key, if any.
+func repositoryHints(config map[string]string, bucketKey string) []repositoryHint {
+	var hints []repositoryHint
+
+	credentials := repositoryHint{status: hintOK, setting: "credentials", message: "the repository uses the same credentials as the plugin"}
+	for _, key := range pluginOnlyCredentialKeys {
+		if config[key] != "" {
+			credentials = repositoryHint{status: hintWarning, setting: key, message: "only the plugin uses this setting; the repository uses credentialsFile or the Velero pod's default credentials, which need access to the bucket too"}
+			break
+		}
+	}
+	hints = append(hints, credentials)
+
+	if config[endpointsConfigKey] != "" {
+		hints = append(hints, repositoryHint{status: hintWarning, setting: endpointsConfigKey, message: "the repository always connects to storage.googleapis.com; resolve it to the private or restricted VIP in the cluster's DNS for repository traffic to take the same path"})
+	}
+
+	kmsKey := config[kmsKeyNameConfigKey]
+	switch {
+	case kmsKey != "" && bucketKey == kmsKey:
+		hints = append(hints, repositoryHint{status: hintOK, setting: kmsKeyNameConfigKey, message: "repository data is encrypted with the bucket's default key, which is the same key"})
+	case kmsKey != "":
+		hints = append(hints, repositoryHint{status: hintWarning, setting: kmsKeyNameConfigKey, message: fmt.Sprintf("repository data is encrypted with %s rather than this key, since the repository uses the bucket's default key; run with --set-bucket-key to make this key the bucket's default", describeBucketKey(bucketKey))})
+	case config[requireCMEKConfigKey] == "true" && bucketKey == "":
+		hints = append(hints, repositoryHint{status: hintWarning, setting: requireCMEKConfigKey, message: "the bucket has no default key, so repository data isn't encrypted with a customer-managed key"})
+	}
+	if config[secretManagerEncryptionKeyConfigKey] != "" {
+		hints = append(hints, repositoryHint{status: hintWarning, setting: secretManagerEncryptionKeyConfigKey, message: fmt.Sprintf("the repository doesn't use customer-supplied keys; its data is encrypted with the repository password and %s", describeBucketKey(bucketKey))})
+	}
+
+	if config[uploadChunkSizeConfigKey] != "" {
+		hints = append(hints, repositoryHint{status: hintOK, setting: uploadChunkSizeConfigKey, message: "only applies to the backup metadata the plugin uploads; the repository uploads its own pack files"})
+	}
+	return hints
+}
+
+func describeBucketKey(key string) string {
+	if key == "" {
+		return "a Google-managed key"
+	}
+	return "the bucket's default key " + key
+}
+
+func writeRepositoryHints(w io.Writer, hints []repositoryHint) {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "STATUS\tSETTING\tHINT")
+	for _, h := range hints {
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", h.status, h.setting, h.message)
+	}
+	tw.Flush()
+}
+
+// runRepositoryHints prints how Velero's file system backup repository on a
+// location compares to the plugin's settings, and with --set-bucket-key
+// makes the location's kmsKeyName the bucket's default key, so the
+// repository's data is encrypted with it like the plugin's.
+func runRepositoryHints(args []string, out io.Writer) int {
+	flags := pflag.NewFlagSet(repositoryHintsCommand, pflag.ContinueOnError)
+	flags.SetOutput(out)
+	var (
+		location  string
+		config    map[string]string
+		setBucket bool
+	)
+	flags.StringVar(&location, "location", "", "name of the BackupStorageLocation to use the config of")
+	flags.StringToStringVar(&config, "config", nil, "BackupStorageLocation config, when not using --location, e.g. bucket=my-bucket,kmsKeyName=projects/my-project/locations/us/keyRings/velero/cryptoKeys/backups")
+	flags.BoolVar(&setBucket, "set-bucket-key", false, "make the location's kmsKeyName the bucket's default Cloud KMS key")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	if err := printRepositoryHints(out, inCluster{}, location, config, setBucket); err != nil {
+		fmt.Fprintln(out, err)
+		return 1
+	}
+	return 0
+}
+
+func printRepositoryHints(out io.Writer, cluster veleroCluster, location string, config map[string]string, setBucket bool) error {
+	if location != "" {
+		locations, err := cluster.backupStorageLocations()
+		if err != nil {
+			return err
+		}
+		found := false
+		for _, l := range locations {
+			if l.Name == location && l.Spec.ObjectStorage != nil {
+				config = map[string]string{"bucket": l.Spec.ObjectStorage.Bucket, "prefix": l.Spec.ObjectStorage.Prefix}
+				for k, v := range l.Spec.Config {
+					config[k] = v
+				}
+				found = true
+			}
+		}
+		if !found {
+			return errors.Errorf("BackupStorageLocation %s not found in namespace %s", location, veleroNamespace())
+		}
+	}
+	bucket := config["bucket"]
+	if bucket == "" {
+		return errors.New("the location's bucket is required")
+	}
+
+	logger := logrus.New()
+	logger.SetOutput(os.Stderr)
+	o := newObjectStore(logger)
+	if err := o.Init(config); err != nil {
+		return err
+	}
+	attrs, err := o.clients().bucketWriter.getBucketAttrs(bucket)
+	if err != nil {
+		return errors.Wrapf(err, "error getting attributes of bucket %s", bucket)
+	}
+	var bucketKey string
+	if attrs.Encryption != nil {
+		bucketKey = attrs.Encryption.DefaultKMSKeyName
+	}
+
+	if key := config[kmsKeyNameConfigKey]; setBucket && key != "" && key != bucketKey {
+		update := storage.BucketAttrsToUpdate{Encryption: &storage.BucketEncryption{DefaultKMSKeyName: key}}
+		if _, err := o.clients().client.Bucket(bucket).Update(context.Background(), update); err != nil {
+			return errors.Wrapf(err, "error setting the default key of bucket %s", bucket)
+		}
+		fmt.Fprintf(out, "set the default key of bucket %s to %s\n", bucket, key)
+		bucketKey = key
+	}
+
+	writeRepositoryHints(out, repositoryHints(config, bucketKey))
+	return nil
+}
@@ -0,0 +1,113 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	api "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+)
+
+func TestRepositoryHints(t *testing.T) {
+	const key = "projects/p/locations/us/keyRings/r/cryptoKeys/k"
+
+	tests := []struct {
+		name      string
+		config    map[string]string
+		bucketKey string
+		expected  []repositoryHint
+	}{
+		{
+			name:     "shared credentials file",
+			config:   map[string]string{credentialsFileConfigKey: "/credentials/cloud"},
+			expected: []repositoryHint{{status: hintOK, setting: "credentials"}},
+		},
+		{
+			name:     "plugin-only credentials",
+			config:   map[string]string{credentialsSecretConfigKey: "velero/gcp/key"},
+			expected: []repositoryHint{{status: hintWarning, setting: credentialsSecretConfigKey}},
+		},
+		{
+			name:   "custom endpoints",
+			config: map[string]string{endpointsConfigKey: "private.googleapis.com,default"},
+			expected: []repositoryHint{
+				{status: hintOK, setting: "credentials"},
+				{status: hintWarning, setting: endpointsConfigKey},
+			},
+		},
+		{
+			name:      "kms key is the bucket default",
+			config:    map[string]string{kmsKeyNameConfigKey: key},
+			bucketKey: key,
+			expected: []repositoryHint{
+				{status: hintOK, setting: "credentials"},
+				{status: hintOK, setting: kmsKeyNameConfigKey},
+			},
+		},
+		{
+			name:   "kms key is not the bucket default",
+			config: map[string]string{kmsKeyNameConfigKey: key},
+			expected: []repositoryHint{
+				{status: hintOK, setting: "credentials"},
+				{status: hintWarning, setting: kmsKeyNameConfigKey},
+			},
+		},
+		{
+			name:   "cmek required without a bucket default key",
+			config: map[string]string{requireCMEKConfigKey: "true"},
+			expected: []repositoryHint{
+				{status: hintOK, setting: "credentials"},
+				{status: hintWarning, setting: requireCMEKConfigKey},
+			},
+		},
+		{
+			name:   "customer-supplied keys and chunk size",
+			config: map[string]string{secretManagerEncryptionKeyConfigKey: "projects/p/secrets/key", uploadChunkSizeConfigKey: "32"},
+			expected: []repositoryHint{
+				{status: hintOK, setting: "credentials"},
+				{status: hintWarning, setting: secretManagerEncryptionKeyConfigKey},
+				{status: hintOK, setting: uploadChunkSizeConfigKey},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			hints := repositoryHints(test.config, test.bucketKey)
+			require.Len(t, hints, len(test.expected))
+			for i, h := range hints {
+				assert.Equal(t, test.expected[i].status, h.status)
+				assert.Equal(t, test.expected[i].setting, h.setting)
+				assert.NotEmpty(t, h.message)
+			}
+		})
+	}
+}
+
+func TestPrintRepositoryHintsLocationNotFound(t *testing.T) {
+	cluster := &fakeCluster{storageLocations: []api.BackupStorageLocation{{}}}
+	err := printRepositoryHints(new(bytes.Buffer), cluster, "default", nil, false)
+	assert.EqualError(t, err, "BackupStorageLocation default not found in namespace "+veleroNamespace())
+}
+
+func TestPrintRepositoryHintsRequiresBucket(t *testing.T) {
+	err := printRepositoryHints(new(bytes.Buffer), &fakeCluster{}, "", map[string]string{}, false)
+	assert.EqualError(t, err, "the location's bucket is required")
+}
@@ -0,0 +1,400 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// maxConcurrentRequestsEnvVar limits the weight of the GCP API requests
+	// in flight at once across all of the plugin's clients.
+	maxConcurrentRequestsEnvVar = "VELERO_GCP_PLUGIN_MAX_CONCURRENT_REQUESTS"
+	// maxRequestsPerSecondEnvVar limits the weight of the GCP API requests
+	// started per second across all of the plugin's clients.
+	maxRequestsPerSecondEnvVar = "VELERO_GCP_PLUGIN_MAX_REQUESTS_PER_SECOND"
+	// requestWeightsEnvVar overrides the weights of operation types, as a
+	// comma-separated list of type=weight pairs.
+	requestWeightsEnvVar = "VELERO_GCP_PLUGIN_REQUEST_WEIGHTS"
+
+	uploadRequest   = "upload"
+	downloadRequest = "download"
+	snapshotRequest = "snapshot"
+	writeRequest    = "write"
+	readRequest     = "read"
+
+	requestBudgetInFlightGauge = "velero_gcp_request_budget_in_flight"
+	requestBudgetWaitsCounter  = "velero_gcp_request_budget_waits_total"
+)
+
+// defaultRequestWeights are the weights of the operation types: uploads and
+// downloads move object data over the node's network, and snapshots start
+// long-running operations that consume the snapshot quotas, so they count
+// for more than reading or updating resources.
+var defaultRequestWeights = map[string]int{
+	uploadRequest:   4,
+	downloadRequest: 4,
+	snapshotRequest: 2,
+	writeRequest:    1,
+	readRequest:     1,
+}
+
+var (
+	requestBudgetOnce sync.Once
+	// processRequestBudget is the budget all of the process's API clients
+	// share, or nil if no limit is configured.
+	processRequestBudget *requestBudget
+)
+
+// sharedRequestBudget returns the process's request budget, configured from
+// the environment the first time, or nil if no limit is configured.
+func sharedRequestBudget(log logrus.FieldLogger) *requestBudget {
+	requestBudgetOnce.Do(func() {
+		processRequestBudget = requestBudgetFromEnv(log)
+	})
+	return processRequestBudget
+}
+
+// requestBudgetFromEnv returns a request budget with the limits and weights
+// set in the environment, or nil if no limit is set. Invalid values are
+// logged and ignored.
+func requestBudgetFromEnv(log logrus.FieldLogger) *requestBudget {
+	maxConcurrent := 0
+	if val := os.Getenv(maxConcurrentRequestsEnvVar); val != "" {
+		parsed, err := strconv.Atoi(val)
+		if err != nil || parsed < 0 {
+			log.Warnf("Invalid %s %q, expected a non-negative integer; not limiting concurrent requests", maxConcurrentRequestsEnvVar, val)
+		} else {
+			maxConcurrent = parsed
+		}
+	}
+	perSecond := 0.0
+	if val := os.Getenv(maxRequestsPerSecondEnvVar); val != "" {
+		parsed, err := strconv.ParseFloat(val, 64)
+		if err != nil || parsed < 0 {
+			log.Warnf("Invalid %s %q, expected a non-negative number; not limiting requests per second", maxRequestsPerSecondEnvVar, val)
+		} else {
+			perSecond = parsed
+		}
+	}
+	adaptive := false
+	if val := os.Getenv(adaptiveConcurrencyEnvVar); val != "" {
+		parsed, err := strconv.ParseBool(val)
+		if err != nil {
+			log.Warnf("Invalid %s %q, expected a boolean; not adapting concurrency", adaptiveConcurrencyEnvVar, val)
+		}
+		adaptive = parsed
+	}
+	if adaptive && maxConcurrent == 0 {
+		maxConcurrent = defaultAdaptiveMaxConcurrency
+	}
+	if maxConcurrent == 0 && perSecond == 0 {
+		return nil
+	}
+
+	weights := make(map[string]int, len(defaultRequestWeights))
+	for operation, weight := range defaultRequestWeights {
+		weights[operation] = weight
+	}
+	for operation, val := range parseKeyValues(os.Getenv(requestWeightsEnvVar)) {
+		weight, err := strconv.Atoi(val)
+		if _, ok := defaultRequestWeights[operation]; !ok || err != nil || weight < 1 {
+			log.Warnf("Ignoring invalid %s entry %s=%s, expected one of upload, download, snapshot, write or read with a positive integer weight", requestWeightsEnvVar, operation, val)
+			continue
+		}
+		weights[operation] = weight
+	}
+
+	log.Infof("Limiting GCP API requests to a weight of %d in flight and %g per second (0 is unlimited), with weights %v", maxConcurrent, perSecond, weights)
+	budget := newRequestBudget(maxConcurrent, perSecond, weights)
+	if adaptive {
+		budget.adapt(newConcurrencyController(maxConcurrent))
+		log.Infof("Adapting the weight of GCP API requests in flight between %d and %d to their latency and error rate", budget.adaptive.min, maxConcurrent)
+	}
+	return budget
+}
+
+// requestBudget limits the GCP API requests the plugin makes, so backups
+// and restores running at once don't exhaust GCP's rate quotas or the
+// node's network between them. Each request counts for the weight of its
+// operation type against both the number of requests in flight and the
+// rate requests are started at. Requests wait for budget in the order they
+// were made.
+type requestBudget struct {
+	maxConcurrent int
+	perSecond     float64
+	weights       map[string]int
+	now           func() time.Time
+	// adaptive adjusts the concurrency limit to the responses, if enabled.
+	adaptive *concurrencyController
+
+	lock sync.Mutex
+	// limit is the weight of the requests allowed in flight, which is
+	// maxConcurrent unless it's adapted.
+	limit    int
+	inFlight int
+	// waiters are the requests waiting for concurrency budget, in order.
+	waiters []*budgetWaiter
+	// tokens is the rate budget left at last; it is negative while
+	// requests wait for budget they reserved.
+	tokens float64
+	last   time.Time
+}
+
+type budgetWaiter struct {
+	weight int
+	ready  chan struct{}
+}
+
+func newRequestBudget(maxConcurrent int, perSecond float64, weights map[string]int) *requestBudget {
+	return &requestBudget{
+		maxConcurrent: maxConcurrent,
+		perSecond:     perSecond,
+		weights:       weights,
+		now:           time.Now,
+		limit:         maxConcurrent,
+		tokens:        perSecond,
+	}
+}
+
+// weight returns the budget a type of operation counts for. A request
+// weighing more than the concurrency budget counts for all of it, so it
+// still runs on its own.
+func (b *requestBudget) weight(operation string) int {
+	weight := b.weights[operation]
+	if weight < 1 {
+		weight = 1
+	}
+	if b.maxConcurrent > 0 && weight > b.maxConcurrent {
+		weight = b.maxConcurrent
+	}
+	return weight
+}
+
+// acquire waits until a request of the given weight fits in the budget, or
+// the context is done. It reports whether the request had to wait.
+func (b *requestBudget) acquire(ctx context.Context, weight int) (bool, error) {
+	waitedForRate, err := b.reserveRate(ctx, weight)
+	if err != nil {
+		return waitedForRate, err
+	}
+	waitedForSlot, err := b.acquireConcurrency(ctx, weight)
+	return waitedForRate || waitedForSlot, err
+}
+
+// reserveRate takes a request's weight from the rate budget, waiting until
+// the budget has been refilled if it ran out.
+func (b *requestBudget) reserveRate(ctx context.Context, weight int) (bool, error) {
+	if b.perSecond <= 0 {
+		return false, nil
+	}
+
+	b.lock.Lock()
+	now := b.now()
+	if !b.last.IsZero() {
+		b.tokens += now.Sub(b.last).Seconds() * b.perSecond
+	}
+	burst := b.perSecond
+	if burst < 1 {
+		burst = 1
+	}
+	if b.tokens > burst {
+		b.tokens = burst
+	}
+	b.last = now
+	b.tokens -= float64(weight)
+	wait := time.Duration(-b.tokens / b.perSecond * float64(time.Second))
+	b.lock.Unlock()
+
+	if wait <= 0 {
+		return false, nil
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true, nil
+	case <-ctx.Done():
+		b.lock.Lock()
+		b.tokens += float64(weight)
+		b.lock.Unlock()
+		return true, ctx.Err()
+	}
+}
+
+// acquireConcurrency adds a request's weight to the requests in flight,
+// waiting for earlier requests to finish if it doesn't fit.
+func (b *requestBudget) acquireConcurrency(ctx context.Context, weight int) (bool, error) {
+	if b.maxConcurrent <= 0 {
+		return false, nil
+	}
+
+	b.lock.Lock()
+	if len(b.waiters) == 0 && b.fits(weight) {
+		b.inFlight += weight
+		b.setGauge()
+		b.lock.Unlock()
+		return false, nil
+	}
+	waiter := &budgetWaiter{weight: weight, ready: make(chan struct{})}
+	b.waiters = append(b.waiters, waiter)
+	b.lock.Unlock()
+
+	select {
+	case <-waiter.ready:
+		return true, nil
+	case <-ctx.Done():
+		b.lock.Lock()
+		defer b.lock.Unlock()
+		select {
+		case <-waiter.ready:
+			// granted while the context was being canceled
+			b.inFlight -= weight
+		default:
+			for i, w := range b.waiters {
+				if w == waiter {
+					b.waiters = append(b.waiters[:i], b.waiters[i+1:]...)
+					break
+				}
+			}
+		}
+		b.grant()
+		return true, ctx.Err()
+	}
+}
+
+// release returns a finished request's weight to the concurrency budget.
+func (b *requestBudget) release(weight int) {
+	if b.maxConcurrent <= 0 {
+		return
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.inFlight -= weight
+	b.grant()
+}
+
+// grant lets the waiting requests that fit in the budget through, in order.
+// It must be called with the lock held.
+func (b *requestBudget) grant() {
+	for len(b.waiters) > 0 && b.fits(b.waiters[0].weight) {
+		b.inFlight += b.waiters[0].weight
+		close(b.waiters[0].ready)
+		b.waiters = b.waiters[1:]
+	}
+	b.setGauge()
+}
+
+// fits reports whether a request of the given weight fits in the budget
+// now. A request weighing more than an adapted limit still runs on its own.
+// It must be called with the lock held.
+func (b *requestBudget) fits(weight int) bool {
+	return b.inFlight+weight <= b.limit || b.inFlight == 0
+}
+
+func (b *requestBudget) setGauge() {
+	pluginMetrics.setGauge(requestBudgetInFlightGauge, "Weight of the GCP API requests in flight, counted against the concurrency budget.", nil, float64(b.inFlight))
+}
+
+// requestOperationType returns the type of operation a request makes, which
+// its weight depends on.
+func requestOperationType(req *http.Request) string {
+	path := req.URL.Path
+	switch {
+	case strings.HasPrefix(path, "/upload/"):
+		return uploadRequest
+	case req.Method == http.MethodGet && (req.URL.Query().Get("alt") == "media" || isStorageXMLRead(req)):
+		return downloadRequest
+	case req.Method == http.MethodPost && (strings.HasSuffix(path, "/createSnapshot") || strings.HasSuffix(path, "/snapshots") ||
+		strings.HasSuffix(path, "/backups") || strings.HasSuffix(path, "/backupRuns")):
+		return snapshotRequest
+	case req.Method == http.MethodGet || req.Method == http.MethodHead:
+		return readRequest
+	}
+	return writeRequest
+}
+
+// isStorageXMLRead reports whether a request reads an object through the
+// Cloud Storage XML API, which the client library downloads objects with.
+func isStorageXMLRead(req *http.Request) bool {
+	return apiOperation(req.URL.EscapedPath()) == "xml" && strings.Count(strings.Trim(req.URL.Path, "/"), "/") > 0
+}
+
+// requestBudgetTransport makes requests within the process's request
+// budget. A request holds its share of the concurrency budget until its
+// response body is closed or read to the end, so downloads count for as
+// long as they're streamed.
+type requestBudgetTransport struct {
+	budget  *requestBudget
+	service string
+	base    http.RoundTripper
+}
+
+func (t *requestBudgetTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	operation := requestOperationType(req)
+	weight := t.budget.weight(operation)
+	waited, err := t.budget.acquire(req.Context(), weight)
+	if waited {
+		pluginMetrics.addCounter(requestBudgetWaitsCounter, "Number of GCP API requests that waited for the request budget.", map[string]string{"service": t.service, "type": operation}, 1)
+	}
+	if err != nil {
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		return nil, err
+	}
+
+	start := time.Now()
+	res, err := t.base.RoundTrip(req)
+	t.budget.observe(operation, time.Since(start), res, err)
+	if err != nil {
+		t.budget.release(weight)
+		return nil, err
+	}
+	res.Body = &budgetBody{ReadCloser: res.Body, release: func() { t.budget.release(weight) }}
+	return res, nil
+}
+
+// budgetBody releases a request's budget once its body is closed or read
+// to the end.
+type budgetBody struct {
+	io.ReadCloser
+	once    sync.Once
+	release func()
+}
+
+func (b *budgetBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err != nil {
+		b.once.Do(b.release)
+	}
+	return n, err
+}
+
+func (b *budgetBody) Close() error {
+	b.once.Do(b.release)
+	return b.ReadCloser.Close()
+}
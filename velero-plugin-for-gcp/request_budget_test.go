@@ -0,0 +1,228 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRequestBudgetConcurrency(t *testing.T) {
+	budget := newRequestBudget(4, 0, defaultRequestWeights)
+	ctx := context.Background()
+
+	waited, err := budget.acquire(ctx, budget.weight(snapshotRequest))
+	require.NoError(t, err)
+	assert.False(t, waited)
+	_, err = budget.acquire(ctx, budget.weight(readRequest))
+	require.NoError(t, err)
+	assert.Equal(t, 3, budget.inFlight)
+
+	// an upload doesn't fit until the others finish, and reads made after
+	// it wait for it
+	upload := make(chan error)
+	go func() {
+		_, err := budget.acquire(ctx, budget.weight(uploadRequest))
+		upload <- err
+	}()
+	require.Eventually(t, func() bool {
+		budget.lock.Lock()
+		defer budget.lock.Unlock()
+		return len(budget.waiters) == 1
+	}, time.Second, time.Millisecond)
+
+	read := make(chan error)
+	go func() {
+		_, err := budget.acquire(ctx, budget.weight(readRequest))
+		read <- err
+	}()
+	require.Eventually(t, func() bool {
+		budget.lock.Lock()
+		defer budget.lock.Unlock()
+		return len(budget.waiters) == 2
+	}, time.Second, time.Millisecond)
+
+	budget.release(budget.weight(snapshotRequest))
+	budget.release(budget.weight(readRequest))
+	require.NoError(t, <-upload)
+	assert.Equal(t, 4, budget.inFlight)
+
+	budget.release(budget.weight(uploadRequest))
+	require.NoError(t, <-read)
+	assert.Equal(t, 1, budget.inFlight)
+
+	// canceled requests stop waiting and don't hold the budget
+	_, err = budget.acquire(ctx, 3)
+	require.NoError(t, err)
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	waited, err = budget.acquire(canceled, 1)
+	assert.True(t, waited)
+	assert.Equal(t, context.Canceled, err)
+	assert.Empty(t, budget.waiters)
+	assert.Equal(t, 4, budget.inFlight)
+}
+
+func TestRequestBudgetWeight(t *testing.T) {
+	budget := newRequestBudget(2, 0, defaultRequestWeights)
+	assert.Equal(t, 2, budget.weight(uploadRequest), "requests weighing more than the budget still run on their own")
+	assert.Equal(t, 1, budget.weight(readRequest))
+	assert.Equal(t, 1, budget.weight("unknown"))
+}
+
+func TestRequestBudgetRate(t *testing.T) {
+	budget := newRequestBudget(0, 100, defaultRequestWeights)
+	now := time.Now()
+	budget.now = func() time.Time { return now }
+	ctx := context.Background()
+
+	for i := 0; i < 25; i++ {
+		waited, err := budget.acquire(ctx, budget.weight(uploadRequest))
+		require.NoError(t, err)
+		require.False(t, waited)
+	}
+
+	// the budget is used up, so the next request waits for it to refill
+	start := time.Now()
+	waited, err := budget.acquire(ctx, budget.weight(readRequest))
+	require.NoError(t, err)
+	assert.True(t, waited)
+	assert.GreaterOrEqual(t, time.Since(start), 5*time.Millisecond)
+
+	// canceled requests give their reservation back
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	_, err = budget.acquire(canceled, 50)
+	assert.Equal(t, context.Canceled, err)
+	assert.InDelta(t, -1, budget.tokens, 0.001)
+
+	now = now.Add(time.Minute)
+	waited, err = budget.acquire(ctx, 1)
+	require.NoError(t, err)
+	assert.False(t, waited)
+	assert.InDelta(t, 99, budget.tokens, 0.001, "the budget refills up to a second's worth")
+}
+
+func TestRequestOperationType(t *testing.T) {
+	tests := []struct {
+		method, url string
+		expected    string
+	}{
+		{method: http.MethodPost, url: "https://storage.googleapis.com/upload/storage/v1/b/bucket/o?uploadType=resumable", expected: uploadRequest},
+		{method: http.MethodPut, url: "https://storage.googleapis.com/upload/storage/v1/b/bucket/o?upload_id=x", expected: uploadRequest},
+		{method: http.MethodGet, url: "https://storage.googleapis.com/bucket/backups/b1/b1.tar.gz", expected: downloadRequest},
+		{method: http.MethodGet, url: "https://storage.googleapis.com/storage/v1/b/bucket/o/backups%2Fb1?alt=media", expected: downloadRequest},
+		{method: http.MethodGet, url: "https://storage.googleapis.com/storage/v1/b/bucket/o/backups%2Fb1", expected: readRequest},
+		{method: http.MethodPost, url: "https://compute.googleapis.com/compute/v1/projects/p/zones/z/disks/d/createSnapshot", expected: snapshotRequest},
+		{method: http.MethodPost, url: "https://compute.googleapis.com/compute/v1/projects/p/global/snapshots", expected: snapshotRequest},
+		{method: http.MethodPost, url: "https://file.googleapis.com/v1/projects/p/locations/l/backups?backupId=b", expected: snapshotRequest},
+		{method: http.MethodPost, url: "https://sqladmin.googleapis.com/v1beta4/projects/p/instances/i/backupRuns", expected: snapshotRequest},
+		{method: http.MethodPost, url: "https://compute.googleapis.com/compute/v1/projects/p/global/snapshots/s/setLabels", expected: writeRequest},
+		{method: http.MethodDelete, url: "https://storage.googleapis.com/storage/v1/b/bucket/o/backups%2Fb1", expected: writeRequest},
+		{method: http.MethodGet, url: "https://compute.googleapis.com/compute/v1/projects/p/zones/z/disks/d", expected: readRequest},
+	}
+	for _, test := range tests {
+		req, err := http.NewRequest(test.method, test.url, nil)
+		require.NoError(t, err)
+		assert.Equal(t, test.expected, requestOperationType(req), test.method+" "+test.url)
+	}
+}
+
+func TestRequestBudgetFromEnv(t *testing.T) {
+	defer func() {
+		os.Unsetenv(maxConcurrentRequestsEnvVar)
+		os.Unsetenv(maxRequestsPerSecondEnvVar)
+		os.Unsetenv(requestWeightsEnvVar)
+	}()
+	logger, hook := logtest.NewNullLogger()
+
+	assert.Nil(t, requestBudgetFromEnv(logger))
+
+	os.Setenv(maxConcurrentRequestsEnvVar, "many")
+	os.Setenv(maxRequestsPerSecondEnvVar, "-1")
+	assert.Nil(t, requestBudgetFromEnv(logger))
+	require.Len(t, hook.AllEntries(), 2)
+	assert.Equal(t, logrus.WarnLevel, hook.LastEntry().Level)
+
+	hook.Reset()
+	os.Setenv(maxConcurrentRequestsEnvVar, "16")
+	os.Setenv(maxRequestsPerSecondEnvVar, "20")
+	os.Setenv(requestWeightsEnvVar, "upload=8, snapshot=3, delete=2, read=0")
+	budget := requestBudgetFromEnv(logger)
+	require.NotNil(t, budget)
+	assert.Equal(t, 16, budget.maxConcurrent)
+	assert.Equal(t, 20.0, budget.perSecond)
+	assert.Equal(t, map[string]int{uploadRequest: 8, downloadRequest: 4, snapshotRequest: 3, writeRequest: 1, readRequest: 1}, budget.weights)
+	assert.Len(t, hook.AllEntries(), 3, "two invalid weights and the limits are logged")
+}
+
+func TestRequestBudgetTransport(t *testing.T) {
+	defer func(registry *metricsRegistry) { pluginMetrics = registry }(pluginMetrics)
+	pluginMetrics = newMetricsRegistry()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("contents"))
+	}))
+	defer server.Close()
+
+	budget := newRequestBudget(4, 0, defaultRequestWeights)
+	client := &http.Client{Transport: &requestBudgetTransport{budget: budget, service: storageService, base: http.DefaultTransport}}
+
+	// a download holds its budget until its body is read
+	res, err := client.Get(server.URL + "/bucket/backups/b1/b1.tar.gz")
+	require.NoError(t, err)
+	assert.Equal(t, 4, budget.inFlight)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, server.URL+"/storage/v1/b/bucket", nil)
+	_, err = client.Do(req)
+	assert.Error(t, err, "requests wait while the budget is used up")
+
+	body, err := ioutil.ReadAll(res.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "contents", string(body))
+	assert.Equal(t, 0, budget.inFlight)
+	res.Body.Close()
+	assert.Equal(t, 0, budget.inFlight, "the budget is released once")
+
+	res, err = client.Post(server.URL+"/compute/v1/projects/p/zones/z/disks/d/createSnapshot", "application/json", strings.NewReader("{}"))
+	require.NoError(t, err)
+	assert.Equal(t, 2, budget.inFlight)
+	res.Body.Close()
+	assert.Equal(t, 0, budget.inFlight)
+
+	values := make(map[string]float64)
+	pluginMetrics.each(func(m *metric, s *sample) {
+		values[m.name+labelString(s.labels)] = s.value
+	})
+	assert.Equal(t, map[string]float64{
+		`velero_gcp_request_budget_in_flight`:                                  0,
+		`velero_gcp_request_budget_waits_total{service="storage",type="read"}`: 1,
+	}, values)
+}
@@ -0,0 +1,83 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+)
+
+const (
+	// requestReasonHeader is the system parameter GCP records as the
+	// reason of a call in its Cloud Audit Logs entry.
+	requestReasonHeader = "X-Goog-Request-Reason"
+
+	backupOperation         = "backup"
+	restoreOperation        = "restore"
+	backupDeletionOperation = "backup-deletion"
+	// backupRestoreOperation identifies restores by the backup they restore
+	// from, for volume snapshotters, which aren't told the restore's name.
+	backupRestoreOperation = "restore-from-backup"
+)
+
+type requestReasonKey struct{}
+
+// requestReason returns the reason identifying the Velero operation a call
+// is made for, e.g. velero/backup/nightly-20211001, or an empty string if
+// the operation's name isn't known.
+func requestReason(operation, name string) string {
+	if name == "" {
+		return ""
+	}
+	return "velero/" + operation + "/" + name
+}
+
+// snapshotBackupReason returns the reason of the calls made to restore from
+// a snapshot or Filestore backup, whose description holds the tags of the
+// Velero backup it was taken for.
+func snapshotBackupReason(description string) string {
+	var tags map[string]string
+	if err := json.Unmarshal([]byte(description), &tags); err != nil {
+		return ""
+	}
+	return requestReason(backupRestoreOperation, tags[backupNameTag])
+}
+
+// headerCall is an API call whose request headers can be set.
+type headerCall interface {
+	Header() http.Header
+}
+
+// setRequestReason sets the reason of a call, if any, so it can be traced
+// back to the Velero operation that made it.
+func setRequestReason(call headerCall, reason string) {
+	if reason != "" {
+		call.Header().Set(requestReasonHeader, reason)
+	}
+}
+
+// withRequestReason returns a context carrying the reason of the calls made
+// with it, for calls made further down the stack.
+func withRequestReason(ctx context.Context, reason string) context.Context {
+	return context.WithValue(ctx, requestReasonKey{}, reason)
+}
+
+func requestReasonFrom(ctx context.Context) string {
+	reason, _ := ctx.Value(requestReasonKey{}).(string)
+	return reason
+}
@@ -0,0 +1,62 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	velerotest "github.com/vmware-tanzu/velero/pkg/test"
+	"google.golang.org/api/compute/v1"
+)
+
+func TestRequestReason(t *testing.T) {
+	assert.Equal(t, "velero/backup/nightly-20211001", requestReason(backupOperation, "nightly-20211001"))
+	assert.Equal(t, "", requestReason(backupOperation, ""))
+
+	assert.Equal(t, "velero/restore-from-backup/nightly-20211001", snapshotBackupReason(`{"velero.io/backup":"nightly-20211001","velero.io/pv":"pvc-1"}`))
+	assert.Equal(t, "", snapshotBackupReason("created by hand"))
+
+	ctx := withRequestReason(context.Background(), "velero/restore/r1")
+	assert.Equal(t, "velero/restore/r1", requestReasonFrom(ctx))
+	assert.Equal(t, "", requestReasonFrom(context.Background()))
+}
+
+func TestSetRequestReason(t *testing.T) {
+	var reasons []string
+	gce := newFakeComputeService(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodDelete {
+			reasons = append(reasons, r.Header.Get(requestReasonHeader))
+		}
+		json.NewEncoder(w).Encode(&compute.Operation{})
+	})
+	b := (&VolumeSnapshotter{log: velerotest.NewLogger(), snapshotProject: "p"}).withClients(&snapshotterClients{gce: gce})
+
+	call := b.clients().gce.Snapshots.Delete("p", "disk-1-snap")
+	setRequestReason(call, requestReason(backupDeletionOperation, "nightly"))
+	_, err := call.Do()
+	require.NoError(t, err)
+
+	_, err = b.deleteSnapshot("disk-2-snap")
+	require.NoError(t, err)
+
+	assert.Equal(t, []string{"velero/backup-deletion/nightly", ""}, reasons)
+}
@@ -0,0 +1,246 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/api/cloudresourcemanager/v3"
+)
+
+const (
+	// resourceTagsConfigKey is the key of a VolumeSnapshotLocation's config
+	// holding the comma-separated tag values bound to the snapshots and
+	// restored disks the plugin creates, as tagValues/ID or
+	// PARENT/KEY/VALUE.
+	resourceTagsConfigKey = "resourceTags"
+
+	// resourceTagsTimeout bounds waiting for a created snapshot or disk to
+	// be readable, to bind tags to its numeric ID.
+	resourceTagsTimeout = time.Minute
+)
+
+var (
+	// resourceTagsPollInterval is how often a created resource is read
+	// until it exists. It is a variable so tests can shorten it.
+	resourceTagsPollInterval = 2 * time.Second
+
+	tagValueRegexp = regexp.MustCompile(`^tagValues/[0-9]+$`)
+	// namespacedTagValueRegexp matches the namespaced names of tag values:
+	// the ID of their organization, or their project, their key's short
+	// name and their short name.
+	namespacedTagValueRegexp = regexp.MustCompile(`^[a-z0-9-]+/[^/]+/[^/]+$`)
+)
+
+func checkResourceTags(val string) error {
+	for _, value := range parseList(val) {
+		if !tagValueRegexp.MatchString(value) && !namespacedTagValueRegexp.MatchString(value) {
+			return errors.Errorf("invalid tag value %q, expected tagValues/ID or ORGANIZATION_OR_PROJECT_ID/KEY/VALUE", value)
+		}
+	}
+	return nil
+}
+
+// resourceTagger binds the tag values of a location to the snapshots and
+// restored disks the plugin creates, so IAM conditions and organization
+// policies based on tags apply to them. Namespaced names are resolved to
+// tag values once. Tags that can't be bound are logged as warnings rather
+// than failing the backup or restore. A nil tagger binds nothing.
+type resourceTagger struct {
+	log         logrus.FieldLogger
+	credentials locationCredentials
+	values      []string
+
+	lock     sync.Mutex
+	bindings *tagBindings
+	resolved []string
+}
+
+// newResourceTagger returns the tagger of a location, or nil if the location
+// doesn't set resourceTags.
+func newResourceTagger(log logrus.FieldLogger, config map[string]string, credentials locationCredentials) *resourceTagger {
+	values := parseList(config[resourceTagsConfigKey])
+	if len(values) == 0 {
+		return nil
+	}
+	return &resourceTagger{log: log, credentials: credentials, values: values}
+}
+
+// tagValues returns the client binding tags and the names of the location's
+// tag values.
+func (t *resourceTagger) tagValues(ctx context.Context) (*tagBindings, []string, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if t.bindings == nil {
+		opts, err := t.credentials.clientOptions(ctx, cloudresourcemanager.CloudPlatformScope)
+		if err != nil {
+			return nil, nil, err
+		}
+		t.bindings = newTagBindings(t.log, opts)
+	}
+	if t.resolved != nil {
+		return t.bindings, t.resolved, nil
+	}
+
+	var resolved []string
+	for _, value := range t.values {
+		if !tagValueRegexp.MatchString(value) {
+			name, err := t.resolve(ctx, value)
+			if err != nil {
+				return nil, nil, err
+			}
+			value = name
+		}
+		resolved = append(resolved, value)
+	}
+	t.resolved = resolved
+	return t.bindings, resolved, nil
+}
+
+// resolve returns the name of the tag value with a namespaced name, looking
+// up the short names of the keys of its parent and of the key's values.
+func (t *resourceTagger) resolve(ctx context.Context, namespacedName string) (string, error) {
+	svc, err := t.bindings.service(ctx, "")
+	if err != nil {
+		return "", err
+	}
+	parts := strings.Split(namespacedName, "/")
+	parent := "projects/" + parts[0]
+	if strings.Trim(parts[0], "0123456789") == "" {
+		parent = "organizations/" + parts[0]
+	}
+
+	var key string
+	err = svc.TagKeys.List().Parent(parent).Pages(ctx, func(page *cloudresourcemanager.ListTagKeysResponse) error {
+		for _, k := range page.TagKeys {
+			if k.ShortName == parts[1] {
+				key = k.Name
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return "", errors.Wrapf(err, "error listing the tag keys of %s", parent)
+	}
+	if key == "" {
+		return "", errors.Errorf("tag value %s not found: %s has no tag key %s", namespacedName, parent, parts[1])
+	}
+
+	var value string
+	err = svc.TagValues.List().Parent(key).Pages(ctx, func(page *cloudresourcemanager.ListTagValuesResponse) error {
+		for _, v := range page.TagValues {
+			if v.ShortName == parts[2] {
+				value = v.Name
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return "", errors.Wrapf(err, "error listing the values of tag key %s", key)
+	}
+	if value == "" {
+		return "", errors.Errorf("tag value %s not found", namespacedName)
+	}
+	return value, nil
+}
+
+// bind binds the location's tag values to a resource once its numeric ID can
+// be read, logging the tags that couldn't be bound.
+func (t *resourceTagger) bind(ctx context.Context, log logrus.FieldLogger, what, location string, resource func(id uint64) string, getID func() (uint64, error)) {
+	bindings, values, err := t.tagValues(ctx)
+	if err != nil {
+		log.WithError(err).Warnf("Unable to bind the %s to %s", resourceTagsConfigKey, what)
+		return
+	}
+
+	deadline := time.Now().Add(resourceTagsTimeout)
+	var id uint64
+	for {
+		id, err = getID()
+		if err == nil || !isNotFound(err) || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(resourceTagsPollInterval)
+	}
+	if err != nil {
+		log.WithError(err).Warnf("Unable to read %s to bind its %s", what, resourceTagsConfigKey)
+		return
+	}
+
+	for _, value := range values {
+		if err := bindings.bindResource(ctx, location, resource(id), value); err != nil {
+			log.WithError(err).Warnf("Unable to bind tag value %s to %s", value, what)
+			continue
+		}
+		log.Debugf("Bound tag value %s to %s", value, what)
+	}
+}
+
+// bindSnapshotTags binds the location's tag values to a snapshot it created.
+// Snapshots are global, so their tags are managed through the global
+// endpoint.
+func (b *VolumeSnapshotter) bindSnapshotTags(name string, tags map[string]string) {
+	resourceTags := b.clients().resourceTags
+	if resourceTags == nil {
+		return
+	}
+	ctx := withRequestReason(context.Background(), requestReason(backupOperation, tags[backupNameTag]))
+	log := b.log.WithFields(logrus.Fields{"backup": tags[backupNameTag], "snapshot": name})
+	resourceTags.bind(ctx, log, "snapshot "+name, "", func(id uint64) string {
+		return fmt.Sprintf("//compute.googleapis.com/projects/%s/global/snapshots/%d", b.snapshotProject, id)
+	}, func() (uint64, error) {
+		s, err := b.clients().gce.Snapshots.Get(b.snapshotProject, name).Context(ctx).Do()
+		if err != nil {
+			return 0, err
+		}
+		return s.Id, nil
+	})
+}
+
+// bindDiskTags binds the location's tag values to a disk it restored.
+func (b *VolumeSnapshotter) bindDiskTags(ref diskRef, reason string) {
+	resourceTags := b.clients().resourceTags
+	if resourceTags == nil {
+		return
+	}
+	ctx := withRequestReason(context.Background(), reason)
+	log := b.log.WithField("volume", ref.name)
+	resourceTags.bind(ctx, log, "disk "+ref.name, ref.location, func(id uint64) string {
+		return diskResourceName(ref, id)
+	}, func() (uint64, error) {
+		if ref.regional {
+			d, err := b.clients().gce.RegionDisks.Get(ref.project, ref.location, ref.name).Context(ctx).Do()
+			if err != nil {
+				return 0, err
+			}
+			return d.Id, nil
+		}
+		d, err := b.clients().gce.Disks.Get(ref.project, ref.location, ref.name).Context(ctx).Do()
+		if err != nil {
+			return 0, err
+		}
+		return d.Id, nil
+	})
+}
@@ -0,0 +1,144 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	velerotest "github.com/vmware-tanzu/velero/pkg/test"
+	"golang.org/x/oauth2"
+	"google.golang.org/api/cloudresourcemanager/v3"
+	"google.golang.org/api/compute/v1"
+	"google.golang.org/api/option"
+)
+
+func TestResourceTags(t *testing.T) {
+	var lock sync.Mutex
+	var created []cloudresourcemanager.TagBinding
+	lists := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		switch {
+		case r.Method == http.MethodGet && r.URL.Path == "/global/v3/tagKeys":
+			lists++
+			assert.Equal(t, "organizations/123", r.URL.Query().Get("parent"))
+			json.NewEncoder(w).Encode(&cloudresourcemanager.ListTagKeysResponse{TagKeys: []*cloudresourcemanager.TagKey{
+				{Name: "tagKeys/1", ShortName: "team"},
+				{Name: "tagKeys/2", ShortName: "env"},
+			}})
+		case r.Method == http.MethodGet && r.URL.Path == "/global/v3/tagValues":
+			assert.Equal(t, "tagKeys/2", r.URL.Query().Get("parent"))
+			json.NewEncoder(w).Encode(&cloudresourcemanager.ListTagValuesResponse{TagValues: []*cloudresourcemanager.TagValue{
+				{Name: "tagValues/20", ShortName: "dev"},
+				{Name: "tagValues/21", ShortName: "prod"},
+			}})
+		case r.Method == http.MethodPost && r.URL.Path == "/global/v3/tagBindings",
+			r.Method == http.MethodPost && r.URL.Path == "/us-central1-a/v3/tagBindings":
+			var binding cloudresourcemanager.TagBinding
+			require.NoError(t, json.NewDecoder(r.Body).Decode(&binding))
+			created = append(created, binding)
+			json.NewEncoder(w).Encode(&cloudresourcemanager.Operation{})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	endpoint := func(location string) string {
+		if location == "" {
+			return server.URL + "/global/"
+		}
+		return server.URL + "/" + location + "/"
+	}
+	defer func(original time.Duration) { resourceTagsPollInterval = original }(resourceTagsPollInterval)
+	resourceTagsPollInterval = time.Millisecond
+
+	snapshotGets := 0
+	gce := newFakeComputeService(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/projects/snaps/global/snapshots/snap-1":
+			// the snapshot isn't readable right away
+			snapshotGets++
+			if snapshotGets == 1 {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			json.NewEncoder(w).Encode(&compute.Snapshot{Name: "snap-1", Id: 99})
+		case "/projects/p/zones/us-central1-a/disks/restore-1":
+			json.NewEncoder(w).Encode(&compute.Disk{Name: "restore-1", Id: 42})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	})
+
+	credentials := locationCredentials{tokenSource: oauth2.StaticTokenSource(&oauth2.Token{AccessToken: "token"})}
+	tagger := func(values string) *resourceTagger {
+		tagger := newResourceTagger(velerotest.NewLogger(), map[string]string{resourceTagsConfigKey: values}, credentials)
+		tagger.bindings = newTagBindings(tagger.log, []option.ClientOption{option.WithoutAuthentication()})
+		tagger.bindings.endpoint = endpoint
+		return tagger
+	}
+	b := (&VolumeSnapshotter{
+		log:             velerotest.NewLogger(),
+		snapshotProject: "snaps",
+	}).withClients(&snapshotterClients{
+		gce:          gce,
+		resourceTags: tagger("tagValues/7, 123/env/prod"),
+	})
+	b.bindSnapshotTags("snap-1", map[string]string{backupNameTag: "nightly"})
+	b.bindDiskTags(diskRef{project: "p", location: "us-central1-a", name: "restore-1"}, "velero/restore/nightly")
+
+	assert.Equal(t, 2, snapshotGets)
+	// namespaced names are resolved once
+	assert.Equal(t, 1, lists)
+	assert.Equal(t, []cloudresourcemanager.TagBinding{
+		{Parent: "//compute.googleapis.com/projects/snaps/global/snapshots/99", TagValue: "tagValues/7"},
+		{Parent: "//compute.googleapis.com/projects/snaps/global/snapshots/99", TagValue: "tagValues/21"},
+		{Parent: "//compute.googleapis.com/projects/p/zones/us-central1-a/disks/42", TagValue: "tagValues/7"},
+		{Parent: "//compute.googleapis.com/projects/p/zones/us-central1-a/disks/42", TagValue: "tagValues/21"},
+	}, created)
+
+	// resources whose tags can't be bound are still created
+	created = nil
+	b.setClients(func(c *snapshotterClients) {
+		c.resourceTags = tagger("123/env/staging")
+	})
+	b.bindDiskTags(diskRef{project: "p", location: "us-central1-a", name: "restore-1"}, "velero/restore/nightly")
+	assert.Empty(t, created)
+
+	// locations without resourceTags bind nothing
+	assert.Nil(t, newResourceTagger(velerotest.NewLogger(), map[string]string{}, credentials))
+	b.setClients(func(c *snapshotterClients) { c.resourceTags = nil })
+	b.bindSnapshotTags("snap-1", map[string]string{backupNameTag: "nightly"})
+	assert.Empty(t, created)
+}
+
+func TestCheckResourceTags(t *testing.T) {
+	assert.NoError(t, checkResourceTags("tagValues/123"))
+	assert.NoError(t, checkResourceTags("tagValues/123, 456/env/prod, my-project/team/shop"))
+	assert.Error(t, checkResourceTags("env/prod"))
+	assert.Error(t, checkResourceTags("tagValues/prod"))
+	assert.Error(t, checkResourceTags("tagKeys/1/prod"))
+}
@@ -0,0 +1,278 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/pflag"
+	"google.golang.org/api/compute/v1"
+	file "google.golang.org/api/file/v1"
+	v1 "k8s.io/api/core/v1"
+)
+
+const (
+	gcRestoreArtifactsCommand = "gc-restore-artifacts"
+
+	// restoredFromLabel is the label of the disks and Filestore instances
+	// created by restores, holding the sanitized name of the backup they
+	// were restored from, so those a failed restore left behind can be
+	// found.
+	restoredFromLabel = "velero-restored-from"
+
+	// restoreArtifactMinAge is how old an unused restored disk or instance
+	// has to be before it's deleted along with its backup, so the volumes of
+	// restores still in progress, which have no persistent volume yet, are
+	// left alone.
+	restoreArtifactMinAge = time.Hour
+
+	restoredDiskKind     = "disk"
+	restoredInstanceKind = "filestore-instance"
+)
+
+// restoredDiskRegexp matches the resource names of restored disks.
+var restoredDiskRegexp = regexp.MustCompile(`^projects/([^/]+)/(zones|regions)/([^/]+)/disks/([^/]+)$`)
+
+// restoreArtifact is a disk or Filestore instance created by a restore.
+type restoreArtifact struct {
+	kind string
+	// name is the artifact's resource name.
+	name string
+	// volumeID is the ID persistent volumes refer to the artifact by: the
+	// name of a disk or the ID of a Filestore instance.
+	volumeID string
+	backup   string
+	inUse    bool
+	created  time.Time
+}
+
+// restoreArtifactLabels returns the labels of a volume restored from a
+// snapshot or Filestore backup with the given labels.
+func restoreArtifactLabels(snapshotLabels map[string]string) map[string]string {
+	return map[string]string{restoredFromLabel: snapshotLabels[backupLabel]}
+}
+
+func (inCluster) persistentVolumes() ([]v1.PersistentVolume, error) {
+	client, err := newInClusterClient()
+	if err != nil {
+		return nil, err
+	}
+	return client.listPersistentVolumes()
+}
+
+// listRestoreArtifacts returns the disks and Filestore instances in the
+// volume project created by restores of a backup, or of any backup if backup
+// is empty.
+func (b *VolumeSnapshotter) listRestoreArtifacts(backup string) ([]restoreArtifact, error) {
+	filter := fmt.Sprintf("labels.%s:*", restoredFromLabel)
+	if backup != "" {
+		filter = fmt.Sprintf("labels.%s=%q", restoredFromLabel, sanitizeLabelValue(backup))
+	}
+
+	var artifacts []restoreArtifact
+	// the aggregated list includes regional disks
+	err := b.clients().gce.Disks.AggregatedList(b.volumeProject).Filter(filter).Pages(context.TODO(), func(page *compute.DiskAggregatedList) error {
+		for scope, list := range page.Items {
+			for _, disk := range list.Disks {
+				created, _ := time.Parse(time.RFC3339, disk.CreationTimestamp)
+				artifacts = append(artifacts, restoreArtifact{
+					kind:     restoredDiskKind,
+					name:     fmt.Sprintf("projects/%s/%s/disks/%s", b.volumeProject, scope, disk.Name),
+					volumeID: disk.Name,
+					backup:   disk.Labels[restoredFromLabel],
+					inUse:    len(disk.Users) > 0,
+					created:  created,
+				})
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "error listing restored disks")
+	}
+
+	svc, err := b.filestoreService()
+	if err != nil {
+		return nil, err
+	}
+	err = svc.Projects.Locations.Instances.List(fmt.Sprintf("projects/%s/locations/-", b.volumeProject)).Filter(filter).Pages(context.TODO(), func(page *file.ListInstancesResponse) error {
+		for _, instance := range page.Instances {
+			created, _ := time.Parse(time.RFC3339, instance.CreateTime)
+			artifacts = append(artifacts, restoreArtifact{
+				kind:     restoredInstanceKind,
+				name:     instance.Name,
+				volumeID: instance.Name[strings.LastIndex(instance.Name, "/")+1:],
+				backup:   instance.Labels[restoredFromLabel],
+				created:  created,
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "error listing restored Filestore instances")
+	}
+	return artifacts, nil
+}
+
+// orphanedRestoreArtifacts returns the restore artifacts that no persistent
+// volume refers to, that aren't attached to an instance and that are older
+// than minAge.
+func orphanedRestoreArtifacts(artifacts []restoreArtifact, pvs []v1.PersistentVolume, minAge time.Duration, now time.Time) []restoreArtifact {
+	referenced := make(map[string]bool, len(pvs))
+	for i := range pvs {
+		id := pvVolumeID(&pvs[i])
+		if m := filestoreVolRegexp.FindStringSubmatch(id); m != nil {
+			id = m[2]
+		} else {
+			id = id[strings.LastIndex(id, "/")+1:]
+		}
+		referenced[id] = true
+	}
+
+	var orphans []restoreArtifact
+	for _, a := range artifacts {
+		if !a.inUse && !referenced[a.volumeID] && now.Sub(a.created) >= minAge {
+			orphans = append(orphans, a)
+		}
+	}
+	return orphans
+}
+
+// deleteRestoreArtifact deletes a restored disk or Filestore instance. Deleting
+// an artifact that doesn't exist anymore succeeds.
+func (b *VolumeSnapshotter) deleteRestoreArtifact(a restoreArtifact) error {
+	var err error
+	switch a.kind {
+	case restoredDiskKind:
+		m := restoredDiskRegexp.FindStringSubmatch(a.name)
+		if m == nil {
+			return errors.Errorf("invalid disk name %q", a.name)
+		}
+		if m[2] == "regions" {
+			_, err = b.clients().gce.RegionDisks.Delete(m[1], m[3], m[4]).Do()
+		} else {
+			_, err = b.clients().gce.Disks.Delete(m[1], m[3], m[4]).Do()
+		}
+	case restoredInstanceKind:
+		svc, svcErr := b.filestoreService()
+		if svcErr != nil {
+			return svcErr
+		}
+		_, err = svc.Projects.Locations.Instances.Delete(a.name).Do()
+	default:
+		return errors.Errorf("unknown restore artifact kind %q", a.kind)
+	}
+	if isNotFound(err) {
+		return nil
+	}
+	return errors.Wrapf(err, "error deleting %s %s", a.kind, a.name)
+}
+
+// deleteBackupRestoreArtifacts deletes the disks and Filestore instances
+// left behind by failed restores of a backup. Restores don't run any plugin
+// when they fail or are deleted, so this runs when their backup is deleted.
+// It returns the names of the deleted artifacts.
+func (b *VolumeSnapshotter) deleteBackupRestoreArtifacts(backupName string) ([]string, error) {
+	artifacts, err := b.listRestoreArtifacts(backupName)
+	if err != nil || len(artifacts) == 0 {
+		return nil, err
+	}
+	pvs, err := b.cluster.persistentVolumes()
+	if err != nil {
+		return nil, err
+	}
+
+	var deleted []string
+	for _, a := range orphanedRestoreArtifacts(artifacts, pvs, restoreArtifactMinAge, time.Now()) {
+		if err := b.deleteRestoreArtifact(a); err != nil {
+			return deleted, err
+		}
+		deleted = append(deleted, a.name)
+	}
+	return deleted, nil
+}
+
+func writeRestoreArtifacts(w io.Writer, artifacts []restoreArtifact) {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "KIND\tNAME\tRESTORED FROM\tIN USE\tCREATED")
+	for _, a := range artifacts {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%t\t%s\n", a.kind, a.name, a.backup, a.inUse, a.created.Format(time.RFC3339))
+	}
+	tw.Flush()
+}
+
+// runGCRestoreArtifacts prints, and with --delete deletes, the disks and
+// Filestore instances created by restores that no persistent volume uses,
+// e.g. because the restore failed or its volumes were deleted with
+// reclaim policy Retain.
+func runGCRestoreArtifacts(args []string, out io.Writer) int {
+	flags := pflag.NewFlagSet(gcRestoreArtifactsCommand, pflag.ContinueOnError)
+	flags.SetOutput(out)
+	var (
+		location snapshotCommandFlags
+		backup   string
+		minAge   time.Duration
+		remove   bool
+	)
+	location.bind(flags)
+	flags.StringVar(&backup, "backup", "", "only consider volumes restored from this backup")
+	flags.DurationVar(&minAge, "min-age", defaultOrphanMinAge, "only consider volumes older than this")
+	flags.BoolVar(&remove, "delete", false, "delete the unused volumes instead of only listing them")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	b, err := location.volumeSnapshotter()
+	if err != nil {
+		fmt.Fprintln(out, err)
+		return 1
+	}
+	artifacts, err := b.listRestoreArtifacts(backup)
+	if err != nil {
+		fmt.Fprintln(out, err)
+		return 1
+	}
+	pvs, err := b.cluster.persistentVolumes()
+	if err != nil {
+		fmt.Fprintln(out, err)
+		return 1
+	}
+
+	orphans := orphanedRestoreArtifacts(artifacts, pvs, minAge, time.Now())
+	writeRestoreArtifacts(out, orphans)
+	if !remove {
+		return 0
+	}
+
+	code := 0
+	for _, a := range orphans {
+		if err := b.deleteRestoreArtifact(a); err != nil {
+			fmt.Fprintln(out, err)
+			code = 1
+			continue
+		}
+		fmt.Fprintf(out, "deleted %s %s\n", a.kind, a.name)
+	}
+	return code
+}
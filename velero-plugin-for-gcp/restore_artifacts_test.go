@@ -0,0 +1,136 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	velerotest "github.com/vmware-tanzu/velero/pkg/test"
+	"google.golang.org/api/compute/v1"
+	file "google.golang.org/api/file/v1"
+	v1 "k8s.io/api/core/v1"
+)
+
+func TestListRestoreArtifacts(t *testing.T) {
+	gce := newFakeComputeService(t, func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "/projects/volume-project/aggregated/disks", r.URL.Path)
+		assert.Equal(t, `labels.velero-restored-from="nightly"`, r.URL.Query().Get("filter"))
+		json.NewEncoder(w).Encode(&compute.DiskAggregatedList{Items: map[string]compute.DisksScopedList{
+			"zones/us-central1-a": {Disks: []*compute.Disk{{
+				Name:              "restore-1",
+				Labels:            map[string]string{restoredFromLabel: "nightly"},
+				Users:             []string{"instances/node-1"},
+				CreationTimestamp: "2021-10-01T10:00:00-07:00",
+			}}},
+			"regions/us-central1": {Disks: []*compute.Disk{{
+				Name:              "restore-2",
+				Labels:            map[string]string{restoredFromLabel: "nightly"},
+				CreationTimestamp: "2021-10-01T10:00:00-07:00",
+			}}},
+		}})
+	})
+	svc := newFakeFilestoreService(t, func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "/v1/projects/volume-project/locations/-/instances", r.URL.Path)
+		assert.Equal(t, `labels.velero-restored-from="nightly"`, r.URL.Query().Get("filter"))
+		json.NewEncoder(w).Encode(&file.ListInstancesResponse{Instances: []*file.Instance{{
+			Name:       "projects/volume-project/locations/us-central1-c/instances/restore-3",
+			Labels:     map[string]string{restoredFromLabel: "nightly"},
+			CreateTime: "2021-10-01T17:00:00Z",
+		}}})
+	})
+
+	b := (&VolumeSnapshotter{log: velerotest.NewLogger(), filestore: svc, volumeProject: "volume-project"}).withClients(&snapshotterClients{gce: gce})
+	artifacts, err := b.listRestoreArtifacts("nightly")
+	require.NoError(t, err)
+	sort.Slice(artifacts, func(i, j int) bool { return artifacts[i].name < artifacts[j].name })
+
+	created := time.Date(2021, 10, 1, 17, 0, 0, 0, time.UTC)
+	require.Len(t, artifacts, 3)
+	for i := range artifacts {
+		assert.True(t, created.Equal(artifacts[i].created))
+		artifacts[i].created = created
+	}
+	assert.Equal(t, []restoreArtifact{
+		{kind: restoredInstanceKind, name: "projects/volume-project/locations/us-central1-c/instances/restore-3", volumeID: "restore-3", backup: "nightly", created: created},
+		{kind: restoredDiskKind, name: "projects/volume-project/regions/us-central1/disks/restore-2", volumeID: "restore-2", backup: "nightly", created: created},
+		{kind: restoredDiskKind, name: "projects/volume-project/zones/us-central1-a/disks/restore-1", volumeID: "restore-1", backup: "nightly", inUse: true, created: created},
+	}, artifacts)
+}
+
+func TestOrphanedRestoreArtifacts(t *testing.T) {
+	now := time.Date(2021, 10, 2, 0, 0, 0, 0, time.UTC)
+	old, recent := now.Add(-2*time.Hour), now.Add(-time.Minute)
+	artifacts := []restoreArtifact{
+		{name: "in-use", volumeID: "in-use", inUse: true, created: old},
+		{name: "in-tree", volumeID: "in-tree", created: old},
+		{name: "csi", volumeID: "csi", created: old},
+		{name: "filestore", volumeID: "filestore", created: old},
+		{name: "recent", volumeID: "recent", created: recent},
+		{name: "orphan", volumeID: "orphan", created: old},
+	}
+	pvs := []v1.PersistentVolume{
+		{Spec: v1.PersistentVolumeSpec{PersistentVolumeSource: v1.PersistentVolumeSource{GCEPersistentDisk: &v1.GCEPersistentDiskVolumeSource{PDName: "in-tree"}}}},
+		{Spec: v1.PersistentVolumeSpec{PersistentVolumeSource: v1.PersistentVolumeSource{CSI: &v1.CSIPersistentVolumeSource{VolumeHandle: "projects/p/zones/us-central1-a/disks/csi"}}}},
+		{Spec: v1.PersistentVolumeSpec{PersistentVolumeSource: v1.PersistentVolumeSource{CSI: &v1.CSIPersistentVolumeSource{VolumeHandle: "modeInstance/us-central1-c/filestore/vol1"}}}},
+	}
+
+	orphans := orphanedRestoreArtifacts(artifacts, pvs, time.Hour, now)
+	require.Len(t, orphans, 1)
+	assert.Equal(t, "orphan", orphans[0].name)
+}
+
+func TestDeleteRestoreArtifact(t *testing.T) {
+	var deleted []string
+	gce := newFakeComputeService(t, func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, http.MethodDelete, r.Method)
+		if r.URL.Path == "/projects/p/zones/us-central1-a/disks/gone" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		deleted = append(deleted, r.URL.Path)
+		json.NewEncoder(w).Encode(&compute.Operation{})
+	})
+	svc := newFakeFilestoreService(t, func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, http.MethodDelete, r.Method)
+		deleted = append(deleted, r.URL.Path)
+		json.NewEncoder(w).Encode(&file.Operation{})
+	})
+	b := (&VolumeSnapshotter{log: velerotest.NewLogger(), filestore: svc}).withClients(&snapshotterClients{gce: gce})
+
+	require.NoError(t, b.deleteRestoreArtifact(restoreArtifact{kind: restoredDiskKind, name: "projects/p/zones/us-central1-a/disks/restore-1"}))
+	require.NoError(t, b.deleteRestoreArtifact(restoreArtifact{kind: restoredDiskKind, name: "projects/p/regions/us-central1/disks/restore-2"}))
+	require.NoError(t, b.deleteRestoreArtifact(restoreArtifact{kind: restoredDiskKind, name: "projects/p/zones/us-central1-a/disks/gone"}))
+	require.NoError(t, b.deleteRestoreArtifact(restoreArtifact{kind: restoredInstanceKind, name: "projects/p/locations/us-central1-c/instances/restore-3"}))
+	assert.Equal(t, []string{
+		"/projects/p/zones/us-central1-a/disks/restore-1",
+		"/projects/p/regions/us-central1/disks/restore-2",
+		"/v1/projects/p/locations/us-central1-c/instances/restore-3",
+	}, deleted)
+}
+
+func TestRestoreArtifactLabels(t *testing.T) {
+	assert.Equal(t, map[string]string{restoredFromLabel: "nightly"}, restoreArtifactLabels(map[string]string{backupLabel: "nightly", pvLabel: "pv-1"}))
+	// volumes restored from snapshots taken before they were labeled are
+	// still recognizable
+	assert.Equal(t, map[string]string{restoredFromLabel: ""}, restoreArtifactLabels(nil))
+}
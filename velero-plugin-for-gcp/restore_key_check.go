@@ -0,0 +1,250 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+	"google.golang.org/api/cloudkms/v1"
+	"google.golang.org/api/compute/v1"
+)
+
+// kmsKeyUseRoles are the roles that let the Compute Engine service agent
+// decrypt the snapshots it restores disks from.
+var kmsKeyUseRoles = map[string]bool{
+	"roles/cloudkms.cryptoKeyEncrypterDecrypter": true,
+	"roles/cloudkms.cryptoKeyDecrypter":          true,
+}
+
+// restoreKeyChecks records the result of verifying the Cloud KMS keys of
+// the snapshots of each backup restored, so a restore fails on its first
+// volume, with a report of every key that can't be used, instead of on
+// whichever volume uses one of them after others were restored. Only
+// definite results are recorded: backups with keys that couldn't be read
+// are verified again for their next volume. Velero runs a new plugin
+// process for each restore, so keys fixed after a failed restore are
+// verified again by the next one.
+type restoreKeyChecks struct {
+	lock    sync.Mutex
+	results map[string]error
+}
+
+// snapshotKMSKey returns the Cloud KMS key, or key version, a snapshot is
+// encrypted with: the one set on the snapshot, or the one that encrypted
+// its disk, recorded in its tags at backup time.
+func snapshotKMSKey(snapshot *compute.Snapshot) string {
+	if snapshot.SnapshotEncryptionKey != nil && snapshot.SnapshotEncryptionKey.KmsKeyName != "" {
+		return snapshot.SnapshotEncryptionKey.KmsKeyName
+	}
+	var tags map[string]string
+	if snapshot.Description != "" && json.Unmarshal([]byte(snapshot.Description), &tags) == nil {
+		return tags[kmsKeyVersionTag]
+	}
+	return ""
+}
+
+// snapshotBackup returns the backup a snapshot was taken for, from its tags.
+func snapshotBackup(snapshot *compute.Snapshot) string {
+	return snapshotTag(snapshot, backupNameTag)
+}
+
+// snapshotTag returns a tag recorded in a snapshot's description.
+func snapshotTag(snapshot *compute.Snapshot, tag string) string {
+	var tags map[string]string
+	if err := json.Unmarshal([]byte(snapshot.Description), &tags); err != nil {
+		return ""
+	}
+	return tags[tag]
+}
+
+// kmsClient returns the Cloud KMS client, creating it when first needed.
+func (b *VolumeSnapshotter) kmsClient() (*cloudkms.Service, error) {
+	b.lazyClientsLock.Lock()
+	defer b.lazyClientsLock.Unlock()
+	if b.kms == nil {
+		kms, err := newKMSService(context.TODO(), b.clients().credentials)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		b.kms = kms
+	}
+	return b.kms, nil
+}
+
+// verifyRestoreKMSKeys verifies, before a volume is restored from a
+// snapshot, that every Cloud KMS key the snapshots of its backup are
+// encrypted with can be used. Snapshots whose backup isn't recorded, or
+// whose backup's snapshots can't be listed, only have their own key
+// verified.
+func (b *VolumeSnapshotter) verifyRestoreKMSKeys(snapshot *compute.Snapshot) error {
+	backup := snapshotBackup(snapshot)
+	if backup == "" {
+		return b.verifySnapshotKMSKey(snapshot)
+	}
+
+	b.keyChecks.lock.Lock()
+	defer b.keyChecks.lock.Unlock()
+	if err, ok := b.keyChecks.results[backup]; ok {
+		return err
+	}
+
+	snapshots, err := b.backupSnapshots(backup)
+	if err != nil {
+		// the other snapshots' keys are verified as they're restored
+		b.log.WithError(err).WithField("backup", backup).Warn("Unable to list the backup's snapshots to verify their Cloud KMS keys before restoring its volumes")
+		return b.verifySnapshotKMSKey(snapshot)
+	}
+	verified, err := b.verifyBackupKMSKeys(backup, append(snapshots, snapshot))
+	if !verified {
+		return err
+	}
+	if b.keyChecks.results == nil {
+		b.keyChecks.results = make(map[string]error)
+	}
+	b.keyChecks.results[backup] = err
+	return err
+}
+
+// backupSnapshots returns the snapshots labeled with a backup's name.
+func (b *VolumeSnapshotter) backupSnapshots(backup string) ([]*compute.Snapshot, error) {
+	var snapshots []*compute.Snapshot
+	filter := fmt.Sprintf("labels.%s=%q", backupLabel, sanitizeLabelValue(backup))
+	err := b.clients().gce.Snapshots.List(b.snapshotProject).Filter(filter).Pages(context.TODO(), func(page *compute.SnapshotList) error {
+		for _, item := range page.Items {
+			// labels are sanitized, so make sure the snapshot really
+			// belongs to this backup
+			if snapshotBackup(item) == backup {
+				snapshots = append(snapshots, item)
+			}
+		}
+		return nil
+	})
+	return snapshots, errors.Wrapf(err, "error listing snapshots of backup %s", backup)
+}
+
+// verifyBackupKMSKeys verifies the Cloud KMS keys of the snapshots of a
+// backup, and returns an error reporting each key version that is disabled
+// or destroyed and the snapshots encrypted with it. Keys that can't be read
+// are logged as warnings, since the Compute Engine service agent may still
+// be able to use them, and verified is false if there were any.
+func (b *VolumeSnapshotter) verifyBackupKMSKeys(backup string, snapshots []*compute.Snapshot) (verified bool, err error) {
+	keys := make(map[string][]string)
+	seen := make(map[string]bool)
+	for _, s := range snapshots {
+		if seen[s.Name] {
+			continue
+		}
+		seen[s.Name] = true
+		if key := snapshotKMSKey(s); key != "" {
+			keys[key] = append(keys[key], s.Name)
+		}
+	}
+	if len(keys) == 0 {
+		return true, nil
+	}
+	names := make([]string, 0, len(keys))
+	for key := range keys {
+		names = append(names, key)
+	}
+	sort.Strings(names)
+
+	log := b.log.WithField("backup", backup)
+	kms, err := b.kmsClient()
+	if err != nil {
+		log.WithError(err).Warn("Unable to verify the Cloud KMS keys of the backup's snapshots before restoring its volumes")
+		return false, nil
+	}
+	agent := b.computeServiceAgent()
+	var problems []string
+	unread := 0
+	for _, key := range names {
+		if err := verifyKMSKey(kms, key); err != nil {
+			if !isKMSKeyUnusable(err) {
+				log.WithError(err).Warnf("Unable to verify Cloud KMS key %s of snapshots %s", key, strings.Join(keys[key], ", "))
+				unread++
+				continue
+			}
+			problems = append(problems, fmt.Sprintf("%s (snapshots %s)", err.Error(), strings.Join(keys[key], ", ")))
+			continue
+		}
+		if agent != "" {
+			b.checkServiceAgentKeyAccess(kms, agent, key)
+		}
+	}
+	if len(problems) > 0 {
+		return true, errors.Errorf("%d of the %d Cloud KMS keys of backup %s can't be used, so none of its volumes are restored: %s", len(problems), len(names), backup, strings.Join(problems, "; "))
+	}
+	if unread > 0 {
+		return false, nil
+	}
+	log.Infof("Verified the %d Cloud KMS keys of the backup's snapshots", len(names))
+	return true, nil
+}
+
+// computeServiceAgent returns the Compute Engine service agent of the
+// volume project, which decrypts snapshots into disks, as an IAM member, or
+// an empty string if the project can't be read.
+func (b *VolumeSnapshotter) computeServiceAgent() string {
+	project, err := b.clients().gce.Projects.Get(b.volumeProject).Do()
+	if err != nil {
+		b.log.WithError(err).Debug("Unable to read the volume project to check its Compute Engine service agent's access to Cloud KMS keys")
+		return ""
+	}
+	return fmt.Sprintf("serviceAccount:service-%d@compute-system.iam.gserviceaccount.com", project.Id)
+}
+
+// checkServiceAgentKeyAccess warns if neither a key's IAM policy nor its
+// key ring's lets the Compute Engine service agent use the key. The role
+// may also be granted on the project or above, which the plugin can't
+// tell, so this isn't an error. Policies the plugin can't read aren't
+// checked.
+func (b *VolumeSnapshotter) checkServiceAgentKeyAccess(kms *cloudkms.Service, agent, key string) {
+	if i := strings.Index(key, cryptoKeyVersionsSegment); i >= 0 {
+		key = key[:i]
+	}
+	policy, err := kms.Projects.Locations.KeyRings.CryptoKeys.GetIamPolicy(key).Do()
+	if err != nil || grantsKeyUse(policy, agent) {
+		return
+	}
+	policy, err = kms.Projects.Locations.KeyRings.GetIamPolicy(key[:strings.LastIndex(key, "/cryptoKeys/")]).Do()
+	if err != nil || grantsKeyUse(policy, agent) {
+		return
+	}
+	b.log.WithField("key", key).Warnf("Neither Cloud KMS key %s nor its key ring grants the Compute Engine service agent %s roles/cloudkms.cryptoKeyEncrypterDecrypter; unless it's granted on the project, restoring volumes from snapshots encrypted with it will fail", key, strings.TrimPrefix(agent, "serviceAccount:"))
+}
+
+// grantsKeyUse reports whether a policy grants a member a role that can
+// decrypt with a key.
+func grantsKeyUse(policy *cloudkms.Policy, member string) bool {
+	for _, binding := range policy.Bindings {
+		if !kmsKeyUseRoles[binding.Role] {
+			continue
+		}
+		for _, m := range binding.Members {
+			if m == member {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,128 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	velerotest "github.com/vmware-tanzu/velero/pkg/test"
+	"google.golang.org/api/cloudkms/v1"
+	"google.golang.org/api/compute/v1"
+)
+
+func TestSnapshotKMSKey(t *testing.T) {
+	assert.Equal(t, "", snapshotKMSKey(&compute.Snapshot{}))
+	assert.Equal(t, testKeyName, snapshotKMSKey(&compute.Snapshot{SnapshotEncryptionKey: &compute.CustomerEncryptionKey{KmsKeyName: testKeyName}}))
+	assert.Equal(t, testKeyName+"/cryptoKeyVersions/2", snapshotKMSKey(&compute.Snapshot{Description: `{"velero.io/kms-key-version":"` + testKeyName + `/cryptoKeyVersions/2"}`}))
+	assert.Equal(t, "", snapshotKMSKey(&compute.Snapshot{Description: "not json"}))
+}
+
+func TestVerifyRestoreKMSKeys(t *testing.T) {
+	description := func(backup, key string) string {
+		data, _ := json.Marshal(map[string]string{backupNameTag: backup, kmsKeyVersionTag: key})
+		return string(data)
+	}
+	enabled := testKeyName + "/cryptoKeyVersions/1"
+	disabled := "projects/p/locations/l/keyRings/r/cryptoKeys/old/cryptoKeyVersions/1"
+	denied := "projects/p/locations/l/keyRings/r/cryptoKeys/denied/cryptoKeyVersions/1"
+	snapshots := []*compute.Snapshot{
+		{Name: "snap-a", Description: description("nightly", enabled)},
+		{Name: "snap-b", Description: description("nightly", disabled)},
+		{Name: "snap-c", Description: description("nightly", disabled)},
+		{Name: "snap-other", Description: description("nightly-2", disabled)},
+		{Name: "snap-plain", Description: description("nightly", "")},
+		{Name: "snap-denied", Description: description("nightly", denied)},
+	}
+	weekly := []*compute.Snapshot{
+		{Name: "snap-w1", Description: description("weekly", enabled)},
+		{Name: "snap-w2", Description: description("weekly", denied)},
+	}
+
+	gce := newFakeComputeService(t, func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/global/snapshots"):
+			switch r.URL.Query().Get("filter") {
+			case `labels.velero-backup="nightly"`:
+				json.NewEncoder(w).Encode(&compute.SnapshotList{Items: snapshots})
+			case `labels.velero-backup="weekly"`:
+				json.NewEncoder(w).Encode(&compute.SnapshotList{Items: weekly})
+			default:
+				t.Errorf("unexpected filter %s", r.URL.Query().Get("filter"))
+			}
+		case strings.HasSuffix(r.URL.Path, "/projects/volume-project"):
+			json.NewEncoder(w).Encode(&compute.Project{Id: 123})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	})
+	var kmsRequests []string
+	kms := newFakeKMSService(t, func(w http.ResponseWriter, r *http.Request) {
+		kmsRequests = append(kmsRequests, r.URL.Path)
+		switch {
+		case strings.HasSuffix(r.URL.Path, ":getIamPolicy"):
+			json.NewEncoder(w).Encode(&cloudkms.Policy{Bindings: []*cloudkms.Binding{{
+				Role:    "roles/cloudkms.cryptoKeyEncrypterDecrypter",
+				Members: []string{"serviceAccount:service-123@compute-system.iam.gserviceaccount.com"},
+			}}})
+		case strings.HasSuffix(r.URL.Path, enabled):
+			json.NewEncoder(w).Encode(&cloudkms.CryptoKeyVersion{Name: enabled, State: "ENABLED"})
+		case strings.HasSuffix(r.URL.Path, denied):
+			w.WriteHeader(http.StatusForbidden)
+		default:
+			json.NewEncoder(w).Encode(&cloudkms.CryptoKeyVersion{Name: disabled, State: "DISABLED"})
+		}
+	})
+	b := (&VolumeSnapshotter{log: velerotest.NewLogger(), kms: kms, volumeProject: "volume-project", snapshotProject: "snapshot-project"}).withClients(&snapshotterClients{gce: gce})
+
+	// restoring the volume of a usable key fails on the other keys of the
+	// backup, before any disk is created
+	err := b.verifyRestoreKMSKeys(snapshots[0])
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "1 of the 3 Cloud KMS keys of backup nightly can't be used")
+	assert.Contains(t, err.Error(), disabled+" is disabled")
+	assert.Contains(t, err.Error(), "(snapshots snap-b, snap-c)")
+	assert.NotContains(t, err.Error(), "snap-other")
+	// keys the plugin can't read are only logged
+	assert.NotContains(t, err.Error(), "snap-denied")
+
+	// the backup's keys are only verified once
+	requests := len(kmsRequests)
+	assert.Equal(t, err, b.verifyRestoreKMSKeys(snapshots[4]))
+	assert.Len(t, kmsRequests, requests)
+
+	// backups with keys that can't be read are restored, and verified again
+	// for their next volume
+	assert.NoError(t, b.verifyRestoreKMSKeys(weekly[0]))
+	requests = len(kmsRequests)
+	assert.NoError(t, b.verifyRestoreKMSKeys(weekly[1]))
+	assert.Greater(t, len(kmsRequests), requests)
+
+	// snapshots without a recorded backup only have their own key verified
+	assert.NoError(t, b.verifyRestoreKMSKeys(&compute.Snapshot{Name: "snap-d", SnapshotEncryptionKey: &compute.CustomerEncryptionKey{KmsKeyName: enabled}}))
+}
+
+func TestGrantsKeyUse(t *testing.T) {
+	agent := "serviceAccount:service-123@compute-system.iam.gserviceaccount.com"
+	assert.False(t, grantsKeyUse(&cloudkms.Policy{}, agent))
+	assert.False(t, grantsKeyUse(&cloudkms.Policy{Bindings: []*cloudkms.Binding{{Role: "roles/cloudkms.viewer", Members: []string{agent}}}}, agent))
+	assert.True(t, grantsKeyUse(&cloudkms.Policy{Bindings: []*cloudkms.Binding{{Role: "roles/cloudkms.cryptoKeyDecrypter", Members: []string{"user:a@example.com", agent}}}}, agent))
+}
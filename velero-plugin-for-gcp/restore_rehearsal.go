@@ -0,0 +1,538 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/gofrs/uuid"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/pflag"
+	api "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	"google.golang.org/api/compute/v1"
+)
+
+const (
+	rehearseRestoreCommand = "rehearse-restore"
+
+	// rehearsalLabel labels the disks and check VM of a restore rehearsal
+	// with the sanitized name of its backup, so they can be torn down even
+	// if the rehearsal was interrupted.
+	rehearsalLabel = "velero-rehearsal"
+
+	// rehearsalMarker prefixes the lines the check VM writes to its serial
+	// port with the result of mounting each disk.
+	rehearsalMarker = "velero-rehearsal:"
+
+	defaultRehearsalDiskType    = "pd-standard"
+	defaultCheckVMImage         = "projects/debian-cloud/global/images/family/debian-12"
+	defaultCheckVMMachineType   = "e2-small"
+	defaultRehearsalTimeout     = 30 * time.Minute
+	rehearsalMounted            = "mounted"
+	rehearsalCheckVMDeviceLimit = 127
+)
+
+// rehearsalPollInterval is how often the progress of a rehearsal's disks
+// and check VM is read. It is a variable so tests can shorten it.
+var rehearsalPollInterval = 10 * time.Second
+
+// checkVMScript is the startup script of the check VM, which mounts each
+// disk, as named in its arguments, read-only, and writes the result to the
+// serial port.
+const checkVMScript = `#!/bin/bash
+for disk in %s; do
+  dev=/dev/disk/by-id/google-$disk
+  dir=/mnt/$disk
+  mkdir -p $dir
+  if mount -o ro,noload $dev $dir 2>/dev/null || mount -o ro,norecovery $dev $dir 2>/dev/null || mount -o ro $dev $dir 2>/dev/null; then
+    echo "velero-rehearsal: $disk mounted $(df -h --output=used $dir | tail -1 | tr -d ' ') used" > /dev/ttyS0
+    umount $dir
+  else
+    echo "velero-rehearsal: $disk failed $(blkid -o value -s TYPE $dev || echo no filesystem found)" > /dev/ttyS0
+  fi
+done
+echo "velero-rehearsal: done" > /dev/ttyS0
+`
+
+// restoreRehearsal restores the snapshots of a backup to disks in a sandbox
+// project and zone, away from the cluster's volumes, optionally mounts them
+// in a check VM, and tears everything down.
+type restoreRehearsal struct {
+	log         logrus.FieldLogger
+	sandbox     *VolumeSnapshotter
+	project     string
+	zone        string
+	diskType    string
+	checkVM     bool
+	image       string
+	machineType string
+	network     string
+	timeout     time.Duration
+}
+
+// rehearsedVolume is the result of restoring one snapshot of a backup.
+type rehearsedVolume struct {
+	volume   string
+	snapshot string
+	disk     *compute.Disk
+	ready    time.Duration
+	mount    string
+	problems []string
+}
+
+// rehearse restores the snapshots of backup and returns the result for
+// each, tearing down the disks and check VM of the rehearsal, and any left
+// by an interrupted one, whether it succeeds or not.
+func (r *restoreRehearsal) rehearse(backup string, snapshots []*compute.Snapshot) ([]*rehearsedVolume, error) {
+	label := sanitizeLabelValue(backup)
+	if err := r.teardown(label); err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := r.teardown(label); err != nil {
+			r.log.WithError(err).Warnf("Unable to tear down the rehearsal of backup %s; delete the disks and instances labeled %s=%s in project %s", backup, rehearsalLabel, label, r.project)
+		}
+	}()
+
+	var volumes []*rehearsedVolume
+	for _, s := range snapshots {
+		v := &rehearsedVolume{volume: snapshotTag(s, pvNameTag), snapshot: s.Name}
+		volumes = append(volumes, v)
+		if s.Status != "READY" {
+			v.problems = append(v.problems, fmt.Sprintf("snapshot is %s", s.Status))
+			continue
+		}
+		disk, err := r.createDisk(s, label)
+		if err != nil {
+			v.problems = append(v.problems, err.Error())
+			continue
+		}
+		v.disk = disk
+	}
+	r.waitForDisks(volumes)
+
+	if r.checkVM {
+		if err := r.mountDisks(label, volumes); err != nil {
+			return volumes, err
+		}
+	}
+	return volumes, nil
+}
+
+// rehearsalName returns a unique name for a disk or VM of a rehearsal.
+func rehearsalName() (string, error) {
+	uid, err := uuid.NewV4()
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	return "rehearsal-" + uid.String(), nil
+}
+
+// createDisk restores a snapshot to a disk in the sandbox, encrypted with
+// the snapshot's Cloud KMS key, if any.
+func (r *restoreRehearsal) createDisk(snapshot *compute.Snapshot, label string) (*compute.Disk, error) {
+	name, err := rehearsalName()
+	if err != nil {
+		return nil, err
+	}
+	labels := map[string]string{rehearsalLabel: label}
+	if pv := snapshot.Labels[pvLabel]; pv != "" {
+		labels[pvLabel] = pv
+	}
+	disk := &compute.Disk{
+		Name:           name,
+		SourceSnapshot: snapshot.SelfLink,
+		Type:           fmt.Sprintf("projects/%s/zones/%s/diskTypes/%s", r.project, r.zone, r.diskType),
+		Description:    snapshot.Description,
+		Labels:         labels,
+	}
+	if snapshot.SnapshotEncryptionKey != nil && snapshot.SnapshotEncryptionKey.KmsKeyName != "" {
+		disk.DiskEncryptionKey = &compute.CustomerEncryptionKey{KmsKeyName: kmsCryptoKey(snapshot.SnapshotEncryptionKey.KmsKeyName)}
+	}
+	if _, err := r.sandbox.clients().gce.Disks.Insert(r.project, r.zone, disk).Do(); err != nil {
+		return nil, errors.Wrapf(err, "error restoring snapshot %s to a disk", snapshot.Name)
+	}
+	return disk, nil
+}
+
+// waitForDisks waits until the disks of the volumes are ready, recording
+// how long each took, or failed, for at most the rehearsal's timeout.
+func (r *restoreRehearsal) waitForDisks(volumes []*rehearsedVolume) {
+	start := time.Now()
+	pending := make(map[*rehearsedVolume]bool)
+	for _, v := range volumes {
+		if v.disk != nil {
+			pending[v] = true
+		}
+	}
+	for len(pending) > 0 {
+		for v := range pending {
+			d, err := r.sandbox.clients().gce.Disks.Get(r.project, r.zone, v.disk.Name).Do()
+			switch {
+			case err != nil:
+				v.problems = append(v.problems, errors.Wrapf(err, "error getting disk %s", v.disk.Name).Error())
+			case d.Status == "FAILED":
+				v.problems = append(v.problems, fmt.Sprintf("disk %s failed", d.Name))
+			case d.Status == "READY":
+				v.disk, v.ready = d, time.Since(start)
+			default:
+				continue
+			}
+			delete(pending, v)
+		}
+		if len(pending) == 0 {
+			return
+		}
+		if time.Since(start) > r.timeout {
+			for v := range pending {
+				v.problems = append(v.problems, fmt.Sprintf("disk %s wasn't ready after %s", v.disk.Name, r.timeout))
+			}
+			return
+		}
+		time.Sleep(rehearsalPollInterval)
+	}
+}
+
+// mountDisks creates the check VM with the ready disks attached read-only,
+// and records whether each could be mounted, from the VM's serial port.
+func (r *restoreRehearsal) mountDisks(label string, volumes []*rehearsedVolume) error {
+	byDisk := make(map[string]*rehearsedVolume)
+	var names []string
+	for _, v := range volumes {
+		if v.disk != nil && v.ready > 0 {
+			byDisk[v.disk.Name] = v
+			names = append(names, v.disk.Name)
+		}
+	}
+	if len(names) == 0 {
+		return nil
+	}
+	if len(names) > rehearsalCheckVMDeviceLimit {
+		return errors.Errorf("the check VM can't attach %d disks, at most %d", len(names), rehearsalCheckVMDeviceLimit)
+	}
+
+	name, err := rehearsalName()
+	if err != nil {
+		return err
+	}
+	script := fmt.Sprintf(checkVMScript, strings.Join(names, " "))
+	instance := &compute.Instance{
+		Name:        name,
+		MachineType: fmt.Sprintf("zones/%s/machineTypes/%s", r.zone, r.machineType),
+		Labels:      map[string]string{rehearsalLabel: label},
+		Disks: []*compute.AttachedDisk{{
+			Boot:             true,
+			AutoDelete:       true,
+			InitializeParams: &compute.AttachedDiskInitializeParams{SourceImage: r.image},
+		}},
+		NetworkInterfaces: []*compute.NetworkInterface{{Network: r.network}},
+		Metadata:          &compute.Metadata{Items: []*compute.MetadataItems{{Key: "startup-script", Value: &script}}},
+	}
+	for _, n := range names {
+		instance.Disks = append(instance.Disks, &compute.AttachedDisk{Source: byDisk[n].disk.SelfLink, DeviceName: n, Mode: "READ_ONLY"})
+	}
+	if _, err := r.sandbox.clients().gce.Instances.Insert(r.project, r.zone, instance).Do(); err != nil {
+		return errors.Wrap(err, "error creating the check VM")
+	}
+	r.log.Infof("Created check VM %s to mount %d disks", name, len(names))
+
+	var (
+		start  = time.Now()
+		next   int64
+		output string
+	)
+	for {
+		out, err := r.sandbox.clients().gce.Instances.GetSerialPortOutput(r.project, r.zone, name).Port(1).Start(next).Do()
+		// the serial port can't be read until the VM is running
+		if err != nil {
+			r.log.WithError(err).Debugf("Unable to read the serial port of check VM %s", name)
+		} else {
+			output, next = output+out.Contents, out.Next
+		}
+		if done := parseCheckVMOutput(output, byDisk); done {
+			break
+		}
+		if time.Since(start) > r.timeout {
+			for _, v := range byDisk {
+				if v.mount == "" {
+					v.problems = append(v.problems, fmt.Sprintf("check VM %s didn't mount the disk within %s", name, r.timeout))
+				}
+			}
+			break
+		}
+		time.Sleep(rehearsalPollInterval)
+	}
+	return nil
+}
+
+// parseCheckVMOutput records the results of the check VM in its serial port
+// output, and returns whether it checked every disk.
+func parseCheckVMOutput(output string, byDisk map[string]*rehearsedVolume) bool {
+	done := false
+	scanner := bufio.NewScanner(strings.NewReader(output))
+	for scanner.Scan() {
+		line := scanner.Text()
+		i := strings.Index(line, rehearsalMarker)
+		if i < 0 {
+			continue
+		}
+		fields := strings.SplitN(strings.TrimSpace(line[i+len(rehearsalMarker):]), " ", 3)
+		if fields[0] == "done" {
+			done = true
+			continue
+		}
+		v, ok := byDisk[fields[0]]
+		if !ok || len(fields) < 2 || v.mount != "" {
+			continue
+		}
+		v.mount = fields[1]
+		detail := ""
+		if len(fields) == 3 {
+			detail = fields[2]
+		}
+		if v.mount == rehearsalMounted {
+			v.mount += " (" + detail + ")"
+		} else {
+			v.problems = append(v.problems, "unable to mount the disk: "+detail)
+		}
+	}
+	return done
+}
+
+// teardown deletes the check VMs and disks of the rehearsals of a backup,
+// waiting for the VMs to be deleted first since attached disks can't be.
+func (r *restoreRehearsal) teardown(label string) error {
+	gce := r.sandbox.clients().gce
+	filter := fmt.Sprintf("labels.%s=%q", rehearsalLabel, label)
+	var instances []string
+	err := gce.Instances.List(r.project, r.zone).Filter(filter).Pages(context.TODO(), func(page *compute.InstanceList) error {
+		for _, i := range page.Items {
+			instances = append(instances, i.Name)
+		}
+		return nil
+	})
+	if err != nil {
+		return errors.Wrapf(err, "error listing the check VMs in project %s", r.project)
+	}
+	for _, name := range instances {
+		if _, err := gce.Instances.Delete(r.project, r.zone, name).Do(); err != nil && !isNotFound(err) {
+			return errors.Wrapf(err, "error deleting check VM %s", name)
+		}
+		err := waitForRehearsal(r.timeout, "deletion of check VM "+name, func() (bool, error) {
+			_, err := gce.Instances.Get(r.project, r.zone, name).Do()
+			if isNotFound(err) {
+				return true, nil
+			}
+			return false, errors.Wrapf(err, "error getting check VM %s", name)
+		})
+		if err != nil {
+			return err
+		}
+		r.log.Infof("Deleted check VM %s", name)
+	}
+
+	var disks []string
+	err = gce.Disks.List(r.project, r.zone).Filter(filter).Pages(context.TODO(), func(page *compute.DiskList) error {
+		for _, d := range page.Items {
+			disks = append(disks, d.Name)
+		}
+		return nil
+	})
+	if err != nil {
+		return errors.Wrapf(err, "error listing the rehearsal disks in project %s", r.project)
+	}
+	for _, name := range disks {
+		if _, err := gce.Disks.Delete(r.project, r.zone, name).Do(); err != nil && !isNotFound(err) {
+			return errors.Wrapf(err, "error deleting disk %s", name)
+		}
+	}
+	if len(disks) > 0 {
+		r.log.Infof("Deleted %d rehearsal disks", len(disks))
+	}
+	return nil
+}
+
+// waitForRehearsal polls until done reports true, for at most timeout.
+func waitForRehearsal(timeout time.Duration, what string, done func() (bool, error)) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		ok, err := done()
+		if err != nil || ok {
+			return err
+		}
+		if time.Now().After(deadline) {
+			return errors.Errorf("timed out waiting for %s", what)
+		}
+		time.Sleep(rehearsalPollInterval)
+	}
+}
+
+// rehearsalSnapshots returns the snapshots of a backup in the projects of
+// the GCP volume snapshot locations, or only the named one, and the volume
+// snapshotter of the first location, whose credentials the rehearsal uses.
+func rehearsalSnapshots(log logrus.FieldLogger, cluster veleroCluster, backup, locationName string) (*VolumeSnapshotter, []*compute.Snapshot, error) {
+	locations, err := cluster.volumeSnapshotLocations()
+	if err != nil {
+		return nil, nil, err
+	}
+	sort.Slice(locations, func(i, j int) bool { return locations[i].Name < locations[j].Name })
+
+	var (
+		sandbox   *VolumeSnapshotter
+		snapshots []*compute.Snapshot
+		found     bool
+	)
+	listed := make(map[string]bool)
+	for _, location := range locations {
+		if !isGCPProvider(location.Spec.Provider) || locationName != "" && location.Name != locationName {
+			continue
+		}
+		found = true
+		b := newVolumeSnapshotter(log)
+		if err := b.Init(location.Spec.Config); err != nil {
+			return nil, nil, errors.WithMessagef(err, "VolumeSnapshotLocation %s", location.Name)
+		}
+		if sandbox == nil {
+			sandbox = b
+		}
+		if listed[b.snapshotProject] {
+			continue
+		}
+		listed[b.snapshotProject] = true
+		s, err := b.backupSnapshots(backup)
+		if err != nil {
+			return nil, nil, err
+		}
+		snapshots = append(snapshots, s...)
+	}
+	if !found {
+		if locationName != "" {
+			return nil, nil, errors.Errorf("GCP VolumeSnapshotLocation %s not found in namespace %s", locationName, veleroNamespace())
+		}
+		return nil, nil, errors.Errorf("no GCP VolumeSnapshotLocation found in namespace %s", veleroNamespace())
+	}
+	sort.Slice(snapshots, func(i, j int) bool { return snapshots[i].Name < snapshots[j].Name })
+	return sandbox, snapshots, nil
+}
+
+// rehearseRestore rehearses restoring the volumes of a completed backup,
+// prints the result of each, and returns whether all were restored, and
+// mounted if the rehearsal has a check VM.
+func rehearseRestore(log logrus.FieldLogger, out io.Writer, cluster veleroCluster, r *restoreRehearsal, backupName, locationName string) (bool, error) {
+	backups, err := cluster.backups()
+	if err != nil {
+		return false, err
+	}
+	var backup *api.Backup
+	for i := range backups {
+		if backups[i].Name == backupName {
+			backup = &backups[i]
+		}
+	}
+	if backup == nil {
+		return false, errors.Errorf("backup %s not found", backupName)
+	}
+	if backup.Status.Phase != api.BackupPhaseCompleted && backup.Status.Phase != api.BackupPhasePartiallyFailed {
+		return false, errors.Errorf("backup %s is %s, not completed", backupName, backup.Status.Phase)
+	}
+
+	sandbox, snapshots, err := rehearsalSnapshots(log, cluster, backupName, locationName)
+	if err != nil {
+		return false, err
+	}
+	if len(snapshots) == 0 {
+		return false, errors.Errorf("no snapshots of backup %s found", backupName)
+	}
+	r.sandbox = sandbox
+
+	volumes, err := r.rehearse(backupName, snapshots)
+	if err != nil {
+		return false, err
+	}
+
+	tw := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "VOLUME\tSNAPSHOT\tDISK READY IN\tMOUNT\tPROBLEMS")
+	passed := true
+	for _, v := range volumes {
+		ready := "-"
+		if v.ready > 0 {
+			ready = v.ready.Round(time.Second).String()
+		}
+		mount := v.mount
+		if mount == "" {
+			mount = "-"
+		}
+		if len(v.problems) > 0 {
+			passed = false
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", v.volume, v.snapshot, ready, mount, strings.Join(v.problems, "; "))
+	}
+	tw.Flush()
+	return passed, nil
+}
+
+// runRehearseRestore rehearses restoring a backup's volumes in a sandbox
+// project and zone.
+func runRehearseRestore(args []string, out io.Writer) int {
+	flags := pflag.NewFlagSet(rehearseRestoreCommand, pflag.ContinueOnError)
+	flags.SetOutput(out)
+	r := &restoreRehearsal{}
+	var backup, location string
+	flags.StringVar(&backup, "backup", "", "the backup whose volumes to restore (required)")
+	flags.StringVar(&r.project, "project", "", "the sandbox project to restore the volumes in (required)")
+	flags.StringVar(&r.zone, "zone", "", "the sandbox zone to restore the volumes in (required)")
+	flags.StringVar(&location, "snapshot-location", "", "only restore the snapshots of this VolumeSnapshotLocation, whose credentials are used")
+	flags.StringVar(&r.diskType, "disk-type", defaultRehearsalDiskType, "the type of the restored disks")
+	flags.BoolVar(&r.checkVM, "check-vm", false, "mount the restored disks read-only in a VM to check their filesystems")
+	flags.StringVar(&r.image, "check-vm-image", defaultCheckVMImage, "the boot image of the check VM")
+	flags.StringVar(&r.machineType, "check-vm-machine-type", defaultCheckVMMachineType, "the machine type of the check VM")
+	flags.StringVar(&r.network, "check-vm-network", "default", "the network of the check VM, by name or as a resource path")
+	flags.DurationVar(&r.timeout, "timeout", defaultRehearsalTimeout, "how long to wait for the disks, and for the check VM to mount them")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if backup == "" || r.project == "" || r.zone == "" {
+		fmt.Fprintln(out, "--backup, --project and --zone are required")
+		return 2
+	}
+	if !strings.Contains(r.network, "/") {
+		r.network = path.Join("global/networks", r.network)
+	}
+
+	logger := logrus.New()
+	logger.SetOutput(os.Stderr)
+	r.log = logger
+	passed, err := rehearseRestore(logger, out, inCluster{}, r, backup, location)
+	if err != nil {
+		fmt.Fprintln(out, err)
+		return 1
+	}
+	if !passed {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,198 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	velerotest "github.com/vmware-tanzu/velero/pkg/test"
+	"google.golang.org/api/compute/v1"
+)
+
+// fakeSandboxCompute is a Compute Engine API keeping the disks and instances
+// of zone sandbox/us-central1-a. Instances report the attached disks
+// restored from snapshots of persistent volumes as mounted to their serial
+// port, and others as failed.
+type fakeSandboxCompute struct {
+	lock      sync.Mutex
+	disks     map[string]*compute.Disk
+	instances map[string]*compute.Instance
+	attached  []*compute.AttachedDisk
+}
+
+func (f *fakeSandboxCompute) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	p := strings.TrimPrefix(r.URL.Path, "/projects/sandbox/zones/us-central1-a/")
+	switch {
+	case p == "disks" && r.Method == http.MethodPost:
+		disk := new(compute.Disk)
+		json.NewDecoder(r.Body).Decode(disk)
+		disk.Status, disk.SelfLink = "READY", "projects/sandbox/zones/us-central1-a/disks/"+disk.Name
+		f.disks[disk.Name] = disk
+		json.NewEncoder(w).Encode(&compute.Operation{})
+	case p == "disks":
+		list := &compute.DiskList{}
+		for _, d := range f.disks {
+			if strings.Contains(r.URL.Query().Get("filter"), fmt.Sprintf("%q", d.Labels[rehearsalLabel])) {
+				list.Items = append(list.Items, d)
+			}
+		}
+		json.NewEncoder(w).Encode(list)
+	case strings.HasPrefix(p, "disks/"):
+		disk, ok := f.disks[path.Base(p)]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if r.Method == http.MethodDelete {
+			delete(f.disks, disk.Name)
+		}
+		json.NewEncoder(w).Encode(disk)
+	case p == "instances" && r.Method == http.MethodPost:
+		instance := new(compute.Instance)
+		json.NewDecoder(r.Body).Decode(instance)
+		f.instances[instance.Name] = instance
+		f.attached = append(f.attached, instance.Disks[1:]...)
+		json.NewEncoder(w).Encode(&compute.Operation{})
+	case p == "instances":
+		list := &compute.InstanceList{}
+		for _, i := range f.instances {
+			list.Items = append(list.Items, i)
+		}
+		json.NewEncoder(w).Encode(list)
+	case strings.HasSuffix(p, "/serialPort"):
+		instance := f.instances[strings.Split(p, "/")[1]]
+		var out strings.Builder
+		out.WriteString("Booting\n")
+		for _, d := range instance.Disks[1:] {
+			if f.disks[d.DeviceName].Labels[pvLabel] == "" {
+				fmt.Fprintf(&out, "%s %s failed no filesystem found\n", rehearsalMarker, d.DeviceName)
+			} else {
+				fmt.Fprintf(&out, "%s %s mounted 1.2G used\n", rehearsalMarker, d.DeviceName)
+			}
+		}
+		fmt.Fprintf(&out, "%s done\n", rehearsalMarker)
+		json.NewEncoder(w).Encode(&compute.SerialPortOutput{Contents: out.String(), Next: int64(out.Len())})
+	case strings.HasPrefix(p, "instances/"):
+		instance, ok := f.instances[path.Base(p)]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if r.Method == http.MethodDelete {
+			delete(f.instances, instance.Name)
+		}
+		json.NewEncoder(w).Encode(instance)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func TestRehearseRestore(t *testing.T) {
+	defer func(interval time.Duration) { rehearsalPollInterval = interval }(rehearsalPollInterval)
+	rehearsalPollInterval = 0
+
+	fake := &fakeSandboxCompute{
+		disks: map[string]*compute.Disk{
+			// left by an interrupted rehearsal
+			"rehearsal-old": {Name: "rehearsal-old", Labels: map[string]string{rehearsalLabel: "nightly"}},
+			"live":          {Name: "live"},
+		},
+		instances: make(map[string]*compute.Instance),
+	}
+	r := &restoreRehearsal{
+		log:         velerotest.NewLogger(),
+		sandbox:     (&VolumeSnapshotter{}).withClients(&snapshotterClients{gce: newFakeComputeService(t, fake.ServeHTTP)}),
+		project:     "sandbox",
+		zone:        "us-central1-a",
+		diskType:    defaultRehearsalDiskType,
+		checkVM:     true,
+		image:       defaultCheckVMImage,
+		machineType: defaultCheckVMMachineType,
+		network:     "global/networks/default",
+		timeout:     time.Minute,
+	}
+
+	snapshots := []*compute.Snapshot{
+		{
+			Name:                  "snap-1",
+			Status:                "READY",
+			SelfLink:              "projects/p/global/snapshots/snap-1",
+			Description:           `{"velero.io/backup":"nightly","velero.io/pv":"pvc-1"}`,
+			Labels:                map[string]string{backupLabel: "nightly", pvLabel: "pvc-1"},
+			SnapshotEncryptionKey: &compute.CustomerEncryptionKey{KmsKeyName: testKeyName + "/cryptoKeyVersions/2"},
+		},
+		{Name: "snap-2", Status: "READY", SelfLink: "projects/p/global/snapshots/snap-2", Description: `{"velero.io/backup":"nightly","velero.io/pv":"pvc-2"}`},
+		{Name: "snap-3", Status: "FAILED", Description: `{"velero.io/backup":"nightly","velero.io/pv":"pvc-3"}`},
+	}
+
+	volumes, err := r.rehearse("nightly", snapshots)
+	require.NoError(t, err)
+	require.Len(t, volumes, 3)
+
+	assert.Equal(t, "pvc-1", volumes[0].volume)
+	assert.True(t, volumes[0].ready > 0)
+	assert.Equal(t, "mounted (1.2G used)", volumes[0].mount)
+	assert.Empty(t, volumes[0].problems)
+	assert.Equal(t, testKeyName, volumes[0].disk.DiskEncryptionKey.KmsKeyName)
+	assert.Equal(t, "projects/sandbox/zones/us-central1-a/diskTypes/pd-standard", volumes[0].disk.Type)
+
+	assert.Equal(t, "failed", volumes[1].mount)
+	assert.Equal(t, []string{"unable to mount the disk: no filesystem found"}, volumes[1].problems)
+
+	assert.Equal(t, "", volumes[2].mount)
+	assert.Equal(t, []string{"snapshot is FAILED"}, volumes[2].problems)
+	assert.Nil(t, volumes[2].disk)
+
+	// the restored disks are attached read-only, and the rehearsal's
+	// resources and the leftovers are torn down, and nothing else is
+	require.Len(t, fake.attached, 2)
+	for _, d := range fake.attached {
+		assert.Equal(t, "READ_ONLY", d.Mode)
+	}
+	assert.Empty(t, fake.instances)
+	assert.Len(t, fake.disks, 1)
+	assert.Contains(t, fake.disks, "live")
+}
+
+func TestParseCheckVMOutput(t *testing.T) {
+	v := &rehearsedVolume{}
+	byDisk := map[string]*rehearsedVolume{"rehearsal-1": v}
+
+	assert.False(t, parseCheckVMOutput("[   12.3] google_metadata_script_runner: starting\n", byDisk))
+	assert.Equal(t, "", v.mount)
+
+	output := "[   13.1] velero-rehearsal: rehearsal-1 mounted 4.0K used\nvelero-rehearsal: rehearsal-9 failed xfs\nvelero-rehearsal: done\n"
+	assert.True(t, parseCheckVMOutput(output, byDisk))
+	assert.Equal(t, "mounted (4.0K used)", v.mount)
+	assert.Empty(t, v.problems)
+
+	// results are only recorded once, as the output is parsed again
+	assert.True(t, parseCheckVMOutput(output, byDisk))
+	assert.Equal(t, "mounted (4.0K used)", v.mount)
+}
@@ -0,0 +1,168 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// maxRestoresPerZoneConfigKey is the key of a VolumeSnapshotLocation's
+	// config limiting how many disks restored from snapshots are created
+	// at once in each zone. Restored disks are created in parallel, since
+	// the plugin doesn't wait for them, which can exceed GCE's rate of
+	// disk creation in a zone for large restores.
+	maxRestoresPerZoneConfigKey = "maxRestoresPerZone"
+
+	restoreThrottleCounter = "velero_gcp_restore_throttle_waits_total"
+)
+
+var (
+	// restoreThrottlePollInterval is how often the disks holding up a new
+	// one are checked. It is a variable so tests can shorten it.
+	restoreThrottlePollInterval = 5 * time.Second
+
+	// restoreThrottleTimeout is how long a disk waits for the others of its
+	// zones before it's created anyway.
+	restoreThrottleTimeout = 10 * time.Minute
+)
+
+// diskStatusGetter returns the status of a disk.
+type diskStatusGetter func(ref diskRef) (string, error)
+
+// zoneRestoreThrottle limits the disks being restored in each zone. It
+// delays each disk until fewer than the maximum of those the snapshotter
+// started restoring in the disk's zones are still being created. Regional
+// disks count against both of their zones.
+type zoneRestoreThrottle struct {
+	log    logrus.FieldLogger
+	max    int
+	status diskStatusGetter
+	now    func() time.Time
+	sleep  func(time.Duration)
+
+	lock sync.Mutex
+	// pending are the disks being restored in each zone.
+	pending map[string][]diskRef
+}
+
+func newZoneRestoreThrottle(log logrus.FieldLogger, max int, status diskStatusGetter) *zoneRestoreThrottle {
+	return &zoneRestoreThrottle{
+		log:     log,
+		max:     max,
+		status:  status,
+		now:     time.Now,
+		sleep:   time.Sleep,
+		pending: make(map[string][]diskRef),
+	}
+}
+
+// wait blocks until a disk can be restored in the given zones. It gives up
+// waiting after restoreThrottleTimeout, letting GCE decide. The lock is
+// released while sleeping, so waiting for a busy zone doesn't hold up disks
+// of other zones or recording the disks that were started.
+func (t *zoneRestoreThrottle) wait(zones []string) {
+	if t == nil || len(zones) == 0 {
+		return
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	deadline := t.now().Add(restoreThrottleTimeout)
+	for waited := false; ; waited = true {
+		busy := ""
+		for _, zone := range zones {
+			t.prune(zone)
+			if len(t.pending[zone]) >= t.max {
+				busy = zone
+			}
+		}
+		if busy == "" {
+			return
+		}
+		if !waited {
+			pluginMetrics.addCounter(restoreThrottleCounter, "Number of restored disks delayed by the per-zone restore limit.", nil, 1)
+		}
+		if !t.now().Before(deadline) {
+			t.log.WithField("zone", busy).Warnf("Restored disks are still being created in the zone after %s, restoring the disk anyway", restoreThrottleTimeout)
+			return
+		}
+		t.log.WithField("zone", busy).Debugf("Waiting for %d restored disks in the zone to be created", len(t.pending[busy]))
+		t.lock.Unlock()
+		t.sleep(restoreThrottlePollInterval)
+		t.lock.Lock()
+	}
+}
+
+// prune forgets the disks of a zone that aren't being created anymore.
+func (t *zoneRestoreThrottle) prune(zone string) {
+	var creating []diskRef
+	for _, ref := range t.pending[zone] {
+		status, err := t.status(ref)
+		if isNotFound(err) {
+			continue
+		}
+		if err != nil {
+			// keep waiting for disks whose status is unknown, until the
+			// timeout
+			t.log.WithError(err).WithField("disk", ref.name).Debug("Unable to get the status of the disk")
+			creating = append(creating, ref)
+			continue
+		}
+		if status == "CREATING" || status == "RESTORING" {
+			creating = append(creating, ref)
+		}
+	}
+	if len(creating) == 0 {
+		delete(t.pending, zone)
+		return
+	}
+	t.pending[zone] = creating
+}
+
+// started records a disk being restored in the given zones.
+func (t *zoneRestoreThrottle) started(zones []string, ref diskRef) {
+	if t == nil {
+		return
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	for _, zone := range zones {
+		t.pending[zone] = append(t.pending[zone], ref)
+	}
+}
+
+// diskStatus returns the status of a disk, read without the lookup cache
+// since it changes while the disk is created.
+func (b *VolumeSnapshotter) diskStatus(ref diskRef) (string, error) {
+	if ref.regional {
+		disk, err := b.clients().gce.RegionDisks.Get(ref.project, ref.location, ref.name).Do()
+		if err != nil {
+			return "", err
+		}
+		return disk.Status, nil
+	}
+	disk, err := b.clients().gce.Disks.Get(ref.project, ref.location, ref.name).Do()
+	if err != nil {
+		return "", err
+	}
+	return disk.Status, nil
+}
@@ -0,0 +1,139 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/api/compute/v1"
+	"google.golang.org/api/googleapi"
+
+	velerotest "github.com/vmware-tanzu/velero/pkg/test"
+)
+
+func TestZoneRestoreThrottle(t *testing.T) {
+	const zoneA, zoneB = "us-central1-a", "us-central1-b"
+	disk := func(name string) diskRef { return diskRef{project: "p", location: zoneA, name: name} }
+
+	statuses := map[string]string{}
+	throttle := newZoneRestoreThrottle(velerotest.NewLogger(), 2, func(ref diskRef) (string, error) {
+		status, ok := statuses[ref.name]
+		if !ok {
+			return "", &googleapi.Error{Code: http.StatusNotFound}
+		}
+		return status, nil
+	})
+	now := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	throttle.now = func() time.Time { return now }
+	sleeps := 0
+	throttle.sleep = func(d time.Duration) {
+		sleeps++
+		now = now.Add(d)
+		// the first disk is created while waiting, and disks of other zones
+		// aren't held up by the wait
+		statuses["disk-1"] = "READY"
+		throttle.wait([]string{zoneB})
+	}
+
+	statuses["disk-1"], statuses["disk-2"] = "CREATING", "RESTORING"
+	throttle.wait([]string{zoneA})
+	throttle.started([]string{zoneA}, disk("disk-1"))
+	throttle.wait([]string{zoneA})
+	throttle.started([]string{zoneA}, disk("disk-2"))
+	assert.Equal(t, 0, sleeps)
+
+	// other zones aren't held up
+	throttle.wait([]string{zoneB})
+	assert.Equal(t, 0, sleeps)
+
+	// the third disk in the zone, or a regional disk replicated to it, waits
+	// for the first to be created
+	throttle.wait([]string{zoneB, zoneA})
+	assert.Equal(t, 1, sleeps)
+	assert.Equal(t, []diskRef{disk("disk-2")}, throttle.pending[zoneA])
+
+	// deleted disks don't hold up others
+	throttle.started([]string{zoneA}, disk("disk-3"))
+	statuses["disk-3"] = "CREATING"
+	delete(statuses, "disk-2")
+	throttle.wait([]string{zoneA})
+	assert.Equal(t, 1, sleeps)
+	assert.Equal(t, []diskRef{disk("disk-3")}, throttle.pending[zoneA])
+}
+
+func TestZoneRestoreThrottleTimeout(t *testing.T) {
+	throttle := newZoneRestoreThrottle(velerotest.NewLogger(), 1, func(diskRef) (string, error) { return "CREATING", nil })
+	now := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	throttle.now = func() time.Time { return now }
+	sleeps := 0
+	throttle.sleep = func(d time.Duration) {
+		sleeps++
+		now = now.Add(d)
+	}
+
+	throttle.started([]string{"us-central1-a"}, diskRef{project: "p", location: "us-central1-a", name: "disk-1"})
+	throttle.wait([]string{"us-central1-a"})
+	assert.Equal(t, int(restoreThrottleTimeout/restoreThrottlePollInterval), sleeps)
+
+	// a nil throttle doesn't limit restores
+	var disabled *zoneRestoreThrottle
+	disabled.wait([]string{"us-central1-a"})
+	disabled.started([]string{"us-central1-a"}, diskRef{})
+}
+
+func TestCreateVolumeFromSnapshotWaitsForZone(t *testing.T) {
+	defer func(interval time.Duration) { restoreThrottlePollInterval = interval }(restoreThrottlePollInterval)
+	restoreThrottlePollInterval = time.Millisecond
+
+	var inserted []string
+	polls := 0
+	gce := newFakeComputeService(t, func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/global/snapshots/snap"):
+			json.NewEncoder(w).Encode(&compute.Snapshot{Name: "snap", SelfLink: "projects/p/global/snapshots/snap"})
+		case r.Method == http.MethodPost:
+			disk := new(compute.Disk)
+			require.NoError(t, json.NewDecoder(r.Body).Decode(disk))
+			inserted = append(inserted, disk.Name)
+			json.NewEncoder(w).Encode(&compute.Operation{})
+		default:
+			// the first disk is created after a few polls
+			polls++
+			status := "CREATING"
+			if polls > 2 {
+				status = "READY"
+			}
+			json.NewEncoder(w).Encode(&compute.Disk{Status: status})
+		}
+	})
+	b := (&VolumeSnapshotter{log: velerotest.NewLogger(), volumeProject: "p", snapshotProject: "p"}).withClients(&snapshotterClients{gce: gce})
+	b.restoreThrottle = newZoneRestoreThrottle(b.log, 1, b.diskStatus)
+
+	first, err := b.CreateVolumeFromSnapshot("snap", "pd-standard", "us-central1-a", nil)
+	require.NoError(t, err)
+	assert.Equal(t, 0, polls)
+	second, err := b.CreateVolumeFromSnapshot("snap", "pd-standard", "us-central1-a", nil)
+	require.NoError(t, err)
+	assert.Equal(t, 3, polls)
+	assert.Equal(t, []string{first, second}, inserted)
+}
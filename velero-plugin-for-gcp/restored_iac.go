@@ -0,0 +1,352 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/pflag"
+	"google.golang.org/api/compute/v1"
+	v1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	exportRestoredCommand = "export-restored"
+
+	iacFormatConfigConnector = "kcc"
+	iacFormatTerraform       = "terraform"
+
+	// persistentVolumeAnnotation is the annotation of the exported Config
+	// Connector resources naming the persistent volume using the disk.
+	persistentVolumeAnnotation = "gcp.velero.io/persistent-volume"
+	// deletionPolicyAnnotation keeps Config Connector from deleting the
+	// disk along with its resource, which would delete the volume's data.
+	deletionPolicyAnnotation = "cnrm.cloud.google.com/deletion-policy"
+
+	computeDiskAPIVersion = "compute.cnrm.cloud.google.com/v1beta1"
+)
+
+// restoredDisk is a disk created by a restore, with the persistent volume
+// using it.
+type restoredDisk struct {
+	project string
+	// zone or region of the disk; regional disks have replica zones.
+	zone, region string
+	disk         *compute.Disk
+	volume       string
+}
+
+// name returns the resource name of the disk.
+func (d *restoredDisk) name() string {
+	if d.region != "" {
+		return fmt.Sprintf("projects/%s/regions/%s/disks/%s", d.project, d.region, d.disk.Name)
+	}
+	return fmt.Sprintf("projects/%s/zones/%s/disks/%s", d.project, d.zone, d.disk.Name)
+}
+
+// location returns the zone or region of the disk.
+func (d *restoredDisk) location() string {
+	if d.region != "" {
+		return d.region
+	}
+	return d.zone
+}
+
+// encryptionKey returns the Cloud KMS key of the disk, without its version.
+func (d *restoredDisk) encryptionKey() string {
+	if d.disk.DiskEncryptionKey == nil || d.disk.DiskEncryptionKey.KmsKeyName == "" {
+		return ""
+	}
+	return kmsCryptoKey(d.disk.DiskEncryptionKey.KmsKeyName)
+}
+
+// listRestoredDisks returns the disks in the volume project created by
+// restores of a backup, or of any backup if backup is empty, that a
+// persistent volume uses, sorted by name. Unused disks are left to
+// gc-restore-artifacts.
+func (b *VolumeSnapshotter) listRestoredDisks(backup string, pvs []v1.PersistentVolume) ([]*restoredDisk, error) {
+	volumes := make(map[string]string, len(pvs))
+	for i := range pvs {
+		id := pvVolumeID(&pvs[i])
+		volumes[id[strings.LastIndex(id, "/")+1:]] = pvs[i].Name
+	}
+
+	filter := fmt.Sprintf("labels.%s:*", restoredFromLabel)
+	if backup != "" {
+		filter = fmt.Sprintf("labels.%s=%q", restoredFromLabel, sanitizeLabelValue(backup))
+	}
+	var disks []*restoredDisk
+	// the aggregated list includes regional disks
+	err := b.clients().gce.Disks.AggregatedList(b.volumeProject).Filter(filter).Pages(context.TODO(), func(page *compute.DiskAggregatedList) error {
+		for scope, list := range page.Items {
+			for _, disk := range list.Disks {
+				volume, ok := volumes[disk.Name]
+				if !ok {
+					continue
+				}
+				d := &restoredDisk{project: b.volumeProject, disk: disk, volume: volume}
+				if strings.HasPrefix(scope, "regions/") {
+					d.region = path.Base(scope)
+				} else {
+					d.zone = path.Base(scope)
+				}
+				disks = append(disks, d)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "error listing restored disks")
+	}
+	sort.Slice(disks, func(i, j int) bool { return disks[i].name() < disks[j].name() })
+	return disks, nil
+}
+
+// configConnectorDisk returns the Config Connector ComputeDisk resource of a
+// disk, which acquires the disk when applied, and abandons it when deleted.
+func configConnectorDisk(d *restoredDisk, namespace string) map[string]interface{} {
+	metadata := map[string]interface{}{
+		"name": d.disk.Name,
+		"annotations": map[string]interface{}{
+			configConnectorProjectIDKey: d.project,
+			deletionPolicyAnnotation:    "abandon",
+			persistentVolumeAnnotation:  d.volume,
+		},
+	}
+	if namespace != "" {
+		metadata["namespace"] = namespace
+	}
+	// Config Connector sets the labels of resources as their GCP labels
+	if len(d.disk.Labels) > 0 {
+		metadata["labels"] = d.disk.Labels
+	}
+
+	spec := map[string]interface{}{
+		"resourceID": d.disk.Name,
+		"location":   d.location(),
+		"type":       path.Base(d.disk.Type),
+		"size":       d.disk.SizeGb,
+	}
+	if d.disk.Description != "" {
+		spec["description"] = d.disk.Description
+	}
+	if d.disk.SourceSnapshot != "" {
+		spec["snapshotRef"] = map[string]interface{}{"external": resourcePath(d.disk.SourceSnapshot)}
+	}
+	if key := d.encryptionKey(); key != "" {
+		spec["diskEncryptionKey"] = map[string]interface{}{"kmsKeyRef": map[string]interface{}{"external": key}}
+	}
+	if d.disk.ProvisionedIops > 0 {
+		spec["provisionedIops"] = d.disk.ProvisionedIops
+	}
+	if len(d.disk.ReplicaZones) > 0 {
+		var zones []string
+		for _, z := range d.disk.ReplicaZones {
+			zones = append(zones, resourcePath(z))
+		}
+		spec["replicaZones"] = zones
+	}
+	if len(d.disk.ResourcePolicies) > 0 {
+		var policies []interface{}
+		for _, p := range d.disk.ResourcePolicies {
+			policies = append(policies, map[string]interface{}{"external": resourcePath(p)})
+		}
+		spec["resourcePolicies"] = policies
+	}
+
+	return map[string]interface{}{
+		"apiVersion": computeDiskAPIVersion,
+		"kind":       "ComputeDisk",
+		"metadata":   metadata,
+		"spec":       spec,
+	}
+}
+
+// writeConfigConnectorDisks writes the Config Connector resources of disks
+// as a multi-document YAML stream.
+func writeConfigConnectorDisks(w io.Writer, disks []*restoredDisk, namespace string) error {
+	for i, d := range disks {
+		data, err := yaml.Marshal(configConnectorDisk(d, namespace))
+		if err != nil {
+			return errors.Wrapf(err, "error encoding disk %s", d.name())
+		}
+		if i > 0 {
+			fmt.Fprintln(w, "---")
+		}
+		if _, err := w.Write(data); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	return nil
+}
+
+// writeTerraformDisks writes the Terraform resources of disks and of the
+// attachments of their resource policies, with the import blocks adopting
+// them.
+func writeTerraformDisks(w io.Writer, disks []*restoredDisk) {
+	for i, d := range disks {
+		if i > 0 {
+			fmt.Fprintln(w)
+		}
+		resource, scope, attachment, kmsKey := "google_compute_disk", "zone", "google_compute_disk_resource_policy_attachment", "kms_key_self_link"
+		if d.region != "" {
+			resource, scope, attachment, kmsKey = "google_compute_region_disk", "region", "google_compute_region_disk_resource_policy_attachment", "kms_key_name"
+		}
+
+		fmt.Fprintf(w, "# Restored by Velero for persistent volume %s\n", d.volume)
+		fmt.Fprintf(w, "resource %q %q {\n", resource, d.disk.Name)
+		fmt.Fprintf(w, "  project = %s\n", hclString(d.project))
+		fmt.Fprintf(w, "  name = %s\n", hclString(d.disk.Name))
+		fmt.Fprintf(w, "  %s = %s\n", scope, hclString(d.location()))
+		fmt.Fprintf(w, "  type = %s\n", hclString(path.Base(d.disk.Type)))
+		fmt.Fprintf(w, "  size = %d\n", d.disk.SizeGb)
+		if d.disk.Description != "" {
+			fmt.Fprintf(w, "  description = %s\n", hclString(d.disk.Description))
+		}
+		if d.disk.SourceSnapshot != "" {
+			fmt.Fprintf(w, "  snapshot = %s\n", hclString(resourcePath(d.disk.SourceSnapshot)))
+		}
+		if d.disk.ProvisionedIops > 0 {
+			fmt.Fprintf(w, "  provisioned_iops = %d\n", d.disk.ProvisionedIops)
+		}
+		if len(d.disk.ReplicaZones) > 0 {
+			var zones []string
+			for _, z := range d.disk.ReplicaZones {
+				zones = append(zones, hclString(resourcePath(z)))
+			}
+			fmt.Fprintf(w, "  replica_zones = [%s]\n", strings.Join(zones, ", "))
+		}
+		if len(d.disk.Labels) > 0 {
+			var keys []string
+			for k := range d.disk.Labels {
+				keys = append(keys, k)
+			}
+			sort.Strings(keys)
+			fmt.Fprintln(w, "  labels = {")
+			for _, k := range keys {
+				fmt.Fprintf(w, "    %s = %s\n", hclString(k), hclString(d.disk.Labels[k]))
+			}
+			fmt.Fprintln(w, "  }")
+		}
+		if key := d.encryptionKey(); key != "" {
+			fmt.Fprintln(w, "  disk_encryption_key {")
+			fmt.Fprintf(w, "    %s = %s\n", kmsKey, hclString(key))
+			fmt.Fprintln(w, "  }")
+		}
+		// the disk holds the volume's data
+		fmt.Fprintln(w, "  lifecycle {")
+		fmt.Fprintln(w, "    prevent_destroy = true")
+		fmt.Fprintln(w, "  }")
+		fmt.Fprintln(w, "}")
+		fmt.Fprintln(w)
+		fmt.Fprintln(w, "import {")
+		fmt.Fprintf(w, "  to = %s.%s\n", resource, d.disk.Name)
+		fmt.Fprintf(w, "  id = %s\n", hclString(d.name()))
+		fmt.Fprintln(w, "}")
+
+		for _, p := range d.disk.ResourcePolicies {
+			policy := path.Base(p)
+			name := d.disk.Name + "_" + policy
+			fmt.Fprintln(w)
+			fmt.Fprintf(w, "resource %q %q {\n", attachment, name)
+			fmt.Fprintf(w, "  project = %s\n", hclString(d.project))
+			fmt.Fprintf(w, "  name = %s\n", hclString(policy))
+			fmt.Fprintf(w, "  disk = %s.%s.name\n", resource, d.disk.Name)
+			fmt.Fprintf(w, "  %s = %s\n", scope, hclString(d.location()))
+			fmt.Fprintln(w, "}")
+			fmt.Fprintln(w)
+			fmt.Fprintln(w, "import {")
+			fmt.Fprintf(w, "  to = %s.%s\n", attachment, name)
+			fmt.Fprintf(w, "  id = %s\n", hclString(strings.Join([]string{d.project, d.location(), d.disk.Name, policy}, "/")))
+			fmt.Fprintln(w, "}")
+		}
+	}
+}
+
+// hclString returns a quoted HCL string, escaping template sequences.
+func hclString(s string) string {
+	s = strings.NewReplacer("${", "$${", "%{", "%%{").Replace(s)
+	return strconv.Quote(s)
+}
+
+// resourcePath returns the relative resource name of a Compute Engine URL,
+// e.g. projects/PROJECT/global/snapshots/NAME.
+func resourcePath(link string) string {
+	if i := strings.Index(link, "projects/"); i >= 0 {
+		return link[i:]
+	}
+	return link
+}
+
+// runExportRestored writes Config Connector or Terraform definitions of the
+// disks restores created that persistent volumes use, so infrastructure as
+// code pipelines can adopt them.
+func runExportRestored(args []string, out io.Writer) int {
+	flags := pflag.NewFlagSet(exportRestoredCommand, pflag.ContinueOnError)
+	flags.SetOutput(out)
+	var (
+		location  snapshotCommandFlags
+		backup    string
+		format    string
+		namespace string
+	)
+	location.bind(flags)
+	flags.StringVar(&backup, "backup", "", "only export volumes restored from this backup")
+	flags.StringVar(&format, "format", iacFormatConfigConnector, "format of the definitions: kcc for Config Connector or terraform")
+	flags.StringVar(&namespace, "namespace", "", "namespace of the Config Connector resources")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if format != iacFormatConfigConnector && format != iacFormatTerraform {
+		fmt.Fprintf(out, "invalid --format %q, expected %s or %s\n", format, iacFormatConfigConnector, iacFormatTerraform)
+		return 2
+	}
+
+	b, err := location.volumeSnapshotter()
+	if err != nil {
+		fmt.Fprintln(out, err)
+		return 1
+	}
+	pvs, err := b.cluster.persistentVolumes()
+	if err != nil {
+		fmt.Fprintln(out, err)
+		return 1
+	}
+	disks, err := b.listRestoredDisks(backup, pvs)
+	if err != nil {
+		fmt.Fprintln(out, err)
+		return 1
+	}
+
+	if format == iacFormatTerraform {
+		writeTerraformDisks(out, disks)
+		return 0
+	}
+	if err := writeConfigConnectorDisks(out, disks, namespace); err != nil {
+		fmt.Fprintln(out, err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,188 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	velerotest "github.com/vmware-tanzu/velero/pkg/test"
+	"google.golang.org/api/compute/v1"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func restoredIACSnapshotter(t *testing.T) *VolumeSnapshotter {
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "/projects/p/aggregated/disks", r.URL.Path)
+		assert.Equal(t, `labels.velero-restored-from="nightly"`, r.URL.Query().Get("filter"))
+		json.NewEncoder(w).Encode(&compute.DiskAggregatedList{Items: map[string]compute.DisksScopedList{
+			"zones/us-central1-a": {Disks: []*compute.Disk{
+				{
+					Name:              "restore-1",
+					Type:              "https://www.googleapis.com/compute/v1/projects/p/zones/us-central1-a/diskTypes/pd-ssd",
+					SizeGb:            100,
+					SourceSnapshot:    "https://www.googleapis.com/compute/v1/projects/p/global/snapshots/snap-1",
+					Labels:            map[string]string{restoredFromLabel: "nightly", "team": "shop"},
+					DiskEncryptionKey: &compute.CustomerEncryptionKey{KmsKeyName: testKeyName + "/cryptoKeyVersions/2"},
+					ResourcePolicies:  []string{"https://www.googleapis.com/compute/v1/projects/p/regions/us-central1/resourcePolicies/daily"},
+				},
+				// not used by a persistent volume
+				{Name: "restore-2", Labels: map[string]string{restoredFromLabel: "nightly"}},
+			}},
+			"regions/us-central1": {Disks: []*compute.Disk{
+				{
+					Name:         "restore-3",
+					Type:         "https://www.googleapis.com/compute/v1/projects/p/regions/us-central1/diskTypes/pd-balanced",
+					SizeGb:       10,
+					ReplicaZones: []string{"https://www.googleapis.com/compute/v1/projects/p/zones/us-central1-a", "https://www.googleapis.com/compute/v1/projects/p/zones/us-central1-b"},
+					Description:  `{"kubernetes.io/created-for/pvc/name":"${data}"}`,
+				},
+			}},
+		}})
+	}
+	return (&VolumeSnapshotter{log: velerotest.NewLogger(), volumeProject: "p"}).withClients(&snapshotterClients{gce: newFakeComputeService(t, handler)})
+}
+
+func restoredIACVolumes() []v1.PersistentVolume {
+	return []v1.PersistentVolume{
+		{
+			ObjectMeta: metav1.ObjectMeta{Name: "pvc-1"},
+			Spec: v1.PersistentVolumeSpec{PersistentVolumeSource: v1.PersistentVolumeSource{
+				CSI: &v1.CSIPersistentVolumeSource{VolumeHandle: "projects/p/zones/us-central1-a/disks/restore-1"},
+			}},
+		},
+		{
+			ObjectMeta: metav1.ObjectMeta{Name: "pvc-3"},
+			Spec: v1.PersistentVolumeSpec{PersistentVolumeSource: v1.PersistentVolumeSource{
+				GCEPersistentDisk: &v1.GCEPersistentDiskVolumeSource{PDName: "restore-3"},
+			}},
+		},
+	}
+}
+
+func TestExportConfigConnectorDisks(t *testing.T) {
+	b := restoredIACSnapshotter(t)
+	disks, err := b.listRestoredDisks("nightly", restoredIACVolumes())
+	require.NoError(t, err)
+	require.Len(t, disks, 2)
+	assert.Equal(t, "projects/p/regions/us-central1/disks/restore-3", disks[0].name())
+	assert.Equal(t, "projects/p/zones/us-central1-a/disks/restore-1", disks[1].name())
+
+	var out strings.Builder
+	require.NoError(t, writeConfigConnectorDisks(&out, disks[1:], "infra"))
+	assert.Equal(t, `apiVersion: compute.cnrm.cloud.google.com/v1beta1
+kind: ComputeDisk
+metadata:
+  annotations:
+    cnrm.cloud.google.com/deletion-policy: abandon
+    cnrm.cloud.google.com/project-id: p
+    gcp.velero.io/persistent-volume: pvc-1
+  labels:
+    team: shop
+    velero-restored-from: nightly
+  name: restore-1
+  namespace: infra
+spec:
+  diskEncryptionKey:
+    kmsKeyRef:
+      external: `+testKeyName+`
+  location: us-central1-a
+  resourceID: restore-1
+  resourcePolicies:
+  - external: projects/p/regions/us-central1/resourcePolicies/daily
+  size: 100
+  snapshotRef:
+    external: projects/p/global/snapshots/snap-1
+  type: pd-ssd
+`, out.String())
+
+	out.Reset()
+	require.NoError(t, writeConfigConnectorDisks(&out, disks, ""))
+	assert.Equal(t, 1, strings.Count(out.String(), "\n---\n"))
+	assert.Contains(t, out.String(), "  replicaZones:\n  - projects/p/zones/us-central1-a\n  - projects/p/zones/us-central1-b\n")
+	assert.NotContains(t, out.String(), "namespace:")
+}
+
+func TestExportTerraformDisks(t *testing.T) {
+	b := restoredIACSnapshotter(t)
+	disks, err := b.listRestoredDisks("nightly", restoredIACVolumes())
+	require.NoError(t, err)
+
+	var out strings.Builder
+	writeTerraformDisks(&out, disks)
+	assert.Equal(t, `# Restored by Velero for persistent volume pvc-3
+resource "google_compute_region_disk" "restore-3" {
+  project = "p"
+  name = "restore-3"
+  region = "us-central1"
+  type = "pd-balanced"
+  size = 10
+  description = "{\"kubernetes.io/created-for/pvc/name\":\"$${data}\"}"
+  replica_zones = ["projects/p/zones/us-central1-a", "projects/p/zones/us-central1-b"]
+  lifecycle {
+    prevent_destroy = true
+  }
+}
+
+import {
+  to = google_compute_region_disk.restore-3
+  id = "projects/p/regions/us-central1/disks/restore-3"
+}
+
+# Restored by Velero for persistent volume pvc-1
+resource "google_compute_disk" "restore-1" {
+  project = "p"
+  name = "restore-1"
+  zone = "us-central1-a"
+  type = "pd-ssd"
+  size = 100
+  snapshot = "projects/p/global/snapshots/snap-1"
+  labels = {
+    "team" = "shop"
+    "velero-restored-from" = "nightly"
+  }
+  disk_encryption_key {
+    kms_key_self_link = "`+testKeyName+`"
+  }
+  lifecycle {
+    prevent_destroy = true
+  }
+}
+
+import {
+  to = google_compute_disk.restore-1
+  id = "projects/p/zones/us-central1-a/disks/restore-1"
+}
+
+resource "google_compute_disk_resource_policy_attachment" "restore-1_daily" {
+  project = "p"
+  name = "daily"
+  disk = google_compute_disk.restore-1.name
+  zone = "us-central1-a"
+}
+
+import {
+  to = google_compute_disk_resource_policy_attachment.restore-1_daily
+  id = "p/us-central1-a/restore-1/daily"
+}
+`, out.String())
+}
@@ -0,0 +1,96 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"regexp"
+
+	"github.com/pkg/errors"
+	"google.golang.org/api/option"
+	"google.golang.org/api/secretmanager/v1"
+)
+
+const (
+	secretManagerCredentialsConfigKey   = "secretManagerCredentials"
+	secretManagerEncryptionKeyConfigKey = "secretManagerEncryptionKey"
+
+	// encryptionKeySize is the size of the AES-256 keys used as
+	// customer-supplied encryption keys.
+	encryptionKeySize = 32
+)
+
+// secretVersionRegexp matches Secret Manager secret and secret version
+// resource names.
+var secretVersionRegexp = regexp.MustCompile(`^projects/[^/]+/secrets/[^/]+(/versions/[^/]+)?$`)
+
+// secretVersionName returns the resource name of the version of a secret to
+// read. Secrets without a version resolve to their latest version.
+func secretVersionName(name string) (string, error) {
+	m := secretVersionRegexp.FindStringSubmatch(name)
+	if m == nil {
+		return "", errors.Errorf("invalid Secret Manager secret %q, expected projects/PROJECT/secrets/SECRET[/versions/VERSION]", name)
+	}
+	if m[1] == "" {
+		name += "/versions/latest"
+	}
+	return name, nil
+}
+
+// secretManagerSecret is a secret version read from Secret Manager.
+type secretManagerSecret struct {
+	// version is the resource name of the version that was read, with
+	// aliases like "latest" resolved.
+	version string
+	data    []byte
+}
+
+func (platformSecrets) secretManagerSecret(ctx context.Context, name string, opts ...option.ClientOption) (secretManagerSecret, error) {
+	version, err := secretVersionName(name)
+	if err != nil {
+		return secretManagerSecret{}, err
+	}
+
+	svc, err := secretmanager.NewService(ctx, append([]option.ClientOption{option.WithScopes(secretmanager.CloudPlatformScope)}, opts...)...)
+	if err != nil {
+		return secretManagerSecret{}, errors.WithStack(err)
+	}
+	res, err := svc.Projects.Secrets.Versions.Access(version).Context(ctx).Do()
+	if err != nil {
+		return secretManagerSecret{}, errors.Wrapf(err, "error accessing Secret Manager secret %s", version)
+	}
+
+	data, err := base64.StdEncoding.DecodeString(res.Payload.Data)
+	if err != nil {
+		return secretManagerSecret{}, errors.Wrapf(err, "error decoding Secret Manager secret %s", version)
+	}
+	return secretManagerSecret{version: res.Name, data: data}, nil
+}
+
+// parseEncryptionKey returns the AES-256 key stored in a secret, either as
+// raw bytes or base64 encoded.
+func parseEncryptionKey(data []byte) ([]byte, error) {
+	if len(data) == encryptionKeySize {
+		return data, nil
+	}
+	key, err := base64.StdEncoding.DecodeString(string(data))
+	if err != nil || len(key) != encryptionKeySize {
+		return nil, errors.Errorf("encryption key must be %d bytes, raw or base64 encoded", encryptionKeySize)
+	}
+	return key, nil
+}
@@ -0,0 +1,88 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/base64"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSecretVersionName(t *testing.T) {
+	name, err := secretVersionName("projects/my-project/secrets/velero")
+	require.NoError(t, err)
+	assert.Equal(t, "projects/my-project/secrets/velero/versions/latest", name)
+
+	name, err = secretVersionName("projects/my-project/secrets/velero/versions/3")
+	require.NoError(t, err)
+	assert.Equal(t, "projects/my-project/secrets/velero/versions/3", name)
+
+	_, err = secretVersionName("velero")
+	assert.Error(t, err)
+}
+
+func TestParseEncryptionKey(t *testing.T) {
+	raw := []byte(strings.Repeat("k", encryptionKeySize))
+
+	key, err := parseEncryptionKey(raw)
+	require.NoError(t, err)
+	assert.Equal(t, raw, key)
+
+	key, err = parseEncryptionKey([]byte(base64.StdEncoding.EncodeToString(raw)))
+	require.NoError(t, err)
+	assert.Equal(t, raw, key)
+
+	_, err = parseEncryptionKey([]byte("too short"))
+	assert.Error(t, err)
+}
+
+func TestLocationCredentialsFromSecretManager(t *testing.T) {
+	version := func(v string) secretManagerSecret {
+		return secretManagerSecret{version: "projects/my-project/secrets/velero/versions/" + v, data: []byte(testServiceAccountJSON)}
+	}
+	secrets := &fakeSecrets{versions: map[string]secretManagerSecret{
+		"projects/my-project/secrets/velero":            version("1"),
+		"projects/my-project/secrets/velero/versions/1": version("1"),
+	}}
+
+	c, err := newLocationCredentials(secrets, map[string]string{secretManagerCredentialsConfigKey: "projects/my-project/secrets/velero"}, "")
+	require.NoError(t, err)
+	assert.Equal(t, []byte(testServiceAccountJSON), c.json)
+	assert.Equal(t, "projects/my-project/secrets/velero/versions/1", c.secretVersion)
+
+	w := newCredentialsWatcher("")
+	now := w.lastCheck
+	w.now = func() time.Time { return now }
+	w.watchVersion(c.secretVersion, c.secretVersionCheck())
+
+	now = now.Add(versionCheckInterval)
+	assert.False(t, w.changed(), "unchanged secret")
+
+	secrets.versions["projects/my-project/secrets/velero"] = version("2")
+	now = now.Add(credentialsCheckInterval)
+	assert.False(t, w.changed(), "versions are checked less often than files")
+	now = now.Add(versionCheckInterval)
+	assert.True(t, w.changed(), "rotated secret")
+
+	pinned, err := newLocationCredentials(secrets, map[string]string{secretManagerCredentialsConfigKey: "projects/my-project/secrets/velero/versions/1"}, "")
+	require.NoError(t, err)
+	assert.Nil(t, pinned.secretVersionCheck(), "pinned versions don't rotate")
+}
@@ -0,0 +1,74 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"strings"
+
+	"github.com/pkg/errors"
+	"google.golang.org/api/option"
+)
+
+const (
+	credentialsSecretConfigKey = "credentialsSecret"
+
+	serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+)
+
+// secretSource reads the secrets credentials and encryption keys are kept
+// in. platformSecrets reads them from the cluster and Secret Manager; tests
+// use fakes.
+type secretSource interface {
+	// credentialsSecret returns the value of a key in a Kubernetes Secret.
+	credentialsSecret(namespace, name, key string) ([]byte, error)
+	// secretManagerSecret reads a secret version from Secret Manager.
+	secretManagerSecret(ctx context.Context, name string, opts ...option.ClientOption) (secretManagerSecret, error)
+}
+
+// platformSecrets reads Kubernetes Secrets with the in-cluster client, and
+// Secret Manager secrets as the plugin's own identity.
+type platformSecrets struct{}
+
+func (platformSecrets) credentialsSecret(namespace, name, key string) ([]byte, error) {
+	client, err := newInClusterClient()
+	if err != nil {
+		return nil, err
+	}
+	return client.secretValue(namespace, name, key)
+}
+
+// parseSecretRef parses a "namespace/name/key" reference to a key in a
+// Kubernetes Secret.
+func parseSecretRef(ref string) (namespace, name, key string, err error) {
+	parts := strings.Split(ref, "/")
+	if len(parts) != 3 || parts[0] == "" || parts[1] == "" || parts[2] == "" {
+		return "", "", "", errors.Errorf("invalid %s %q, expected namespace/name/key", credentialsSecretConfigKey, ref)
+	}
+	return parts[0], parts[1], parts[2], nil
+}
+
+// checkSecretNamespace returns an error unless a Secret the credentials of
+// a location are read from is in Velero's namespace. The plugin reads it
+// with the Velero service account, so a location's config mustn't be able
+// to point it at other namespaces' Secrets.
+func checkSecretNamespace(namespace string) error {
+	if ns := veleroNamespace(); namespace != ns {
+		return errors.Errorf("the Secret must be in Velero's namespace %s, not %s", ns, namespace)
+	}
+	return nil
+}
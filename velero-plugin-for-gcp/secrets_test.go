@@ -0,0 +1,94 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/api/option"
+)
+
+// fakeSecrets is a secretSource holding its secrets in memory.
+type fakeSecrets struct {
+	// values are the values of the keys of Kubernetes Secrets, by
+	// NAMESPACE/NAME/KEY.
+	values map[string][]byte
+	// versions are the Secret Manager secrets, by the name they're read
+	// with.
+	versions map[string]secretManagerSecret
+}
+
+func (s *fakeSecrets) credentialsSecret(namespace, name, key string) ([]byte, error) {
+	value, ok := s.values[namespace+"/"+name+"/"+key]
+	if !ok {
+		return nil, errors.Errorf("secret %s/%s not found", namespace, name)
+	}
+	return value, nil
+}
+
+func (s *fakeSecrets) secretManagerSecret(_ context.Context, name string, _ ...option.ClientOption) (secretManagerSecret, error) {
+	secret, ok := s.versions[name]
+	if !ok {
+		return secretManagerSecret{}, errors.Errorf("secret %s not found", name)
+	}
+	return secret, nil
+}
+
+func TestParseSecretRef(t *testing.T) {
+	namespace, name, key, err := parseSecretRef("velero/gcp-credentials/cloud")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"velero", "gcp-credentials", "cloud"}, []string{namespace, name, key})
+
+	for _, ref := range []string{"", "gcp-credentials/cloud", "velero//cloud", "velero/gcp-credentials/cloud/extra"} {
+		_, _, _, err := parseSecretRef(ref)
+		assert.Error(t, err, ref)
+	}
+}
+
+func TestLocationCredentialsFromSecret(t *testing.T) {
+	secrets := &fakeSecrets{values: map[string][]byte{
+		"velero/gcp-credentials/cloud":   []byte(`{"type": "service_account"}`),
+		"tenant-b/gcp-credentials/cloud": []byte(`{"type": "service_account"}`),
+	}}
+
+	c, err := newLocationCredentials(secrets, map[string]string{credentialsSecretConfigKey: "velero/gcp-credentials/cloud"}, "")
+	require.NoError(t, err)
+	assert.Equal(t, []byte(`{"type": "service_account"}`), c.json)
+	assert.Len(t, c.baseOptions(), 1)
+
+	b, err := c.configuredJSON()
+	require.NoError(t, err)
+	assert.Equal(t, c.json, b)
+
+	_, err = newLocationCredentials(secrets, map[string]string{
+		credentialsFileConfigKey:   "/credentials/cloud",
+		credentialsSecretConfigKey: "velero/gcp-credentials/cloud",
+	}, "")
+	assert.Error(t, err, "a credentials file and secret can't both be set")
+
+	// Secrets outside Velero's namespace are never read
+	_, err = newLocationCredentials(secrets, map[string]string{credentialsSecretConfigKey: "tenant-b/gcp-credentials/cloud"}, "")
+	assert.EqualError(t, err, `invalid credentialsSecret "tenant-b/gcp-credentials/cloud": the Secret must be in Velero's namespace velero, not tenant-b`)
+	t.Setenv(veleroNamespaceEnvVar, "tenant-b")
+	_, err = newLocationCredentials(secrets, map[string]string{credentialsSecretConfigKey: "tenant-b/gcp-credentials/cloud"}, "")
+	assert.NoError(t, err)
+	assert.Error(t, checkSecretRef("velero/gcp-credentials/cloud"))
+}
@@ -0,0 +1,220 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	stderrors "errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/vmware-tanzu/velero/pkg/plugin/framework"
+	"github.com/vmware-tanzu/velero/pkg/plugin/velero"
+	"google.golang.org/api/googleapi"
+	iam "google.golang.org/api/iam/v1"
+	"google.golang.org/api/option"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	serviceAccountActionName = "velero.io/gcp-workload-identity"
+
+	workloadIdentityAnnotation = "iam.gke.io/gcp-service-account"
+
+	// serviceAccountsConfigKey and projectsConfigKey are the keys of the
+	// action's ConfigMap holding YAML maps of old to new service account
+	// emails and project IDs.
+	serviceAccountsConfigKey = "serviceAccounts"
+	projectsConfigKey        = "projects"
+
+	// workloadPoolConfigKey is the key of the action's ConfigMap holding
+	// the workload identity pool of the destination cluster, e.g.
+	// my-project.svc.id.goog, which enables checking that restored
+	// service accounts can act as their Google service accounts.
+	workloadPoolConfigKey = "workloadPool"
+
+	serviceAccountDomain     = ".iam.gserviceaccount.com"
+	workloadIdentityUserRole = "roles/iam.workloadIdentityUser"
+)
+
+// getServiceAccountPolicy returns the IAM policy of a Google service
+// account.
+func getServiceAccountPolicy(ctx context.Context, email string, opts ...option.ClientOption) (*iam.Policy, error) {
+	svc, err := iam.NewService(ctx, opts...)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return svc.Projects.ServiceAccounts.GetIamPolicy("projects/-/serviceAccounts/" + email).Context(ctx).Do()
+}
+
+// ServiceAccountAction is a restore item action that remaps the Google
+// service accounts Kubernetes service accounts act as with workload
+// identity, so workloads restored into another project authenticate as
+// that project's service accounts.
+type ServiceAccountAction struct {
+	log     logrus.FieldLogger
+	cluster veleroCluster
+	// getPolicy returns the IAM policy of a Google service account.
+	getPolicy func(ctx context.Context, email string, opts ...option.ClientOption) (*iam.Policy, error)
+
+	configOnce   sync.Once
+	mapping      serviceAccountMapping
+	workloadPool string
+	configErr    error
+
+	optsOnce sync.Once
+	opts     []option.ClientOption
+	optsErr  error
+}
+
+func newServiceAccountAction(logger logrus.FieldLogger) (interface{}, error) {
+	return &ServiceAccountAction{log: logger, cluster: inCluster{}, getPolicy: getServiceAccountPolicy}, nil
+}
+
+func (a *ServiceAccountAction) AppliesTo() (velero.ResourceSelector, error) {
+	return velero.ResourceSelector{
+		IncludedResources: []string{"serviceaccounts"},
+	}, nil
+}
+
+// loadConfig reads the action's configuration once, since the action is
+// executed for every service account being restored.
+func (a *ServiceAccountAction) loadConfig() (serviceAccountMapping, string, error) {
+	a.configOnce.Do(func() {
+		var config map[string]string
+		config, a.configErr = a.cluster.pluginConfig(framework.PluginKindRestoreItemAction, serviceAccountActionName)
+		if a.configErr != nil {
+			return
+		}
+		a.mapping, a.configErr = parseServiceAccountMapping(config)
+		a.workloadPool = config[workloadPoolConfigKey]
+	})
+	return a.mapping, a.workloadPool, a.configErr
+}
+
+func (a *ServiceAccountAction) Execute(input *velero.RestoreItemActionExecuteInput) (*velero.RestoreItemActionExecuteOutput, error) {
+	obj := &unstructured.Unstructured{Object: input.Item.UnstructuredContent()}
+
+	annotations := obj.GetAnnotations()
+	email := annotations[workloadIdentityAnnotation]
+	if email == "" {
+		return velero.NewRestoreItemActionExecuteOutput(obj), nil
+	}
+
+	mapping, pool, err := a.loadConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	if mapped := mapping.remap(email); mapped != email {
+		a.log.Infof("Updating %s annotation of service account %s/%s from %s to %s", workloadIdentityAnnotation, obj.GetNamespace(), obj.GetName(), email, mapped)
+		annotations[workloadIdentityAnnotation] = mapped
+		obj.SetAnnotations(annotations)
+		email = mapped
+	}
+
+	if pool != "" {
+		// the restored service account's namespace is only changed once
+		// restore item actions have run
+		namespace := obj.GetNamespace()
+		if input.Restore != nil {
+			if mapped, ok := input.Restore.Spec.NamespaceMapping[namespace]; ok {
+				namespace = mapped
+			}
+		}
+		a.verifyBinding(email, fmt.Sprintf("serviceAccount:%s[%s/%s]", pool, namespace, obj.GetName()))
+	}
+	return velero.NewRestoreItemActionExecuteOutput(obj), nil
+}
+
+// verifyBinding warns if a Google service account doesn't exist or doesn't
+// let a Kubernetes service account act as it. It never fails the restore,
+// since the binding can be added afterwards.
+func (a *ServiceAccountAction) verifyBinding(email, member string) {
+	a.optsOnce.Do(func() {
+		a.opts, _, _, a.optsErr = newActionClientOptions(a.cluster, framework.PluginKindRestoreItemAction, serviceAccountActionName, iam.CloudPlatformScope)
+	})
+	log := a.log.WithFields(logrus.Fields{"serviceAccount": email, "member": member})
+	if a.optsErr != nil {
+		log.WithError(a.optsErr).Warn("Unable to verify the workload identity binding of the Google service account")
+		return
+	}
+
+	policy, err := a.getPolicy(context.Background(), email, a.opts...)
+	var apiErr *googleapi.Error
+	switch {
+	case stderrors.As(err, &apiErr) && apiErr.Code == http.StatusNotFound:
+		log.Warn("Google service account doesn't exist, workloads using the restored service account will fail to authenticate")
+		return
+	case err != nil:
+		log.WithError(err).Warn("Unable to verify the workload identity binding of the Google service account")
+		return
+	}
+
+	for _, binding := range policy.Bindings {
+		if binding.Role != workloadIdentityUserRole {
+			continue
+		}
+		for _, m := range binding.Members {
+			if m == member {
+				return
+			}
+		}
+	}
+	log.Warnf("Google service account doesn't grant %s to the restored service account, workloads using it will fail to authenticate", workloadIdentityUserRole)
+}
+
+// serviceAccountMapping maps Google service accounts, either individually
+// or by the project they belong to.
+type serviceAccountMapping struct {
+	serviceAccounts map[string]string
+	projects        map[string]string
+}
+
+func parseServiceAccountMapping(config map[string]string) (serviceAccountMapping, error) {
+	var m serviceAccountMapping
+	if err := yaml.Unmarshal([]byte(config[serviceAccountsConfigKey]), &m.serviceAccounts); err != nil {
+		return m, errors.Wrapf(err, "error parsing %s in the %s ConfigMap", serviceAccountsConfigKey, serviceAccountActionName)
+	}
+	if err := yaml.Unmarshal([]byte(config[projectsConfigKey]), &m.projects); err != nil {
+		return m, errors.Wrapf(err, "error parsing %s in the %s ConfigMap", projectsConfigKey, serviceAccountActionName)
+	}
+	return m, nil
+}
+
+// remap returns the service account email mapped to, preferring an exact
+// match over a project match. Emails that aren't mapped are returned as is.
+func (m serviceAccountMapping) remap(email string) string {
+	if mapped, ok := m.serviceAccounts[email]; ok {
+		return mapped
+	}
+
+	at := strings.LastIndex(email, "@")
+	if at < 0 || !strings.HasSuffix(email, serviceAccountDomain) {
+		return email
+	}
+	project := strings.TrimSuffix(email[at+1:], serviceAccountDomain)
+	if mapped, ok := m.projects[project]; ok {
+		return email[:at+1] + mapped + serviceAccountDomain
+	}
+	return email
+}
@@ -0,0 +1,169 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	api "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	"github.com/vmware-tanzu/velero/pkg/plugin/velero"
+	"google.golang.org/api/googleapi"
+	iam "google.golang.org/api/iam/v1"
+	"google.golang.org/api/option"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+
+	velerotest "github.com/vmware-tanzu/velero/pkg/test"
+)
+
+func TestServiceAccountMappingRemap(t *testing.T) {
+	m, err := parseServiceAccountMapping(map[string]string{
+		serviceAccountsConfigKey: "velero@old-project.iam.gserviceaccount.com: backup@new-project.iam.gserviceaccount.com",
+		projectsConfigKey:        "old-project: new-project",
+	})
+	require.NoError(t, err)
+
+	tests := []struct {
+		email    string
+		expected string
+	}{
+		{email: "velero@old-project.iam.gserviceaccount.com", expected: "backup@new-project.iam.gserviceaccount.com"},
+		{email: "app@old-project.iam.gserviceaccount.com", expected: "app@new-project.iam.gserviceaccount.com"},
+		{email: "app@other-project.iam.gserviceaccount.com", expected: "app@other-project.iam.gserviceaccount.com"},
+		{email: "123-compute@developer.gserviceaccount.com", expected: "123-compute@developer.gserviceaccount.com"},
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.expected, m.remap(test.email), test.email)
+	}
+
+	_, err = parseServiceAccountMapping(map[string]string{projectsConfigKey: "[not a map"})
+	assert.Error(t, err)
+}
+
+func TestServiceAccountActionExecute(t *testing.T) {
+	cluster := &fakeCluster{configs: map[string]map[string]string{serviceAccountActionName: {projectsConfigKey: "old-project: new-project"}}}
+	action := &ServiceAccountAction{log: velerotest.NewLogger(), cluster: cluster}
+
+	item := &unstructured.Unstructured{}
+	item.SetName("app")
+	item.SetNamespace("default")
+	item.SetAnnotations(map[string]string{workloadIdentityAnnotation: "app@old-project.iam.gserviceaccount.com", "other": "value"})
+
+	out, err := action.Execute(&velero.RestoreItemActionExecuteInput{Item: item})
+	require.NoError(t, err)
+	updated := &unstructured.Unstructured{Object: out.UpdatedItem.UnstructuredContent()}
+	assert.Equal(t, map[string]string{workloadIdentityAnnotation: "app@new-project.iam.gserviceaccount.com", "other": "value"}, updated.GetAnnotations())
+
+	// the config is read once, not for every service account
+	other := &unstructured.Unstructured{}
+	other.SetName("worker")
+	other.SetAnnotations(map[string]string{workloadIdentityAnnotation: "worker@old-project.iam.gserviceaccount.com"})
+	out, err = action.Execute(&velero.RestoreItemActionExecuteInput{Item: other})
+	require.NoError(t, err)
+	updated = &unstructured.Unstructured{Object: out.UpdatedItem.UnstructuredContent()}
+	assert.Equal(t, "worker@new-project.iam.gserviceaccount.com", updated.GetAnnotations()[workloadIdentityAnnotation])
+	assert.Equal(t, 1, cluster.configReads)
+
+	// service accounts without the annotation don't need the config
+	plain := &unstructured.Unstructured{}
+	plain.SetName("default")
+	out, err = (&ServiceAccountAction{log: velerotest.NewLogger(), cluster: &fakeCluster{err: errors.New("unexpected read")}}).Execute(&velero.RestoreItemActionExecuteInput{Item: plain})
+	require.NoError(t, err)
+	assert.Equal(t, plain.Object, out.UpdatedItem.UnstructuredContent())
+}
+
+func TestServiceAccountActionVerifyBinding(t *testing.T) {
+	const member = "serviceAccount:dr-project.svc.id.goog[shop-dr/web]"
+
+	tests := []struct {
+		name        string
+		policy      *iam.Policy
+		err         error
+		expectedLog string
+	}{
+		{
+			name: "bound service account",
+			policy: &iam.Policy{Bindings: []*iam.Binding{
+				{Role: "roles/iam.serviceAccountUser", Members: []string{"user:admin@example.com"}},
+				{Role: workloadIdentityUserRole, Members: []string{member}},
+			}},
+		},
+		{
+			name: "service account bound to the source cluster only",
+			policy: &iam.Policy{Bindings: []*iam.Binding{
+				{Role: workloadIdentityUserRole, Members: []string{"serviceAccount:prod-project.svc.id.goog[shop/web]"}},
+			}},
+			expectedLog: "doesn't grant roles/iam.workloadIdentityUser",
+		},
+		{
+			name:        "missing service account",
+			err:         &googleapi.Error{Code: http.StatusNotFound},
+			expectedLog: "doesn't exist",
+		},
+		{
+			name:        "policy can't be read",
+			err:         &googleapi.Error{Code: http.StatusForbidden},
+			expectedLog: "Unable to verify",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			logger, hook := logtest.NewNullLogger()
+			action := &ServiceAccountAction{
+				log: logger,
+				cluster: &fakeCluster{configs: map[string]map[string]string{serviceAccountActionName: {
+					projectsConfigKey:     "prod-project: dr-project",
+					workloadPoolConfigKey: "dr-project.svc.id.goog",
+				}}},
+				getPolicy: func(ctx context.Context, email string, opts ...option.ClientOption) (*iam.Policy, error) {
+					assert.Equal(t, "web@dr-project.iam.gserviceaccount.com", email)
+					return test.policy, test.err
+				},
+			}
+			action.optsOnce.Do(func() {})
+
+			item := &unstructured.Unstructured{}
+			item.SetNamespace("shop")
+			item.SetName("web")
+			item.SetAnnotations(map[string]string{workloadIdentityAnnotation: "web@prod-project.iam.gserviceaccount.com"})
+			restore := &api.Restore{Spec: api.RestoreSpec{NamespaceMapping: map[string]string{"shop": "shop-dr"}}}
+
+			_, err := action.Execute(&velero.RestoreItemActionExecuteInput{Item: item, Restore: restore})
+			require.NoError(t, err)
+
+			var warnings []string
+			for _, entry := range hook.AllEntries() {
+				if entry.Level == logrus.WarnLevel {
+					warnings = append(warnings, entry.Message)
+				}
+			}
+			if test.expectedLog == "" {
+				assert.Empty(t, warnings)
+				return
+			}
+			require.Len(t, warnings, 1)
+			assert.Contains(t, warnings[0], test.expectedLog)
+		})
+	}
+}
@@ -0,0 +1,290 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	api "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	"github.com/vmware-tanzu/velero/pkg/plugin/velero"
+	"google.golang.org/api/compute/v1"
+)
+
+const (
+	snapshotCleanupActionName = "velero.io/gcp-snapshot-cleanup"
+
+	backupNameTag = "velero.io/backup"
+	pvNameTag     = "velero.io/pv"
+
+	// backupLabel and pvLabel are the snapshot labels holding the
+	// sanitized names of the backup and persistent volume a snapshot was
+	// created for, so snapshots can be found with a list filter.
+	backupLabel = "velero-backup"
+	pvLabel     = "velero-pv"
+
+	maxLabelValueLength = 63
+)
+
+var (
+	// cleanedBackups records the backups whose snapshots were already
+	// cleaned up in this process, since the action runs for every item of
+	// a deleted backup.
+	cleanedBackups     = make(map[string]bool)
+	cleanedBackupsLock sync.Mutex
+)
+
+// snapshotLabels returns the labels identifying the backup and persistent
+// volume a snapshot is created for.
+func snapshotLabels(tags map[string]string) map[string]string {
+	labels := make(map[string]string)
+	if backup := tags[backupNameTag]; backup != "" {
+		labels[backupLabel] = sanitizeLabelValue(backup)
+	}
+	if pv := tags[pvNameTag]; pv != "" {
+		labels[pvLabel] = sanitizeLabelValue(pv)
+	}
+	if len(labels) == 0 {
+		return nil
+	}
+	return labels
+}
+
+// sanitizeLabelValue converts a Kubernetes object name to a valid GCE label
+// value, which consists of at most 63 lowercase letters, digits, underscores
+// and hyphens.
+func sanitizeLabelValue(s string) string {
+	b := []byte(strings.ToLower(s))
+	for i, c := range b {
+		if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '_' || c == '-') {
+			b[i] = '-'
+		}
+	}
+	if len(b) > maxLabelValueLength {
+		b = b[:maxLabelValueLength]
+	}
+	return string(b)
+}
+
+// deleteBackupSnapshots deletes the snapshots created for a backup,
+// including any that aren't recorded in the backup because it only
+// partially succeeded. It returns the names of the deleted snapshots.
+func (b *VolumeSnapshotter) deleteBackupSnapshots(backupName string) ([]string, error) {
+	filter := fmt.Sprintf("labels.%s=%q", backupLabel, sanitizeLabelValue(backupName))
+
+	var snapshots []*compute.Snapshot
+	err := b.clients().gce.Snapshots.List(b.snapshotProject).Filter(filter).Pages(context.Background(), func(page *compute.SnapshotList) error {
+		snapshots = append(snapshots, page.Items...)
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "error listing snapshots of backup %s", backupName)
+	}
+
+	var deleted []string
+	for _, snapshot := range snapshots {
+		// labels are sanitized, so make sure the snapshot really belongs
+		// to this backup before deleting it
+		var tags map[string]string
+		if err := json.Unmarshal([]byte(snapshot.Description), &tags); err != nil || tags[backupNameTag] != backupName {
+			continue
+		}
+		if err := checkRetention(snapshot.Name, snapshot.Labels, time.Now()); err != nil {
+			return deleted, errors.WithMessagef(err, "error deleting snapshot of backup %s", backupName)
+		}
+
+		call := b.clients().gce.Snapshots.Delete(b.snapshotProject, snapshot.Name)
+		setRequestReason(call, requestReason(backupDeletionOperation, backupName))
+		_, err := call.Do()
+		if isNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return deleted, errors.Wrapf(err, "error deleting snapshot %s of backup %s", snapshot.Name, backupName)
+		}
+		deleted = append(deleted, snapshot.Name)
+	}
+	return deleted, nil
+}
+
+// volumeSnapshotLocations returns the VolumeSnapshotLocations in Velero's
+// namespace.
+func (inCluster) volumeSnapshotLocations() ([]api.VolumeSnapshotLocation, error) {
+	client, err := newInClusterClient()
+	if err != nil {
+		return nil, err
+	}
+	return client.listVolumeSnapshotLocations(veleroNamespace())
+}
+
+// isGCPProvider reports whether a location's provider is this plugin.
+func isGCPProvider(provider string) bool {
+	return provider == "gcp" || provider == "velero.io/gcp"
+}
+
+// SnapshotCleanupAction is a delete item action that deletes the snapshots
+// and Filestore backups created for a backup when it is deleted, including
+// those Velero has no record of because the backup failed part way through,
+// and the unused volumes failed restores of the backup left behind.
+type SnapshotCleanupAction struct {
+	log     logrus.FieldLogger
+	cluster veleroCluster
+
+	// snapshotters are the snapshotters deleting the snapshots of each
+	// location, by location name.
+	lock         sync.Mutex
+	snapshotters map[string]*cleanupSnapshotter
+}
+
+// cleanupSnapshotter is a snapshotter of a location with only its
+// credentials and compute client, along with the config it was built with.
+type cleanupSnapshotter struct {
+	config      map[string]string
+	snapshotter *VolumeSnapshotter
+}
+
+func newSnapshotCleanupAction(logger logrus.FieldLogger) (interface{}, error) {
+	return &SnapshotCleanupAction{log: logger, cluster: inCluster{}, snapshotters: make(map[string]*cleanupSnapshotter)}, nil
+}
+
+func (a *SnapshotCleanupAction) AppliesTo() (velero.ResourceSelector, error) {
+	// Velero records a persistent volume in the backup before snapshotting
+	// it, so a backup with snapshots, even ones that leaked because the
+	// backup failed part way through, has persistent volumes. The action
+	// runs for each of them and cleans up once per backup.
+	return velero.ResourceSelector{IncludedResources: []string{"persistentvolumes"}}, nil
+}
+
+func (a *SnapshotCleanupAction) Execute(input *velero.DeleteItemActionExecuteInput) error {
+	backup := input.Backup
+	key := backup.Namespace + "/" + backup.Name + "/" + string(backup.UID)
+
+	cleanedBackupsLock.Lock()
+	cleaned := cleanedBackups[key]
+	cleanedBackupsLock.Unlock()
+	if cleaned {
+		return nil
+	}
+
+	locations, err := a.cluster.volumeSnapshotLocations()
+	if err != nil {
+		return err
+	}
+
+	selected := make(map[string]bool, len(backup.Spec.VolumeSnapshotLocations))
+	for _, name := range backup.Spec.VolumeSnapshotLocations {
+		selected[name] = true
+	}
+
+	log := a.log.WithField("backup", backup.Name)
+	var errs []string
+	for _, location := range locations {
+		if !isGCPProvider(location.Spec.Provider) || (len(selected) > 0 && !selected[location.Name]) {
+			continue
+		}
+
+		snapshotter, err := a.snapshotter(location)
+		if err != nil {
+			errs = append(errs, errors.Wrapf(err, "error connecting VolumeSnapshotLocation %s", location.Name).Error())
+			continue
+		}
+
+		deleted, err := snapshotter.deleteBackupSnapshots(backup.Name)
+		for _, name := range deleted {
+			log.WithField("snapshot", name).Info("Deleted snapshot of deleted backup")
+		}
+		if err != nil {
+			errs = append(errs, err.Error())
+		}
+
+		deleted, err = snapshotter.deleteBackupFilestoreBackups(backup.Name)
+		for _, name := range deleted {
+			log.WithField("filestoreBackup", name).Info("Deleted Filestore backup of deleted backup")
+		}
+		if err != nil {
+			errs = append(errs, err.Error())
+		}
+
+		deleted, err = snapshotter.deleteBackupRestoreArtifacts(backup.Name)
+		for _, name := range deleted {
+			log.WithField("volume", name).Info("Deleted unused volume restored from deleted backup")
+		}
+		if err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		// the next item of the backup retries the cleanup
+		return errors.Errorf("error cleaning up snapshots: %s", strings.Join(errs, "; "))
+	}
+
+	cleanedBackupsLock.Lock()
+	cleanedBackups[key] = true
+	cleanedBackupsLock.Unlock()
+	return nil
+}
+
+// snapshotter returns the snapshotter deleting the snapshots of a location,
+// building it when first needed or when the location's config changed. Only
+// the location's credentials and compute client are loaded, so none of the
+// watchers and monitors Init starts run for the cleanup, and the compute
+// client is shared with the location's other snapshotters.
+func (a *SnapshotCleanupAction) snapshotter(location api.VolumeSnapshotLocation) (*VolumeSnapshotter, error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if cached := a.snapshotters[location.Name]; cached != nil && reflect.DeepEqual(cached.config, location.Spec.Config) {
+		return cached.snapshotter, nil
+	}
+
+	config := location.Spec.Config
+	b := newVolumeSnapshotter(a.log.WithField("volumeSnapshotLocation", location.Name))
+	b.cluster, b.config = a.cluster, config
+	credentials, err := newLocationCredentials(b.secrets, config, volumeSnapshotterCredentialsEnvVar)
+	if err != nil {
+		return nil, err
+	}
+	scopes := parseScopes(config, compute.ComputeScope)
+	creds, err := credentials.find(context.TODO(), scopes...)
+	if err != nil {
+		return nil, err
+	}
+	endpoint, err := locationEndpoint(config, b.log)
+	if err != nil {
+		return nil, err
+	}
+	key := locationKey("VolumeSnapshotLocation", config, endpoint, credentials)
+	gce, err := locationClients.get(key, computeService, func() (interface{}, error) {
+		return b.newComputeService(withLocationKey(context.TODO(), key), credentials, endpoint, scopes)
+	})
+	if err != nil {
+		return nil, err
+	}
+	b.useClients(&snapshotterClients{credentials: credentials, clientsKey: key, gce: gce.(*compute.Service)})
+	if err := b.setProjects(config, creds); err != nil {
+		return nil, err
+	}
+
+	a.snapshotters[location.Name] = &cleanupSnapshotter{config: config, snapshotter: b}
+	return b, nil
+}
@@ -0,0 +1,117 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	api "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	"github.com/vmware-tanzu/velero/pkg/plugin/velero"
+	"google.golang.org/api/compute/v1"
+	"google.golang.org/api/option"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	velerotest "github.com/vmware-tanzu/velero/pkg/test"
+)
+
+func newFakeComputeService(t *testing.T, handler http.HandlerFunc) *compute.Service {
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+
+	gce, err := compute.NewService(context.Background(), option.WithEndpoint(server.URL), option.WithoutAuthentication())
+	require.NoError(t, err)
+	return gce
+}
+
+func TestSnapshotLabels(t *testing.T) {
+	assert.Nil(t, snapshotLabels(nil))
+	assert.Equal(t,
+		map[string]string{backupLabel: "nightly-2021-10-01", pvLabel: "pvc-1"},
+		snapshotLabels(map[string]string{backupNameTag: "Nightly-2021.10.01", pvNameTag: "pvc-1"}),
+	)
+	assert.Equal(t, "a-b-c", sanitizeLabelValue("a.b/c"))
+	assert.Len(t, sanitizeLabelValue(strings.Repeat("a", 100)), maxLabelValueLength)
+}
+
+func TestDeleteBackupSnapshots(t *testing.T) {
+	var deleted []string
+	gce := newFakeComputeService(t, func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodGet && strings.HasSuffix(r.URL.Path, "/projects/snapshot-project/global/snapshots"):
+			assert.Equal(t, `labels.velero-backup="nightly"`, r.URL.Query().Get("filter"))
+			json.NewEncoder(w).Encode(&compute.SnapshotList{Items: []*compute.Snapshot{
+				{Name: "recorded", Description: `{"velero.io/backup":"nightly"}`},
+				{Name: "leaked", Description: `{"velero.io/backup":"nightly"}`},
+				{Name: "other-backup", Description: `{"velero.io/backup":"NIGHTLY"}`},
+				{Name: "gone", Description: `{"velero.io/backup":"nightly"}`},
+			}})
+		case r.Method == http.MethodDelete && strings.HasSuffix(r.URL.Path, "/snapshots/gone"):
+			w.WriteHeader(http.StatusNotFound)
+		case r.Method == http.MethodDelete:
+			deleted = append(deleted, r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:])
+			json.NewEncoder(w).Encode(&compute.Operation{})
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	})
+
+	b := (&VolumeSnapshotter{log: velerotest.NewLogger(), snapshotProject: "snapshot-project"}).withClients(&snapshotterClients{gce: gce})
+	names, err := b.deleteBackupSnapshots("nightly")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"recorded", "leaked"}, names)
+	assert.Equal(t, []string{"recorded", "leaked"}, deleted)
+}
+
+// locationReads counts the reads of a cluster's VolumeSnapshotLocations,
+// failing the first.
+type locationReads struct {
+	*fakeCluster
+	reads int
+}
+
+func (c *locationReads) volumeSnapshotLocations() ([]api.VolumeSnapshotLocation, error) {
+	c.reads++
+	if c.reads == 1 {
+		return nil, errors.New("locations unavailable")
+	}
+	return c.fakeCluster.volumeSnapshotLocations()
+}
+
+func TestSnapshotCleanupActionExecute(t *testing.T) {
+	cluster := &locationReads{fakeCluster: &fakeCluster{snapshotLocations: []api.VolumeSnapshotLocation{
+		{ObjectMeta: metav1.ObjectMeta{Name: "aws"}, Spec: api.VolumeSnapshotLocationSpec{Provider: "aws"}},
+	}}}
+
+	action := &SnapshotCleanupAction{log: velerotest.NewLogger(), cluster: cluster, snapshotters: make(map[string]*cleanupSnapshotter)}
+	selector, err := action.AppliesTo()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"persistentvolumes"}, selector.IncludedResources)
+
+	backup := &api.Backup{ObjectMeta: metav1.ObjectMeta{Namespace: "velero", Name: "nightly", UID: "uid-1"}}
+	assert.Error(t, action.Execute(&velero.DeleteItemActionExecuteInput{Backup: backup}))
+	require.NoError(t, action.Execute(&velero.DeleteItemActionExecuteInput{Backup: backup}), "a failed cleanup is retried")
+	require.NoError(t, action.Execute(&velero.DeleteItemActionExecuteInput{Backup: backup}))
+	assert.Equal(t, 2, cluster.reads, "snapshots are cleaned up once per backup")
+}
@@ -0,0 +1,410 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/pflag"
+	api "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	"google.golang.org/api/compute/v1"
+)
+
+// Snapshot management commands run instead of the plugin server, e.g. from a
+// Job or CronJob using the Velero image and service account:
+// `/plugins/velero-plugin-for-gcp gc-orphans --location default --delete`.
+const (
+	listSnapshotsCommand = "list-snapshots"
+	gcOrphansCommand     = "gc-orphans"
+	verifyBackupCommand  = "verify-backup"
+	migrateLabelsCommand = "migrate-snapshot-labels"
+
+	defaultOrphanMinAge = 24 * time.Hour
+)
+
+// pluginSnapshot is a snapshot created by the plugin.
+type pluginSnapshot struct {
+	name    string
+	backup  string
+	pv      string
+	status  string
+	sizeGB  int64
+	created time.Time
+	// retainUntil is the time until which the snapshot is retained, zero
+	// if it isn't.
+	retainUntil time.Time
+}
+
+// backups returns the Velero backups in Velero's namespace.
+func (inCluster) backups() ([]api.Backup, error) {
+	client, err := newInClusterClient()
+	if err != nil {
+		return nil, err
+	}
+	return client.listBackups(veleroNamespace())
+}
+
+// snapshotCommandFlags are the flags shared by the snapshot commands, which
+// choose the VolumeSnapshotLocation whose snapshots to manage.
+type snapshotCommandFlags struct {
+	location string
+	config   map[string]string
+}
+
+func (f *snapshotCommandFlags) bind(flags *pflag.FlagSet) {
+	flags.StringVar(&f.location, "location", "", "name of the VolumeSnapshotLocation to use the config of")
+	flags.StringToStringVar(&f.config, "config", nil, "VolumeSnapshotLocation config, when not using --location, e.g. project=my-project,credentialsFile=/credentials/cloud")
+}
+
+// volumeSnapshotter returns a volume snapshotter initialized with the
+// location's config, like Velero does.
+func (f *snapshotCommandFlags) volumeSnapshotter() (*VolumeSnapshotter, error) {
+	logger := logrus.New()
+	logger.SetOutput(os.Stderr)
+	b := newVolumeSnapshotter(logger)
+
+	config := f.config
+	if f.location != "" {
+		locations, err := b.cluster.volumeSnapshotLocations()
+		if err != nil {
+			return nil, err
+		}
+		found := false
+		for _, location := range locations {
+			if location.Name == f.location {
+				config, found = location.Spec.Config, true
+			}
+		}
+		if !found {
+			return nil, errors.Errorf("VolumeSnapshotLocation %s not found in namespace %s", f.location, veleroNamespace())
+		}
+	}
+
+	if err := b.Init(config); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// listPluginSnapshots returns the snapshots in a project the plugin created,
+// or only those of one backup if backup isn't empty, sorted by creation
+// time. Snapshots are recognized by the tags in their description, which
+// older snapshots without labels also have.
+func listPluginSnapshots(gce *compute.Service, project, backup string) ([]pluginSnapshot, error) {
+	var snapshots []pluginSnapshot
+	err := gce.Snapshots.List(project).Pages(context.Background(), func(page *compute.SnapshotList) error {
+		for _, snapshot := range page.Items {
+			var tags map[string]string
+			if err := json.Unmarshal([]byte(snapshot.Description), &tags); err != nil || tags[backupNameTag] == "" {
+				continue
+			}
+			if backup != "" && tags[backupNameTag] != backup {
+				continue
+			}
+			created, _ := time.Parse(time.RFC3339, snapshot.CreationTimestamp)
+			retainUntil, _ := retainedUntil(snapshot.Labels)
+			snapshots = append(snapshots, pluginSnapshot{
+				name:        snapshot.Name,
+				backup:      tags[backupNameTag],
+				pv:          tags[pvNameTag],
+				status:      snapshot.Status,
+				sizeGB:      snapshot.DiskSizeGb,
+				created:     created,
+				retainUntil: retainUntil,
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "error listing snapshots in project %s", project)
+	}
+	sort.SliceStable(snapshots, func(i, j int) bool { return snapshots[i].created.Before(snapshots[j].created) })
+	return snapshots, nil
+}
+
+func writeSnapshots(w io.Writer, snapshots []pluginSnapshot) {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAME\tBACKUP\tPERSISTENT VOLUME\tSTATUS\tSIZE (GB)\tCREATED")
+	for _, s := range snapshots {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%d\t%s\n", s.name, s.backup, s.pv, s.status, s.sizeGB, s.created.Format(time.RFC3339))
+	}
+	tw.Flush()
+}
+
+// orphanedSnapshots returns the snapshots of backups that don't exist
+// anymore and that are older than minAge, which leaves alone the snapshots
+// of backups still being created or synced from object storage, and that
+// aren't retained anymore.
+func orphanedSnapshots(snapshots []pluginSnapshot, backups []api.Backup, minAge time.Duration, now time.Time) []pluginSnapshot {
+	existing := make(map[string]bool, len(backups))
+	for _, backup := range backups {
+		existing[backup.Name] = true
+	}
+
+	var orphans []pluginSnapshot
+	for _, s := range snapshots {
+		if !existing[s.backup] && now.Sub(s.created) >= minAge && !now.Before(s.retainUntil) {
+			orphans = append(orphans, s)
+		}
+	}
+	return orphans
+}
+
+// verifyBackupSnapshots returns the problems with the snapshots of a backup:
+// snapshots that aren't ready and snapshots missing compared to the number
+// Velero recorded as completed.
+func verifyBackupSnapshots(backup *api.Backup, snapshots []pluginSnapshot) []string {
+	var problems []string
+	ready := 0
+	for _, s := range snapshots {
+		if s.status != "READY" {
+			problems = append(problems, fmt.Sprintf("snapshot %s of persistent volume %s is %s", s.name, s.pv, s.status))
+			continue
+		}
+		ready++
+	}
+	if completed := backup.Status.VolumeSnapshotsCompleted; ready < completed {
+		problems = append(problems, fmt.Sprintf("backup %s completed %d snapshots but only %d are ready", backup.Name, completed, ready))
+	}
+	return problems
+}
+
+// migrateSnapshotLabels adds the labels identifying the backup and
+// persistent volume of a snapshot to the snapshots the plugin created before
+// it labeled them, using the tags in their description. It returns the names
+// of the snapshots that were, or with dryRun would be, labeled.
+func migrateSnapshotLabels(gce *compute.Service, project string, dryRun bool) ([]string, error) {
+	var snapshots []*compute.Snapshot
+	err := gce.Snapshots.List(project).Pages(context.Background(), func(page *compute.SnapshotList) error {
+		snapshots = append(snapshots, page.Items...)
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "error listing snapshots in project %s", project)
+	}
+
+	var migrated []string
+	for _, snapshot := range snapshots {
+		var tags map[string]string
+		if err := json.Unmarshal([]byte(snapshot.Description), &tags); err != nil || tags[backupNameTag] == "" {
+			continue
+		}
+
+		labels := make(map[string]string, len(snapshot.Labels)+2)
+		for k, v := range snapshot.Labels {
+			labels[k] = v
+		}
+		changed := false
+		for k, v := range snapshotLabels(tags) {
+			if labels[k] != v {
+				labels[k] = v
+				changed = true
+			}
+		}
+		if !changed {
+			continue
+		}
+
+		if !dryRun {
+			req := &compute.GlobalSetLabelsRequest{Labels: labels, LabelFingerprint: snapshot.LabelFingerprint}
+			if _, err := gce.Snapshots.SetLabels(project, snapshot.Name, req).Do(); err != nil {
+				return migrated, errors.Wrapf(err, "error labeling snapshot %s", snapshot.Name)
+			}
+		}
+		migrated = append(migrated, snapshot.Name)
+	}
+	return migrated, nil
+}
+
+// runListSnapshots prints the snapshots the plugin created.
+func runListSnapshots(args []string, out io.Writer) int {
+	flags := pflag.NewFlagSet(listSnapshotsCommand, pflag.ContinueOnError)
+	flags.SetOutput(out)
+	var (
+		location snapshotCommandFlags
+		backup   string
+	)
+	location.bind(flags)
+	flags.StringVar(&backup, "backup", "", "only list the snapshots of this backup")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	b, err := location.volumeSnapshotter()
+	if err != nil {
+		fmt.Fprintln(out, err)
+		return 1
+	}
+	snapshots, err := listPluginSnapshots(b.clients().gce, b.snapshotProject, backup)
+	if err != nil {
+		fmt.Fprintln(out, err)
+		return 1
+	}
+	writeSnapshots(out, snapshots)
+	return 0
+}
+
+// runGCOrphans prints, and with --delete deletes, the snapshots of backups
+// that don't exist anymore.
+func runGCOrphans(args []string, out io.Writer) int {
+	flags := pflag.NewFlagSet(gcOrphansCommand, pflag.ContinueOnError)
+	flags.SetOutput(out)
+	var (
+		location snapshotCommandFlags
+		minAge   time.Duration
+		remove   bool
+	)
+	location.bind(flags)
+	flags.DurationVar(&minAge, "min-age", defaultOrphanMinAge, "only consider snapshots older than this")
+	flags.BoolVar(&remove, "delete", false, "delete the orphaned snapshots instead of only listing them")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	b, err := location.volumeSnapshotter()
+	if err != nil {
+		fmt.Fprintln(out, err)
+		return 1
+	}
+	snapshots, err := listPluginSnapshots(b.clients().gce, b.snapshotProject, "")
+	if err != nil {
+		fmt.Fprintln(out, err)
+		return 1
+	}
+	backups, err := b.cluster.backups()
+	if err != nil {
+		fmt.Fprintln(out, err)
+		return 1
+	}
+
+	orphans := orphanedSnapshots(snapshots, backups, minAge, time.Now())
+	writeSnapshots(out, orphans)
+	if !remove {
+		return 0
+	}
+
+	code := 0
+	for _, s := range orphans {
+		if err := b.DeleteSnapshot(s.name); err != nil {
+			fmt.Fprintf(out, "error deleting snapshot %s: %v\n", s.name, err)
+			code = 1
+			continue
+		}
+		fmt.Fprintf(out, "deleted snapshot %s\n", s.name)
+	}
+	return code
+}
+
+// runVerifyBackup checks that the snapshots of a backup exist and are ready.
+func runVerifyBackup(args []string, out io.Writer) int {
+	flags := pflag.NewFlagSet(verifyBackupCommand, pflag.ContinueOnError)
+	flags.SetOutput(out)
+	var (
+		location snapshotCommandFlags
+		name     string
+	)
+	location.bind(flags)
+	flags.StringVar(&name, "backup", "", "name of the backup to verify")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if name == "" {
+		fmt.Fprintln(out, "--backup is required")
+		return 2
+	}
+
+	backups, err := inCluster{}.backups()
+	if err != nil {
+		fmt.Fprintln(out, err)
+		return 1
+	}
+	var backup *api.Backup
+	for i := range backups {
+		if backups[i].Name == name {
+			backup = &backups[i]
+		}
+	}
+	if backup == nil {
+		fmt.Fprintf(out, "backup %s not found\n", name)
+		return 1
+	}
+
+	b, err := location.volumeSnapshotter()
+	if err != nil {
+		fmt.Fprintln(out, err)
+		return 1
+	}
+	snapshots, err := listPluginSnapshots(b.clients().gce, b.snapshotProject, name)
+	if err != nil {
+		fmt.Fprintln(out, err)
+		return 1
+	}
+	writeSnapshots(out, snapshots)
+
+	problems := verifyBackupSnapshots(backup, snapshots)
+	for _, problem := range problems {
+		fmt.Fprintln(out, problem)
+	}
+	if len(problems) > 0 {
+		return 1
+	}
+	return 0
+}
+
+// runMigrateLabels labels the snapshots the plugin created before it labeled
+// snapshots, so they can be found by backup, e.g. to be cleaned up.
+func runMigrateLabels(args []string, out io.Writer) int {
+	flags := pflag.NewFlagSet(migrateLabelsCommand, pflag.ContinueOnError)
+	flags.SetOutput(out)
+	var (
+		location snapshotCommandFlags
+		dryRun   bool
+	)
+	location.bind(flags)
+	flags.BoolVar(&dryRun, "dry-run", false, "only list the snapshots that would be labeled")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	b, err := location.volumeSnapshotter()
+	if err != nil {
+		fmt.Fprintln(out, err)
+		return 1
+	}
+	migrated, err := migrateSnapshotLabels(b.clients().gce, b.snapshotProject, dryRun)
+	verb := "labeled"
+	if dryRun {
+		verb = "would label"
+	}
+	for _, name := range migrated {
+		fmt.Fprintf(out, "%s snapshot %s\n", verb, name)
+	}
+	if err != nil {
+		fmt.Fprintln(out, err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,131 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	api "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	"google.golang.org/api/compute/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestListPluginSnapshots(t *testing.T) {
+	gce := newFakeComputeService(t, func(w http.ResponseWriter, r *http.Request) {
+		require.True(t, strings.HasSuffix(r.URL.Path, "/projects/snapshot-project/global/snapshots"))
+		json.NewEncoder(w).Encode(&compute.SnapshotList{Items: []*compute.Snapshot{
+			{Name: "new", Description: `{"velero.io/backup":"nightly","velero.io/pv":"pvc-2"}`, Status: "READY", DiskSizeGb: 20, CreationTimestamp: "2021-10-02T00:00:00Z"},
+			{Name: "manual", Description: "taken by hand"},
+			{Name: "old", Description: `{"velero.io/backup":"weekly","velero.io/pv":"pvc-1"}`, Status: "READY", DiskSizeGb: 10, CreationTimestamp: "2021-10-01T00:00:00Z"},
+		}})
+	})
+
+	snapshots, err := listPluginSnapshots(gce, "snapshot-project", "")
+	require.NoError(t, err)
+	assert.Equal(t, []pluginSnapshot{
+		{name: "old", backup: "weekly", pv: "pvc-1", status: "READY", sizeGB: 10, created: time.Date(2021, 10, 1, 0, 0, 0, 0, time.UTC)},
+		{name: "new", backup: "nightly", pv: "pvc-2", status: "READY", sizeGB: 20, created: time.Date(2021, 10, 2, 0, 0, 0, 0, time.UTC)},
+	}, snapshots)
+
+	snapshots, err = listPluginSnapshots(gce, "snapshot-project", "nightly")
+	require.NoError(t, err)
+	require.Len(t, snapshots, 1)
+	assert.Equal(t, "new", snapshots[0].name)
+
+	var out bytes.Buffer
+	writeSnapshots(&out, snapshots)
+	assert.Contains(t, out.String(), "new   nightly  pvc-2")
+}
+
+func TestOrphanedSnapshots(t *testing.T) {
+	now := time.Date(2021, 10, 3, 0, 0, 0, 0, time.UTC)
+	snapshots := []pluginSnapshot{
+		{name: "kept", backup: "nightly", created: now.Add(-48 * time.Hour)},
+		{name: "orphan", backup: "deleted", created: now.Add(-48 * time.Hour)},
+		{name: "recent", backup: "syncing", created: now.Add(-time.Hour)},
+		{name: "retained", backup: "deleted", created: now.Add(-48 * time.Hour), retainUntil: now.Add(time.Hour)},
+	}
+	backups := []api.Backup{{ObjectMeta: metav1.ObjectMeta{Name: "nightly"}}}
+
+	orphans := orphanedSnapshots(snapshots, backups, defaultOrphanMinAge, now)
+	require.Len(t, orphans, 1)
+	assert.Equal(t, "orphan", orphans[0].name)
+}
+
+func TestVerifyBackupSnapshots(t *testing.T) {
+	backup := &api.Backup{ObjectMeta: metav1.ObjectMeta{Name: "nightly"}, Status: api.BackupStatus{VolumeSnapshotsCompleted: 3}}
+	snapshots := []pluginSnapshot{
+		{name: "a", pv: "pvc-1", status: "READY"},
+		{name: "b", pv: "pvc-2", status: "FAILED"},
+	}
+
+	assert.Equal(t, []string{
+		"snapshot b of persistent volume pvc-2 is FAILED",
+		"backup nightly completed 3 snapshots but only 1 are ready",
+	}, verifyBackupSnapshots(backup, snapshots))
+
+	backup.Status.VolumeSnapshotsCompleted = 1
+	assert.Empty(t, verifyBackupSnapshots(backup, snapshots[:1]))
+}
+
+func TestSnapshotCommandFlags(t *testing.T) {
+	var out bytes.Buffer
+	assert.Equal(t, 2, runVerifyBackup(nil, &out))
+	assert.Contains(t, out.String(), "--backup is required")
+}
+
+func TestMigrateSnapshotLabels(t *testing.T) {
+	for _, dryRun := range []bool{true, false} {
+		var labeled []string
+		gce := newFakeComputeService(t, func(w http.ResponseWriter, r *http.Request) {
+			switch {
+			case r.Method == http.MethodGet && strings.HasSuffix(r.URL.Path, "/projects/snapshot-project/global/snapshots"):
+				json.NewEncoder(w).Encode(&compute.SnapshotList{Items: []*compute.Snapshot{
+					{Name: "legacy", Description: `{"velero.io/backup":"nightly.1","velero.io/pv":"pvc-1"}`, Labels: map[string]string{"team": "db"}, LabelFingerprint: "fp"},
+					{Name: "labeled", Description: `{"velero.io/backup":"nightly","velero.io/pv":"pvc-2"}`, Labels: map[string]string{backupLabel: "nightly", pvLabel: "pvc-2"}},
+					{Name: "manual", Description: "taken by hand"},
+				}})
+			case r.Method == http.MethodPost && strings.HasSuffix(r.URL.Path, "/snapshots/legacy/setLabels"):
+				req := new(compute.GlobalSetLabelsRequest)
+				require.NoError(t, json.NewDecoder(r.Body).Decode(req))
+				assert.Equal(t, map[string]string{"team": "db", backupLabel: "nightly-1", pvLabel: "pvc-1"}, req.Labels)
+				assert.Equal(t, "fp", req.LabelFingerprint)
+				labeled = append(labeled, "legacy")
+				json.NewEncoder(w).Encode(&compute.Operation{})
+			default:
+				t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+				http.NotFound(w, r)
+			}
+		})
+
+		migrated, err := migrateSnapshotLabels(gce, "snapshot-project", dryRun)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"legacy"}, migrated)
+		if dryRun {
+			assert.Empty(t, labeled)
+		} else {
+			assert.Equal(t, []string{"legacy"}, labeled)
+		}
+	}
+}
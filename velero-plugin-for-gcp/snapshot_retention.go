@@ -0,0 +1,146 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// minimumRetentionConfigKey is the key of a VolumeSnapshotLocation's
+	// config setting how long its snapshots are kept at least, whatever
+	// happens to their backups.
+	minimumRetentionConfigKey = "minimumRetention"
+
+	// retainUntilLabel is the snapshot label holding the Unix time until
+	// which the plugin refuses to delete the snapshot. It's a hint the
+	// plugin honors, not enforcement: whoever can delete or relabel the
+	// snapshot can ignore it.
+	retainUntilLabel = "velero-retain-until"
+)
+
+// snapshotRetention keeps snapshots for a minimum time after they're
+// created. Snapshots are labeled with the time they're retained until when
+// created, so the retention they were created with holds even if the
+// location's config changes, and every way the plugin deletes snapshots
+// refuses to delete them earlier.
+//
+// The label only stops deletions made through the plugin. Backups whose
+// retention must be enforced are stored in a backup vault instead, whose
+// enforced retention the plugin requires to cover the minimum retention.
+type snapshotRetention struct {
+	period time.Duration
+	now    func() time.Time
+}
+
+// newSnapshotRetention returns the minimum retention of the location's
+// snapshots, or nil if it has none.
+func newSnapshotRetention(config map[string]string) (*snapshotRetention, error) {
+	val, ok := config[minimumRetentionConfigKey]
+	if !ok {
+		return nil, nil
+	}
+	period, err := time.ParseDuration(val)
+	if err != nil || period <= 0 {
+		return nil, errors.Errorf("%s must be a positive duration, got %q", minimumRetentionConfigKey, val)
+	}
+	return &snapshotRetention{period: period, now: time.Now}, nil
+}
+
+// label adds the time a snapshot created now is retained until to its
+// labels.
+func (r *snapshotRetention) label(labels map[string]string) map[string]string {
+	if r == nil {
+		return labels
+	}
+	if labels == nil {
+		labels = make(map[string]string)
+	}
+	labels[retainUntilLabel] = strconv.FormatInt(r.now().Add(r.period).Unix(), 10)
+	return labels
+}
+
+// retainedUntil returns the time until which a snapshot with the given
+// labels is retained, and false if it isn't.
+func retainedUntil(labels map[string]string) (time.Time, bool) {
+	val, ok := labels[retainUntilLabel]
+	if !ok {
+		return time.Time{}, false
+	}
+	seconds, err := strconv.ParseInt(val, 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(seconds, 0).UTC(), true
+}
+
+// checkRetention returns an error if a snapshot with the given labels is
+// still retained.
+func checkRetention(snapshot string, labels map[string]string, now time.Time) error {
+	if until, ok := retainedUntil(labels); ok && now.Before(until) {
+		return errors.Errorf("snapshot %s is retained until %s by its location's %s", snapshot, until.Format(time.RFC3339), minimumRetentionConfigKey)
+	}
+	return nil
+}
+
+// checkEnforced returns an error if a backup vault backup's enforced
+// retention, as an RFC 3339 time, ends before the minimum retention of a
+// backup made now.
+func (r *snapshotRetention) checkEnforced(backup, enforcedRetentionEndTime string) error {
+	if r == nil {
+		return nil
+	}
+	until := r.now().Add(r.period)
+	end, err := time.Parse(time.RFC3339Nano, enforcedRetentionEndTime)
+	if err != nil {
+		return errors.Errorf("backup %s has no enforced retention, but its location's %s is %s; set the backup vault's minimum enforced retention", backup, minimumRetentionConfigKey, r.period)
+	}
+	if end.Before(until) {
+		return errors.Errorf("backup %s is only retained until %s by its backup vault, before its location's %s of %s ends at %s", backup, end.UTC().Format(time.RFC3339), minimumRetentionConfigKey, r.period, until.UTC().Format(time.RFC3339))
+	}
+	return nil
+}
+
+// checkSnapshotRetention returns an error if a snapshot is still retained.
+// The label a snapshot was created with is honored even if its location no
+// longer sets a minimum retention, which only decides the label of the
+// snapshots created, so removing it from the config doesn't release the
+// snapshots it retains.
+func (b *VolumeSnapshotter) checkSnapshotRetention(snapshotID string) error {
+	now := time.Now
+	if b.retention != nil {
+		now = b.retention.now
+	}
+	var labels map[string]string
+	err := retryTransient(b.sleep, func() error {
+		snapshot, err := b.getSnapshot(b.snapshotProject, snapshotID)
+		if err == nil {
+			labels = snapshot.Labels
+		}
+		return err
+	})
+	if isNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return errors.Wrapf(err, "error reading the retention of snapshot %s", snapshotID)
+	}
+	return checkRetention(snapshotID, labels, now())
+}
@@ -0,0 +1,117 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	velerotest "github.com/vmware-tanzu/velero/pkg/test"
+	"google.golang.org/api/compute/v1"
+)
+
+func TestNewSnapshotRetention(t *testing.T) {
+	retention, err := newSnapshotRetention(map[string]string{})
+	require.NoError(t, err)
+	assert.Nil(t, retention)
+	assert.Nil(t, retention.label(nil), "a nil retention doesn't label snapshots")
+
+	for _, val := range []string{"0s", "-1h", "a month"} {
+		_, err = newSnapshotRetention(map[string]string{minimumRetentionConfigKey: val})
+		assert.Error(t, err, val)
+	}
+
+	retention, err = newSnapshotRetention(map[string]string{minimumRetentionConfigKey: "720h"})
+	require.NoError(t, err)
+	now := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	retention.now = func() time.Time { return now }
+
+	labels := retention.label(map[string]string{backupLabel: "nightly"})
+	assert.Equal(t, map[string]string{backupLabel: "nightly", retainUntilLabel: "1612051200"}, labels)
+	until, ok := retainedUntil(labels)
+	assert.True(t, ok)
+	assert.Equal(t, now.Add(720*time.Hour), until)
+
+	assert.Error(t, checkRetention("snap", labels, now.Add(719*time.Hour)))
+	assert.NoError(t, checkRetention("snap", labels, now.Add(720*time.Hour)))
+	assert.NoError(t, checkRetention("snap", nil, now))
+	assert.NoError(t, checkRetention("snap", map[string]string{retainUntilLabel: "soon"}, now))
+
+	// backup vault backups must be retained by the vault at least as long
+	assert.NoError(t, retention.checkEnforced("backup", now.Add(720*time.Hour).Format(time.RFC3339)))
+	assert.EqualError(t, retention.checkEnforced("backup", now.Add(24*time.Hour).Format(time.RFC3339)),
+		"backup backup is only retained until 2021-01-02T00:00:00Z by its backup vault, before its location's minimumRetention of 720h0m0s ends at 2021-01-31T00:00:00Z")
+	assert.Error(t, retention.checkEnforced("backup", ""))
+	assert.NoError(t, (*snapshotRetention)(nil).checkEnforced("backup", ""))
+}
+
+func TestDeleteRetainedSnapshot(t *testing.T) {
+	now := time.Now()
+	retainUntil := strconv.FormatInt(now.Add(time.Hour).Unix(), 10)
+	var deleted []string
+	gce := newFakeComputeService(t, func(w http.ResponseWriter, r *http.Request) {
+		name := r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:]
+		switch {
+		case r.Method == http.MethodGet && strings.HasSuffix(r.URL.Path, "/global/snapshots"):
+			json.NewEncoder(w).Encode(&compute.SnapshotList{Items: []*compute.Snapshot{
+				{Name: "retained", Description: `{"velero.io/backup":"nightly"}`, Labels: map[string]string{retainUntilLabel: retainUntil}},
+			}})
+		case r.Method == http.MethodGet && name == "retained":
+			json.NewEncoder(w).Encode(&compute.Snapshot{Name: name, Labels: map[string]string{retainUntilLabel: retainUntil}})
+		case r.Method == http.MethodGet && name == "expired":
+			json.NewEncoder(w).Encode(&compute.Snapshot{Name: name, Labels: map[string]string{retainUntilLabel: "1"}})
+		case r.Method == http.MethodGet:
+			w.WriteHeader(http.StatusNotFound)
+		case r.Method == http.MethodDelete:
+			deleted = append(deleted, name)
+			json.NewEncoder(w).Encode(&compute.Operation{})
+		}
+	})
+	b := (&VolumeSnapshotter{
+		log:             velerotest.NewLogger(),
+		snapshotProject: "p",
+		retention:       &snapshotRetention{period: time.Hour, now: time.Now},
+	}).withClients(&snapshotterClients{
+		gce: gce,
+	})
+
+	_, err := b.deleteSnapshot("retained")
+	assert.Error(t, err)
+	_, err = b.deleteSnapshot("expired")
+	require.NoError(t, err)
+	_, err = b.deleteSnapshot("gone")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"expired", "gone"}, deleted)
+
+	// snapshots of deleted backups are retained too
+	_, err = b.deleteBackupSnapshots("nightly")
+	assert.Error(t, err)
+	assert.Equal(t, []string{"expired", "gone"}, deleted)
+
+	// snapshots stay retained when the location's minimumRetention is
+	// removed
+	b.retention = nil
+	_, err = b.deleteSnapshot("retained")
+	assert.Error(t, err)
+	assert.Equal(t, []string{"expired", "gone"}, deleted)
+}
@@ -0,0 +1,163 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// maxSnapshotsPerInstanceConfigKey is the key of a VolumeSnapshotLocation's
+// config limiting how many snapshots of disks attached to the same VM are
+// created at once. GCE fails snapshot operations beyond its per-instance
+// limits, which backups of dense nodes with many attached disks hit.
+const maxSnapshotsPerInstanceConfigKey = "maxSnapshotsPerInstance"
+
+var (
+	// snapshotThrottlePollInterval is how often the snapshots holding up a
+	// new one are checked. It is a variable so tests can shorten it.
+	snapshotThrottlePollInterval = 5 * time.Second
+
+	// snapshotThrottleTimeout is how long a snapshot waits for the others of
+	// its instance before it's created anyway.
+	snapshotThrottleTimeout = 10 * time.Minute
+)
+
+// snapshotStatusGetter returns the status of a snapshot.
+type snapshotStatusGetter func(name string) (string, error)
+
+// instanceSnapshotThrottle limits the snapshots being created of the disks
+// attached to each instance. Velero has no way to group the volumes of a VM
+// before they are snapshotted, so the throttle delays each snapshot until
+// fewer than the maximum of those the snapshotter started for the disk's
+// instances are still being created. Each VolumeSnapshotter has its own
+// throttle, so the limit only applies within a plugin process: snapshots
+// created by other Velero servers, or by other plugin processes, aren't
+// counted.
+type instanceSnapshotThrottle struct {
+	log    logrus.FieldLogger
+	max    int
+	status snapshotStatusGetter
+	now    func() time.Time
+	sleep  func(time.Duration)
+
+	lock sync.Mutex
+	// pending are the snapshots started of the disks of each instance, by
+	// instance URL.
+	pending map[string][]string
+}
+
+func newInstanceSnapshotThrottle(log logrus.FieldLogger, max int, status snapshotStatusGetter) *instanceSnapshotThrottle {
+	return &instanceSnapshotThrottle{
+		log:     log,
+		max:     max,
+		status:  status,
+		now:     time.Now,
+		sleep:   time.Sleep,
+		pending: make(map[string][]string),
+	}
+}
+
+// wait blocks until a snapshot of a disk attached to the given instances can
+// be created. It gives up waiting after snapshotThrottleTimeout, letting GCE
+// decide. The lock is released while sleeping, so waiting for a busy
+// instance doesn't hold up snapshots of other instances or recording the
+// snapshots that were started.
+func (t *instanceSnapshotThrottle) wait(instances []string) {
+	if t == nil || len(instances) == 0 {
+		return
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	deadline := t.now().Add(snapshotThrottleTimeout)
+	for waited := false; ; waited = true {
+		busy := ""
+		for _, instance := range instances {
+			t.prune(instance)
+			if len(t.pending[instance]) >= t.max {
+				busy = instance
+			}
+		}
+		if busy == "" {
+			return
+		}
+		if !waited {
+			pluginMetrics.addCounter(snapshotThrottleCounter, "Number of snapshots delayed by the per-instance snapshot limit.", nil, 1)
+		}
+		if !t.now().Before(deadline) {
+			t.log.WithField("instance", busy).Warnf("Snapshots of the instance's disks are still being created after %s, creating the snapshot anyway", snapshotThrottleTimeout)
+			return
+		}
+		t.log.WithField("instance", busy).Debugf("Waiting for %d snapshots of the instance's disks to be created", len(t.pending[busy]))
+		t.lock.Unlock()
+		t.sleep(snapshotThrottlePollInterval)
+		t.lock.Lock()
+	}
+}
+
+// prune forgets the snapshots of an instance that aren't being created
+// anymore.
+func (t *instanceSnapshotThrottle) prune(instance string) {
+	var creating []string
+	for _, name := range t.pending[instance] {
+		status, err := t.status(name)
+		if isNotFound(err) {
+			continue
+		}
+		if err != nil {
+			// keep waiting for snapshots whose status is unknown, until the
+			// timeout
+			t.log.WithError(err).WithField("snapshot", name).Debug("Unable to get the status of the snapshot")
+			creating = append(creating, name)
+			continue
+		}
+		if status == "CREATING" {
+			creating = append(creating, name)
+		}
+	}
+	if len(creating) == 0 {
+		delete(t.pending, instance)
+		return
+	}
+	t.pending[instance] = creating
+}
+
+// started records a snapshot being created of a disk attached to the given
+// instances.
+func (t *instanceSnapshotThrottle) started(instances []string, snapshot string) {
+	if t == nil {
+		return
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	for _, instance := range instances {
+		t.pending[instance] = append(t.pending[instance], snapshot)
+	}
+}
+
+// snapshotStatus returns the status of a snapshot in the snapshot project.
+func (b *VolumeSnapshotter) snapshotStatus(name string) (string, error) {
+	snapshot, err := b.clients().gce.Snapshots.Get(b.snapshotProject, name).Do()
+	if err != nil {
+		return "", err
+	}
+	return snapshot.Status, nil
+}
@@ -0,0 +1,120 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/api/googleapi"
+
+	velerotest "github.com/vmware-tanzu/velero/pkg/test"
+)
+
+func TestInstanceSnapshotThrottle(t *testing.T) {
+	const vm1, vm2 = "zones/us-central1-a/instances/vm-1", "zones/us-central1-a/instances/vm-2"
+
+	statuses := map[string]string{}
+	throttle := newInstanceSnapshotThrottle(velerotest.NewLogger(), 2, func(name string) (string, error) {
+		status, ok := statuses[name]
+		if !ok {
+			return "", &googleapi.Error{Code: http.StatusNotFound}
+		}
+		return status, nil
+	})
+	now := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	throttle.now = func() time.Time { return now }
+	sleeps := 0
+	throttle.sleep = func(d time.Duration) {
+		sleeps++
+		now = now.Add(d)
+		// the first snapshot completes while waiting
+		statuses["snap-1"] = "UPLOADING"
+	}
+
+	statuses["snap-1"], statuses["snap-2"] = "CREATING", "CREATING"
+	throttle.wait([]string{vm1})
+	throttle.started([]string{vm1}, "snap-1")
+	throttle.wait([]string{vm1})
+	throttle.started([]string{vm1}, "snap-2")
+	assert.Equal(t, 0, sleeps)
+
+	// disks of other instances aren't held up
+	throttle.wait([]string{vm2})
+	assert.Equal(t, 0, sleeps)
+
+	// the third snapshot of vm-1 waits for the first to be created
+	throttle.wait([]string{vm1, vm2})
+	assert.Equal(t, 1, sleeps)
+	assert.Equal(t, []string{"snap-2"}, throttle.pending[vm1])
+
+	// deleted snapshots don't hold up others
+	throttle.started([]string{vm1}, "snap-3")
+	statuses["snap-3"] = "CREATING"
+	delete(statuses, "snap-2")
+	throttle.wait([]string{vm1})
+	assert.Equal(t, 1, sleeps)
+	assert.Equal(t, []string{"snap-3"}, throttle.pending[vm1])
+}
+
+func TestInstanceSnapshotThrottleTimeout(t *testing.T) {
+	throttle := newInstanceSnapshotThrottle(velerotest.NewLogger(), 1, func(string) (string, error) { return "CREATING", nil })
+	now := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	throttle.now = func() time.Time { return now }
+	sleeps := 0
+	throttle.sleep = func(d time.Duration) {
+		sleeps++
+		now = now.Add(d)
+	}
+
+	throttle.started([]string{"vm"}, "stuck")
+	throttle.wait([]string{"vm"})
+	assert.Equal(t, int(snapshotThrottleTimeout/snapshotThrottlePollInterval), sleeps)
+}
+
+func TestInstanceSnapshotThrottleDisabled(t *testing.T) {
+	var throttle *instanceSnapshotThrottle
+	throttle.wait([]string{"vm"})
+	throttle.started([]string{"vm"}, "snap")
+}
+
+func TestInstanceSnapshotThrottleReleasesLock(t *testing.T) {
+	statuses := map[string]string{"busy": "CREATING"}
+	throttle := newInstanceSnapshotThrottle(velerotest.NewLogger(), 1, func(name string) (string, error) {
+		status, ok := statuses[name]
+		if !ok {
+			return "", &googleapi.Error{Code: http.StatusNotFound}
+		}
+		return status, nil
+	})
+	sleeps := 0
+	throttle.sleep = func(time.Duration) {
+		sleeps++
+		// snapshots of other instances are started while a busy one waits,
+		// which would deadlock if the lock were held
+		throttle.wait([]string{"other"})
+		throttle.started([]string{"other"}, "other-snap")
+		statuses["busy"] = "READY"
+	}
+
+	throttle.started([]string{"vm"}, "busy")
+	throttle.wait([]string{"vm"})
+	assert.Equal(t, 1, sleeps)
+	assert.Equal(t, []string{"other-snap"}, throttle.pending["other"])
+}
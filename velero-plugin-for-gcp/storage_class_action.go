@@ -0,0 +1,236 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"reflect"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/vmware-tanzu/velero/pkg/plugin/framework"
+	"github.com/vmware-tanzu/velero/pkg/plugin/velero"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	storageClassRegionActionName = "velero.io/gcp-storage-class-region"
+
+	// regionsConfigKey and zonesConfigKey are the keys of the action's
+	// ConfigMap holding YAML maps of source to destination regions and
+	// zones.
+	regionsConfigKey = "regions"
+	zonesConfigKey   = "zones"
+
+	regionLabel     = "topology.kubernetes.io/region"
+	betaRegionLabel = "failure-domain.beta.kubernetes.io/region"
+	gkeZoneLabel    = "topology.gke.io/zone"
+
+	kmsKeyParameter = "disk-encryption-kms-key"
+)
+
+// zoneParameters are the StorageClass parameters of the GCP provisioners
+// holding zones, as comma-separated lists.
+var zoneParameters = []string{"zone", "zones"}
+
+// StorageClassRegionAction is a restore item action that moves the zones
+// and regions restored StorageClasses refer to, in their allowed topologies
+// and parameters, to the destination region, so PVCs of a region migration
+// don't stay pending.
+type StorageClassRegionAction struct {
+	log     logrus.FieldLogger
+	cluster veleroCluster
+
+	once      sync.Once
+	mapping   regionMapping
+	configErr error
+}
+
+// regionMapping maps zones and regions. Zones that aren't mapped
+// individually keep their suffix in the region they're mapped to, e.g.
+// us-central1-a becomes europe-west1-a when mapping us-central1 to
+// europe-west1.
+type regionMapping struct {
+	regions map[string]string
+	zones   map[string]string
+}
+
+func newStorageClassRegionAction(logger logrus.FieldLogger) (interface{}, error) {
+	return &StorageClassRegionAction{log: logger, cluster: inCluster{}}, nil
+}
+
+func (a *StorageClassRegionAction) AppliesTo() (velero.ResourceSelector, error) {
+	return velero.ResourceSelector{
+		IncludedResources: []string{"storageclasses"},
+	}, nil
+}
+
+func (a *StorageClassRegionAction) loadConfig() (regionMapping, error) {
+	a.once.Do(func() {
+		var data map[string]string
+		data, a.configErr = a.cluster.pluginConfig(framework.PluginKindRestoreItemAction, storageClassRegionActionName)
+		if a.configErr != nil {
+			return
+		}
+		a.mapping, a.configErr = parseRegionMapping(data, storageClassRegionActionName)
+	})
+	return a.mapping, a.configErr
+}
+
+// parseRegionMapping parses the regions and zones in the ConfigMap of an
+// action.
+func parseRegionMapping(data map[string]string, action string) (regionMapping, error) {
+	var m regionMapping
+	if err := yaml.Unmarshal([]byte(data[regionsConfigKey]), &m.regions); err != nil {
+		return m, errors.Wrapf(err, "error parsing %s in the %s ConfigMap", regionsConfigKey, action)
+	}
+	if err := yaml.Unmarshal([]byte(data[zonesConfigKey]), &m.zones); err != nil {
+		return m, errors.Wrapf(err, "error parsing %s in the %s ConfigMap", zonesConfigKey, action)
+	}
+	return m, nil
+}
+
+func (m regionMapping) empty() bool {
+	return len(m.regions) == 0 && len(m.zones) == 0
+}
+
+func (m regionMapping) region(region string) string {
+	if mapped, ok := m.regions[region]; ok {
+		return mapped
+	}
+	return region
+}
+
+func (m regionMapping) zone(zone string) string {
+	if mapped, ok := m.zones[zone]; ok {
+		return mapped
+	}
+	region, err := parseRegion(zone)
+	if err != nil || !strings.HasPrefix(zone, region) {
+		return zone
+	}
+	if mapped, ok := m.regions[region]; ok {
+		return mapped + strings.TrimPrefix(zone, region)
+	}
+	return zone
+}
+
+// kmsKey moves a Cloud KMS key name to the mapped region, for keys in a
+// regional location.
+func (m regionMapping) kmsKey(key string) string {
+	parts := strings.Split(key, "/")
+	for i := 0; i+1 < len(parts); i++ {
+		if parts[i] == "locations" {
+			parts[i+1] = m.region(parts[i+1])
+			break
+		}
+	}
+	return strings.Join(parts, "/")
+}
+
+func (a *StorageClassRegionAction) Execute(input *velero.RestoreItemActionExecuteInput) (*velero.RestoreItemActionExecuteOutput, error) {
+	obj := &unstructured.Unstructured{Object: input.Item.UnstructuredContent()}
+
+	mapping, err := a.loadConfig()
+	if err != nil {
+		return nil, err
+	}
+	if mapping.empty() {
+		return velero.NewRestoreItemActionExecuteOutput(obj), nil
+	}
+
+	original := obj.DeepCopy()
+
+	parameters, _, err := unstructured.NestedStringMap(obj.Object, "parameters")
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if len(parameters) > 0 {
+		for _, key := range zoneParameters {
+			if value, ok := parameters[key]; ok {
+				zones := parseList(value)
+				for i, zone := range zones {
+					zones[i] = mapping.zone(zone)
+				}
+				parameters[key] = strings.Join(zones, ",")
+			}
+		}
+		if key, ok := parameters[kmsKeyParameter]; ok {
+			parameters[kmsKeyParameter] = mapping.kmsKey(key)
+		}
+		if err := unstructured.SetNestedStringMap(obj.Object, parameters, "parameters"); err != nil {
+			return nil, errors.WithStack(err)
+		}
+	}
+
+	topologies, _, err := unstructured.NestedSlice(obj.Object, "allowedTopologies")
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	for _, topology := range topologies {
+		term, ok := topology.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		expressions, _, err := unstructured.NestedSlice(term, "matchLabelExpressions")
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		for _, expression := range expressions {
+			requirement, ok := expression.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			key, _, _ := unstructured.NestedString(requirement, "key")
+			values, _, err := unstructured.NestedStringSlice(requirement, "values")
+			if err != nil {
+				return nil, errors.WithStack(err)
+			}
+
+			var mapValue func(string) string
+			switch key {
+			case zoneLabel, betaZoneLabel, gkeZoneLabel:
+				mapValue = mapping.zone
+			case regionLabel, betaRegionLabel:
+				mapValue = mapping.region
+			default:
+				continue
+			}
+
+			mapped := make([]interface{}, 0, len(values))
+			for _, value := range values {
+				mapped = append(mapped, mapValue(value))
+			}
+			requirement["values"] = mapped
+		}
+		if err := unstructured.SetNestedSlice(term, expressions, "matchLabelExpressions"); err != nil {
+			return nil, errors.WithStack(err)
+		}
+	}
+	if len(topologies) > 0 {
+		if err := unstructured.SetNestedSlice(obj.Object, topologies, "allowedTopologies"); err != nil {
+			return nil, errors.WithStack(err)
+		}
+	}
+
+	if !reflect.DeepEqual(original.Object, obj.Object) {
+		a.log.Infof("Updated the zones and regions of StorageClass %s for the destination region", obj.GetName())
+	}
+	return velero.NewRestoreItemActionExecuteOutput(obj), nil
+}
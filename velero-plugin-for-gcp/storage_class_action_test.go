@@ -0,0 +1,96 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vmware-tanzu/velero/pkg/plugin/velero"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+
+	velerotest "github.com/vmware-tanzu/velero/pkg/test"
+)
+
+func TestRegionMapping(t *testing.T) {
+	m := regionMapping{
+		regions: map[string]string{"us-central1": "europe-west1"},
+		zones:   map[string]string{"us-central1-f": "europe-west1-d"},
+	}
+
+	assert.Equal(t, "europe-west1", m.region("us-central1"))
+	assert.Equal(t, "us-east1", m.region("us-east1"))
+	assert.Equal(t, "europe-west1-a", m.zone("us-central1-a"))
+	assert.Equal(t, "europe-west1-d", m.zone("us-central1-f"))
+	assert.Equal(t, "us-east1-b", m.zone("us-east1-b"))
+	assert.Equal(t,
+		"projects/kms/locations/europe-west1/keyRings/r/cryptoKeys/k",
+		m.kmsKey("projects/kms/locations/us-central1/keyRings/r/cryptoKeys/k"),
+	)
+	assert.Equal(t,
+		"projects/kms/locations/global/keyRings/r/cryptoKeys/k",
+		m.kmsKey("projects/kms/locations/global/keyRings/r/cryptoKeys/k"),
+	)
+}
+
+func TestStorageClassRegionActionExecute(t *testing.T) {
+	cluster := &fakeCluster{configs: map[string]map[string]string{storageClassRegionActionName: {regionsConfigKey: "us-central1: europe-west1"}}}
+
+	storageClass := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion":  "storage.k8s.io/v1",
+		"kind":        "StorageClass",
+		"metadata":    map[string]interface{}{"name": "regional"},
+		"provisioner": pdCSIDriver,
+		"parameters": map[string]interface{}{
+			"type":                    "pd-ssd",
+			"replication-type":        "regional-pd",
+			"zones":                   "us-central1-a,us-central1-b",
+			"disk-encryption-kms-key": "projects/kms/locations/us-central1/keyRings/r/cryptoKeys/k",
+		},
+		"allowedTopologies": []interface{}{
+			map[string]interface{}{
+				"matchLabelExpressions": []interface{}{
+					map[string]interface{}{"key": gkeZoneLabel, "values": []interface{}{"us-central1-a", "us-central1-b"}},
+					map[string]interface{}{"key": regionLabel, "values": []interface{}{"us-central1"}},
+					map[string]interface{}{"key": "example.com/rack", "values": []interface{}{"us-central1-a"}},
+				},
+			},
+		},
+	}}
+
+	action := &StorageClassRegionAction{log: velerotest.NewLogger(), cluster: cluster}
+	out, err := action.Execute(&velero.RestoreItemActionExecuteInput{Item: storageClass})
+	require.NoError(t, err)
+
+	updated := out.UpdatedItem.UnstructuredContent()
+	assert.Equal(t, map[string]interface{}{
+		"type":                    "pd-ssd",
+		"replication-type":        "regional-pd",
+		"zones":                   "europe-west1-a,europe-west1-b",
+		"disk-encryption-kms-key": "projects/kms/locations/europe-west1/keyRings/r/cryptoKeys/k",
+	}, updated["parameters"])
+	assert.Equal(t, []interface{}{
+		map[string]interface{}{
+			"matchLabelExpressions": []interface{}{
+				map[string]interface{}{"key": gkeZoneLabel, "values": []interface{}{"europe-west1-a", "europe-west1-b"}},
+				map[string]interface{}{"key": regionLabel, "values": []interface{}{"europe-west1"}},
+				map[string]interface{}{"key": "example.com/rack", "values": []interface{}{"us-central1-a"}},
+			},
+		},
+	}, updated["allowedTopologies"])
+}
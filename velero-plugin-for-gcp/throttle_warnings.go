@@ -0,0 +1,106 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// throttleWarningsEnvVar disables the throttling warnings when set to
+	// false.
+	throttleWarningsEnvVar = "VELERO_GCP_PLUGIN_THROTTLE_WARNINGS"
+
+	// throttleWarningInterval is how often warnings are logged while
+	// requests keep being throttled.
+	throttleWarningInterval = time.Minute
+)
+
+func throttleWarningsEnabled() bool {
+	enabled, err := strconv.ParseBool(os.Getenv(throttleWarningsEnvVar))
+	return err != nil || enabled
+}
+
+// throttleWarningTransport logs warnings when the requests made through it
+// are rate limited or fail transiently, which the client libraries and the
+// plugin back off from and retry. Velero writes the plugin's warnings to the
+// log of the backup or restore it runs for and counts them in its status, so
+// they explain why it's slow.
+type throttleWarningTransport struct {
+	log     logrus.FieldLogger
+	service string
+	base    http.RoundTripper
+	now     func() time.Time
+
+	lock sync.Mutex
+	// throttled and transient count the requests since the last warning,
+	// the first of which was made at since.
+	throttled int
+	transient int
+	since     time.Time
+	warned    time.Time
+}
+
+func newThrottleWarningTransport(log logrus.FieldLogger, service string, base http.RoundTripper) *throttleWarningTransport {
+	return &throttleWarningTransport{log: log, service: service, base: base, now: time.Now}
+}
+
+func (t *throttleWarningTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	res, err := t.base.RoundTrip(req)
+
+	switch {
+	case err == nil && isThrottled(res):
+		t.record(apiOperation(req.URL.EscapedPath()), true)
+	case err == nil && isTransientStatus(res.StatusCode),
+		// requests canceled by the caller aren't retried
+		err != nil && req.Context().Err() == nil:
+		t.record(apiOperation(req.URL.EscapedPath()), false)
+	}
+	return res, err
+}
+
+// record counts a throttled or transiently failed request, and logs a
+// warning unless one was logged within the interval.
+func (t *throttleWarningTransport) record(operation string, throttled bool) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	now := t.now()
+	if t.throttled+t.transient == 0 {
+		t.since = now
+	}
+	if throttled {
+		t.throttled++
+	} else {
+		t.transient++
+	}
+	if !t.warned.IsZero() && now.Sub(t.warned) < throttleWarningInterval {
+		return
+	}
+
+	t.log.WithFields(logrus.Fields{"service": t.service, "operation": operation}).Warnf(
+		"GCP %s API requests were rate limited %d times and failed transiently %d times in the last %s; they are retried with backoff, which slows the operation down. If this persists, raise the API's quotas or run fewer backups and restores at once",
+		t.service, t.throttled, t.transient, now.Sub(t.since).Round(time.Second))
+	t.throttled, t.transient = 0, 0
+	t.warned = now
+}
@@ -0,0 +1,91 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/api/compute/v1"
+	"google.golang.org/api/option"
+)
+
+func TestThrottleWarningTransport(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/compute/v1/projects/p/zones/z/disks/throttled":
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(`{"error":{"code":403,"errors":[{"reason":"rateLimitExceeded"}],"message":"Rate Limit Exceeded"}}`))
+		case "/compute/v1/projects/p/zones/z/disks/unavailable":
+			w.WriteHeader(http.StatusServiceUnavailable)
+		default:
+			w.Write([]byte(`{"name":"d"}`))
+		}
+	}))
+	defer server.Close()
+
+	logger, hook := logtest.NewNullLogger()
+	now := time.Now()
+	transport := newThrottleWarningTransport(logger, computeService, http.DefaultTransport)
+	transport.now = func() time.Time { return now }
+	gce, err := compute.NewService(context.Background(),
+		option.WithEndpoint(server.URL+"/compute/v1/"),
+		option.WithHTTPClient(&http.Client{Transport: transport}),
+	)
+	require.NoError(t, err)
+
+	_, err = gce.Disks.Get("p", "z", "d").Do()
+	require.NoError(t, err)
+	assert.Empty(t, hook.AllEntries())
+
+	_, err = gce.Disks.Get("p", "z", "throttled").Do()
+	require.Error(t, err)
+	require.Len(t, hook.AllEntries(), 1)
+	assert.Equal(t, logrus.WarnLevel, hook.LastEntry().Level)
+	assert.Contains(t, hook.LastEntry().Message, "GCP compute API requests were rate limited 1 times and failed transiently 0 times in the last 0s")
+	assert.Equal(t, "projects.zones.disks", hook.LastEntry().Data["operation"])
+
+	// warnings are only logged once within the interval
+	now = now.Add(10 * time.Second)
+	gce.Disks.Get("p", "z", "unavailable").Do()
+	gce.Disks.Get("p", "z", "throttled").Do()
+	assert.Len(t, hook.AllEntries(), 1)
+
+	now = now.Add(throttleWarningInterval)
+	gce.Disks.Get("p", "z", "unavailable").Do()
+	require.Len(t, hook.AllEntries(), 2)
+	assert.Contains(t, hook.LastEntry().Message, "rate limited 1 times and failed transiently 2 times in the last 1m0s")
+}
+
+func TestThrottleWarningsEnabled(t *testing.T) {
+	defer os.Unsetenv(throttleWarningsEnvVar)
+
+	os.Unsetenv(throttleWarningsEnvVar)
+	assert.True(t, throttleWarningsEnabled())
+	os.Setenv(throttleWarningsEnvVar, "false")
+	assert.False(t, throttleWarningsEnabled())
+	os.Setenv(throttleWarningsEnvVar, "true")
+	assert.True(t, throttleWarningsEnabled())
+}
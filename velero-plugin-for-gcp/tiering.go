@@ -0,0 +1,912 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"cloud.google.com/go/storage"
+	uuid "github.com/gofrs/uuid"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/pflag"
+	api "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	"google.golang.org/api/compute/v1"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/iterator"
+	htransport "google.golang.org/api/transport/http"
+)
+
+const (
+	applyTieringCommand = "apply-tiering"
+
+	// archiveSnapshotsAfterConfigKey is the key of a VolumeSnapshotLocation's
+	// config holding the age of backups whose snapshots are moved to archive
+	// snapshots.
+	archiveSnapshotsAfterConfigKey = "archiveSnapshotsAfter"
+	// tierObjectsAfterConfigKey is the key of a BackupStorageLocation's
+	// config holding the age of backups whose objects are moved to a colder
+	// storage class.
+	tierObjectsAfterConfigKey = "tierObjectsAfter"
+	// tierObjectsStorageClassConfigKey is the key of a BackupStorageLocation's
+	// config holding the storage class objects are moved to, COLDLINE by
+	// default.
+	tierObjectsStorageClassConfigKey = "tierObjectsStorageClass"
+
+	defaultTierStorageClass = "COLDLINE"
+	archiveSnapshotType     = "ARCHIVE"
+
+	// snapshotTierLabel labels the snapshots moved to archive storage with
+	// their tier.
+	snapshotTierLabel   = "velero-tier"
+	archiveSnapshotTier = "archive"
+	// tieringOfLabel labels the disk holding a snapshot's data while it's
+	// moved to archive storage with the snapshot's name.
+	tieringOfLabel = "velero-tiering-of"
+	// tieringLocationLabel labels that disk with the storage location of
+	// the snapshot, to create the archive snapshot in the same location.
+	tieringLocationLabel = "velero-snapshot-location"
+	// archiveOfLabel labels archive snapshots, and the disks holding the
+	// data they're created from, with the name of the snapshot they
+	// replace, which Velero still knows them by.
+	archiveOfLabel = "velero-archive-of"
+	// archiveSnapshotSuffix ends the names of archive snapshots.
+	archiveSnapshotSuffix = "-archive"
+
+	// tieringTimeout bounds each step of moving a snapshot to archive
+	// storage, which includes uploading it.
+	tieringTimeout = 2 * time.Hour
+	// tierObjectTimeout bounds copying an object to another storage class.
+	tierObjectTimeout = time.Hour
+)
+
+var (
+	// tieringPollInterval is how often the progress of disks and snapshots
+	// is read while moving a snapshot. It is a variable so tests can
+	// shorten it.
+	tieringPollInterval = 10 * time.Second
+
+	// sourceDiskRegexp matches the source disk URL of a snapshot, with
+	// whether the disk is zonal or regional and its zone or region as
+	// submatches.
+	sourceDiskRegexp = regexp.MustCompile(`/(zones|regions)/([^/]+)/disks/[^/]+$`)
+
+	// storageClassTiers orders the storage classes from warmest to coldest,
+	// so objects are only ever moved to colder classes.
+	storageClassTiers = map[string]int{
+		"STANDARD":                     0,
+		"REGIONAL":                     0,
+		"MULTI_REGIONAL":               0,
+		"DURABLE_REDUCED_AVAILABILITY": 0,
+		"NEARLINE":                     1,
+		"COLDLINE":                     2,
+		"ARCHIVE":                      3,
+	}
+)
+
+func checkTierStorageClass(val string) error {
+	if tier, ok := storageClassTiers[val]; !ok || tier == 0 {
+		return errors.New("expected NEARLINE, COLDLINE or ARCHIVE")
+	}
+	return nil
+}
+
+// tieringRecord records the tier of a backup's objects and snapshots, next
+// to the backup's other files.
+type tieringRecord struct {
+	Backup    string         `json:"backup"`
+	Objects   *objectTier    `json:"objects,omitempty"`
+	Snapshots []snapshotTier `json:"snapshots,omitempty"`
+}
+
+type objectTier struct {
+	StorageClass string    `json:"storageClass"`
+	Moved        int       `json:"moved"`
+	Transitioned time.Time `json:"transitioned"`
+}
+
+type snapshotTier struct {
+	Name string `json:"name"`
+	// Snapshot is the name of the snapshot holding the data now, if it was
+	// replaced by one in the tier.
+	Snapshot     string    `json:"snapshot,omitempty"`
+	Tier         string    `json:"tier"`
+	Transitioned time.Time `json:"transitioned"`
+}
+
+// tieringRecordKey returns the key of a backup's tiering record.
+func tieringRecordKey(prefix, backup string) string {
+	return path.Join(prefix, "backups", backup, backup+"-gcp-tiering.json")
+}
+
+// isArchiveSnapshot reports whether a snapshot was moved to archive storage.
+func isArchiveSnapshot(snapshot *compute.Snapshot) bool {
+	return snapshot.Labels[snapshotTierLabel] == archiveSnapshotTier
+}
+
+// archiveSnapshotName returns the name of the archive snapshot a snapshot is
+// moved to. Names that would be too long are shortened, with a hash of the
+// snapshot's name keeping them unique.
+func archiveSnapshotName(name string) string {
+	if len(name)+len(archiveSnapshotSuffix) <= maxLabelValueLength {
+		return name + archiveSnapshotSuffix
+	}
+	h := fnv.New32a()
+	h.Write([]byte(name))
+	hash := fmt.Sprintf("-%08x", h.Sum32())
+	return strings.TrimRight(name[:maxLabelValueLength-len(archiveSnapshotSuffix)-len(hash)], "-") + hash + archiveSnapshotSuffix
+}
+
+// getSnapshot returns a snapshot Velero recorded, or the archive snapshot it
+// was moved to.
+func (b *VolumeSnapshotter) getSnapshot(project, name string) (*compute.Snapshot, error) {
+	snapshot, err := b.clients().gce.Snapshots.Get(project, name).Do()
+	if !isNotFound(err) {
+		return snapshot, err
+	}
+	archive, archiveErr := b.clients().gce.Snapshots.Get(project, archiveSnapshotName(name)).Do()
+	if archiveErr != nil || archive.Labels[archiveOfLabel] != name || archive.Status != "READY" {
+		return nil, err
+	}
+	return archive, nil
+}
+
+// computeHTTPClient returns the HTTP client of the Compute Engine API, for
+// the requests the client library has no fields for, creating it when first
+// needed.
+func (b *VolumeSnapshotter) computeHTTPClient() (*http.Client, error) {
+	b.lazyClientsLock.Lock()
+	defer b.lazyClientsLock.Unlock()
+	if b.computeHTTP == nil {
+		ctx := context.TODO()
+		opts, err := b.clients().credentials.clientOptions(ctx, parseScopes(b.config, compute.ComputeScope)...)
+		if err != nil {
+			return nil, err
+		}
+		if opts, err = instrumentClientOptions(ctx, b.log, computeService, opts); err != nil {
+			return nil, err
+		}
+		client, _, err := htransport.NewClient(ctx, opts...)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		b.computeHTTP = client
+	}
+	return b.computeHTTP, nil
+}
+
+// createArchiveSnapshot snapshots a zonal or regional disk, as scope is
+// "zones" or "regions", as an archive snapshot labeled with its tier. The
+// client library has no field for the snapshot type, so the request is made
+// directly.
+func (b *VolumeSnapshotter) createArchiveSnapshot(scope, location, disk string, snapshot *compute.Snapshot, reason string) (*compute.Operation, error) {
+	client, err := b.computeHTTPClient()
+	if err != nil {
+		return nil, err
+	}
+	labels := map[string]string{snapshotTierLabel: archiveSnapshotTier}
+	for k, v := range snapshot.Labels {
+		labels[k] = v
+	}
+	archive := *snapshot
+	archive.Labels = labels
+	data, err := json.Marshal(&archive)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	fields := make(map[string]interface{})
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	fields["snapshotType"] = archiveSnapshotType
+	if data, err = json.Marshal(fields); err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	u := googleapi.ResolveRelative(b.clients().gce.BasePath, fmt.Sprintf("projects/%s/%s/%s/disks/%s/createSnapshot", url.PathEscape(b.snapshotProject), scope, url.PathEscape(location), url.PathEscape(disk)))
+	req, err := http.NewRequest(http.MethodPost, u, bytes.NewReader(data))
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if reason != "" {
+		req.Header.Set(requestReasonHeader, reason)
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error creating archive snapshot %s", snapshot.Name)
+	}
+	defer res.Body.Close()
+	if err := googleapi.CheckResponse(res); err != nil {
+		return nil, errors.Wrapf(err, "error creating archive snapshot %s", snapshot.Name)
+	}
+	op := new(compute.Operation)
+	if err := json.NewDecoder(res.Body).Decode(op); err != nil {
+		return nil, errors.Wrapf(err, "error decoding the operation creating archive snapshot %s", snapshot.Name)
+	}
+	return op, nil
+}
+
+// tieringDisk returns the disk holding a snapshot's data while it's moved to
+// archive storage, or nil if there's none.
+func (b *VolumeSnapshotter) tieringDisk(snapshot string) (*compute.Disk, error) {
+	var disk *compute.Disk
+	filter := fmt.Sprintf("labels.%s=%q", tieringOfLabel, snapshot)
+	err := b.clients().gce.Disks.AggregatedList(b.snapshotProject).Filter(filter).Pages(context.TODO(), func(page *compute.DiskAggregatedList) error {
+		for _, scoped := range page.Items {
+			for _, d := range scoped.Disks {
+				if d.Labels[tieringOfLabel] == snapshot {
+					disk = d
+				}
+			}
+		}
+		return nil
+	})
+	return disk, errors.Wrapf(err, "error listing the disks of snapshot %s", snapshot)
+}
+
+// tieringZone returns the zone to create the disk holding a snapshot's
+// data in: its source disk's zone, or a zone of its source disk's region.
+func (b *VolumeSnapshotter) tieringZone(snapshot *compute.Snapshot) (string, error) {
+	m := sourceDiskRegexp.FindStringSubmatch(snapshot.SourceDisk)
+	if m == nil {
+		return "", errors.Errorf("unable to determine the zone of the source disk of snapshot %s", snapshot.Name)
+	}
+	if m[1] == "zones" {
+		return m[2], nil
+	}
+	region, err := b.clients().gce.Regions.Get(b.snapshotProject, m[2]).Do()
+	if err != nil {
+		return "", errors.Wrapf(err, "error getting region %s", m[2])
+	}
+	if len(region.Zones) == 0 {
+		return "", errors.Errorf("region %s has no zones", m[2])
+	}
+	return path.Base(region.Zones[0]), nil
+}
+
+// waitForTiering polls until done reports true, for at most tieringTimeout.
+func waitForTiering(what string, done func() (bool, error)) error {
+	deadline := time.Now().Add(tieringTimeout)
+	for {
+		ok, err := done()
+		if err != nil || ok {
+			return err
+		}
+		if time.Now().After(deadline) {
+			return errors.Errorf("timed out waiting for %s", what)
+		}
+		time.Sleep(tieringPollInterval)
+	}
+}
+
+// archiveSnapshot moves a snapshot to archive storage. Snapshots can't
+// change type, so the snapshot is restored to a disk, which is snapshotted
+// as an archive snapshot with the same description, labels and key, named
+// by archiveSnapshotName and labeled with the snapshot's name, which
+// restores and deletions resolve it by. Only once the archive snapshot is
+// ready are the disk and then the snapshot deleted, so the snapshot is
+// restorable throughout. The disk is labeled with the snapshot's name, so a
+// move that was interrupted resumes from where it stopped, and a move whose
+// snapshot was deleted with its backup in the meantime, which leaves the
+// disk without the snapshot, is cleaned up. It returns whether the snapshot
+// was moved, which with dryRun it isn't.
+func (b *VolumeSnapshotter) archiveSnapshot(name string, dryRun bool) (bool, error) {
+	archiveName := archiveSnapshotName(name)
+	snapshot, err := b.getTieringSnapshot(name)
+	if err != nil {
+		return false, err
+	}
+	archive, err := b.getTieringSnapshot(archiveName)
+	if err != nil {
+		return false, err
+	}
+	disk, err := b.tieringDisk(name)
+	if err != nil {
+		return false, err
+	}
+
+	switch {
+	case snapshot != nil && isArchiveSnapshot(snapshot):
+		// moved under its own name by an earlier version, only the disk
+		// may be left to delete
+		return false, b.deleteTieringDisk(disk)
+	case snapshot == nil && disk != nil && disk.Labels[archiveOfLabel] == "":
+		// an earlier version deleted the snapshot before creating the
+		// archive snapshot, leaving its data only in the disk
+		return false, errors.Errorf("the move of snapshot %s to archive storage by an earlier version of %s was interrupted, and its data is only in disk %s; snapshot the disk to keep it", name, applyTieringCommand, disk.Name)
+	case snapshot == nil && disk == nil && archive == nil:
+		return false, errors.Errorf("snapshot %s not found", name)
+	case snapshot == nil && disk == nil && archive.Status == "READY":
+		// moved
+		return false, nil
+	case snapshot == nil:
+		// deleted with its backup while it was moved
+		if dryRun {
+			return false, nil
+		}
+		b.log.WithField("snapshot", name).Infof("Snapshot %s was deleted while it was moved to archive storage, cleaning up", name)
+		return false, b.cleanUpArchiveMove(archive, disk)
+	case snapshot.Status != "READY":
+		return false, nil
+	}
+	if dryRun {
+		return true, nil
+	}
+	log := b.log.WithField("snapshot", name)
+
+	if archive == nil || archive.Status != "READY" {
+		if disk == nil {
+			if disk, err = b.createTieringDisk(snapshot); err != nil {
+				return false, err
+			}
+			log.Infof("Restored snapshot %s to disk %s to move it to archive storage", name, disk.Name)
+		}
+		if err := b.waitForTieringDisk(name, disk); err != nil {
+			return false, err
+		}
+
+		if archive != nil && archive.Status == "FAILED" {
+			if err := b.deleteTieringSnapshot(archiveName); err != nil {
+				return false, err
+			}
+			archive = nil
+		}
+		if archive == nil {
+			if _, err := b.createArchiveSnapshot("zones", path.Base(disk.Zone), disk.Name, archiveSnapshotOf(name, disk), ""); err != nil {
+				return false, err
+			}
+		}
+		err = waitForTiering("archive snapshot "+archiveName, func() (bool, error) {
+			s, err := b.clients().gce.Snapshots.Get(b.snapshotProject, archiveName).Do()
+			if err != nil {
+				return false, errors.Wrapf(err, "error getting archive snapshot %s", archiveName)
+			}
+			if s.Status == "FAILED" {
+				return false, errors.Errorf("archive snapshot %s of snapshot %s failed, the snapshot is unchanged", archiveName, name)
+			}
+			return s.Status == "READY", nil
+		})
+		if err != nil {
+			return false, err
+		}
+	}
+
+	// the snapshot may have been deleted with its backup during the move,
+	// which left the archive snapshot behind
+	current, err := b.getTieringSnapshot(name)
+	if err != nil {
+		return false, err
+	}
+	if current == nil {
+		log.Infof("Snapshot %s was deleted while it was moved to archive storage, cleaning up", name)
+		archive, err := b.getTieringSnapshot(archiveName)
+		if err != nil {
+			return false, err
+		}
+		return false, b.cleanUpArchiveMove(archive, disk)
+	}
+	if err := b.deleteTieringDisk(disk); err != nil {
+		return false, err
+	}
+	if err := b.deleteTieringSnapshot(name); err != nil {
+		return false, err
+	}
+	log.Infof("Moved snapshot %s to archive snapshot %s", name, archiveName)
+	return true, nil
+}
+
+// getTieringSnapshot returns a snapshot in the snapshot project, or nil if
+// there's none.
+func (b *VolumeSnapshotter) getTieringSnapshot(name string) (*compute.Snapshot, error) {
+	snapshot, err := b.clients().gce.Snapshots.Get(b.snapshotProject, name).Do()
+	if isNotFound(err) {
+		return nil, nil
+	}
+	return snapshot, errors.Wrapf(err, "error getting snapshot %s", name)
+}
+
+func (b *VolumeSnapshotter) deleteTieringSnapshot(name string) error {
+	if _, err := b.clients().gce.Snapshots.Delete(b.snapshotProject, name).Do(); err != nil && !isNotFound(err) {
+		return errors.Wrapf(err, "error deleting snapshot %s", name)
+	}
+	return nil
+}
+
+// waitForTieringDisk waits until the disk holding a snapshot's data is
+// ready.
+func (b *VolumeSnapshotter) waitForTieringDisk(name string, disk *compute.Disk) error {
+	zone := path.Base(disk.Zone)
+	return waitForTiering("disk "+disk.Name, func() (bool, error) {
+		d, err := b.clients().gce.Disks.Get(b.snapshotProject, zone, disk.Name).Do()
+		if err != nil {
+			return false, errors.Wrapf(err, "error getting disk %s", disk.Name)
+		}
+		if d.Status == "FAILED" {
+			return false, errors.Errorf("disk %s restored from snapshot %s failed", disk.Name, name)
+		}
+		*disk = *d
+		return d.Status == "READY", nil
+	})
+}
+
+// cleanUpArchiveMove deletes what's left of the move of a snapshot that was
+// deleted in the meantime.
+func (b *VolumeSnapshotter) cleanUpArchiveMove(archive *compute.Snapshot, disk *compute.Disk) error {
+	if archive != nil {
+		if err := b.deleteTieringSnapshot(archive.Name); err != nil {
+			return err
+		}
+	}
+	return b.deleteTieringDisk(disk)
+}
+
+// createTieringDisk restores a snapshot to a disk that holds its data while
+// it's moved to archive storage.
+func (b *VolumeSnapshotter) createTieringDisk(snapshot *compute.Snapshot) (*compute.Disk, error) {
+	zone, err := b.tieringZone(snapshot)
+	if err != nil {
+		return nil, err
+	}
+	uid, err := uuid.NewV4()
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	labels := map[string]string{tieringOfLabel: snapshot.Name, archiveOfLabel: snapshot.Name}
+	for k, v := range snapshot.Labels {
+		labels[k] = v
+	}
+	if len(snapshot.StorageLocations) > 0 {
+		labels[tieringLocationLabel] = snapshot.StorageLocations[0]
+	}
+	disk := &compute.Disk{
+		Name:           "tiering-" + uid.String(),
+		SourceSnapshot: snapshot.SelfLink,
+		Type:           fmt.Sprintf("projects/%s/zones/%s/diskTypes/pd-standard", b.snapshotProject, zone),
+		Description:    snapshot.Description,
+		Labels:         labels,
+	}
+	if snapshot.SnapshotEncryptionKey != nil && snapshot.SnapshotEncryptionKey.KmsKeyName != "" {
+		disk.DiskEncryptionKey = &compute.CustomerEncryptionKey{KmsKeyName: kmsCryptoKey(snapshot.SnapshotEncryptionKey.KmsKeyName)}
+	}
+	if _, err := b.clients().gce.Disks.Insert(b.snapshotProject, zone, disk).Do(); err != nil {
+		return nil, errors.Wrapf(err, "error restoring snapshot %s to a disk", snapshot.Name)
+	}
+	disk.Zone = zone
+	return disk, nil
+}
+
+// archiveSnapshotOf returns the archive snapshot to create of the disk
+// holding a snapshot's data.
+func archiveSnapshotOf(name string, disk *compute.Disk) *compute.Snapshot {
+	labels := map[string]string{archiveOfLabel: name}
+	for k, v := range disk.Labels {
+		if k != tieringOfLabel && k != tieringLocationLabel {
+			labels[k] = v
+		}
+	}
+	snapshot := &compute.Snapshot{Name: archiveSnapshotName(name), Description: disk.Description, Labels: labels}
+	if location := disk.Labels[tieringLocationLabel]; location != "" {
+		snapshot.StorageLocations = []string{location}
+	}
+	if disk.DiskEncryptionKey != nil && disk.DiskEncryptionKey.KmsKeyName != "" {
+		snapshot.SnapshotEncryptionKey = &compute.CustomerEncryptionKey{KmsKeyName: kmsCryptoKey(disk.DiskEncryptionKey.KmsKeyName)}
+	}
+	return snapshot
+}
+
+// kmsCryptoKey returns the key of a Cloud KMS key version.
+func kmsCryptoKey(name string) string {
+	if i := strings.Index(name, cryptoKeyVersionsSegment); i >= 0 {
+		return name[:i]
+	}
+	return name
+}
+
+func (b *VolumeSnapshotter) deleteTieringDisk(disk *compute.Disk) error {
+	if disk == nil {
+		return nil
+	}
+	_, err := b.clients().gce.Disks.Delete(b.snapshotProject, path.Base(disk.Zone), disk.Name).Do()
+	if err != nil && !isNotFound(err) {
+		return errors.Wrapf(err, "error deleting disk %s", disk.Name)
+	}
+	return nil
+}
+
+// checkSnapshotTiering explains why a snapshot being restored wasn't found
+// when it's being moved to archive storage.
+func (b *VolumeSnapshotter) checkSnapshotTiering(snapshotID string, err error) error {
+	if !isNotFound(err) {
+		return err
+	}
+	disk, listErr := b.tieringDisk(snapshotID)
+	if listErr != nil || disk == nil {
+		return err
+	}
+	return errors.Errorf("snapshot %s is being moved to archive storage by %s, and its data is in disk %s until then; retry the restore once it's done", snapshotID, applyTieringCommand, disk.Name)
+}
+
+// logSnapshotTier notes restores from archive snapshots, which take longer
+// and are charged for the data retrieved.
+func (b *VolumeSnapshotter) logSnapshotTier(snapshot *compute.Snapshot) {
+	if isArchiveSnapshot(snapshot) {
+		b.log.WithField("snapshot", snapshot.Name).Info("Restoring the volume from an archive snapshot, which takes longer than from a standard snapshot and incurs retrieval charges")
+	}
+}
+
+// tierBackupObjects copies the objects of a backup in a colder storage class
+// than class to it, keeping their metadata and encryption, and returns the
+// number of objects moved, which with dryRun aren't.
+func (o *ObjectStore) tierBackupObjects(bucket, prefix, backup, class string, dryRun bool) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), storageListTimeout)
+	defer cancel()
+
+	record := tieringRecordKey(prefix, backup)
+	var objects []*storage.ObjectAttrs
+	iter := o.clients().readClient.Bucket(bucket).Objects(ctx, &storage.Query{Prefix: path.Join(prefix, "backups", backup) + "/"})
+	for {
+		attrs, err := iter.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return 0, errors.Wrapf(err, "error listing objects of backup %s", backup)
+		}
+		if attrs.Name != record && storageClassTiers[attrs.StorageClass] < storageClassTiers[class] {
+			objects = append(objects, attrs)
+		}
+	}
+	if dryRun {
+		return len(objects), nil
+	}
+
+	moved := 0
+	for _, attrs := range objects {
+		if err := o.setStorageClass(attrs, class); err != nil {
+			return moved, err
+		}
+		moved++
+	}
+	return moved, nil
+}
+
+// setStorageClass rewrites an object in another storage class, unless it
+// was overwritten since it was listed.
+func (o *ObjectStore) setStorageClass(attrs *storage.ObjectAttrs, class string) error {
+	clients := o.clients()
+	ctx, cancel := context.WithTimeout(context.Background(), tierObjectTimeout)
+	defer cancel()
+
+	obj := clients.client.Bucket(attrs.Bucket).Object(attrs.Name)
+	src := obj.Generation(attrs.Generation)
+	dst := obj.If(storage.Conditions{GenerationMatch: attrs.Generation})
+	if clients.encryptionKey != nil {
+		src, dst = src.Key(clients.encryptionKey), dst.Key(clients.encryptionKey)
+	}
+	copier := dst.CopierFrom(src)
+	copier.StorageClass = class
+	copier.ContentType = attrs.ContentType
+	copier.ContentEncoding = attrs.ContentEncoding
+	copier.ContentLanguage = attrs.ContentLanguage
+	copier.ContentDisposition = attrs.ContentDisposition
+	copier.CacheControl = attrs.CacheControl
+	copier.Metadata = attrs.Metadata
+	if attrs.KMSKeyName != "" {
+		copier.DestinationKMSKeyName = kmsCryptoKey(attrs.KMSKeyName)
+	}
+	if _, err := copier.Run(ctx); err != nil {
+		return errors.Wrapf(err, "error moving object %s to storage class %s", attrs.Name, class)
+	}
+	return nil
+}
+
+// readTieringRecord returns a backup's tiering record, or an empty one if it
+// has none.
+func (o *ObjectStore) readTieringRecord(bucket, prefix, backup string) (*tieringRecord, error) {
+	record := &tieringRecord{Backup: backup}
+	key := tieringRecordKey(prefix, backup)
+	exists, err := o.ObjectExists(bucket, key)
+	if err != nil || !exists {
+		return record, err
+	}
+	body, err := o.GetObject(bucket, key)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	if err := json.NewDecoder(body).Decode(record); err != nil {
+		return nil, errors.Wrapf(err, "error decoding %s", key)
+	}
+	return record, nil
+}
+
+// writeTieringRecord writes a backup's tiering record.
+func (o *ObjectStore) writeTieringRecord(bucket, prefix string, record *tieringRecord) error {
+	data, err := json.MarshalIndent(record, "", "  ")
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	key := tieringRecordKey(prefix, record.Backup)
+	return errors.Wrapf(o.PutObject(bucket, key, bytes.NewReader(data)), "error writing %s", key)
+}
+
+// recordSnapshotTier sets the tier of a snapshot, and the name of the
+// snapshot it was moved to, in a record.
+func (r *tieringRecord) recordSnapshotTier(name, snapshot, tier string, now time.Time) {
+	for i := range r.Snapshots {
+		if r.Snapshots[i].Name == name {
+			r.Snapshots[i] = snapshotTier{Name: name, Snapshot: snapshot, Tier: tier, Transitioned: now}
+			return
+		}
+	}
+	r.Snapshots = append(r.Snapshots, snapshotTier{Name: name, Snapshot: snapshot, Tier: tier, Transitioned: now})
+}
+
+// objectTieringPolicy is the tiering policy of a BackupStorageLocation.
+type objectTieringPolicy struct {
+	store  *ObjectStore
+	bucket string
+	prefix string
+	after  time.Duration
+	class  string
+}
+
+// snapshotTieringPolicy is the tiering policy of a VolumeSnapshotLocation,
+// with the snapshots in its project by backup.
+type snapshotTieringPolicy struct {
+	snapshotter *VolumeSnapshotter
+	after       time.Duration
+	snapshots   map[string][]*compute.Snapshot
+}
+
+// newTieringObjectStore returns the object store of a backup storage
+// location.
+func newTieringObjectStore(log logrus.FieldLogger, location *api.BackupStorageLocation) (*ObjectStore, error) {
+	config := map[string]string{"bucket": location.Spec.ObjectStorage.Bucket, "prefix": location.Spec.ObjectStorage.Prefix}
+	for k, v := range location.Spec.Config {
+		config[k] = v
+	}
+	o := newObjectStore(log)
+	if err := o.Init(config); err != nil {
+		return nil, err
+	}
+	return o, nil
+}
+
+// objectTieringPolicies returns the policies of the GCP backup storage
+// locations with tierObjectsAfter set, by name.
+func objectTieringPolicies(log logrus.FieldLogger, locations []api.BackupStorageLocation) (map[string]*objectTieringPolicy, error) {
+	policies := make(map[string]*objectTieringPolicy)
+	for i := range locations {
+		location := &locations[i]
+		val := location.Spec.Config[tierObjectsAfterConfigKey]
+		if !isGCPProvider(location.Spec.Provider) || location.Spec.ObjectStorage == nil || val == "" {
+			continue
+		}
+		after, err := time.ParseDuration(val)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid %s of BackupStorageLocation %s", tierObjectsAfterConfigKey, location.Name)
+		}
+		class := location.Spec.Config[tierObjectsStorageClassConfigKey]
+		if class == "" {
+			class = defaultTierStorageClass
+		}
+		store, err := newTieringObjectStore(log, location)
+		if err != nil {
+			return nil, errors.WithMessagef(err, "BackupStorageLocation %s", location.Name)
+		}
+		policies[location.Name] = &objectTieringPolicy{
+			store:  store,
+			bucket: location.Spec.ObjectStorage.Bucket,
+			prefix: location.Spec.ObjectStorage.Prefix,
+			after:  after,
+			class:  class,
+		}
+	}
+	return policies, nil
+}
+
+// snapshotTieringPolicies returns the policies of the GCP volume snapshot
+// locations with archiveSnapshotsAfter set, with their snapshots. Snapshots
+// of locations sharing a project are only listed once.
+func snapshotTieringPolicies(log logrus.FieldLogger, locations []api.VolumeSnapshotLocation) ([]*snapshotTieringPolicy, error) {
+	var policies []*snapshotTieringPolicy
+	listed := make(map[string]bool)
+	for _, location := range locations {
+		val := location.Spec.Config[archiveSnapshotsAfterConfigKey]
+		if !isGCPProvider(location.Spec.Provider) || val == "" {
+			continue
+		}
+		after, err := time.ParseDuration(val)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid %s of VolumeSnapshotLocation %s", archiveSnapshotsAfterConfigKey, location.Name)
+		}
+		b := newVolumeSnapshotter(log)
+		if err := b.Init(location.Spec.Config); err != nil {
+			return nil, errors.WithMessagef(err, "VolumeSnapshotLocation %s", location.Name)
+		}
+		if listed[b.snapshotProject] {
+			continue
+		}
+		listed[b.snapshotProject] = true
+
+		snapshots := make(map[string][]*compute.Snapshot)
+		err = b.clients().gce.Snapshots.List(b.snapshotProject).Filter(fmt.Sprintf("labels.%s:*", backupLabel)).Pages(context.TODO(), func(page *compute.SnapshotList) error {
+			for _, s := range page.Items {
+				if backup := snapshotBackup(s); backup != "" {
+					snapshots[backup] = append(snapshots[backup], s)
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, errors.Wrapf(err, "error listing snapshots in project %s", b.snapshotProject)
+		}
+		policies = append(policies, &snapshotTieringPolicy{snapshotter: b, after: after, snapshots: snapshots})
+	}
+	return policies, nil
+}
+
+// applyTiering moves the objects and snapshots of the completed backups, or
+// only the named one, that are older than their locations' thresholds to
+// colder storage, records their tier next to each backup, and returns
+// whether every move succeeded.
+func applyTiering(log logrus.FieldLogger, out io.Writer, cluster veleroCluster, name string, dryRun bool, now time.Time) (bool, error) {
+	backups, err := cluster.backups()
+	if err != nil {
+		return false, err
+	}
+	storageLocations, err := cluster.backupStorageLocations()
+	if err != nil {
+		return false, err
+	}
+	snapshotLocations, err := cluster.volumeSnapshotLocations()
+	if err != nil {
+		return false, err
+	}
+	objectPolicies, err := objectTieringPolicies(log, storageLocations)
+	if err != nil {
+		return false, err
+	}
+	snapshotPolicies, err := snapshotTieringPolicies(log, snapshotLocations)
+	if err != nil {
+		return false, err
+	}
+
+	sort.Slice(backups, func(i, j int) bool { return backups[i].Name < backups[j].Name })
+	tw := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "BACKUP\tAGE\tOBJECTS MOVED\tSNAPSHOTS ARCHIVED\tPROBLEMS")
+	succeeded, found := true, false
+	for i := range backups {
+		backup := &backups[i]
+		if name != "" && backup.Name != name {
+			continue
+		}
+		found = true
+		if backup.Status.Phase != api.BackupPhaseCompleted && backup.Status.Phase != api.BackupPhasePartiallyFailed {
+			continue
+		}
+		age := now.Sub(backup.CreationTimestamp.Time)
+
+		var problems []string
+		moved, archived := 0, 0
+		policy := objectPolicies[backup.Spec.StorageLocation]
+		record := &tieringRecord{Backup: backup.Name}
+		if policy != nil && !dryRun {
+			if record, err = policy.store.readTieringRecord(policy.bucket, policy.prefix, backup.Name); err != nil {
+				problems = append(problems, err.Error())
+				record = &tieringRecord{Backup: backup.Name}
+			}
+		}
+
+		if policy != nil && age >= policy.after {
+			n, err := policy.store.tierBackupObjects(policy.bucket, policy.prefix, backup.Name, policy.class, dryRun)
+			moved += n
+			if err != nil {
+				problems = append(problems, err.Error())
+			}
+			if n > 0 {
+				record.Objects = &objectTier{StorageClass: policy.class, Moved: n, Transitioned: now.UTC()}
+			}
+		}
+		for _, p := range snapshotPolicies {
+			if age < p.after {
+				continue
+			}
+			// archive snapshots are moved with the snapshots they replace
+			seen := make(map[string]bool)
+			for _, s := range p.snapshots[backup.Name] {
+				name := s.Name
+				if of := s.Labels[archiveOfLabel]; of != "" {
+					name = of
+				}
+				if seen[name] {
+					continue
+				}
+				seen[name] = true
+				ok, err := p.snapshotter.archiveSnapshot(name, dryRun)
+				if err != nil {
+					problems = append(problems, err.Error())
+				}
+				if ok {
+					archived++
+					record.recordSnapshotTier(name, archiveSnapshotName(name), archiveSnapshotTier, now.UTC())
+				}
+			}
+		}
+
+		if policy != nil && !dryRun && (moved > 0 || archived > 0) {
+			if err := policy.store.writeTieringRecord(policy.bucket, policy.prefix, record); err != nil {
+				problems = append(problems, err.Error())
+			}
+		}
+		if len(problems) > 0 {
+			succeeded = false
+		}
+		if moved > 0 || archived > 0 || len(problems) > 0 {
+			fmt.Fprintf(tw, "%s\t%s\t%d\t%d\t%s\n", backup.Name, age.Round(time.Hour), moved, archived, strings.Join(problems, "; "))
+		}
+	}
+	tw.Flush()
+	if name != "" && !found {
+		return false, errors.Errorf("backup %s not found", name)
+	}
+	return succeeded, nil
+}
+
+// runApplyTiering moves backups that passed their locations' age thresholds
+// to colder storage.
+func runApplyTiering(args []string, out io.Writer) int {
+	flags := pflag.NewFlagSet(applyTieringCommand, pflag.ContinueOnError)
+	flags.SetOutput(out)
+	var (
+		name   string
+		dryRun bool
+	)
+	flags.StringVar(&name, "backup", "", "only move this backup")
+	flags.BoolVar(&dryRun, "dry-run", false, "only list what would be moved")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	logger := logrus.New()
+	logger.SetOutput(os.Stderr)
+	succeeded, err := applyTiering(logger, out, inCluster{}, name, dryRun, time.Now())
+	if err != nil {
+		fmt.Fprintln(out, err)
+		return 1
+	}
+	if !succeeded {
+		return 1
+	}
+	return 0
+}
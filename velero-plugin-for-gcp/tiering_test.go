@@ -0,0 +1,353 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	velerotest "github.com/vmware-tanzu/velero/pkg/test"
+	"google.golang.org/api/compute/v1"
+	"google.golang.org/api/option"
+)
+
+func TestCheckTierStorageClass(t *testing.T) {
+	for _, val := range []string{"NEARLINE", "COLDLINE", "ARCHIVE"} {
+		assert.NoError(t, checkTierStorageClass(val), val)
+	}
+	for _, val := range []string{"", "STANDARD", "coldline", "GLACIER"} {
+		assert.Error(t, checkTierStorageClass(val), val)
+	}
+}
+
+// fakeTieringCompute is a Compute Engine API keeping the snapshots and disks
+// of a project.
+type fakeTieringCompute struct {
+	lock      sync.Mutex
+	snapshots map[string]map[string]interface{}
+	disks     map[string]*compute.Disk
+	requests  []string
+	// snapshotStatus is the status of the snapshots created, READY if
+	// empty.
+	snapshotStatus string
+}
+
+func (f *fakeTieringCompute) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.requests = append(f.requests, r.Method+" "+r.URL.Path)
+
+	p := strings.TrimPrefix(r.URL.Path, "/projects/p/")
+	switch {
+	case strings.HasPrefix(p, "global/snapshots/"):
+		name := path.Base(p)
+		snapshot, ok := f.snapshots[name]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if r.Method == http.MethodDelete {
+			delete(f.snapshots, name)
+		}
+		json.NewEncoder(w).Encode(snapshot)
+	case p == "aggregated/disks":
+		list := &compute.DiskAggregatedList{Items: map[string]compute.DisksScopedList{}}
+		for _, d := range f.disks {
+			list.Items["zones/"+path.Base(d.Zone)] = compute.DisksScopedList{Disks: []*compute.Disk{d}}
+		}
+		json.NewEncoder(w).Encode(list)
+	case r.Method == http.MethodPost && strings.HasSuffix(p, "/disks"):
+		disk := new(compute.Disk)
+		json.NewDecoder(r.Body).Decode(disk)
+		disk.Zone, disk.Status = strings.Split(p, "/")[1], "READY"
+		f.disks[disk.Name] = disk
+		json.NewEncoder(w).Encode(&compute.Operation{})
+	case strings.HasSuffix(p, "/createSnapshot"):
+		snapshot := make(map[string]interface{})
+		json.NewDecoder(r.Body).Decode(&snapshot)
+		snapshot["status"] = "READY"
+		if f.snapshotStatus != "" {
+			snapshot["status"] = f.snapshotStatus
+		}
+		f.snapshots[snapshot["name"].(string)] = snapshot
+		json.NewEncoder(w).Encode(&compute.Operation{})
+	case strings.Contains(p, "/disks/"):
+		disk, ok := f.disks[path.Base(p)]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if r.Method == http.MethodDelete {
+			delete(f.disks, disk.Name)
+		}
+		json.NewEncoder(w).Encode(disk)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func TestArchiveSnapshotName(t *testing.T) {
+	assert.Equal(t, "snap-1-archive", archiveSnapshotName("snap-1"))
+	long := "pvc-0123456789abcdef-0123456789abcdef-0123456789abcdef-01234567"
+	name := archiveSnapshotName(long)
+	assert.Len(t, name, 63)
+	assert.True(t, strings.HasSuffix(name, archiveSnapshotSuffix))
+	assert.NotEqual(t, name, archiveSnapshotName(long[:62]+"9"))
+}
+
+func testTieringSnapshot(key string) map[string]interface{} {
+	return map[string]interface{}{
+		"name":                  "snap-1",
+		"status":                "READY",
+		"selfLink":              "https://compute.googleapis.com/compute/v1/projects/p/global/snapshots/snap-1",
+		"sourceDisk":            "https://compute.googleapis.com/compute/v1/projects/p/zones/us-central1-a/disks/pvc-1",
+		"description":           `{"velero.io/backup":"nightly"}`,
+		"labels":                map[string]string{backupLabel: "nightly", pvLabel: "pvc-1"},
+		"storageLocations":      []string{"us"},
+		"snapshotEncryptionKey": map[string]string{"kmsKeyName": key + "/cryptoKeyVersions/1"},
+	}
+}
+
+func TestArchiveSnapshot(t *testing.T) {
+	defer func(interval time.Duration) { tieringPollInterval = interval }(tieringPollInterval)
+	tieringPollInterval = 0
+
+	key := "projects/p/locations/us/keyRings/r/cryptoKeys/k"
+	fake := &fakeTieringCompute{
+		snapshots: map[string]map[string]interface{}{"snap-1": testTieringSnapshot(key)},
+		disks:     make(map[string]*compute.Disk),
+	}
+	b := (&VolumeSnapshotter{
+		log:             velerotest.NewLogger(),
+		computeHTTP:     http.DefaultClient,
+		snapshotProject: "p",
+	}).withClients(&snapshotterClients{
+		gce: newFakeComputeService(t, fake.ServeHTTP),
+	})
+
+	moved, err := b.archiveSnapshot("snap-1", true)
+	require.NoError(t, err)
+	assert.True(t, moved)
+	assert.Equal(t, []string{"GET /projects/p/global/snapshots/snap-1", "GET /projects/p/global/snapshots/snap-1-archive", "GET /projects/p/aggregated/disks"}, fake.requests)
+
+	moved, err = b.archiveSnapshot("snap-1", false)
+	require.NoError(t, err)
+	assert.True(t, moved)
+	assert.Empty(t, fake.disks)
+	assert.Equal(t, map[string]map[string]interface{}{
+		"snap-1-archive": {
+			"name":                  "snap-1-archive",
+			"status":                "READY",
+			"snapshotType":          "ARCHIVE",
+			"description":           `{"velero.io/backup":"nightly"}`,
+			"labels":                map[string]interface{}{backupLabel: "nightly", pvLabel: "pvc-1", archiveOfLabel: "snap-1", snapshotTierLabel: archiveSnapshotTier},
+			"storageLocations":      []interface{}{"us"},
+			"snapshotEncryptionKey": map[string]interface{}{"kmsKeyName": key},
+		},
+	}, fake.snapshots)
+
+	// Velero keeps the name it recorded
+	snapshot, err := b.getSnapshot("p", "snap-1")
+	require.NoError(t, err)
+	assert.Equal(t, "snap-1-archive", snapshot.Name)
+
+	// archived snapshots are left alone
+	fake.requests = nil
+	moved, err = b.archiveSnapshot("snap-1", false)
+	require.NoError(t, err)
+	assert.False(t, moved)
+	assert.Equal(t, []string{"GET /projects/p/global/snapshots/snap-1", "GET /projects/p/global/snapshots/snap-1-archive", "GET /projects/p/aggregated/disks"}, fake.requests)
+
+	deleted, err := b.deleteSnapshot("snap-1")
+	require.NoError(t, err)
+	assert.True(t, deleted)
+	assert.Empty(t, fake.snapshots)
+}
+
+func TestArchiveSnapshotFails(t *testing.T) {
+	defer func(interval time.Duration) { tieringPollInterval = interval }(tieringPollInterval)
+	tieringPollInterval = 0
+
+	fake := &fakeTieringCompute{
+		snapshots:      map[string]map[string]interface{}{"snap-1": testTieringSnapshot("projects/p/locations/us/keyRings/r/cryptoKeys/k")},
+		disks:          make(map[string]*compute.Disk),
+		snapshotStatus: "FAILED",
+	}
+	b := (&VolumeSnapshotter{
+		log:             velerotest.NewLogger(),
+		computeHTTP:     http.DefaultClient,
+		snapshotProject: "p",
+	}).withClients(&snapshotterClients{
+		gce: newFakeComputeService(t, fake.ServeHTTP),
+	})
+
+	// the snapshot is only deleted once its archive snapshot is ready
+	_, err := b.archiveSnapshot("snap-1", false)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "archive snapshot snap-1-archive of snapshot snap-1 failed, the snapshot is unchanged")
+	assert.Equal(t, "READY", fake.snapshots["snap-1"]["status"])
+	snapshot, err := b.getSnapshot("p", "snap-1")
+	require.NoError(t, err)
+	assert.Equal(t, "snap-1", snapshot.Name)
+
+	// the next run replaces the failed archive snapshot
+	fake.snapshotStatus = ""
+	moved, err := b.archiveSnapshot("snap-1", false)
+	require.NoError(t, err)
+	assert.True(t, moved)
+	assert.Empty(t, fake.disks)
+	assert.Equal(t, "READY", fake.snapshots["snap-1-archive"]["status"])
+	assert.NotContains(t, fake.snapshots, "snap-1")
+}
+
+func TestArchiveSnapshotResumes(t *testing.T) {
+	defer func(interval time.Duration) { tieringPollInterval = interval }(tieringPollInterval)
+	tieringPollInterval = 0
+
+	tieringDisk := func(labels map[string]string) map[string]*compute.Disk {
+		return map[string]*compute.Disk{
+			"tiering-1": {
+				Name:        "tiering-1",
+				Zone:        "https://compute.googleapis.com/compute/v1/projects/p/zones/us-central1-a",
+				Status:      "READY",
+				Description: `{"velero.io/backup":"nightly"}`,
+				Labels:      labels,
+			},
+		}
+	}
+	archive := map[string]interface{}{"name": "snap-1-archive", "status": "READY", "labels": map[string]string{backupLabel: "nightly", archiveOfLabel: "snap-1"}}
+	fake := &fakeTieringCompute{}
+	b := (&VolumeSnapshotter{
+		log:             velerotest.NewLogger(),
+		computeHTTP:     http.DefaultClient,
+		snapshotProject: "p",
+	}).withClients(&snapshotterClients{
+		gce: newFakeComputeService(t, fake.ServeHTTP),
+	})
+
+	// the archive snapshot is ready, but the move stopped before deleting
+	// the disk and the snapshot
+	fake.snapshots = map[string]map[string]interface{}{"snap-1": testTieringSnapshot(""), "snap-1-archive": archive}
+	fake.disks = tieringDisk(map[string]string{backupLabel: "nightly", tieringOfLabel: "snap-1", archiveOfLabel: "snap-1"})
+	moved, err := b.archiveSnapshot("snap-1", false)
+	require.NoError(t, err)
+	assert.True(t, moved)
+	assert.Empty(t, fake.disks)
+	assert.Equal(t, []string{"snap-1-archive"}, snapshotNames(fake.snapshots))
+
+	// the snapshot was deleted with its backup during the move
+	fake.snapshots = map[string]map[string]interface{}{"snap-1-archive": archive}
+	fake.disks = tieringDisk(map[string]string{backupLabel: "nightly", tieringOfLabel: "snap-1", archiveOfLabel: "snap-1"})
+	moved, err = b.archiveSnapshot("snap-1", false)
+	require.NoError(t, err)
+	assert.False(t, moved)
+	assert.Empty(t, fake.disks)
+	assert.Empty(t, fake.snapshots)
+
+	// an earlier version deleted the snapshot but didn't create its
+	// archive snapshot
+	fake.snapshots = make(map[string]map[string]interface{})
+	fake.disks = tieringDisk(map[string]string{backupLabel: "nightly", tieringOfLabel: "snap-1"})
+
+	// restores explain where the snapshot went
+	_, err = b.createVolumeFromSnapshot("snap-1", "pd-standard", "us-central1-a")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "snapshot snap-1 is being moved to archive storage by apply-tiering, and its data is in disk tiering-1")
+
+	_, err = b.archiveSnapshot("snap-1", false)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "its data is only in disk tiering-1")
+	assert.Len(t, fake.disks, 1)
+}
+
+func snapshotNames(snapshots map[string]map[string]interface{}) []string {
+	var names []string
+	for name := range snapshots {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestTierBackupObjects(t *testing.T) {
+	var rewrites []map[string]interface{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodGet && strings.HasSuffix(r.URL.Path, "/b/bucket/o"):
+			assert.Equal(t, "velero/backups/nightly/", r.URL.Query().Get("prefix"))
+			json.NewEncoder(w).Encode(map[string]interface{}{"items": []map[string]interface{}{
+				{"name": "velero/backups/nightly/nightly.tar.gz", "bucket": "bucket", "storageClass": "STANDARD", "generation": "7", "contentType": "application/octet-stream", "metadata": map[string]string{"k": "v"}},
+				{"name": "velero/backups/nightly/nightly-logs.gz", "bucket": "bucket", "storageClass": "ARCHIVE", "generation": "8"},
+				{"name": "velero/backups/nightly/nightly-gcp-tiering.json", "bucket": "bucket", "storageClass": "STANDARD", "generation": "9"},
+			}})
+		case r.Method == http.MethodPost && strings.Contains(r.URL.Path, "/rewriteTo/"):
+			assert.Equal(t, "7", r.URL.Query().Get("sourceGeneration"))
+			assert.Equal(t, "7", r.URL.Query().Get("ifGenerationMatch"))
+			body := make(map[string]interface{})
+			json.NewDecoder(r.Body).Decode(&body)
+			rewrites = append(rewrites, body)
+			json.NewEncoder(w).Encode(map[string]interface{}{"done": true, "resource": body})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+	client, err := storage.NewClient(context.Background(), option.WithEndpoint(server.URL+"/storage/v1/"), option.WithoutAuthentication())
+	require.NoError(t, err)
+
+	o := newObjectStore(velerotest.NewLogger())
+	o.setClients(func(c *objectStoreClients) { c.client, c.readClient = client, client })
+
+	// only objects in warmer classes are moved, except the tiering record
+	n, err := o.tierBackupObjects("bucket", "velero", "nightly", "COLDLINE", true)
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+	assert.Empty(t, rewrites)
+
+	n, err = o.tierBackupObjects("bucket", "velero", "nightly", "COLDLINE", false)
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+	require.Len(t, rewrites, 1)
+	assert.Equal(t, "COLDLINE", rewrites[0]["storageClass"])
+	assert.Equal(t, "application/octet-stream", rewrites[0]["contentType"])
+	assert.Equal(t, map[string]interface{}{"k": "v"}, rewrites[0]["metadata"])
+}
+
+func TestTieringRecord(t *testing.T) {
+	assert.Equal(t, "velero/backups/nightly/nightly-gcp-tiering.json", tieringRecordKey("velero", "nightly"))
+	assert.Equal(t, testKeyName, kmsCryptoKey(testKeyName+"/cryptoKeyVersions/3"))
+
+	var record tieringRecord
+	record.recordSnapshotTier("snap-1", "snap-1-archive", archiveSnapshotTier, time.Unix(1, 0))
+	record.recordSnapshotTier("snap-2", "snap-2-archive", archiveSnapshotTier, time.Unix(2, 0))
+	record.recordSnapshotTier("snap-1", "snap-1-archive", archiveSnapshotTier, time.Unix(3, 0))
+	assert.Equal(t, []snapshotTier{
+		{Name: "snap-1", Snapshot: "snap-1-archive", Tier: archiveSnapshotTier, Transitioned: time.Unix(3, 0)},
+		{Name: "snap-2", Snapshot: "snap-2-archive", Tier: archiveSnapshotTier, Transitioned: time.Unix(2, 0)},
+	}, record.Snapshots)
+}
@@ -0,0 +1,76 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/oauth2"
+)
+
+const (
+	accessTokenFileConfigKey = "accessTokenFile"
+
+	// accessTokenEnvVar holds a pre-issued OAuth2 access token, used instead
+	// of application default credentials.
+	accessTokenEnvVar = "GOOGLE_OAUTH_ACCESS_TOKEN"
+)
+
+// fileTokenSource returns the OAuth2 access token stored in a file, e.g. one
+// kept fresh by a sidecar. The file is re-read whenever it changes.
+type fileTokenSource struct {
+	path string
+
+	lock    sync.Mutex
+	modTime time.Time
+	token   *oauth2.Token
+}
+
+func newFileTokenSource(path string) *fileTokenSource {
+	return &fileTokenSource{path: path}
+}
+
+func (s *fileTokenSource) Token() (*oauth2.Token, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	info, err := os.Stat(s.path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error reading access token file %v", s.path)
+	}
+	if s.token != nil && info.ModTime().Equal(s.modTime) {
+		return s.token, nil
+	}
+
+	b, err := ioutil.ReadFile(s.path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error reading access token file %v", s.path)
+	}
+	accessToken := strings.TrimSpace(string(b))
+	if accessToken == "" {
+		return nil, errors.Errorf("access token file %v is empty", s.path)
+	}
+
+	s.token = &oauth2.Token{AccessToken: accessToken, TokenType: "Bearer"}
+	s.modTime = info.ModTime()
+	return s.token, nil
+}
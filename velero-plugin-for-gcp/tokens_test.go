@@ -0,0 +1,90 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFileTokenSource(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "token")
+	ts := newFileTokenSource(path)
+
+	_, err := ts.Token()
+	assert.Error(t, err, "missing token file")
+
+	require.NoError(t, ioutil.WriteFile(path, []byte("\n"), 0600))
+	_, err = ts.Token()
+	assert.Error(t, err, "empty token file")
+
+	require.NoError(t, ioutil.WriteFile(path, []byte("ya29.first\n"), 0600))
+	token, err := ts.Token()
+	require.NoError(t, err)
+	assert.Equal(t, "ya29.first", token.AccessToken)
+
+	// the sidecar refreshes the token
+	require.NoError(t, ioutil.WriteFile(path, []byte("ya29.second"), 0600))
+	later := time.Now().Add(time.Minute)
+	require.NoError(t, os.Chtimes(path, later, later))
+	token, err = ts.Token()
+	require.NoError(t, err)
+	assert.Equal(t, "ya29.second", token.AccessToken)
+}
+
+func TestLocationCredentialsAccessToken(t *testing.T) {
+	t.Setenv(credentialsJSONEnvVar, "")
+	t.Setenv(accessTokenEnvVar, "")
+
+	c, err := newLocationCredentials(&fakeSecrets{}, map[string]string{}, "")
+	require.NoError(t, err)
+	assert.Nil(t, c.tokenSource)
+
+	c, err = newLocationCredentials(&fakeSecrets{}, map[string]string{accessTokenFileConfigKey: "/var/run/token/access-token"}, "")
+	require.NoError(t, err)
+	assert.IsType(t, &fileTokenSource{}, c.tokenSource)
+
+	t.Setenv(accessTokenEnvVar, "ya29.static")
+	c, err = newLocationCredentials(&fakeSecrets{}, map[string]string{}, "")
+	require.NoError(t, err)
+	require.NotNil(t, c.tokenSource)
+	token, err := c.tokenSource.Token()
+	require.NoError(t, err)
+	assert.Equal(t, "ya29.static", token.AccessToken)
+	assert.Len(t, c.baseOptions(), 1)
+
+	creds, err := c.find(context.Background())
+	require.NoError(t, err)
+	assert.Empty(t, creds.ProjectID)
+
+	c, err = newLocationCredentials(&fakeSecrets{}, map[string]string{credentialsFileConfigKey: "/credentials/cloud"}, "")
+	require.NoError(t, err)
+	assert.Nil(t, c.tokenSource, "credentials configured for the location take precedence over the environment")
+
+	_, err = newLocationCredentials(&fakeSecrets{}, map[string]string{
+		credentialsFileConfigKey: "/credentials/cloud",
+		accessTokenFileConfigKey: "/var/run/token/access-token",
+	}, "")
+	assert.Error(t, err)
+}
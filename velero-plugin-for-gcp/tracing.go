@@ -0,0 +1,413 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// The standard OpenTelemetry environment variables configuring the export of
+// spans. Only the http/json OTLP protocol is supported.
+const (
+	otlpEndpointEnvVar       = "OTEL_EXPORTER_OTLP_ENDPOINT"
+	otlpTracesEndpointEnvVar = "OTEL_EXPORTER_OTLP_TRACES_ENDPOINT"
+	otlpHeadersEnvVar        = "OTEL_EXPORTER_OTLP_HEADERS"
+	otlpProtocolEnvVar       = "OTEL_EXPORTER_OTLP_PROTOCOL"
+	otelServiceNameEnvVar    = "OTEL_SERVICE_NAME"
+	otelResourceEnvVar       = "OTEL_RESOURCE_ATTRIBUTES"
+
+	otlpJSONProtocol   = "http/json"
+	defaultServiceName = "velero-plugin-for-gcp"
+
+	backupNameAttribute  = "velero.backup.name"
+	restoreNameAttribute = "velero.restore.name"
+)
+
+// OTLP span kinds and status codes.
+const (
+	spanKindInternal = 1
+	spanKindClient   = 3
+
+	spanStatusError = 2
+)
+
+var (
+	// pluginTracer exports the plugin's spans. It is nil, and spans are
+	// discarded, unless an OTLP endpoint is configured.
+	pluginTracer *tracer
+	tracingOnce  sync.Once
+
+	// spanQueueSize is how many ended spans can wait to be exported before
+	// new ones are dropped.
+	spanQueueSize = 1024
+	// maxSpanBatch is the most spans exported in one request.
+	maxSpanBatch = 256
+)
+
+// startTracing starts exporting spans to the OTLP endpoint from the
+// environment, if any. It is safe to call more than once.
+func startTracing(log logrus.FieldLogger) {
+	tracingOnce.Do(func() {
+		endpoint := os.Getenv(otlpTracesEndpointEnvVar)
+		if endpoint == "" {
+			if base := os.Getenv(otlpEndpointEnvVar); base != "" {
+				endpoint = strings.TrimSuffix(base, "/") + "/v1/traces"
+			}
+		}
+		if endpoint == "" {
+			return
+		}
+		if protocol := os.Getenv(otlpProtocolEnvVar); protocol != "" && protocol != otlpJSONProtocol {
+			log.Warnf("Not exporting traces: OTLP protocol %s isn't supported, set %s to %s", protocol, otlpProtocolEnvVar, otlpJSONProtocol)
+			return
+		}
+
+		t := newTracer(log, endpoint, parseKeyValues(os.Getenv(otlpHeadersEnvVar)), tracingResource())
+		go t.run()
+		pluginTracer = t
+	})
+}
+
+// tracingResource returns the attributes describing the plugin in exported
+// spans.
+func tracingResource() map[string]string {
+	resource := parseKeyValues(os.Getenv(otelResourceEnvVar))
+	if name := os.Getenv(otelServiceNameEnvVar); name != "" {
+		resource["service.name"] = name
+	}
+	if resource["service.name"] == "" {
+		resource["service.name"] = defaultServiceName
+	}
+	return resource
+}
+
+// parseKeyValues parses a comma-separated list of URL encoded key=value
+// pairs, the format of the OpenTelemetry headers and resource attributes
+// environment variables.
+func parseKeyValues(s string) map[string]string {
+	values := make(map[string]string)
+	for _, pair := range parseList(s) {
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		key, keyErr := url.QueryUnescape(strings.TrimSpace(parts[0]))
+		value, valueErr := url.QueryUnescape(strings.TrimSpace(parts[1]))
+		if keyErr != nil || valueErr != nil || key == "" {
+			continue
+		}
+		values[key] = value
+	}
+	return values
+}
+
+// tracer exports ended spans to an OTLP/HTTP endpoint in the background,
+// batching the spans that end while a request is in flight.
+type tracer struct {
+	log      logrus.FieldLogger
+	endpoint string
+	headers  map[string]string
+	resource map[string]string
+	client   *http.Client
+	queue    chan *span
+}
+
+func newTracer(log logrus.FieldLogger, endpoint string, headers, resource map[string]string) *tracer {
+	return &tracer{
+		log:      log,
+		endpoint: endpoint,
+		headers:  headers,
+		resource: resource,
+		client:   &http.Client{Timeout: 10 * time.Second},
+		queue:    make(chan *span, spanQueueSize),
+	}
+}
+
+func (t *tracer) run() {
+	for first := range t.queue {
+		batch := []*span{first}
+	drain:
+		for len(batch) < maxSpanBatch {
+			select {
+			case s := <-t.queue:
+				batch = append(batch, s)
+			default:
+				break drain
+			}
+		}
+		if err := t.export(batch); err != nil {
+			t.log.WithError(err).Warnf("Unable to export %d spans", len(batch))
+		}
+	}
+}
+
+// enqueue schedules an ended span for export, dropping it if too many
+// spans are waiting so the plugin's operations never block on tracing.
+func (t *tracer) enqueue(s *span) {
+	select {
+	case t.queue <- s:
+	default:
+		t.log.Debugf("Dropping span %s, the export queue is full", s.name)
+	}
+}
+
+// export sends spans to the endpoint in the JSON encoding of an OTLP
+// ExportTraceServiceRequest.
+func (t *tracer) export(spans []*span) error {
+	body, err := json.Marshal(otlpRequest{ResourceSpans: []otlpResourceSpans{{
+		Resource: otlpResource{Attributes: otlpAttributes(t.resource)},
+		ScopeSpans: []otlpScopeSpans{{
+			Scope: otlpScope{Name: defaultServiceName},
+			Spans: otlpSpans(spans),
+		}},
+	}}})
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	req, err := http.NewRequest(http.MethodPost, t.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range t.headers {
+		req.Header.Set(k, v)
+	}
+
+	res, err := t.client.Do(req)
+	if err != nil {
+		return errors.Wrapf(err, "error exporting spans to %s", t.endpoint)
+	}
+	defer res.Body.Close()
+	if res.StatusCode/100 != 2 {
+		return errors.Errorf("error exporting spans to %s: %s", t.endpoint, res.Status)
+	}
+	return nil
+}
+
+// span is a timed plugin operation. Spans of the same backup or restore
+// share a trace, whose ID is derived from the backup or restore name, so
+// the operations of different plugin processes can be followed end to end.
+type span struct {
+	tracer     *tracer
+	traceID    [16]byte
+	spanID     [8]byte
+	name       string
+	kind       int
+	start, end time.Time
+	attributes map[string]string
+	err        error
+	once       sync.Once
+}
+
+// startSpan starts a span. The trace is picked from the backup or restore
+// name attribute, if any, and is random otherwise. Spans started while
+// tracing is disabled are no-ops.
+func startSpan(name string, kind int, attributes map[string]string) *span {
+	if attributes == nil {
+		attributes = make(map[string]string)
+	}
+	s := &span{tracer: pluginTracer, name: name, kind: kind, start: time.Now(), attributes: attributes}
+	if s.tracer == nil {
+		return s
+	}
+
+	switch {
+	case attributes[backupNameAttribute] != "":
+		s.traceID = traceIDFor("backup", attributes[backupNameAttribute])
+	case attributes[restoreNameAttribute] != "":
+		s.traceID = traceIDFor("restore", attributes[restoreNameAttribute])
+	default:
+		rand.Read(s.traceID[:])
+	}
+	rand.Read(s.spanID[:])
+	return s
+}
+
+// traceIDFor returns the ID of the trace of a backup or restore.
+func traceIDFor(kind, name string) [16]byte {
+	var id [16]byte
+	sum := sha256.Sum256([]byte("velero.io/" + kind + "/" + name))
+	copy(id[:], sum[:])
+	return id
+}
+
+func (s *span) setAttribute(key, value string) {
+	if value != "" {
+		s.attributes[key] = value
+	}
+}
+
+// finish ends the span with the result of its operation and schedules it
+// for export. Only the first call has an effect.
+func (s *span) finish(err error) {
+	if s.tracer == nil {
+		return
+	}
+	s.once.Do(func() {
+		s.end = time.Now()
+		s.err = err
+		s.tracer.enqueue(s)
+	})
+}
+
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttribute `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            *otlpStatus     `json:"status,omitempty"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+func otlpSpans(spans []*span) []otlpSpan {
+	res := make([]otlpSpan, 0, len(spans))
+	for _, s := range spans {
+		o := otlpSpan{
+			TraceID:           hex.EncodeToString(s.traceID[:]),
+			SpanID:            hex.EncodeToString(s.spanID[:]),
+			Name:              s.name,
+			Kind:              s.kind,
+			StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+			Attributes:        otlpAttributes(s.attributes),
+		}
+		if s.err != nil {
+			o.Status = &otlpStatus{Code: spanStatusError, Message: s.err.Error()}
+		}
+		res = append(res, o)
+	}
+	return res
+}
+
+func otlpAttributes(attributes map[string]string) []otlpAttribute {
+	keys := make([]string, 0, len(attributes))
+	for k, v := range attributes {
+		if v != "" {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	res := make([]otlpAttribute, 0, len(keys))
+	for _, k := range keys {
+		res = append(res, otlpAttribute{Key: k, Value: otlpValue{StringValue: attributes[k]}})
+	}
+	return res
+}
+
+// objectSpanAttributes returns the attributes of a span of an operation on
+// an object, including the backup or restore the object belongs to when
+// its key follows Velero's layout, e.g. PREFIX/backups/BACKUP/FILE.
+func objectSpanAttributes(bucket, key string) map[string]string {
+	attributes := map[string]string{"gcs.bucket": bucket, "gcs.object": key}
+	segments := strings.Split(key, "/")
+	for i := 0; i+2 < len(segments); i++ {
+		switch segments[i] {
+		case "backups":
+			attributes[backupNameAttribute] = segments[i+1]
+			return attributes
+		case "restores":
+			attributes[restoreNameAttribute] = segments[i+1]
+			return attributes
+		}
+	}
+	return attributes
+}
+
+// tracedReader ends a span of a download when it is closed, recording the
+// bytes read and any read error.
+type tracedReader struct {
+	io.ReadCloser
+	span    *span
+	bytes   int64
+	readErr error
+}
+
+func (r *tracedReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.bytes += int64(n)
+	if err != nil && err != io.EOF {
+		r.readErr = err
+	}
+	return n, err
+}
+
+func (r *tracedReader) Close() error {
+	err := r.ReadCloser.Close()
+	r.span.setAttribute("gcs.bytes", strconv.FormatInt(r.bytes, 10))
+	if r.readErr != nil {
+		r.span.finish(r.readErr)
+	} else {
+		r.span.finish(err)
+	}
+	return err
+}
@@ -0,0 +1,142 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	velerotest "github.com/vmware-tanzu/velero/pkg/test"
+)
+
+func TestParseKeyValues(t *testing.T) {
+	assert.Equal(t, map[string]string{}, parseKeyValues(""))
+	assert.Equal(t,
+		map[string]string{"Authorization": "Bearer abc", "x-tenant": "a=b"},
+		parseKeyValues("Authorization=Bearer%20abc, x-tenant=a=b,invalid,=empty"),
+	)
+}
+
+func TestObjectSpanAttributes(t *testing.T) {
+	assert.Equal(t,
+		map[string]string{"gcs.bucket": "b", "gcs.object": "prefix/backups/b1/b1.tar.gz", backupNameAttribute: "b1"},
+		objectSpanAttributes("b", "prefix/backups/b1/b1.tar.gz"),
+	)
+	assert.Equal(t,
+		map[string]string{"gcs.bucket": "b", "gcs.object": "restores/r1/restore-r1-logs.gz", restoreNameAttribute: "r1"},
+		objectSpanAttributes("b", "restores/r1/restore-r1-logs.gz"),
+	)
+	assert.Equal(t,
+		map[string]string{"gcs.bucket": "b", "gcs.object": "restic/ns/config"},
+		objectSpanAttributes("b", "restic/ns/config"),
+	)
+}
+
+func TestStartSpanWithoutTracing(t *testing.T) {
+	defer func(t *tracer) { pluginTracer = t }(pluginTracer)
+	pluginTracer = nil
+
+	span := startSpan("op", spanKindInternal, nil)
+	span.setAttribute("key", "value")
+	span.finish(nil)
+	assert.True(t, span.end.IsZero())
+}
+
+func TestTracerExport(t *testing.T) {
+	var (
+		request otlpRequest
+		headers http.Header
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		headers = r.Header
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&request))
+	}))
+	defer server.Close()
+
+	defer func(t *tracer) { pluginTracer = t }(pluginTracer)
+	pluginTracer = newTracer(velerotest.NewLogger(), server.URL+"/v1/traces", map[string]string{"Authorization": "Bearer abc"}, map[string]string{"service.name": "velero"})
+
+	snapshot := startSpan("compute.CreateSnapshot", spanKindInternal, map[string]string{backupNameAttribute: "b1", "gcp.zone": ""})
+	snapshot.finish(nil)
+	upload := startSpan("gcs.PutObject", spanKindClient, objectSpanAttributes("bucket", "backups/b1/b1.tar.gz"))
+	upload.finish(errors.New("upload failed"))
+	// only the first result is recorded
+	upload.finish(nil)
+	disk := startSpan("compute.CreateVolumeFromSnapshot", spanKindInternal, nil)
+	disk.finish(nil)
+
+	require.Len(t, pluginTracer.queue, 3)
+	spans := []*span{<-pluginTracer.queue, <-pluginTracer.queue, <-pluginTracer.queue}
+	require.NoError(t, pluginTracer.export(spans))
+
+	assert.Equal(t, "application/json", headers.Get("Content-Type"))
+	assert.Equal(t, "Bearer abc", headers.Get("Authorization"))
+
+	require.Len(t, request.ResourceSpans, 1)
+	assert.Equal(t, []otlpAttribute{{Key: "service.name", Value: otlpValue{StringValue: "velero"}}}, request.ResourceSpans[0].Resource.Attributes)
+	require.Len(t, request.ResourceSpans[0].ScopeSpans, 1)
+	exported := request.ResourceSpans[0].ScopeSpans[0].Spans
+	require.Len(t, exported, 3)
+
+	// spans of the same backup share a trace
+	backupTrace := traceIDFor("backup", "b1")
+	assert.Equal(t, hex.EncodeToString(backupTrace[:]), exported[0].TraceID)
+	assert.Equal(t, exported[0].TraceID, exported[1].TraceID)
+	assert.NotEqual(t, exported[0].TraceID, exported[2].TraceID)
+	assert.NotEqual(t, exported[0].SpanID, exported[1].SpanID)
+
+	assert.Equal(t, "compute.CreateSnapshot", exported[0].Name)
+	assert.Equal(t, []otlpAttribute{{Key: backupNameAttribute, Value: otlpValue{StringValue: "b1"}}}, exported[0].Attributes)
+	assert.Nil(t, exported[0].Status)
+	assert.Equal(t, spanKindClient, exported[1].Kind)
+	assert.Equal(t, &otlpStatus{Code: spanStatusError, Message: "upload failed"}, exported[1].Status)
+}
+
+func TestTracerExportError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer server.Close()
+
+	tr := newTracer(velerotest.NewLogger(), server.URL, nil, nil)
+	assert.Error(t, tr.export([]*span{{tracer: tr, name: "op", attributes: map[string]string{}}}))
+}
+
+func TestTracedReader(t *testing.T) {
+	defer func(t *tracer) { pluginTracer = t }(pluginTracer)
+	pluginTracer = newTracer(velerotest.NewLogger(), "http://localhost", nil, nil)
+
+	span := startSpan("gcs.GetObject", spanKindClient, nil)
+	r := &tracedReader{ReadCloser: ioutil.NopCloser(strings.NewReader("backup data")), span: span}
+	data, err := ioutil.ReadAll(r)
+	require.NoError(t, err)
+	assert.Equal(t, "backup data", string(data))
+	require.NoError(t, r.Close())
+
+	assert.Equal(t, "11", span.attributes["gcs.bytes"])
+	assert.False(t, span.end.IsZero())
+	assert.Len(t, pluginTracer.queue, 1)
+}
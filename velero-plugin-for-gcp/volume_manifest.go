@@ -0,0 +1,318 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	api "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+)
+
+// volumeManifestConfigKey is the key of a VolumeSnapshotLocation's config
+// enabling the volume manifest, which records the disk and snapshot of each
+// persistent volume in a backup in the backup's directory of its backup
+// storage location, for tooling that doesn't talk to Velero.
+const volumeManifestConfigKey = "volumeManifest"
+
+// volumeManifest is the content of a backup's volume manifest.
+type volumeManifest struct {
+	Backup  string                `json:"backup"`
+	Volumes []volumeManifestEntry `json:"volumes"`
+}
+
+type volumeManifestEntry struct {
+	PersistentVolumeClaim string    `json:"persistentVolumeClaim,omitempty"`
+	PersistentVolume      string    `json:"persistentVolume"`
+	Volume                string    `json:"volume"`
+	Snapshot              string    `json:"snapshot"`
+	Created               time.Time `json:"created"`
+	// DurationSeconds is how long creating the snapshot took, until GCP
+	// accepted it.
+	DurationSeconds float64 `json:"durationSeconds,omitempty"`
+	snapshotDetails
+}
+
+// snapshotDetails is what GCP reports about a snapshot or Filestore backup.
+// The stored size is only known once the snapshot is ready.
+type snapshotDetails struct {
+	SelfLink     string `json:"selfLink,omitempty"`
+	Status       string `json:"status,omitempty"`
+	DiskSizeGB   int64  `json:"diskSizeGb,omitempty"`
+	StorageBytes int64  `json:"storageBytes,omitempty"`
+}
+
+// final reports whether a snapshot's details won't change anymore.
+func (d snapshotDetails) final() bool {
+	return d.Status == "READY" || d.Status == "FAILED"
+}
+
+// manifestStore reads and writes the volume manifests in a backup storage
+// location.
+type manifestStore interface {
+	ObjectExists(bucket, key string) (bool, error)
+	GetObject(bucket, key string) (io.ReadCloser, error)
+	PutObject(bucket, key string, body io.Reader) error
+}
+
+func (inCluster) backupStorageLocation(backupName string) (*api.BackupStorageLocation, error) {
+	client, err := newInClusterClient()
+	if err != nil {
+		return nil, err
+	}
+	namespace := veleroNamespace()
+	backup, err := client.getBackup(namespace, backupName)
+	if err != nil {
+		return nil, err
+	}
+	return client.getBackupStorageLocation(namespace, backup.Spec.StorageLocation)
+}
+
+func (inCluster) volumeClaim(pvName string) (string, error) {
+	client, err := newInClusterClient()
+	if err != nil {
+		return "", err
+	}
+	pv, err := client.getPersistentVolume(pvName)
+	if err != nil {
+		return "", err
+	}
+	if pv.Spec.ClaimRef == nil {
+		return "", nil
+	}
+	return pv.Spec.ClaimRef.Namespace + "/" + pv.Spec.ClaimRef.Name, nil
+}
+
+// newManifestStore returns the object store of a backup storage location.
+func newManifestStore(log logrus.FieldLogger, location *api.BackupStorageLocation) (manifestStore, error) {
+	config := map[string]string{"bucket": location.Spec.ObjectStorage.Bucket, "prefix": location.Spec.ObjectStorage.Prefix}
+	for k, v := range location.Spec.Config {
+		config[k] = v
+	}
+	o := newObjectStore(log)
+	if err := o.Init(config); err != nil {
+		return nil, err
+	}
+	return o, nil
+}
+
+// volumeManifestWriter adds the snapshots a volume snapshotter takes to the
+// volume manifests of their backups.
+type volumeManifestWriter struct {
+	log     logrus.FieldLogger
+	cluster veleroCluster
+	now     func() time.Time
+	// describe returns the details of a snapshot by its resource name.
+	describe func(snapshot string) (snapshotDetails, error)
+	// newStore returns the object store of a backup storage location.
+	newStore func(log logrus.FieldLogger, location *api.BackupStorageLocation) (manifestStore, error)
+
+	lock   sync.Mutex
+	stores map[string]manifestStore
+}
+
+func newVolumeManifestWriter(log logrus.FieldLogger, cluster veleroCluster, describe func(snapshot string) (snapshotDetails, error)) *volumeManifestWriter {
+	return &volumeManifestWriter{
+		log:      log,
+		cluster:  cluster,
+		now:      time.Now,
+		describe: describe,
+		newStore: newManifestStore,
+		stores:   make(map[string]manifestStore),
+	}
+}
+
+// volumeManifestKey returns the key of a backup's volume manifest, next to
+// the other files of the backup.
+func volumeManifestKey(prefix, backup string) string {
+	return path.Join(prefix, "backups", backup, backup+"-gcp-volumes.json")
+}
+
+// record adds a snapshot to its backup's volume manifest, with how long
+// creating it took. It never fails the snapshot, since the manifest is only
+// informational.
+func (w *volumeManifestWriter) record(volume, snapshot string, tags map[string]string, duration time.Duration) {
+	backup, pv := tags[backupNameTag], tags[pvNameTag]
+	if w == nil || backup == "" {
+		return
+	}
+	log := w.log.WithFields(logrus.Fields{"backup": backup, "persistentVolume": pv})
+	entry := volumeManifestEntry{
+		PersistentVolume: pv,
+		Volume:           volume,
+		Snapshot:         snapshot,
+		Created:          w.now().UTC(),
+		DurationSeconds:  duration.Seconds(),
+	}
+	if err := w.add(backup, entry); err != nil {
+		log.WithError(err).Warn("Unable to add the snapshot to the backup's volume manifest")
+	}
+}
+
+func (w *volumeManifestWriter) add(backup string, entry volumeManifestEntry) error {
+	// snapshots of a backup are taken one at a time, but the lock keeps
+	// concurrent backups from racing on the stores
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	location, err := w.cluster.backupStorageLocation(backup)
+	if err != nil {
+		return err
+	}
+	if !isGCPProvider(location.Spec.Provider) || location.Spec.ObjectStorage == nil {
+		return errors.Errorf("backup storage location %s isn't a GCS bucket", location.Name)
+	}
+	store, ok := w.stores[location.Name]
+	if !ok {
+		if store, err = w.newStore(w.log, location); err != nil {
+			return err
+		}
+		w.stores[location.Name] = store
+	}
+
+	if entry.PersistentVolume != "" {
+		if entry.PersistentVolumeClaim, err = w.cluster.volumeClaim(entry.PersistentVolume); err != nil {
+			w.log.WithError(err).Debug("Unable to find the claim of the persistent volume")
+		}
+	}
+
+	bucket, key := location.Spec.ObjectStorage.Bucket, volumeManifestKey(location.Spec.ObjectStorage.Prefix, backup)
+	manifest := volumeManifest{Backup: backup}
+	exists, err := store.ObjectExists(bucket, key)
+	if err != nil {
+		return err
+	}
+	if exists {
+		body, err := store.GetObject(bucket, key)
+		if err != nil {
+			return err
+		}
+		defer body.Close()
+		if err := json.NewDecoder(body).Decode(&manifest); err != nil {
+			return errors.Wrapf(err, "error decoding volume manifest %s", key)
+		}
+	}
+
+	// a retried snapshot replaces the volume's entry
+	replaced := false
+	for i := range manifest.Volumes {
+		if manifest.Volumes[i].PersistentVolume == entry.PersistentVolume && entry.PersistentVolume != "" {
+			manifest.Volumes[i], replaced = entry, true
+		}
+	}
+	if !replaced {
+		manifest.Volumes = append(manifest.Volumes, entry)
+	}
+
+	// snapshots are uploaded in the background, so the details of the
+	// earlier ones are updated as the backup goes
+	for i := range manifest.Volumes {
+		v := &manifest.Volumes[i]
+		if w.describe == nil || v.final() {
+			continue
+		}
+		details, err := w.describe(v.Snapshot)
+		if err != nil {
+			w.log.WithError(err).WithField("snapshot", v.Snapshot).Debug("Unable to get the details of the snapshot")
+			continue
+		}
+		v.snapshotDetails = details
+	}
+
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	return store.PutObject(bucket, key, bytes.NewReader(data))
+}
+
+// manifestVolume returns the resource name of a snapshotted volume.
+func (b *VolumeSnapshotter) manifestVolume(volumeID, volumeAZ string) string {
+	if isFilestoreVolume(volumeID) {
+		return volumeID
+	}
+	if isMultiZone(volumeAZ) {
+		if region, err := parseRegion(volumeAZ); err == nil {
+			return fmt.Sprintf("projects/%s/regions/%s/disks/%s", b.volumeProject, region, volumeID)
+		}
+	}
+	return fmt.Sprintf("projects/%s/zones/%s/disks/%s", b.volumeProject, volumeAZ, volumeID)
+}
+
+// describeSnapshot returns the details of a snapshot, Filestore backup or
+// backup vault backup by its resource name.
+func (b *VolumeSnapshotter) describeSnapshot(name string) (snapshotDetails, error) {
+	if isFilestoreBackup(name) {
+		svc, err := b.filestoreService()
+		if err != nil {
+			return snapshotDetails{}, err
+		}
+		backup, err := svc.Projects.Locations.Backups.Get(name).Do()
+		if err != nil {
+			return snapshotDetails{}, errors.WithStack(err)
+		}
+		return snapshotDetails{Status: backup.State, DiskSizeGB: backup.CapacityGb, StorageBytes: backup.StorageBytes}, nil
+	}
+
+	if isBackupVaultBackup(name) {
+		backup, err := b.getVaultBackup(name)
+		if err != nil {
+			return snapshotDetails{}, err
+		}
+		// backups that succeeded can be restored, like READY snapshots
+		details := snapshotDetails{Status: backup.State, StorageBytes: backup.ResourceSizeBytes}
+		if backup.State == vaultBackupSucceeded {
+			details.Status = "READY"
+		}
+		if backup.DiskBackupProperties != nil {
+			details.DiskSizeGB = backup.DiskBackupProperties.SizeGb
+		}
+		return details, nil
+	}
+
+	parts := strings.Split(name, "/")
+	if len(parts) != 5 {
+		return snapshotDetails{}, errors.Errorf("invalid snapshot name %q", name)
+	}
+	snapshot, err := b.getSnapshot(parts[1], parts[4])
+	if err != nil {
+		return snapshotDetails{}, errors.WithStack(err)
+	}
+	return snapshotDetails{
+		SelfLink:     snapshot.SelfLink,
+		Status:       snapshot.Status,
+		DiskSizeGB:   snapshot.DiskSizeGb,
+		StorageBytes: snapshot.StorageBytes,
+	}, nil
+}
+
+// manifestSnapshot returns the resource name of a snapshot, or the ID of a
+// Backup for GKE reference.
+func (b *VolumeSnapshotter) manifestSnapshot(snapshotID string) string {
+	if isFilestoreBackup(snapshotID) || isBackupVaultBackup(snapshotID) || isBackupForGKEReference(snapshotID) {
+		return snapshotID
+	}
+	return fmt.Sprintf("projects/%s/global/snapshots/%s", b.snapshotProject, snapshotID)
+}
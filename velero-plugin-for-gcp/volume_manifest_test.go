@@ -0,0 +1,203 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	api "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	velerotest "github.com/vmware-tanzu/velero/pkg/test"
+	"google.golang.org/api/compute/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+type fakeManifestStore struct {
+	objects map[string][]byte
+}
+
+func (s *fakeManifestStore) ObjectExists(bucket, key string) (bool, error) {
+	_, ok := s.objects[bucket+"/"+key]
+	return ok, nil
+}
+
+func (s *fakeManifestStore) GetObject(bucket, key string) (io.ReadCloser, error) {
+	return ioutil.NopCloser(bytes.NewReader(s.objects[bucket+"/"+key])), nil
+}
+
+func (s *fakeManifestStore) PutObject(bucket, key string, body io.Reader) error {
+	data, err := ioutil.ReadAll(body)
+	s.objects[bucket+"/"+key] = data
+	return err
+}
+
+func TestVolumeManifestWriter(t *testing.T) {
+	store := &fakeManifestStore{objects: make(map[string][]byte)}
+	location := &api.BackupStorageLocation{
+		ObjectMeta: metav1.ObjectMeta{Name: "default"},
+		Spec: api.BackupStorageLocationSpec{
+			Provider:    "velero.io/gcp",
+			StorageType: api.StorageType{ObjectStorage: &api.ObjectStorageLocation{Bucket: "bucket", Prefix: "cluster"}},
+		},
+	}
+
+	cluster := &fakeCluster{
+		location: location,
+		claims:   map[string]string{"pv-1": "ns/claim-pv-1", "pv-2": "ns/claim-pv-2", "pv-5": "ns/claim-pv-5"},
+	}
+
+	b := &VolumeSnapshotter{log: velerotest.NewLogger(), volumeProject: "vol-project", snapshotProject: "snap-project"}
+	// snap-2 becomes ready once another snapshot is recorded
+	described := map[string]int{}
+	w := newVolumeManifestWriter(b.log, cluster, func(snapshot string) (snapshotDetails, error) {
+		described[snapshot]++
+		if snapshot == "projects/snap-project/global/snapshots/snap-2" && described[snapshot] > 1 {
+			return snapshotDetails{SelfLink: "https://www.googleapis.com/compute/v1/" + snapshot, Status: "READY", DiskSizeGB: 10, StorageBytes: 1 << 30}, nil
+		}
+		return snapshotDetails{SelfLink: "https://www.googleapis.com/compute/v1/" + snapshot, Status: "CREATING", DiskSizeGB: 10}, nil
+	})
+	w.now = func() time.Time { return time.Date(2021, 1, 2, 3, 4, 5, 0, time.UTC) }
+	stores := 0
+	w.newStore = func(logrus.FieldLogger, *api.BackupStorageLocation) (manifestStore, error) {
+		stores++
+		return store, nil
+	}
+
+	tags := func(pv string) map[string]string {
+		return map[string]string{backupNameTag: "backup-1", pvNameTag: pv}
+	}
+	w.record(b.manifestVolume("disk-1", "us-central1-a"), b.manifestSnapshot("snap-1"), tags("pv-1"), time.Second)
+	w.record(b.manifestVolume("disk-2", "us-central1-a__us-central1-b"), b.manifestSnapshot("snap-2"), tags("pv-2"), 2*time.Second)
+	// a retried snapshot replaces the volume's entry
+	w.record(b.manifestVolume("disk-1", "us-central1-a"), b.manifestSnapshot("snap-3"), tags("pv-1"), 3*time.Second)
+	// snapshots taken outside of a backup aren't recorded
+	w.record(b.manifestVolume("disk-4", "us-central1-a"), b.manifestSnapshot("snap-4"), nil, time.Second)
+	// ready snapshots aren't described again
+	w.record(b.manifestVolume("disk-5", "us-central1-a"), b.manifestSnapshot("snap-5"), tags("pv-5"), time.Second)
+	assert.Equal(t, 2, described["projects/snap-project/global/snapshots/snap-2"])
+
+	assert.Equal(t, 1, stores)
+	data, ok := store.objects["bucket/cluster/backups/backup-1/backup-1-gcp-volumes.json"]
+	require.True(t, ok)
+
+	var manifest volumeManifest
+	require.NoError(t, json.Unmarshal(data, &manifest))
+	created := w.now()
+	assert.Equal(t, volumeManifest{
+		Backup: "backup-1",
+		Volumes: []volumeManifestEntry{
+			{
+				PersistentVolumeClaim: "ns/claim-pv-1",
+				PersistentVolume:      "pv-1",
+				Volume:                "projects/vol-project/zones/us-central1-a/disks/disk-1",
+				Snapshot:              "projects/snap-project/global/snapshots/snap-3",
+				Created:               created,
+				DurationSeconds:       3,
+				snapshotDetails: snapshotDetails{
+					SelfLink:   "https://www.googleapis.com/compute/v1/projects/snap-project/global/snapshots/snap-3",
+					Status:     "CREATING",
+					DiskSizeGB: 10,
+				},
+			},
+			{
+				PersistentVolumeClaim: "ns/claim-pv-2",
+				PersistentVolume:      "pv-2",
+				Volume:                "projects/vol-project/regions/us-central1/disks/disk-2",
+				Snapshot:              "projects/snap-project/global/snapshots/snap-2",
+				Created:               created,
+				DurationSeconds:       2,
+				snapshotDetails: snapshotDetails{
+					SelfLink:     "https://www.googleapis.com/compute/v1/projects/snap-project/global/snapshots/snap-2",
+					Status:       "READY",
+					DiskSizeGB:   10,
+					StorageBytes: 1 << 30,
+				},
+			},
+			{
+				PersistentVolumeClaim: "ns/claim-pv-5",
+				PersistentVolume:      "pv-5",
+				Volume:                "projects/vol-project/zones/us-central1-a/disks/disk-5",
+				Snapshot:              "projects/snap-project/global/snapshots/snap-5",
+				Created:               created,
+				DurationSeconds:       1,
+				snapshotDetails: snapshotDetails{
+					SelfLink:   "https://www.googleapis.com/compute/v1/projects/snap-project/global/snapshots/snap-5",
+					Status:     "CREATING",
+					DiskSizeGB: 10,
+				},
+			},
+		},
+	}, manifest)
+}
+
+func TestVolumeManifestWriterSkipsOtherProviders(t *testing.T) {
+	cluster := &fakeCluster{location: &api.BackupStorageLocation{Spec: api.BackupStorageLocationSpec{
+		Provider:    "aws",
+		StorageType: api.StorageType{ObjectStorage: &api.ObjectStorageLocation{Bucket: "bucket"}},
+	}}}
+
+	w := newVolumeManifestWriter(velerotest.NewLogger(), cluster, nil)
+	assert.Error(t, w.add("backup-1", volumeManifestEntry{PersistentVolume: "pv-1"}))
+}
+
+func TestManifestFilestoreNames(t *testing.T) {
+	b := &VolumeSnapshotter{volumeProject: "vol-project", snapshotProject: "snap-project"}
+	assert.Equal(t, "modeInstance/us-central1/instance/share", b.manifestVolume("modeInstance/us-central1/instance/share", ""))
+	assert.Equal(t, "projects/p/locations/us-central1/backups/b", b.manifestSnapshot("projects/p/locations/us-central1/backups/b"))
+}
+
+func TestVolumeSnapshotterInitVolumeManifest(t *testing.T) {
+	b := &VolumeSnapshotter{log: velerotest.NewLogger()}
+	err := b.Init(map[string]string{volumeManifestConfigKey: "maybe"})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), volumeManifestConfigKey)
+}
+
+func TestDescribeSnapshot(t *testing.T) {
+	gce := newFakeComputeService(t, func(w http.ResponseWriter, r *http.Request) {
+		assert.True(t, strings.HasSuffix(r.URL.Path, "/projects/snap-project/global/snapshots/snap-1"), r.URL.Path)
+		json.NewEncoder(w).Encode(&compute.Snapshot{
+			SelfLink:     "https://www.googleapis.com/compute/v1/projects/snap-project/global/snapshots/snap-1",
+			Status:       "READY",
+			DiskSizeGb:   10,
+			StorageBytes: 1 << 30,
+		})
+	})
+	b := (&VolumeSnapshotter{snapshotProject: "snap-project"}).withClients(&snapshotterClients{gce: gce})
+
+	details, err := b.describeSnapshot(b.manifestSnapshot("snap-1"))
+	require.NoError(t, err)
+	assert.Equal(t, snapshotDetails{
+		SelfLink:     "https://www.googleapis.com/compute/v1/projects/snap-project/global/snapshots/snap-1",
+		Status:       "READY",
+		DiskSizeGB:   10,
+		StorageBytes: 1 << 30,
+	}, details)
+	assert.True(t, details.final())
+
+	_, err = b.describeSnapshot("snap-1")
+	assert.Error(t, err)
+}
@@ -0,0 +1,68 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"time"
+)
+
+const (
+	snapshotsCounter         = "velero_gcp_snapshots_total"
+	snapshotDuration         = "velero_gcp_snapshot_duration_seconds"
+	snapshotDiskBytesCounter = "velero_gcp_snapshot_disk_bytes_total"
+	volumeRestoresCounter    = "velero_gcp_volume_restores_total"
+	volumeRestoreDuration    = "velero_gcp_volume_restore_duration_seconds"
+
+	outcomeSuccess = "success"
+	outcomeFailure = "failure"
+
+	// bytesPerGB is the size of the GB disk sizes are given in.
+	bytesPerGB = 1 << 30
+)
+
+// operationDurationBuckets are the upper bounds, in seconds, of the buckets
+// of the snapshot and restore duration histograms.
+var operationDurationBuckets = []float64{1, 5, 10, 30, 60, 120, 300, 600, 1800}
+
+func outcome(err error) string {
+	if err != nil {
+		return outcomeFailure
+	}
+	return outcomeSuccess
+}
+
+// recordSnapshot records the outcome and duration of a snapshot of a
+// backup, by the schedule that created the backup, if any.
+func recordSnapshot(tags map[string]string, start time.Time, err error) {
+	schedule := tags[scheduleNameLabel]
+	pluginMetrics.addCounter(snapshotsCounter, "Number of volume snapshots taken, by schedule and outcome.", map[string]string{"schedule": schedule, "outcome": outcome(err)}, 1)
+	pluginMetrics.observeHistogram(snapshotDuration, "Time taken to start volume snapshots in seconds, by schedule.", map[string]string{"schedule": schedule}, operationDurationBuckets, time.Since(start).Seconds())
+	pluginMetricsPusher.pushSoon()
+}
+
+// recordSnapshotDisk records the size of a disk a snapshot was started of.
+func recordSnapshotDisk(tags map[string]string, sizeGB int64) {
+	pluginMetrics.addCounter(snapshotDiskBytesCounter, "Total size in bytes of the disks snapshotted, by schedule.", map[string]string{"schedule": tags[scheduleNameLabel]}, float64(sizeGB*bytesPerGB))
+}
+
+// recordVolumeRestore records the outcome and duration of the creation of a
+// volume from a snapshot.
+func recordVolumeRestore(start time.Time, err error) {
+	pluginMetrics.addCounter(volumeRestoresCounter, "Number of volumes created from snapshots, by outcome.", map[string]string{"outcome": outcome(err)}, 1)
+	pluginMetrics.observeHistogram(volumeRestoreDuration, "Time taken to create volumes from snapshots in seconds.", nil, operationDurationBuckets, time.Since(start).Seconds())
+	pluginMetricsPusher.pushSoon()
+}
@@ -0,0 +1,46 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRecordSnapshot(t *testing.T) {
+	defer func(registry *metricsRegistry) { pluginMetrics = registry }(pluginMetrics)
+	pluginMetrics = newMetricsRegistry()
+
+	tags := map[string]string{backupNameTag: "daily-20240101", scheduleNameLabel: "daily"}
+	recordSnapshot(tags, time.Now(), nil)
+	recordSnapshot(tags, time.Now(), errors.New("quota exceeded"))
+	recordSnapshotDisk(tags, 10)
+	recordVolumeRestore(time.Now(), nil)
+
+	values := make(map[string]float64)
+	pluginMetrics.each(func(m *metric, s *sample) {
+		values[m.name+labelString(s.labels)] = s.value
+	})
+	assert.Equal(t, 1.0, values[`velero_gcp_snapshots_total{outcome="success",schedule="daily"}`])
+	assert.Equal(t, 1.0, values[`velero_gcp_snapshots_total{outcome="failure",schedule="daily"}`])
+	assert.Equal(t, 2.0, values[`velero_gcp_snapshot_duration_seconds{schedule="daily"}`])
+	assert.Equal(t, 10.0*bytesPerGB, values[`velero_gcp_snapshot_disk_bytes_total{schedule="daily"}`])
+	assert.Equal(t, 1.0, values[`velero_gcp_volume_restores_total{outcome="success"}`])
+}
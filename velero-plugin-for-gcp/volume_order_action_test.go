@@ -0,0 +1,148 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	api "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	"github.com/vmware-tanzu/velero/pkg/plugin/velero"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+
+	velerotest "github.com/vmware-tanzu/velero/pkg/test"
+)
+
+func testPod(name string, phase v1.PodPhase, claims ...string) v1.Pod {
+	pod := v1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "db", Name: name}, Status: v1.PodStatus{Phase: phase}}
+	for _, claim := range claims {
+		pod.Spec.Volumes = append(pod.Spec.Volumes, v1.Volume{
+			Name:         claim,
+			VolumeSource: v1.VolumeSource{PersistentVolumeClaim: &v1.PersistentVolumeClaimVolumeSource{ClaimName: claim}},
+		})
+	}
+	return pod
+}
+
+func testClaim(name, volume string, labels ...string) v1.PersistentVolumeClaim {
+	claim := v1.PersistentVolumeClaim{ObjectMeta: metav1.ObjectMeta{Namespace: "db", Name: name, Labels: make(map[string]string)}, Spec: v1.PersistentVolumeClaimSpec{VolumeName: volume}}
+	for i := 0; i+1 < len(labels); i += 2 {
+		claim.Labels[labels[i]] = labels[i+1]
+	}
+	return claim
+}
+
+func TestVolumeOrderActionExecute(t *testing.T) {
+	claims := []v1.PersistentVolumeClaim{
+		testClaim("data-db-0", "pv-data-0", "app", "db"),
+		testClaim("wal-db-0", "pv-wal-0", "app", "db"),
+		testClaim("cache-db-0", "pv-cache-0"),
+		testClaim("data-db-1", "pv-data-1"),
+		testClaim("wal-db-1", "pv-wal-1"),
+		testClaim("pending", ""),
+		testClaim("scratch", "pv-scratch"),
+	}
+	pods := []v1.Pod{
+		testPod("db-0", v1.PodRunning, "data-db-0", "wal-db-0", "cache-db-0", "pending"),
+		testPod("db-1", v1.PodRunning, "data-db-1", "wal-db-1"),
+		testPod("job", v1.PodSucceeded, "data-db-0", "scratch"),
+	}
+
+	tests := []struct {
+		name     string
+		claimRef *v1.ObjectReference
+		spec     api.BackupSpec
+		readErr  error
+		expected []velero.ResourceIdentifier
+	}{
+		{
+			name:     "volumes of the same replica are backed up next",
+			claimRef: &v1.ObjectReference{Namespace: "db", Name: "data-db-0"},
+			expected: []velero.ResourceIdentifier{
+				{GroupResource: persistentVolumesResource, Name: "pv-cache-0"},
+				{GroupResource: persistentVolumesResource, Name: "pv-wal-0"},
+			},
+		},
+		{
+			name:     "volumes whose claims the backup's label selector doesn't match are not backed up next",
+			claimRef: &v1.ObjectReference{Namespace: "db", Name: "data-db-0"},
+			spec:     api.BackupSpec{LabelSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "db"}}},
+			expected: []velero.ResourceIdentifier{{GroupResource: persistentVolumesResource, Name: "pv-wal-0"}},
+		},
+		{
+			name:     "volumes in namespaces the backup includes are backed up next",
+			claimRef: &v1.ObjectReference{Namespace: "db", Name: "wal-db-1"},
+			spec:     api.BackupSpec{IncludedNamespaces: []string{"shop", "d*"}},
+			expected: []velero.ResourceIdentifier{{GroupResource: persistentVolumesResource, Name: "pv-data-1"}},
+		},
+		{
+			name:     "volumes in namespaces the backup doesn't include are not backed up next",
+			claimRef: &v1.ObjectReference{Namespace: "db", Name: "data-db-0"},
+			spec:     api.BackupSpec{IncludedNamespaces: []string{"shop"}},
+		},
+		{
+			name:     "volumes in namespaces the backup excludes are not backed up next",
+			claimRef: &v1.ObjectReference{Namespace: "db", Name: "data-db-0"},
+			spec:     api.BackupSpec{IncludedNamespaces: []string{"*"}, ExcludedNamespaces: []string{"db"}},
+		},
+		{
+			name:     "volumes of other replicas are not backed up next",
+			claimRef: &v1.ObjectReference{Namespace: "db", Name: "wal-db-1"},
+			expected: []velero.ResourceIdentifier{{GroupResource: persistentVolumesResource, Name: "pv-data-1"}},
+		},
+		{
+			name:     "completed pods are ignored",
+			claimRef: &v1.ObjectReference{Namespace: "db", Name: "scratch"},
+		},
+		{
+			name: "unbound volume",
+		},
+		{
+			name:     "volumes aren't backed up next when pods can't be listed",
+			claimRef: &v1.ObjectReference{Namespace: "db", Name: "data-db-0"},
+			readErr:  errors.New("forbidden"),
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			pv := &v1.PersistentVolume{ObjectMeta: metav1.ObjectMeta{Name: "pv"}, Spec: v1.PersistentVolumeSpec{ClaimRef: test.claimRef}}
+			if test.claimRef != nil {
+				for _, c := range claims {
+					if c.Name == test.claimRef.Name {
+						pv.Name = c.Spec.VolumeName
+					}
+				}
+			}
+			content, err := runtime.DefaultUnstructuredConverter.ToUnstructured(pv)
+			require.NoError(t, err)
+			item := &unstructured.Unstructured{Object: content}
+
+			cluster := &fakeCluster{pods: pods, volumeClaims: claims, err: test.readErr}
+			action := &VolumeOrderAction{log: velerotest.NewLogger(), cluster: cluster}
+			out, additional, err := action.Execute(item, &api.Backup{Spec: test.spec})
+			require.NoError(t, err)
+			assert.Equal(t, item, out)
+			assert.Equal(t, test.expected, additional)
+		})
+	}
+}
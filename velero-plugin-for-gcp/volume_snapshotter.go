@@ -20,23 +20,25 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
-	"io/ioutil"
 	"net/http"
+	"os"
 	"regexp"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	uuid "github.com/gofrs/uuid"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 	"golang.org/x/oauth2/google"
+	"google.golang.org/api/cloudkms/v1"
 	"google.golang.org/api/compute/v1"
-	"google.golang.org/api/googleapi"
-	"google.golang.org/api/option"
+	file "google.golang.org/api/file/v1"
 	v1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime"
-
-	veleroplugin "github.com/vmware-tanzu/velero/pkg/plugin/framework"
 )
 
 const (
@@ -50,58 +52,236 @@ var pdVolRegexp = regexp.MustCompile(`^projects\/[^\/]+\/(zones|regions)\/[^\/]+
 
 type VolumeSnapshotter struct {
 	log              logrus.FieldLogger
-	gce              *compute.Service
+	cluster          veleroCluster
+	secrets          secretSource
+	sleep            func(time.Duration)
 	snapshotLocation string
 	volumeProject    string
 	snapshotProject  string
+	kms              *cloudkms.Service
+	filestore        *file.Service
+	// computeHTTP makes the Compute Engine requests the client library has
+	// no fields for, like creating archive snapshots.
+	computeHTTP *http.Client
+	// backupDRHTTP makes the Backup and DR requests of locations backing up
+	// disks to a backup vault, relative to backupDRBase.
+	backupDRHTTP *http.Client
+	backupDRBase string
+	// config is the location's config, kept to rebuild the client when the
+	// credentials file changes.
+	config             map[string]string
+	credentialsWatcher *credentialsWatcher
+	// manifest records the snapshots taken in the volume manifests of
+	// their backups, if enabled.
+	manifest *volumeManifestWriter
+	// throttle limits the snapshots created at once of the disks of each
+	// instance, if enabled.
+	throttle *instanceSnapshotThrottle
+	// restoreThrottle limits the disks restored at once in each zone, if
+	// enabled.
+	restoreThrottle *zoneRestoreThrottle
+	// quotas warns when the quotas snapshots and restores consume are
+	// nearly exhausted, if enabled.
+	quotas *quotaMonitor
+	// backupForGKE coordinates snapshots with Backup for GKE, if
+	// backupForGKE is set.
+	backupForGKE *backupForGKEGuard
+	// kubeEvents creates Kubernetes Events for snapshots, if enabled.
+	kubeEvents *kubeEventRecorder
+	// journal records the snapshots started until their backups finish, if
+	// enabled.
+	journal *operationJournal
+	// retention keeps snapshots for a minimum time, if configured.
+	retention *snapshotRetention
+	// residency keeps snapshots and restored volumes in the allowed
+	// regions, if allowedRegions is set.
+	residency *residencyPolicy
+	// keyChecks records the backups whose snapshots' Cloud KMS keys were
+	// verified before restoring their volumes.
+	keyChecks restoreKeyChecks
+	// current holds the *snapshotterClients calls use. reloadCredentials
+	// replaces them instead of changing them, so calls in flight keep
+	// using the clients they loaded and don't hold up the reload.
+	current atomic.Value
+	// reload rebuilds the clients when the credentials change.
+	reload clientsReload
+	// lazyClientsLock guards the clients created when first needed.
+	lazyClientsLock sync.Mutex
+	// deferInit lets Init succeed when GCP can't be reached, connecting the
+	// clients when the snapshotter is first used instead. It's set when
+	// serving Velero, whose Init failures last until the pod restarts.
+	deferInit bool
+	// init connects the clients if that was deferred.
+	init *deferredInit
 }
 
 func newVolumeSnapshotter(logger logrus.FieldLogger) *VolumeSnapshotter {
-	return &VolumeSnapshotter{log: logger}
+	return &VolumeSnapshotter{log: logger, cluster: inCluster{}, secrets: platformSecrets{}, sleep: time.Sleep}
 }
 
 func (b *VolumeSnapshotter) Init(config map[string]string) error {
-	if err := veleroplugin.ValidateVolumeSnapshotterConfigKeys(config, snapshotLocationKey, projectKey, credentialsFileConfigKey); err != nil {
+	if err := checkFIPSMode(); err != nil {
+		return err
+	}
+	startTracing(b.log)
+	startCloudMonitoring(b.log)
+
+	if err := validateConfig("VolumeSnapshotLocation", config, []string{
+		snapshotLocationKey,
+		projectKey,
+		credentialsFileConfigKey,
+		credentialsSecretConfigKey,
+		credentialsJSONConfigKey,
+		accessTokenFileConfigKey,
+		endpointsConfigKey,
+		impersonateServiceAccountConfigKey,
+		impersonateDelegatesConfigKey,
+		scopesConfigKey,
+		quotaProjectConfigKey,
+		clientCertificateFileConfigKey,
+		clientKeyFileConfigKey,
+		credentialProfileConfigKey,
+		secretManagerCredentialsConfigKey,
+		fleetMembershipConfigKey,
+		fleetTokenFileConfigKey,
+		fleetServiceAccountConfigKey,
+		filestoreNetworkConfigKey,
+		volumeManifestConfigKey,
+		maxSnapshotsPerInstanceConfigKey,
+		maxRestoresPerZoneConfigKey,
+		pubsubTopicConfigKey,
+		quotaCheckIntervalConfigKey,
+		quotaWarningThresholdConfigKey,
+		kubernetesEventsConfigKey,
+		operationJournalConfigKey,
+		minimumRetentionConfigKey,
+		allowedRegionsConfigKey,
+		archiveSnapshotsAfterConfigKey,
+		budgetSubscriptionConfigKey,
+		budgetThresholdConfigKey,
+		budgetActionConfigKey,
+		orgPolicyChecksConfigKey,
+		drProjectConfigKey,
+		drSnapshotLocationConfigKey,
+		drKMSKeyNameConfigKey,
+		backupForGKEConfigKey,
+		backupForGKENamespacesConfigKey,
+		backupForGKEBackupPlanConfigKey,
+		resourceTagsConfigKey,
+		backupVaultPlanConfigKey,
+		backupVaultRuleConfigKey,
+	}, volumeSnapshotterConfigChecks, credentialsConfigChecks); err != nil {
 		return err
 	}
+	if b.kubeEvents == nil {
+		b.kubeEvents = newKubeEventRecorder(b.log, config, b.cluster)
+	}
+	if b.journal == nil {
+		b.journal = newOperationJournal(b.log, config)
+	}
 
-	clientOptions := []option.ClientOption{
-		option.WithScopes(compute.ComputeScope),
+	retention, err := newSnapshotRetention(config)
+	if err != nil {
+		return err
+	}
+	b.retention = retention
+	if retention != nil && config[backupVaultPlanConfigKey] == "" {
+		b.log.Warnf("%s only labels snapshots with the time they're retained until, which doesn't stop them from being deleted outside the plugin; set %s to store backups in a backup vault that enforces their retention", minimumRetentionConfigKey, backupVaultPlanConfigKey)
 	}
 
-	// Credentials used to connect to GCP compute service.
-	var creds *google.Credentials
-	var err error
+	// snapshots without a storage location are stored in the multi-region
+	// nearest their disk, which may be outside the allowed regions
+	if b.residency = newResidencyPolicy(config); b.residency != nil {
+		if config[snapshotLocationKey] == "" {
+			return errors.Errorf("%s must be set along with %s", snapshotLocationKey, allowedRegionsConfigKey)
+		}
+		if err := b.residency.check(snapshotLocationKey, config[snapshotLocationKey]); err != nil {
+			return err
+		}
+	}
 
-	// If credential is provided for the VSL, use it instead of default credential.
-	if credentialsFile, ok := config[credentialsFileConfigKey]; ok {
-		b, err := ioutil.ReadFile(credentialsFile)
+	if val := config[volumeManifestConfigKey]; val != "" {
+		enabled, err := strconv.ParseBool(val)
 		if err != nil {
-			return errors.Wrapf(err, "error reading provided credentials file %v", credentialsFile)
+			return errors.Wrapf(err, "invalid value %q for %s", val, volumeManifestConfigKey)
+		}
+		if enabled && b.manifest == nil {
+			b.manifest = newVolumeManifestWriter(b.log, b.cluster, b.describeSnapshot)
 		}
+	}
 
-		creds, err = google.CredentialsFromJSON(context.TODO(), b)
-		if err != nil {
-			return errors.WithStack(err)
+	if val := config[maxSnapshotsPerInstanceConfigKey]; val != "" {
+		max, err := strconv.Atoi(val)
+		if err != nil || max < 0 {
+			return errors.Errorf("invalid value %q for %s, expected a non-negative integer", val, maxSnapshotsPerInstanceConfigKey)
 		}
+		if max > 0 {
+			b.throttle = newInstanceSnapshotThrottle(b.log, max, b.snapshotStatus)
+		}
+	}
 
-		// If using a credentials file, we also need to pass it when creating the client.
-		clientOptions = append(clientOptions, option.WithCredentialsFile(credentialsFile))
-	} else {
-		/* Use default credential, when no credential is provisioned in VSL. */
-		creds, err = google.FindDefaultCredentials(context.TODO(), compute.ComputeScope)
-		if err != nil {
-			return errors.WithStack(err)
+	if val := config[maxRestoresPerZoneConfigKey]; val != "" {
+		max, err := strconv.Atoi(val)
+		if err != nil || max < 0 {
+			return errors.Errorf("invalid value %q for %s, expected a non-negative integer", val, maxRestoresPerZoneConfigKey)
+		}
+		if max > 0 {
+			b.restoreThrottle = newZoneRestoreThrottle(b.log, max, b.diskStatus)
 		}
-		clientOptions = append(clientOptions, option.WithTokenSource(creds.TokenSource))
 	}
 
+	b.config = config
+	b.init, err = connectWithRetries(b.log, "volume snapshotter", b.deferInit, b.sleep, func() error {
+		return b.connect(config)
+	})
+	return err
+}
+
+// connect loads the location's credentials and builds its clients, which
+// needs GCP, and for some credentials the metadata server, to be reachable.
+func (b *VolumeSnapshotter) connect(config map[string]string) error {
+	clients, creds, err := b.buildClients(config)
+	if err != nil {
+		return err
+	}
+	b.backupForGKE = newBackupForGKEGuard(b.log, config, b.cluster)
+
 	b.snapshotLocation = config[snapshotLocationKey]
+	if err := b.setProjects(config, creds); err != nil {
+		return err
+	}
+
+	b.useClients(clients)
+	startKeyCheck(b.log, creds.JSON, clients.credentials)
 
+	if err := b.startQuotaMonitor(config); err != nil {
+		return err
+	}
+	b.credentialsWatcher = newCredentialsWatcher(clients.credentials.file,
+		config[clientCertificateFileConfigKey],
+		config[clientKeyFileConfigKey],
+		os.Getenv(credentialProfilesEnvVar),
+	)
+	b.credentialsWatcher.watchVersion(clients.credentials.secretVersion, clients.credentials.secretVersionCheck())
+
+	// deleting the snapshots of interrupted backups doesn't hold up this one
+	go b.journal.recover(b.snapshotProject, b.deleteSnapshot)
+
+	return nil
+}
+
+// setProjects sets the projects of the volumes and snapshots, from the
+// location's config or else its credentials.
+func (b *VolumeSnapshotter) setProjects(config map[string]string, creds *google.Credentials) error {
 	b.volumeProject = config[projectKey]
 	if b.volumeProject == "" {
 		b.volumeProject = creds.ProjectID
 	}
+	if b.volumeProject == "" {
+		// federated (external_account) credentials and access tokens don't
+		// carry a project
+		return errors.Errorf("unable to determine the project from the credentials; %s is expected to be provided as an item in VolumeSnapshotLocation's config", projectKey)
+	}
 
 	// get snapshot project from 'project' config key if specified,
 	// otherwise from the credentials file
@@ -109,17 +289,138 @@ func (b *VolumeSnapshotter) Init(config map[string]string) error {
 	if b.snapshotProject == "" {
 		b.snapshotProject = b.volumeProject
 	}
+	return nil
+}
+
+// snapshotterClients are the credentials of a volume snapshotter and the
+// clients built with them, which are replaced as a whole when the
+// credentials change and aren't changed once in use.
+type snapshotterClients struct {
+	credentials locationCredentials
+	// clientsKey identifies the location's clients in locationClients.
+	clientsKey string
+	gce        *compute.Service
+	// events publishes backup lifecycle events, if a topic is configured.
+	events *eventPublisher
+	// budget throttles scheduled backups while a budget is exceeded, if a
+	// budget subscription is configured.
+	budget *budgetGuard
+	// orgPolicies checks the organization policies snapshots and restores
+	// break, if enabled.
+	orgPolicies *orgPolicyChecker
+	// resourceTags binds tags to created snapshots and restored disks, if
+	// resourceTags is set.
+	resourceTags *resourceTagger
+}
+
+// clients returns the credentials and clients for a call to use.
+func (b *VolumeSnapshotter) clients() *snapshotterClients {
+	if c, ok := b.current.Load().(*snapshotterClients); ok {
+		return c
+	}
+	return &snapshotterClients{}
+}
+
+// buildClients loads the location's credentials and builds the clients
+// using them, without changing the snapshotter. It also returns the
+// credentials found, for the project they carry.
+func (b *VolumeSnapshotter) buildClients(config map[string]string) (*snapshotterClients, *google.Credentials, error) {
+	c := &snapshotterClients{}
+
+	var err error
+	c.credentials, err = newLocationCredentials(b.secrets, config, volumeSnapshotterCredentialsEnvVar)
+	if err != nil {
+		return nil, nil, err
+	}
+	c.events = newEventPublisher(b.log, config, c.credentials)
+	c.budget = newBudgetGuard(b.log, config, c.credentials)
+	c.orgPolicies = newOrgPolicyChecker(b.log, config, c.credentials)
+	c.resourceTags = newResourceTagger(b.log, config, c.credentials)
+
+	scopes := parseScopes(config, compute.ComputeScope)
+
+	// If credential is provided for the VSL, use it instead of default credential.
+	creds, err := c.credentials.find(context.TODO(), scopes...)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	endpoint, err := locationEndpoint(config, b.log)
+	if err != nil {
+		return nil, nil, err
+	}
+	c.clientsKey = locationKey("VolumeSnapshotLocation", config, endpoint, c.credentials)
+	gce, err := locationClients.get(c.clientsKey, computeService, func() (interface{}, error) {
+		return b.newComputeService(withLocationKey(context.TODO(), c.clientsKey), c.credentials, endpoint, scopes)
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	c.gce = gce.(*compute.Service)
+	return c, creds, nil
+}
+
+// useClients replaces the snapshotter's credentials and clients. Calls using
+// the current ones finish with them.
+func (b *VolumeSnapshotter) useClients(c *snapshotterClients) {
+	b.current.Store(c)
+	b.lazyClientsLock.Lock()
+	b.kms = nil
+	b.filestore = nil
+	b.computeHTTP = nil
+	b.backupDRHTTP = nil
+	b.lazyClientsLock.Unlock()
+	if b.quotas != nil {
+		b.quotas.lock.Lock()
+		b.quotas.gce = c.gce
+		b.quotas.lock.Unlock()
+	}
+}
 
-	gce, err := compute.NewService(context.TODO(), clientOptions...)
+// newComputeService builds the location's compute client with the given
+// credentials, routed through the endpoint selected for it.
+func (b *VolumeSnapshotter) newComputeService(ctx context.Context, credentials locationCredentials, endpoint string, scopes []string) (*compute.Service, error) {
+	clientOptions, err := credentials.clientOptions(ctx, scopes...)
 	if err != nil {
-		return errors.WithStack(err)
+		return nil, err
+	}
+	clientOptions = append(clientOptions, endpointOptions(endpoint, "compute/v1/")...)
+	if clientOptions, err = instrumentClientOptions(ctx, b.log, computeService, clientOptions); err != nil {
+		return nil, err
 	}
 
-	b.gce = gce
+	gce, err := compute.NewService(ctx, clientOptions...)
+	return gce, errors.WithStack(err)
+}
 
+// ready connects the clients if that was deferred, and rebuilds them if the
+// credentials changed or their requests failed.
+func (b *VolumeSnapshotter) ready() error {
+	if err := b.init.ensure(); err != nil {
+		return err
+	}
+	b.reloadCredentials()
 	return nil
 }
 
+// reloadCredentials rebuilds the credentials and clients if the credentials
+// changed since they were loaded, or the clients were forgotten because
+// their requests couldn't reach GCP or their credentials were rejected. Only
+// the credentials and clients are rebuilt; the journal recovery, checks and
+// monitors started when the snapshotter connected aren't repeated. If the
+// new credentials can't be loaded, the existing clients are kept, and the
+// rebuild is retried with backoff.
+func (b *VolumeSnapshotter) reloadCredentials() {
+	b.reload.reload(b.log, b.credentialsWatcher, b.clients().clientsKey, func() error {
+		clients, _, err := b.buildClients(b.config)
+		if err != nil {
+			return err
+		}
+		b.useClients(clients)
+		return nil
+	})
+}
+
 // isMultiZone returns true if the failure-domain tag contains
 // double underscore, which is the separator used
 // by GKE when a storage class spans multiple availability
@@ -155,22 +456,73 @@ func (b *VolumeSnapshotter) getZoneURLs(volumeAZ string) ([]string, error) {
 	zones := strings.Split(volumeAZ, zoneSeparator)
 	var zoneURLs []string
 	for _, z := range zones {
-		zone, err := b.gce.Zones.Get(b.volumeProject, z).Do()
+		zoneURL, err := computeLookups.zoneURL(b.volumeProject, z, func() (zone *compute.Zone, err error) {
+			err = retryTransient(b.sleep, func() (err error) {
+				zone, err = b.clients().gce.Zones.Get(b.volumeProject, z).Do()
+				return err
+			})
+			return zone, err
+		})
 		if err != nil {
 			return nil, errors.WithStack(err)
 		}
 
-		zoneURLs = append(zoneURLs, zone.SelfLink)
+		zoneURLs = append(zoneURLs, zoneURL)
 	}
 
 	return zoneURLs, nil
 }
 
-func (b *VolumeSnapshotter) CreateVolumeFromSnapshot(snapshotID, volumeType, volumeAZ string, iops *int64) (volumeID string, err error) {
+func (b *VolumeSnapshotter) CreateVolumeFromSnapshot(snapshotID, volumeType, volumeAZ string, iops *int64) (string, error) {
+	if err := b.ready(); err != nil {
+		return "", reportError(volumeSnapshotterComponent, "CreateVolumeFromSnapshot", err)
+	}
+
+	if region, err := parseRegion(volumeAZ); err == nil && !isFilestoreBackup(snapshotID) && !isBackupForGKEReference(snapshotID) && !isBackupVaultBackup(snapshotID) {
+		b.quotas.check(b.log, "restore", quotaScope{project: b.volumeProject, region: region})
+	}
+
+	start := time.Now()
+	span := startSpan("compute.CreateVolumeFromSnapshot", spanKindInternal, map[string]string{
+		"gcp.snapshot": snapshotID,
+		"gcp.zone":     volumeAZ,
+	})
+	volumeID, err := b.createVolumeFromSnapshot(snapshotID, volumeType, volumeAZ)
+	span.setAttribute("gcp.volume", volumeID)
+	span.finish(err)
+	recordVolumeRestore(start, err)
+	return volumeID, reportError(volumeSnapshotterComponent, "CreateVolumeFromSnapshot", err)
+}
+
+func (b *VolumeSnapshotter) createVolumeFromSnapshot(snapshotID, volumeType, volumeAZ string) (string, error) {
+	if isBackupForGKEReference(snapshotID) {
+		return "", b.backupForGKERestoreError(snapshotID)
+	}
+	if isFilestoreBackup(snapshotID) {
+		return b.createFilestoreInstance(snapshotID)
+	}
+	if isBackupVaultBackup(snapshotID) {
+		return b.createDiskFromVaultBackup(snapshotID, volumeType, volumeAZ)
+	}
+	for _, zone := range strings.Split(volumeAZ, zoneSeparator) {
+		if err := b.residency.check("zone of restored volume", zone); err != nil {
+			return "", err
+		}
+	}
+
 	// get the snapshot so we can apply its tags to the volume
-	res, err := b.gce.Snapshots.Get(b.snapshotProject, snapshotID).Do()
+	var res *compute.Snapshot
+	err := retryTransient(b.sleep, func() (err error) {
+		res, err = b.getSnapshot(b.snapshotProject, snapshotID)
+		return err
+	})
 	if err != nil {
-		return "", errors.WithStack(err)
+		return "", b.checkSnapshotTiering(snapshotID, errors.WithStack(err))
+	}
+	b.logSnapshotTier(res)
+
+	if err := b.verifyRestoreKMSKeys(res); err != nil {
+		return "", err
 	}
 
 	// Kubernetes uses the description field of GCP disks to store a JSON doc containing
@@ -187,6 +539,16 @@ func (b *VolumeSnapshotter) CreateVolumeFromSnapshot(snapshotID, volumeType, vol
 		SourceSnapshot: res.SelfLink,
 		Type:           volumeType,
 		Description:    res.Description,
+		Labels:         restoreArtifactLabels(res.Labels),
+	}
+
+	// the cluster may have no nodes in some of the zones a regional disk
+	// was replicated to
+	if isMultiZone(volumeAZ) {
+		volumeAZ = b.restoreZones(volumeAZ)
+	}
+	if err := b.checkRestoreOrgPolicies(res, strings.Split(volumeAZ, zoneSeparator)); err != nil {
+		return "", err
 	}
 
 	if isMultiZone(volumeAZ) {
@@ -203,43 +565,140 @@ func (b *VolumeSnapshotter) CreateVolumeFromSnapshot(snapshotID, volumeType, vol
 
 		disk.ReplicaZones = zoneURLs
 
-		if _, err = b.gce.RegionDisks.Insert(b.volumeProject, volumeRegion, disk).Do(); err != nil {
+		zones := strings.Split(volumeAZ, zoneSeparator)
+		b.restoreThrottle.wait(zones)
+		call := b.clients().gce.RegionDisks.Insert(b.volumeProject, volumeRegion, disk)
+		setRequestReason(call, snapshotBackupReason(res.Description))
+		if _, err = call.Do(); err != nil {
 			return "", errors.WithStack(err)
 		}
+		ref := diskRef{project: b.volumeProject, location: volumeRegion, name: disk.Name, regional: true}
+		b.restoreThrottle.started(zones, ref)
+		b.bindDiskTags(ref, snapshotBackupReason(res.Description))
 	} else {
-		if _, err = b.gce.Disks.Insert(b.volumeProject, volumeAZ, disk).Do(); err != nil {
+		b.restoreThrottle.wait([]string{volumeAZ})
+		call := b.clients().gce.Disks.Insert(b.volumeProject, volumeAZ, disk)
+		setRequestReason(call, snapshotBackupReason(res.Description))
+		if _, err = call.Do(); err != nil {
 			return "", errors.WithStack(err)
 		}
+		ref := diskRef{project: b.volumeProject, location: volumeAZ, name: disk.Name}
+		b.restoreThrottle.started([]string{volumeAZ}, ref)
+		b.bindDiskTags(ref, snapshotBackupReason(res.Description))
 	}
 
 	return disk.Name, nil
 }
 
 func (b *VolumeSnapshotter) GetVolumeInfo(volumeID, volumeAZ string) (string, *int64, error) {
-	var (
-		res *compute.Disk
-		err error
-	)
+	if err := b.ready(); err != nil {
+		return "", nil, reportError(volumeSnapshotterComponent, "GetVolumeInfo", err)
+	}
+
+	if isFilestoreVolume(volumeID) {
+		return "", nil, nil
+	}
 
+	ref := diskRef{project: b.volumeProject, location: volumeAZ, name: volumeID}
 	if isMultiZone(volumeAZ) {
 		volumeRegion, err := parseRegion(volumeAZ)
 		if err != nil {
 			return "", nil, errors.WithStack(err)
 		}
-		res, err = b.gce.RegionDisks.Get(b.volumeProject, volumeRegion, volumeID).Do()
-		if err != nil {
-			return "", nil, errors.WithStack(err)
-		}
-	} else {
-		res, err = b.gce.Disks.Get(b.volumeProject, volumeAZ, volumeID).Do()
-		if err != nil {
-			return "", nil, errors.WithStack(err)
-		}
+		ref.location, ref.regional = volumeRegion, true
+	}
+	res, err := b.getDisk(ref)
+	if err != nil {
+		return "", nil, reportError(volumeSnapshotterComponent, "GetVolumeInfo", errors.WithStack(err))
 	}
 	return res.Type, nil, nil
 }
 
+// getDisk reads a disk, or returns it from the cache if it was read or
+// listed moments ago for the same backup.
+func (b *VolumeSnapshotter) getDisk(ref diskRef) (*compute.Disk, error) {
+	list := func(project string) (disks map[diskRef]*compute.Disk, err error) {
+		err = retryTransient(b.sleep, func() (err error) {
+			disks, err = listProjectDisks(context.Background(), b.clients().gce, project)
+			return err
+		})
+		return disks, err
+	}
+	return computeLookups.disk(ref, list, func() (disk *compute.Disk, err error) {
+		err = retryTransient(b.sleep, func() (err error) {
+			if ref.regional {
+				disk, err = b.clients().gce.RegionDisks.Get(ref.project, ref.location, ref.name).Do()
+			} else {
+				disk, err = b.clients().gce.Disks.Get(ref.project, ref.location, ref.name).Do()
+			}
+			return err
+		})
+		return disk, err
+	})
+}
+
 func (b *VolumeSnapshotter) CreateSnapshot(volumeID, volumeAZ string, tags map[string]string) (string, error) {
+	if err := b.ready(); err != nil {
+		return "", reportError(volumeSnapshotterComponent, "CreateSnapshot", err)
+	}
+
+	if !isFilestoreVolume(volumeID) {
+		b.quotas.check(b.log, tags[backupNameTag], quotaScope{project: b.snapshotProject})
+	}
+
+	b.snapshotEvent(tags, v1.EventTypeNormal, snapshotStartedReason, fmt.Sprintf("Creating snapshot of volume %s", volumeID))
+
+	start := time.Now()
+	span := startSpan("compute.CreateSnapshot", spanKindInternal, map[string]string{
+		"gcp.volume":        volumeID,
+		"gcp.zone":          volumeAZ,
+		backupNameAttribute: tags[backupNameTag],
+	})
+	snapshotID, err := b.createVolumeSnapshot(volumeID, volumeAZ, tags)
+	span.setAttribute("gcp.snapshot", snapshotID)
+	span.finish(err)
+	recordSnapshot(tags, start, err)
+	if err != nil {
+		err = reportError(volumeSnapshotterComponent, "CreateSnapshot", err)
+		b.snapshotEvent(tags, v1.EventTypeWarning, snapshotFailedReason, fmt.Sprintf("Error creating snapshot of volume %s: %v", volumeID, err))
+		return "", err
+	}
+	b.snapshotEvent(tags, v1.EventTypeNormal, snapshotCompletedReason, fmt.Sprintf("Created snapshot %s of volume %s in %s", snapshotID, volumeID, time.Since(start).Round(time.Second)))
+	b.manifest.record(b.manifestVolume(volumeID, volumeAZ), b.manifestSnapshot(snapshotID), tags, time.Since(start))
+	b.clients().events.publish(backupEvent{
+		Type:     snapshotCreatedEvent,
+		Backup:   tags[backupNameTag],
+		Schedule: tags[scheduleNameLabel],
+		Snapshot: snapshotID,
+		Volume:   volumeID,
+		Zone:     volumeAZ,
+		Project:  b.snapshotProject,
+	})
+	return snapshotID, nil
+}
+
+// snapshotEvent records a snapshot's event on its backup and on the claim of
+// its persistent volume.
+func (b *VolumeSnapshotter) snapshotEvent(tags map[string]string, eventType, reason, message string) {
+	b.kubeEvents.backup(tags[backupNameTag], eventType, reason, message)
+	b.kubeEvents.volume(tags[pvNameTag], eventType, reason, message)
+}
+
+func (b *VolumeSnapshotter) createVolumeSnapshot(volumeID, volumeAZ string, tags map[string]string) (string, error) {
+	if reference, err := b.backupForGKEReference(volumeID, tags); err != nil || reference != "" {
+		return reference, err
+	}
+	archive, err := b.budgetThrottle(volumeID, tags)
+	if err != nil {
+		return "", err
+	}
+	if isFilestoreVolume(volumeID) {
+		return b.createFilestoreBackup(volumeID, tags)
+	}
+	if b.config[backupVaultPlanConfigKey] != "" {
+		return b.createBackupVaultBackup(volumeID, volumeAZ, tags)
+	}
+
 	// snapshot names must adhere to RFC1035 and be 1-63 characters
 	// long
 	var snapshotName string
@@ -260,54 +719,92 @@ func (b *VolumeSnapshotter) CreateSnapshot(volumeID, volumeAZ string, tags map[s
 		if err != nil {
 			return "", errors.WithStack(err)
 		}
-		return b.createRegionSnapshot(snapshotName, volumeID, volumeRegion, tags)
+		return b.createRegionSnapshot(snapshotName, volumeID, volumeRegion, tags, archive)
 	} else {
-		return b.createSnapshot(snapshotName, volumeID, volumeAZ, tags)
+		return b.createSnapshot(snapshotName, volumeID, volumeAZ, tags, archive)
 	}
 }
 
-func (b *VolumeSnapshotter) createSnapshot(snapshotName, volumeID, volumeAZ string, tags map[string]string) (string, error) {
-	disk, err := b.gce.Disks.Get(b.volumeProject, volumeAZ, volumeID).Do()
+func (b *VolumeSnapshotter) createSnapshot(snapshotName, volumeID, volumeAZ string, tags map[string]string, archive bool) (string, error) {
+	disk, err := b.getDisk(diskRef{project: b.volumeProject, location: volumeAZ, name: volumeID})
 	if err != nil {
 		return "", errors.WithStack(err)
 	}
+	if err := b.checkSnapshotResidency(disk); err != nil {
+		return "", err
+	}
+	if err := b.checkSnapshotOrgPolicies(disk); err != nil {
+		return "", err
+	}
 
 	gceSnap := compute.Snapshot{
 		Name:        snapshotName,
-		Description: getSnapshotTags(tags, disk.Description, b.log),
+		Description: getSnapshotTags(withKMSKeyVersionTag(tags, disk), disk.Description, b.log),
+		Labels:      b.retention.label(snapshotLabels(tags)),
 	}
 
 	if b.snapshotLocation != "" {
 		gceSnap.StorageLocations = []string{b.snapshotLocation}
 	}
 
-	_, err = b.gce.Disks.CreateSnapshot(b.snapshotProject, volumeAZ, volumeID, &gceSnap).Do()
+	b.throttle.wait(disk.Users)
+	var op *compute.Operation
+	if archive {
+		op, err = b.createArchiveSnapshot("zones", volumeAZ, volumeID, &gceSnap, requestReason(backupOperation, tags[backupNameTag]))
+	} else {
+		call := b.clients().gce.Disks.CreateSnapshot(b.snapshotProject, volumeAZ, volumeID, &gceSnap)
+		setRequestReason(call, requestReason(backupOperation, tags[backupNameTag]))
+		op, err = call.Do()
+	}
 	if err != nil {
 		return "", errors.WithStack(err)
 	}
+	b.journal.record(gceSnap.Name, op.Name, b.snapshotProject, tags)
+	b.throttle.started(disk.Users, gceSnap.Name)
+	b.bindSnapshotTags(gceSnap.Name, tags)
+	recordSnapshotDisk(tags, disk.SizeGb)
 
 	return gceSnap.Name, nil
 }
 
-func (b *VolumeSnapshotter) createRegionSnapshot(snapshotName, volumeID, volumeRegion string, tags map[string]string) (string, error) {
-	disk, err := b.gce.RegionDisks.Get(b.volumeProject, volumeRegion, volumeID).Do()
+func (b *VolumeSnapshotter) createRegionSnapshot(snapshotName, volumeID, volumeRegion string, tags map[string]string, archive bool) (string, error) {
+	disk, err := b.getDisk(diskRef{project: b.volumeProject, location: volumeRegion, name: volumeID, regional: true})
 	if err != nil {
 		return "", errors.WithStack(err)
 	}
+	if err := b.checkSnapshotResidency(disk); err != nil {
+		return "", err
+	}
+	if err := b.checkSnapshotOrgPolicies(disk); err != nil {
+		return "", err
+	}
 
 	gceSnap := compute.Snapshot{
 		Name:        snapshotName,
-		Description: getSnapshotTags(tags, disk.Description, b.log),
+		Description: getSnapshotTags(withKMSKeyVersionTag(tags, disk), disk.Description, b.log),
+		Labels:      b.retention.label(snapshotLabels(tags)),
 	}
 
 	if b.snapshotLocation != "" {
 		gceSnap.StorageLocations = []string{b.snapshotLocation}
 	}
 
-	_, err = b.gce.RegionDisks.CreateSnapshot(b.snapshotProject, volumeRegion, volumeID, &gceSnap).Do()
+	b.throttle.wait(disk.Users)
+	var op *compute.Operation
+	if archive {
+		op, err = b.createArchiveSnapshot("regions", volumeRegion, volumeID, &gceSnap, requestReason(backupOperation, tags[backupNameTag]))
+	} else {
+		call := b.clients().gce.RegionDisks.CreateSnapshot(b.snapshotProject, volumeRegion, volumeID, &gceSnap)
+		setRequestReason(call, requestReason(backupOperation, tags[backupNameTag]))
+		op, err = call.Do()
+	}
 	if err != nil {
 		return "", errors.WithStack(err)
 	}
+	b.journal.record(gceSnap.Name, op.Name, b.snapshotProject, tags)
+	b.throttle.started(disk.Users, gceSnap.Name)
+	b.bindSnapshotTags(gceSnap.Name, tags)
+	recordSnapshotDisk(tags, disk.SizeGb)
 
 	return gceSnap.Name, nil
 }
@@ -350,22 +847,101 @@ func getSnapshotTags(veleroTags map[string]string, diskDescription string, log l
 	return string(tagsJSON)
 }
 
-func (b *VolumeSnapshotter) DeleteSnapshot(snapshotID string) error {
+// withKMSKeyVersionTag returns a copy of tags that also records the Cloud KMS
+// key version encrypting the disk, if any, so it can be verified at restore.
+func withKMSKeyVersionTag(tags map[string]string, disk *compute.Disk) map[string]string {
+	if disk.DiskEncryptionKey == nil || disk.DiskEncryptionKey.KmsKeyName == "" {
+		return tags
+	}
 
-	_, err := b.gce.Snapshots.Delete(b.snapshotProject, snapshotID).Do()
+	res := make(map[string]string, len(tags)+1)
+	for k, v := range tags {
+		res[k] = v
+	}
+	res[kmsKeyVersionTag] = disk.DiskEncryptionKey.KmsKeyName
+	return res
+}
 
-	// if it's a 404 (not found) error, we don't need to return an error
-	// since the snapshot is not there.
-	if gcpErr, ok := err.(*googleapi.Error); ok && gcpErr.Code == http.StatusNotFound {
+// verifySnapshotKMSKey checks that the Cloud KMS key protecting the snapshot,
+// either set on the snapshot itself or recorded in its tags at backup time,
+// is still usable so restores fail with an actionable error instead of a
+// generic one from the disk insert. Disks are decrypted by the Compute Engine
+// service agent, not the plugin's service account, so keys that can't be
+// read are only logged and the restore goes on.
+func (b *VolumeSnapshotter) verifySnapshotKMSKey(snapshot *compute.Snapshot) error {
+	keyName := snapshotKMSKey(snapshot)
+	if keyName == "" {
 		return nil
 	}
-	if err != nil {
-		return errors.WithStack(err)
+
+	kms, err := b.kmsClient()
+	if err == nil {
+		err = verifyKMSKey(kms, keyName)
 	}
+	if err != nil && !isKMSKeyUnusable(err) {
+		b.log.WithError(err).WithField("snapshot", snapshot.Name).Warnf("Unable to verify Cloud KMS key %s before restoring from the snapshot", keyName)
+		return nil
+	}
+	return errors.Wrapf(err, "unable to restore from snapshot %s", snapshot.Name)
+}
 
+func (b *VolumeSnapshotter) DeleteSnapshot(snapshotID string) error {
+	if err := b.ready(); err != nil {
+		return reportError(volumeSnapshotterComponent, "DeleteSnapshot", err)
+	}
+
+	deleted, err := b.deleteSnapshot(snapshotID)
+	if err != nil {
+		return reportError(volumeSnapshotterComponent, "DeleteSnapshot", err)
+	}
+	if deleted {
+		b.clients().events.publish(backupEvent{
+			Type:     snapshotDeletedEvent,
+			Snapshot: snapshotID,
+			Project:  b.snapshotProject,
+		})
+	}
 	return nil
 }
 
+// deleteSnapshot deletes a snapshot, Filestore backup or backup vault
+// backup, and reports whether it existed.
+func (b *VolumeSnapshotter) deleteSnapshot(snapshotID string) (bool, error) {
+	if isBackupForGKEReference(snapshotID) {
+		// Backup for GKE deletes its backups by their plan's retention
+		return false, nil
+	}
+	if isFilestoreBackup(snapshotID) {
+		return b.deleteFilestoreBackup(snapshotID, "")
+	}
+	if isBackupVaultBackup(snapshotID) {
+		return b.deleteVaultBackup(snapshotID)
+	}
+	if err := b.checkSnapshotRetention(snapshotID); err != nil {
+		return false, err
+	}
+
+	// a snapshot moved to archive storage is deleted by the name of its
+	// archive snapshot
+	for _, name := range []string{snapshotID, archiveSnapshotName(snapshotID)} {
+		err := retryTransient(b.sleep, func() error {
+			_, err := b.clients().gce.Snapshots.Delete(b.snapshotProject, name).Do()
+			return err
+		})
+
+		// if it's a 404 (not found) error, we don't need to return an error
+		// since the snapshot is not there.
+		if isNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return false, errors.WithStack(err)
+		}
+		return true, nil
+	}
+	return false, nil
+}
+
 func (b *VolumeSnapshotter) GetVolumeID(unstructuredPV runtime.Unstructured) (string, error) {
 	pv := new(v1.PersistentVolume)
 	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(unstructuredPV.UnstructuredContent(), pv); err != nil {
@@ -383,6 +959,14 @@ func (b *VolumeSnapshotter) GetVolumeID(unstructuredPV runtime.Unstructured) (st
 			l := strings.Split(handle, "/")
 			return l[len(l)-1], nil
 		}
+		if driver == filestoreCSIDriver {
+			handle := pv.Spec.CSI.VolumeHandle
+			if !isFilestoreVolume(handle) {
+				return "", fmt.Errorf("invalid volumeHandle for CSI driver:%s, expected modeInstance/{location}/{instance}/{share}, got %s",
+					filestoreCSIDriver, handle)
+			}
+			return handle, nil
+		}
 		b.log.Infof("Unable to handle CSI driver: %s", driver)
 	}
 
@@ -412,6 +996,10 @@ func (b *VolumeSnapshotter) SetVolumeID(unstructuredPV runtime.Unstructured, vol
 					pdCSIDriver, handle)
 			}
 			pv.Spec.CSI.VolumeHandle = handle[:strings.LastIndex(handle, "/")+1] + volumeID
+		} else if driver == filestoreCSIDriver {
+			if err := b.setFilestoreVolumeID(pv, volumeID); err != nil {
+				return nil, err
+			}
 		} else {
 			return nil, fmt.Errorf("unable to handle CSI driver: %s", driver)
 		}
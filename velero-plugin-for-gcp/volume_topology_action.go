@@ -0,0 +1,167 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"reflect"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/vmware-tanzu/velero/pkg/plugin/framework"
+	"github.com/vmware-tanzu/velero/pkg/plugin/velero"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+const volumeTopologyActionName = "velero.io/gcp-volume-topology"
+
+// topologyLabels maps the deprecated topology labels to their current
+// equivalents.
+var topologyLabels = map[string]string{
+	betaZoneLabel:   zoneLabel,
+	betaRegionLabel: regionLabel,
+}
+
+// VolumeTopologyAction is a restore item action that rewrites the node
+// affinity of persistent volumes using the deprecated
+// failure-domain.beta.kubernetes.io labels, which nodes of newer clusters
+// don't have, to the topology.kubernetes.io labels, and moves their zones to
+// other regions and zones according to a configured mapping.
+type VolumeTopologyAction struct {
+	log     logrus.FieldLogger
+	cluster veleroCluster
+
+	once      sync.Once
+	mapping   regionMapping
+	configErr error
+}
+
+func newVolumeTopologyAction(logger logrus.FieldLogger) (interface{}, error) {
+	return &VolumeTopologyAction{log: logger, cluster: inCluster{}}, nil
+}
+
+func (a *VolumeTopologyAction) AppliesTo() (velero.ResourceSelector, error) {
+	return velero.ResourceSelector{
+		IncludedResources: []string{"persistentvolumes"},
+	}, nil
+}
+
+func (a *VolumeTopologyAction) loadConfig() (regionMapping, error) {
+	a.once.Do(func() {
+		var data map[string]string
+		data, a.configErr = a.cluster.pluginConfig(framework.PluginKindRestoreItemAction, volumeTopologyActionName)
+		if a.configErr != nil {
+			return
+		}
+		a.mapping, a.configErr = parseRegionMapping(data, volumeTopologyActionName)
+	})
+	return a.mapping, a.configErr
+}
+
+func (a *VolumeTopologyAction) Execute(input *velero.RestoreItemActionExecuteInput) (*velero.RestoreItemActionExecuteOutput, error) {
+	mapping, err := a.loadConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	pv := new(v1.PersistentVolume)
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(input.Item.UnstructuredContent(), pv); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	log := a.log.WithField("persistentVolume", pv.Name)
+
+	// disks restored from snapshots are created in the zones they were
+	// backed up in, so only volumes whose disks were moved otherwise can
+	// be moved to other zones
+	if !mapping.empty() && input.ItemFromBackup != nil {
+		backedUp := new(v1.PersistentVolume)
+		if err := runtime.DefaultUnstructuredConverter.FromUnstructured(input.ItemFromBackup.UnstructuredContent(), backedUp); err != nil {
+			return nil, errors.WithStack(err)
+		}
+		if pvVolumeID(pv) != pvVolumeID(backedUp) {
+			log.Info("Not moving the volume to other zones since its disk was restored from a snapshot in its original zones")
+			mapping = regionMapping{}
+		}
+	}
+
+	original := pv.DeepCopy()
+	modernizeVolumeTopology(pv, mapping)
+	if reflect.DeepEqual(original, pv) {
+		return velero.NewRestoreItemActionExecuteOutput(input.Item), nil
+	}
+	log.Info("Updated the topology labels and zones of the volume's node affinity")
+
+	res, err := runtime.DefaultUnstructuredConverter.ToUnstructured(pv)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return velero.NewRestoreItemActionExecuteOutput(&unstructured.Unstructured{Object: res}), nil
+}
+
+// pvVolumeID returns the disk or volume handle of a persistent volume.
+func pvVolumeID(pv *v1.PersistentVolume) string {
+	switch {
+	case pv.Spec.CSI != nil:
+		return pv.Spec.CSI.VolumeHandle
+	case pv.Spec.GCEPersistentDisk != nil:
+		return pv.Spec.GCEPersistentDisk.PDName
+	}
+	return ""
+}
+
+// modernizeVolumeTopology replaces deprecated topology labels in the node
+// affinity of a persistent volume and maps its zones and regions, in its
+// node affinity and labels.
+func modernizeVolumeTopology(pv *v1.PersistentVolume, mapping regionMapping) {
+	if pv.Spec.NodeAffinity != nil && pv.Spec.NodeAffinity.Required != nil {
+		for i := range pv.Spec.NodeAffinity.Required.NodeSelectorTerms {
+			term := &pv.Spec.NodeAffinity.Required.NodeSelectorTerms[i]
+			for j := range term.MatchExpressions {
+				requirement := &term.MatchExpressions[j]
+				if key, ok := topologyLabels[requirement.Key]; ok {
+					requirement.Key = key
+				}
+				for k, value := range requirement.Values {
+					requirement.Values[k] = mapTopologyValue(mapping, requirement.Key, value)
+				}
+			}
+		}
+	}
+
+	for key, value := range pv.Labels {
+		pv.Labels[key] = mapTopologyValue(mapping, key, value)
+	}
+}
+
+// mapTopologyValue maps the value of a topology label, which for zones of
+// regional disks lists several zones.
+func mapTopologyValue(mapping regionMapping, key, value string) string {
+	switch key {
+	case zoneLabel, betaZoneLabel, gkeZoneLabel:
+		zones := strings.Split(value, zoneSeparator)
+		for i, zone := range zones {
+			zones[i] = mapping.zone(zone)
+		}
+		return strings.Join(zones, zoneSeparator)
+	case regionLabel, betaRegionLabel:
+		return mapping.region(value)
+	}
+	return value
+}
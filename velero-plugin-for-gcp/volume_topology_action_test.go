@@ -0,0 +1,105 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vmware-tanzu/velero/pkg/plugin/velero"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+
+	velerotest "github.com/vmware-tanzu/velero/pkg/test"
+)
+
+func TestVolumeTopologyActionExecute(t *testing.T) {
+	affinity := func(key string, zones ...string) *v1.VolumeNodeAffinity {
+		return &v1.VolumeNodeAffinity{Required: &v1.NodeSelector{NodeSelectorTerms: []v1.NodeSelectorTerm{{
+			MatchExpressions: []v1.NodeSelectorRequirement{{Key: key, Operator: v1.NodeSelectorOpIn, Values: zones}},
+		}}}}
+	}
+	newPV := func(disk, zone, key string) *v1.PersistentVolume {
+		return &v1.PersistentVolume{
+			ObjectMeta: metav1.ObjectMeta{Name: "pv", Labels: map[string]string{betaZoneLabel: zone, betaRegionLabel: "us-central1"}},
+			Spec: v1.PersistentVolumeSpec{
+				PersistentVolumeSource: v1.PersistentVolumeSource{GCEPersistentDisk: &v1.GCEPersistentDiskVolumeSource{PDName: disk}},
+				NodeAffinity:           affinity(key, zone),
+			},
+		}
+	}
+
+	tests := []struct {
+		name     string
+		config   map[string]string
+		backedUp *v1.PersistentVolume
+		restored *v1.PersistentVolume
+		expected *v1.PersistentVolume
+	}{
+		{
+			name:     "deprecated labels are replaced",
+			backedUp: newPV("disk", "us-central1-a", betaZoneLabel),
+			restored: newPV("disk", "us-central1-a", betaZoneLabel),
+			expected: newPV("disk", "us-central1-a", zoneLabel),
+		},
+		{
+			name:     "zones are mapped",
+			config:   map[string]string{regionsConfigKey: "us-central1: europe-west1"},
+			backedUp: newPV("disk", "us-central1-a__us-central1-b", betaZoneLabel),
+			restored: newPV("disk", "us-central1-a__us-central1-b", betaZoneLabel),
+			expected: func() *v1.PersistentVolume {
+				pv := newPV("disk", "europe-west1-a__europe-west1-b", zoneLabel)
+				pv.Labels[betaRegionLabel] = "europe-west1"
+				return pv
+			}(),
+		},
+		{
+			name:     "volumes restored from snapshots keep their zones",
+			config:   map[string]string{zonesConfigKey: "us-central1-a: us-central1-f"},
+			backedUp: newPV("disk", "us-central1-a", betaZoneLabel),
+			restored: newPV("restore-123", "us-central1-a", betaZoneLabel),
+			expected: newPV("restore-123", "us-central1-a", zoneLabel),
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			toUnstructured := func(pv *v1.PersistentVolume) *unstructured.Unstructured {
+				content, err := runtime.DefaultUnstructuredConverter.ToUnstructured(pv)
+				require.NoError(t, err)
+				return &unstructured.Unstructured{Object: content}
+			}
+
+			action := &VolumeTopologyAction{
+				log:     velerotest.NewLogger(),
+				cluster: &fakeCluster{configs: map[string]map[string]string{volumeTopologyActionName: test.config}},
+			}
+			out, err := action.Execute(&velero.RestoreItemActionExecuteInput{
+				Item:           toUnstructured(test.restored),
+				ItemFromBackup: toUnstructured(test.backedUp),
+			})
+			require.NoError(t, err)
+
+			restored := new(v1.PersistentVolume)
+			require.NoError(t, runtime.DefaultUnstructuredConverter.FromUnstructured(out.UpdatedItem.UnstructuredContent(), restored))
+			assert.Equal(t, test.expected, restored)
+		})
+	}
+}